@@ -7,8 +7,13 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/private"
 	"code.gitea.io/gitea/modules/setting"
 
 	"github.com/urfave/cli"
@@ -24,6 +29,8 @@ to make automatic initialization process more smoothly`,
 		Subcommands: []cli.Command{
 			subcmdCreateUser,
 			subcmdChangePassword,
+			subcmdSendMail,
+			subcmdMail,
 		},
 	}
 
@@ -76,6 +83,72 @@ to make automatic initialization process more smoothly`,
 			},
 		},
 	}
+
+	subcmdSendMail = cli.Command{
+		Name:   "sendmail",
+		Usage:  "Send a test email to verify the mail settings",
+		Action: runSendMail,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "to",
+				Value: "",
+				Usage: "Email address to send the test email to",
+			},
+			cli.StringFlag{
+				Name:  "config, c",
+				Value: "custom/conf/app.ini",
+				Usage: "Custom configuration file path",
+			},
+		},
+	}
+
+	subcmdMail = cli.Command{
+		Name:  "mail",
+		Usage: "Manage the mail queue of the running server",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the queued mails and the dead letters",
+				Action: runMailList,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config, c",
+						Value: "custom/conf/app.ini",
+						Usage: "Custom configuration file path",
+					},
+				},
+			},
+			{
+				Name:   "flush",
+				Usage:  "Send all queued mails now, also those scheduled or waiting for a retry",
+				Action: runMailFlush,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "dead-letters",
+						Usage: "Move all dead letters back into the queue as well",
+					},
+					cli.StringFlag{
+						Name:  "config, c",
+						Value: "custom/conf/app.ini",
+						Usage: "Custom configuration file path",
+					},
+				},
+			},
+			{
+				Name:      "retry",
+				Usage:     "Move a dead letter back into the queue",
+				ArgsUsage: "<id>",
+				Action:    runMailRetry,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config, c",
+						Value: "custom/conf/app.ini",
+						Usage: "Custom configuration file path",
+					},
+				},
+			},
+		},
+	}
 )
 
 func runChangePassword(c *cli.Context) error {
@@ -145,3 +218,103 @@ func runCreateUser(c *cli.Context) error {
 	fmt.Printf("New user '%s' has been successfully created!\n", c.String("name"))
 	return nil
 }
+
+func runSendMail(c *cli.Context) error {
+	if !c.IsSet("to") {
+		return fmt.Errorf("Email is not specified")
+	}
+
+	if c.IsSet("config") {
+		setting.CustomConf = c.String("config")
+	}
+
+	setting.NewContext()
+	setting.NewServices()
+
+	// The transcript shows the dialogue with the mail server, also if sending failed.
+	transcript, err := models.SendTestMail(c.String("to"))
+	fmt.Print(transcript)
+	if err != nil {
+		return fmt.Errorf("SendTestMail: %v", err)
+	}
+	return nil
+}
+
+func runMailList(c *cli.Context) error {
+	if c.IsSet("config") {
+		setting.CustomConf = c.String("config")
+	}
+
+	setting.NewContext()
+
+	queue, err := private.GetMailQueue()
+	if err != nil {
+		return fmt.Errorf("GetMailQueue: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "%d queued mails:\n", len(queue.Pending))
+	if len(queue.Pending) > 0 {
+		fmt.Fprintln(w, "ID\tTo\tSubject\tQueued\tAttempts\tLast error")
+	}
+	for _, pm := range queue.Pending {
+		queued := pm.Queued.Format("2006-01-02 15:04:05")
+		if pm.Sending {
+			queued += " (sending)"
+		} else if !pm.Scheduled.IsZero() {
+			queued += " (scheduled " + pm.Scheduled.Format("2006-01-02 15:04:05") + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", pm.ID, strings.Join(pm.To, ", "), pm.Subject, queued, pm.Attempts, pm.Error)
+	}
+
+	fmt.Fprintf(w, "\n%d dead letters:\n", len(queue.DeadLetters))
+	if len(queue.DeadLetters) > 0 {
+		fmt.Fprintln(w, "ID\tTo\tSubject\tFailed\tAttempts\tError")
+	}
+	for _, dl := range queue.DeadLetters {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", dl.ID, strings.Join(dl.To, ", "), dl.Subject, dl.Failed.Format("2006-01-02 15:04:05"), dl.Attempts, dl.Error)
+	}
+	return w.Flush()
+}
+
+func runMailFlush(c *cli.Context) error {
+	if c.IsSet("config") {
+		setting.CustomConf = c.String("config")
+	}
+
+	setting.NewContext()
+
+	flushed, requeued, err := private.FlushMailQueue(c.Bool("dead-letters"))
+	if err != nil {
+		return fmt.Errorf("FlushMailQueue: %v", err)
+	}
+
+	fmt.Printf("%d queued mails are sent now.\n", flushed)
+	if c.Bool("dead-letters") {
+		fmt.Printf("%d dead letters have been moved back into the queue.\n", requeued)
+	}
+	return nil
+}
+
+func runMailRetry(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("ID of the dead letter is not specified")
+	}
+	id, err := strconv.ParseInt(c.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid ID of the dead letter: %s", c.Args().First())
+	}
+
+	if c.IsSet("config") {
+		setting.CustomConf = c.String("config")
+	}
+
+	setting.NewContext()
+
+	if err = private.RetryDeadLetter(id); err != nil {
+		return fmt.Errorf("RetryDeadLetter: %v", err)
+	}
+
+	fmt.Printf("Dead letter %d has been moved back into the queue.\n", id)
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/templates"
+
+	"github.com/urfave/cli"
+)
+
+// CmdDoctor represents the available doctor sub-command.
+var CmdDoctor = cli.Command{
+	Name:  "doctor",
+	Usage: "Diagnose problems of the configuration",
+	Description: `Check the configuration of the mail service: the connections to the
+SMTP servers, the SPF, DKIM and DMARC records of the sender domain and the
+mail templates, and suggest fixes for the problems found`,
+	Action: runDoctor,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config, c",
+			Value: "custom/conf/app.ini",
+			Usage: "Custom configuration file path",
+		},
+	},
+}
+
+func runDoctor(c *cli.Context) error {
+	if c.IsSet("config") {
+		setting.CustomConf = c.String("config")
+	}
+
+	setting.NewContext()
+	setting.NewServices()
+
+	if setting.MailService == nil {
+		fmt.Println("The mail service is disabled, set ENABLED = true in [mailer] to enable it.")
+		return nil
+	}
+
+	diagnoses := []*mailer.Diagnosis{{Check: "Mail templates"}}
+	if html, text, err := templates.Mailer(); err != nil {
+		diagnoses[0].Problem = err.Error()
+	} else if err = models.InitMailRender(html, text); err != nil {
+		diagnoses[0].Problem = err.Error()
+	}
+	if len(diagnoses[0].Problem) > 0 {
+		diagnoses[0].Fix = "Fix or remove the mail templates in " + setting.CustomPath + "/templates/mail."
+	}
+	diagnoses = append(diagnoses, mailer.Diagnose()...)
+
+	failed := 0
+	for _, d := range diagnoses {
+		switch {
+		case len(d.Problem) == 0:
+			fmt.Printf("[OK]   %s\n", d.Check)
+			continue
+		case d.Warning:
+			fmt.Printf("[WARN] %s: %s\n", d.Check, d.Problem)
+		default:
+			fmt.Printf("[FAIL] %s: %s\n", d.Check, d.Problem)
+			failed++
+		}
+		if len(d.Fix) > 0 {
+			fmt.Printf("       Fix: %s\n", d.Fix)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
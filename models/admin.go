@@ -21,6 +21,8 @@ type NoticeType int
 const (
 	//NoticeRepository type
 	NoticeRepository NoticeType = iota + 1
+	//NoticeMail type
+	NoticeMail
 )
 
 // Notice represents a system notice for admin.
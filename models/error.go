@@ -167,6 +167,52 @@ func (err ErrReachLimitOfRepo) Error() string {
 	return fmt.Sprintf("user has reached maximum limit of repositories [limit: %d]", err.Limit)
 }
 
+// ErrUnsubscribeTokenInvalid represents a "UnsubscribeTokenInvalid" kind of error.
+type ErrUnsubscribeTokenInvalid struct {
+	Token string
+}
+
+// IsErrUnsubscribeTokenInvalid checks if an error is a ErrUnsubscribeTokenInvalid.
+func IsErrUnsubscribeTokenInvalid(err error) bool {
+	_, ok := err.(ErrUnsubscribeTokenInvalid)
+	return ok
+}
+
+func (err ErrUnsubscribeTokenInvalid) Error() string {
+	return fmt.Sprintf("unsubscribe token is invalid [token: %s]", err.Token)
+}
+
+// ErrMailActionTokenInvalid represents a "MailActionTokenInvalid" kind of error.
+type ErrMailActionTokenInvalid struct {
+	Token   string
+	Expired bool
+}
+
+// IsErrMailActionTokenInvalid checks if an error is a ErrMailActionTokenInvalid.
+func IsErrMailActionTokenInvalid(err error) bool {
+	_, ok := err.(ErrMailActionTokenInvalid)
+	return ok
+}
+
+func (err ErrMailActionTokenInvalid) Error() string {
+	return fmt.Sprintf("mail action token is invalid [token: %s, expired: %t]", err.Token, err.Expired)
+}
+
+// ErrReplyTokenInvalid represents a "ReplyTokenInvalid" kind of error.
+type ErrReplyTokenInvalid struct {
+	Token string
+}
+
+// IsErrReplyTokenInvalid checks if an error is a ErrReplyTokenInvalid.
+func IsErrReplyTokenInvalid(err error) bool {
+	_, ok := err.(ErrReplyTokenInvalid)
+	return ok
+}
+
+func (err ErrReplyTokenInvalid) Error() string {
+	return fmt.Sprintf("reply token is invalid [token: %s]", err.Token)
+}
+
 //  __      __.__ __   .__
 // /  \    /  \__|  | _|__|
 // \   \/\/   /  |  |/ /  |
@@ -366,6 +366,61 @@ func verifySign(s *packet.Signature, h hash.Hash, k *GPGKey) error {
 	return pkey.VerifySignature(h, s)
 }
 
+// HasEncryptionGPGKey returns true if the user has a GPG key which can encrypt
+// notification mails.
+func HasEncryptionGPGKey(uid int64) (bool, error) {
+	keys, err := ListGPGKeys(uid)
+	if err != nil {
+		return false, err
+	}
+	entities, err := encryptionEntities(keys)
+	return len(entities) > 0, err
+}
+
+// encryptionEntities returns the keys which can encrypt as entities to encrypt
+// messages to. Only the public key packets are stored, so the self-signature
+// holding the key flags and algorithm preferences is synthesized.
+func encryptionEntities(keys []*GPGKey) (openpgp.EntityList, error) {
+	now := time.Now()
+
+	var entities openpgp.EntityList
+	for _, key := range keys {
+		for _, k := range append([]*GPGKey{key}, key.SubsKey...) {
+			if !k.CanEncryptComms || (k.ExpiredUnix > 0 && k.Expired.Before(now)) {
+				continue
+			}
+
+			b, err := readerFromBase64(k.Content)
+			if err != nil {
+				return nil, err
+			}
+			p, err := packet.Read(b)
+			if err != nil {
+				return nil, err
+			}
+			pkey, ok := p.(*packet.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("key is not a public key")
+			}
+
+			entities = append(entities, &openpgp.Entity{
+				PrimaryKey: pkey,
+				Identities: map[string]*openpgp.Identity{
+					"": {
+						SelfSignature: &packet.Signature{
+							FlagsValid:                true,
+							FlagEncryptCommunications: true,
+							PreferredSymmetric:        []uint8{uint8(packet.CipherAES256), uint8(packet.CipherAES128)},
+							PreferredHash:             []uint8{8}, // SHA256
+						},
+					},
+				},
+			})
+		}
+	}
+	return entities, nil
+}
+
 // ParseCommitWithSignature check if signature is good against keystore.
 func ParseCommitWithSignature(c *git.Commit) *CommitVerification {
 
@@ -7,6 +7,9 @@ package models
 import (
 	"testing"
 
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -162,3 +165,27 @@ Unknown GPG key with good email
 	err = verifySign(goodSig, goodHash, cannotsignkey)
 	assert.NotNil(t, err, "Validate a bad signature with a kay that can not sign")
 }
+
+func TestEncryptNotifyMail_NoKey(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	html, text := testMailTemplates()
+	assert.NoError(t, InitMailRender(html, text))
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	defer func() { setting.MailService = nil }()
+
+	u := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	has, err := HasEncryptionGPGKey(u.ID)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// The user gets a notice instead of the unencrypted notification.
+	notification := mailer.NewMessage([]string{u.Email}, "Secret subject", "Secret content")
+	notification.Info = "UID: 2, issue comment"
+	msg, err := encryptNotifyMail(notification, u)
+	assert.NoError(t, err)
+	assert.False(t, msg == notification)
+	assert.Equal(t, []string{u.Email}, msg.GetHeader("To"))
+	assert.NotContains(t, msg.GetHeader("Subject")[0], "Secret")
+	plain, body := msg.Bodies()
+	assert.NotContains(t, plain+body, "Secret content")
+}
@@ -733,6 +733,32 @@ func (issue *Issue) ChangeContent(doer *User, content string) (err error) {
 	return nil
 }
 
+// ChangeDeadline changes the deadline of this issue, as the given user. A
+// zero deadline removes it, a new one is sent as calendar invitation to the
+// receivers of notifications about the issue.
+func (issue *Issue) ChangeDeadline(doer *User, deadline time.Time) error {
+	if deadline.IsZero() {
+		deadline = time.Unix(0, 0)
+	}
+	issue.Deadline = deadline
+	if err := updateIssueCols(x, issue, "deadline_unix"); err != nil {
+		return fmt.Errorf("updateIssueCols: %v", err)
+	}
+
+	if !hasDeadline(issue.DeadlineUnix) {
+		return nil
+	}
+	if err := mailIssueDeadlineToParticipants(issue, doer); err != nil {
+		log.Error(4, "mailIssueDeadlineToParticipants: %v", err)
+	}
+	return nil
+}
+
+// HasDeadline returns true if the issue has a deadline.
+func (issue *Issue) HasDeadline() bool {
+	return hasDeadline(issue.DeadlineUnix)
+}
+
 // ChangeAssignee changes the Assignee field of this issue.
 func (issue *Issue) ChangeAssignee(doer *User, assigneeID int64) (err error) {
 	var oldAssigneeID = issue.AssigneeID
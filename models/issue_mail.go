@@ -10,6 +10,7 @@ import (
 	"github.com/Unknwon/com"
 
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
 	"code.gitea.io/gitea/modules/markdown"
 	"code.gitea.io/gitea/modules/setting"
 )
@@ -18,10 +19,23 @@ func (issue *Issue) mailSubject() string {
 	return fmt.Sprintf("[%s] %s (#%d)", issue.Repo.Name, issue.Title, issue.Index)
 }
 
+// mailMessageID returns the local part of the Message-ID of mails about the issue,
+// the mails about its comments refer to it to be shown in one thread.
+func (issue *Issue) mailMessageID() string {
+	path := "issues"
+	if issue.IsPull {
+		path = "pulls"
+	}
+	return fmt.Sprintf("%s/%s/%d", issue.Repo.FullName(), path, issue.Index)
+}
+
 // mailIssueCommentToParticipants can be used for both new issue creation and comment.
-// This function sends two list of emails:
-// 1. Repository watchers and users who are participated in comments.
-// 2. Users who are not in 1. but get mentioned in current issue/comment.
+// This function sends three list of emails:
+// 1. The assignee of the issue.
+// 2. Repository watchers and users who are participated in comments.
+// 3. Users who are not in 1. or 2. but get mentioned in current issue/comment.
+// Users who do not want mails for the activity of a list are left out of it,
+// users who muted the issue only get mails if they are mentioned.
 func mailIssueCommentToParticipants(issue *Issue, doer *User, comment *Comment, mentions []string) error {
 	if !setting.Service.EnableNotifyMail {
 		return nil
@@ -42,10 +56,32 @@ func mailIssueCommentToParticipants(issue *Issue, doer *User, comment *Comment,
 		participants = append(participants, issue.Poster)
 	}
 
-	tos := make([]string, 0, len(watchers)) // List of email addresses.
+	issueWatches, err := GetIssueWatchers(issue.ID)
+	if err != nil {
+		return fmt.Errorf("GetIssueWatchers [issue_id: %d]: %v", issue.ID, err)
+	}
+	muted := make(map[int64]bool, len(issueWatches))
+	for _, iw := range issueWatches {
+		if !iw.IsWatching {
+			muted[iw.UserID] = true
+		}
+	}
+
 	names := make([]string, 0, len(watchers))
+	if issue.AssigneeID > 0 && issue.AssigneeID != doer.ID && !muted[issue.AssigneeID] {
+		assignee, err := GetUserByID(issue.AssigneeID)
+		if err != nil {
+			return fmt.Errorf("GetUserByID [%d]: %v", issue.AssigneeID, err)
+		}
+		if assignee.WantsNotifyMail(mailer.EventAssigned) {
+			SendIssueCommentMail(issue, doer, comment, mailer.EventAssigned, []string{assignee.Email})
+			names = append(names, assignee.Name)
+		}
+	}
+
+	tos := make([]string, 0, len(watchers)) // List of email addresses.
 	for i := range watchers {
-		if watchers[i].UserID == doer.ID {
+		if watchers[i].UserID == doer.ID || muted[watchers[i].UserID] {
 			continue
 		}
 
@@ -53,7 +89,9 @@ func mailIssueCommentToParticipants(issue *Issue, doer *User, comment *Comment,
 		if err != nil {
 			return fmt.Errorf("GetUserByID [%d]: %v", watchers[i].UserID, err)
 		}
-		if to.IsOrganization() {
+		if to.IsOrganization() || !to.WantsNotifyMail(mailer.EventWatched) {
+			continue
+		} else if com.IsSliceContainsStr(names, to.Name) {
 			continue
 		}
 
@@ -61,17 +99,19 @@ func mailIssueCommentToParticipants(issue *Issue, doer *User, comment *Comment,
 		names = append(names, to.Name)
 	}
 	for i := range participants {
-		if participants[i].ID == doer.ID {
+		if participants[i].ID == doer.ID || muted[participants[i].ID] {
 			continue
 		} else if com.IsSliceContainsStr(names, participants[i].Name) {
 			continue
+		} else if !participants[i].WantsNotifyMail(mailer.EventWatched) {
+			continue
 		}
 
 		tos = append(tos, participants[i].Email)
 		names = append(names, participants[i].Name)
 	}
 
-	SendIssueCommentMail(issue, doer, comment, tos)
+	SendIssueCommentMail(issue, doer, comment, mailer.EventWatched, tos)
 
 	// Mail mentioned people and exclude watchers.
 	names = append(names, doer.Name)
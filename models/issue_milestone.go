@@ -32,6 +32,8 @@ type Milestone struct {
 	DeadlineUnix   int64
 	ClosedDate     time.Time `xorm:"-"`
 	ClosedDateUnix int64
+
+	DeadlineMailedUnix int64 `xorm:"NOT NULL DEFAULT 0"` // Deadline the last invitation was sent for.
 }
 
 // BeforeInsert is invoked from XORM before inserting an object of this type.
@@ -5,9 +5,8 @@
 package models
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"html/template"
 	"path"
 
 	"code.gitea.io/gitea/modules/base"
@@ -28,121 +27,241 @@ const (
 	mailIssueMention base.TplName = "issue/mention"
 
 	mailNotifyCollaborator base.TplName = "notify/collaborator"
+	mailNotifyDigest       base.TplName = "notify/digest"
+	mailNotifyAnnouncement base.TplName = "notify/announcement"
+	mailNotifyDeadline     base.TplName = "notify/deadline"
+	mailNotifyEncryptKey   base.TplName = "notify/encrypt_key"
 )
 
-var templates *template.Template
-
-// InitMailRender initializes the macaron mail renderer
-func InitMailRender(tmpls *template.Template) {
-	templates = tmpls
-}
-
-// SendTestMail sends a test mail
-func SendTestMail(email string) error {
+// SendTestMail sends a test mail and returns the transcript of the delivery
+func SendTestMail(email string) (string, error) {
 	msg := mailer.NewMessage(
 		[]string{email},
 		"Gitea Test Email!",
 		"Gitea Test Email!",
 	)
+	msg.Info = "test email"
 
-	return mailer.SendSync(msg)
+	return mailer.SendTest(msg)
 }
 
-// SendUserMail sends a mail to the user
+// SendUserMail sends a mail to the user, the subject is translated to the
+// language of the user.
 func SendUserMail(c *macaron.Context, u *User, tpl base.TplName, code, subject, info string) {
+	sendUserMail(c, u, tpl, code, subject, info, nil)
+}
+
+// sendUserMail sends a mail to the user, fn is called with the outcome
+// of the delivery if it is not nil.
+func sendUserMail(c *macaron.Context, u *User, tpl base.TplName, code, subject, info string, fn func(error)) {
+	locale := mailLocale(u)
 	data := map[string]interface{}{
 		"Username":          u.DisplayName(),
 		"ActiveCodeLives":   base.MinutesToFriendly(setting.Service.ActiveCodeLives),
 		"ResetPwdCodeLives": base.MinutesToFriendly(setting.Service.ResetPwdCodeLives),
 		"Code":              code,
+		"i18n":              locale,
 	}
 
-	var content bytes.Buffer
-
-	if err := templates.ExecuteTemplate(&content, string(tpl), data); err != nil {
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, tpl, locale.Tr(subject), data)
+	if err != nil {
 		log.Error(3, "Template: %v", err)
+		if fn != nil {
+			fn(err)
+		}
 		return
 	}
-
-	msg := mailer.NewMessage([]string{u.Email}, subject, content.String())
 	msg.Info = fmt.Sprintf("UID: %d, %s", u.ID, info)
+	msg.Category = mailer.CategorySecurity
+	recordMailAudit(u, u.Email, info, msg)
 
-	mailer.SendAsync(msg)
+	if fn == nil {
+		mailer.SendAsync(msg)
+		return
+	}
+	mailer.SendAsyncWithCallback(context.Background(), msg, fn)
 }
 
 // SendActivateAccountMail sends an activation mail to the user (new user registration)
 func SendActivateAccountMail(c *macaron.Context, u *User) {
-	SendUserMail(c, u, mailAuthActivate, u.GenerateActivateCode(), c.Tr("mail.activate_account"), "activate account")
+	SendUserMail(c, u, mailAuthActivate, u.GenerateActivateCode(), "mail.activate_account", "activate account")
 }
 
-// SendResetPasswordMail sends a password reset mail to the user
-func SendResetPasswordMail(c *macaron.Context, u *User) {
-	SendUserMail(c, u, mailAuthResetPassword, u.GenerateActivateCode(), c.Tr("mail.reset_password"), "reset password")
+// SendResetPasswordMail sends a password reset mail to the user,
+// fn is called with the outcome of the delivery if it is not nil.
+func SendResetPasswordMail(c *macaron.Context, u *User, fn func(error)) {
+	sendUserMail(c, u, mailAuthResetPassword, u.GenerateActivateCode(), "mail.reset_password", "reset password", fn)
 }
 
-// SendActivateEmailMail sends confirmation email to confirm new email address
-func SendActivateEmailMail(c *macaron.Context, u *User, email *EmailAddress) {
+// SendActivateEmailMail sends confirmation email to confirm new email address,
+// it returns once the mail server accepted the mail
+func SendActivateEmailMail(c *macaron.Context, u *User, email *EmailAddress) error {
 	data := map[string]interface{}{
 		"Username":        u.DisplayName(),
 		"ActiveCodeLives": base.MinutesToFriendly(setting.Service.ActiveCodeLives),
 		"Code":            u.GenerateEmailActivateCode(email.Email),
 		"Email":           email.Email,
+		"i18n":            mailLocale(u),
 	}
 
-	var content bytes.Buffer
-
-	if err := templates.ExecuteTemplate(&content, string(mailAuthActivateEmail), data); err != nil {
+	msg, err := newMailMessage([]string{email.Email}, setting.MailService.From, mailAuthActivateEmail, mailLocale(u).Tr("mail.activate_email"), data)
+	if err != nil {
 		log.Error(3, "Template: %v", err)
-		return
+		return err
 	}
-
-	msg := mailer.NewMessage([]string{email.Email}, c.Tr("mail.activate_email"), content.String())
 	msg.Info = fmt.Sprintf("UID: %d, activate email", u.ID)
+	msg.Category = mailer.CategorySecurity
+	recordMailAudit(u, email.Email, "activate email", msg)
 
-	mailer.SendAsync(msg)
+	_, err = mailer.SendSync(c.Req.Context(), msg)
+	return err
 }
 
 // SendRegisterNotifyMail triggers a notify e-mail by admin created a account.
 func SendRegisterNotifyMail(c *macaron.Context, u *User) {
 	data := map[string]interface{}{
 		"Username": u.DisplayName(),
+		"i18n":     mailLocale(u),
 	}
 
-	var content bytes.Buffer
-
-	if err := templates.ExecuteTemplate(&content, string(mailAuthRegisterNotify), data); err != nil {
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, mailAuthRegisterNotify, mailLocale(u).Tr("mail.register_notify"), data)
+	if err != nil {
 		log.Error(3, "Template: %v", err)
 		return
 	}
-
-	msg := mailer.NewMessage([]string{u.Email}, c.Tr("mail.register_notify"), content.String())
 	msg.Info = fmt.Sprintf("UID: %d, registration notify", u.ID)
+	msg.Category = mailer.CategorySecurity
+	recordMailAudit(u, u.Email, "registration notify", msg)
 
 	mailer.SendAsync(msg)
 }
 
 // SendCollaboratorMail sends mail notification to new collaborator.
 func SendCollaboratorMail(u, doer *User, repo *Repository) {
+	if !allowNotifyMails(doer, 1) {
+		return
+	}
+
 	repoName := path.Join(repo.Owner.Name, repo.Name)
-	subject := fmt.Sprintf("%s added you to %s", doer.DisplayName(), repoName)
+	locale := mailLocale(u)
+	subject := locale.Tr("mail.collaborator.subject", doer.DisplayName(), repoName)
 
 	data := map[string]interface{}{
-		"Subject":  subject,
-		"RepoName": repoName,
-		"Link":     repo.HTMLURL(),
+		"i18n":           locale,
+		"RepoName":       repoName,
+		"Repo":           repo,
+		"Doer":           doer,
+		"Link":           repo.HTMLURL(),
+		"UnsubscribeAll": u.UnsubscribeURL(0),
 	}
 
-	var content bytes.Buffer
-
-	if err := templates.ExecuteTemplate(&content, string(mailNotifyCollaborator), data); err != nil {
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, mailNotifyCollaborator, subject, data)
+	if err != nil {
 		log.Error(3, "Template: %v", err)
 		return
 	}
-
-	msg := mailer.NewMessage([]string{u.Email}, subject, content.String())
 	msg.Info = fmt.Sprintf("UID: %d, add collaborator", u.ID)
+	msg.SetMetadata(mailer.Metadata{
+		Repository: repoName,
+		Sender:     doer.Name,
+	})
+	msg.SetListUnsubscribe(u.UnsubscribeURL(0))
+
+	if u.EncryptNotifyMail {
+		if msg, err = encryptNotifyMail(msg, u); err != nil {
+			log.Error(3, "Failed to encrypt collaborator mail [uid: %d]: %v", u.ID, err)
+			return
+		}
+	}
 
-	mailer.SendAsync(msg)
+	queueNotifyMail(u, msg)
+}
+
+// encryptNotifyMail marks the notification mail to be encrypted to the GPG keys of
+// the user. If none of the keys can encrypt, e.g. because they expired, the mail is
+// replaced by a notice asking the user to add one, which is not encrypted.
+func encryptNotifyMail(msg *mailer.Message, u *User) (*mailer.Message, error) {
+	keys, err := ListGPGKeys(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := encryptionEntities(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return composeEncryptKeyMessage(u, msg)
+	}
+	return msg, msg.EncryptTo(entities)
+}
+
+// composeEncryptKeyMessage composes the notice sent instead of the notification mail
+// to a user who has no GPG key to encrypt it to.
+func composeEncryptKeyMessage(u *User, notification *mailer.Message) (*mailer.Message, error) {
+	locale := mailLocale(u)
+	data := map[string]interface{}{
+		"i18n":           locale,
+		"Link":           setting.AppURL + "user/settings/keys",
+		"UnsubscribeAll": u.UnsubscribeURL(0),
+	}
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, mailNotifyEncryptKey,
+		locale.Tr("mail.encrypt_key.subject", setting.AppName), data)
+	if err != nil {
+		return nil, fmt.Errorf("Template: %v", err)
+	}
+	msg.Info = notification.Info + ", no GPG key to encrypt to"
+	msg.Category = notification.Category
+	msg.Event = notification.Event
+	msg.SetListUnsubscribe(u.UnsubscribeURL(0))
+	return msg, nil
+}
+
+// sendNotifyMail sends the composed notification mail for the event to all receivers.
+// Every user gets a separate message, so it can carry the links to unsubscribe the user,
+// for receivers who enabled the digest the item is collected instead. The addresses
+// not belonging to a user share a message composed without a user. Messages
+// which fail to compose are nil. Receivers exceeding USER_NOTIFY_LIMIT of the doer are
+// left out.
+func sendNotifyMail(doer *User, tos []string, event mailer.Event, item *MailDigestItem, compose func(tos []string, u *User) *mailer.Message) {
+	others := make([]string, 0, len(tos))
+	for _, to := range tos {
+		u, err := GetUserByEmail(to)
+		if err != nil {
+			others = append(others, to)
+			continue
+		}
+
+		if !u.WantsNotifyMail(event) || !allowNotifyMails(doer, 1) {
+			continue
+		}
+
+		if u.NotifyMailDigest != MailDigestOff {
+			if err = addMailDigestItem(u, item); err != nil {
+				log.Error(3, "Failed to add notification to digest [uid: %d]: %v", u.ID, err)
+			}
+			continue
+		}
+
+		msg := compose([]string{to}, u)
+		if msg == nil {
+			continue
+		}
+		msg.Event = event
+		if u.EncryptNotifyMail {
+			if msg, err = encryptNotifyMail(msg, u); err != nil {
+				log.Error(3, "Failed to encrypt notification mail [uid: %d]: %v", u.ID, err)
+				continue
+			}
+		}
+		queueNotifyMail(u, msg)
+	}
+
+	if len(others) > 0 && allowNotifyMails(doer, len(others)) {
+		if msg := compose(others, nil); msg != nil {
+			msg.Event = event
+			mailer.SendAsync(msg)
+		}
+	}
 }
 
 func composeTplData(subject, body, link string) map[string]interface{} {
@@ -153,36 +272,81 @@ func composeTplData(subject, body, link string) map[string]interface{} {
 	return data
 }
 
-func composeIssueCommentMessage(issue *Issue, doer *User, comment *Comment, tplName base.TplName, tos []string, info string) *mailer.Message {
-	subject := issue.mailSubject()
-	body := string(markdown.RenderString(issue.Content, issue.Repo.HTMLURL(), issue.Repo.ComposeMetas()))
-
-	data := make(map[string]interface{}, 10)
+// composeIssueDigestItem returns the digest item of the issue notification.
+func composeIssueDigestItem(issue *Issue, doer *User, comment *Comment) *MailDigestItem {
+	item := &MailDigestItem{
+		Subject: issue.mailSubject(),
+		Link:    issue.HTMLURL(),
+		Doer:    doer.DisplayName(),
+		Body:    string(markdown.RenderString(issue.Content, issue.Repo.HTMLURL(), issue.Repo.ComposeMetas())),
+	}
 	if comment != nil {
-		data = composeTplData(subject, body, issue.HTMLURL()+"#"+comment.HashTag())
-	} else {
-		data = composeTplData(subject, body, issue.HTMLURL())
+		item.Link += "#" + comment.HashTag()
 	}
-	data["Doer"] = doer
+	return item
+}
 
-	var content bytes.Buffer
+// composeIssueCommentMessage composes the mail of the issue notification, if u is
+// not nil it is in the language of the user and gets the links to mute the issue or
+// all notification mails of the user.
+// It returns nil if the template fails to render.
+func composeIssueCommentMessage(issue *Issue, doer *User, comment *Comment, tplName base.TplName, tos []string, u *User, info string) *mailer.Message {
+	item := composeIssueDigestItem(issue, doer, comment)
+	subject := item.Subject
 
-	if err := templates.ExecuteTemplate(&content, string(tplName), data); err != nil {
-		log.Error(3, "Template: %v", err)
+	data := composeTplData(subject, item.Body, item.Link)
+	data["Doer"] = doer
+	data["Issue"] = issue
+	data["Repo"] = issue.Repo
+	data["Comment"] = comment
+	data["i18n"] = mailLocale(u)
+	var replyTo string
+	if u != nil {
+		data["UnsubscribeThread"] = u.UnsubscribeURL(issue.ID)
+		data["UnsubscribeAll"] = u.UnsubscribeURL(0)
+		data["MarkRead"] = u.MailActionURL(MailActionMarkRead, issue.ID)
+		if replyTo = u.ReplyToAddress(issue.ID); len(replyTo) > 0 {
+			data["ReplyToken"] = u.ReplyToken(issue.ID)
+		}
 	}
 
-	msg := mailer.NewMessageFrom(tos, fmt.Sprintf(`"%s" <%s>`, doer.DisplayName(), setting.MailService.FromEmail), subject, content.String())
+	msg, err := newMailMessage(tos, mailer.FromUser(doer.DisplayName()), tplName, subject, data)
+	if err != nil {
+		log.Error(3, "Template: %v", err)
+		return nil
+	}
 	msg.Info = fmt.Sprintf("Subject: %s, %s", subject, info)
+	msg.SetMetadata(mailer.Metadata{
+		Repository: issue.Repo.FullName(),
+		Sender:     doer.Name,
+		Issue:      issue.Index,
+	})
+
+	rootID := mailer.MessageID(issue.mailMessageID())
+	if comment != nil {
+		msg.SetThread(mailer.MessageID(fmt.Sprintf("%s/comment/%d", issue.mailMessageID(), comment.ID)), rootID)
+	} else {
+		msg.SetThread(rootID, rootID)
+	}
+
+	if u != nil {
+		msg.SetListUnsubscribe(u.UnsubscribeURL(issue.ID))
+	}
+	if len(replyTo) > 0 {
+		msg.SetHeader("Reply-To", replyTo)
+	}
 	return msg
 }
 
-// SendIssueCommentMail composes and sends issue comment emails to target receivers.
-func SendIssueCommentMail(issue *Issue, doer *User, comment *Comment, tos []string) {
+// SendIssueCommentMail composes and sends issue comment emails for the event to target receivers.
+func SendIssueCommentMail(issue *Issue, doer *User, comment *Comment, event mailer.Event, tos []string) {
 	if len(tos) == 0 {
 		return
 	}
 
-	mailer.SendAsync(composeIssueCommentMessage(issue, doer, comment, mailIssueComment, tos, "issue comment"))
+	sendNotifyMail(doer, tos, event, composeIssueDigestItem(issue, doer, comment), func(tos []string, u *User) *mailer.Message {
+		return composeIssueCommentMessage(issue, doer, comment, mailIssueComment, tos, u, "issue comment")
+	})
 }
 
 // SendIssueMentionMail composes and sends issue mention emails to target receivers.
@@ -190,5 +354,7 @@ func SendIssueMentionMail(issue *Issue, doer *User, comment *Comment, tos []stri
 	if len(tos) == 0 {
 		return
 	}
-	mailer.SendAsync(composeIssueCommentMessage(issue, doer, comment, mailIssueMention, tos, "issue mention"))
+	sendNotifyMail(doer, tos, mailer.EventMention, composeIssueDigestItem(issue, doer, comment), func(tos []string, u *User) *mailer.Message {
+		return composeIssueCommentMessage(issue, doer, comment, mailIssueMention, tos, u, "issue mention")
+	})
 }
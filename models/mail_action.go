@@ -0,0 +1,64 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Actions which can be performed with the deep links of mails.
+const (
+	// MailActionMarkRead marks the notification of the issue as read.
+	MailActionMarkRead = "read"
+)
+
+// MailActionURL returns the signed link performing the action of the user
+// on the issue of given ID, it is empty if DEEP_LINK_EXPIRY disables the links.
+func (u *User) MailActionURL(action string, issueID int64) string {
+	if setting.MailService == nil || setting.MailService.DeepLinkExpiry <= 0 {
+		return ""
+	}
+	return mailer.NewDeepLink(action, u.ID, issueID).URL(u.Rands)
+}
+
+// VerifyMailActionToken returns the user and the link of a valid token of a
+// mail action.
+func VerifyMailActionToken(token string) (*User, *mailer.DeepLink, error) {
+	var u *User
+	link, err := mailer.VerifyDeepLink(token, func(l *mailer.DeepLink) (string, error) {
+		var err error
+		if u, err = GetUserByID(l.UserID); IsErrUserNotExist(err) {
+			return "", mailer.ErrDeepLinkInvalid
+		} else if err != nil {
+			return "", err
+		}
+		return u.Rands, nil
+	})
+	switch {
+	case err == mailer.ErrDeepLinkInvalid:
+		return nil, nil, ErrMailActionTokenInvalid{Token: token}
+	case err == mailer.ErrDeepLinkExpired:
+		return nil, nil, ErrMailActionTokenInvalid{Token: token, Expired: true}
+	case err != nil:
+		return nil, nil, err
+	}
+
+	switch link.Action {
+	case MailActionMarkRead:
+	default:
+		return nil, nil, ErrMailActionTokenInvalid{Token: token}
+	}
+	return u, link, nil
+}
+
+// PerformMailAction performs the action of the link for the user.
+func PerformMailAction(u *User, link *mailer.DeepLink) error {
+	switch link.Action {
+	case MailActionMarkRead:
+		return setNotificationStatusReadIfUnread(x, u.ID, link.TargetID)
+	}
+	return ErrMailActionTokenInvalid{}
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailAction(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	setting.MailService = &setting.Mailer{DeepLinkExpiry: time.Hour}
+	defer func() { setting.MailService = nil }()
+	user := AssertExistsAndLoadBean(t, &User{ID: 1}).(*User)
+
+	url := user.MailActionURL(MailActionMarkRead, 1)
+	assert.True(t, strings.HasPrefix(url, setting.AppURL+"user/mail_action/"))
+	u, link, err := VerifyMailActionToken(url[strings.LastIndexByte(url, '/')+1:])
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, u.ID)
+	assert.EqualValues(t, 1, link.TargetID)
+
+	assert.NoError(t, PerformMailAction(u, link))
+	AssertExistsAndLoadBean(t, &Notification{ID: 1, Status: NotificationStatusRead})
+
+	// Links signed with an old key, unknown actions and expired links are invalid.
+	_, _, err = VerifyMailActionToken(mailer.NewDeepLink(MailActionMarkRead, user.ID, 1).Token("old rands"))
+	assert.True(t, IsErrMailActionTokenInvalid(err))
+	_, _, err = VerifyMailActionToken(mailer.NewDeepLink("merge", user.ID, 1).Token(user.Rands))
+	assert.True(t, IsErrMailActionTokenInvalid(err))
+	expired := mailer.NewDeepLink(MailActionMarkRead, user.ID, 1)
+	expired.Expires = time.Now().Add(-time.Minute)
+	_, _, err = VerifyMailActionToken(expired.Token(user.Rands))
+	assert.True(t, IsErrMailActionTokenInvalid(err))
+	assert.True(t, err.(ErrMailActionTokenInvalid).Expired)
+
+	setting.MailService.DeepLinkExpiry = 0
+	assert.Empty(t, user.MailActionURL(MailActionMarkRead, 1))
+}
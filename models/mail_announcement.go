@@ -0,0 +1,120 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/markdown"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Announcement is a mail of the admin to the active users of the instance, the
+// members of an organization or the watchers of a repository.
+type Announcement struct {
+	Org     *User       // Members of the organization if not nil.
+	Repo    *Repository // Watchers of the repository if not nil.
+	Subject string
+	Content string // Markdown.
+
+	// Bcc sends one mail per BCC_MAX_RECIPIENTS users with the users in Bcc,
+	// instead of one mail addressed to every user.
+	Bcc bool
+}
+
+// getAnnouncementReceivers returns the active users of the organization, the
+// active watchers of the repository, or the active users of the instance if
+// both are nil.
+func getAnnouncementReceivers(org *User, repo *Repository) ([]*User, error) {
+	sess := x.Where("`user`.type = ?", UserTypeIndividual).
+		And("`user`.is_active = ?", true)
+	if org != nil {
+		sess.Join("INNER", "org_user", "org_user.uid = `user`.id").
+			And("org_user.org_id = ?", org.ID)
+	}
+	if repo != nil {
+		sess.Join("INNER", "watch", "watch.user_id = `user`.id").
+			And("watch.repo_id = ?", repo.ID)
+	}
+	users := make([]*User, 0, 10)
+	return users, sess.Asc("`user`.id").Find(&users)
+}
+
+// info returns the description of the announcement for the mail log.
+func (a *Announcement) info() string {
+	switch {
+	case a.Org != nil:
+		return fmt.Sprintf("announcement to organization %s", a.Org.Name)
+	case a.Repo != nil:
+		return fmt.Sprintf("announcement to watchers of repository %d", a.Repo.ID)
+	}
+	return "announcement"
+}
+
+// SendAnnouncementMail queues the announcement for its receivers. The mails
+// are sent within the rate limits of the mailer and suppressed addresses are
+// skipped. Personalized mails are in the language of the receiver, the
+// shared Bcc mails in the default language. It returns the number of receivers.
+func SendAnnouncementMail(a *Announcement) (int, error) {
+	users, err := getAnnouncementReceivers(a.Org, a.Repo)
+	if err != nil {
+		return 0, fmt.Errorf("getAnnouncementReceivers: %v", err)
+	}
+	receivers := make([]*User, 0, len(users))
+	for _, u := range users {
+		if u.IsMailable() && !u.ProhibitLogin && len(u.Email) > 0 {
+			receivers = append(receivers, u)
+		}
+	}
+	if len(receivers) == 0 {
+		return 0, nil
+	}
+
+	data := composeTplData(a.Subject, markdown.RenderString(a.Content, setting.AppURL, nil), setting.AppURL)
+	data["i18n"] = mailLocale(nil)
+	if !a.Bcc {
+		htmlTpls, textTpls := mailTemplates()
+		batch := &mailer.Batch{
+			Subject:    "{{.Subject}}",
+			Body:       htmlTpls.Lookup(string(mailNotifyAnnouncement)),
+			Data:       data,
+			Recipients: make([]*mailer.BatchRecipient, 0, len(receivers)),
+			Info:       a.info(),
+			Category:   mailer.CategoryBroadcast,
+		}
+		if tpl := textTpls.Lookup(string(mailNotifyAnnouncement) + mailSubjectSuffix); tpl != nil {
+			batch.SubjectTemplate = tpl
+		}
+		if tpl := textTpls.Lookup(string(mailNotifyAnnouncement) + mailTextSuffix); tpl != nil {
+			batch.Text = tpl
+		}
+		for _, u := range receivers {
+			batch.Recipients = append(batch.Recipients, &mailer.BatchRecipient{
+				Email: u.Email,
+				Name:  u.DisplayName(),
+				Data:  map[string]interface{}{"i18n": mailLocale(u)},
+			})
+		}
+		return mailer.SendBatch(batch)
+	}
+
+	subject, body, text, err := renderMail(mailNotifyAnnouncement, a.Subject, data)
+	if err != nil {
+		return 0, fmt.Errorf("render announcement: %v", err)
+	}
+	tos := make([]string, 0, len(receivers))
+	for _, u := range receivers {
+		tos = append(tos, u.Email)
+	}
+	for _, msg := range mailer.NewBccMessages(tos, subject, body) {
+		msg.Info = a.info()
+		if len(text) > 0 {
+			msg.SetTextBody(text)
+		}
+		mailer.SendAsync(msg)
+	}
+	return len(tos), nil
+}
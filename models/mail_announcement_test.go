@@ -0,0 +1,40 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAnnouncementReceivers(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+
+	ids := func(users []*User) []int64 {
+		list := make([]int64, 0, len(users))
+		for _, u := range users {
+			list = append(list, u.ID)
+		}
+		return list
+	}
+
+	users, err := getAnnouncementReceivers(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 5, 8, 10, 11, 12, 13, 14}, ids(users))
+
+	// User 4 is a member of the organization, but not active.
+	org := AssertExistsAndLoadBean(t, &User{ID: 3}).(*User)
+	users, err = getAnnouncementReceivers(org, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2}, ids(users))
+
+	// Only the active watchers of the repository.
+	repo := AssertExistsAndLoadBean(t, &Repository{ID: 1}).(*Repository)
+	assert.NoError(t, WatchRepo(5, repo.ID, true))
+	users, err = getAnnouncementReceivers(nil, repo)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{5}, ids(users))
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-xorm/xorm"
+	gouuid "github.com/satori/go.uuid"
+)
+
+// MailAttachment represents a file attached to a mail which exceeded the
+// maximum size of the mailer. It is linked in the mail instead and can only
+// be downloaded by the recipients until it expires.
+type MailAttachment struct {
+	ID          int64  `xorm:"pk autoincr"`
+	UUID        string `xorm:"uuid UNIQUE"`
+	Name        string
+	Recipients  string    `xorm:"TEXT"` // Comma separated email addresses.
+	Created     time.Time `xorm:"-"`
+	CreatedUnix int64
+	Expires     time.Time `xorm:"-"`
+	ExpiresUnix int64     `xorm:"INDEX"`
+}
+
+// BeforeInsert is invoked from XORM before inserting an object of this type.
+func (a *MailAttachment) BeforeInsert() {
+	a.CreatedUnix = time.Now().Unix()
+}
+
+// AfterSet is invoked from XORM after setting the value of a field of this object.
+func (a *MailAttachment) AfterSet(colName string, _ xorm.Cell) {
+	switch colName {
+	case "created_unix":
+		a.Created = time.Unix(a.CreatedUnix, 0).Local()
+	case "expires_unix":
+		a.Expires = time.Unix(a.ExpiresUnix, 0).Local()
+	}
+}
+
+// LocalPath returns where the attachment is stored in local file system.
+func (a *MailAttachment) LocalPath() string {
+	return path.Join(setting.AttachmentPath, "mail", a.UUID[0:1], a.UUID[1:2], a.UUID)
+}
+
+// IsExpired reports whether the attachment can no longer be downloaded.
+func (a *MailAttachment) IsExpired() bool {
+	return time.Now().Unix() >= a.ExpiresUnix
+}
+
+// IsRecipient reports whether the mail was sent to an activated email
+// address of the user.
+func (a *MailAttachment) IsRecipient(u *User) (bool, error) {
+	emails, err := GetEmailAddresses(u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, rcpt := range strings.Split(a.Recipients, ",") {
+		for _, email := range emails {
+			if email.IsActivated && strings.EqualFold(email.Email, rcpt) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// NewMailAttachment stores a file attached to a mail which exceeds the
+// maximum size of the mailer and returns the URL to download it, which is
+// sent in the mail instead. It is used as mailer.AttachmentUploader.
+func NewMailAttachment(name string, r io.Reader, recipients []string) (string, error) {
+	attach := &MailAttachment{
+		UUID:        gouuid.NewV4().String(),
+		Name:        name,
+		Recipients:  strings.Join(recipients, ","),
+		ExpiresUnix: time.Now().Add(setting.MailService.OversizeLinkExpiry).Unix(),
+	}
+
+	localPath := attach.LocalPath()
+	if err := os.MkdirAll(path.Dir(localPath), os.ModePerm); err != nil {
+		return "", fmt.Errorf("MkdirAll: %v", err)
+	}
+	fw, err := os.Create(localPath)
+	if err != nil {
+		return "", fmt.Errorf("Create: %v", err)
+	}
+	defer fw.Close()
+	if _, err = io.Copy(fw, r); err != nil {
+		return "", fmt.Errorf("Copy: %v", err)
+	}
+
+	if _, err = x.Insert(attach); err != nil {
+		return "", err
+	}
+	return setting.AppURL + "attachments/mail/" + attach.UUID, nil
+}
+
+// GetMailAttachmentByUUID returns the mail attachment by given UUID.
+func GetMailAttachmentByUUID(uuid string) (*MailAttachment, error) {
+	attach := &MailAttachment{UUID: uuid}
+	has, err := x.Get(attach)
+	if err != nil {
+		return nil, err
+	} else if !has {
+		return nil, ErrAttachmentNotExist{0, uuid}
+	}
+	return attach, nil
+}
+
+// DeleteExpiredMailAttachments deletes the expired mail attachments and
+// their files.
+func DeleteExpiredMailAttachments() {
+	if !taskStatusTable.StartIfNotRunning(mailAttachmentCleanup) {
+		return
+	}
+	defer taskStatusTable.Stop(mailAttachmentCleanup)
+
+	stop, ok := startMailLease(mailAttachmentCleanup)
+	if !ok {
+		return
+	}
+	defer stop()
+
+	log.Trace("Doing: MailAttachmentCleanup")
+
+	if err := deleteExpiredMailAttachments(); err != nil {
+		log.Error(4, "MailAttachmentCleanup: %v", err)
+	}
+}
+
+func deleteExpiredMailAttachments() error {
+	attachments := make([]*MailAttachment, 0, 10)
+	if err := x.Where("expires_unix <= ?", time.Now().Unix()).Find(&attachments); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		if err := os.Remove(a.LocalPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if _, err := x.Id(a.ID).Delete(new(MailAttachment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
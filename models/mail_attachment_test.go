@@ -0,0 +1,67 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMailAttachment(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	dir, err := ioutil.TempDir("", "attachments")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(path string) { setting.AttachmentPath = path }(setting.AttachmentPath)
+	setting.AttachmentPath = dir
+	setting.AppURL = "https://try.gitea.io/"
+	defer func(s *setting.Mailer) { setting.MailService = s }(setting.MailService)
+	setting.MailService = &setting.Mailer{OversizeLinkExpiry: time.Hour}
+
+	link, err := NewMailAttachment("report.pdf", strings.NewReader("%PDF-1.4"), []string{"User2@example.com", "other@example.com"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(link, "https://try.gitea.io/attachments/mail/"))
+
+	attach, err := GetMailAttachmentByUUID(strings.TrimPrefix(link, "https://try.gitea.io/attachments/mail/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", attach.Name)
+	assert.False(t, attach.IsExpired())
+	data, err := ioutil.ReadFile(attach.LocalPath())
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4", string(data))
+
+	// The link is not an attachment of issues or releases.
+	_, err = GetAttachmentByUUID(attach.UUID)
+	assert.True(t, IsErrAttachmentNotExist(err))
+
+	// Only activated email addresses are recipients.
+	isRecipient, err := attach.IsRecipient(AssertExistsAndLoadBean(t, &User{ID: 2}).(*User))
+	assert.NoError(t, err)
+	assert.True(t, isRecipient)
+	attach.Recipients = "user21@example.com"
+	isRecipient, err = attach.IsRecipient(AssertExistsAndLoadBean(t, &User{ID: 2}).(*User))
+	assert.NoError(t, err)
+	assert.False(t, isRecipient)
+	isRecipient, err = attach.IsRecipient(AssertExistsAndLoadBean(t, &User{ID: 1}).(*User))
+	assert.NoError(t, err)
+	assert.False(t, isRecipient)
+
+	// Expired attachments are deleted with their files.
+	assert.NoError(t, deleteExpiredMailAttachments())
+	AssertExistsAndLoadBean(t, &MailAttachment{ID: attach.ID})
+	_, err = x.Id(attach.ID).Cols("expires_unix").Update(&MailAttachment{ExpiresUnix: time.Now().Unix()})
+	assert.NoError(t, err)
+	assert.NoError(t, deleteExpiredMailAttachments())
+	AssertNotExistsBean(t, &MailAttachment{ID: attach.ID})
+	_, err = os.Stat(attach.LocalPath())
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+
+	"github.com/go-xorm/xorm"
+)
+
+// MailAuditQueued is the status of an audited mail which was not sent yet,
+// or never because no recipient was left after filtering.
+const MailAuditQueued mailer.DeliveryStatus = "queued"
+
+// MailAudit records a security mail sent to a user, like a password reset or
+// the confirmation of a new email address, with the outcome of its delivery.
+type MailAudit struct {
+	ID          int64                 `xorm:"pk autoincr" json:"id"`
+	UID         int64                 `xorm:"INDEX" json:"user_id"`
+	Kind        string                `json:"kind"`
+	Email       string                `json:"email"`
+	MessageID   string                `xorm:"INDEX" json:"message_id"`
+	Status      mailer.DeliveryStatus `json:"status"`
+	Error       string                `xorm:"TEXT" json:"error"`
+	Created     time.Time             `xorm:"-" json:"created_at"`
+	CreatedUnix int64                 `xorm:"INDEX" json:"-"`
+	Updated     time.Time             `xorm:"-" json:"updated_at"`
+	UpdatedUnix int64                 `json:"-"`
+}
+
+// BeforeInsert is invoked from XORM before inserting an object of this type.
+func (a *MailAudit) BeforeInsert() {
+	a.CreatedUnix = time.Now().Unix()
+	a.UpdatedUnix = a.CreatedUnix
+}
+
+// BeforeUpdate is invoked from XORM before updating this object.
+func (a *MailAudit) BeforeUpdate() {
+	a.UpdatedUnix = time.Now().Unix()
+}
+
+// AfterSet is invoked from XORM after setting the value of a field of this object.
+func (a *MailAudit) AfterSet(colName string, _ xorm.Cell) {
+	switch colName {
+	case "created_unix":
+		a.Created = time.Unix(a.CreatedUnix, 0).Local()
+	case "updated_unix":
+		a.Updated = time.Unix(a.UpdatedUnix, 0).Local()
+	}
+}
+
+// recordMailAudit records that the security mail of the kind is sent to the
+// user, the outcome is recorded by MailAuditHook.
+func recordMailAudit(u *User, email, kind string, msg *mailer.Message) {
+	var messageID string
+	if ids := msg.GetHeader("Message-ID"); len(ids) > 0 {
+		messageID = ids[0]
+	}
+	if _, err := x.Insert(&MailAudit{
+		UID:       u.ID,
+		Kind:      kind,
+		Email:     email,
+		MessageID: messageID,
+		Status:    MailAuditQueued,
+	}); err != nil {
+		log.Error(4, "Failed to record mail audit [uid: %d, kind: %s]: %v", u.ID, kind, err)
+	}
+}
+
+// updateMailAudit records the outcome of the delivery of the security mail.
+func updateMailAudit(msg *mailer.Message, status mailer.DeliveryStatus, sendErr error) {
+	ids := msg.GetHeader("Message-ID")
+	if msg.Category != mailer.CategorySecurity || len(ids) == 0 {
+		return
+	}
+
+	audit := &MailAudit{Status: status}
+	if sendErr != nil {
+		audit.Error = sendErr.Error()
+	}
+	if _, err := x.Where("message_id = ?", ids[0]).Cols("status", "error", "updated_unix").Update(audit); err != nil {
+		log.Error(4, "Failed to update mail audit [message_id: %s]: %v", ids[0], err)
+	}
+}
+
+// MailAuditHook records the outcome of the delivery of security mails in
+// the mail audit, it is registered as mailer.Hook.
+type MailAuditHook struct {
+	mailer.NopHook
+}
+
+// AfterSend records that the mail was sent.
+func (MailAuditHook) AfterSend(msg *mailer.Message, duration time.Duration) {
+	updateMailAudit(msg, mailer.DeliverySent, nil)
+}
+
+// OnFailure records that the delivery failed or is retried.
+func (MailAuditHook) OnFailure(msg *mailer.Message, err error, status mailer.DeliveryStatus) {
+	updateMailAudit(msg, status, err)
+}
+
+// GetMailAudits returns the security mails sent to the user, oldest first.
+func GetMailAudits(uid int64) ([]*MailAudit, error) {
+	audits := make([]*MailAudit, 0, 10)
+	return audits, x.Where("uid = ?", uid).Asc("id").Find(&audits)
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailAudit(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	defer func() { setting.MailService = nil }()
+
+	u := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	reset := mailer.NewMessage([]string{u.Email}, "Reset", "Body")
+	reset.Category = mailer.CategorySecurity
+	recordMailAudit(u, u.Email, "reset password", reset)
+	activate := mailer.NewMessage([]string{"new@example.com"}, "Activate", "Body")
+	activate.Category = mailer.CategorySecurity
+	recordMailAudit(u, "new@example.com", "activate email", activate)
+
+	hook := MailAuditHook{}
+	hook.OnFailure(reset, errors.New("421 Try again later"), mailer.DeliveryDeferred)
+	hook.AfterSend(reset, 0)
+	hook.OnFailure(activate, errors.New("550 No such user"), mailer.DeliveryFailed)
+
+	// Other mails are not audited.
+	hook.AfterSend(mailer.NewMessage([]string{u.Email}, "Notification", "Body"), 0)
+
+	audits, err := GetMailAudits(u.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, audits, 2) {
+		assert.Equal(t, "reset password", audits[0].Kind)
+		assert.Equal(t, u.Email, audits[0].Email)
+		assert.Equal(t, reset.GetHeader("Message-ID")[0], audits[0].MessageID)
+		assert.Equal(t, mailer.DeliverySent, audits[0].Status)
+		assert.Empty(t, audits[0].Error)
+
+		assert.Equal(t, "new@example.com", audits[1].Email)
+		assert.Equal(t, mailer.DeliveryFailed, audits[1].Status)
+		assert.Equal(t, "550 No such user", audits[1].Error)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-xorm/xorm"
+)
+
+// MailBounce represents an address mails to bounced permanently.
+type MailBounce struct {
+	ID          int64  `xorm:"pk autoincr"`
+	Email       string `xorm:"UNIQUE NOT NULL"`
+	Count       int
+	Status      string
+	Reason      string    `xorm:"TEXT"`
+	Suppressed  bool      `xorm:"INDEX"`
+	Created     time.Time `xorm:"-"`
+	CreatedUnix int64
+	Updated     time.Time `xorm:"-"`
+	UpdatedUnix int64     `xorm:"INDEX"`
+}
+
+// BeforeInsert is invoked from XORM before inserting an object of this type.
+func (b *MailBounce) BeforeInsert() {
+	b.CreatedUnix = time.Now().Unix()
+	b.UpdatedUnix = b.CreatedUnix
+}
+
+// BeforeUpdate is invoked from XORM before updating this object.
+func (b *MailBounce) BeforeUpdate() {
+	b.UpdatedUnix = time.Now().Unix()
+}
+
+// AfterSet is invoked from XORM after setting the value of a field of this object.
+func (b *MailBounce) AfterSet(colName string, _ xorm.Cell) {
+	switch colName {
+	case "created_unix":
+		b.Created = time.Unix(b.CreatedUnix, 0).Local()
+	case "updated_unix":
+		b.Updated = time.Unix(b.UpdatedUnix, 0).Local()
+	}
+}
+
+// RecordMailBounce counts the permanent bounce of the address and suppresses
+// further mails to it once the configured threshold is reached. Complaints
+// of the recipient suppress the address at once, temporary failures are
+// ignored.
+func RecordMailBounce(b *mailer.Bounce) error {
+	if !b.Permanent && !b.Complaint {
+		return nil
+	}
+
+	email := strings.ToLower(strings.TrimSpace(b.Email))
+	if len(email) == 0 {
+		return nil
+	}
+
+	sess := x.NewSession()
+	defer sess.Close()
+	if err := sess.Begin(); err != nil {
+		return err
+	}
+
+	bounce := &MailBounce{Email: email}
+	has, err := sess.Get(bounce)
+	if err != nil {
+		return err
+	}
+	bounce.Count++
+	bounce.Status = b.Status
+	bounce.Reason = b.Reason
+	threshold := setting.MailService.BounceThreshold
+	if b.Complaint && !bounce.Suppressed {
+		bounce.Suppressed = true
+		log.Info("Mails to %s are suppressed after a complaint", email)
+	} else if threshold > 0 && bounce.Count >= threshold && !bounce.Suppressed {
+		bounce.Suppressed = true
+		log.Info("Mails to %s are suppressed after %d permanent bounces", email, bounce.Count)
+	}
+
+	if has {
+		_, err = sess.Id(bounce.ID).AllCols().Update(bounce)
+	} else {
+		_, err = sess.Insert(bounce)
+	}
+	if err != nil {
+		return err
+	}
+	return sess.Commit()
+}
+
+// minSecurityMailBounces is the number of bounces of a suppressed address
+// before security mails to it are suppressed too. A single bounce must not
+// keep users from resetting their password.
+const minSecurityMailBounces = 2
+
+// IsMailSuppressed returns true if mails of the category to the address are
+// suppressed, it is used as mailer.SuppressionChecker.
+func IsMailSuppressed(email string, category mailer.Category) bool {
+	bounce := new(MailBounce)
+	has, err := x.Where("email = ? AND suppressed = ?", strings.ToLower(email), true).Get(bounce)
+	if err != nil {
+		log.Error(4, "IsMailSuppressed: %v", err)
+		return false
+	}
+	if category == mailer.CategorySecurity {
+		return has && bounce.Count >= minSecurityMailBounces
+	}
+	return has
+}
+
+func mailBouncesByKeyword(keyword string) *xorm.Session {
+	sess := x.NewSession()
+	if len(keyword) > 0 {
+		sess.Where("email LIKE ?", "%"+strings.ToLower(keyword)+"%")
+	}
+	return sess
+}
+
+// CountMailBounces returns the number of bounced addresses matching the keyword.
+func CountMailBounces(keyword string) int64 {
+	count, _ := mailBouncesByKeyword(keyword).Count(new(MailBounce))
+	return count
+}
+
+// MailBounces returns the bounced addresses matching the keyword in given page,
+// the ones bounced most recently first.
+func MailBounces(keyword string, page, pageSize int) ([]*MailBounce, error) {
+	bounces := make([]*MailBounce, 0, pageSize)
+	return bounces, mailBouncesByKeyword(keyword).
+		Limit(pageSize, (page-1)*pageSize).
+		Desc("updated_unix").
+		Find(&bounces)
+}
+
+// DeleteMailBounce clears the bounces of the address of given ID, mails to it
+// are sent again.
+func DeleteMailBounce(id int64) error {
+	_, err := x.Id(id).Delete(new(MailBounce))
+	return err
+}
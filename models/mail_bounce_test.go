@@ -0,0 +1,56 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordMailBounce(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	setting.MailService = &setting.Mailer{BounceThreshold: 2}
+	defer func() { setting.MailService = nil }()
+
+	assert.NoError(t, RecordMailBounce(&mailer.Bounce{Email: "bounced@example.com", Status: "4.2.2"}))
+	assert.EqualValues(t, 0, CountMailBounces(""))
+
+	assert.NoError(t, RecordMailBounce(&mailer.Bounce{Email: "Bounced@example.com", Status: "5.1.1", Permanent: true}))
+	assert.False(t, IsMailSuppressed("bounced@example.com", mailer.CategoryNotification))
+
+	assert.NoError(t, RecordMailBounce(&mailer.Bounce{Email: "bounced@example.com", Status: "5.1.2", Reason: "unknown", Permanent: true}))
+	assert.True(t, IsMailSuppressed("Bounced@example.com", mailer.CategoryNotification))
+	assert.False(t, IsMailSuppressed("user@example.com", mailer.CategoryNotification))
+
+	bounces, err := MailBounces("bounced", 1, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, bounces, 1) {
+		assert.Equal(t, "bounced@example.com", bounces[0].Email)
+		assert.Equal(t, 2, bounces[0].Count)
+		assert.Equal(t, "5.1.2", bounces[0].Status)
+		assert.Equal(t, "unknown", bounces[0].Reason)
+
+		assert.NoError(t, DeleteMailBounce(bounces[0].ID))
+		assert.False(t, IsMailSuppressed("bounced@example.com", mailer.CategoryNotification))
+	}
+}
+
+func TestRecordMailBounce_Complaint(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	setting.MailService = &setting.Mailer{BounceThreshold: 3}
+	defer func() { setting.MailService = nil }()
+
+	assert.NoError(t, RecordMailBounce(&mailer.Bounce{Email: "complained@example.com", Complaint: true}))
+	assert.True(t, IsMailSuppressed("complained@example.com", mailer.CategoryNotification))
+
+	// Security mails are suppressed only after a second bounce.
+	assert.False(t, IsMailSuppressed("complained@example.com", mailer.CategorySecurity))
+	assert.NoError(t, RecordMailBounce(&mailer.Bounce{Email: "complained@example.com", Status: "5.1.1", Permanent: true}))
+	assert.True(t, IsMailSuppressed("complained@example.com", mailer.CategorySecurity))
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// hasDeadline returns true if the deadline is set, milestones without one
+// are due on 9999-12-31.
+func hasDeadline(deadlineUnix int64) bool {
+	return deadlineUnix > 0 && time.Unix(deadlineUnix, 0).Year() != 9999
+}
+
+// mailCalendarUID returns the UID of the calendar event of the deadline of
+// an issue or milestone, invitations with it update the same event.
+func mailCalendarUID(local string) string {
+	return strings.Trim(mailer.MessageID(local+"/deadline"), "<>")
+}
+
+// sendDeadlineMail renders the invitation to the deadline for the user in
+// the language of the user and queues it. Invitations are never collected in digests, which would lose
+// the calendar event.
+func sendDeadlineMail(u *User, from string, data map[string]interface{}, ev *mailer.CalendarEvent, md mailer.Metadata) {
+	data["UnsubscribeAll"] = u.UnsubscribeURL(0)
+	data["i18n"] = mailLocale(u)
+
+	msg, err := newMailMessage([]string{u.Email}, from, mailNotifyDeadline, data["Subject"].(string), data)
+	if err != nil {
+		log.Error(3, "Template: %v", err)
+		return
+	}
+	msg.Info = fmt.Sprintf("UID: %d, deadline invitation", u.ID)
+	msg.Event = mailer.EventWatched
+	msg.SetMetadata(md)
+	msg.SetListUnsubscribe(u.UnsubscribeURL(0))
+	msg.SetCalendarEvent(ev)
+
+	if u.EncryptNotifyMail {
+		if msg, err = encryptNotifyMail(msg, u); err != nil {
+			log.Error(3, "Failed to encrypt deadline invitation [uid: %d]: %v", u.ID, err)
+			return
+		}
+	}
+	queueNotifyMail(u, msg)
+}
+
+// issueDeadlineReceivers returns the assignee, the watchers and the
+// participants of the issue who want mails about it, except the doer.
+func issueDeadlineReceivers(issue *Issue, doer *User) ([]*User, error) {
+	issueWatches, err := GetIssueWatchers(issue.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetIssueWatchers [issue_id: %d]: %v", issue.ID, err)
+	}
+	skip := map[int64]bool{doer.ID: true}
+	for _, iw := range issueWatches {
+		if !iw.IsWatching {
+			skip[iw.UserID] = true
+		}
+	}
+
+	receivers := make([]*User, 0, 10)
+	add := func(u *User, event mailer.Event) {
+		if skip[u.ID] || u.IsOrganization() || !u.WantsNotifyMail(event) {
+			return
+		}
+		skip[u.ID] = true
+		receivers = append(receivers, u)
+	}
+
+	if issue.Assignee != nil {
+		add(issue.Assignee, mailer.EventAssigned)
+	}
+	watchers, err := GetWatchers(issue.RepoID)
+	if err != nil {
+		return nil, fmt.Errorf("GetWatchers [repo_id: %d]: %v", issue.RepoID, err)
+	}
+	for _, w := range watchers {
+		if skip[w.UserID] {
+			continue
+		}
+		u, err := GetUserByID(w.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("GetUserByID [%d]: %v", w.UserID, err)
+		}
+		add(u, mailer.EventWatched)
+	}
+	participants, err := GetParticipantsByIssueID(issue.ID)
+	if err != nil {
+		return nil, fmt.Errorf("GetParticipantsByIssueID [issue_id: %d]: %v", issue.ID, err)
+	}
+	for _, u := range append(participants, issue.Poster) {
+		add(u, mailer.EventWatched)
+	}
+	return receivers, nil
+}
+
+// mailIssueDeadlineToParticipants sends the invitation to the deadline of the
+// issue to its receivers.
+func mailIssueDeadlineToParticipants(issue *Issue, doer *User) error {
+	if !setting.Service.EnableNotifyMail {
+		return nil
+	}
+	if err := issue.loadAttributes(x); err != nil {
+		return fmt.Errorf("loadAttributes: %v", err)
+	}
+	receivers, err := issueDeadlineReceivers(issue, doer)
+	if err != nil {
+		return err
+	}
+
+	ev := &mailer.CalendarEvent{
+		UID:         mailCalendarUID(issue.mailMessageID()),
+		Sequence:    issue.UpdatedUnix,
+		Summary:     issue.mailSubject(),
+		Description: issue.HTMLURL(),
+		URL:         issue.HTMLURL(),
+		Start:       issue.Deadline,
+		AllDay:      true,
+	}
+	md := mailer.Metadata{
+		Repository: issue.Repo.FullName(),
+		Sender:     doer.Name,
+		Issue:      issue.Index,
+	}
+	for _, u := range receivers {
+		sendDeadlineMail(u, mailer.FromUser(doer.DisplayName()), map[string]interface{}{
+			"Subject":  issue.mailSubject(),
+			"Title":    fmt.Sprintf("%s#%d", issue.Repo.FullName(), issue.Index),
+			"Deadline": issue.Deadline.Format("2006-01-02"),
+			"Link":     issue.HTMLURL(),
+		}, ev, md)
+	}
+	return nil
+}
+
+// getDueMilestones returns the open milestones due until the given time
+// whose deadline has not been mailed yet.
+func getDueMilestones(now, until time.Time) ([]*Milestone, error) {
+	milestones := make([]*Milestone, 0, 10)
+	return milestones, x.
+		Where("is_closed = ? AND deadline_unix > ? AND deadline_unix <= ?", false, now.Unix(), until.Unix()).
+		And("deadline_mailed_unix <> deadline_unix").
+		Asc("id").
+		Find(&milestones)
+}
+
+// SendMilestoneDeadlineMails sends the invitations to the deadlines of the
+// milestones due soon to the watchers of their repository, once for every
+// deadline.
+func SendMilestoneDeadlineMails() {
+	if !taskStatusTable.StartIfNotRunning(milestoneDeadlineMail) {
+		return
+	}
+	defer taskStatusTable.Stop(milestoneDeadlineMail)
+
+	if !setting.Service.EnableNotifyMail {
+		return
+	}
+
+	stop, ok := startMailLease(milestoneDeadlineMail)
+	if !ok {
+		return
+	}
+	defer stop()
+	log.Trace("Doing: MilestoneDeadlineMail")
+
+	now := time.Now()
+	milestones, err := getDueMilestones(now, now.Add(setting.Cron.MilestoneDeadlineMail.Lead))
+	if err != nil {
+		log.Error(4, "MilestoneDeadlineMail: get milestones: %v", err)
+		return
+	}
+	for _, m := range milestones {
+		// Marked first, so failures do not send the invitation repeatedly.
+		if err = markMilestoneDeadlineMailed(m); err != nil {
+			log.Error(4, "MilestoneDeadlineMail [id: %d]: %v", m.ID, err)
+		} else if err = sendMilestoneDeadlineMail(m, now); err != nil {
+			log.Error(4, "MilestoneDeadlineMail [id: %d]: %v", m.ID, err)
+		}
+	}
+}
+
+// markMilestoneDeadlineMailed records that the invitation to the current
+// deadline of the milestone is sent.
+func markMilestoneDeadlineMailed(m *Milestone) error {
+	m.DeadlineMailedUnix = m.DeadlineUnix
+	_, err := x.Id(m.ID).Cols("deadline_mailed_unix").Update(m)
+	return err
+}
+
+// sendMilestoneDeadlineMail sends the invitation to the deadline of the
+// milestone to the watchers of its repository.
+func sendMilestoneDeadlineMail(m *Milestone, now time.Time) error {
+	repo, err := GetRepositoryByID(m.RepoID)
+	if err != nil {
+		return fmt.Errorf("GetRepositoryByID [%d]: %v", m.RepoID, err)
+	}
+	watchers, err := GetWatchers(repo.ID)
+	if err != nil {
+		return fmt.Errorf("GetWatchers [repo_id: %d]: %v", repo.ID, err)
+	}
+
+	link := fmt.Sprintf("%s/milestones", repo.HTMLURL())
+	deadline := m.Deadline.Format("2006-01-02")
+	ev := &mailer.CalendarEvent{
+		UID:         mailCalendarUID(fmt.Sprintf("%s/milestones/%d", repo.FullName(), m.ID)),
+		Sequence:    now.Unix(),
+		Summary:     fmt.Sprintf("[%s] %s", repo.Name, m.Name),
+		Description: m.Content,
+		URL:         link,
+		Start:       m.Deadline,
+		AllDay:      true,
+	}
+	md := mailer.Metadata{Repository: repo.FullName()}
+	for _, w := range watchers {
+		u, err := GetUserByID(w.UserID)
+		if err != nil {
+			return fmt.Errorf("GetUserByID [%d]: %v", w.UserID, err)
+		}
+		if u.IsOrganization() || !u.WantsNotifyMail(mailer.EventWatched) {
+			continue
+		}
+		locale := mailLocale(u)
+		sendDeadlineMail(u, setting.MailService.From, map[string]interface{}{
+			"Subject":  locale.Tr("mail.milestone_deadline.subject", repo.Name, m.Name, deadline),
+			"Title":    locale.Tr("mail.milestone_deadline.title", repo.FullName(), m.Name),
+			"Deadline": deadline,
+			"Link":     link,
+		}, ev, md)
+	}
+	return nil
+}
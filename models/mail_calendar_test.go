@@ -0,0 +1,58 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDueMilestones(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+
+	now := time.Now()
+	m := AssertExistsAndLoadBean(t, &Milestone{ID: 1}).(*Milestone)
+	m.Deadline = now.Add(24 * time.Hour)
+	assert.NoError(t, UpdateMilestone(m))
+
+	ids := func() []int64 {
+		milestones, err := getDueMilestones(now, now.Add(72*time.Hour))
+		assert.NoError(t, err)
+		list := make([]int64, 0, len(milestones))
+		for _, m := range milestones {
+			list = append(list, m.ID)
+		}
+		return list
+	}
+	assert.Equal(t, []int64{1}, ids())
+
+	// The deadline is mailed once, until it changes.
+	m = AssertExistsAndLoadBean(t, &Milestone{ID: 1}).(*Milestone)
+	assert.NoError(t, markMilestoneDeadlineMailed(m))
+	assert.Empty(t, ids())
+	m.Deadline = now.Add(48 * time.Hour)
+	assert.NoError(t, UpdateMilestone(m))
+	assert.Equal(t, []int64{1}, ids())
+}
+
+func TestIssue_ChangeDeadline(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+
+	issue := AssertExistsAndLoadBean(t, &Issue{ID: 1}).(*Issue)
+	doer := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	assert.False(t, issue.HasDeadline())
+
+	deadline := time.Date(2017, 10, 12, 0, 0, 0, 0, time.Local)
+	assert.NoError(t, issue.ChangeDeadline(doer, deadline))
+	issue = AssertExistsAndLoadBean(t, &Issue{ID: 1}).(*Issue)
+	assert.True(t, issue.HasDeadline())
+	assert.Equal(t, deadline.Unix(), issue.DeadlineUnix)
+
+	assert.NoError(t, issue.ChangeDeadline(doer, time.Time{}))
+	issue = AssertExistsAndLoadBean(t, &Issue{ID: 1}).(*Issue)
+	assert.False(t, issue.HasDeadline())
+}
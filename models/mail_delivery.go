@@ -0,0 +1,142 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-xorm/xorm"
+)
+
+// MailDelivery represents a delivery attempt of an email.
+type MailDelivery struct {
+	ID          int64  `xorm:"pk autoincr"`
+	MessageID   string `xorm:"INDEX"`
+	Recipients  string `xorm:"TEXT"`
+	Subject     string
+	Category    string
+	Backend     string
+	Code        int
+	Error       string `xorm:"TEXT"`
+	Duration    int64  // In milliseconds.
+	Attempt     int
+	Status      mailer.DeliveryStatus
+	Created     time.Time `xorm:"-"`
+	CreatedUnix int64     `xorm:"INDEX"`
+}
+
+// BeforeInsert is invoked from XORM before inserting an object of this type.
+func (d *MailDelivery) BeforeInsert() {
+	d.CreatedUnix = time.Now().Unix()
+}
+
+// AfterSet is invoked from XORM after setting the value of a field of this object.
+func (d *MailDelivery) AfterSet(colName string, _ xorm.Cell) {
+	switch colName {
+	case "created_unix":
+		d.Created = time.Unix(d.CreatedUnix, 0).Local()
+	}
+}
+
+// NoticeMailCircuit creates a system notice when the delivery of mails is
+// paused or resumed, it is used as mailer.CircuitListener.
+func NoticeMailCircuit(state mailer.CircuitState, err error) {
+	desc := "Mail delivery resumed"
+	if state == mailer.CircuitOpen {
+		desc = fmt.Sprintf("Mail delivery paused after consecutive failures: %v", err)
+	}
+	if err := CreateNotice(NoticeMail, desc); err != nil {
+		log.Error(4, "CreateNotice: %v", err)
+	}
+}
+
+// RecordMailDelivery stores the delivery attempt, it is used as mailer.DeliveryRecorder.
+func RecordMailDelivery(d *mailer.Delivery) error {
+	_, err := x.Insert(&MailDelivery{
+		MessageID:  d.MessageID,
+		Recipients: strings.Join(d.Recipients, ", "),
+		Subject:    d.Subject,
+		Category:   string(d.Category),
+		Backend:    d.Backend,
+		Code:       d.Code,
+		Error:      d.Error,
+		Duration:   int64(d.Duration / time.Millisecond),
+		Attempt:    d.Attempt,
+		Status:     d.Status,
+	})
+	return err
+}
+
+// IsMailDeliveredTo checks whether the message was sent to the address
+// according to the delivery log.
+func IsMailDeliveredTo(messageID, email string) (bool, error) {
+	deliveries := make([]*MailDelivery, 0, 2)
+	if err := x.Where("message_id = ?", messageID).Cols("recipients").Find(&deliveries); err != nil {
+		return false, err
+	}
+	email = strings.ToLower(email)
+	for _, d := range deliveries {
+		for _, rcpt := range strings.Split(d.Recipients, ", ") {
+			if rcpt = strings.ToLower(rcpt); rcpt == email || strings.HasSuffix(rcpt, "<"+email+">") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func mailDeliveriesByKeyword(keyword string) *xorm.Session {
+	sess := x.NewSession()
+	if len(keyword) > 0 {
+		keyword = "%" + strings.ToLower(keyword) + "%"
+		sess.Where("LOWER(recipients) LIKE ?", keyword).
+			Or("LOWER(subject) LIKE ?", keyword).
+			Or("message_id LIKE ?", keyword)
+	}
+	return sess
+}
+
+// CountMailDeliveries returns the number of delivery attempts matching the keyword.
+func CountMailDeliveries(keyword string) int64 {
+	count, _ := mailDeliveriesByKeyword(keyword).Count(new(MailDelivery))
+	return count
+}
+
+// MailDeliveries returns the delivery attempts matching the keyword in given page,
+// the keyword is searched in the recipients, subject and message ID.
+func MailDeliveries(keyword string, page, pageSize int) ([]*MailDelivery, error) {
+	deliveries := make([]*MailDelivery, 0, pageSize)
+	return deliveries, mailDeliveriesByKeyword(keyword).
+		Limit(pageSize, (page-1)*pageSize).
+		Desc("id").
+		Find(&deliveries)
+}
+
+// DeleteOldMailDeliveries deletes the delivery attempts older than the retention period.
+func DeleteOldMailDeliveries() {
+	if !taskStatusTable.StartIfNotRunning(mailDeliveryCleanup) {
+		return
+	}
+	defer taskStatusTable.Stop(mailDeliveryCleanup)
+
+	stop, ok := startMailLease(mailDeliveryCleanup)
+	if !ok {
+		return
+	}
+	defer stop()
+
+	log.Trace("Doing: MailDeliveryCleanup")
+
+	olderThan := time.Now().Add(-setting.Cron.MailDeliveryCleanup.OlderThan).Unix()
+	if _, err := x.Where("created_unix < ?", olderThan).Delete(new(MailDelivery)); err != nil {
+		log.Error(4, "MailDeliveryCleanup: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/mailer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsMailDeliveredTo(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+
+	assert.NoError(t, RecordMailDelivery(&mailer.Delivery{
+		MessageID:  "<1500000000.abcdef@example.com>",
+		Recipients: []string{"user@example.com", "Other <other@example.com>"},
+		Status:     mailer.DeliverySent,
+	}))
+	for _, test := range []struct {
+		messageID, email string
+		expected         bool
+	}{
+		{"<1500000000.abcdef@example.com>", "User@example.com", true},
+		{"<1500000000.abcdef@example.com>", "other@example.com", true},
+		{"<1500000000.abcdef@example.com>", "unknown@example.com", false},
+		{"<1500000000.fedcba@example.com>", "user@example.com", false},
+	} {
+		sent, err := IsMailDeliveredTo(test.messageID, test.email)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, sent, "%s to %s", test.messageID, test.email)
+	}
+	_, err := x.Where("message_id = ?", "<1500000000.abcdef@example.com>").Delete(new(MailDelivery))
+	assert.NoError(t, err)
+}
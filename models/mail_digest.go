@@ -0,0 +1,194 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/go-xorm/xorm"
+)
+
+// Possible intervals of the notification mail digest.
+const (
+	MailDigestOff    = ""
+	MailDigestHourly = "hourly"
+	MailDigestDaily  = "daily"
+)
+
+// mailDigestLead is how long before they are due digests are composed,
+// they are scheduled with the mailer to be sent on time. It matches the
+// default schedule of the digest cron task.
+const mailDigestLead = 10 * time.Minute
+
+// MailDigestItem represents a notification collected for the next digest of a user.
+type MailDigestItem struct {
+	ID          int64 `xorm:"pk autoincr"`
+	UserID      int64 `xorm:"INDEX"`
+	Subject     string
+	Link        string
+	Doer        string
+	Body        string    `xorm:"TEXT"`
+	Created     time.Time `xorm:"-"`
+	CreatedUnix int64     `xorm:"INDEX"`
+}
+
+// BeforeInsert is invoked from XORM before inserting an object of this type.
+func (item *MailDigestItem) BeforeInsert() {
+	item.CreatedUnix = time.Now().Unix()
+}
+
+// AfterSet is invoked from XORM after setting the value of a field of this object.
+func (item *MailDigestItem) AfterSet(colName string, _ xorm.Cell) {
+	switch colName {
+	case "created_unix":
+		item.Created = time.Unix(item.CreatedUnix, 0).Local()
+	}
+}
+
+// addMailDigestItem collects the notification for the next digest of the user.
+func addMailDigestItem(u *User, item *MailDigestItem) error {
+	_, err := x.Insert(&MailDigestItem{
+		UserID:  u.ID,
+		Subject: item.Subject,
+		Link:    item.Link,
+		Doer:    item.Doer,
+		Body:    item.Body,
+	})
+	return err
+}
+
+// mailDigestItems returns all collected notifications of the user.
+func mailDigestItems(uid int64) ([]*MailDigestItem, error) {
+	items := make([]*MailDigestItem, 0, 10)
+	return items, x.Where("user_id = ?", uid).Asc("id").Find(&items)
+}
+
+// mailDigestDue returns the time the digest containing a notification
+// created at given time is due. Hourly digests are sent at the full hour,
+// daily digests at the configured hour of the day. Notifications of users
+// who turned the digest off are due immediately.
+func mailDigestDue(interval string, created time.Time) time.Time {
+	switch interval {
+	case MailDigestHourly:
+		return created.Truncate(time.Hour).Add(time.Hour)
+	case MailDigestDaily:
+		due := time.Date(created.Year(), created.Month(), created.Day(), setting.MailService.DigestHour, 0, 0, 0, created.Location())
+		if !due.After(created) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due
+	}
+	return created
+}
+
+// SendMailDigests composes the due digests of all users and schedules them
+// with the mailer.
+func SendMailDigests() {
+	if setting.MailService == nil || !setting.Service.EnableNotifyMail {
+		return
+	}
+	if !taskStatusTable.StartIfNotRunning(mailDigest) {
+		return
+	}
+	defer taskStatusTable.Stop(mailDigest)
+
+	stop, ok := startMailLease(mailDigest)
+	if !ok {
+		return
+	}
+	defer stop()
+
+	log.Trace("Doing: MailDigest")
+
+	userIDs := make([]int64, 0, 10)
+	if err := x.Table("mail_digest_item").Cols("user_id").
+		Distinct("user_id").
+		Find(&userIDs); err != nil {
+		log.Error(4, "MailDigest: get user IDs: %v", err)
+		return
+	}
+
+	until := time.Now().Add(mailDigestLead)
+	for _, uid := range userIDs {
+		if err := sendMailDigest(uid, until); err != nil {
+			log.Error(4, "MailDigest [uid: %d]: %v", uid, err)
+		}
+	}
+}
+
+// sendMailDigest sends a digest of the notifications of the user due until given time.
+func sendMailDigest(uid int64, until time.Time) error {
+	u, err := GetUserByID(uid)
+	if IsErrUserNotExist(err) {
+		_, err = x.Where("user_id = ?", uid).Delete(new(MailDigestItem))
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	items, err := mailDigestItems(uid)
+	if err != nil {
+		return err
+	}
+
+	var due time.Time
+	ids := make([]int64, 0, len(items))
+	included := items[:0]
+	for _, item := range items {
+		itemDue := mailDigestDue(u.NotifyMailDigest, item.Created)
+		// Digests due in the quiet hours collect everything until they are over.
+		if quietEnd := u.QuietUntil(itemDue); !quietEnd.IsZero() {
+			itemDue = quietEnd
+		}
+		if itemDue.After(until) {
+			continue
+		}
+		if itemDue.After(due) {
+			due = itemDue
+		}
+		ids = append(ids, item.ID)
+		included = append(included, item)
+	}
+	if len(included) == 0 {
+		return nil
+	}
+
+	locale := mailLocale(u)
+	subject := locale.Tr("mail.digest.subject", setting.AppName, len(included))
+	data := map[string]interface{}{
+		"i18n":           locale,
+		"Username":       u.DisplayName(),
+		"Items":          included,
+		"UnsubscribeAll": u.UnsubscribeURL(0),
+	}
+
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, mailNotifyDigest, subject, data)
+	if err != nil {
+		return fmt.Errorf("Template: %v", err)
+	}
+	msg.Info = fmt.Sprintf("UID: %d, digest of %d notifications", u.ID, len(included))
+	msg.Category = mailer.CategoryDigest
+	msg.SetListUnsubscribe(u.UnsubscribeURL(0))
+
+	if u.EncryptNotifyMail {
+		if msg, err = encryptNotifyMail(msg, u); err != nil {
+			return fmt.Errorf("encrypt: %v", err)
+		}
+	}
+
+	// The items are kept for the next run if the digest could not be queued,
+	// unless the user does not want to get it anyway.
+	if err = mailer.SendAt(msg, due); err != nil && err != mailer.ErrNoRecipients {
+		return fmt.Errorf("SendAt: %v", err)
+	}
+
+	_, err = x.In("id", ids).Delete(new(MailDigestItem))
+	return err
+}
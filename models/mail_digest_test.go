@@ -0,0 +1,67 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailDigestDue(t *testing.T) {
+	setting.MailService = &setting.Mailer{DigestHour: 8}
+	defer func() { setting.MailService = nil }()
+
+	created := time.Date(2017, 6, 1, 10, 25, 0, 0, time.UTC)
+	assert.Equal(t, created, mailDigestDue(MailDigestOff, created))
+	assert.Equal(t, time.Date(2017, 6, 1, 11, 0, 0, 0, time.UTC), mailDigestDue(MailDigestHourly, created))
+	assert.Equal(t, time.Date(2017, 6, 2, 8, 0, 0, 0, time.UTC), mailDigestDue(MailDigestDaily, created))
+
+	created = time.Date(2017, 6, 1, 7, 59, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2017, 6, 1, 8, 0, 0, 0, time.UTC), mailDigestDue(MailDigestDaily, created))
+}
+
+func TestAddMailDigestItem(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+
+	assert.NoError(t, addMailDigestItem(user, &MailDigestItem{
+		Subject: "[user2/repo1] issue1 (#1)",
+		Link:    "https://try.gitea.io/user2/repo1/issues/1",
+		Doer:    "user1",
+		Body:    "<p>content</p>",
+	}))
+
+	items, err := mailDigestItems(user.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, "[user2/repo1] issue1 (#1)", items[0].Subject)
+		assert.Equal(t, "user1", items[0].Doer)
+		assert.False(t, items[0].Created.IsZero())
+	}
+	_, err = x.Where("user_id = ?", user.ID).Delete(new(MailDigestItem))
+	assert.NoError(t, err)
+}
+
+func TestSendMailDigest_NotQueued(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	html, text := testMailTemplates()
+	assert.NoError(t, InitMailRender(html, text))
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	defer func() { setting.MailService = nil }()
+
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	assert.NoError(t, addMailDigestItem(user, &MailDigestItem{Subject: "[user2/repo1] issue1 (#1)"}))
+	defer x.Where("user_id = ?", user.ID).Delete(new(MailDigestItem))
+
+	// The mailer is not running, the items are kept for the next digest.
+	assert.Error(t, sendMailDigest(user.ID, time.Now().Add(mailDigestLead)))
+	items, err := mailDigestItems(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+}
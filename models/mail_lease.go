@@ -0,0 +1,110 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+const (
+	// mailLeaseTimeout is the time after which the lease of an instance
+	// which stopped renewing it, e.g. because it crashed, expires.
+	mailLeaseTimeout = 10 * time.Minute
+
+	// mailLeaseHold is the minimum time a lease is held, so the runs of
+	// other instances for the same schedule are skipped even if the
+	// task finishes quickly.
+	mailLeaseHold = time.Minute
+)
+
+// mailLeaseOwner identifies this instance in the leases.
+var mailLeaseOwner = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
+
+// MailLease is held by the instance running a scheduled mail task, like the
+// notification digests. Several instances sharing the database run every
+// task once instead of once per instance.
+type MailLease struct {
+	Name        string `xorm:"pk VARCHAR(50)"`
+	Owner       string `xorm:"NOT NULL"`
+	ExpiresUnix int64
+}
+
+// acquireMailLease takes the lease of the task until the time, if no other
+// instance holds it.
+func acquireMailLease(name string, until time.Time) (bool, error) {
+	now := time.Now().Unix()
+	lease := &MailLease{Name: name, Owner: mailLeaseOwner, ExpiresUnix: until.Unix()}
+	n, err := x.Where("name = ? AND (owner = ? OR expires_unix < ?)", name, mailLeaseOwner, now).
+		Cols("owner", "expires_unix").Update(lease)
+	if err != nil {
+		return false, err
+	} else if n > 0 {
+		return true, nil
+	}
+
+	if has, err := x.Get(&MailLease{Name: name}); err != nil {
+		return false, err
+	} else if has {
+		return false, nil
+	}
+	if _, err = x.Insert(lease); err != nil {
+		// Another instance inserted it first.
+		if has, _ := x.Get(&MailLease{Name: name}); has {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// startMailLease acquires the lease of the task and renews it until the
+// returned stop function is called. It reports false if the task runs on
+// another instance or the lease cannot be acquired.
+func startMailLease(name string) (stop func(), ok bool) {
+	start := time.Now()
+	ok, err := acquireMailLease(name, start.Add(mailLeaseTimeout))
+	if err != nil {
+		log.Error(4, "Failed to acquire lease %s: %v", name, err)
+		return nil, false
+	} else if !ok {
+		log.Trace("Skipping %s, it runs on another instance", name)
+		return nil, false
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(mailLeaseTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := acquireMailLease(name, time.Now().Add(mailLeaseTimeout)); err != nil {
+					log.Error(4, "Failed to renew lease %s: %v", name, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		until := start.Add(mailLeaseHold)
+		if now := time.Now(); now.After(until) {
+			until = now
+		}
+		if _, err := x.Where("name = ? AND owner = ?", name, mailLeaseOwner).
+			Cols("expires_unix").Update(&MailLease{ExpiresUnix: until.Unix()}); err != nil {
+			log.Error(4, "Failed to release lease %s: %v", name, err)
+		}
+	}, true
+}
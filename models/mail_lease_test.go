@@ -0,0 +1,40 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailLease(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	defer func(owner string) { mailLeaseOwner = owner }(mailLeaseOwner)
+
+	mailLeaseOwner = "this:1"
+	stop, ok := startMailLease("test_task")
+	assert.True(t, ok)
+
+	// Another instance skips the task while it runs and shortly after.
+	mailLeaseOwner = "other:1"
+	_, ok = startMailLease("test_task")
+	assert.False(t, ok)
+	mailLeaseOwner = "this:1"
+	stop()
+	mailLeaseOwner = "other:1"
+	_, ok = startMailLease("test_task")
+	assert.False(t, ok)
+
+	// The lease expires.
+	_, err := x.Id("test_task").Cols("expires_unix").Update(&MailLease{ExpiresUnix: time.Now().Add(-time.Second).Unix()})
+	assert.NoError(t, err)
+	stop, ok = startMailLease("test_task")
+	assert.True(t, ok)
+	stop()
+	lease := AssertExistsAndLoadBean(t, &MailLease{Name: "test_task"}).(*MailLease)
+	assert.Equal(t, "other:1", lease.Owner)
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// notifyMailLimits counts the notification mails caused by each user since
+// the start of the current USER_NOTIFY_LIMIT_PERIOD.
+var notifyMailLimits = struct {
+	sync.Mutex
+	start   time.Time
+	counts  map[int64]int
+	tripped map[int64]bool
+}{}
+
+// allowNotifyMails reserves n notification mails caused by the doer and
+// returns false if they exceed USER_NOTIFY_LIMIT. The first time a user
+// exceeds the limit within a period the admins get a system notice.
+func allowNotifyMails(doer *User, n int) bool {
+	if setting.MailService == nil || doer == nil || doer.IsAdmin {
+		return true
+	}
+	limit := setting.MailService.UserNotifyLimit
+	if limit <= 0 {
+		return true
+	}
+
+	l := &notifyMailLimits
+	l.Lock()
+	now := time.Now()
+	if l.counts == nil || now.Sub(l.start) >= setting.MailService.UserNotifyLimitPeriod {
+		l.start = now
+		l.counts = make(map[int64]int)
+		l.tripped = make(map[int64]bool)
+	}
+	if l.counts[doer.ID]+n <= limit {
+		l.counts[doer.ID] += n
+		l.Unlock()
+		return true
+	}
+	tripped := l.tripped[doer.ID]
+	l.tripped[doer.ID] = true
+	l.Unlock()
+
+	log.Warn("Dropping %d notification mails caused by %s [uid: %d], exceeding the limit of %d per %v",
+		n, doer.Name, doer.ID, limit, setting.MailService.UserNotifyLimitPeriod)
+	if !tripped {
+		desc := fmt.Sprintf("Notification mails caused by %s exceeded the limit of %d per %v and are dropped",
+			doer.Name, limit, setting.MailService.UserNotifyLimitPeriod)
+		if err := CreateNotice(NoticeMail, desc); err != nil {
+			log.Error(4, "CreateNotice: %v", err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowNotifyMails(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	setting.MailService = &setting.Mailer{UserNotifyLimit: 3, UserNotifyLimitPeriod: time.Hour}
+	defer func() { setting.MailService = nil }()
+	notifyMailLimits.counts = nil
+
+	admin := AssertExistsAndLoadBean(t, &User{ID: 1}).(*User)
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	notices := CountNotices()
+
+	assert.True(t, allowNotifyMails(user, 2))
+	assert.True(t, allowNotifyMails(user, 1))
+	assert.False(t, allowNotifyMails(user, 1))
+	assert.False(t, allowNotifyMails(user, 1))
+	assert.True(t, allowNotifyMails(admin, 10))
+
+	// The admins get a single notice per period.
+	assert.Equal(t, notices+1, CountNotices())
+	AssertExistsAndLoadBean(t, &Notice{Type: NoticeMail})
+
+	notifyMailLimits.start = time.Now().Add(-time.Hour)
+	assert.True(t, allowNotifyMails(user, 3))
+}
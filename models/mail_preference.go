@@ -0,0 +1,101 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"time"
+
+	"code.gitea.io/gitea/modules/mailer"
+)
+
+// Possible choices of the events users get notification mails for.
+const (
+	NotifyMailAll      = ""
+	NotifyMailAssigned = "assigned"
+	NotifyMailMentions = "mentions"
+	NotifyMailNone     = "none"
+)
+
+// WantsNotifyMail reports whether the user wants to get notification
+// mails for the event. Users who chose assigned issues get mentions too.
+func (u *User) WantsNotifyMail(event mailer.Event) bool {
+	switch u.NotifyMailEvents {
+	case NotifyMailNone:
+		return false
+	case NotifyMailMentions:
+		return event == mailer.EventMention
+	case NotifyMailAssigned:
+		return event == mailer.EventMention || event == mailer.EventAssigned
+	}
+	return true
+}
+
+// ResolveMailPreference reports whether the owner of the address wants to get
+// notification mails for the event, it is used as mailer.PreferenceResolver.
+// Addresses not belonging to a user are not filtered.
+func ResolveMailPreference(to string, event mailer.Event) bool {
+	u, err := GetUserByEmail(to)
+	if err != nil {
+		return true
+	}
+	return u.WantsNotifyMail(event)
+}
+
+// ResolveMailTracking reports whether the owner of the address allows to
+// track the mails, it is used as mailer.TrackingResolver. Addresses not
+// belonging to a user are tracked.
+func ResolveMailTracking(to string) bool {
+	u, err := GetUserByEmail(to)
+	if err != nil {
+		return true
+	}
+	return !u.DisableMailTracking
+}
+
+// TimeLocation returns the time zone of the user, the server time zone if none
+// or an unknown one is set.
+func (u *User) TimeLocation() *time.Location {
+	if len(u.Timezone) == 0 {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// QuietUntil returns the end of the quiet hours of the user if given
+// time is within them, the zero time otherwise. The quiet hours are disabled
+// if they start and end at the same hour.
+func (u *User) QuietUntil(t time.Time) time.Time {
+	start, end := u.QuietHoursStart, u.QuietHoursEnd
+	if start == end {
+		return time.Time{}
+	}
+
+	local := t.In(u.TimeLocation())
+	hour := local.Hour()
+	if start < end && (hour < start || hour >= end) ||
+		start > end && hour < start && hour >= end {
+		return time.Time{}
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end, 0, 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until
+}
+
+// queueNotifyMail queues the notification mail to the user, it is held back
+// by the mailer until the quiet hours of the user are over.
+func queueNotifyMail(u *User, msg *mailer.Message) {
+	if until := u.QuietUntil(time.Now()); !until.IsZero() {
+		mailer.SendAt(msg, until)
+		return
+	}
+	mailer.SendAsync(msg)
+}
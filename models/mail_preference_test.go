@@ -0,0 +1,60 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/mailer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUser_WantsNotifyMail(t *testing.T) {
+	events := []mailer.Event{mailer.EventMention, mailer.EventAssigned, mailer.EventWatched}
+	for choice, wanted := range map[string][]bool{
+		NotifyMailAll:      {true, true, true},
+		NotifyMailAssigned: {true, true, false},
+		NotifyMailMentions: {true, false, false},
+		NotifyMailNone:     {false, false, false},
+	} {
+		u := &User{NotifyMailEvents: choice}
+		for i, event := range events {
+			assert.Equal(t, wanted[i], u.WantsNotifyMail(event), "%q: %s", choice, event)
+		}
+	}
+}
+
+func TestResolveMailPreference(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	assert.True(t, ResolveMailPreference(user.Email, mailer.EventWatched))
+	assert.True(t, ResolveMailPreference("nobody@example.com", mailer.EventWatched))
+
+	user.NotifyMailEvents = NotifyMailMentions
+	assert.NoError(t, UpdateUser(user))
+	assert.False(t, ResolveMailPreference(user.Email, mailer.EventWatched))
+	assert.True(t, ResolveMailPreference(user.Email, mailer.EventMention))
+}
+
+func TestUser_QuietUntil(t *testing.T) {
+	u := &User{QuietHoursStart: 22, QuietHoursEnd: 7, Timezone: "UTC"}
+	night := time.Date(2017, 6, 1, 23, 30, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2017, 6, 2, 7, 0, 0, 0, time.UTC), u.QuietUntil(night))
+	morning := time.Date(2017, 6, 2, 6, 59, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2017, 6, 2, 7, 0, 0, 0, time.UTC), u.QuietUntil(morning))
+	assert.True(t, u.QuietUntil(time.Date(2017, 6, 2, 7, 0, 0, 0, time.UTC)).IsZero())
+	assert.True(t, u.QuietUntil(time.Date(2017, 6, 2, 12, 0, 0, 0, time.UTC)).IsZero())
+
+	// Quiet hours are in the time zone of the user.
+	u = &User{QuietHoursStart: 12, QuietHoursEnd: 14, Timezone: "Asia/Tokyo"}
+	noon := time.Date(2017, 6, 2, 3, 30, 0, 0, time.UTC) // 12:30 in Tokyo
+	assert.True(t, u.QuietUntil(noon).Equal(time.Date(2017, 6, 2, 5, 0, 0, 0, time.UTC)))
+	assert.True(t, u.QuietUntil(noon.Add(-time.Hour)).IsZero())
+
+	u = &User{QuietHoursStart: 8, QuietHoursEnd: 8}
+	assert.True(t, u.QuietUntil(night).IsZero())
+}
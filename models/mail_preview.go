@@ -0,0 +1,153 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/Unknwon/i18n"
+)
+
+// previewMailCode is the activation code and token of the sample data, so
+// previews sent by mail do not contain valid codes.
+const previewMailCode = "0123456789abcdef"
+
+// previewMailBody is the markdown of the sample issues and comments.
+const previewMailBody = "Sample content with **markdown**, `code` and [a link](https://gitea.io).\n\n> A quote\n\n```\ngo build\n```"
+
+// MailTemplateNames returns the names of the mail templates, e.g. issue/comment.
+func MailTemplateNames() []string {
+	names := make([]string, len(mailTemplateNames))
+	for i, name := range mailTemplateNames {
+		names[i] = string(name)
+	}
+	return names
+}
+
+// MailPreview is a mail template rendered with sample data.
+type MailPreview struct {
+	Name    string
+	Subject string
+	HTML    string // As sent, with the theme and the inlined style sheets.
+	Text    string // Rendered by NAME.text or generated from the HTML body.
+
+	msg *mailer.Message
+}
+
+// PreviewMail renders the mail template with sample data in the language as
+// a mail to the user, who is also the sender of the sample notifications.
+func PreviewMail(name, lang string, u *User) (*MailPreview, error) {
+	tpl := base.TplName(name)
+	found := false
+	for _, n := range mailTemplateNames {
+		found = found || n == tpl
+	}
+	if !found {
+		return nil, fmt.Errorf("mail template %s not found", name)
+	}
+
+	locale := i18n.Locale{Lang: lang}
+	subject, data := previewMailData(tpl, locale, u)
+	data["i18n"] = locale
+	msg, err := newMailMessage([]string{u.Email}, setting.MailService.From, tpl, subject, data)
+	if err != nil {
+		return nil, err
+	}
+	msg.Info = fmt.Sprintf("UID: %d, preview of %s", u.ID, name)
+
+	text, html := msg.Bodies()
+	return &MailPreview{
+		Name:    name,
+		Subject: msg.GetHeader("Subject")[0],
+		HTML:    html,
+		Text:    text,
+		msg:     msg,
+	}, nil
+}
+
+// Send sends the preview to the user it was rendered for.
+func (p *MailPreview) Send() {
+	mailer.SendAsync(p.msg)
+}
+
+// previewMailData returns the subject and the sample data of the mail template.
+func previewMailData(name base.TplName, locale i18n.Locale, u *User) (string, map[string]interface{}) {
+	repo := &Repository{OwnerID: u.ID, Owner: u, Name: "example", LowerName: "example", Units: []*RepoUnit{}}
+	issue := &Issue{Repo: repo, Index: 1, Title: "Sample issue", Poster: u, Content: previewMailBody}
+	comment := &Comment{Poster: u, Content: previewMailBody}
+	unsubscribe := setting.AppURL + "user/unsubscribe/" + previewMailCode
+
+	switch name {
+	case mailAuthActivate, mailAuthActivateEmail, mailAuthResetPassword, mailAuthRegisterNotify:
+		subjects := map[base.TplName]string{
+			mailAuthActivate:       "mail.activate_account",
+			mailAuthActivateEmail:  "mail.activate_email",
+			mailAuthResetPassword:  "mail.reset_password",
+			mailAuthRegisterNotify: "mail.register_notify",
+		}
+		return locale.Tr(subjects[name]), map[string]interface{}{
+			"Username":          u.DisplayName(),
+			"ActiveCodeLives":   base.MinutesToFriendly(setting.Service.ActiveCodeLives),
+			"ResetPwdCodeLives": base.MinutesToFriendly(setting.Service.ResetPwdCodeLives),
+			"Code":              previewMailCode,
+			"Email":             u.Email,
+		}
+	case mailNotifyCollaborator:
+		return locale.Tr("mail.collaborator.subject", u.DisplayName(), repo.FullName()), map[string]interface{}{
+			"RepoName":       repo.FullName(),
+			"Repo":           repo,
+			"Doer":           u,
+			"Link":           repo.HTMLURL(),
+			"UnsubscribeAll": unsubscribe,
+		}
+	case mailNotifyDigest:
+		items := []*MailDigestItem{
+			composeIssueDigestItem(issue, u, nil),
+			composeIssueDigestItem(issue, u, comment),
+		}
+		for i, item := range items {
+			item.Created = time.Now().Add(-time.Duration(len(items)-i) * time.Hour)
+		}
+		return locale.Tr("mail.digest.subject", setting.AppName, len(items)), map[string]interface{}{
+			"Username":       u.DisplayName(),
+			"Items":          items,
+			"UnsubscribeAll": unsubscribe,
+		}
+	case mailNotifyAnnouncement:
+		item := composeIssueDigestItem(issue, u, nil)
+		return "Sample announcement", composeTplData("Sample announcement", item.Body, setting.AppURL)
+	case mailNotifyEncryptKey:
+		return locale.Tr("mail.encrypt_key.subject", setting.AppName), map[string]interface{}{
+			"Link":           setting.AppURL + "user/settings/keys",
+			"UnsubscribeAll": unsubscribe,
+		}
+	case mailNotifyDeadline:
+		return issue.mailSubject(), map[string]interface{}{
+			"Title":          fmt.Sprintf("%s#%d", repo.FullName(), issue.Index),
+			"Deadline":       time.Now().AddDate(0, 0, 1).Format("2006-01-02"),
+			"Link":           issue.HTMLURL(),
+			"UnsubscribeAll": unsubscribe,
+		}
+	}
+
+	// Issue comments and mentions.
+	item := composeIssueDigestItem(issue, u, nil)
+	data := composeTplData(item.Subject, item.Body, item.Link)
+	data["Doer"] = u
+	data["Issue"] = issue
+	data["Repo"] = repo
+	data["Comment"] = comment
+	data["UnsubscribeThread"] = unsubscribe
+	data["UnsubscribeAll"] = unsubscribe
+	if len(u.ReplyToAddress(issue.ID)) > 0 {
+		data["ReplyToken"] = previewMailCode
+	}
+	return item.Subject, data
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+	texttmpl "text/template"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewMail(t *testing.T) {
+	html, text := testMailTemplates()
+	texttmpl.Must(text.New(string(mailNotifyDigest) + mailTextSuffix).Parse("{{len .Items}} notifications"))
+	assert.NoError(t, InitMailRender(html, text))
+
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	defer func() { setting.MailService = nil }()
+	setting.AppURL = "https://try.gitea.io/"
+	u := &User{ID: 2, Name: "user2", Email: "user2@example.com"}
+
+	assert.Len(t, MailTemplateNames(), len(mailTemplateNames))
+	for _, name := range MailTemplateNames() {
+		preview, err := PreviewMail(name, "en-US", u)
+		assert.NoError(t, err)
+		assert.Equal(t, name, preview.Name)
+		assert.NotEmpty(t, preview.Subject)
+		assert.Contains(t, preview.HTML, preview.Subject)
+		assert.NotEmpty(t, preview.Text)
+	}
+
+	preview, err := PreviewMail(string(mailIssueComment), "en-US", u)
+	assert.NoError(t, err)
+	assert.Equal(t, "[example] Sample issue (#1)", preview.Subject)
+	assert.Contains(t, preview.HTML, "&lt;strong&gt;markdown&lt;/strong&gt;")
+
+	preview, err = PreviewMail(string(mailNotifyDigest), "en-US", u)
+	assert.NoError(t, err)
+	assert.Equal(t, "2 notifications", preview.Text)
+
+	_, err = PreviewMail("unknown", "en-US", u)
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// ReplyToken returns the signed token identifying the user and the issue
+// of given ID in replies to notification mails.
+func (u *User) ReplyToken(issueID int64) string {
+	return u.mailToken("reply", issueID)
+}
+
+// ReplyToAddress returns the address the user can send replies to for
+// commenting on the issue of given ID, it is empty if replying by mail
+// is disabled.
+func (u *User) ReplyToAddress(issueID int64) string {
+	if setting.IncomingMail == nil {
+		return ""
+	}
+	return strings.Replace(setting.IncomingMail.ReplyToAddress, "%{token}", u.ReplyToken(issueID), 1)
+}
+
+// VerifyReplyToken returns the user and the issue of a valid reply token.
+func VerifyReplyToken(token string) (*User, *Issue, error) {
+	u, issueID, err := verifyMailToken("reply", token)
+	if err != nil {
+		return nil, nil, err
+	} else if u == nil || issueID == 0 {
+		return nil, nil, ErrReplyTokenInvalid{token}
+	}
+
+	issue, err := GetIssueByID(issueID)
+	if IsErrIssueNotExist(err) {
+		return nil, nil, ErrReplyTokenInvalid{token}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return u, issue, nil
+}
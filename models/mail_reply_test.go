@@ -0,0 +1,46 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyReplyToken(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+
+	u, issue, err := VerifyReplyToken(user.ReplyToken(1))
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, u.ID)
+	assert.EqualValues(t, 1, issue.ID)
+
+	for _, token := range []string{
+		"",
+		user.ReplyToken(0),
+		user.ReplyToken(1000),
+		user.UnsubscribeToken(1),
+	} {
+		_, _, err = VerifyReplyToken(token)
+		assert.True(t, IsErrReplyTokenInvalid(err), token)
+	}
+}
+
+func TestUser_ReplyToAddress(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+
+	assert.Empty(t, user.ReplyToAddress(1))
+
+	setting.IncomingMail = &setting.IncomingMailer{ReplyToAddress: "incoming+%{token}@example.com"}
+	defer func() {
+		setting.IncomingMail = nil
+	}()
+	assert.Equal(t, "incoming+"+user.ReplyToken(1)+"@example.com", user.ReplyToAddress(1))
+}
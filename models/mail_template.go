@@ -0,0 +1,132 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+	texttmpl "text/template"
+
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/Unknwon/i18n"
+)
+
+// Suffixes of the text templates rendering the subject and the plain text
+// body of the mail template without the suffix, e.g. issue/comment.subject.
+const (
+	mailSubjectSuffix = ".subject"
+	mailTextSuffix    = ".text"
+)
+
+// mailTemplateNames are the HTML templates the mails are rendered with.
+var mailTemplateNames = []base.TplName{
+	mailAuthActivate,
+	mailAuthActivateEmail,
+	mailAuthResetPassword,
+	mailAuthRegisterNotify,
+	mailIssueComment,
+	mailIssueMention,
+	mailNotifyCollaborator,
+	mailNotifyDigest,
+	mailNotifyAnnouncement,
+	mailNotifyDeadline,
+	mailNotifyEncryptKey,
+}
+
+var (
+	mailTemplateLock sync.RWMutex
+	templates        *template.Template
+	textTemplates    *texttmpl.Template
+)
+
+// InitMailRender checks that all mail templates are defined and uses them
+// for the mails sent from now on. It is called again when the templates are
+// reloaded.
+func InitMailRender(html *template.Template, text *texttmpl.Template) error {
+	for _, name := range mailTemplateNames {
+		if html.Lookup(string(name)) == nil {
+			return fmt.Errorf("mail template %s not found", name)
+		}
+	}
+
+	mailTemplateLock.Lock()
+	templates, textTemplates = html, text
+	mailTemplateLock.Unlock()
+	return nil
+}
+
+// mailTemplates returns the current templates of the mails.
+func mailTemplates() (*template.Template, *texttmpl.Template) {
+	mailTemplateLock.RLock()
+	defer mailTemplateLock.RUnlock()
+	return templates, textTemplates
+}
+
+// mailLocale returns the locale of the mails to the user, the default language
+// of the instance for addresses without user and users without or with an
+// unknown language.
+func mailLocale(u *User) i18n.Locale {
+	if u != nil && len(u.Language) > 0 && i18n.IsExist(u.Language) {
+		return i18n.Locale{Lang: u.Language}
+	}
+	if len(setting.Langs) > 0 {
+		return i18n.Locale{Lang: setting.Langs[0]}
+	}
+	return i18n.Locale{}
+}
+
+// renderMail renders the mail template with the data, which gets the
+// subject as .Subject and the default locale as .i18n unless it has one. Unless the template NAME.subject overrides it, the
+// subject is returned as is. The plain text body is rendered by NAME.text if
+// defined, else it is empty and generated from the HTML body by the mailer.
+func renderMail(name base.TplName, subject string, data map[string]interface{}) (_, html, text string, err error) {
+	htmlTpls, textTpls := mailTemplates()
+	data["Subject"] = subject
+	if _, ok := data["i18n"]; !ok {
+		data["i18n"] = mailLocale(nil)
+	}
+
+	var buf bytes.Buffer
+	if err = htmlTpls.ExecuteTemplate(&buf, string(name), data); err != nil {
+		return "", "", "", err
+	}
+	html = buf.String()
+
+	if tpl := textTpls.Lookup(string(name) + mailSubjectSuffix); tpl != nil {
+		buf.Reset()
+		if err = tpl.Execute(&buf, data); err != nil {
+			return "", "", "", err
+		}
+		subject = strings.TrimSpace(buf.String())
+	}
+	if tpl := textTpls.Lookup(string(name) + mailTextSuffix); tpl != nil {
+		buf.Reset()
+		if err = tpl.Execute(&buf, data); err != nil {
+			return "", "", "", err
+		}
+		text = buf.String()
+	}
+	return subject, html, text, nil
+}
+
+// newMailMessage renders the mail template with the data as message from
+// the sender to the receivers.
+func newMailMessage(tos []string, from string, name base.TplName, subject string, data map[string]interface{}) (*mailer.Message, error) {
+	subject, html, text, err := renderMail(name, subject, data)
+	if err != nil {
+		return nil, fmt.Errorf("render %s: %v", name, err)
+	}
+	msg := mailer.NewMessageFrom(tos, from, subject, html)
+	if len(text) > 0 {
+		msg.SetTextBody(text)
+	}
+	return msg, nil
+}
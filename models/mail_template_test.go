@@ -0,0 +1,83 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"html/template"
+	"testing"
+	texttmpl "text/template"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/Unknwon/i18n"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMailTemplates() (*template.Template, *texttmpl.Template) {
+	html := template.New("")
+	for _, name := range mailTemplateNames {
+		template.Must(html.New(string(name)).Parse(`<p>{{.Subject}}: {{.Body}}</p>`))
+	}
+	return html, texttmpl.New("")
+}
+
+func TestInitMailRender(t *testing.T) {
+	html, text := testMailTemplates()
+	assert.NoError(t, InitMailRender(html, text))
+
+	missing := template.Must(template.New("").New(string(mailAuthActivate)).Parse("activate"))
+	assert.Error(t, InitMailRender(missing, text))
+
+	// The previous templates stay in use.
+	current, _ := mailTemplates()
+	assert.Equal(t, html, current)
+}
+
+func TestRenderMail(t *testing.T) {
+	html, text := testMailTemplates()
+	assert.NoError(t, InitMailRender(html, text))
+
+	data := map[string]interface{}{"Body": "<b>content</b>"}
+	subject, body, plain, err := renderMail(mailIssueComment, "[user2/repo1] issue1 (#1)", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "[user2/repo1] issue1 (#1)", subject)
+	assert.Equal(t, "<p>[user2/repo1] issue1 (#1): &lt;b&gt;content&lt;/b&gt;</p>", body)
+	assert.Empty(t, plain)
+
+	texttmpl.Must(text.New(string(mailIssueComment) + mailSubjectSuffix).Parse("Re: {{.Subject}}\n"))
+	texttmpl.Must(text.New(string(mailIssueComment) + mailTextSuffix).Parse("{{.Body}}"))
+	subject, _, plain, err = renderMail(mailIssueComment, "[user2/repo1] issue1 (#1)", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "Re: [user2/repo1] issue1 (#1)", subject)
+	assert.Equal(t, "<b>content</b>", plain)
+}
+
+func TestMailLocale(t *testing.T) {
+	assert.NoError(t, i18n.SetMessage("en-US", []byte("[mail]\nhi_user = Hi <b>%s</b>,")))
+	assert.NoError(t, i18n.SetMessage("de-DE", []byte("[mail]\nhi_user = Hallo <b>%s</b>,")))
+	defer func(langs []string) { setting.Langs = langs }(setting.Langs)
+	setting.Langs = []string{"en-US", "de-DE"}
+
+	assert.Equal(t, "en-US", mailLocale(nil).Lang)
+	assert.Equal(t, "en-US", mailLocale(&User{}).Lang)
+	assert.Equal(t, "en-US", mailLocale(&User{Language: "xx-XX"}).Lang)
+	assert.Equal(t, "de-DE", mailLocale(&User{Language: "de-DE"}).Lang)
+
+	html, text := testMailTemplates()
+	html.Funcs(template.FuncMap{"Str2html": func(s string) template.HTML { return template.HTML(s) }})
+	template.Must(html.New(string(mailAuthRegisterNotify)).Parse(`{{.i18n.Tr "mail.hi_user" .Username | Str2html}}`))
+	assert.NoError(t, InitMailRender(html, text))
+
+	_, body, _, err := renderMail(mailAuthRegisterNotify, "", map[string]interface{}{"Username": "user2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi <b>user2</b>,", body)
+
+	_, body, _, err = renderMail(mailAuthRegisterNotify, "", map[string]interface{}{
+		"Username": "user2",
+		"i18n":     mailLocale(&User{Language: "de-DE"}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hallo <b>user2</b>,", body)
+}
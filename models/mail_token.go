@@ -0,0 +1,55 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/Unknwon/com"
+)
+
+// mailTokenSignature signs the purpose, user and issue ID of a mail token.
+// The random string of the user is included, so changing the password
+// invalidates all tokens of the user. The signature is shortened to 128 bits
+// to keep the token usable as part of an address.
+func (u *User) mailTokenSignature(purpose string, issueID int64) string {
+	mac := hmac.New(sha256.New, []byte(setting.SecretKey))
+	fmt.Fprintf(mac, "%s:%d:%d:%s", purpose, u.ID, issueID, u.Rands)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// mailToken returns the token sent in mails to the user, which allows an
+// action on the issue of given ID without signing in.
+func (u *User) mailToken(purpose string, issueID int64) string {
+	return fmt.Sprintf("%d.%d.%s", u.ID, issueID, u.mailTokenSignature(purpose, issueID))
+}
+
+// verifyMailToken returns the user and the issue ID of the token, the user
+// is nil if the token is invalid.
+func verifyMailToken(purpose, token string) (*User, int64, error) {
+	fields := strings.Split(token, ".")
+	if len(fields) != 3 {
+		return nil, 0, nil
+	}
+	uid := com.StrTo(fields[0]).MustInt64()
+	issueID := com.StrTo(fields[1]).MustInt64()
+
+	u, err := GetUserByID(uid)
+	if IsErrUserNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if !hmac.Equal([]byte(strings.ToLower(fields[2])), []byte(u.mailTokenSignature(purpose, issueID))) {
+		return nil, 0, nil
+	}
+	return u, issueID, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// UnsubscribeToken returns the signed token to mute the issue of given ID,
+// or all notification mails if it is 0, without signing in.
+func (u *User) UnsubscribeToken(issueID int64) string {
+	return u.mailToken("unsubscribe", issueID)
+}
+
+// UnsubscribeURL returns the link to unsubscribe with the token.
+func (u *User) UnsubscribeURL(issueID int64) string {
+	return setting.AppURL + "user/unsubscribe/" + u.UnsubscribeToken(issueID)
+}
+
+// VerifyUnsubscribeToken returns the user and the issue ID of a valid unsubscribe token.
+func VerifyUnsubscribeToken(token string) (*User, int64, error) {
+	u, issueID, err := verifyMailToken("unsubscribe", token)
+	if err != nil {
+		return nil, 0, err
+	} else if u == nil {
+		return nil, 0, ErrUnsubscribeTokenInvalid{token}
+	}
+	return u, issueID, nil
+}
+
+// UnsubscribeNotifyMail stops the notification mails of the issue of given ID
+// to the user, or all notification mails if it is 0.
+func UnsubscribeNotifyMail(u *User, issueID int64) error {
+	if issueID > 0 {
+		return CreateOrUpdateIssueWatch(u.ID, issueID, false)
+	}
+	u.NotifyMailEvents = NotifyMailNone
+	_, err := x.Id(u.ID).Cols("notify_mail_events").Update(u)
+	return err
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyUnsubscribeToken(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+
+	u, issueID, err := VerifyUnsubscribeToken(user.UnsubscribeToken(1))
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, u.ID)
+	assert.EqualValues(t, 1, issueID)
+
+	_, issueID, err = VerifyUnsubscribeToken(user.UnsubscribeToken(0))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, issueID)
+
+	other := AssertExistsAndLoadBean(t, &User{ID: 4}).(*User)
+	for _, token := range []string{
+		"",
+		"2.1",
+		"2.2." + user.mailTokenSignature("unsubscribe", 1),
+		"4.1." + user.mailTokenSignature("unsubscribe", 1),
+		"2.1." + other.mailTokenSignature("unsubscribe", 1),
+		"2.1." + user.mailTokenSignature("reply", 1),
+	} {
+		_, _, err = VerifyUnsubscribeToken(token)
+		assert.True(t, IsErrUnsubscribeTokenInvalid(err), token)
+	}
+}
+
+func TestUnsubscribeNotifyMail(t *testing.T) {
+	assert.NoError(t, PrepareTestDatabase())
+	user := AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+
+	assert.NoError(t, UnsubscribeNotifyMail(user, 1))
+	iw := AssertExistsAndLoadBean(t, &IssueWatch{UserID: user.ID, IssueID: 1}).(*IssueWatch)
+	assert.False(t, iw.IsWatching)
+
+	assert.NoError(t, UnsubscribeNotifyMail(user, 0))
+	user = AssertExistsAndLoadBean(t, &User{ID: 2}).(*User)
+	assert.Equal(t, NotifyMailNone, user.NotifyMailEvents)
+}
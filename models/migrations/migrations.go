@@ -118,6 +118,20 @@ var migrations = []Migration{
 	NewMigration("remove columns from action", removeActionColumns),
 	// v34 -> v35
 	NewMigration("give all units to owner teams", giveAllUnitsToOwnerTeams),
+	// v35 -> v36
+	NewMigration("add encrypt notify mail field to user", addUserEncryptNotifyMail),
+	// v36 -> v37
+	NewMigration("add notify mail digest field to user", addUserNotifyMailDigest),
+	// v37 -> v38
+	NewMigration("add notify mail events field to user", addUserNotifyMailEvents),
+	// v38 -> v39
+	NewMigration("add quiet hours and timezone fields to user", addUserQuietHours),
+	// v39 -> v40
+	NewMigration("add deadline mailed field to milestone", addMilestoneDeadlineMailed),
+	// v40 -> v41
+	NewMigration("add language field to user", addUserLanguage),
+	// v41 -> v42
+	NewMigration("add disable mail tracking field to user", addUserDisableMailTracking),
 }
 
 // Migrate database to current version
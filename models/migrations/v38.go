@@ -0,0 +1,25 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package migrations
+
+import (
+	"fmt"
+
+	"github.com/go-xorm/xorm"
+)
+
+func addUserQuietHours(x *xorm.Engine) error {
+	// User see models/user.go
+	type User struct {
+		QuietHoursStart int    `xorm:"NOT NULL DEFAULT 0"`
+		QuietHoursEnd   int    `xorm:"NOT NULL DEFAULT 0"`
+		Timezone        string `xorm:"NOT NULL DEFAULT ''"`
+	}
+
+	if err := x.Sync2(new(User)); err != nil {
+		return fmt.Errorf("Sync2: %v", err)
+	}
+	return nil
+}
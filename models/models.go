@@ -106,6 +106,12 @@ func init() {
 		new(TeamUser),
 		new(TeamRepo),
 		new(Notice),
+		new(MailDelivery),
+		new(MailAudit),
+		new(MailLease),
+		new(MailDigestItem),
+		new(MailBounce),
+		new(MailAttachment),
 		new(EmailAddress),
 		new(Notification),
 		new(IssueUser),
@@ -2019,10 +2019,14 @@ func SyncRepositoryHooks() error {
 var taskStatusTable = sync.NewStatusTable()
 
 const (
-	mirrorUpdate   = "mirror_update"
-	gitFsck        = "git_fsck"
-	checkRepos     = "check_repos"
-	archiveCleanup = "archive_cleanup"
+	mirrorUpdate          = "mirror_update"
+	gitFsck               = "git_fsck"
+	checkRepos            = "check_repos"
+	archiveCleanup        = "archive_cleanup"
+	mailDeliveryCleanup   = "mail_delivery_cleanup"
+	mailAttachmentCleanup = "mail_attachment_cleanup"
+	mailDigest            = "mail_digest"
+	milestoneDeadlineMail = "milestone_deadline_mail"
 )
 
 // GitFsck calls 'git fsck' to check repository health.
@@ -133,7 +133,16 @@ type User struct {
 	Members     []*User `xorm:"-"`
 
 	// Preferences
-	DiffViewStyle string `xorm:"NOT NULL DEFAULT ''"`
+	DiffViewStyle     string `xorm:"NOT NULL DEFAULT ''"`
+	EncryptNotifyMail bool   `xorm:"NOT NULL DEFAULT false"`
+	NotifyMailDigest  string `xorm:"NOT NULL DEFAULT ''"`
+	NotifyMailEvents  string `xorm:"NOT NULL DEFAULT ''"`
+	QuietHoursStart   int    `xorm:"NOT NULL DEFAULT 0"`
+	QuietHoursEnd     int    `xorm:"NOT NULL DEFAULT 0"`
+	Timezone          string `xorm:"NOT NULL DEFAULT ''"`
+	Language          string `xorm:"NOT NULL DEFAULT ''"`
+
+	DisableMailTracking bool `xorm:"NOT NULL DEFAULT false"`
 }
 
 // BeforeInsert is invoked from XORM before inserting an object of this type.
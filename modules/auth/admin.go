@@ -47,3 +47,18 @@ type AdminEditUserForm struct {
 func (f *AdminEditUserForm) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
 	return validate(errs, ctx.Data, f, ctx.Locale)
 }
+
+// AdminAnnouncementForm form for admin to send an announcement mail
+type AdminAnnouncementForm struct {
+	Audience     string `binding:"Required;In(all,org,repo)"`
+	Organization string `binding:"MaxSize(35)"`
+	Repository   string `binding:"MaxSize(136)"`
+	Subject      string `binding:"Required;MaxSize(255)"`
+	Content      string `binding:"Required"`
+	Bcc          bool
+}
+
+// Validate validates form fields
+func (f *AdminAnnouncementForm) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return validate(errs, ctx.Data, f, ctx.Locale)
+}
@@ -176,6 +176,33 @@ func (f *AddKeyForm) Validate(ctx *macaron.Context, errs binding.Errors) binding
 	return validate(errs, ctx.Data, f, ctx.Locale)
 }
 
+// EncryptNotifyMailForm form for changing encryption of notification mails
+type EncryptNotifyMailForm struct {
+	EncryptNotifyMail bool
+}
+
+// Validate validates the fields
+func (f *EncryptNotifyMailForm) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return validate(errs, ctx.Data, f, ctx.Locale)
+}
+
+// UpdateNotificationsForm form for changing notification mail settings
+type UpdateNotificationsForm struct {
+	NotifyMailEvents string
+	NotifyMailDigest string
+	QuietHoursStart  int    `binding:"Range(0,23)"`
+	QuietHoursEnd    int    `binding:"Range(0,23)"`
+	Timezone         string `binding:"MaxSize(64)"`
+	Language         string `binding:"MaxSize(16)"`
+
+	DisableMailTracking bool
+}
+
+// Validate validates the fields
+func (f *UpdateNotificationsForm) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
+	return validate(errs, ctx.Data, f, ctx.Locale)
+}
+
 // NewAccessTokenForm form for creating access token
 type NewAccessTokenForm struct {
 	Name string `binding:"Required"`
@@ -11,6 +11,7 @@ import (
 
 	"code.gitea.io/gitea/models"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer/incoming"
 	"code.gitea.io/gitea/modules/setting"
 )
 
@@ -77,6 +78,61 @@ func NewContext() {
 			go models.SyncExternalUsers()
 		}
 	}
+	if setting.Cron.MailDeliveryCleanup.Enabled {
+		entry, err = c.AddFunc("Clean up old mail delivery logs", setting.Cron.MailDeliveryCleanup.Schedule, models.DeleteOldMailDeliveries)
+		if err != nil {
+			log.Fatal(4, "Cron[Clean up old mail delivery logs]: %v", err)
+		}
+		if setting.Cron.MailDeliveryCleanup.RunAtStart {
+			entry.Prev = time.Now()
+			entry.ExecTimes++
+			go models.DeleteOldMailDeliveries()
+		}
+	}
+	if setting.Cron.MailAttachmentCleanup.Enabled {
+		entry, err = c.AddFunc("Clean up expired mail attachments", setting.Cron.MailAttachmentCleanup.Schedule, models.DeleteExpiredMailAttachments)
+		if err != nil {
+			log.Fatal(4, "Cron[Clean up expired mail attachments]: %v", err)
+		}
+		if setting.Cron.MailAttachmentCleanup.RunAtStart {
+			entry.Prev = time.Now()
+			entry.ExecTimes++
+			go models.DeleteExpiredMailAttachments()
+		}
+	}
+	if setting.Cron.MailDigest.Enabled {
+		entry, err = c.AddFunc("Send notification mail digests", setting.Cron.MailDigest.Schedule, models.SendMailDigests)
+		if err != nil {
+			log.Fatal(4, "Cron[Send notification mail digests]: %v", err)
+		}
+		if setting.Cron.MailDigest.RunAtStart {
+			entry.Prev = time.Now()
+			entry.ExecTimes++
+			go models.SendMailDigests()
+		}
+	}
+	if setting.Cron.MilestoneDeadlineMail.Enabled {
+		entry, err = c.AddFunc("Send milestone deadline invitations", setting.Cron.MilestoneDeadlineMail.Schedule, models.SendMilestoneDeadlineMails)
+		if err != nil {
+			log.Fatal(4, "Cron[Send milestone deadline invitations]: %v", err)
+		}
+		if setting.Cron.MilestoneDeadlineMail.RunAtStart {
+			entry.Prev = time.Now()
+			entry.ExecTimes++
+			go models.SendMilestoneDeadlineMails()
+		}
+	}
+	if setting.IncomingMail != nil && setting.IncomingMail.Polling() && setting.Cron.FetchIncomingMail.Enabled {
+		entry, err = c.AddFunc("Fetch incoming mail", setting.Cron.FetchIncomingMail.Schedule, incoming.Fetch)
+		if err != nil {
+			log.Fatal(4, "Cron[Fetch incoming mail]: %v", err)
+		}
+		if setting.Cron.FetchIncomingMail.RunAtStart {
+			entry.Prev = time.Now()
+			entry.ExecTimes++
+			go incoming.Fetch()
+		}
+	}
 	c.Start()
 }
 
@@ -0,0 +1,240 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// alertCheckInterval is the interval in which the alert thresholds are checked.
+const alertCheckInterval = time.Minute
+
+// Alert describes why the mail delivery needs the attention of the
+// administrators.
+type Alert struct {
+	Since       time.Time
+	Reasons     []string
+	Attempts    int // Delivery attempts within ALERT_WINDOW.
+	Failures    int
+	DeadLetters int
+}
+
+// FailurePercent returns the percentage of the attempts which failed.
+func (a *Alert) FailurePercent() int {
+	if a.Attempts == 0 {
+		return 0
+	}
+	return a.Failures * 100 / a.Attempts
+}
+
+// Reason returns the reasons as a sentence.
+func (a *Alert) Reason() string {
+	return strings.Join(a.Reasons, ", ")
+}
+
+// alertBucket counts the delivery attempts of one minute.
+type alertBucket struct {
+	minute   int64
+	attempts int
+	failures int
+}
+
+// alertMonitor raises an alert while the failure rate of the delivery
+// attempts within ALERT_WINDOW or the number of dead letters exceed the
+// thresholds of the settings, and resolves it once both are back below.
+type alertMonitor struct {
+	lock    sync.Mutex
+	buckets []alertBucket // Of the minutes with attempts, oldest first.
+	alert   *Alert        // Nil while there is no alert.
+}
+
+// prune drops the buckets before the window.
+func (m *alertMonitor) prune(minute int64) {
+	first := minute - int64(setting.MailService.AlertWindow/time.Minute)
+	i := 0
+	for i < len(m.buckets) && m.buckets[i].minute < first {
+		i++
+	}
+	m.buckets = m.buckets[i:]
+}
+
+// Done records the outcome of a delivery attempt. Greylisting is part of
+// the normal delivery and does not count as failure.
+// This method is thread-safe.
+func (m *alertMonitor) Done(err error, now time.Time) {
+	minute := now.Unix() / 60
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if n := len(m.buckets); n == 0 || m.buckets[n-1].minute != minute {
+		m.prune(minute)
+		m.buckets = append(m.buckets, alertBucket{minute: minute})
+	}
+	b := &m.buckets[len(m.buckets)-1]
+	b.attempts++
+	if err != nil && !IsErrGreylisted(err) {
+		b.failures++
+	}
+}
+
+// Check compares the attempts within the window and the dead letters with
+// the thresholds. It returns the alert if it was raised or resolved by the
+// check, and whether it is firing.
+// This method is thread-safe.
+func (m *alertMonitor) Check(deadLetters int, now time.Time) (changed *Alert, firing bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune(now.Unix() / 60)
+	a := &Alert{DeadLetters: deadLetters}
+	for _, b := range m.buckets {
+		a.Attempts += b.attempts
+		a.Failures += b.failures
+	}
+
+	opts := setting.MailService
+	if percent := opts.AlertFailurePercent; percent > 0 && a.Attempts > 0 && a.Attempts >= opts.AlertMinAttempts &&
+		a.FailurePercent() >= percent {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("%d%% of %d delivery attempts failed within %s",
+			a.FailurePercent(), a.Attempts, opts.AlertWindow))
+	}
+	if threshold := opts.AlertDeadLetters; threshold > 0 && deadLetters >= threshold {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("%d mails failed permanently", deadLetters))
+	}
+
+	switch {
+	case len(a.Reasons) > 0 && m.alert == nil:
+		a.Since = now
+		m.alert = a
+		return a, true
+	case len(a.Reasons) > 0:
+		a.Since = m.alert.Since
+		m.alert = a
+	case m.alert != nil:
+		resolved := m.alert
+		m.alert = nil
+		return resolved, false
+	}
+	return nil, false
+}
+
+// Alert returns the current alert, or nil if there is none.
+// This method is thread-safe.
+func (m *alertMonitor) Alert() *Alert {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.alert
+}
+
+// GetAlert returns why the mail delivery needs the attention of the
+// administrators, or nil if it works as expected.
+func GetAlert() *Alert {
+	if daemon == nil {
+		return nil
+	}
+	return daemon.alerts.Alert()
+}
+
+// alertPayload is the JSON document posted to ALERT_WEBHOOK_URL when an
+// alert is raised or resolved.
+type alertPayload struct {
+	Status      string    `json:"status"` // Either "firing" or "resolved".
+	Since       time.Time `json:"since"`
+	Reasons     []string  `json:"reasons"`
+	Attempts    int       `json:"attempts"`
+	Failures    int       `json:"failures"`
+	DeadLetters int       `json:"dead_letters"`
+	URL         string    `json:"url"`
+}
+
+// slackPayload is the message posted to a Slack incoming webhook.
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// notifyAlert posts the raised or resolved alert to ALERT_WEBHOOK_URL, as
+// alerting about failing mails by mail is unreliable.
+func notifyAlert(a *Alert, firing bool) error {
+	opts := setting.MailService
+	if len(opts.AlertWebhookURL) == 0 {
+		return nil
+	}
+
+	p := &alertPayload{
+		Status:      "resolved",
+		Since:       a.Since,
+		Reasons:     a.Reasons,
+		Attempts:    a.Attempts,
+		Failures:    a.Failures,
+		DeadLetters: a.DeadLetters,
+		URL:         setting.AppURL + "admin/mail",
+	}
+	if firing {
+		p.Status = "firing"
+	}
+
+	var v interface{} = p
+	if opts.AlertWebhookType == "slack" {
+		text := fmt.Sprintf("%s: mail delivery recovered", setting.AppName)
+		if firing {
+			text = fmt.Sprintf("%s: mail delivery needs attention, %s. <%s|Mail queue>",
+				setting.AppName, a.Reason(), p.URL)
+		}
+		v = &slackPayload{Text: text}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req := httplib.Post(opts.AlertWebhookURL).
+		Header("Content-Type", "application/json").
+		Body(data)
+	return doAPIRequest("Alert webhook", req, nil)
+}
+
+// watchAlerts checks the alert thresholds until the daemon is closed.
+func (d *Daemon) watchAlerts() {
+	t := time.NewTicker(alertCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.closeChan:
+			return
+		case <-t.C:
+		}
+
+		var deadLetters int
+		if setting.MailService.AlertDeadLetters > 0 {
+			list, err := d.queue.DeadLetters().List()
+			if err != nil {
+				log.Error(3, "Failed to list dead letters: %v", err)
+				continue
+			}
+			deadLetters = len(list)
+		}
+
+		a, firing := d.alerts.Check(deadLetters, time.Now())
+		if a == nil {
+			continue
+		}
+		if firing {
+			log.Error(3, "Mail delivery needs attention: %s", a.Reason())
+		} else {
+			log.Info("Mail delivery recovered")
+		}
+		if err := notifyAlert(a, firing); err != nil {
+			log.Error(3, "Failed to post mail alert: %v", err)
+		}
+	}
+}
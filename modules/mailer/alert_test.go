@@ -0,0 +1,85 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertMonitor(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		AlertFailurePercent: 60,
+		AlertMinAttempts:    4,
+		AlertWindow:         15 * time.Minute,
+		AlertDeadLetters:    3,
+	}
+	m := &alertMonitor{}
+	now := time.Now()
+
+	// Too few attempts and greylisting do not raise an alert.
+	m.Done(errors.New("connection refused"), now)
+	m.Done(errors.New("connection refused"), now)
+	a, _ := m.Check(0, now)
+	assert.Nil(t, a)
+	m.Done(ErrGreylisted{errors.New("try again later")}, now)
+	m.Done(nil, now)
+	a, _ = m.Check(0, now)
+	assert.Nil(t, a)
+
+	m.Done(errors.New("connection refused"), now)
+	a, firing := m.Check(0, now)
+	if assert.NotNil(t, a) {
+		assert.True(t, firing)
+		assert.Equal(t, 60, a.FailurePercent())
+		assert.Equal(t, "60% of 5 delivery attempts failed within 15m0s", a.Reason())
+	}
+	assert.Equal(t, a, m.Alert())
+
+	// The alert is raised once and keeps its start.
+	a, _ = m.Check(3, now.Add(time.Minute))
+	assert.Nil(t, a)
+	assert.Len(t, m.Alert().Reasons, 2)
+	assert.Equal(t, now, m.Alert().Since)
+
+	// Attempts before the window are dropped.
+	a, firing = m.Check(0, now.Add(20*time.Minute))
+	if assert.NotNil(t, a) {
+		assert.False(t, firing)
+	}
+	assert.Nil(t, m.Alert())
+}
+
+func TestNotifyAlert(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	setting.AppURL = "https://try.gitea.io/"
+	setting.MailService = &setting.Mailer{AlertWebhookURL: server.URL, AlertWebhookType: "json"}
+	a := &Alert{Reasons: []string{"3 mails failed permanently"}, DeadLetters: 3}
+	assert.NoError(t, notifyAlert(a, true))
+	var p alertPayload
+	assert.NoError(t, json.Unmarshal(body, &p))
+	assert.Equal(t, "firing", p.Status)
+	assert.Equal(t, 3, p.DeadLetters)
+	assert.Equal(t, "https://try.gitea.io/admin/mail", p.URL)
+
+	setting.AppName = "Gitea"
+	setting.MailService.AlertWebhookType = "slack"
+	assert.NoError(t, notifyAlert(a, false))
+	assert.JSONEq(t, `{"text":"Gitea: mail delivery recovered"}`, string(body))
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+)
+
+const (
+	apiTimeout = 30 * time.Second
+)
+
+// ErrAPIRequest represents a request rejected by the HTTP API of a mail provider.
+type ErrAPIRequest struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+// IsErrAPIRequest checks if an error is a ErrAPIRequest.
+func IsErrAPIRequest(err error) bool {
+	_, ok := err.(ErrAPIRequest)
+	return ok
+}
+
+func (err ErrAPIRequest) Error() string {
+	return fmt.Sprintf("%s API request failed [status: %d]: %s", err.Provider, err.StatusCode, err.Body)
+}
+
+// permanentAPIError returns requests rejected with a client error as
+// ErrPermanentFailure, as they fail again if the message is retried.
+// Timeouts and rate limits are temporary, like server errors.
+func permanentAPIError(err error) error {
+	if apiErr, ok := err.(ErrAPIRequest); ok && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 &&
+		apiErr.StatusCode != 408 && apiErr.StatusCode != 429 {
+		return ErrPermanentFailure{err}
+	}
+	return err
+}
+
+// doAPIRequest sends the request to the HTTP API of a mail provider.
+// The JSON response is decoded into v if it is not nil.
+func doAPIRequest(provider string, req *httplib.Request, v interface{}) error {
+	resp, err := req.SetTimeout(apiTimeout, apiTimeout).Response()
+	if err != nil {
+		return fmt.Errorf("%s API request: %v", provider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s API response: %v", provider, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ErrAPIRequest{
+			Provider:   provider,
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	if v != nil && len(body) > 0 {
+		if err = json.Unmarshal(body, v); err != nil {
+			return fmt.Errorf("%s API response: %v", provider, err)
+		}
+	}
+	return nil
+}
+
+// addressList formats the addresses as a comma separated header value.
+func addressList(list []*mail.Address) string {
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.String())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// renderWithBcc renders the message including the Bcc header, for the APIs
+// which take the recipients from the MIME headers of a raw message.
+func (m *Message) renderWithBcc() ([]byte, error) {
+	var raw bytes.Buffer
+	if bcc := m.GetHeader("Bcc"); len(bcc) > 0 {
+		raw.WriteString("Bcc: " + strings.Join(bcc, ", ") + "\r\n")
+	}
+	if _, err := m.WriteTo(&raw); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
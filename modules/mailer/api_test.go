@@ -0,0 +1,108 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// apiRequest is a request received by the apiServer.
+type apiRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// apiServer is a local HTTP server replying to the requests of the API
+// senders with the configured status and body.
+type apiServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	status   int
+	body     string
+	paths    map[string][2]string // Status and body of the replies to the path.
+	requests []*apiRequest
+}
+
+func newAPIServer() *apiServer {
+	s := &apiServer{status: http.StatusOK, paths: make(map[string][2]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		s.requests = append(s.requests, &apiRequest{r.Method, r.URL.Path, r.Header, body})
+		status, reply := strconv.Itoa(s.status), s.body
+		if p, ok := s.paths[r.URL.Path]; ok {
+			status, reply = p[0], p[1]
+		}
+		s.lock.Unlock()
+
+		code, _ := strconv.Atoi(status)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(reply))
+	}))
+	return s
+}
+
+// reply sets the status and the body of the following responses.
+func (s *apiServer) reply(status int, body string) {
+	s.lock.Lock()
+	s.status, s.body = status, body
+	s.lock.Unlock()
+}
+
+// replyPath sets the status and the body of the responses to the path,
+// e.g. of a token endpoint, which do not change with reply.
+func (s *apiServer) replyPath(path string, status int, body string) {
+	s.lock.Lock()
+	s.paths[path] = [2]string{strconv.Itoa(status), body}
+	s.lock.Unlock()
+}
+
+// last returns the last request received.
+func (s *apiServer) last() *apiRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// assertAPIErrors checks that the client errors of the API reject the
+// message permanently, while rate limits and server errors are retried.
+func assertAPIErrors(t *testing.T, s *apiServer, send func() error) {
+	s.reply(http.StatusBadRequest, `{"message":"invalid"}`)
+	err := send()
+	assert.True(t, IsErrPermanentFailure(err), "%v", err)
+
+	s.reply(http.StatusTooManyRequests, `{"message":"slow down"}`)
+	err = send()
+	assert.Error(t, err)
+	assert.False(t, IsErrPermanentFailure(err), "%v", err)
+
+	s.reply(http.StatusServiceUnavailable, `{"message":"unavailable"}`)
+	err = send()
+	assert.Error(t, err)
+	assert.False(t, IsErrPermanentFailure(err), "%v", err)
+}
+
+func TestPermanentAPIError(t *testing.T) {
+	assert.True(t, IsErrPermanentFailure(permanentAPIError(ErrAPIRequest{StatusCode: 400})))
+	assert.True(t, IsErrPermanentFailure(permanentAPIError(ErrAPIRequest{StatusCode: 422})))
+	assert.False(t, IsErrPermanentFailure(permanentAPIError(ErrAPIRequest{StatusCode: 408})))
+	assert.False(t, IsErrPermanentFailure(permanentAPIError(ErrAPIRequest{StatusCode: 429})))
+	assert.False(t, IsErrPermanentFailure(permanentAPIError(ErrAPIRequest{StatusCode: 502})))
+	assert.Nil(t, permanentAPIError(nil))
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"gopkg.in/gomail.v2"
+)
+
+// ErrAttachmentTooLarge represents a "AttachmentTooLarge" kind of error.
+type ErrAttachmentTooLarge struct {
+	Name    string
+	MaxSize int64
+}
+
+// IsErrAttachmentTooLarge checks if an error is a ErrAttachmentTooLarge.
+func IsErrAttachmentTooLarge(err error) bool {
+	_, ok := err.(ErrAttachmentTooLarge)
+	return ok
+}
+
+func (err ErrAttachmentTooLarge) Error() string {
+	return fmt.Sprintf("attachments exceed the maximum size of the message [name: %s, max_size: %d]", err.Name, err.MaxSize)
+}
+
+// memoryFileSize is the size up to which the content of attached readers is
+// kept in memory, larger files are spooled to a temporary file.
+const memoryFileSize = 256 << 10
+
+// messageFile is an attached or embedded file of a message. Its content is
+// streamed into the message every time it is rendered.
+type messageFile struct {
+	name        string
+	contentType string
+	size        int64
+	data        []byte // Content of small files.
+	path        string // File with the content of larger files.
+	temp        bool   // Whether path is a temporary file removed with the message.
+}
+
+// open returns a reader of the content of the file.
+func (f *messageFile) open() (io.ReadCloser, error) {
+	if len(f.path) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+	}
+	return os.Open(f.path)
+}
+
+// remove deletes the temporary file of the content, if any.
+func (f *messageFile) remove() {
+	if f.temp {
+		os.Remove(f.path)
+	}
+}
+
+// AttachFile attaches the file to the message. The file is read each time
+// the message is sent, so it has to be kept until the mail is delivered.
+func (m *Message) AttachFile(filename string) error {
+	f, err := m.openFile(filename)
+	if err != nil {
+		return err
+	}
+	m.attachments = append(m.attachments, f)
+	return nil
+}
+
+// AttachReader attaches the content read from r as a file with the given name.
+// The content type is detected from the name or the content. The total size of
+// all attached and embedded files of a message is limited by the mailer
+// ATTACHMENT_MAX_SIZE. Large contents are spooled to a temporary file.
+func (m *Message) AttachReader(name string, r io.Reader) error {
+	f, err := m.readFile(name, r)
+	if err != nil {
+		return err
+	}
+
+	// Attachments are added when the message is rendered, so they can be
+	// replaced by links if the message is too large.
+	m.attachments = append(m.attachments, f)
+	return nil
+}
+
+// attachPending adds the attachments to the rendered message.
+func (m *Message) attachPending() {
+	for _, f := range m.attachments {
+		m.Attach(f.name, fileSettings(f, "attachment")...)
+	}
+	m.attachments = nil
+}
+
+// EmbedFile embeds the file into the message and returns the "cid:" URL
+// to reference it from the HTML body, e.g. as the src of an image. The file
+// has to be kept until the mail is delivered.
+func (m *Message) EmbedFile(filename string) (string, error) {
+	f, err := m.openFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return m.embed(f), nil
+}
+
+// EmbedReader embeds the content read from r as an inline file with the given
+// name and returns the "cid:" URL to reference it from the HTML body. The name
+// is used as Content-ID and has to be unique within the message.
+func (m *Message) EmbedReader(name string, r io.Reader) (string, error) {
+	f, err := m.readFile(name, r)
+	if err != nil {
+		return "", err
+	}
+	return m.embed(f), nil
+}
+
+// embed adds the inline file to the message and returns its "cid:" URL.
+func (m *Message) embed(f *messageFile) string {
+	settings := append(fileSettings(f, "inline"), gomail.SetHeader(map[string][]string{
+		"Content-ID": {"<" + f.name + ">"},
+	}))
+	m.Embed(f.name, settings...)
+	return "cid:" + f.name
+}
+
+// openFile accounts the file on disk against the maximum size of the
+// message and detects its content type.
+func (m *Message) openFile(filename string) (*messageFile, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(filename)
+	if err = m.reserveFileSize(name, fi.Size()); err != nil {
+		return nil, err
+	}
+
+	f := &messageFile{name: name, size: fi.Size(), path: filename}
+	if err = f.detectContentType(); err != nil {
+		m.filesSize -= f.size
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFile reads the content of an attached or embedded file and accounts
+// it against the maximum size of the message. Contents larger than
+// memoryFileSize are written to a temporary file, which is removed once the
+// message is garbage collected.
+func (m *Message) readFile(name string, r io.Reader) (*messageFile, error) {
+	maxSize := setting.MailService.AttachmentMaxSize
+	limit := maxSize - m.filesSize
+	r = io.LimitReader(r, limit+1)
+
+	f := &messageFile{name: name}
+	head, err := ioutil.ReadAll(io.LimitReader(r, memoryFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(head) <= memoryFileSize {
+		f.data, f.size = head, int64(len(head))
+	} else {
+		tmp, err := ioutil.TempFile("", "gitea-mail")
+		if err != nil {
+			return nil, err
+		}
+		f.path, f.temp = tmp.Name(), true
+		size, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(head), r))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			f.remove()
+			return nil, err
+		}
+		f.size = size
+	}
+
+	if err = m.reserveFileSize(name, f.size); err != nil {
+		f.remove()
+		return nil, err
+	}
+	if f.temp {
+		runtime.SetFinalizer(f, (*messageFile).remove)
+	}
+	if err = f.detectContentType(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reserveFileSize adds the size of a file to the total size of the attached
+// and embedded files, if it stays within ATTACHMENT_MAX_SIZE.
+func (m *Message) reserveFileSize(name string, size int64) error {
+	maxSize := setting.MailService.AttachmentMaxSize
+	if size > maxSize-m.filesSize {
+		return ErrAttachmentTooLarge{name, maxSize}
+	}
+	m.filesSize += size
+	return nil
+}
+
+// detectContentType sets the content type of the file from its name or,
+// if unknown, its first bytes.
+func (f *messageFile) detectContentType() error {
+	if f.contentType = mime.TypeByExtension(filepath.Ext(f.name)); len(f.contentType) > 0 {
+		return nil
+	}
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	head, err := ioutil.ReadAll(io.LimitReader(r, 512))
+	if err != nil {
+		return err
+	}
+	f.contentType = http.DetectContentType(head)
+	return nil
+}
+
+// fileSettings returns the gomail settings of a file with the given
+// disposition, which stream its content into the message.
+func fileSettings(f *messageFile, disposition string) []gomail.FileSetting {
+	encodedName := mime.QEncoding.Encode("UTF-8", f.name)
+
+	return []gomail.FileSetting{
+		gomail.SetHeader(map[string][]string{
+			"Content-Type":        {fmt.Sprintf(`%s; name="%s"`, f.contentType, encodedName)},
+			"Content-Disposition": {fmt.Sprintf(`%s; filename="%s"`, disposition, encodedName)},
+		}),
+		gomail.SetCopyFunc(func(w io.Writer) error {
+			r, err := f.open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(w, r)
+			return err
+		}),
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageAttachReader(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AttachmentMaxSize: 20}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "<p>Body</p>")
+	assert.NoError(t, msg.AttachReader("fix.patch", strings.NewReader("diff --git")))
+	assert.NoError(t, msg.AttachReader("Übersicht", strings.NewReader("%PDF-1.4")))
+
+	err := msg.AttachReader("large.bin", strings.NewReader("0123456789"))
+	assert.True(t, IsErrAttachmentTooLarge(err))
+
+	c, err := msg.content()
+	assert.NoError(t, err)
+	if assert.Len(t, c.Attachments, 2) {
+		assert.Equal(t, "fix.patch", c.Attachments[0].Filename)
+		assert.Equal(t, "diff --git", string(c.Attachments[0].Data))
+		assert.Equal(t, "Übersicht", c.Attachments[1].Filename)
+		assert.Equal(t, "application/pdf", c.Attachments[1].ContentType)
+	}
+}
+
+func TestMessageEmbedReader(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AttachmentMaxSize: 1 << 20}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "")
+	cid, err := msg.EmbedReader("logo.png", strings.NewReader("\x89PNG\r\n\x1a\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "cid:logo.png", cid)
+	msg.SetAlternativeBodies("Text", `<img src="`+cid+`">`)
+
+	c, err := msg.content()
+	assert.NoError(t, err)
+	assert.Contains(t, c.HTML, `src="cid:logo.png"`)
+	if assert.Len(t, c.Attachments, 1) {
+		assert.Equal(t, "logo.png", c.Attachments[0].ContentID)
+		assert.Equal(t, "image/png", c.Attachments[0].ContentType)
+	}
+}
+
+func TestMessageAttachLarge(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AttachmentMaxSize: 1 << 20}
+
+	content := strings.Repeat("0123456789abcdef", memoryFileSize/8)
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "<p>Body</p>")
+	assert.NoError(t, msg.AttachReader("large.txt", strings.NewReader(content)))
+	if assert.Len(t, msg.attachments, 1) {
+		f := msg.attachments[0]
+		assert.True(t, f.temp)
+		assert.Nil(t, f.data)
+		assert.Equal(t, int64(len(content)), f.size)
+		assert.Equal(t, "text/plain; charset=utf-8", f.contentType)
+	}
+
+	dir, err := ioutil.TempDir("", "mailer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "fix")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("diff --git"), 0644))
+	assert.NoError(t, msg.AttachFile(filename))
+	assert.EqualValues(t, len(content)+len("diff --git"), msg.filesSize)
+
+	// The files are streamed every time the message is rendered.
+	for i := 0; i < 2; i++ {
+		c, err := msg.content()
+		assert.NoError(t, err)
+		if assert.Len(t, c.Attachments, 2) {
+			assert.Equal(t, content, string(c.Attachments[0].Data))
+			assert.Equal(t, "fix", c.Attachments[1].Filename)
+			assert.Equal(t, "diff --git", string(c.Attachments[1].Data))
+		}
+	}
+
+	err = msg.AttachReader("huge.bin", strings.NewReader(strings.Repeat("x", 1<<20)))
+	assert.True(t, IsErrAttachmentTooLarge(err))
+	assert.EqualValues(t, len(content)+len("diff --git"), msg.filesSize)
+}
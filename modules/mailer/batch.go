@@ -0,0 +1,158 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"text/template"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// Template renders the body of the messages of a batch, like the templates
+// of html/template.
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// BatchRecipient is a receiver of a batch with its own template variables.
+type BatchRecipient struct {
+	Email          string
+	Name           string // Display name of the To header.
+	UnsubscribeURL string // Sets the List-Unsubscribe header if not empty.
+	Data           map[string]interface{}
+}
+
+// Batch is a mail personalized for every recipient. The subject and body
+// templates are executed with the shared Data, overridden by the Data of the
+// recipient and its fields .Email, .Name and .UnsubscribeURL.
+type Batch struct {
+	Subject         string   // Template of the subject, see text/template.
+	SubjectTemplate Template // Renders the subject instead of Subject if not nil, trimmed.
+	Body            Template
+	Text            Template // Renders the plain text body if not nil, else it is generated.
+	Data            map[string]interface{}
+	Recipients      []*BatchRecipient
+
+	Info     string
+	Category Category
+	Event    Event
+}
+
+// ErrInvalidBatch represents a batch whose subject template can not be parsed.
+type ErrInvalidBatch struct {
+	Err error
+}
+
+// IsErrInvalidBatch checks if an error is a ErrInvalidBatch.
+func IsErrInvalidBatch(err error) bool {
+	_, ok := err.(ErrInvalidBatch)
+	return ok
+}
+
+func (err ErrInvalidBatch) Error() string {
+	return fmt.Sprintf("invalid batch: %v", err.Err)
+}
+
+// messages renders the message of every recipient. The subject template is
+// parsed once, recipients whose message can not be rendered are skipped.
+func (b *Batch) messages() ([]*Message, error) {
+	subject := b.SubjectTemplate
+	if subject == nil {
+		tpl, err := template.New("subject").Parse(b.Subject)
+		if err != nil {
+			return nil, ErrInvalidBatch{err}
+		}
+		subject = tpl
+	}
+
+	msgs := make([]*Message, 0, len(b.Recipients))
+	var buf bytes.Buffer
+	for _, rcpt := range b.Recipients {
+		data := make(map[string]interface{}, len(b.Data)+len(rcpt.Data)+3)
+		for k, v := range b.Data {
+			data[k] = v
+		}
+		for k, v := range rcpt.Data {
+			data[k] = v
+		}
+		data["Email"] = rcpt.Email
+		data["Name"] = rcpt.Name
+		data["UnsubscribeURL"] = rcpt.UnsubscribeURL
+
+		buf.Reset()
+		if err := subject.Execute(&buf, data); err != nil {
+			log.Error(3, "Failed to render subject of %s to %s: %v", b.Info, rcpt.Email, err)
+			continue
+		}
+		subjectText := buf.String()
+		if b.SubjectTemplate != nil {
+			// Subject template files end with a newline.
+			subjectText = strings.TrimSpace(subjectText)
+		}
+		buf.Reset()
+		if err := b.Body.Execute(&buf, data); err != nil {
+			log.Error(3, "Failed to render body of %s to %s: %v", b.Info, rcpt.Email, err)
+			continue
+		}
+		body := buf.String()
+		var text string
+		if b.Text != nil {
+			buf.Reset()
+			if err := b.Text.Execute(&buf, data); err != nil {
+				log.Error(3, "Failed to render text of %s to %s: %v", b.Info, rcpt.Email, err)
+				continue
+			}
+			text = buf.String()
+		}
+
+		to := rcpt.Email
+		if len(rcpt.Name) > 0 {
+			to = (&mail.Address{Name: rcpt.Name, Address: rcpt.Email}).String()
+		}
+		msg := NewMessage([]string{to}, subjectText, body)
+		if len(text) > 0 {
+			msg.SetTextBody(text)
+		}
+		msg.Info = b.Info
+		msg.Event = b.Event
+		if len(b.Category) > 0 {
+			msg.Category = b.Category
+		}
+		if len(rcpt.UnsubscribeURL) > 0 {
+			msg.SetListUnsubscribe(rcpt.UnsubscribeURL)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// SendBatch renders and queues the message of every recipient of the batch,
+// which are sent with the pooled connections of the workers within the rate
+// limits. It returns the number of queued messages; recipients not wanting
+// the event are not counted.
+func (d *Daemon) SendBatch(b *Batch) (int, error) {
+	msgs, err := b.messages()
+	if err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, msg := range msgs {
+		if d.IsClosed() {
+			return queued, ErrMailServiceDisabled
+		}
+		if err = d.send(msg); err == nil {
+			queued++
+		} else if err != ErrNoRecipients {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
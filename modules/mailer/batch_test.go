@@ -0,0 +1,78 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"html/template"
+	"testing"
+	texttmpl "text/template"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_Messages(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	b := &Batch{
+		Subject: "[{{.Repo}}] Hello {{.Name}}",
+		Body:    template.Must(template.New("body").Parse(`<p>{{.Greeting}}, {{.Name}}</p><a href="{{.UnsubscribeURL}}">Unsubscribe</a>`)),
+		Data:    map[string]interface{}{"Repo": "user2/repo1", "Greeting": "Hi"},
+		Recipients: []*BatchRecipient{
+			{Email: "a@example.com", Name: "Anne", UnsubscribeURL: "https://try.gitea.io/unsubscribe/a"},
+			{Email: "b@example.com", Data: map[string]interface{}{"Greeting": "<Hey>"}},
+		},
+		Category: CategoryBroadcast,
+	}
+	msgs, err := b.messages()
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, []string{`"Anne" <a@example.com>`}, msgs[0].GetHeader("To"))
+		assert.Equal(t, []string{"[user2/repo1] Hello Anne"}, msgs[0].GetHeader("Subject"))
+		assert.Equal(t, []string{"<https://try.gitea.io/unsubscribe/a>"}, msgs[0].GetHeader("List-Unsubscribe"))
+		assert.Contains(t, msgs[0].html, "<p>Hi, Anne</p>")
+		assert.Equal(t, CategoryBroadcast, msgs[0].Category)
+
+		assert.Equal(t, []string{"[user2/repo1] Hello "}, msgs[1].GetHeader("Subject"))
+		assert.Contains(t, msgs[1].html, "<p>&lt;Hey&gt;, </p>")
+		assert.Empty(t, msgs[1].GetHeader("List-Unsubscribe"))
+	}
+
+	b.Subject = "{{.Name"
+	_, err = b.messages()
+	assert.True(t, IsErrInvalidBatch(err))
+
+	b.SubjectTemplate = texttmpl.Must(texttmpl.New("subject").Parse("Hello {{.Name}}\n"))
+	b.Text = texttmpl.Must(texttmpl.New("text").Parse("{{.Greeting}}, {{.Name}}"))
+	msgs, err = b.messages()
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, []string{"Hello Anne"}, msgs[0].GetHeader("Subject"))
+		assert.Equal(t, "Hi, Anne", msgs[0].text)
+		assert.Contains(t, msgs[0].html, "<p>Hi, Anne</p>")
+	}
+}
+
+func TestDaemonSendBatch(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:        "gitea@example.com",
+		MailType:    "dummy",
+		Workers:     1,
+		QueueLength: 10,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	n, err := d.SendBatch(&Batch{
+		Subject:    "Subject",
+		Body:       template.Must(template.New("body").Parse("Body {{.Email}}")),
+		Recipients: []*BatchRecipient{{Email: "a@example.com"}, {Email: "b@example.com"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
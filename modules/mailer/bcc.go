@@ -0,0 +1,36 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// undisclosedRecipients is the empty group the To header of mails sent only
+// to Bcc recipients is set to (RFC 5322).
+const undisclosedRecipients = "undisclosed-recipients:;"
+
+// NewBccMessages creates the messages of an announcement to the receivers,
+// who are kept in Bcc so they do not see each other. The receivers are split
+// into messages of at most BCC_MAX_RECIPIENTS.
+func NewBccMessages(bcc []string, subject, body string) []*Message {
+	size := setting.MailService.BccMaxRecipients
+	if size <= 0 {
+		size = len(bcc)
+	}
+
+	var msgs []*Message
+	for start := 0; start < len(bcc); start += size {
+		end := start + size
+		if end > len(bcc) {
+			end = len(bcc)
+		}
+		msg := NewMessage([]string{undisclosedRecipients}, subject, body)
+		msg.SetAddresses("Bcc", append([]string(nil), bcc[start:end]...)...)
+		msg.Category = CategoryBroadcast
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
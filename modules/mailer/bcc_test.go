@@ -0,0 +1,65 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBccMessages(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", BccMaxRecipients: 2}
+
+	msgs := NewBccMessages([]string{"a@example.com", "b@example.com", "c@example.com"}, "Subject", "Body")
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, msgs[0].GetHeader("Bcc"))
+		assert.Equal(t, []string{"c@example.com"}, msgs[1].GetHeader("Bcc"))
+	}
+
+	msg := msgs[0]
+	assert.Equal(t, CategoryBroadcast, msg.Category)
+	_, to, err := msg.envelope()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "To: undisclosed-recipients:;\r\n")
+	assert.NotContains(t, buf.String(), "Bcc:")
+	assert.NotContains(t, buf.String(), " b@example.com")
+
+	setting.MailService.BccMaxRecipients = 0
+	assert.Len(t, NewBccMessages([]string{"a@example.com", "b@example.com", "c@example.com"}, "Subject", "Body"), 1)
+}
+
+func TestFilterRecipients_Bcc(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	SetPreferenceResolver(func(to string, event Event) bool {
+		return to != "muted@example.com"
+	})
+	defer SetPreferenceResolver(nil)
+
+	msg := NewBccMessages([]string{"user@example.com", "muted@example.com"}, "Subject", "Body")[0]
+	msg.Event = EventWatched
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{undisclosedRecipients}, msg.GetHeader("To"))
+	assert.Equal(t, []string{"user@example.com"}, msg.GetHeader("Bcc"))
+
+	msg = NewBccMessages([]string{"muted@example.com"}, "Subject", "Body")[0]
+	msg.Event = EventWatched
+	assert.False(t, filterRecipients(msg))
+
+	// The To header is never left empty.
+	msg = NewMessage([]string{"muted@example.com"}, "Subject", "Body")
+	msg.SetAddresses("Bcc", "user@example.com")
+	msg.Event = EventWatched
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{undisclosedRecipients}, msg.GetHeader("To"))
+}
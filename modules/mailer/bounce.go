@@ -0,0 +1,103 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Bounce is a failed delivery reported by a mail server or service, or a
+// complaint of the recipient about the mail.
+type Bounce struct {
+	Email     string
+	Status    string // Status code, like the enhanced status code 5.1.1 if known.
+	Reason    string
+	Permanent bool
+	Complaint bool
+}
+
+// SuppressionChecker reports whether sending mails of the category to the
+// address is suppressed, e.g. because mails to it bounced permanently.
+type SuppressionChecker func(addr string, category Category) bool
+
+var (
+	suppressionCheckerLock sync.RWMutex
+	suppressionChecker     SuppressionChecker
+)
+
+// SetSuppressionChecker sets the function consulted for all receivers of
+// mails before they are sent.
+// This method is thread-safe.
+func SetSuppressionChecker(c SuppressionChecker) {
+	suppressionCheckerLock.Lock()
+	suppressionChecker = c
+	suppressionCheckerLock.Unlock()
+}
+
+// Suppressed reports whether sending mails of the category to the address
+// is suppressed.
+func Suppressed(addr string, category Category) bool {
+	suppressionCheckerLock.RLock()
+	check := suppressionChecker
+	suppressionCheckerLock.RUnlock()
+	return check != nil && check(addr, category)
+}
+
+// ParseDeliveryStatus parses the message/delivery-status part of a delivery
+// status notification (RFC 3464) and returns the failed and delayed
+// deliveries it reports.
+func ParseDeliveryStatus(data []byte) ([]*Bounce, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	// The per-message fields are of no interest.
+	if _, err := r.ReadMIMEHeader(); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var bounces []*Bounce
+	for {
+		fields, err := r.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		action := strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+		if action == "failed" || action == "delayed" {
+			recipient := fields.Get("Final-Recipient")
+			if len(recipient) == 0 {
+				recipient = fields.Get("Original-Recipient")
+			}
+			// The address is prefixed by its type, like rfc822;user@example.com.
+			if i := strings.IndexByte(recipient, ';'); i >= 0 {
+				recipient = recipient[i+1:]
+			}
+			status := strings.TrimSpace(fields.Get("Status"))
+			reason := fields.Get("Diagnostic-Code")
+			if i := strings.IndexByte(reason, ';'); i >= 0 {
+				reason = reason[i+1:]
+			}
+
+			if recipient = strings.Trim(strings.TrimSpace(recipient), "<>"); len(recipient) > 0 {
+				bounces = append(bounces, &Bounce{
+					Email:     recipient,
+					Status:    status,
+					Reason:    strings.TrimSpace(reason),
+					Permanent: action == "failed" && strings.HasPrefix(status, "5"),
+				})
+			}
+		}
+
+		if err == io.EOF {
+			return bounces, nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeliveryStatus(t *testing.T) {
+	report := "Reporting-MTA: dns; mx.example.com\r\n" +
+		"Arrival-Date: Mon, 2 Jan 2017 10:00:00 +0000\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; unknown@example.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+		"\r\n" +
+		"Original-Recipient: rfc822;<full@example.com>\r\n" +
+		"Action: delayed\r\n" +
+		"Status: 4.2.2\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; user@example.com\r\n" +
+		"Action: delivered\r\n" +
+		"Status: 2.0.0\r\n"
+
+	bounces, err := ParseDeliveryStatus([]byte(report))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Bounce{
+		{Email: "unknown@example.com", Status: "5.1.1", Reason: "550 5.1.1 User unknown", Permanent: true},
+		{Email: "full@example.com", Status: "4.2.2"},
+	}, bounces)
+}
+
+func TestFilterRecipients_Suppressed(t *testing.T) {
+	SetSuppressionChecker(func(addr string, category Category) bool {
+		return addr == "bounced@example.com" && category != CategorySecurity
+	})
+	defer SetSuppressionChecker(nil)
+
+	msg := NewMessage([]string{"user@example.com", "Bounced <bounced@example.com>"}, "Subject", "Body")
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{"user@example.com"}, msg.GetHeader("To"))
+
+	msg = NewMessage([]string{"bounced@example.com"}, "Subject", "Body")
+	assert.False(t, filterRecipients(msg))
+
+	msg = NewMessage([]string{"bounced@example.com"}, "Subject", "Body")
+	msg.Category = CategorySecurity
+	assert.True(t, filterRecipients(msg))
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// CircuitState is the state of the circuit breaker around the sender backend.
+type CircuitState string
+
+// The states of the circuit breaker.
+const (
+	// CircuitClosed delivers the mails.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen pauses the delivery after consecutive failures.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen sends a single mail to probe whether the backend recovered.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitListener is notified when the circuit breaker opens, with the
+// error of the last failure, and when it closes again. Probes which fail
+// do not notify it.
+type CircuitListener func(state CircuitState, err error)
+
+var (
+	circuitListenerLock sync.RWMutex
+	circuitListener     CircuitListener
+)
+
+// SetCircuitListener sets the function called when the circuit breaker
+// around the sender backend changes its state. It is called by a worker
+// routine and must not block.
+// This method is thread-safe.
+func SetCircuitListener(l CircuitListener) {
+	circuitListenerLock.Lock()
+	circuitListener = l
+	circuitListenerLock.Unlock()
+}
+
+// circuitBreaker pauses the workers after threshold consecutive failed
+// delivery attempts, to not send every queued mail to a backend which is
+// down. Once the probe interval passed, the first worker which gets a mail
+// sends it as probe, the others resume when it succeeds.
+type circuitBreaker struct {
+	lock     sync.Mutex
+	state    CircuitState
+	failures int
+	probeAt  time.Time     // When the next probe may be sent while open.
+	resumed  chan struct{} // Closed when the circuit closes again.
+
+	threshold int
+	interval  time.Duration
+}
+
+func newCircuitBreaker(threshold int, interval time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		state:     CircuitClosed,
+		threshold: threshold,
+		interval:  interval,
+	}
+}
+
+// State returns the current state.
+// This method is thread-safe.
+func (b *circuitBreaker) State() CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Wait blocks until the worker may take a mail from the queue: immediately
+// while the circuit is closed, else once it closes or a probe is due. It
+// returns false if stop or closed is closed in the meantime.
+// This method is thread-safe.
+func (b *circuitBreaker) Wait(stop, closed <-chan struct{}) bool {
+	for {
+		b.lock.Lock()
+		if b.state == CircuitClosed || b.state == CircuitOpen && !time.Now().Before(b.probeAt) {
+			b.lock.Unlock()
+			return true
+		}
+		delay := b.probeAt.Sub(time.Now())
+		if delay <= 0 {
+			// Another worker sends the probe, check again once it is overdue.
+			delay = b.interval
+		}
+		resumed := b.resumed
+		b.lock.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-resumed:
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return false
+		case <-closed:
+			t.Stop()
+			return false
+		}
+		t.Stop()
+	}
+}
+
+// Allow reports whether the worker may send the mail it took from the queue,
+// which is the probe if one is due. Only the worker sending the probe calls
+// Done, so workers without mails never hold the probe.
+// This method is thread-safe.
+func (b *circuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case b.state == CircuitClosed:
+		return true
+	case b.state == CircuitOpen && !time.Now().Before(b.probeAt):
+		b.state = CircuitHalfOpen
+		log.Trace("Probing the mail delivery")
+		return true
+	}
+	return false
+}
+
+// Done records the outcome of a delivery attempt. Rejections of single
+// recipients show that the backend is working.
+// This method is thread-safe.
+func (b *circuitBreaker) Done(err error) {
+	failed := err != nil && !IsErrPermanentFailure(err) && !IsErrGreylisted(err)
+
+	b.lock.Lock()
+	if !failed {
+		b.failures = 0
+		if b.state == CircuitClosed {
+			b.lock.Unlock()
+			return
+		}
+		b.state = CircuitClosed
+		close(b.resumed)
+		b.lock.Unlock()
+		log.Info("Mail delivery resumed")
+		b.notify(CircuitClosed, nil)
+		return
+	}
+
+	b.failures++
+	from, failures := b.state, b.failures
+	if from == CircuitClosed && failures < b.threshold {
+		b.lock.Unlock()
+		return
+	}
+	// A failed probe opens the circuit again, failures of the mails sent
+	// before it opened do not postpone the probe.
+	if from == CircuitClosed {
+		b.resumed = make(chan struct{})
+	}
+	if from != CircuitOpen {
+		b.state = CircuitOpen
+		b.probeAt = time.Now().Add(b.interval)
+	}
+	b.lock.Unlock()
+
+	switch from {
+	case CircuitClosed:
+		log.Warn("Mail delivery paused after %d failed attempts: %v", failures, err)
+		countCircuitOpen()
+		b.notify(CircuitOpen, err)
+	case CircuitHalfOpen:
+		log.Trace("Mail delivery probe failed, next probe in %v: %v", b.interval, err)
+	}
+}
+
+// notify passes the state change to the listener, if any.
+func (b *circuitBreaker) notify(state CircuitState, err error) {
+	circuitListenerLock.RLock()
+	l := circuitListener
+	circuitListenerLock.RUnlock()
+	if l != nil {
+		l(state, err)
+	}
+}
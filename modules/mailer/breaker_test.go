@@ -0,0 +1,70 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var states []CircuitState
+	SetCircuitListener(func(state CircuitState, err error) {
+		states = append(states, state)
+	})
+	defer SetCircuitListener(nil)
+
+	b := newCircuitBreaker(2, 50*time.Millisecond)
+	stop := make(chan struct{})
+	down := errors.New("dial tcp: connection refused")
+
+	// Rejected recipients and greylisting show that the backend works.
+	b.Done(down)
+	b.Done(ErrPermanentFailure{down})
+	b.Done(down)
+	b.Done(ErrGreylisted{down})
+	assert.Equal(t, CircuitClosed, b.State())
+	assert.True(t, b.Wait(stop, nil))
+
+	b.Done(down)
+	b.Done(down)
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.Equal(t, []CircuitState{CircuitOpen}, states)
+
+	// A failed probe opens the circuit again.
+	start := time.Now()
+	assert.True(t, b.Wait(stop, nil))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	b.Done(down)
+	assert.Equal(t, CircuitOpen, b.State())
+	assert.Len(t, states, 1)
+
+	// The other workers resume once the probe succeeded.
+	assert.True(t, b.Wait(stop, nil))
+	assert.True(t, b.Allow())
+	resumed := make(chan bool)
+	go func() { resumed <- b.Wait(stop, nil) }()
+	select {
+	case <-resumed:
+		t.Fatal("worker resumed during the probe")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.Done(nil)
+	assert.True(t, <-resumed)
+	assert.Equal(t, CircuitClosed, b.State())
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitClosed}, states)
+
+	b.Done(down)
+	b.Done(down)
+	close(stop)
+	assert.False(t, b.Wait(stop, nil))
+}
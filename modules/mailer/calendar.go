@@ -0,0 +1,138 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// calendarContentType is the media type of the iCalendar part of
+// invitations (RFC 6047).
+const calendarContentType = "text/calendar; method=REQUEST"
+
+// CalendarEvent is an event sent as iCalendar invitation (RFC 5545, 5546),
+// so that mail clients offer to add it to the calendar of the recipient.
+type CalendarEvent struct {
+	// UID identifies the event, invitations with the same UID and a higher
+	// Sequence update it in the calendars of the recipients.
+	UID         string
+	Sequence    int64
+	Summary     string
+	Description string
+	URL         string
+	Start       time.Time
+	End         time.Time // Zero for an event lasting one day or no time.
+	AllDay      bool      // Start and End are dates in the location of Start.
+}
+
+// SetCalendarEvent adds the event as text/calendar part with METHOD:REQUEST
+// to the message. The organizer is the From address and the attendees are
+// the To and Cc addresses of the message, so it has to be called after they
+// are set. Replacing the bodies keeps the calendar part.
+func (m *Message) SetCalendarEvent(ev *CalendarEvent) {
+	m.calendar = ev.ical(m.GetHeader("From"), append(m.addresses("To"), m.addresses("Cc")...), time.Now())
+	m.SetAlternativeBodies(m.text, m.html)
+}
+
+// ical renders the event as calendar with the request to attend it.
+func (ev *CalendarEvent) ical(from, attendees []string, now time.Time) string {
+	w := &icalWriter{}
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:-//Gitea//Gitea//EN")
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:REQUEST")
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + icalText(ev.UID))
+	w.line(fmt.Sprintf("SEQUENCE:%d", ev.Sequence))
+	w.line("DTSTAMP:" + now.UTC().Format("20060102T150405Z"))
+
+	end := ev.End
+	if ev.AllDay {
+		if end.IsZero() {
+			end = ev.Start.AddDate(0, 0, 1)
+		}
+		w.line("DTSTART;VALUE=DATE:" + ev.Start.Format("20060102"))
+		w.line("DTEND;VALUE=DATE:" + end.In(ev.Start.Location()).Format("20060102"))
+	} else {
+		if end.IsZero() {
+			end = ev.Start
+		}
+		w.line("DTSTART:" + ev.Start.UTC().Format("20060102T150405Z"))
+		w.line("DTEND:" + end.UTC().Format("20060102T150405Z"))
+	}
+
+	w.line("SUMMARY:" + icalText(ev.Summary))
+	if len(ev.Description) > 0 {
+		w.line("DESCRIPTION:" + icalText(ev.Description))
+	}
+	if len(ev.URL) > 0 {
+		w.line("URL:" + ev.URL)
+	}
+	if len(from) > 0 {
+		if addr, err := mail.ParseAddress(from[0]); err == nil {
+			w.line("ORGANIZER" + icalCommonName(addr.Name) + ":mailto:" + addr.Address)
+		}
+	}
+	for _, a := range attendees {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			continue
+		}
+		w.line("ATTENDEE" + icalCommonName(addr.Name) +
+			";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=FALSE:mailto:" + addr.Address)
+	}
+	w.line("STATUS:CONFIRMED")
+	w.line("TRANSP:TRANSPARENT")
+	w.line("END:VEVENT")
+	w.line("END:VCALENDAR")
+	return w.String()
+}
+
+// icalWriter writes content lines folded to 75 octets (RFC 5545 3.1).
+type icalWriter struct {
+	bytes.Buffer
+}
+
+func (w *icalWriter) line(s string) {
+	const maxLen = 75
+	for limit := maxLen; len(s) > limit; limit = maxLen - 1 {
+		// Fold between characters, not within their UTF-8 encoding.
+		i := limit
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+		w.WriteString(s[:i] + "\r\n ")
+		s = s[i:]
+	}
+	w.WriteString(s + "\r\n")
+}
+
+var icalTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+// icalText escapes the value of a TEXT property.
+func icalText(s string) string {
+	return icalTextEscaper.Replace(s)
+}
+
+// icalCommonName returns the CN parameter of the name, which is quoted and
+// can not contain quotes.
+func icalCommonName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r < ' ' {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) == 0 {
+		return ""
+	}
+	return `;CN="` + name + `"`
+}
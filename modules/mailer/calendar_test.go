@@ -0,0 +1,88 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalendarEvent_ical(t *testing.T) {
+	ev := &CalendarEvent{
+		UID:         "user2/repo1/issues/1@example.com",
+		Sequence:    3,
+		Summary:     "[repo1] Fix the build, again; finally",
+		Description: "Line 1\nLine 2 " + strings.Repeat("ü", 60),
+		URL:         "https://try.gitea.io/user2/repo1/issues/1",
+		Start:       time.Date(2017, 10, 12, 0, 0, 0, 0, time.UTC),
+		AllDay:      true,
+	}
+	now := time.Date(2017, 10, 1, 8, 30, 0, 0, time.UTC)
+	ical := ev.ical([]string{`"Gitea" <gitea@example.com>`}, []string{"User Two <user2@example.com>", "user4@example.com"}, now)
+
+	for _, line := range []string{
+		"METHOD:REQUEST",
+		"UID:user2/repo1/issues/1@example.com",
+		"SEQUENCE:3",
+		"DTSTAMP:20171001T083000Z",
+		"DTSTART;VALUE=DATE:20171012",
+		"DTEND;VALUE=DATE:20171013",
+		`SUMMARY:[repo1] Fix the build\, again\; finally`,
+		`ORGANIZER;CN="Gitea":mailto:gitea@example.com`,
+		`ATTENDEE;CN="User Two";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=FALSE:mailto:user2@example.com`,
+		"ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=FALSE:mailto:user4@example.com",
+	} {
+		unfolded := strings.Replace(ical, "\r\n ", "", -1)
+		assert.Contains(t, unfolded, "\r\n"+line+"\r\n")
+	}
+	assert.Contains(t, strings.Replace(ical, "\r\n ", "", -1), `DESCRIPTION:Line 1\nLine 2 `)
+	for _, line := range strings.Split(strings.TrimSuffix(ical, "\r\n"), "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+		assert.True(t, utf8.ValidString(line), line)
+	}
+
+	ev.AllDay = false
+	ev.Start = time.Date(2017, 10, 12, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	ical = ev.ical(nil, nil, now)
+	assert.Contains(t, ical, "\r\nDTSTART:20171012T120000Z\r\n")
+	assert.Contains(t, ical, "\r\nDTEND:20171012T120000Z\r\n")
+	assert.NotContains(t, ical, "ORGANIZER")
+}
+
+func TestMessage_SetCalendarEvent(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: `"Gitea" <gitea@example.com>`}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "<p>Due soon</p>")
+	msg.SetCalendarEvent(&CalendarEvent{
+		UID:     "milestone-1@example.com",
+		Summary: "v1.0",
+		Start:   time.Date(2017, 10, 12, 0, 0, 0, 0, time.UTC),
+		AllDay:  true,
+	})
+	msg.SetTextBody("Due soon")
+
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Content-Type: multipart/alternative;")
+	assert.Contains(t, buf.String(), "Content-Type: text/calendar; method=REQUEST; charset=UTF-8")
+
+	c, err := msg.content()
+	assert.NoError(t, err)
+	assert.Equal(t, "Due soon", c.Text)
+	assert.Contains(t, c.HTML, "Due soon")
+	if assert.Len(t, c.Attachments, 1) {
+		assert.Equal(t, "invite.ics", c.Attachments[0].Filename)
+		assert.Equal(t, "text/calendar; method=REQUEST", c.Attachments[0].ContentType)
+		assert.Contains(t, string(c.Attachments[0].Data), "ATTENDEE;ROLE=REQ-PARTICIPANT")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// sendCallback is called with the outcome of a queued message.
+type sendCallback struct {
+	ctx context.Context
+	fn  func(error)
+}
+
+// sendCallbacks keeps the callbacks of queued messages by message ID, as a
+// persistent queue does not return the same message instance.
+type sendCallbacks struct {
+	lock      sync.Mutex
+	callbacks map[string]sendCallback
+}
+
+func headerMessageID(msg *Message) string {
+	if ids := msg.GetHeader("Message-ID"); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+func (c *sendCallbacks) add(ctx context.Context, msg *Message, fn func(error)) {
+	c.lock.Lock()
+	if c.callbacks == nil {
+		c.callbacks = make(map[string]sendCallback)
+	}
+	c.callbacks[headerMessageID(msg)] = sendCallback{ctx, fn}
+	c.lock.Unlock()
+}
+
+// canceled returns the error of the context of the message, if it is done.
+func (c *sendCallbacks) canceled(msg *Message) error {
+	c.lock.Lock()
+	cb, ok := c.callbacks[headerMessageID(msg)]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return cb.ctx.Err()
+}
+
+// done calls and removes the callback of the message, if any.
+func (c *sendCallbacks) done(msg *Message, err error) {
+	id := headerMessageID(msg)
+	c.lock.Lock()
+	cb, ok := c.callbacks[id]
+	delete(c.callbacks, id)
+	c.lock.Unlock()
+	if ok {
+		cb.fn(err)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// reservedHeaders are the headers API based senders pass as dedicated fields.
+var reservedHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Sender":                    true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Dkim-Signature":            true,
+}
+
+// messageAttachment is an attached or embedded file of a message.
+type messageAttachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string // Only set for embedded files.
+	Data        []byte
+}
+
+// messageContent is the decoded content of a message. It is used by the
+// senders which deliver mails through an HTTP API instead of SMTP.
+type messageContent struct {
+	From        *mail.Address
+	ReplyTo     []*mail.Address
+	To, Cc, Bcc []*mail.Address
+	Subject     string
+	Text, HTML  string
+	Headers     map[string]string // Headers which are not reserved.
+	Attachments []*messageAttachment
+}
+
+// headerDecoder decodes RFC 2047 encoded words.
+var headerDecoder = new(mime.WordDecoder)
+
+// content renders the message and decodes the result.
+func (m *Message) content() (*messageContent, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	parsed, err := mail.ReadMessage(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &messageContent{
+		Headers: make(map[string]string),
+	}
+
+	from, err := parsed.Header.AddressList("From")
+	if err != nil {
+		return nil, err
+	}
+	c.From = from[0]
+	for field, list := range map[string]*[]*mail.Address{
+		"Reply-To": &c.ReplyTo,
+		"To":       &c.To,
+		"Cc":       &c.Cc,
+	} {
+		if parsed.Header.Get(field) == "" {
+			continue
+		}
+		if *list, err = parsed.Header.AddressList(field); err != nil {
+			return nil, err
+		}
+	}
+	// Bcc is not part of the rendered message.
+	for _, a := range m.GetHeader("Bcc") {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		c.Bcc = append(c.Bcc, addr)
+	}
+	if m.rcpts != nil {
+		c.To, c.Cc, c.Bcc = m.recipients(c.To), m.recipients(c.Cc), m.recipients(c.Bcc)
+	}
+
+	if c.Subject, err = headerDecoder.DecodeHeader(parsed.Header.Get("Subject")); err != nil {
+		return nil, err
+	}
+	for field, values := range parsed.Header {
+		if !reservedHeaders[field] && len(values) > 0 {
+			c.Headers[field] = values[0]
+		}
+	}
+
+	if err = c.readPart(parsed.Header.Get("Content-Type"), parsed.Header.Get("Content-Transfer-Encoding"),
+		"", "", parsed.Body); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// recipients returns the addresses of the list which are recipients of the
+// current delivery.
+func (m *Message) recipients(list []*mail.Address) []*mail.Address {
+	var rcpts []*mail.Address
+	for _, addr := range list {
+		if m.isRecipient(addr.Address) {
+			rcpts = append(rcpts, addr)
+		}
+	}
+	return rcpts
+}
+
+// readPart decodes a MIME part and collects its bodies and files.
+func (c *messageContent) readPart(contentType, encoding, disposition, contentID string, r io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err = c.readPart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), p.Header.Get("Content-ID"), p); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	if dispType == "" {
+		switch mediaType {
+		case "text/plain":
+			c.Text = string(data)
+			return nil
+		case "text/html":
+			c.HTML = string(data)
+			return nil
+		}
+	}
+
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := headerDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	// APIs take the calendar part of invitations as file only.
+	if mediaType == "text/calendar" && dispType == "" {
+		if filename == "" {
+			filename = "invite.ics"
+		}
+		if method := params["method"]; len(method) > 0 {
+			mediaType = mime.FormatMediaType(mediaType, map[string]string{"method": method})
+		}
+	}
+	c.Attachments = append(c.Attachments, &messageAttachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		ContentID:   strings.Trim(contentID, "<>"),
+		Data:        data,
+	})
+	return nil
+}
+
+// splitRawMessage splits the rendered message into the header section,
+// including the CRLF of the last field, and the body. Line endings are
+// normalized to CRLF.
+func splitRawMessage(raw []byte) (header, body []byte) {
+	raw = bytes.Replace(bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+2], raw[i+4:]
+	}
+	return raw, nil
+}
+
+// splitContentEntity splits the rendered message into the outer header fields
+// and the MIME entity made of content header fields and body, as needed to
+// sign or encrypt the content.
+func splitContentEntity(raw []byte) (outer, entity *bytes.Buffer) {
+	header, body := splitRawMessage(raw)
+
+	outer, entity = new(bytes.Buffer), new(bytes.Buffer)
+	for _, field := range splitHeaderFields(header) {
+		name := strings.ToLower(fieldName(field))
+		switch {
+		case name == "mime-version":
+		case strings.HasPrefix(name, "content-"):
+			entity.WriteString(field + "\r\n")
+		default:
+			outer.WriteString(field + "\r\n")
+		}
+	}
+	if entity.Len() == 0 {
+		entity.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+	return outer, entity
+}
+
+// splitHeaderFields splits the header section into its fields,
+// keeping continuation lines with the field they belong to.
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return field
+}
+
+// hasHeaderField checks if the header section of the rendered message
+// contains the field.
+func hasHeaderField(raw []byte, name string) bool {
+	header, _ := splitRawMessage(raw)
+	for _, field := range splitHeaderFields(header) {
+		if strings.EqualFold(fieldName(field), name) {
+			return true
+		}
+	}
+	return false
+}
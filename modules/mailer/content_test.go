@@ -0,0 +1,68 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+func TestMessageContent(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: `"Gitea" <gitea@example.com>`}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Grüße", "<p>Hello <b>world</b></p>")
+	msg.SetHeader("Bcc", "user3@example.com")
+	msg.SetHeader("X-Gitea-Test", "yes")
+	msg.Attach("patch.diff", gomail.SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write([]byte("diff --git"))
+		return err
+	}))
+
+	c, err := msg.content()
+	assert.NoError(t, err)
+	assert.Equal(t, "gitea@example.com", c.From.Address)
+	assert.Equal(t, "Gitea", c.From.Name)
+	assert.Equal(t, "user2@example.com", c.To[0].Address)
+	assert.Equal(t, "user3@example.com", c.Bcc[0].Address)
+	assert.Equal(t, "Grüße", c.Subject)
+	assert.Equal(t, "yes", c.Headers["X-Gitea-Test"])
+	assert.Contains(t, c.HTML, "<b>world</b>")
+	assert.Contains(t, c.Text, "Hello")
+	if assert.Len(t, c.Attachments, 1) {
+		assert.Equal(t, "patch.diff", c.Attachments[0].Filename)
+		assert.Equal(t, "diff --git", string(c.Attachments[0].Data))
+	}
+
+	// A delivery to some of the recipients only.
+	msg.rcpts = []string{"user3@example.com"}
+	c, err = msg.content()
+	assert.NoError(t, err)
+	assert.Empty(t, c.To)
+	assert.Equal(t, "user3@example.com", c.Bcc[0].Address)
+}
+
+func TestMessageAlternativeBodies(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "<p>Generated</p>")
+	msg.SetAlternativeBodies("Custom text", "<p>Custom HTML</p>")
+
+	c, err := msg.content()
+	assert.NoError(t, err)
+	assert.Equal(t, "Custom text", c.Text)
+	assert.Equal(t, "<p>Custom HTML</p>", c.HTML)
+
+	setting.MailService.SendAsPlainText = true
+	msg = NewMessage([]string{"user2@example.com"}, "Subject", "<p>Body</p>")
+	c, err = msg.content()
+	assert.NoError(t, err)
+	assert.Equal(t, "Body", c.Text)
+	assert.Empty(t, c.HTML)
+}
@@ -5,6 +5,7 @@
 package mailer
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -16,45 +17,333 @@ import (
 )
 
 const (
-	keepaliveTimeout = 30 * time.Second
+	// Interval in which the number of workers is adjusted to the queue length.
+	autoscaleInterval = 10 * time.Second
+	// Number of queued messages which justify an additional worker.
+	autoscaleQueueDepth = 10
 )
 
 // Daemon implements an asynchronous mail service daemon.
 type Daemon struct {
-	mailQueue chan *Message
+	queue        Queue
+	rateLimit    *rateLimiter       // Nil if not limited.
+	domainLimits *domainRateLimiter // Nil if not limited.
+	breaker      *circuitBreaker    // Nil if disabled.
+	alerts       *alertMonitor
+
+	workerLock  sync.Mutex
+	workerStops []chan struct{} // Closed to stop the worker routine.
+	minWorkers  int
+	maxWorkers  int
+
+	partitionStops []chan struct{} // Closed to stop a worker of a queue partition.
+
+	callbacks sendCallbacks
+	started   time.Time
 
 	closeMutex sync.Mutex
 	closeChan  chan struct{}
+	workers    sync.WaitGroup
 }
 
 // NewDaemon create a new mail daemon.
 func NewDaemon() (*Daemon, error) {
 	queueLen := setting.MailService.QueueLength
-	workers := setting.MailService.Workers
 
 	// Validate input.
 	if queueLen < 0 {
 		return nil, fmt.Errorf("mail daemon: invalid queue length: %v", queueLen)
-	} else if workers < 1 {
-		return nil, fmt.Errorf("mail daemon: invalid workers routines: %v", workers)
+	}
+
+	q, err := createQueue()
+	if err != nil {
+		return nil, err
 	}
 
 	d := &Daemon{
-		mailQueue: make(chan *Message, queueLen),
+		queue:     q,
+		alerts:    &alertMonitor{},
 		closeChan: make(chan struct{}),
+		started:   time.Now(),
+	}
+	d.newRateLimits()
+
+	if err = d.SetWorkers(setting.MailService.Workers, setting.MailService.MaxWorkers); err != nil {
+		d.Close()
+		return nil, err
+	}
+	d.workerLock.Lock()
+	err = d.startPartitionWorkers()
+	d.workerLock.Unlock()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	go d.autoscale()
+	go d.watchAlerts()
+	return d, nil
+}
+
+// newRateLimits creates the rate limiters and the circuit breaker of the
+// current settings.
+func (d *Daemon) newRateLimits() {
+	d.rateLimit, d.domainLimits = nil, nil
+	if perMinute := setting.MailService.RateLimit; perMinute > 0 {
+		d.rateLimit = newRateLimiter(perMinute, setting.MailService.RateLimitBurst)
+	}
+	if perDomain := setting.MailService.RateLimitPerDomain; perDomain > 0 {
+		d.domainLimits = newDomainRateLimiter(perDomain)
+	}
+	d.breaker = nil
+	if threshold := setting.MailService.CircuitBreakerThreshold; threshold > 0 {
+		d.breaker = newCircuitBreaker(threshold, setting.MailService.CircuitBreakerProbeInterval)
+	}
+}
+
+// Reconfigure replaces the mail settings by opts and rebuilds the senders,
+// rate limits and workers. The workers finish the messages they are sending
+// with the old senders first. The queue is kept as it is. Settings which
+// fail to build the senders are rejected, the workers keep running with
+// the current settings then.
+// This method is thread-safe.
+func (d *Daemon) Reconfigure(opts *setting.Mailer) error {
+	min, max := opts.Workers, opts.MaxWorkers
+	if max == 0 {
+		max = min
+	}
+	if min < 1 || max < min {
+		return ErrInvalidWorkers{min, max}
+	}
+	if err := checkSender(opts); err != nil {
+		return err
+	}
+
+	d.workerLock.Lock()
+	defer d.workerLock.Unlock()
+
+	if d.IsClosed() {
+		setting.MailService = opts
+		return nil
+	}
+
+	n, old := len(d.workerStops), setting.MailService
+	d.stopWorkers()
+	setting.MailService = opts
+	err := d.startWorkers(n)
+	if err == nil {
+		return nil
+	}
+
+	log.Error(3, "Failed to start mail workers with the new settings, keeping the current settings: %v", err)
+	d.stopWorkers()
+	setting.MailService = old
+	if serr := d.startWorkers(n); serr != nil {
+		log.Error(3, "Failed to restart mail workers: %v", serr)
+	}
+	return err
+}
+
+// stopWorkers stops all workers, which close their senders, and closes
+// the pooled connections.
+// The caller must hold the workerLock.
+func (d *Daemon) stopWorkers() {
+	for _, stop := range d.workerStops {
+		close(stop)
+	}
+	for _, stop := range d.partitionStops {
+		close(stop)
+	}
+	d.workerStops, d.partitionStops = nil, nil
+	d.workers.Wait()
+
+	if err := resetSMTPPool(); err != nil {
+		log.Error(3, "Failed to close mail server connections: %v", err)
+	}
+	if err := resetDirectPools(); err != nil {
+		log.Error(3, "Failed to close mail server connections: %v", err)
+	}
+	if err := resetRoutePools(); err != nil {
+		log.Error(3, "Failed to close mail server connections: %v", err)
+	}
+	if err := resetFallbackPools(); err != nil {
+		log.Error(3, "Failed to close mail server connections: %v", err)
+	}
+	resetSyncSenders()
+}
+
+// startWorkers starts n workers, within the limits of the settings, and the
+// workers of the partitions with the current settings.
+// The caller must hold the workerLock.
+func (d *Daemon) startWorkers(n int) error {
+	d.newRateLimits()
+
+	min, max := setting.MailService.Workers, setting.MailService.MaxWorkers
+	if max == 0 {
+		max = min
+	}
+	d.minWorkers, d.maxWorkers = min, max
+	if n < min {
+		n = min
+	} else if n > max {
+		n = max
+	}
+	if err := d.scaleWorkers(n); err != nil {
+		return err
+	}
+	return d.startPartitionWorkers()
+}
+
+// ErrInvalidWorkers represents a "InvalidWorkers" kind of error.
+type ErrInvalidWorkers struct {
+	Min, Max int
+}
+
+// IsErrInvalidWorkers checks if an error is a ErrInvalidWorkers.
+func IsErrInvalidWorkers(err error) bool {
+	_, ok := err.(ErrInvalidWorkers)
+	return ok
+}
+
+func (err ErrInvalidWorkers) Error() string {
+	return fmt.Sprintf("invalid number of mail workers [min: %d, max: %d]", err.Min, err.Max)
+}
+
+// Workers returns the number of running worker routines and the
+// range in which the number is adjusted to the queue length. The workers
+// of the queue partitions are not counted.
+func (d *Daemon) Workers() (running, min, max int) {
+	d.workerLock.Lock()
+	defer d.workerLock.Unlock()
+	return len(d.workerStops), d.minWorkers, d.maxWorkers
+}
+
+// SetWorkers changes the number of worker routines. With a max larger
+// than min, workers are added and removed depending on the queue length.
+// A max of 0 keeps the number of workers fixed to min.
+// This method is thread-safe.
+func (d *Daemon) SetWorkers(min, max int) error {
+	if max == 0 {
+		max = min
+	}
+	if min < 1 || max < min {
+		return ErrInvalidWorkers{min, max}
+	}
+
+	d.workerLock.Lock()
+	defer d.workerLock.Unlock()
+
+	d.minWorkers, d.maxWorkers = min, max
+	n := len(d.workerStops)
+	if n < min {
+		n = min
+	} else if n > max {
+		n = max
+	}
+	return d.scaleWorkers(n)
+}
+
+// scaleWorkers starts or stops worker routines until n are running.
+// The caller must hold the workerLock.
+func (d *Daemon) scaleWorkers(n int) error {
+	if d.IsClosed() {
+		return nil
+	}
+
+	if n != len(d.workerStops) {
+		log.Trace("Mail daemon: scaling from %d to %d workers", len(d.workerStops), n)
+	}
+	for len(d.workerStops) > n {
+		last := len(d.workerStops) - 1
+		close(d.workerStops[last])
+		d.workerStops = d.workerStops[:last]
 	}
 
 	// Create a sender for each mail worker routine.
-	for i := 0; i < workers; i++ {
+	for len(d.workerStops) < n {
 		s, err := createSender()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		go d.processMailQueue(s)
+		stop := make(chan struct{})
+		d.workerStops = append(d.workerStops, stop)
+		d.workers.Add(1)
+		go d.processMailQueue(s, d.workerQueue(), stop)
+	}
+	return nil
+}
+
+// workerQueue returns the queue of the workers of [mailer], which is the
+// first partition of a partitioned queue.
+func (d *Daemon) workerQueue() Queue {
+	if pq, ok := d.queue.(*partitionedQueue); ok {
+		return pq.queues[0]
 	}
+	return d.queue
+}
 
-	return d, nil
+// startPartitionWorkers starts the SEND_WORKERS worker routines of every
+// partition of the queue. A partition removed from the settings keeps one
+// worker until the queue is reopened on restart.
+// The caller must hold the workerLock.
+func (d *Daemon) startPartitionWorkers() error {
+	pq, ok := d.queue.(*partitionedQueue)
+	if !ok || d.IsClosed() {
+		return nil
+	}
+
+	for i := 1; i < len(pq.queues); i++ {
+		workers := 1
+		for _, p := range setting.MailService.Partitions {
+			if p.Name == pq.names[i] {
+				workers = p.Workers
+			}
+		}
+		for j := 0; j < workers; j++ {
+			s, err := createSender()
+			if err != nil {
+				return err
+			}
+
+			stop := make(chan struct{})
+			d.partitionStops = append(d.partitionStops, stop)
+			d.workers.Add(1)
+			go d.processMailQueue(s, pq.queues[i], stop)
+		}
+	}
+	return nil
+}
+
+// autoscale adjusts the number of workers to the queue length. Workers are
+// added at once if needed, but removed one by one to avoid flapping.
+func (d *Daemon) autoscale() {
+	t := time.NewTicker(autoscaleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.closeChan:
+			return
+		case <-t.C:
+		}
+
+		d.workerLock.Lock()
+		running := len(d.workerStops)
+		if d.maxWorkers > d.minWorkers {
+			n := d.minWorkers + d.workerQueue().Len()/autoscaleQueueDepth
+			if n > d.maxWorkers {
+				n = d.maxWorkers
+			}
+			if n < running {
+				n = running - 1
+			}
+			if err := d.scaleWorkers(n); err != nil {
+				log.Error(3, "Failed to scale mail workers: %v", err)
+			}
+		}
+		d.workerLock.Unlock()
+	}
 }
 
 // IsClosed returns a boolean indicating if the daemon is closed.
@@ -79,24 +368,82 @@ func (d *Daemon) Close() {
 		return
 	}
 
-	// Release routines.
+	// Release routines and wait for them to finish their current message.
+	d.workerLock.Lock()
 	close(d.closeChan)
+	d.workerStops, d.partitionStops = nil, nil
+	d.workerLock.Unlock()
+	d.workers.Wait()
+
+	if err := d.queue.Close(); err != nil {
+		log.Error(3, "Failed to close mail queue: %v", err)
+	}
 }
 
 // SendAsync send mail asynchronous.
 func (d *Daemon) SendAsync(msg *Message) {
-	// TODO: think about removing the extra goroutine an
-	//       drop mails if the channel is full/flooded.
-	go func() {
-		// Don't block if closed.
-		select {
-		case <-d.closeChan:
-		case d.mailQueue <- msg:
-		}
-	}()
+	d.send(msg)
+}
+
+// SendAsyncWithCallback sends the mail asynchronous and calls fn once the
+// mail is sent, could not be queued or is given up after all retries. The
+// mail is not sent anymore once ctx is done, fn gets the error of ctx then.
+// The callback is lost if the daemon is closed or the mail is removed from
+// the queue before. It is called by a worker routine and must not block.
+func (d *Daemon) SendAsyncWithCallback(ctx context.Context, msg *Message, fn func(error)) {
+	if len(headerMessageID(msg)) == 0 {
+		msg.SetHeader("Message-ID", newMessageID())
+	}
+	d.callbacks.add(ctx, msg, fn)
+	if err := d.send(msg); err != nil {
+		d.callbacks.done(msg, err)
+	}
+}
+
+func (d *Daemon) send(msg *Message) error {
+	// The preferences of the receivers are resolved once when the message is
+	// first queued, not again when it is queued once more.
+	if msg.queued.IsZero() && !filterRecipients(msg) {
+		log.Trace("No receiver wants to get the email: %s", msg.Info)
+		return ErrNoRecipients
+	}
+	if err := beforeEnqueue(msg); err != nil {
+		log.Error(3, "Failed to queue emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		return err
+	}
+	addTracking(msg)
+	redirectRecipients(msg)
+	if err := msg.encryptPending(); err != nil {
+		log.Error(3, "Failed to encrypt emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		return err
+	}
+	if err := checkSize(msg); err != nil {
+		log.Error(3, "Failed to queue emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		return err
+	}
+	if msg.queued.IsZero() {
+		msg.queued = time.Now()
+	}
+	err := d.queue.Push(msg)
+	if err != nil {
+		log.Error(3, "Failed to queue emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+	return err
+}
+
+// SendAt queues the mail to be sent at the given time. A persistent queue
+// keeps scheduled mails across restarts. The error tells if the mail could
+// not be queued.
+func (d *Daemon) SendAt(msg *Message, at time.Time) error {
+	msg.sendAt = at
+	return d.send(msg)
 }
 
-func (d *Daemon) processMailQueue(s Sender) {
+// processMailQueue sends the messages of the queue, which is the partition
+// of the worker.
+func (d *Daemon) processMailQueue(s Sender, q Queue, stop <-chan struct{}) {
+	defer d.workers.Done()
+
 	var err error
 
 	// Our close connection timer.
@@ -104,6 +451,14 @@ func (d *Daemon) processMailQueue(s Sender) {
 	defer t.Stop()
 
 	for {
+		// Workers do not take mails from the queue while the delivery is paused.
+		if d.breaker != nil && !d.breaker.Wait(stop, d.closeChan) {
+			if err = s.Close(); err != nil {
+				log.Error(3, "Failed to close mail sender connection: %v", err)
+			}
+			return
+		}
+
 		select {
 		case <-d.closeChan:
 			if err = s.Close(); err != nil {
@@ -111,22 +466,178 @@ func (d *Daemon) processMailQueue(s Sender) {
 			}
 			return
 
-		case msg := <-d.mailQueue:
+		case <-stop:
+			if err = s.Close(); err != nil {
+				log.Error(3, "Failed to close mail sender connection: %v", err)
+			}
+			return
+
+		case msg := <-q.Chan():
+			if delay := d.throttle(msg); delay > 0 && d.deferMessage(msg, delay) {
+				continue
+			}
+
+			if cerr := d.callbacks.canceled(msg); cerr != nil {
+				log.Trace("Discarding canceled e-mails %s: %s - %v", msg.GetHeader("To"), msg.Info, cerr)
+				if err = d.queue.Done(msg); err != nil {
+					log.Error(3, "Failed to remove canceled emails from queue %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+				}
+				d.callbacks.done(msg, cerr)
+				continue
+			}
+
+			// Another worker may have taken the probe since Wait returned,
+			// the message keeps the rate limits it reserved then.
+			if d.breaker != nil && !d.breaker.Allow() {
+				msg.reserved = true
+				if d.deferMessage(msg, 0) {
+					continue
+				}
+			}
+
 			log.Trace("New e-mails sending request %s: %s", msg.GetHeader("To"), msg.Info)
-			if err = s.Send(msg); err != nil {
+			attempt := msg.attempts + 1
+			start := time.Now()
+			err = sendWithHooks(s, msg)
+			duration := time.Since(start)
+			countSend(backendName(), duration, err)
+			if d.breaker != nil {
+				d.breaker.Done(err)
+			}
+			d.alerts.Done(err, time.Now())
+			if err != nil {
 				log.Error(3, "Failed to send emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+				status := d.handleFailure(msg, err)
+				recordDelivery(msg, attempt, duration, err, status)
+				afterSend(msg, duration, err, status)
+				if status == DeliveryFailed {
+					d.callbacks.done(msg, err)
+				}
 			} else {
 				log.Trace("E-mails sent %s: %s", msg.GetHeader("To"), msg.Info)
+				recordDelivery(msg, attempt, duration, nil, DeliverySent)
+				afterSend(msg, duration, nil, DeliverySent)
+				d.callbacks.done(msg, nil)
+			}
+			if err = d.queue.Done(msg); err != nil {
+				log.Error(3, "Failed to remove sent emails from queue %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
 			}
 
-			// Reset the keepalive timeout timer.
-			t.Reset(keepaliveTimeout)
+			// Reset the idle timeout timer.
+			wait, ok := expireIdle(s)
+			if !ok {
+				wait = setting.MailService.SMTPIdleTimeout
+			}
+			if wait > 0 {
+				t.Reset(wait)
+			}
 
-		// Close the mail server connection if no email was sent within the timeout.
+		// Close the mail server connections which were idle for the
+		// timeout, unless they are kept alive.
 		case <-t.C:
-			if err = s.Close(); err != nil {
+			if wait, ok := expireIdle(s); ok {
+				if wait > 0 {
+					t.Reset(wait)
+				}
+			} else if err = s.Close(); err != nil {
 				log.Error(3, "Failed to close mail sender connection: %v", err)
 			}
 		}
 	}
 }
+
+// throttle reserves the sending of the message under the rate limits and
+// returns how long to wait before it may be sent. A message is reserved
+// once, it is sent when it comes back from the queue after the delay.
+func (d *Daemon) throttle(msg *Message) time.Duration {
+	if msg.reserved {
+		msg.reserved = false
+		return 0
+	}
+	now := time.Now()
+
+	var delay time.Duration
+	if d.rateLimit != nil {
+		delay = d.rateLimit.Reserve(now)
+	}
+	if d.domainLimits != nil {
+		// Invalid recipients are reported by the sender.
+		if _, to, err := msg.envelope(); err == nil {
+			if domainDelay := d.domainLimits.Reserve(to, now); domainDelay > delay {
+				delay = domainDelay
+			}
+		}
+	}
+	msg.reserved = delay > 0
+	return delay
+}
+
+// deferMessage queues the throttled or paused message again to be sent after
+// the delay, so the worker goes on with the messages to other domains instead
+// of waiting. It returns false if the message could not be queued, it is
+// sent at once then.
+func (d *Daemon) deferMessage(msg *Message, delay time.Duration) bool {
+	log.Trace("Delaying e-mails %s: %s by %v", msg.GetHeader("To"), msg.Info, delay)
+	sendAt := msg.sendAt
+	msg.sendAt = time.Now().Add(delay)
+	if err := d.queue.Push(msg); err != nil {
+		log.Error(3, "Failed to delay emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		msg.sendAt, msg.reserved = sendAt, false
+		return false
+	}
+	if err := d.queue.Done(msg); err != nil {
+		log.Error(3, "Failed to remove delayed emails from queue %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+	return true
+}
+
+// retryDelay returns the delay before the retry of a message which failed the
+// number of attempts. It starts at RETRY_DELAY and doubles with every failed
+// attempt up to RETRY_MAX_DELAY, so a failing relay is not retried at once.
+func retryDelay(attempts int) time.Duration {
+	delay, max := setting.MailService.RetryDelay, setting.MailService.RetryMaxDelay
+	for i := 1; i < attempts && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// handleFailure queues the failed message again after the retry delay or
+// moves it to the dead letters once all retries are exhausted.
+func (d *Daemon) handleFailure(msg *Message, sendErr error) DeliveryStatus {
+	msg.lastError = sendErr.Error()
+	msg.failed = time.Now()
+
+	// Greylisting servers accept the message once it is retried after a
+	// delay, which does not count as a failed attempt until the timeout.
+	if IsErrGreylisted(sendErr) && msg.failed.Sub(msg.queued) < setting.MailService.GreylistTimeout {
+		msg.sendAt = msg.failed.Add(setting.MailService.GreylistDelay)
+		err := d.queue.Push(msg)
+		if err == nil {
+			countRetry()
+			return DeliveryDeferred
+		}
+		log.Error(3, "Failed to requeue emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+
+	msg.attempts++
+
+	if msg.attempts <= setting.MailService.MaxRetries && !IsErrPermanentFailure(sendErr) {
+		msg.sendAt = msg.failed.Add(retryDelay(msg.attempts))
+		err := d.queue.Push(msg)
+		if err == nil {
+			countRetry()
+			return DeliveryDeferred
+		}
+		log.Error(3, "Failed to requeue emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+
+	log.Warn("Giving up on emails %s: %s after %d attempts", msg.GetHeader("To"), msg.Info, msg.attempts)
+	if err := d.queue.DeadLetters().Add(msg); err != nil {
+		log.Error(3, "Failed to store dead letter %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+	return DeliveryFailed
+}
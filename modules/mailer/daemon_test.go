@@ -0,0 +1,282 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemonSetWorkers(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "dummy",
+		Workers:  2,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	running, min, max := d.Workers()
+	assert.Equal(t, []int{2, 2, 2}, []int{running, min, max})
+
+	assert.NoError(t, d.SetWorkers(4, 0))
+	running, min, max = d.Workers()
+	assert.Equal(t, []int{4, 4, 4}, []int{running, min, max})
+
+	// The number of running workers is kept within the new range.
+	assert.NoError(t, d.SetWorkers(1, 3))
+	running, min, max = d.Workers()
+	assert.Equal(t, []int{3, 1, 3}, []int{running, min, max})
+
+	assert.True(t, IsErrInvalidWorkers(d.SetWorkers(0, 0)))
+	assert.True(t, IsErrInvalidWorkers(d.SetWorkers(3, 2)))
+}
+
+func TestDaemonReconfigure(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "dummy",
+		Workers:  2,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	opts := &setting.Mailer{
+		From:      "gitea@example.com",
+		MailType:  "dummy",
+		Workers:   1,
+		RateLimit: 60,
+	}
+	assert.NoError(t, d.Reconfigure(opts))
+	assert.True(t, setting.MailService == opts)
+	running, min, max := d.Workers()
+	assert.Equal(t, []int{1, 1, 1}, []int{running, min, max})
+	assert.NotNil(t, d.rateLimit)
+
+	// Invalid settings keep the current settings and the running workers.
+	assert.True(t, IsErrInvalidWorkers(d.Reconfigure(&setting.Mailer{From: "gitea@example.com", MailType: "dummy"})))
+	assert.Error(t, d.Reconfigure(&setting.Mailer{From: "gitea@example.com", MailType: "webhook", Workers: 2}))
+	assert.Error(t, d.Reconfigure(&setting.Mailer{From: "gitea@example.com", MailType: "smtp", Workers: 2}))
+	assert.True(t, setting.MailService == opts)
+	running, _, _ = d.Workers()
+	assert.Equal(t, 1, running)
+}
+
+func TestDaemonPartitions(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:        "gitea@example.com",
+		MailType:    "dummy",
+		QueueType:   "channel",
+		QueueLength: 10,
+		Workers:     1,
+		Partitions:  []*setting.MailPartition{{Name: "security", Categories: []string{"security"}, Workers: 2}},
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+	assert.Len(t, d.partitionStops, 2)
+
+	// The partitions keep their workers when the daemon is reconfigured.
+	assert.NoError(t, d.Reconfigure(setting.MailService))
+	assert.Len(t, d.partitionStops, 2)
+	running, _, _ := d.Workers()
+	assert.Equal(t, 1, running)
+
+	done := make(chan error, 1)
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.Category = CategorySecurity
+	d.SendAsyncWithCallback(context.Background(), msg, func(err error) { done <- err })
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("security mail not sent")
+	}
+}
+
+func TestDaemonPartitions_Probe(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:                        "gitea@example.com",
+		MailType:                    "dummy",
+		QueueType:                   "channel",
+		QueueLength:                 10,
+		Workers:                     1,
+		Partitions:                  []*setting.MailPartition{{Name: "security", Categories: []string{"security"}, Workers: 2}},
+		CircuitBreakerThreshold:     1,
+		CircuitBreakerProbeInterval: 20 * time.Millisecond,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	// The idle workers of the security partition do not hold the probe.
+	d.breaker.Done(errors.New("dial tcp: connection refused"))
+	assert.Equal(t, CircuitOpen, d.breaker.State())
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	d.SendAsyncWithCallback(context.Background(), NewMessage([]string{"user2@example.com"}, "Subject", "Body"), func(err error) { done <- err })
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe not sent")
+	}
+	assert.Equal(t, CircuitClosed, d.breaker.State())
+
+	// Neither do the idle default workers hold the probe of the partition.
+	d.breaker.Done(errors.New("dial tcp: connection refused"))
+	assert.Equal(t, CircuitOpen, d.breaker.State())
+	time.Sleep(50 * time.Millisecond)
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.Category = CategorySecurity
+	d.SendAsyncWithCallback(context.Background(), msg, func(err error) { done <- err })
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("security probe not sent")
+	}
+	assert.Equal(t, CircuitClosed, d.breaker.State())
+}
+
+func TestDaemonSendAsyncWithCallback(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:        "gitea@example.com",
+		MailType:    "dummy",
+		Workers:     1,
+		QueueLength: 10,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	wait := func(result chan error) error {
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("callback not called")
+			return nil
+		}
+	}
+
+	result := make(chan error, 1)
+	d.SendAsyncWithCallback(context.Background(), NewMessage([]string{"user@example.com"}, "Subject", "Body"), func(err error) {
+		result <- err
+	})
+	assert.NoError(t, wait(result))
+
+	// Canceled mails are not sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.SendAsyncWithCallback(ctx, NewMessage([]string{"user@example.com"}, "Subject", "Body"), func(err error) {
+		result <- err
+	})
+	assert.Equal(t, context.Canceled, wait(result))
+}
+
+func TestDaemonHandleFailure_Greylisted(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:            "gitea@example.com",
+		MailType:        "dummy",
+		Workers:         1,
+		GreylistDelay:   5 * time.Minute,
+		GreylistTimeout: time.Hour,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	greylisted := ErrGreylisted{&textproto.Error{Code: 450, Msg: "4.2.0 Greylisted"}}
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.queued = time.Now()
+	assert.Equal(t, DeliveryDeferred, d.handleFailure(msg, greylisted))
+	assert.Equal(t, 0, msg.attempts)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), msg.sendAt, time.Minute)
+
+	// Greylisting counts as a failed attempt after the timeout.
+	msg.queued = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, DeliveryFailed, d.handleFailure(msg, greylisted))
+	assert.Equal(t, 1, msg.attempts)
+
+	assert.True(t, isGreylisting(greylisted.Err))
+	assert.False(t, isGreylisting(&textproto.Error{Code: 550, Msg: "5.7.1 Greylisted forever"}))
+	assert.False(t, isGreylisting(errors.New("450 greylisted")))
+	assert.True(t, isGreylisting(&textproto.Error{Code: 451, Msg: "4.7.1 Please try again later"}))
+	assert.False(t, isGreylisting(&textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full, try again later"}))
+	assert.False(t, isGreylisting(&textproto.Error{Code: 421, Msg: "4.7.0 Too many connections, try again later"}))
+}
+
+func TestDaemonHandleFailure_Retry(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:          "gitea@example.com",
+		MailType:      "dummy",
+		Workers:       1,
+		QueueLength:   10,
+		MaxRetries:    2,
+		RetryDelay:    time.Minute,
+		RetryMaxDelay: 90 * time.Second,
+	}
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	// The retries are scheduled with a growing delay.
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	assert.Equal(t, DeliveryDeferred, d.handleFailure(msg, errors.New("connection refused")))
+	assert.Equal(t, 1, msg.attempts)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), msg.sendAt, 10*time.Second)
+	assert.Equal(t, DeliveryDeferred, d.handleFailure(msg, errors.New("connection refused")))
+	assert.Equal(t, 2, msg.attempts)
+	assert.WithinDuration(t, time.Now().Add(90*time.Second), msg.sendAt, 10*time.Second)
+	// Scheduled retries do not count as waiting.
+	pending, err := d.queue.List()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, 0, d.queue.Len())
+
+	// The message is given up once the retries are exhausted.
+	assert.Equal(t, DeliveryFailed, d.handleFailure(msg, errors.New("connection refused")))
+	deadLetters, err := d.queue.DeadLetters().List()
+	assert.NoError(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, 3, deadLetters[0].Attempts)
+		assert.Equal(t, "connection refused", deadLetters[0].Error)
+	}
+
+	// Rejected messages are not retried.
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	assert.Equal(t, DeliveryFailed, d.handleFailure(msg, ErrPermanentFailure{errors.New("550 rejected")}))
+}
+
+func TestRetryDelay(t *testing.T) {
+	setting.MailService = &setting.Mailer{RetryDelay: time.Minute, RetryMaxDelay: time.Hour}
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 32*time.Minute, retryDelay(6))
+	assert.Equal(t, time.Hour, retryDelay(7))
+	assert.Equal(t, time.Hour, retryDelay(100))
+
+	setting.MailService.RetryDelay = 0
+	assert.Equal(t, time.Duration(0), retryDelay(3))
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Certificate usages of TLSA records, only DANE-TA and DANE-EE are usable
+// for SMTP (RFC 7672).
+const (
+	tlsaDANETA = 2
+	tlsaDANEEE = 3
+)
+
+// tlsaRecord is a TLSA record (RFC 6698) of a mail server.
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// usable reports whether the record can be used to authenticate the server.
+func (r *tlsaRecord) usable() bool {
+	return (r.Usage == tlsaDANETA || r.Usage == tlsaDANEEE) && r.Selector <= 1 && r.MatchingType <= 2
+}
+
+// matches reports whether the record matches the certificate.
+func (r *tlsaRecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// lookupTLSA returns the usable TLSA records of the SMTP server of the host,
+// if they are secure. A failed lookup makes the host unusable, as it may be
+// caused by an attacker.
+var lookupTLSA = func(host string) ([]*tlsaRecord, error) {
+	result, err := dnsQuery("_25._tcp."+host, dnsTypeTLSA)
+	if err != nil {
+		return nil, fmt.Errorf("TLSA lookup of %s failed: %v", host, err)
+	}
+	if !result.Secure {
+		return nil, nil
+	}
+
+	var records []*tlsaRecord
+	for _, rr := range result.Records {
+		if len(rr.Data) < 4 {
+			continue
+		}
+		r := &tlsaRecord{Usage: rr.Data[0], Selector: rr.Data[1], MatchingType: rr.Data[2], Data: rr.Data[3:]}
+		if r.usable() {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// verifyDANE returns the verification of the certificates of the host with
+// its TLSA records. DANE-EE records match the certificate of the server
+// regardless of its name and expiry, DANE-TA records a CA of its chain.
+func verifyDANE(host string, records []*tlsaRecord) func(tls.ConnectionState) error {
+	host = strings.TrimSuffix(host, ".")
+	return func(state tls.ConnectionState) error {
+		certs := state.PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("DANE: no certificate presented")
+		}
+		for _, r := range records {
+			if r.Usage == tlsaDANEEE {
+				if r.matches(certs[0]) {
+					return nil
+				}
+				continue
+			}
+
+			for i, ta := range certs[1:] {
+				if !r.matches(ta) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(ta)
+				intermediates := x509.NewCertPool()
+				for _, cert := range certs[1 : i+1] {
+					intermediates.AddCert(cert)
+				}
+				if _, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       host,
+					Roots:         roots,
+					Intermediates: intermediates,
+				}); err == nil {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("DANE: the certificate of %s matches none of its TLSA records", host)
+	}
+}
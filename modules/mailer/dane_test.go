@@ -0,0 +1,108 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDNSResponse(t *testing.T) {
+	query, id, err := newDNSQuery("example.com", dnsTypeMX)
+	assert.NoError(t, err)
+
+	resp := append([]byte{}, query[:len(query)-11]...)
+	resp[2], resp[3] = 0x81, 0xa0 // QR, RD, RA and AD.
+	resp[7], resp[11] = 2, 0
+	// Two answers, the names point to example.com in the question.
+	resp = append(resp, 0xc0, 12, 0, dnsTypeMX, 0, 1, 0, 0, 1, 0, 0, 8, 0, 20, 3, 'm', 'x', '2', 0xc0, 12)
+	resp = append(resp, 0xc0, 12, 0, dnsTypeMX, 0, 1, 0, 0, 1, 0, 0, 8, 0, 10, 3, 'm', 'x', '1', 0xc0, 12)
+
+	result, err := parseDNSResponse(resp, id, dnsTypeMX)
+	assert.NoError(t, err)
+	assert.True(t, result.Secure)
+	if assert.Len(t, result.Records, 2) {
+		assert.Equal(t, &net.MX{Host: "mx2.example.com.", Pref: 20}, result.Records[0].MX)
+		assert.Equal(t, &net.MX{Host: "mx1.example.com.", Pref: 10}, result.Records[1].MX)
+	}
+
+	_, err = parseDNSResponse(resp, id+1, dnsTypeMX)
+	assert.Error(t, err)
+	_, err = parseDNSResponse(resp[:len(resp)-3], id, dnsTypeMX)
+	assert.Error(t, err)
+
+	resp[3] = 0x82 // SERVFAIL of a bogus answer.
+	_, err = parseDNSResponse(resp, id, dnsTypeMX)
+	assert.Error(t, err)
+}
+
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestVerifyDANE(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "Mail CA", nil, nil)
+	leaf, _ := newTestCertificate(t, "mx.example.com", ca, caKey)
+	other, _ := newTestCertificate(t, "mx.example.com", nil, nil)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	ee := &tlsaRecord{Usage: tlsaDANEEE, Selector: 1, MatchingType: 1, Data: spki[:]}
+	ta := &tlsaRecord{Usage: tlsaDANETA, Selector: 0, MatchingType: 0, Data: ca.Raw}
+	assert.True(t, ee.usable())
+	assert.False(t, (&tlsaRecord{Usage: 1, Selector: 1, MatchingType: 1}).usable())
+
+	assert.NoError(t, verifyDANE("mx.example.com.", []*tlsaRecord{ee})(state))
+	// DANE-EE does not check the name.
+	assert.NoError(t, verifyDANE("mail.example.org", []*tlsaRecord{ee})(state))
+	assert.NoError(t, verifyDANE("mx.example.com", []*tlsaRecord{ta})(state))
+	assert.Error(t, verifyDANE("mail.example.org", []*tlsaRecord{ta})(state))
+
+	state.PeerCertificates = []*x509.Certificate{other}
+	assert.Error(t, verifyDANE("mx.example.com", []*tlsaRecord{ee, ta})(state))
+}
+
+func TestDNSResolver(t *testing.T) {
+	setting.MailService = &setting.Mailer{DANEResolver: "127.0.0.1:53"}
+	addr, err := dnsResolver()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:53", addr)
+
+	// Remote resolvers could forge the answers on the way.
+	setting.MailService.DANEResolver = "192.0.2.1:53"
+	_, err = dnsResolver()
+	assert.Error(t, err)
+}
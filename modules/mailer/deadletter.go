@@ -0,0 +1,129 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxMemoryDeadLetters is the number of dead letters kept by in-memory queues.
+const maxMemoryDeadLetters = 1000
+
+// DeadLetter describes a message which could not be delivered
+// after all retries were exhausted.
+type DeadLetter struct {
+	ID       int64     `json:"id"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Info     string    `json:"info"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed_at"`
+}
+
+func newDeadLetter(id int64, msg *Message) *DeadLetter {
+	dl := &DeadLetter{
+		ID:       id,
+		To:       msg.GetHeader("To"),
+		Info:     msg.Info,
+		Attempts: msg.attempts,
+		Error:    msg.lastError,
+		Failed:   msg.failed,
+	}
+	if subject := msg.GetHeader("Subject"); len(subject) > 0 {
+		dl.Subject = subject[0]
+	}
+	return dl
+}
+
+// ErrDeadLetterNotExist represents a "DeadLetterNotExist" kind of error.
+type ErrDeadLetterNotExist struct {
+	ID int64
+}
+
+// IsErrDeadLetterNotExist checks if an error is a ErrDeadLetterNotExist.
+func IsErrDeadLetterNotExist(err error) bool {
+	_, ok := err.(ErrDeadLetterNotExist)
+	return ok
+}
+
+func (err ErrDeadLetterNotExist) Error() string {
+	return fmt.Sprintf("dead letter does not exist [id: %d]", err.ID)
+}
+
+// DeadLetterStore defines the storage of permanently failed messages.
+type DeadLetterStore interface {
+	// Add stores the failed message.
+	Add(msg *Message) error
+
+	// List returns all stored dead letters, oldest first.
+	List() ([]*DeadLetter, error)
+
+	// Remove deletes the dead letter and returns its message.
+	Remove(id int64) (*Message, error)
+
+	// Purge deletes all dead letters.
+	Purge() error
+}
+
+// memoryDeadLetters keeps the most recent dead letters in memory.
+type memoryDeadLetters struct {
+	lock     sync.Mutex
+	lastID   int64
+	messages map[int64]*Message
+}
+
+func newMemoryDeadLetters() *memoryDeadLetters {
+	return &memoryDeadLetters{
+		messages: make(map[int64]*Message),
+	}
+}
+
+func (s *memoryDeadLetters) Add(msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastID++
+	s.messages[s.lastID] = msg
+	delete(s.messages, s.lastID-maxMemoryDeadLetters)
+	return nil
+}
+
+func (s *memoryDeadLetters) List() ([]*DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]*DeadLetter, 0, len(s.messages))
+	for id, msg := range s.messages {
+		list = append(list, newDeadLetter(id, msg))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (s *memoryDeadLetters) Remove(id int64) (*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, ErrDeadLetterNotExist{id}
+	}
+	delete(s.messages, id)
+	return msg, nil
+}
+
+func (s *memoryDeadLetters) Purge() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.messages = make(map[int64]*Message)
+	return nil
+}
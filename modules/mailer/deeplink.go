@@ -0,0 +1,94 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/Unknwon/com"
+)
+
+var (
+	// ErrDeepLinkInvalid is returned if the token of a deep link is malformed or its signature does not match.
+	ErrDeepLinkInvalid = errors.New("invalid deep link token")
+	// ErrDeepLinkExpired is returned if a deep link is older than DEEP_LINK_EXPIRY.
+	ErrDeepLinkExpired = errors.New("deep link token is expired")
+)
+
+// DeepLink is a link in a mail which lets the receiver perform an action,
+// e.g. marking the notification of an issue as read, without signing in.
+type DeepLink struct {
+	Action   string
+	UserID   int64
+	TargetID int64 // ID of the object the action is performed on.
+	Expires  time.Time
+}
+
+// NewDeepLink returns the link of the action of the user on the target,
+// which expires after DEEP_LINK_EXPIRY.
+func NewDeepLink(action string, userID, targetID int64) *DeepLink {
+	return &DeepLink{
+		Action:   action,
+		UserID:   userID,
+		TargetID: targetID,
+		Expires:  time.Now().Add(setting.MailService.DeepLinkExpiry),
+	}
+}
+
+// signature signs the link with the SECRET_KEY and the key of the user, so
+// changing the key invalidates all links of the user.
+func (l *DeepLink) signature(key string) string {
+	mac := hmac.New(sha256.New, []byte(setting.SecretKey))
+	fmt.Fprintf(mac, "deeplink:%s:%d:%d:%d:%s", l.Action, l.UserID, l.TargetID, l.Expires.Unix(), key)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Token returns the signed token of the link.
+func (l *DeepLink) Token(key string) string {
+	return fmt.Sprintf("%s.%d.%d.%d.%s", l.Action, l.UserID, l.TargetID, l.Expires.Unix(), l.signature(key))
+}
+
+// URL returns the address of the page performing the action of the link.
+func (l *DeepLink) URL(key string) string {
+	return setting.AppURL + "user/mail_action/" + l.Token(key)
+}
+
+// VerifyDeepLink returns the link of the token. The key of the user of the
+// link is returned by fn, which returns ErrDeepLinkInvalid for unknown users.
+func VerifyDeepLink(token string, fn func(l *DeepLink) (string, error)) (*DeepLink, error) {
+	fields := strings.Split(token, ".")
+	if len(fields) != 5 || len(fields[0]) == 0 {
+		return nil, ErrDeepLinkInvalid
+	}
+	l := &DeepLink{
+		Action:   fields[0],
+		UserID:   com.StrTo(fields[1]).MustInt64(),
+		TargetID: com.StrTo(fields[2]).MustInt64(),
+		Expires:  time.Unix(com.StrTo(fields[3]).MustInt64(), 0),
+	}
+	if l.UserID <= 0 {
+		return nil, ErrDeepLinkInvalid
+	}
+
+	key, err := fn(l)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(strings.ToLower(fields[4])), []byte(l.signature(key))) {
+		return nil, ErrDeepLinkInvalid
+	}
+	if time.Now().After(l.Expires) {
+		return nil, ErrDeepLinkExpired
+	}
+	return l, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeepLink(t *testing.T) {
+	setting.SecretKey = "secret"
+	setting.MailService = &setting.Mailer{DeepLinkExpiry: time.Hour}
+	key := func(l *DeepLink) (string, error) {
+		if l.UserID != 2 {
+			return "", ErrDeepLinkInvalid
+		}
+		return "rands", nil
+	}
+
+	l := NewDeepLink("read", 2, 5)
+	link, err := VerifyDeepLink(l.Token("rands"), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "read", link.Action)
+	assert.EqualValues(t, 2, link.UserID)
+	assert.EqualValues(t, 5, link.TargetID)
+	assert.Equal(t, l.Expires.Unix(), link.Expires.Unix())
+
+	for _, token := range []string{
+		"",
+		"read.2.5",
+		NewDeepLink("read", 2, 5).Token("other"),
+		NewDeepLink("read", 3, 5).Token("rands"),
+		"read.2.6." + l.Token("rands")[len("read.2.5."):],
+	} {
+		_, err = VerifyDeepLink(token, key)
+		assert.Equal(t, ErrDeepLinkInvalid, err, token)
+	}
+
+	l.Expires = time.Now().Add(-time.Second)
+	_, err = VerifyDeepLink(l.Token("rands"), key)
+	assert.Equal(t, ErrDeepLinkExpired, err)
+}
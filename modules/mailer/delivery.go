@@ -0,0 +1,122 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"net/textproto"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// DeliveryStatus is the outcome of a delivery attempt.
+type DeliveryStatus string
+
+// The outcomes of delivery attempts.
+const (
+	// DeliverySent means the message was accepted by the mail server or service.
+	DeliverySent DeliveryStatus = "sent"
+	// DeliveryDeferred means the attempt failed and the message is retried later.
+	DeliveryDeferred DeliveryStatus = "deferred"
+	// DeliveryFailed means the attempt failed and the message is not retried.
+	DeliveryFailed DeliveryStatus = "failed"
+
+	// The outcomes reported by the mail service after it accepted the message.
+
+	// DeliveryDelivered means the message was delivered to the mailbox of the recipient.
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryBounced means the mail server of the recipient rejected the message.
+	DeliveryBounced DeliveryStatus = "bounced"
+	// DeliveryComplained means the recipient reported the message as spam.
+	DeliveryComplained DeliveryStatus = "complained"
+)
+
+// Delivery describes a delivery attempt of a message.
+type Delivery struct {
+	MessageID  string
+	Recipients []string
+	Subject    string
+	Category   Category
+	Backend    string
+	Code       int // SMTP reply or HTTP status code of the error, 0 if unknown.
+	Error      string
+	Duration   time.Duration
+	Attempt    int
+	Status     DeliveryStatus
+}
+
+// DeliveryRecorder stores a delivery attempt.
+type DeliveryRecorder func(*Delivery) error
+
+var (
+	deliveryRecorderLock sync.RWMutex
+	deliveryRecorder     DeliveryRecorder
+)
+
+// SetDeliveryRecorder sets the function called after every delivery attempt.
+// This method is thread-safe.
+func SetDeliveryRecorder(r DeliveryRecorder) {
+	deliveryRecorderLock.Lock()
+	deliveryRecorder = r
+	deliveryRecorderLock.Unlock()
+}
+
+// recordDelivery passes the delivery attempt to the recorder, if any.
+func recordDelivery(msg *Message, attempt int, duration time.Duration, sendErr error, status DeliveryStatus) {
+	deliveryRecorderLock.RLock()
+	record := deliveryRecorder
+	deliveryRecorderLock.RUnlock()
+	if record == nil {
+		return
+	}
+
+	d := &Delivery{
+		Category: msg.Category,
+		Backend:  backendName(),
+		Duration: duration,
+		Attempt:  attempt,
+		Status:   status,
+	}
+	if ids := msg.GetHeader("Message-ID"); len(ids) > 0 {
+		d.MessageID = ids[0]
+	}
+	if subject := msg.GetHeader("Subject"); len(subject) > 0 {
+		d.Subject = subject[0]
+	}
+	if _, to, err := msg.envelope(); err == nil {
+		d.Recipients = to
+	} else {
+		d.Recipients = msg.GetHeader("To")
+	}
+	if sendErr != nil {
+		d.Code = errorCode(sendErr)
+		d.Error = sendErr.Error()
+	}
+
+	if err := record(d); err != nil {
+		log.Error(3, "Failed to record delivery of emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+	}
+}
+
+// errorCode returns the SMTP reply or HTTP status code of a send error.
+func errorCode(err error) int {
+	switch wrapped := err.(type) {
+	case ErrPermanentFailure:
+		err = wrapped.Err
+	case ErrGreylisted:
+		err = wrapped.Err
+	}
+	if wrapped, ok := err.(ErrRecipientsDeferred); ok {
+		err = wrapped.Err
+	}
+	switch err := err.(type) {
+	case *textproto.Error:
+		return err.Code
+	case ErrAPIRequest:
+		return err.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryRecorder(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "dummy",
+		Workers:  1,
+	}
+
+	deliveries := make(chan *Delivery, 1)
+	SetDeliveryRecorder(func(d *Delivery) error {
+		deliveries <- d
+		return nil
+	})
+	defer SetDeliveryRecorder(nil)
+
+	d, err := NewDaemon()
+	assert.NoError(t, err)
+	defer d.Close()
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	d.SendAsync(msg)
+
+	select {
+	case delivery := <-deliveries:
+		assert.Equal(t, msg.GetHeader("Message-ID")[0], delivery.MessageID)
+		assert.Equal(t, []string{"user@example.com"}, delivery.Recipients)
+		assert.Equal(t, "Subject", delivery.Subject)
+		assert.Equal(t, "dummy", delivery.Backend)
+		assert.Equal(t, 1, delivery.Attempt)
+		assert.Equal(t, DeliverySent, delivery.Status)
+		assert.Empty(t, delivery.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not recorded")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	smtpErr := &textproto.Error{Code: 550, Msg: "mailbox unavailable"}
+	assert.Equal(t, 550, errorCode(smtpErr))
+	assert.Equal(t, 550, errorCode(ErrPermanentFailure{smtpErr}))
+	assert.Equal(t, 429, errorCode(ErrAPIRequest{Provider: "SendGrid", StatusCode: 429}))
+	assert.Equal(t, 0, errorCode(errors.New("connection refused")))
+}
@@ -0,0 +1,345 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"gopkg.in/gomail.v2"
+)
+
+// directPort is the port of the mail servers of the recipient domains.
+var directPort = 25
+
+// Sender implementation delivering the mails directly to the mail servers of
+// the recipient domains, honoring their MTA-STS policies and TLSA records.
+// All direct senders share one pool of connections per domain.
+type directSender struct{}
+
+var (
+	directPoolLock sync.Mutex
+	directPools    = make(map[string]*smtpPool)
+)
+
+func newDirectSender() (Sender, error) {
+	return &directSender{}, nil
+}
+
+// directPool returns the pool of connections to the mail servers of the
+// domain.
+func directPool(domain string) *smtpPool {
+	directPoolLock.Lock()
+	defer directPoolLock.Unlock()
+
+	p, ok := directPools[domain]
+	if !ok {
+		p = newSMTPPool(func() (gomail.SendCloser, error) {
+			return connectDomain(domain, ioutil.Discard)
+		}, 0, setting.MailService)
+		directPools[domain] = p
+	}
+	return p
+}
+
+// removeUnusedDirectPools removes the pools without idle connections, so the
+// pools of all domains ever mailed do not pile up.
+func removeUnusedDirectPools() {
+	directPoolLock.Lock()
+	defer directPoolLock.Unlock()
+	for domain, p := range directPools {
+		if p.CloseIfUnused() {
+			delete(directPools, domain)
+		}
+	}
+}
+
+// resetDirectPools closes the idle connections of all domains, new
+// connections use the current settings.
+func resetDirectPools() (err error) {
+	directPoolLock.Lock()
+	pools := directPools
+	directPools = make(map[string]*smtpPool)
+	directPoolLock.Unlock()
+
+	for _, p := range pools {
+		if cerr := p.CloseIdle(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// directDelivery sends the envelope to the mail servers of every recipient
+// domain. The dialogue of test mails is written to the transcript.
+type directDelivery struct {
+	msg        *Message
+	transcript io.Writer
+}
+
+// Send the message synchronous with a cached connection per recipient
+// domain. Recipients which accepted the message in a previous attempt are
+// skipped. This method is thread-safe.
+func (s *directSender) Send(msg *Message) error {
+	return msg.send(&directDelivery{msg, msg.transcript})
+}
+
+// Close the idle connections of all domains.
+// This method is thread-safe.
+func (s *directSender) Close() error {
+	directPoolLock.Lock()
+	pools := make([]*smtpPool, 0, len(directPools))
+	for _, p := range directPools {
+		pools = append(pools, p)
+	}
+	directPoolLock.Unlock()
+
+	var err error
+	for _, p := range pools {
+		if cerr := p.CloseIdle(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Send delivers the message to the recipients, grouped by their domain. If
+// every failed domain greylisted the message, ErrGreylisted is returned.
+func (d *directDelivery) Send(from string, to []string, msg io.WriterTo) error {
+	var domains []string
+	rcpts := make(map[string][]string)
+	for _, addr := range to {
+		if d.msg.isDelivered(addr) {
+			continue
+		}
+		domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+		if _, ok := rcpts[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcpts[domain] = append(rcpts[domain], addr)
+	}
+
+	var errs []string
+	greylisted := true
+	for _, domain := range domains {
+		err := d.deliver(domain, from, rcpts[domain], msg)
+		if err == nil {
+			d.msg.delivered = append(d.msg.delivered, rcpts[domain]...)
+			continue
+		}
+		if deferred, ok := err.(ErrRecipientsDeferred); ok {
+			d.msg.delivered = append(d.msg.delivered, deferred.accepted(rcpts[domain])...)
+		}
+		if isGreylisting(err) {
+			err = ErrGreylisted{err}
+		}
+		if len(domains) == 1 {
+			return err
+		}
+		errs = append(errs, err.Error())
+		greylisted = greylisted && IsErrGreylisted(err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("failed to deliver to some domains: %s", strings.Join(errs, "; "))
+	if greylisted {
+		return ErrGreylisted{err}
+	}
+	return err
+}
+
+// deliver sends the message to the domain with a connection of its pool, or
+// a new connection recording the transcript of a test mail.
+func (d *directDelivery) deliver(domain, from string, rcpts []string, msg io.WriterTo) error {
+	if d.transcript != nil {
+		c, err := connectDomain(domain, d.transcript)
+		if err != nil {
+			return err
+		}
+		err = sendEnvelope(c, from, rcpts, msg)
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	pool := directPool(domain)
+	for {
+		c, err := pool.Get()
+		if err != nil {
+			return err
+		}
+
+		err = sendEnvelope(c, from, rcpts, msg)
+		if err == nil || IsErrRecipientsDeferred(err) {
+			pool.Put(c)
+			return err
+		}
+		pool.Discard(c)
+
+		// Idle connections may have been closed by the server in the meantime.
+		if _, isReply := err.(*textproto.Error); !c.reused || isReply {
+			return err
+		}
+	}
+}
+
+// sendEnvelope sends the message with the ASCII form of the envelope if the
+// server does not support SMTPUTF8.
+func sendEnvelope(c gomail.Sender, from string, to []string, msg io.WriterTo) error {
+	if r, ok := c.(extensionReporter); ok {
+		if has, _ := r.Extension("SMTPUTF8"); !has {
+			var err error
+			if from, to, err = asciiEnvelope(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Send(from, to, msg)
+}
+
+// lookupMX returns the mail servers of the domain and whether the answer is
+// secure. Only DANE needs a validated answer.
+var lookupMX = func(domain string) ([]*net.MX, bool, error) {
+	if !setting.MailService.DANE {
+		mxs, err := net.LookupMX(domain)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, false, nil
+		}
+		return mxs, false, err
+	}
+
+	result, err := dnsQuery(domain, dnsTypeMX)
+	if err != nil {
+		return nil, false, err
+	}
+	mxs := make([]*net.MX, 0, len(result.Records))
+	for _, rr := range result.Records {
+		mxs = append(mxs, rr.MX)
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, result.Secure, nil
+}
+
+// connectDomain connects to the first mail server of the domain which
+// accepts the connection with the security required by the domain.
+func connectDomain(domain string, w io.Writer) (*smtpTranscript, error) {
+	domain = idnaDomain(domain)
+	mxs, secure, err := lookupMX(domain)
+	if err != nil {
+		return nil, fmt.Errorf("MX lookup of %s failed: %v", domain, err)
+	}
+	if len(mxs) == 0 {
+		// The domain itself is the implicit mail server (RFC 5321).
+		mxs = []*net.MX{{Host: domain}}
+	} else if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, ErrPermanentFailure{fmt.Errorf("domain %s does not accept mail", domain)}
+	}
+
+	var policy *mtaSTSPolicy
+	if setting.MailService.MTASTS {
+		if policy = getMTASTSPolicy(domain); policy != nil && policy.Mode == "none" {
+			policy = nil
+		}
+	}
+
+	var errs []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if policy != nil && !policy.matches(host) {
+			if policy.Mode == "enforce" {
+				fmt.Fprintf(w, "* %s is not allowed by the MTA-STS policy of %s\n", host, domain)
+				errs = append(errs, fmt.Sprintf("%s: not allowed by the MTA-STS policy", host))
+				continue
+			}
+			log.Warn("MTA-STS: %s is not allowed by the testing policy of %s", host, domain)
+		}
+
+		c, err := dialMX(host, secure, policy, w)
+		if err != nil {
+			fmt.Fprintf(w, "* Failed to connect to %s: %v\n", host, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", host, err))
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to connect to the mail servers of %s: %s", domain, strings.Join(errs, "; "))
+}
+
+// dialMX connects to the mail server. Its TLSA records take precedence over
+// the MTA-STS policy of the domain, without either TLS is used if offered but
+// the certificate is not verified.
+func dialMX(host string, secure bool, policy *mtaSTSPolicy, w io.Writer) (*smtpTranscript, error) {
+	config, err := newSMTPTLSConfig(setting.MailService, host)
+	if err != nil {
+		return nil, err
+	}
+	security := "starttls"
+
+	var records []*tlsaRecord
+	if setting.MailService.DANE && secure {
+		if records, err = lookupTLSA(host); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(records) > 0:
+		security = "starttls-required"
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyDANE(host, records)
+	case policy != nil && policy.Mode == "enforce":
+		security = "starttls-required"
+		config.InsecureSkipVerify = false
+	case policy != nil:
+		// Report failures of the testing policy, but deliver anyway.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if err := verifyPKIX(host, config.RootCAs, state); err != nil {
+				log.Warn("MTA-STS: the testing policy of %s fails: %v", host, err)
+			}
+			return nil
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+
+	dialer := &gomail.Dialer{Host: host, Port: directPort, TLSConfig: config}
+	if !setting.MailService.DisableHelo {
+		if dialer.LocalName, err = heloHostname(setting.MailService); err != nil {
+			return nil, err
+		}
+	}
+	return dialSMTPSecurity(dialer, security, w)
+}
+
+// verifyPKIX verifies the certificates of the host like crypto/tls.
+func verifyPKIX(host string, roots *x509.CertPool, state tls.ConnectionState) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectSender(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", MTASTS: true, DANE: true}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	mx, tlsa, lookup, policies := lookupMX, lookupTLSA, lookupMTASTSID, mtaSTSPolicies
+	defer func() {
+		lookupMX, lookupTLSA, lookupMTASTSID, mtaSTSPolicies = mx, tlsa, lookup, policies
+		directPort = 25
+	}()
+	directPort, _ = strconv.Atoi(port)
+	lookupMX = func(domain string) ([]*net.MX, bool, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, domain == "dane.example.org", nil
+	}
+	lookupTLSA = func(string) ([]*tlsaRecord, error) {
+		return []*tlsaRecord{{Usage: tlsaDANEEE, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}}, nil
+	}
+	lookupMTASTSID = func(string) (string, error) { return "", nil }
+	mtaSTSPolicies = map[string]*mtaSTSPolicy{
+		"sts.example.org": {Mode: "enforce", MX: []string{"mx.sts.example.org"}, Expires: time.Now().Add(time.Hour)},
+	}
+
+	send := func(to string, connects bool) (string, error) {
+		var transcript bytes.Buffer
+		msg := NewMessage([]string{to}, "Subject", "Body")
+		msg.transcript = &transcript
+		done := make(chan struct{})
+		go func() {
+			if connects {
+				serveTestSMTP(t, l)
+			}
+			close(done)
+		}()
+		err := new(directSender).Send(msg)
+		resetDirectPools()
+		<-done
+		return transcript.String(), err
+	}
+
+	transcript, err := send("user@example.org", true)
+	assert.NoError(t, err)
+	assert.Contains(t, transcript, "C: RCPT TO:<user@example.org>\n")
+
+	// The server offers no STARTTLS, which the TLSA records require.
+	transcript, err = send("user@dane.example.org", true)
+	assert.Error(t, err)
+	assert.Contains(t, transcript, "* STARTTLS is not offered by the server\n")
+	assert.NotContains(t, transcript, "C: MAIL")
+
+	transcript, err = send("user@sts.example.org", false)
+	assert.Error(t, err)
+	assert.Contains(t, transcript, "* 127.0.0.1 is not allowed by the MTA-STS policy of sts.example.org\n")
+}
+
+func TestDirectSender_Pool(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	mx := lookupMX
+	defer func() {
+		lookupMX = mx
+		directPort = 25
+	}()
+	directPort, _ = strconv.Atoi(port)
+	lookupMX = func(string) ([]*net.MX, bool, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, false, nil
+	}
+
+	// Both domains get their own connection, which is reused.
+	go serveTestSMTP(t, l)
+	go serveTestSMTP(t, l)
+	defer resetDirectPools()
+	s := new(directSender)
+	assert.NoError(t, s.Send(NewMessage([]string{"a@example.org"}, "Subject", "Body")))
+	assert.NoError(t, s.Send(NewMessage([]string{"b@example.org"}, "Subject", "Body")))
+	assert.Len(t, directPool("example.org").idle, 1)
+
+	// Recipients which accepted the greylisted message are skipped when it
+	// is retried.
+	msg := NewMessage([]string{"c@example.org", "greylisted@example.net"}, "Subject", "Body")
+	err = s.Send(msg)
+	assert.True(t, IsErrGreylisted(err))
+	assert.Equal(t, []string{"c@example.org"}, msg.delivered)
+
+	msg.delivered = append(msg.delivered, "greylisted@example.net")
+	assert.NoError(t, s.Send(msg))
+	assert.NoError(t, s.Close())
+	assert.Empty(t, directPool("example.org").idle)
+
+	// Pools without idle connections are removed.
+	_, ok := expireIdle(s)
+	assert.True(t, ok)
+	directPoolLock.Lock()
+	assert.Empty(t, directPools)
+	directPoolLock.Unlock()
+}
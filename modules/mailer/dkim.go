@@ -0,0 +1,171 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// dkimHeaders are the headers signed if present in the message.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "Mime-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
+var dkimWhitespace = regexp.MustCompile(`[ \t]+`)
+
+// dkimSigner signs messages with DKIM (RFC 6376), using the rsa-sha256
+// algorithm and relaxed canonicalization for header and body.
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      *rsa.PrivateKey
+}
+
+// newDKIMSigner loads the configured DKIM private key.
+// It returns nil if DKIM signing is not enabled.
+func newDKIMSigner(opts *setting.Mailer) (*dkimSigner, error) {
+	if len(opts.DKIMDomain) == 0 {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(opts.DKIMPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: read private key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data found in private key file")
+	}
+
+	var key *rsa.PrivateKey
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = k.(*rsa.PrivateKey); !ok {
+				err = errors.New("not an RSA key")
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim: parse private key: %v", err)
+	}
+
+	return &dkimSigner{
+		domain:   opts.DKIMDomain,
+		selector: opts.DKIMSelector,
+		key:      key,
+	}, nil
+}
+
+// sign returns the rendered message with a DKIM-Signature header prepended.
+func (s *dkimSigner) sign(raw []byte, now time.Time) ([]byte, error) {
+	header, body := splitRawMessage(raw)
+	fields := splitHeaderFields(header)
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	var signed []string
+	var canonical bytes.Buffer
+	for _, name := range dkimHeaders {
+		// Sign the bottom-most instance of the header, as verifiers do.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				canonical.WriteString(relaxedHeader(fields[i]) + "\r\n")
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.domain, s.selector, now.Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	canonical.WriteString(relaxedHeader(sig))
+
+	hashed := sha256.Sum256(canonical.Bytes())
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return nil, fmt.Errorf("dkim: sign: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(sig + base64.StdEncoding.EncodeToString(signature) + "\r\n")
+	buf.Write(header)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// relaxedHeader canonicalizes a header field (RFC 6376 section 3.4.2).
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(field)) + ":"
+	}
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(dkimWhitespace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(field[:i])) + ":" + value
+}
+
+// relaxedBody canonicalizes the message body (RFC 6376 section 3.4.4).
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespace.ReplaceAllString(line, " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// dkimSender signs every message with DKIM before it is passed
+// to the actual sender.
+type dkimSender struct {
+	Sender
+	signer *dkimSigner
+}
+
+func (s *dkimSender) Send(msg *Message) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	// Retried messages are signed already.
+	if !hasHeaderField(buf.Bytes(), "DKIM-Signature") {
+		raw, err := s.signer.sign(buf.Bytes(), time.Now())
+		if err != nil {
+			return err
+		}
+		msg.raw = raw
+	}
+
+	return s.Sender.Send(msg)
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// Examples from RFC 6376 section 3.4.5.
+	assert.Equal(t, "a:X", relaxedHeader("A: X"))
+	assert.Equal(t, "b:Y Z", relaxedHeader("B : Y\t\r\n\tZ  "))
+	assert.Equal(t, " C\r\nD E\r\n", string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))))
+	assert.Empty(t, relaxedBody([]byte("\r\n")))
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	s := &dkimSigner{domain: "example.com", selector: "gitea", key: key}
+
+	raw := "From: gitea@example.com\r\nTo: user2@example.com\r\nSubject: Test\r\n\r\nHello  world \r\n\r\n"
+	signed, err := s.sign([]byte(raw), time.Unix(1500000000, 0))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(signed), raw))
+	assert.True(t, hasHeaderField(signed, "DKIM-Signature"))
+
+	fields := splitHeaderFields(signed[:len(signed)-len(raw)])
+	if !assert.Len(t, fields, 1) {
+		return
+	}
+	sig := fields[0]
+	assert.Contains(t, sig, "d=example.com; s=gitea;")
+	assert.Contains(t, sig, "t=1500000000; h=from:subject:to;")
+
+	bodyHash := sha256.Sum256([]byte("Hello world\r\n"))
+	assert.Contains(t, sig, "bh="+base64.StdEncoding.EncodeToString(bodyHash[:])+";")
+
+	// Verify the signature as a receiving server would.
+	b := regexp.MustCompile(`b=([A-Za-z0-9+/=]+)$`).FindStringSubmatch(sig)
+	if !assert.Len(t, b, 2) {
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(b[1])
+	assert.NoError(t, err)
+	canonical := "from:gitea@example.com\r\nsubject:Test\r\nto:user2@example.com\r\n" +
+		relaxedHeader(strings.TrimSuffix(sig, b[1]))
+	hashed := sha256.Sum256([]byte(canonical))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], signature))
+}
@@ -0,0 +1,263 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Types of DNS records.
+const (
+	dnsTypeMX   = 15
+	dnsTypeOPT  = 41
+	dnsTypeTLSA = 52
+)
+
+// dnsRecord is a resource record of the answer to a DNS query.
+type dnsRecord struct {
+	Type uint16
+	MX   *net.MX // MX records are decoded, as they contain compressed names.
+	Data []byte
+}
+
+// dnsResult is the answer of a DNS query. It is secure if the resolver
+// validated it with DNSSEC.
+type dnsResult struct {
+	Records []dnsRecord
+	Secure  bool
+}
+
+// dnsResolver returns the address of the resolver, which is DANE_RESOLVER
+// or the first nameserver of /etc/resolv.conf. It must run on the local host,
+// the answers and whether they are secure are not protected on the way from
+// a remote resolver.
+func dnsResolver() (string, error) {
+	addr := setting.MailService.DANEResolver
+	if len(addr) == 0 {
+		var err error
+		if addr, err = systemResolver(); err != nil {
+			return "", err
+		}
+	}
+	if host, _, _ := net.SplitHostPort(addr); !isLoopbackHost(host) {
+		return "", fmt.Errorf("resolver %s is not on the local host, DANE requires a local validating resolver", addr)
+	}
+	return addr, nil
+}
+
+// isLoopbackHost checks whether the host is a loopback address.
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// systemResolver returns the address of the first nameserver of /etc/resolv.conf.
+func systemResolver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// dnsQuery asks the resolver for the records of the name, with the DO bit so
+// the resolver validates the answer. Go's resolver supports neither TLSA
+// records nor reports whether the answer is secure.
+func dnsQuery(name string, qtype uint16) (*dnsResult, error) {
+	addr, err := dnsResolver()
+	if err != nil {
+		return nil, err
+	}
+	query, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsExchange("udp", addr, query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// The answer is truncated, repeat the query with TCP.
+		resp, err = dnsExchange("tcp", addr, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSResponse(resp, id, qtype)
+}
+
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, 0, err
+	}
+
+	// Header with RD and AD set, one question and the OPT record.
+	msg := []byte{id[0], id[1], 0x01, 0x20, 0, 1, 0, 0, 0, 0, 0, 1}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	// OPT record with a payload size of 4096 bytes and the DO bit.
+	msg = append(msg, 0, 0, dnsTypeOPT, 0x10, 0, 0, 0, 0x80, 0, 0, 0)
+	return msg, binary.BigEndian.Uint16(id[:]), nil
+}
+
+func dnsExchange(network, addr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 4096)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err = conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+var errDNSFormat = errors.New("invalid DNS response")
+
+func parseDNSResponse(msg []byte, id, qtype uint16) (*dnsResult, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, errDNSFormat
+	}
+	result := &dnsResult{Secure: msg[3]&0x20 != 0}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		// The name does not exist.
+		return result, nil
+	default:
+		// Failed validations are reported as SERVFAIL.
+		return nil, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+
+	off := 12
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	for i := binary.BigEndian.Uint16(msg[6:]); i > 0; i-- {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errDNSFormat
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10
+		if off+length > len(msg) {
+			return nil, errDNSFormat
+		}
+		data := msg[off : off+length]
+
+		switch {
+		case rtype == dnsTypeMX && qtype == dnsTypeMX:
+			if length < 3 {
+				return nil, errDNSFormat
+			}
+			host, _, err := readDNSName(msg, off+2)
+			if err != nil {
+				return nil, err
+			}
+			result.Records = append(result.Records, dnsRecord{
+				Type: rtype,
+				MX:   &net.MX{Host: host, Pref: binary.BigEndian.Uint16(data)},
+			})
+		case rtype == qtype:
+			result.Records = append(result.Records, dnsRecord{Type: rtype, Data: data})
+		}
+		off += length
+	}
+	return result, nil
+}
+
+// readDNSName reads the possibly compressed name at the offset, returning it
+// with a trailing dot and the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSFormat
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case length > 63 || off+1+length > len(msg):
+			return "", 0, errDNSFormat
+		default:
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Diagnosis is the outcome of a check of the mail configuration.
+type Diagnosis struct {
+	Check   string
+	Problem string // Empty if the check passed.
+	Fix     string // How to solve the problem.
+	Warning bool   // The problem does not stop the delivery, but mails may be taken for spam.
+}
+
+// lookupTXT returns the TXT records of the name, it is overridden by tests.
+var lookupTXT = net.LookupTXT
+
+// Diagnose checks the mail configuration: the connections to the SMTP
+// servers with STARTTLS and authentication, and the SPF, DKIM and DMARC
+// records in the DNS of the domain of FROM.
+func Diagnose() []*Diagnosis {
+	opts := setting.MailService
+	var result []*Diagnosis
+	if opts.MailType == "smtp" {
+		result = append(result, diagnoseSMTP(opts)...)
+	}
+
+	domain := strings.ToLower(opts.FromEmail[strings.LastIndexByte(opts.FromEmail, '@')+1:])
+	spfDomain := domain
+	if i := strings.LastIndexByte(opts.EnvelopeFrom, '@'); i >= 0 {
+		spfDomain = strings.ToLower(opts.EnvelopeFrom[i+1:])
+	}
+	return append(result, diagnoseSPF(spfDomain), diagnoseDKIM(opts), diagnoseDMARC(domain))
+}
+
+// diagnoseSMTP connects to every configured SMTP server.
+func diagnoseSMTP(opts *setting.Mailer) []*Diagnosis {
+	hosts, err := newSMTPHosts(opts)
+	if err != nil {
+		return []*Diagnosis{{
+			Check:   "SMTP servers",
+			Problem: err.Error(),
+			Fix:     "Set HOST to the mail server and port, like smtp.example.com:587.",
+		}}
+	}
+
+	var result []*Diagnosis
+	for _, h := range hosts.hosts {
+		d := &Diagnosis{Check: "SMTP connection to " + h.addr}
+		result = append(result, d)
+
+		var transcript bytes.Buffer
+		c, err := dialSMTPSecurity(h.dialer, h.security, &transcript)
+		if err != nil {
+			d.Problem = err.Error()
+			d.Fix = smtpFix(err, transcript.String())
+			continue
+		}
+		_, auth := c.ext["AUTH"]
+		switch {
+		case !c.tls && h.security != "none":
+			d.Problem, d.Warning = "the server does not offer STARTTLS, mails and passwords are sent unencrypted", true
+			d.Fix = "Enable STARTTLS on the mail server, or set SECURITY = none if that is intended."
+		case !auth && len(opts.User) > 0:
+			d.Problem, d.Warning = "the server does not offer authentication, USER is not used", true
+			d.Fix = "Remove USER and PASSWD, or check whether the server offers AUTH on another port."
+		}
+		c.Close()
+	}
+	return result
+}
+
+// smtpFix suggests how to solve the failure to connect to an SMTP server.
+func smtpFix(err error, transcript string) string {
+	if reply, ok := err.(*textproto.Error); ok && strings.Contains(transcript, "C: AUTH") {
+		if reply.Code == 535 || reply.Code == 534 || reply.Code == 530 {
+			return "Check USER and PASSWD, some providers require an application password."
+		}
+		return "Check USER and PASSWD, or set SMTP_AUTH to a mechanism the server supports."
+	}
+	if verifyErr, ok := err.(*tls.CertificateVerificationError); ok {
+		err = verifyErr.Err
+	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError:
+		return "Set CA_FILE to the CA which issued the certificate of the server, or SKIP_VERIFY = true."
+	case x509.HostnameError:
+		return "Set HOST to a name the certificate of the server is valid for."
+	case x509.CertificateInvalidError:
+		return "Renew the certificate of the mail server, or set SKIP_VERIFY = true."
+	case tls.RecordHeaderError:
+		return "The server does not speak TLS on this port: set SECURITY = starttls, or use port 465 for implicit TLS."
+	}
+	if strings.Contains(err.Error(), "STARTTLS") {
+		return "Enable STARTTLS on the mail server, or set SECURITY = none to send unencrypted."
+	}
+	if !strings.Contains(transcript, "S: 220") {
+		return "Check HOST and that the mail server is reachable on the port from this machine."
+	}
+	return "Check the settings of [mailer] against the documentation of the mail server."
+}
+
+// txtRecords returns the TXT records of the name starting with the prefix,
+// which is compared case insensitively.
+func txtRecords(name, prefix string) ([]string, error) {
+	records, err := lookupTXT(name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, r := range records {
+		if strings.HasPrefix(strings.ToLower(r), strings.ToLower(prefix)) {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+func diagnoseSPF(domain string) *Diagnosis {
+	d := &Diagnosis{Check: "SPF record of " + domain}
+	records, err := txtRecords(domain, "v=spf1")
+	switch {
+	case err != nil:
+		d.Problem, d.Warning = "DNS lookup failed: "+err.Error(), true
+		d.Fix = "Check the DNS resolver of this machine."
+	case len(records) == 0:
+		d.Problem, d.Warning = "no SPF record found", true
+		d.Fix = fmt.Sprintf("Publish a TXT record for %s allowing the mail server, like \"v=spf1 mx -all\".", domain)
+	case len(records) > 1:
+		d.Problem = "multiple SPF records found, receivers treat this as an error"
+		d.Fix = fmt.Sprintf("Merge the SPF records of %s into one.", domain)
+	}
+	return d
+}
+
+func diagnoseDKIM(opts *setting.Mailer) *Diagnosis {
+	if len(opts.DKIMDomain) == 0 {
+		return &Diagnosis{
+			Check:   "DKIM signature",
+			Problem: "mails are not signed with DKIM",
+			Fix:     "Set DKIM_DOMAIN and DKIM_PRIVATE_KEY_FILE and publish the public key, or sign the mails on the mail server.",
+			Warning: true,
+		}
+	}
+
+	name := opts.DKIMSelector + "._domainkey." + opts.DKIMDomain
+	d := &Diagnosis{Check: "DKIM record " + name}
+	signer, err := newDKIMSigner(opts)
+	if err != nil {
+		d.Problem = err.Error()
+		d.Fix = "Set DKIM_PRIVATE_KEY_FILE to a PEM encoded RSA private key."
+		return d
+	}
+	der, err := x509.MarshalPKIXPublicKey(&signer.key.PublicKey)
+	if err != nil {
+		d.Problem = err.Error()
+		return d
+	}
+	publicKey := base64.StdEncoding.EncodeToString(der)
+	fix := fmt.Sprintf("Publish a TXT record for %s with \"v=DKIM1; k=rsa; p=%s\".", name, publicKey)
+
+	records, err := txtRecords(name, "")
+	if err != nil {
+		d.Problem, d.Fix = "DNS lookup failed: "+err.Error(), "Check the DNS resolver of this machine."
+		return d
+	}
+	for _, r := range records {
+		for _, tag := range strings.Split(r, ";") {
+			tag = strings.Replace(strings.TrimSpace(tag), " ", "", -1)
+			if strings.HasPrefix(tag, "p=") && tag[2:] == publicKey {
+				return d
+			}
+		}
+	}
+	if len(records) == 0 {
+		d.Problem = "no DKIM record found, receivers can not verify the signatures"
+	} else {
+		d.Problem = "the DKIM record does not match the private key"
+	}
+	d.Fix = fix
+	return d
+}
+
+func diagnoseDMARC(domain string) *Diagnosis {
+	d := &Diagnosis{Check: "DMARC record of " + domain}
+	names := []string{"_dmarc." + domain}
+	// The policy of the organizational domain applies to its subdomains.
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil && org != domain {
+		names = append(names, "_dmarc."+org)
+	}
+	for _, name := range names {
+		records, err := txtRecords(name, "v=DMARC1")
+		if err != nil {
+			d.Problem, d.Warning = "DNS lookup failed: "+err.Error(), true
+			d.Fix = "Check the DNS resolver of this machine."
+			return d
+		} else if len(records) > 0 {
+			return d
+		}
+	}
+	d.Problem, d.Warning = "no DMARC record found", true
+	d.Fix = fmt.Sprintf("Publish a TXT record for _dmarc.%s, like \"v=DMARC1; p=none; rua=mailto:postmaster@%s\".", domain, domain)
+	return d
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"net"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	txt := lookupTXT
+	defer func() { lookupTXT = txt }()
+	lookupTXT = func(name string) ([]string, error) {
+		switch name {
+		case "example.com":
+			return []string{"google-site-verification=abc", "v=spf1 mx -all"}, nil
+		case "twice.example.org":
+			return []string{"v=spf1 mx -all", "v=spf1 a -all"}, nil
+		case "_dmarc.example.org", "_dmarc.example.co.uk":
+			return []string{"v=DMARC1; p=reject"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	setting.MailService = &setting.Mailer{FromEmail: "gitea@example.com", MailType: "dummy"}
+	result := Diagnose()
+	if assert.Len(t, result, 3) {
+		assert.Empty(t, result[0].Problem, "SPF")
+		assert.True(t, result[1].Warning, "DKIM")
+		assert.True(t, result[2].Warning, "DMARC")
+	}
+
+	// The policy of the organizational domain applies to subdomains.
+	setting.MailService = &setting.Mailer{FromEmail: "gitea@twice.example.org", MailType: "dummy"}
+	result = Diagnose()
+	if assert.Len(t, result, 3) {
+		assert.NotEmpty(t, result[0].Problem, "SPF")
+		assert.False(t, result[0].Warning, "SPF")
+		assert.Empty(t, result[2].Problem, "DMARC")
+	}
+
+	// The organizational domain is found with the public suffix list.
+	setting.MailService = &setting.Mailer{FromEmail: "gitea@mail.example.co.uk", MailType: "dummy"}
+	result = Diagnose()
+	if assert.Len(t, result, 3) {
+		assert.Empty(t, result[2].Problem, "DMARC")
+	}
+}
+
+func TestDiagnoseSMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go serveTestSMTP(t, l)
+
+	result := diagnoseSMTP(&setting.Mailer{Host: l.Addr().String()})
+	if assert.Len(t, result, 1) {
+		assert.Contains(t, result[0].Problem, "STARTTLS")
+		assert.True(t, result[0].Warning)
+	}
+
+	result = diagnoseSMTP(&setting.Mailer{Host: "127.0.0.1:1"})
+	if assert.Len(t, result, 1) {
+		assert.NotEmpty(t, result[0].Problem)
+		assert.False(t, result[0].Warning)
+		assert.Contains(t, result[0].Fix, "HOST")
+	}
+}
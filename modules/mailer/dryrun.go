@@ -0,0 +1,48 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// dryRunBackend is the backend of the mails recorded with DRY_RUN.
+const dryRunBackend = "dry-run"
+
+// backendName returns the name of the backend the mails are counted and
+// recorded for.
+func backendName() string {
+	if setting.MailService.DryRun {
+		return dryRunBackend
+	}
+	return setting.MailService.MailType
+}
+
+// Sender implementation replacing the backend with DRY_RUN, which renders
+// the messages like the backend would but never sends them.
+type dryRunSender struct{}
+
+// Send renders the message and writes it to the log.
+func (s *dryRunSender) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if _, err = msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	log.Trace("Mail not sent (dry run) from %s to %v: %s - %s, %d bytes:\n%s", from, to, msg.GetHeader("Subject"), msg.Info, buf.Len(), buf.String())
+	return nil
+}
+
+// Close is a no-op.
+func (s *dryRunSender) Close() error {
+	return nil
+}
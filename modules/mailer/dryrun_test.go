@@ -0,0 +1,41 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"context"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRun(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "smtp",
+		Host:     "127.0.0.1:1",
+		DryRun:   true,
+	}
+	defer resetSyncSenders()
+
+	var recorded []*Delivery
+	SetDeliveryRecorder(func(d *Delivery) error {
+		recorded = append(recorded, d)
+		return nil
+	})
+	defer SetDeliveryRecorder(nil)
+
+	// The SMTP server is never connected.
+	result, err := SendSync(context.Background(), NewMessage([]string{"user@example.com"}, "Subject", "Body"))
+	assert.NoError(t, err)
+	assert.Equal(t, "dry-run", result.Backend)
+	if assert.Len(t, recorded, 1) {
+		assert.Equal(t, "dry-run", recorded[0].Backend)
+		assert.Equal(t, DeliverySent, recorded[0].Status)
+	}
+	assert.NotZero(t, GetStats().Sent["dry-run"])
+}
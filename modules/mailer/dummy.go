@@ -0,0 +1,39 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// Sender implementation which only logs the messages and never delivers them.
+type dummySender struct{}
+
+func newDummySender() (Sender, error) {
+	return &dummySender{}, nil
+}
+
+// Send logs the message instead of sending it.
+func (s *dummySender) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+	log.Info("Mail not sent (dummy sender) from %s to %v: %s - %s", from, to, msg.GetHeader("Subject"), msg.Info)
+
+	var buf bytes.Buffer
+	if _, err = msg.WriteTo(&buf); err != nil {
+		return err
+	}
+	log.Trace("Dummy sender message:\n%s", buf.String())
+	return nil
+}
+
+// Close is a no-op.
+func (s *dummySender) Close() error {
+	return nil
+}
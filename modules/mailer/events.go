@@ -0,0 +1,600 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+var (
+	// ErrWebhookDisabled is returned for the event webhook of a provider
+	// which is not configured.
+	ErrWebhookDisabled = errors.New("event webhook is not enabled")
+	// ErrWebhookSignature is returned if the signature of an event webhook
+	// request is invalid.
+	ErrWebhookSignature = errors.New("invalid event webhook signature")
+)
+
+// DeliveryEvent is the outcome of a delivery reported by the mail service
+// after it accepted the message.
+type DeliveryEvent struct {
+	// DeliveryDelivered, DeliveryDeferred, DeliveryBounced or DeliveryComplained.
+	Status    DeliveryStatus
+	MessageID string
+	Email     string
+	Code      string // Status code, like the enhanced status code 5.1.1 if known.
+	Reason    string
+	Permanent bool // Whether a bounce is permanent.
+}
+
+// Bounce returns the bounce or complaint reported by the event, or nil.
+func (e *DeliveryEvent) Bounce() *Bounce {
+	if e.Status != DeliveryBounced && e.Status != DeliveryComplained {
+		return nil
+	}
+	return &Bounce{
+		Email:     e.Email,
+		Status:    e.Code,
+		Reason:    e.Reason,
+		Permanent: e.Permanent || e.Status == DeliveryComplained,
+		Complaint: e.Status == DeliveryComplained,
+	}
+}
+
+// Delivery returns the event as entry of the delivery log.
+func (e *DeliveryEvent) Delivery(provider string) *Delivery {
+	code, _ := strconv.Atoi(e.Code)
+	return &Delivery{
+		MessageID:  e.MessageID,
+		Recipients: []string{e.Email},
+		Backend:    provider,
+		Code:       code,
+		Error:      e.Reason,
+		Status:     e.Status,
+	}
+}
+
+// bracketMessageID returns the message ID enclosed in angle brackets, as in
+// the Message-ID header.
+func bracketMessageID(id string) string {
+	if len(id) == 0 || strings.HasPrefix(id, "<") {
+		return id
+	}
+	return "<" + id + ">"
+}
+
+// ParseWebhookEvents verifies the event webhook request of the provider and
+// returns the delivery events it reports. The requests of SendGrid, Mailgun
+// and Amazon SES (via SNS) are signed, the requests of Postmark and of the
+// generic format have to pass the configured token in the token parameter.
+// The generic format is a JSON array of objects with the fields event,
+// message_id, email, code, reason and permanent.
+func ParseWebhookEvents(provider string, req *http.Request, body []byte) ([]*DeliveryEvent, error) {
+	opts := setting.MailService
+	if opts == nil {
+		return nil, ErrWebhookDisabled
+	}
+
+	switch provider {
+	case "sendgrid":
+		if len(opts.SendGridWebhookPublicKey) == 0 {
+			return nil, ErrWebhookDisabled
+		}
+		if err := verifySendGridSignature(opts.SendGridWebhookPublicKey,
+			req.Header.Get("X-Twilio-Email-Event-Webhook-Signature"),
+			req.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp"), body); err != nil {
+			return nil, err
+		}
+		if err := checkWebhookReplay(req.Header.Get("X-Twilio-Email-Event-Webhook-Timestamp"),
+			"sendgrid:"+req.Header.Get("X-Twilio-Email-Event-Webhook-Signature")); err != nil {
+			return nil, err
+		}
+		return parseSendGridEvents(body)
+	case "mailgun":
+		if len(opts.MailgunWebhookSigningKey) == 0 {
+			return nil, ErrWebhookDisabled
+		}
+		return parseMailgunEvents(opts.MailgunWebhookSigningKey, body)
+	case "ses":
+		if len(opts.SESTopicARN) == 0 {
+			return nil, ErrWebhookDisabled
+		}
+		return parseSESEvents(opts.SESTopicARN, body)
+	case "postmark", "generic":
+		if len(opts.EventWebhookToken) == 0 {
+			return nil, ErrWebhookDisabled
+		}
+		if subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("token")), []byte(opts.EventWebhookToken)) != 1 {
+			return nil, ErrWebhookSignature
+		}
+		if provider == "postmark" {
+			return parsePostmarkEvents(body)
+		}
+		return parseGenericEvents(body)
+	}
+	return nil, ErrWebhookDisabled
+}
+
+// webhookMaxAge is how far the timestamp of a signed webhook request may be
+// off, older requests are rejected as they may be replayed.
+const webhookMaxAge = 5 * time.Minute
+
+// webhookReplays holds the signed webhook requests seen until their
+// timestamp is too old to be accepted anyway.
+var webhookReplays = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+// checkWebhookReplay rejects signed webhook requests whose unix timestamp is
+// more than webhookMaxAge off and requests with a key seen before, like the
+// token of Mailgun.
+func checkWebhookReplay(timestamp, key string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	now := time.Now()
+	at := time.Unix(sec, 0)
+	if at.Before(now.Add(-webhookMaxAge)) || at.After(now.Add(webhookMaxAge)) {
+		return ErrWebhookSignature
+	}
+
+	webhookReplays.Lock()
+	defer webhookReplays.Unlock()
+	for k, expires := range webhookReplays.expires {
+		if now.After(expires) {
+			delete(webhookReplays.expires, k)
+		}
+	}
+	if _, seen := webhookReplays.expires[key]; seen {
+		return ErrWebhookSignature
+	}
+	webhookReplays.expires[key] = at.Add(webhookMaxAge)
+	return nil
+}
+
+// verifySendGridSignature verifies the ECDSA signature of the signed event
+// webhook of SendGrid, using the base64 encoded public key of the account.
+func verifySendGridSignature(publicKey, signature, timestamp string, body []byte) error {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return fmt.Errorf("sendgrid: public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("sendgrid: public key: %v", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("sendgrid: public key is not an ECDSA key")
+	}
+
+	rawSig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(rawSig, &sig); err != nil {
+		return ErrWebhookSignature
+	}
+
+	hashed := sha256.Sum256(append([]byte(timestamp), body...))
+	if !ecdsa.Verify(key, hashed[:], sig.R, sig.S) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+func parseSendGridEvents(body []byte) ([]*DeliveryEvent, error) {
+	var events []*struct {
+		Email  string `json:"email"`
+		Event  string `json:"event"`
+		Type   string `json:"type"`
+		SMTPID string `json:"smtp-id"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+
+	result := make([]*DeliveryEvent, 0, len(events))
+	for _, e := range events {
+		event := &DeliveryEvent{
+			MessageID: bracketMessageID(e.SMTPID),
+			Email:     e.Email,
+			Code:      e.Status,
+			Reason:    e.Reason,
+		}
+		switch e.Event {
+		case "delivered":
+			event.Status = DeliveryDelivered
+		case "deferred":
+			event.Status = DeliveryDeferred
+		case "bounce":
+			event.Status = DeliveryBounced
+			// Blocked messages were rejected for the content or the sender.
+			event.Permanent = e.Type != "blocked"
+		case "spamreport":
+			event.Status = DeliveryComplained
+		default:
+			continue
+		}
+		result = append(result, event)
+	}
+	return result, nil
+}
+
+// parseMailgunEvents verifies the HMAC signature of the Mailgun webhook
+// and returns its event.
+func parseMailgunEvents(signingKey string, body []byte) ([]*DeliveryEvent, error) {
+	var payload struct {
+		Signature struct {
+			Timestamp string `json:"timestamp"`
+			Token     string `json:"token"`
+			Signature string `json:"signature"`
+		} `json:"signature"`
+		EventData struct {
+			Event     string `json:"event"`
+			Severity  string `json:"severity"`
+			Recipient string `json:"recipient"`
+			Message   struct {
+				Headers struct {
+					MessageID string `json:"message-id"`
+				} `json:"headers"`
+			} `json:"message"`
+			DeliveryStatus struct {
+				Code        int    `json:"code"`
+				Message     string `json:"message"`
+				Description string `json:"description"`
+			} `json:"delivery-status"`
+		} `json:"event-data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(payload.Signature.Timestamp + payload.Signature.Token))
+	sig, err := hex.DecodeString(payload.Signature.Signature)
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrWebhookSignature
+	}
+	if err = checkWebhookReplay(payload.Signature.Timestamp, "mailgun:"+payload.Signature.Token); err != nil {
+		return nil, err
+	}
+
+	e := payload.EventData
+	event := &DeliveryEvent{
+		MessageID: bracketMessageID(e.Message.Headers.MessageID),
+		Email:     e.Recipient,
+		Reason:    e.DeliveryStatus.Message,
+	}
+	if len(event.Reason) == 0 {
+		event.Reason = e.DeliveryStatus.Description
+	}
+	if e.DeliveryStatus.Code > 0 {
+		event.Code = strconv.Itoa(e.DeliveryStatus.Code)
+	}
+	switch e.Event {
+	case "delivered":
+		event.Status = DeliveryDelivered
+	case "failed":
+		if e.Severity == "permanent" {
+			event.Status, event.Permanent = DeliveryBounced, true
+		} else {
+			event.Status = DeliveryDeferred
+		}
+	case "complained":
+		event.Status = DeliveryComplained
+	default:
+		return nil, nil
+	}
+	return []*DeliveryEvent{event}, nil
+}
+
+func parsePostmarkEvents(body []byte) ([]*DeliveryEvent, error) {
+	var payload struct {
+		RecordType  string `json:"RecordType"`
+		Type        string `json:"Type"`
+		Email       string `json:"Email"`
+		Recipient   string `json:"Recipient"`
+		Description string `json:"Description"`
+		Details     string `json:"Details"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	event := &DeliveryEvent{
+		Email:  payload.Email,
+		Code:   payload.Type,
+		Reason: payload.Details,
+	}
+	if len(event.Reason) == 0 {
+		event.Reason = payload.Description
+	}
+	switch payload.RecordType {
+	case "Delivery":
+		event.Status, event.Email = DeliveryDelivered, payload.Recipient
+	case "Bounce":
+		event.Status = DeliveryBounced
+		event.Permanent = payload.Type == "HardBounce" || payload.Type == "BadEmailAddress"
+	case "SpamComplaint":
+		event.Status = DeliveryComplained
+	default:
+		return nil, nil
+	}
+	return []*DeliveryEvent{event}, nil
+}
+
+func parseGenericEvents(body []byte) ([]*DeliveryEvent, error) {
+	var events []*struct {
+		Event     DeliveryStatus `json:"event"`
+		MessageID string         `json:"message_id"`
+		Email     string         `json:"email"`
+		Code      string         `json:"code"`
+		Reason    string         `json:"reason"`
+		Permanent bool           `json:"permanent"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+
+	result := make([]*DeliveryEvent, 0, len(events))
+	for _, e := range events {
+		switch e.Event {
+		case DeliveryDelivered, DeliveryDeferred, DeliveryBounced, DeliveryComplained:
+		default:
+			return nil, fmt.Errorf("unknown event: %s", e.Event)
+		}
+		result = append(result, &DeliveryEvent{
+			Status:    e.Event,
+			MessageID: bracketMessageID(e.MessageID),
+			Email:     e.Email,
+			Code:      e.Code,
+			Reason:    e.Reason,
+			Permanent: e.Permanent,
+		})
+	}
+	return result, nil
+}
+
+// snsMessage is a message of Amazon SNS.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// stringToSign returns the fields of the message covered by its signature.
+func (m *snsMessage) stringToSign() string {
+	fields := []string{"Message", m.Message, "MessageId", m.MessageID}
+	if m.Type == "Notification" {
+		if len(m.Subject) > 0 {
+			fields = append(fields, "Subject", m.Subject)
+		}
+		fields = append(fields, "Timestamp", m.Timestamp, "TopicArn", m.TopicArn, "Type", m.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", m.SubscribeURL, "Timestamp", m.Timestamp,
+			"Token", m.Token, "TopicArn", m.TopicArn, "Type", m.Type)
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// snsHostPattern matches the regional hosts of Amazon SNS.
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com$`)
+
+// isSNSURL checks if the URL points to Amazon SNS.
+func isSNSURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && snsHostPattern.MatchString(u.Host)
+}
+
+// isSNSCertificateURL checks if the URL points to a certificate of Amazon SNS.
+func isSNSCertificateURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && snsHostPattern.MatchString(u.Host) && strings.HasSuffix(u.Path, ".pem")
+}
+
+// maxSNSCertificates limits the number of cached signing certificates, SNS
+// uses few of them at a time.
+const maxSNSCertificates = 16
+
+var snsCertificates = struct {
+	sync.Mutex
+	certs map[string]*x509.Certificate
+}{certs: make(map[string]*x509.Certificate)}
+
+// fetchSNSCertificate returns the signing certificate of SNS messages, it is
+// overridden by tests.
+var fetchSNSCertificate = func(certURL string) (*x509.Certificate, error) {
+	snsCertificates.Lock()
+	defer snsCertificates.Unlock()
+	if cert, ok := snsCertificates.certs[certURL]; ok {
+		return cert, nil
+	}
+
+	data, err := httplib.Get(certURL).SetTimeout(apiTimeout, apiTimeout).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(snsCertificates.certs) >= maxSNSCertificates {
+		snsCertificates.certs = make(map[string]*x509.Certificate)
+	}
+	snsCertificates.certs[certURL] = cert
+	return cert, nil
+}
+
+// verify checks the signature of the message.
+func (m *snsMessage) verify() error {
+	if !isSNSCertificateURL(m.SigningCertURL) {
+		return ErrWebhookSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+
+	var alg x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		alg = x509.SHA1WithRSA
+	case "2":
+		alg = x509.SHA256WithRSA
+	default:
+		return ErrWebhookSignature
+	}
+
+	cert, err := fetchSNSCertificate(m.SigningCertURL)
+	if err != nil {
+		return fmt.Errorf("ses: signing certificate: %v", err)
+	}
+	if err = cert.CheckSignature(alg, []byte(m.stringToSign()), sig); err != nil {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+// parseSESEvents verifies the SNS message of the topic and returns the
+// events of the SES notification it contains. Subscriptions to the topic
+// are confirmed.
+func parseSESEvents(topicARN string, body []byte) ([]*DeliveryEvent, error) {
+	msg := new(snsMessage)
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	if msg.TopicArn != topicARN {
+		return nil, ErrWebhookSignature
+	}
+	if err := msg.verify(); err != nil {
+		return nil, err
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if !isSNSURL(msg.SubscribeURL) {
+			return nil, fmt.Errorf("ses: invalid subscription URL: %s", msg.SubscribeURL)
+		}
+		return nil, doAPIRequest("SNS", httplib.Get(msg.SubscribeURL), nil)
+	case "Notification":
+	default:
+		return nil, nil
+	}
+
+	type recipient struct {
+		EmailAddress   string `json:"emailAddress"`
+		Status         string `json:"status"`
+		DiagnosticCode string `json:"diagnosticCode"`
+	}
+	var n struct {
+		NotificationType string `json:"notificationType"`
+		EventType        string `json:"eventType"`
+		Mail             struct {
+			CommonHeaders struct {
+				MessageID string `json:"messageId"`
+			} `json:"commonHeaders"`
+		} `json:"mail"`
+		Delivery struct {
+			Recipients   []string `json:"recipients"`
+			SMTPResponse string   `json:"smtpResponse"`
+		} `json:"delivery"`
+		Bounce struct {
+			BounceType        string      `json:"bounceType"`
+			BouncedRecipients []recipient `json:"bouncedRecipients"`
+		} `json:"bounce"`
+		Complaint struct {
+			ComplainedRecipients []recipient `json:"complainedRecipients"`
+			FeedbackType         string      `json:"complaintFeedbackType"`
+		} `json:"complaint"`
+		DeliveryDelay struct {
+			DelayType         string      `json:"delayType"`
+			DelayedRecipients []recipient `json:"delayedRecipients"`
+		} `json:"deliveryDelay"`
+	}
+	if err := json.Unmarshal([]byte(msg.Message), &n); err != nil {
+		return nil, err
+	}
+
+	messageID := bracketMessageID(n.Mail.CommonHeaders.MessageID)
+	var events []*DeliveryEvent
+	add := func(status DeliveryStatus, recipients []recipient, reason string) {
+		for _, r := range recipients {
+			event := &DeliveryEvent{
+				Status:    status,
+				MessageID: messageID,
+				Email:     r.EmailAddress,
+				Code:      r.Status,
+				Reason:    r.DiagnosticCode,
+				Permanent: status == DeliveryBounced && n.Bounce.BounceType == "Permanent",
+			}
+			if len(event.Reason) == 0 {
+				event.Reason = reason
+			}
+			events = append(events, event)
+		}
+	}
+
+	eventType := n.NotificationType
+	if len(eventType) == 0 {
+		eventType = n.EventType
+	}
+	switch eventType {
+	case "Delivery":
+		recipients := make([]recipient, 0, len(n.Delivery.Recipients))
+		for _, email := range n.Delivery.Recipients {
+			recipients = append(recipients, recipient{EmailAddress: email})
+		}
+		add(DeliveryDelivered, recipients, n.Delivery.SMTPResponse)
+	case "Bounce":
+		add(DeliveryBounced, n.Bounce.BouncedRecipients, n.Bounce.BounceType)
+	case "Complaint":
+		add(DeliveryComplained, n.Complaint.ComplainedRecipients, n.Complaint.FeedbackType)
+	case "DeliveryDelay":
+		add(DeliveryDeferred, n.DeliveryDelay.DelayedRecipients, n.DeliveryDelay.DelayType)
+	}
+	return events, nil
+}
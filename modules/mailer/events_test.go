@@ -0,0 +1,218 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetWebhookReplays forgets the signed webhook requests of former runs.
+func resetWebhookReplays() {
+	webhookReplays.Lock()
+	webhookReplays.expires = make(map[string]time.Time)
+	webhookReplays.Unlock()
+}
+
+func TestParseWebhookEvents_SendGrid(t *testing.T) {
+	resetWebhookReplays()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	setting.MailService = &setting.Mailer{SendGridWebhookPublicKey: base64.StdEncoding.EncodeToString(der)}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := `[{"email":"a@example.com","event":"bounce","type":"bounce","status":"5.1.1","reason":"unknown","smtp-id":"<1@example.com>"},
+		{"email":"b@example.com","event":"bounce","type":"blocked","status":"5.7.1","reason":"spam"},
+		{"email":"c@example.com","event":"spamreport"},
+		{"email":"d@example.com","event":"open"}]`
+	hashed := sha256.Sum256([]byte(timestamp + body))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hashed[:])
+	assert.NoError(t, err)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/api/v1/mail/events/sendgrid", nil)
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Twilio-Email-Event-Webhook-Signature", base64.StdEncoding.EncodeToString(sig))
+	events, err := ParseWebhookEvents("sendgrid", req, []byte(body))
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, []*DeliveryEvent{
+		{Status: DeliveryBounced, MessageID: "<1@example.com>", Email: "a@example.com", Code: "5.1.1", Reason: "unknown", Permanent: true},
+		{Status: DeliveryBounced, Email: "b@example.com", Code: "5.7.1", Reason: "spam"},
+		{Status: DeliveryComplained, Email: "c@example.com"},
+	}, events)
+	assert.Equal(t, &Bounce{Email: "c@example.com", Permanent: true, Complaint: true}, events[2].Bounce())
+
+	_, err = ParseWebhookEvents("sendgrid", req, []byte(body+" "))
+	assert.Equal(t, ErrWebhookSignature, err)
+
+	// The request may not be replayed.
+	_, err = ParseWebhookEvents("sendgrid", req, []byte(body))
+	assert.Equal(t, ErrWebhookSignature, err)
+}
+
+func TestParseWebhookEvents_Mailgun(t *testing.T) {
+	resetWebhookReplays()
+	setting.MailService = &setting.Mailer{MailgunWebhookSigningKey: "key"}
+
+	sign := func(timestamp, token string) string {
+		mac := hmac.New(sha256.New, []byte("key"))
+		mac.Write([]byte(timestamp + token))
+		return `{"signature":{"timestamp":"` + timestamp + `","token":"` + token + `","signature":"` + hex.EncodeToString(mac.Sum(nil)) + `"},
+		"event-data":{"event":"failed","severity":"permanent","recipient":"a@example.com",
+		"message":{"headers":{"message-id":"1@example.com"}},
+		"delivery-status":{"code":550,"message":"No such user"}}}`
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := sign(timestamp, "token")
+
+	req := httptest.NewRequest("POST", "/api/v1/mail/events/mailgun", nil)
+	events, err := ParseWebhookEvents("mailgun", req, []byte(body))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, []*DeliveryEvent{
+		{Status: DeliveryBounced, MessageID: "<1@example.com>", Email: "a@example.com", Code: "550", Reason: "No such user", Permanent: true},
+	}, events)
+	assert.Equal(t, &Delivery{
+		MessageID:  "<1@example.com>",
+		Recipients: []string{"a@example.com"},
+		Backend:    "mailgun",
+		Code:       550,
+		Error:      "No such user",
+		Status:     DeliveryBounced,
+	}, events[0].Delivery("mailgun"))
+
+	_, err = ParseWebhookEvents("mailgun", req, []byte(strings.Replace(body, `"token":"token"`, `"token":"other"`, 1)))
+	assert.Equal(t, ErrWebhookSignature, err)
+
+	// Tokens seen before and stale requests are rejected.
+	_, err = ParseWebhookEvents("mailgun", req, []byte(body))
+	assert.Equal(t, ErrWebhookSignature, err)
+	_, err = ParseWebhookEvents("mailgun", req, []byte(sign("1500000000", "stale")))
+	assert.Equal(t, ErrWebhookSignature, err)
+}
+
+func TestParseWebhookEvents_SES(t *testing.T) {
+	const topic = "arn:aws:sns:us-east-1:123456789012:ses"
+	setting.MailService = &setting.Mailer{SESTopicARN: topic}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	fetch := fetchSNSCertificate
+	defer func() { fetchSNSCertificate = fetch }()
+	fetchSNSCertificate = func(string) (*x509.Certificate, error) {
+		return cert, nil
+	}
+
+	notification := `{"notificationType":"Bounce","mail":{"commonHeaders":{"messageId":"1@example.com"}},` +
+		`"bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"a@example.com","status":"5.1.1","diagnosticCode":"smtp; 550"}]}}`
+	msg := &snsMessage{
+		Type:             "Notification",
+		MessageID:        "1",
+		TopicArn:         topic,
+		Message:          notification,
+		Timestamp:        "2017-01-01T00:00:00.000Z",
+		SignatureVersion: "2",
+		SigningCertURL:   "https://sns.us-east-1.amazonaws.com/cert.pem",
+	}
+	hashed := sha256.Sum256([]byte(msg.stringToSign()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	assert.NoError(t, err)
+	msg.Signature = base64.StdEncoding.EncodeToString(sig)
+	body, err := json.Marshal(msg)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/api/v1/mail/events/ses", nil)
+	events, err := ParseWebhookEvents("ses", req, body)
+	assert.NoError(t, err)
+	assert.Equal(t, []*DeliveryEvent{
+		{Status: DeliveryBounced, MessageID: "<1@example.com>", Email: "a@example.com", Code: "5.1.1", Reason: "smtp; 550", Permanent: true},
+	}, events)
+
+	msg.Message = strings.Replace(notification, "Permanent", "Transient", 1)
+	body, _ = json.Marshal(msg)
+	_, err = ParseWebhookEvents("ses", req, body)
+	assert.Equal(t, ErrWebhookSignature, err)
+
+	for _, certURL := range []string{
+		"https://example.com/cert.pem",
+		"https://sns.evil.com.amazonaws.com.example.com/cert.pem",
+		"https://sns.us-east-1.amazonaws.com/cert",
+		"http://sns.us-east-1.amazonaws.com/cert.pem",
+	} {
+		msg.SigningCertURL = certURL
+		body, _ = json.Marshal(msg)
+		_, err = ParseWebhookEvents("ses", req, body)
+		assert.Equal(t, ErrWebhookSignature, err, certURL)
+	}
+}
+
+func TestParseWebhookEvents_Token(t *testing.T) {
+	setting.MailService = &setting.Mailer{EventWebhookToken: "secret"}
+
+	req := httptest.NewRequest("POST", "/api/v1/mail/events/postmark?token=secret", nil)
+	events, err := ParseWebhookEvents("postmark", req,
+		[]byte(`{"RecordType":"Bounce","Type":"HardBounce","Email":"a@example.com","Description":"Unknown user"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*DeliveryEvent{
+		{Status: DeliveryBounced, Email: "a@example.com", Code: "HardBounce", Reason: "Unknown user", Permanent: true},
+	}, events)
+
+	req = httptest.NewRequest("POST", "/api/v1/mail/events/generic?token=secret", nil)
+	events, err = ParseWebhookEvents("generic", req,
+		[]byte(`[{"event":"delivered","message_id":"<1@example.com>","email":"a@example.com","code":"250"}]`))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, []*DeliveryEvent{
+		{Status: DeliveryDelivered, MessageID: "<1@example.com>", Email: "a@example.com", Code: "250"},
+	}, events)
+	assert.Nil(t, events[0].Bounce())
+
+	_, err = ParseWebhookEvents("generic", req, []byte(`[{"event":"opened"}]`))
+	assert.Error(t, err)
+
+	req = httptest.NewRequest("POST", "/api/v1/mail/events/generic?token=wrong", nil)
+	_, err = ParseWebhookEvents("generic", req, []byte(`[]`))
+	assert.Equal(t, ErrWebhookSignature, err)
+
+	_, err = ParseWebhookEvents("sendgrid", req, []byte(`[]`))
+	assert.Equal(t, ErrWebhookDisabled, err)
+}
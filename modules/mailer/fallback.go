@@ -0,0 +1,124 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+var (
+	fallbackPoolLock sync.Mutex
+	fallbackHosts    = make(map[string]*smtpHosts)
+	fallbackPools    = make(map[string]*smtpPool)
+)
+
+// fallbackSMTPSender returns a sender using the connection pool of the
+// fallback, which is separate from the pools of [mailer] and the routes.
+func fallbackSMTPSender(f *setting.MailFallback) (Sender, error) {
+	fallbackPoolLock.Lock()
+	defer fallbackPoolLock.Unlock()
+
+	p, ok := fallbackPools[f.Name]
+	if !ok {
+		hosts, err := newSMTPHosts(f.Mailer)
+		if err != nil {
+			return nil, err
+		}
+		p = newSMTPPool(hosts.Dial, f.SMTPMaxConns, f.Mailer)
+		fallbackHosts[f.Name], fallbackPools[f.Name] = hosts, p
+	}
+	return &smtpSender{hosts: fallbackHosts[f.Name], pool: p}, nil
+}
+
+// resetFallbackPools closes the idle connections of all fallbacks, new
+// connections use the current settings.
+func resetFallbackPools() (err error) {
+	fallbackPoolLock.Lock()
+	pools := fallbackPools
+	fallbackHosts = make(map[string]*smtpHosts)
+	fallbackPools = make(map[string]*smtpPool)
+	fallbackPoolLock.Unlock()
+
+	for _, p := range pools {
+		if cerr := p.CloseIdle(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// fallbackSender sends the mails with the backend of [mailer] and moves on
+// to the next backend of FALLBACKS when a backend rejects a mail, or once
+// it failed FALLBACK_ATTEMPTS times to deliver it. The retries of the
+// daemon are spread over the backends, so MAX_RETRIES has to allow for
+// them.
+type fallbackSender struct {
+	senders []Sender // The backend of [mailer] first.
+	names   []string
+}
+
+func newFallbackSender(s Sender) (Sender, error) {
+	fs := &fallbackSender{
+		senders: []Sender{s},
+		names:   []string{setting.MailService.MailType},
+	}
+	for _, f := range setting.MailService.Fallbacks {
+		var fb Sender
+		var err error
+		if f.MailType == "smtp" {
+			fb, err = fallbackSMTPSender(f)
+		} else {
+			fb, err = createBackend(f.Mailer)
+		}
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("mailer.fallback.%s: %v", f.Name, err)
+		}
+		fs.senders = append(fs.senders, fb)
+		fs.names = append(fs.names, f.Name)
+	}
+	return fs, nil
+}
+
+// Send the message with the backend for its number of failed attempts. If
+// the backend rejects it, the message is sent with the next backends at
+// once, the error of the last backend is returned.
+func (s *fallbackSender) Send(msg *Message) error {
+	first := 0
+	if n := setting.MailService.FallbackAttempts; n > 0 {
+		first = msg.attempts / n
+	}
+	if first >= len(s.senders) {
+		first = len(s.senders) - 1
+	}
+
+	var err error
+	for i := first; i < len(s.senders); i++ {
+		if i > 0 {
+			log.Trace("Sending e-mails %s: %s with fallback %s", msg.GetHeader("To"), msg.Info, s.names[i])
+		}
+		if err = s.senders[i].Send(msg); err == nil || !IsErrPermanentFailure(err) {
+			return err
+		}
+		if i+1 < len(s.senders) {
+			log.Warn("Backend %s rejected e-mails %s: %s - %v", s.names[i], msg.GetHeader("To"), msg.Info, err)
+		}
+	}
+	return err
+}
+
+// Close the connections of all backends.
+func (s *fallbackSender) Close() (err error) {
+	for _, fs := range s.senders {
+		if cerr := fs.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
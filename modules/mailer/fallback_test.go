@@ -0,0 +1,63 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingSender returns its error and counts the messages.
+type failingSender struct {
+	err  error
+	sent int
+}
+
+func (s *failingSender) Send(msg *Message) error {
+	s.sent++
+	return s.err
+}
+
+func (s *failingSender) Close() error {
+	return nil
+}
+
+func TestFallbackSender(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", FallbackAttempts: 2}
+	primary := &failingSender{err: errors.New("connection refused")}
+	fallback := &failingSender{}
+	s := &fallbackSender{senders: []Sender{primary, fallback}, names: []string{"ses", "local"}}
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+
+	// Temporary failures are retried with the primary backend first.
+	assert.Error(t, s.Send(msg))
+	msg.attempts = 1
+	assert.Error(t, s.Send(msg))
+	msg.attempts = 2
+	assert.NoError(t, s.Send(msg))
+	assert.Equal(t, 2, primary.sent)
+	assert.Equal(t, 1, fallback.sent)
+
+	// Rejected messages are sent with the fallback at once.
+	primary.err = ErrPermanentFailure{errors.New("554 rejected")}
+	msg.attempts = 0
+	assert.NoError(t, s.Send(msg))
+	assert.Equal(t, 3, primary.sent)
+	assert.Equal(t, 2, fallback.sent)
+
+	// The error of the last backend is returned.
+	fallback.err = ErrPermanentFailure{errors.New("550 rejected")}
+	err := s.Send(msg)
+	assert.True(t, IsErrPermanentFailure(err))
+	assert.Contains(t, err.Error(), "550 rejected")
+	msg.attempts = 10
+	assert.Error(t, s.Send(msg))
+	assert.Equal(t, 4, primary.sent)
+	assert.Equal(t, 4, fallback.sent)
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+var fileSenderCounter uint64
+
+// Sender implementation which writes every message into a directory,
+// either as .eml files or using the Maildir layout.
+type fileSender struct {
+	dir      string
+	maildir  bool
+	hostname string
+}
+
+func newFileSender(opts *setting.Mailer) (Sender, error) {
+
+	s := &fileSender{
+		dir:     opts.FileDir,
+		maildir: opts.FileFormat == "maildir",
+	}
+
+	dirs := []string{s.dir}
+	if s.maildir {
+		dirs = []string{filepath.Join(s.dir, "tmp"), filepath.Join(s.dir, "new"), filepath.Join(s.dir, "cur")}
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		// Maildir file names must not contain slashes or colons.
+		s.hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("mailer: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Send writes the message into the directory.
+func (s *fileSender) Send(msg *Message) error {
+	// Keep Bcc in the file so the recipients can be inspected.
+	raw, err := msg.renderWithBcc()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	n := atomic.AddUint64(&fileSenderCounter, 1)
+
+	if !s.maildir {
+		name := fmt.Sprintf("%s-%d.eml", now.Format("20060102T150405.000000000"), n)
+		return ioutil.WriteFile(filepath.Join(s.dir, name), raw, 0644)
+	}
+
+	// Deliver into tmp first and move the complete file into new.
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, s.hostname)
+	tmp := filepath.Join(s.dir, "tmp", name)
+	if err = ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "new", name))
+}
+
+// Close is a no-op.
+func (s *fileSender) Close() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mails")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	setting.MailService = &setting.Mailer{From: "Gitea <gitea@example.com>", FileDir: dir}
+	s, err := newFileSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	msg.SetHeader("Bcc", "hidden@example.com")
+	assert.NoError(t, s.Send(msg))
+	assert.NoError(t, s.Send(msg))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.True(t, strings.HasSuffix(files[0].Name(), ".eml"))
+		data, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "Subject: Subject")
+		assert.Contains(t, string(data), "hidden@example.com")
+	}
+}
+
+func TestFileSender_Maildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	setting.MailService = &setting.Mailer{From: "Gitea <gitea@example.com>", FileDir: dir, FileFormat: "maildir"}
+	s, err := newFileSender(setting.MailService)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Send(NewMessage([]string{"user@example.com"}, "Subject", "<p>Body</p>")))
+
+	for name, count := range map[string]int{"tmp": 0, "new": 1, "cur": 0} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Len(t, files, count, name)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	gmailScope     = "https://www.googleapis.com/auth/gmail.send"
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// gmailSendURL is the endpoint of the Gmail API, tests change it to a local server.
+var gmailSendURL = "https://gmail.googleapis.com/gmail/v1/users/me/messages/send"
+
+// googleServiceAccount is the JSON key file of a Google service account.
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// Sender implementation for the Gmail API, authenticated as a service
+// account with domain-wide delegation for the sending user.
+type gmailSender struct {
+	tokens *oauth2TokenSource
+}
+
+func newGmailSender(opts *setting.Mailer) (Sender, error) {
+
+	data, err := ioutil.ReadFile(opts.GmailServiceAccountFile)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: read Gmail service account: %v", err)
+	}
+	var account googleServiceAccount
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("mailer: parse Gmail service account: %v", err)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("mailer: parse Gmail service account key: %v", err)
+	}
+	if len(account.TokenURI) == 0 {
+		account.TokenURI = googleTokenURL
+	}
+
+	user := opts.GmailUser
+	if len(user) == 0 {
+		user = opts.FromEmail
+	}
+	if len(user) == 0 {
+		return nil, errors.New("mailer: GMAIL_USER is required for the Gmail sender")
+	}
+
+	return &gmailSender{
+		tokens: &oauth2TokenSource{
+			provider: "Gmail",
+			tokenURL: account.TokenURI,
+			params: func() (map[string]string, error) {
+				// Request a token for the delegated user with a signed assertion.
+				now := time.Now()
+				assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+					"iss":   account.ClientEmail,
+					"sub":   user,
+					"scope": gmailScope,
+					"aud":   account.TokenURI,
+					"iat":   now.Unix(),
+					"exp":   now.Add(time.Hour).Unix(),
+				}).SignedString(key)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]string{
+					"grant_type": "urn:ietf:params:oauth:grant-type:jwt-bearer",
+					"assertion":  assertion,
+				}, nil
+			},
+		},
+	}, nil
+}
+
+// Send the message synchronous.
+func (s *gmailSender) Send(msg *Message) error {
+	// Gmail takes the recipients from the MIME headers.
+	raw, err := msg.renderWithBcc()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{
+		"raw": base64.URLEncoding.EncodeToString(raw),
+	})
+	if err != nil {
+		return err
+	}
+
+	for retried := false; ; retried = true {
+		token, err := s.tokens.Token()
+		if err != nil {
+			return err
+		}
+
+		req := httplib.Post(gmailSendURL).
+			Header("Authorization", "Bearer "+token).
+			Header("Content-Type", "application/json").
+			Body(body)
+		err = doAPIRequest("Gmail", req, nil)
+		if apiErr, ok := err.(ErrAPIRequest); ok && apiErr.StatusCode == 401 && !retried {
+			// The token was revoked before it expired, request a new one.
+			s.tokens.Reset()
+			continue
+		}
+		return permanentAPIError(err)
+	}
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *gmailSender) Close() error {
+	return nil
+}
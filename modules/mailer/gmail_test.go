@@ -0,0 +1,88 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGmailSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+	defer func(url string) { gmailSendURL = url }(gmailSendURL)
+	gmailSendURL = server.URL + "/gmail/v1/users/me/messages/send"
+	server.replyPath("/token", http.StatusOK, `{"access_token":"token","expires_in":3600}`)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	account, err := json.Marshal(&googleServiceAccount{
+		ClientEmail: "gitea@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		TokenURI:    server.URL + "/token",
+	})
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "gmail")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	accountFile := filepath.Join(dir, "account.json")
+	assert.NoError(t, ioutil.WriteFile(accountFile, account, 0600))
+
+	setting.MailService = &setting.Mailer{
+		From:                    "Gitea <gitea@example.com>",
+		FromEmail:               "gitea@example.com",
+		GmailServiceAccountFile: accountFile,
+	}
+	s, err := newGmailSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	server.reply(http.StatusOK, `{"id":"1"}`)
+	assert.NoError(t, s.Send(msg))
+
+	if assert.Len(t, server.requests, 2) {
+		params, err := url.ParseQuery(string(server.requests[0].Body))
+		assert.NoError(t, err)
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", params.Get("grant_type"))
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(params.Get("assertion"), claims, func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "gitea@example.com", claims["sub"])
+		assert.Equal(t, gmailScope, claims["scope"])
+	}
+	req := server.last()
+	assert.Equal(t, "/gmail/v1/users/me/messages/send", req.Path)
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(req.Body, &body))
+	raw, err := base64.URLEncoding.DecodeString(body["raw"])
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), "Subject: Subject")
+
+	// A revoked token is requested again once.
+	server.reply(http.StatusUnauthorized, "")
+	err = s.Send(msg)
+	assert.True(t, IsErrPermanentFailure(err), "%v", err)
+	assert.Len(t, server.requests, 5)
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
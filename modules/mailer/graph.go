@@ -0,0 +1,89 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// The endpoints of the Microsoft identity platform and the Graph API, tests
+// change them to a local server.
+var (
+	graphTokenURL = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+	graphAPIURL   = "https://graph.microsoft.com/v1.0/users/"
+)
+
+// Sender implementation for the Microsoft Graph sendMail API.
+type graphSender struct {
+	sendURL string
+	tokens  *oauth2TokenSource
+}
+
+func newGraphSender(opts *setting.Mailer) (Sender, error) {
+	if len(opts.GraphTenantID) == 0 || len(opts.GraphClientID) == 0 {
+		return nil, errors.New("mailer: GRAPH_TENANT_ID and GRAPH_CLIENT_ID are required for the Microsoft Graph sender")
+	}
+
+	user := opts.GraphUser
+	if len(user) == 0 {
+		user = opts.FromEmail
+	}
+
+	return &graphSender{
+		sendURL: graphAPIURL + url.PathEscape(user) + "/sendMail",
+		tokens: &oauth2TokenSource{
+			provider: "Microsoft Graph",
+			tokenURL: fmt.Sprintf(graphTokenURL, url.PathEscape(opts.GraphTenantID)),
+			params: func() (map[string]string, error) {
+				return map[string]string{
+					"grant_type":    "client_credentials",
+					"client_id":     opts.GraphClientID,
+					"client_secret": opts.GraphClientSecret,
+					"scope":         "https://graph.microsoft.com/.default",
+				}, nil
+			},
+		},
+	}, nil
+}
+
+// Send the message synchronous.
+func (s *graphSender) Send(msg *Message) error {
+	// Graph takes the recipients from the MIME headers.
+	raw, err := msg.renderWithBcc()
+	if err != nil {
+		return err
+	}
+	body := base64.StdEncoding.EncodeToString(raw)
+
+	for retried := false; ; retried = true {
+		token, err := s.tokens.Token()
+		if err != nil {
+			return err
+		}
+
+		req := httplib.Post(s.sendURL).
+			Header("Authorization", "Bearer "+token).
+			Header("Content-Type", "text/plain").
+			Body(body)
+		err = doAPIRequest("Microsoft Graph", req, nil)
+		if apiErr, ok := err.(ErrAPIRequest); ok && apiErr.StatusCode == 401 && !retried {
+			// The token was revoked before it expired, request a new one.
+			s.tokens.Reset()
+			continue
+		}
+		return permanentAPIError(err)
+	}
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *graphSender) Close() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+	defer func(tokenURL, apiURL string) { graphTokenURL, graphAPIURL = tokenURL, apiURL }(graphTokenURL, graphAPIURL)
+	graphTokenURL = server.URL + "/%s/oauth2/v2.0/token"
+	graphAPIURL = server.URL + "/v1.0/users/"
+	server.replyPath("/tenant/oauth2/v2.0/token", http.StatusOK, `{"access_token":"token","expires_in":3600}`)
+
+	setting.MailService = &setting.Mailer{
+		From:              "Gitea <gitea@example.com>",
+		FromEmail:         "gitea@example.com",
+		GraphTenantID:     "tenant",
+		GraphClientID:     "client",
+		GraphClientSecret: "secret",
+	}
+	s, err := newGraphSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	server.reply(http.StatusAccepted, "")
+	assert.NoError(t, s.Send(msg))
+
+	if assert.Len(t, server.requests, 2) {
+		params, err := url.ParseQuery(string(server.requests[0].Body))
+		assert.NoError(t, err)
+		assert.Equal(t, "client_credentials", params.Get("grant_type"))
+		assert.Equal(t, "client", params.Get("client_id"))
+		assert.Equal(t, "secret", params.Get("client_secret"))
+	}
+	req := server.last()
+	assert.Equal(t, "/v1.0/users/gitea@example.com/sendMail", req.Path)
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	raw, err := base64.StdEncoding.DecodeString(string(req.Body))
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), "Subject: Subject")
+
+	// A revoked token is requested again once.
+	server.reply(http.StatusUnauthorized, "")
+	err = s.Send(msg)
+	assert.True(t, IsErrPermanentFailure(err), "%v", err)
+	assert.Len(t, server.requests, 5)
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// HealthStatus is the outcome of a health check.
+type HealthStatus string
+
+// The outcomes of health checks.
+const (
+	HealthPass HealthStatus = "pass"
+	HealthWarn HealthStatus = "warn"
+	HealthFail HealthStatus = "fail"
+)
+
+// Health describes the state of the mail delivery.
+type Health struct {
+	Status        HealthStatus
+	Reason        string       // Why the status is not HealthPass.
+	Circuit       CircuitState // Empty if the circuit breaker is disabled.
+	QueueLength   int
+	QueueCapacity int       // Zero if the queue is not bounded.
+	LastSent      time.Time // Zero if no mail was sent since the start.
+}
+
+// queueFullRatio is the ratio of the queue capacity from which the health
+// check warns about a queue about to overflow.
+const queueFullRatio = 0.9
+
+// GetHealth checks the state of the mail delivery: it fails while the
+// circuit breaker is open or if mails are queued but none was sent within
+// HEALTH_STUCK_TIMEOUT, and warns while the delivery is probed or the queue
+// is almost full.
+func GetHealth() (*Health, error) {
+	if daemon == nil {
+		return nil, ErrMailServiceDisabled
+	}
+
+	h := &Health{
+		Status:      HealthPass,
+		QueueLength: daemon.queue.Len(),
+		LastSent:    GetStats().LastSent,
+	}
+	if setting.MailService.QueueType != "persistent" {
+		h.QueueCapacity = setting.MailService.QueueLength
+	}
+	if daemon.breaker != nil {
+		h.Circuit = daemon.breaker.State()
+	}
+
+	since := h.LastSent
+	if since.Before(daemon.started) {
+		since = daemon.started
+	}
+	switch {
+	case h.Circuit == CircuitOpen:
+		h.Status, h.Reason = HealthFail, "delivery paused after consecutive failures"
+	case h.QueueLength > 0 && time.Since(since) > setting.MailService.HealthStuckTimeout:
+		h.Status, h.Reason = HealthFail, "no mail sent since "+since.Format(time.RFC3339)
+	case h.Circuit == CircuitHalfOpen:
+		h.Status, h.Reason = HealthWarn, "probing the delivery after consecutive failures"
+	case h.QueueCapacity > 0 && float64(h.QueueLength) >= queueFullRatio*float64(h.QueueCapacity):
+		h.Status, h.Reason = HealthWarn, "queue almost full"
+	}
+	return h, nil
+}
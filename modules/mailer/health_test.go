@@ -0,0 +1,62 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetHealth(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:               "gitea@example.com",
+		QueueLength:        10,
+		HealthStuckTimeout: time.Minute,
+	}
+	daemon = nil
+	_, err := GetHealth()
+	assert.Equal(t, ErrMailServiceDisabled, err)
+
+	daemon = &Daemon{
+		queue:   newChannelQueue(10, "block", time.Second, nil),
+		breaker: newCircuitBreaker(1, time.Minute),
+		started: time.Now(),
+	}
+	defer func() { daemon = nil }()
+
+	h, err := GetHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, &Health{Status: HealthPass, Circuit: CircuitClosed, QueueCapacity: 10, LastSent: h.LastSent}, h)
+
+	for i := 0; i < 9; i++ {
+		assert.NoError(t, daemon.queue.Push(NewMessage([]string{"user2@example.com"}, "Subject", "Body")))
+	}
+	h, err = GetHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, HealthWarn, h.Status)
+	assert.Equal(t, 9, h.QueueLength)
+
+	// Queued mails but none sent within the timeout
+	stats = newStats()
+	daemon.started = time.Now().Add(-2 * time.Minute)
+	h, err = GetHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, HealthFail, h.Status)
+
+	countSend("dummy", 0, nil)
+	h, err = GetHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, HealthWarn, h.Status)
+
+	daemon.breaker.Done(ErrMailServiceDisabled)
+	h, err = GetHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, HealthFail, h.Status)
+	assert.Equal(t, CircuitOpen, h.Circuit)
+}
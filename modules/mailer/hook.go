@@ -0,0 +1,100 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// Hook is notified of the stages of the send pipeline, to audit the mails,
+// add headers or send some of them with another sender. The hooks are called
+// in the order they were registered, by the routine queueing the message and
+// by a worker routine, and must not block. Embed NopHook to implement a part
+// of the methods only.
+type Hook interface {
+	// BeforeEnqueue is called before the message is queued or sent
+	// synchronously, once its recipients are filtered. An error rejects the
+	// message.
+	BeforeEnqueue(msg *Message) error
+
+	// BeforeSend is called before each delivery attempt with the sender of
+	// the worker and returns the sender to use, which the hook has to close.
+	// An error fails the attempt like an error of the sender.
+	BeforeSend(msg *Message, s Sender) (Sender, error)
+
+	// AfterSend is called once the message was sent.
+	AfterSend(msg *Message, duration time.Duration)
+
+	// OnFailure is called after a failed delivery attempt, with the status
+	// DeliveryDeferred if the message is retried and DeliveryFailed if not.
+	OnFailure(msg *Message, err error, status DeliveryStatus)
+}
+
+// NopHook implements Hook without doing anything.
+type NopHook struct{}
+
+// BeforeEnqueue accepts the message.
+func (NopHook) BeforeEnqueue(msg *Message) error { return nil }
+
+// BeforeSend keeps the sender.
+func (NopHook) BeforeSend(msg *Message, s Sender) (Sender, error) { return s, nil }
+
+// AfterSend does nothing.
+func (NopHook) AfterSend(msg *Message, duration time.Duration) {}
+
+// OnFailure does nothing.
+func (NopHook) OnFailure(msg *Message, err error, status DeliveryStatus) {}
+
+var (
+	hooksLock sync.RWMutex
+	hooks     []Hook
+)
+
+// RegisterHook adds the hook to the send pipeline.
+// This method is thread-safe.
+func RegisterHook(h Hook) {
+	hooksLock.Lock()
+	hooks = append(hooks, h)
+	hooksLock.Unlock()
+}
+
+// getHooks returns the registered hooks.
+func getHooks() []Hook {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	return hooks
+}
+
+// beforeEnqueue passes the message to the hooks until one rejects it.
+func beforeEnqueue(msg *Message) error {
+	for _, h := range getHooks() {
+		if err := h.BeforeEnqueue(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWithHooks sends the message with the sender chosen by the hooks.
+func sendWithHooks(s Sender, msg *Message) (err error) {
+	for _, h := range getHooks() {
+		if s, err = h.BeforeSend(msg, s); err != nil {
+			return err
+		}
+	}
+	return s.Send(msg)
+}
+
+// afterSend notifies the hooks of the outcome of a delivery attempt.
+func afterSend(msg *Message, duration time.Duration, err error, status DeliveryStatus) {
+	for _, h := range getHooks() {
+		if err != nil {
+			h.OnFailure(msg, err, status)
+		} else {
+			h.AfterSend(msg, duration)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHook adds a header to the mails and sends the mails to
+// route@example.com with its own sender.
+type recordingHook struct {
+	NopHook
+	events  []string
+	sendErr error
+}
+
+func (h *recordingHook) BeforeEnqueue(msg *Message) error {
+	h.events = append(h.events, "enqueue")
+	if msg.GetHeader("Subject")[0] == "Rejected" {
+		return errors.New("rejected")
+	}
+	msg.SetHeader("X-Audit", "1")
+	return nil
+}
+
+func (h *recordingHook) BeforeSend(msg *Message, s Sender) (Sender, error) {
+	h.events = append(h.events, "send")
+	if msg.GetHeader("To")[0] == "route@example.com" {
+		return h, nil
+	}
+	return s, nil
+}
+
+func (h *recordingHook) AfterSend(msg *Message, duration time.Duration) {
+	h.events = append(h.events, "sent")
+}
+
+func (h *recordingHook) OnFailure(msg *Message, err error, status DeliveryStatus) {
+	h.events = append(h.events, "failure "+string(status)+": "+err.Error())
+}
+
+func (h *recordingHook) Send(msg *Message) error {
+	return h.sendErr
+}
+
+func (h *recordingHook) Close() error {
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "dummy",
+	}
+	defer resetSyncSenders()
+
+	h := &recordingHook{sendErr: errors.New("routed")}
+	RegisterHook(h)
+	defer func() { hooks = nil }()
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	_, err := SendSync(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, msg.GetHeader("X-Audit"))
+	assert.Equal(t, []string{"enqueue", "send", "sent"}, h.events)
+
+	h.events = nil
+	_, err = SendSync(context.Background(), NewMessage([]string{"route@example.com"}, "Subject", "Body"))
+	assert.EqualError(t, err, "routed")
+	assert.Equal(t, []string{"enqueue", "send", "failure failed: routed"}, h.events)
+
+	h.events = nil
+	_, err = SendSync(context.Background(), NewMessage([]string{"user@example.com"}, "Rejected", "Body"))
+	assert.EqualError(t, err, "rejected")
+	assert.Equal(t, []string{"enqueue"}, h.events)
+}
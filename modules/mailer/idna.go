@@ -0,0 +1,147 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parameters of Punycode for IDNA (RFC 3492).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycode encodes the label with the Punycode algorithm.
+func punycode(label string) string {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			} else if r == n {
+				q := delta
+				for k := punyBase; ; k += punyBase {
+					t := k - bias
+					if t < punyTMin {
+						t = punyTMin
+					} else if t > punyTMax {
+						t = punyTMax
+					}
+					if q < t {
+						break
+					}
+					out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+					q = (q - t) / (punyBase - t)
+				}
+				out = append(out, punyDigit(q))
+				bias = punyAdapt(delta, h+1, h == b)
+				delta = 0
+				h++
+			}
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+// idnaDomain converts the internationalized domain to its ASCII form, e.g.
+// bücher.example to xn--bcher-kva.example. The labels are only lowercased,
+// the full IDNA mapping is left to the user entering the address.
+func idnaDomain(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			labels[i] = "xn--" + punycode(label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// idnaAddress converts the domain of the address to its ASCII form, so it
+// can be used without SMTPUTF8. Addresses with an internationalized local
+// part that can not be converted are returned unchanged.
+func idnaAddress(addr string) string {
+	if isASCII(addr) {
+		return addr
+	}
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	at := strings.LastIndexByte(parsed.Address, '@')
+	if at < 0 || !isASCII(parsed.Address[:at]) {
+		return addr
+	}
+	parsed.Address = parsed.Address[:at+1] + idnaDomain(parsed.Address[at+1:])
+	if len(parsed.Name) == 0 {
+		return parsed.Address
+	}
+	return parsed.String()
+}
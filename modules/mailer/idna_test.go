@@ -0,0 +1,80 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	gomail "gopkg.in/gomail.v2"
+)
+
+func TestIDNADomain(t *testing.T) {
+	for _, test := range []struct {
+		domain, expected string
+	}{
+		{"example.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"München.de", "xn--mnchen-3ya.de"},
+		{"例子.广告", "xn--fsqu00a.xn--4rr70v"},
+	} {
+		assert.Equal(t, test.expected, idnaDomain(test.domain))
+	}
+
+	assert.Equal(t, "user@xn--bcher-kva.example", idnaAddress("user@bücher.example"))
+	assert.Equal(t, "=?utf-8?q?J=C3=BCrgen?= <user@xn--bcher-kva.example>", idnaAddress("Jürgen <user@bücher.example>"))
+	assert.Equal(t, "jürgen@bücher.example", idnaAddress("jürgen@bücher.example"))
+}
+
+// extensionSender is an SMTP connection offering the extensions.
+type extensionSender struct {
+	gomail.SendFunc
+	ext map[string]bool
+}
+
+func (s *extensionSender) Extension(ext string) (bool, string) {
+	return s.ext[ext], ""
+}
+
+func TestMessage_SendSMTPUTF8(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@bücher.example"}
+
+	msg := NewMessage([]string{"user@bücher.example", "jürgen@example.com"}, "Subject", "Body")
+	assert.Equal(t, []string{"user@xn--bcher-kva.example, jürgen@example.com"}, msg.GetHeader("To"))
+
+	var envelopeFrom string
+	var envelopeTo []string
+	s := &extensionSender{SendFunc: func(from string, to []string, _ io.WriterTo) error {
+		envelopeFrom, envelopeTo = from, to
+		return nil
+	}}
+
+	s.ext = map[string]bool{"SMTPUTF8": true}
+	assert.NoError(t, msg.send(s))
+	assert.Equal(t, "gitea@xn--bcher-kva.example", envelopeFrom)
+	assert.Equal(t, []string{"user@xn--bcher-kva.example", "jürgen@example.com"}, envelopeTo)
+
+	s.ext = nil
+	assert.NoError(t, msg.send(s))
+	assert.Equal(t, []string{"user@xn--bcher-kva.example"}, envelopeTo)
+
+	msg = NewMessage([]string{"jürgen@example.com"}, "Subject", "Body")
+	assert.Error(t, msg.send(s))
+
+	// Sendmail does not report the extensions of the server.
+	assert.NoError(t, msg.send(s.SendFunc))
+	assert.Equal(t, []string{"jürgen@example.com"}, envelopeTo)
+
+	data, err := msg.encode()
+	assert.NoError(t, err)
+	msg, err = decodeMessage(data)
+	assert.NoError(t, err)
+	_, to, err := msg.envelope()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"jürgen@example.com"}, to)
+}
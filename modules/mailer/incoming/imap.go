@@ -0,0 +1,198 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+var imapLiteral = regexp.MustCompile(`\{([0-9]+)\}$`)
+
+// imapClient is a minimal IMAP4rev1 (RFC 3501) client. Processed mails are
+// flagged as seen, or deleted if configured.
+type imapClient struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	tag           int
+	deleteFetched bool
+	expunge       bool
+}
+
+// imapResponse is a response line of the server, with the literals read
+// from it.
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+// imapQuote returns the string as IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func newIMAPClient(conn net.Conn, cfg *setting.IncomingMailer) (*imapClient, error) {
+	c := &imapClient{
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		deleteFetched: cfg.DeleteFetched,
+	}
+
+	greeting, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(greeting.text, "* OK"):
+		if _, err = c.cmd("LOGIN %s %s", imapQuote(cfg.User), imapQuote(cfg.Passwd)); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(greeting.text, "* PREAUTH"):
+	default:
+		return nil, fmt.Errorf("imap: %s", greeting.text)
+	}
+
+	if _, err = c.cmd("SELECT %s", imapQuote(cfg.Mailbox)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readResponse reads a response line, including the literals it contains.
+func (c *imapClient) readResponse() (*imapResponse, error) {
+	resp := new(imapResponse)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.text += line
+
+		match := imapLiteral.FindStringSubmatch(line)
+		if match == nil {
+			return resp, nil
+		}
+		size, _ := strconv.Atoi(match[1])
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+// cmd sends a command and returns the untagged responses to it.
+func (c *imapClient) cmd(format string, args ...interface{}) ([]*imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d ", c.tag)
+	if _, err := fmt.Fprintf(c.conn, tag+format+"\r\n", args...); err != nil {
+		return nil, err
+	}
+
+	var untagged []*imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp.text, tag) {
+			untagged = append(untagged, resp)
+			continue
+		}
+
+		status := resp.text[len(tag):]
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			return nil, fmt.Errorf("imap: %s", status)
+		}
+		return untagged, nil
+	}
+}
+
+// imapFetchItems returns the data items of a FETCH response, or nil if the
+// response is none.
+func imapFetchItems(text string) map[string]string {
+	i := strings.Index(strings.ToUpper(text), " FETCH (")
+	if i < 0 {
+		return nil
+	}
+	fields := strings.Fields(strings.TrimSuffix(text[i+len(" FETCH ("):], ")"))
+	items := make(map[string]string, len(fields)/2)
+	for j := 0; j+1 < len(fields); j += 2 {
+		items[strings.ToUpper(fields[j])] = fields[j+1]
+	}
+	return items
+}
+
+func (c *imapClient) list() ([]message, error) {
+	resps, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, resp := range resps {
+		if fields := strings.Fields(resp.text); len(fields) > 1 && strings.EqualFold(fields[1], "SEARCH") {
+			uids = append(uids, fields[2:]...)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	if resps, err = c.cmd("UID FETCH %s (RFC822.SIZE)", strings.Join(uids, ",")); err != nil {
+		return nil, err
+	}
+	msgs := make([]message, 0, len(uids))
+	for _, resp := range resps {
+		items := imapFetchItems(resp.text)
+		if len(items["UID"]) == 0 {
+			continue
+		}
+		size, _ := strconv.ParseInt(items["RFC822.SIZE"], 10, 64)
+		msgs = append(msgs, message{id: items["UID"], size: size})
+	}
+	return msgs, nil
+}
+
+func (c *imapClient) retrieve(id string) ([]byte, error) {
+	resps, err := c.cmd("UID FETCH %s (BODY.PEEK[])", id)
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range resps {
+		if len(resp.literals) > 0 && imapFetchItems(resp.text)["UID"] == id {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("imap: mail %s not found", id)
+}
+
+func (c *imapClient) done(id string) error {
+	flags := `\Seen`
+	if c.deleteFetched {
+		flags += ` \Deleted`
+		c.expunge = true
+	}
+	_, err := c.cmd("UID STORE %s +FLAGS.SILENT (%s)", id, flags)
+	return err
+}
+
+func (c *imapClient) close() error {
+	defer c.conn.Close()
+	if c.expunge {
+		if _, err := c.cmd("EXPUNGE"); err != nil {
+			return err
+		}
+	}
+	_, err := c.cmd("LOGOUT")
+	return err
+}
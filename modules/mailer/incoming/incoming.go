@@ -0,0 +1,388 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package incoming receives replies to notification mails and creates issue
+// comments from them. Delivery status notifications are recorded as bounces.
+package incoming
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/notification"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/sync"
+)
+
+const fetchIncomingMail = "fetch_incoming_mail"
+
+// fetchTimeout limits how long a single fetch may take, a stalled server
+// must not block the following runs.
+const fetchTimeout = 10 * time.Minute
+
+var statusTable = sync.NewStatusTable()
+
+// ErrRejected represents a mail that is not turned into a comment. Rejected
+// mails are marked as processed and not fetched again.
+type ErrRejected struct {
+	Reason string
+}
+
+// IsErrRejected checks if an error is a ErrRejected.
+func IsErrRejected(err error) bool {
+	_, ok := err.(ErrRejected)
+	return ok
+}
+
+func (err ErrRejected) Error() string {
+	return fmt.Sprintf("mail rejected: %s", err.Reason)
+}
+
+// message identifies a mail in the mailbox.
+type message struct {
+	id   string
+	size int64
+}
+
+// mailbox is a connection to the mailbox replies are delivered to.
+type mailbox interface {
+	// list returns the mails which have not been processed yet.
+	list() ([]message, error)
+	// retrieve returns the raw mail.
+	retrieve(id string) ([]byte, error)
+	// done marks the mail as processed.
+	done(id string) error
+	close() error
+}
+
+func openMailbox(cfg *setting.IncomingMailer) (mailbox, error) {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if cfg.UseTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+			ServerName:         cfg.Host,
+			InsecureSkipVerify: cfg.SkipVerify,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(fetchTimeout))
+
+	var mb mailbox
+	if cfg.Protocol == "pop3" {
+		mb, err = newPOP3Client(conn, cfg)
+	} else {
+		mb, err = newIMAPClient(conn, cfg)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mb, nil
+}
+
+// Fetch fetches the replies to notification mails from the configured
+// mailbox and creates comments from them.
+func Fetch() {
+	if !statusTable.StartIfNotRunning(fetchIncomingMail) {
+		return
+	}
+	defer statusTable.Stop(fetchIncomingMail)
+
+	log.Trace("Doing: FetchIncomingMail")
+
+	if err := fetch(setting.IncomingMail); err != nil {
+		log.Error(4, "FetchIncomingMail: %v", err)
+	}
+}
+
+func fetch(cfg *setting.IncomingMailer) error {
+	mb, err := openMailbox(cfg)
+	if err != nil {
+		return fmt.Errorf("open mailbox: %v", err)
+	}
+	defer mb.close()
+
+	msgs, err := mb.list()
+	if err != nil {
+		return fmt.Errorf("list: %v", err)
+	}
+
+	for _, msg := range msgs {
+		if msg.size > cfg.MaxSize {
+			err = ErrRejected{fmt.Sprintf("size of %d bytes exceeds limit", msg.size)}
+		} else {
+			var raw []byte
+			if raw, err = mb.retrieve(msg.id); err != nil {
+				// Keep the mail to try again later.
+				log.Error(4, "FetchIncomingMail: retrieve %s: %v", msg.id, err)
+				continue
+			}
+			err = handleReply(cfg, raw, nil)
+		}
+
+		if IsErrRejected(err) {
+			log.Trace("FetchIncomingMail [id: %s]: %v", msg.id, err)
+		} else if err != nil {
+			// Keep the mail to try again later.
+			log.Error(4, "FetchIncomingMail [id: %s]: %v", msg.id, err)
+			continue
+		}
+		if err = mb.done(msg.id); err != nil {
+			return fmt.Errorf("done %s: %v", msg.id, err)
+		}
+	}
+	return nil
+}
+
+// handleReply creates a comment from the reply on behalf of the user the
+// reply token belongs to. The envelope recipients, if known, take precedence
+// over the recipients in the header.
+func handleReply(cfg *setting.IncomingMailer, raw []byte, recipients []string) error {
+	m, err := parseMail(raw)
+	if err != nil {
+		return ErrRejected{fmt.Sprintf("parse: %v", err)}
+	}
+	m.Recipients = append(append([]string(nil), recipients...), m.Recipients...)
+
+	for _, addr := range m.Recipients {
+		if messageID, rcpt, ok := mailer.ParseVERPAddress(addr); ok {
+			return handleVERPBounce(m, addr, messageID, rcpt)
+		}
+	}
+	if len(m.DeliveryStatus) > 0 {
+		return handleBounce(m)
+	} else if isAutoReply(m) {
+		return ErrRejected{"automatic reply"}
+	}
+
+	token := replyToken(m, cfg.ReplyToAddress)
+	if len(token) == 0 {
+		return ErrRejected{"no reply token"}
+	}
+	u, issue, err := models.VerifyReplyToken(token)
+	if models.IsErrReplyTokenInvalid(err) {
+		return ErrRejected{err.Error()}
+	} else if err != nil {
+		return fmt.Errorf("VerifyReplyToken: %v", err)
+	}
+
+	if !u.IsActive || u.ProhibitLogin {
+		return ErrRejected{fmt.Sprintf("user %d is not allowed to sign in", u.ID)}
+	}
+	if verified, err := isVerifiedEmail(u, m.From); err != nil {
+		return fmt.Errorf("isVerifiedEmail: %v", err)
+	} else if !verified {
+		return ErrRejected{fmt.Sprintf("sender %s is not a verified address of user %d", m.From, u.ID)}
+	}
+	has, err := models.HasAccess(u.ID, issue.Repo, models.AccessModeRead)
+	if err != nil {
+		return fmt.Errorf("HasAccess: %v", err)
+	} else if !has {
+		return ErrRejected{fmt.Sprintf("user %d has no access to repository %d", u.ID, issue.RepoID)}
+	}
+
+	content := stripQuotedReply(m.Text)
+	allowed := allowedAttachments(m.Attachments)
+	if len(content) == 0 && len(allowed) == 0 {
+		return ErrRejected{"empty reply"}
+	}
+
+	// The mail is fetched again if the comment is not created, so the
+	// attachments are deleted to not store them once more.
+	attachments, err := saveAttachments(allowed)
+	if err != nil {
+		return fmt.Errorf("save attachments: %v", err)
+	}
+	uuids := make([]string, len(attachments))
+	for i, attach := range attachments {
+		uuids[i] = attach.UUID
+	}
+	comment, err := models.CreateIssueComment(u, issue.Repo, issue, content, uuids)
+	if err != nil {
+		if _, delErr := models.DeleteAttachments(attachments, true); delErr != nil {
+			log.Error(4, "DeleteAttachments: %v", delErr)
+		}
+		return fmt.Errorf("CreateIssueComment: %v", err)
+	}
+
+	notification.Service.NotifyIssue(issue, u.ID)
+
+	log.Trace("Comment created by mail: %d/%d/%d", issue.RepoID, issue.ID, comment.ID)
+	return nil
+}
+
+// isVerifiedEmail checks whether the address is one of the activated email
+// addresses of the user, the reply token alone may have been forwarded.
+func isVerifiedEmail(u *models.User, addr string) (bool, error) {
+	emails, err := models.GetEmailAddresses(u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, email := range emails {
+		if email.IsActivated && strings.EqualFold(email.Email, addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handleBounce records the failed deliveries reported by a delivery status
+// notification, which is not sent to a VERP address. Anyone could send such
+// a report, so only the recipients the returned mail was really sent to
+// according to the delivery log are recorded.
+func handleBounce(m *Mail) error {
+	if len(m.OriginalMessageID) == 0 {
+		return ErrRejected{"delivery status without the returned mail"}
+	}
+	bounces, err := mailer.ParseDeliveryStatus(m.DeliveryStatus)
+	if err != nil {
+		return ErrRejected{fmt.Sprintf("parse delivery status: %v", err)}
+	}
+	for _, b := range bounces {
+		if sent, err := models.IsMailDeliveredTo(m.OriginalMessageID, b.Email); err != nil {
+			return fmt.Errorf("IsMailDeliveredTo: %v", err)
+		} else if !sent {
+			log.Trace("Bounce of %s to %s ignored, it was not sent", m.OriginalMessageID, b.Email)
+			continue
+		}
+		if err = models.RecordMailBounce(b); err != nil {
+			return fmt.Errorf("RecordMailBounce: %v", err)
+		}
+	}
+	return nil
+}
+
+// handleVERPBounce records the bounce of the message to the recipient, which
+// are known from the VERP address the bounce was sent to. The status is taken
+// from the delivery status notification if there is one, other mails to the
+// address are taken as permanent failures unless they are automatic replies.
+// If the address only contains the hash of the recipient, the recipient is
+// taken from the report and the message from the returned mail.
+func handleVERPBounce(m *Mail, verpAddr, messageID, rcpt string) error {
+	if len(messageID) == 0 {
+		messageID = m.OriginalMessageID
+	}
+	b := &mailer.Bounce{Email: rcpt, Reason: m.Subject, Permanent: true}
+	if len(m.DeliveryStatus) > 0 {
+		bounces, err := mailer.ParseDeliveryStatus(m.DeliveryStatus)
+		if err != nil {
+			return ErrRejected{fmt.Sprintf("parse delivery status: %v", err)}
+		} else if len(bounces) == 0 {
+			// Successful deliveries may be reported as well.
+			return nil
+		}
+		// The recipient in the report may be rewritten, e.g. by a forwarding.
+		reported := bounces[0]
+		if len(rcpt) == 0 {
+			for _, bounce := range bounces {
+				if mailer.IsVERPRecipient(verpAddr, bounce.Email) {
+					b.Email, reported = bounce.Email, bounce
+					break
+				}
+			}
+		}
+		b.Status, b.Reason, b.Permanent = reported.Status, reported.Reason, reported.Permanent
+	} else if isAutoReply(m) {
+		return ErrRejected{"automatic reply"}
+	}
+	if len(b.Email) == 0 {
+		return ErrRejected{"recipient of the bounce is unknown"}
+	}
+	rcpt = b.Email
+
+	if setting.MailService.DeliveryLog {
+		status := mailer.DeliveryDeferred
+		if b.Permanent {
+			status = mailer.DeliveryBounced
+		}
+		if err := models.RecordMailDelivery(&mailer.Delivery{
+			MessageID:  messageID,
+			Recipients: []string{rcpt},
+			Backend:    "verp",
+			Error:      strings.TrimSpace(b.Status + " " + b.Reason),
+			Status:     status,
+		}); err != nil {
+			return fmt.Errorf("RecordMailDelivery: %v", err)
+		}
+	}
+	if err := models.RecordMailBounce(b); err != nil {
+		return fmt.Errorf("RecordMailBounce: %v", err)
+	}
+	log.Trace("Mail bounce of %s to %s recorded", messageID, rcpt)
+	return nil
+}
+
+// noFile is an empty multipart.File, the data of the attachments is passed
+// as buffer.
+type noFile struct {
+	*strings.Reader
+}
+
+func (noFile) Close() error {
+	return nil
+}
+
+// allowedAttachments returns the attachments of the reply which satisfy
+// the attachment settings.
+func allowedAttachments(attachments []*Attachment) []*Attachment {
+	if !setting.AttachmentEnabled {
+		return nil
+	}
+
+	allowedTypes := strings.Split(setting.AttachmentAllowedTypes, ",")
+	allowed := make([]*Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		if len(allowed) >= setting.AttachmentMaxFiles {
+			break
+		}
+
+		fileType := http.DetectContentType(a.Data)
+		isAllowed := false
+		for _, t := range allowedTypes {
+			t := strings.Trim(t, " ")
+			if t == "*/*" || t == fileType {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed || int64(len(a.Data)) > setting.AttachmentMaxSize<<20 {
+			log.Trace("FetchIncomingMail: attachment %q of type %s skipped", a.Name, fileType)
+			continue
+		}
+		allowed = append(allowed, a)
+	}
+	return allowed
+}
+
+// saveAttachments stores the attachments. The attachments stored before
+// are deleted if one of them cannot be stored.
+func saveAttachments(attachments []*Attachment) ([]*models.Attachment, error) {
+	saved := make([]*models.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		attach, err := models.NewAttachment(a.Name, a.Data, noFile{strings.NewReader("")})
+		if err != nil {
+			if _, delErr := models.DeleteAttachments(saved, true); delErr != nil {
+				log.Error(4, "DeleteAttachments: %v", delErr)
+			}
+			return nil, err
+		}
+		saved = append(saved, attach)
+	}
+	return saved, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// commandTimeout is how long the listener waits for the next command.
+const commandTimeout = 5 * time.Minute
+
+// maxAcceptDelay limits the wait after temporary errors accepting connections.
+const maxAcceptDelay = time.Second
+
+// server receives replies from the mail server over LMTP (RFC 2033) or
+// SMTP and passes them to the same processing as fetched replies.
+type server struct {
+	lmtp    bool
+	maxSize int64
+	// handle processes the mail for one envelope recipient.
+	handle func(raw []byte, rcpt string) error
+}
+
+// Listen starts the LMTP or SMTP listener for replies on given address,
+// which is a unix socket if it is a path.
+func Listen(addr string) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		// Remove the socket left by the last run, but no other file.
+		if fi, err := os.Lstat(addr); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				log.Fatal(4, "Failed to start incoming mail server: %s exists and is not a socket", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Fatal(4, "Failed to start incoming mail server: %v", err)
+	}
+	if network == "unix" {
+		// Only the mail server, which shares the group, may connect.
+		if err = os.Chmod(addr, 0660); err != nil {
+			log.Fatal(4, "Failed to set the mode of the incoming mail socket: %v", err)
+		}
+	}
+
+	cfg := setting.IncomingMail
+	s := &server{
+		lmtp:    cfg.Protocol == "lmtp",
+		maxSize: cfg.MaxSize,
+		handle: func(raw []byte, rcpt string) error {
+			return handleReply(cfg, raw, []string{rcpt})
+		},
+	}
+	go s.serve(l)
+}
+
+// serve accepts the connections of the listener until it is closed. Like
+// net/http it backs off after temporary errors, e.g. too many open files.
+func (s *server) serve(l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Error(3, "Incoming mail: Error accepting connection: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Error(3, "Incoming mail: Error accepting connection: %v", err)
+			return
+		}
+		delay = 0
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn handles the session of a client. Only the commands required by
+// the protocol are implemented, the client is trusted to be the mail server.
+func (s *server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	hello, name := "EHLO", "ESMTP"
+	if s.lmtp {
+		hello, name = "LHLO", "LMTP"
+	}
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 %s %s Gitea", setting.Domain, name)
+
+	var inTransaction bool
+	var rcpts []string
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch verb = strings.ToUpper(verb); {
+		case verb == hello:
+			text.PrintfLine("250-%s", setting.Domain)
+			text.PrintfLine("250-8BITMIME")
+			text.PrintfLine("250-ENHANCEDSTATUSCODES")
+			text.PrintfLine("250 SIZE %d", s.maxSize)
+		case verb == "HELO" && !s.lmtp:
+			text.PrintfLine("250 %s", setting.Domain)
+		case verb == "MAIL":
+			if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+				text.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			inTransaction, rcpts = true, nil
+			text.PrintfLine("250 2.1.0 OK")
+		case verb == "RCPT":
+			if !inTransaction {
+				text.PrintfLine("503 5.5.1 Need MAIL command")
+				continue
+			}
+			rcpt, ok := parsePath(arg, "TO:")
+			if !ok {
+				text.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			rcpts = append(rcpts, rcpt)
+			text.PrintfLine("250 2.1.5 OK")
+		case verb == "DATA":
+			if len(rcpts) == 0 {
+				text.PrintfLine("503 5.5.1 Need RCPT command")
+				continue
+			}
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			s.deliver(text, rcpts)
+			inTransaction, rcpts = false, nil
+		case verb == "RSET":
+			inTransaction, rcpts = false, nil
+			text.PrintfLine("250 2.0.0 OK")
+		case verb == "NOOP":
+			text.PrintfLine("250 2.0.0 OK")
+		case verb == "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("502 5.5.2 Command not implemented")
+		}
+	}
+}
+
+// parsePath returns the address of a MAIL or RCPT argument like TO:<address>.
+func parsePath(arg, prefix string) (string, bool) {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(arg, '>')
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+// deliver reads the mail and processes it for every recipient. LMTP replies
+// with the status of each recipient, SMTP with the worst of them.
+func (s *server) deliver(text *textproto.Conn, rcpts []string) {
+	dr := text.DotReader()
+	raw, err := ioutil.ReadAll(io.LimitReader(dr, s.maxSize+1))
+	if err != nil {
+		log.Error(4, "Incoming mail: Error reading mail: %v", err)
+		s.reply(text, rcpts, 451, "4.3.0 Error reading mail, try again later")
+		return
+	}
+	tooBig := int64(len(raw)) > s.maxSize
+	if tooBig {
+		io.Copy(ioutil.Discard, dr)
+	}
+
+	var code int
+	var status string
+	for _, rcpt := range rcpts {
+		rcptCode, rcptStatus := 552, "5.3.4 Message too big"
+		if !tooBig {
+			rcptCode, rcptStatus = s.deliverTo(raw, rcpt)
+		}
+		if s.lmtp {
+			text.PrintfLine("%d %s", rcptCode, rcptStatus)
+		} else if code == 0 || rcptCode/100 == 4 || (rcptCode/100 == 5 && code/100 == 2) {
+			code, status = rcptCode, rcptStatus
+		}
+	}
+	if !s.lmtp {
+		text.PrintfLine("%d %s", code, status)
+	}
+}
+
+// reply sends the same reply for all recipients, which is one line for SMTP
+// and one per recipient for LMTP.
+func (s *server) reply(text *textproto.Conn, rcpts []string, code int, status string) {
+	n := 1
+	if s.lmtp {
+		n = len(rcpts)
+	}
+	for i := 0; i < n; i++ {
+		text.PrintfLine("%d %s", code, status)
+	}
+}
+
+func (s *server) deliverTo(raw []byte, rcpt string) (int, string) {
+	err := s.handle(raw, rcpt)
+	if IsErrRejected(err) {
+		log.Trace("Incoming mail [rcpt: %s]: %v", rcpt, err)
+		return 550, "5.7.1 " + err.Error()
+	} else if err != nil {
+		log.Error(4, "Incoming mail [rcpt: %s]: %v", rcpt, err)
+		return 451, "4.3.0 Temporary failure, try again later"
+	}
+	return 250, "2.0.0 OK"
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSession sends the commands to the server and returns its responses.
+func testSession(t *testing.T, s *server, commands ...string) []string {
+	client, conn := net.Pipe()
+	go s.serveConn(conn)
+
+	text := textproto.NewConn(client)
+	defer text.Close()
+
+	var responses []string
+	readResponse := func() {
+		for {
+			line, err := text.ReadLine()
+			if !assert.NoError(t, err) {
+				return
+			}
+			responses = append(responses, line)
+			if len(line) < 4 || line[3] != '-' {
+				return
+			}
+		}
+	}
+
+	readResponse()
+	var rcpts int
+	for _, cmd := range commands {
+		text.PrintfLine("%s", cmd)
+		readResponse()
+		switch {
+		case strings.HasPrefix(cmd, "RCPT") && strings.HasPrefix(responses[len(responses)-1], "250"):
+			rcpts++
+		case cmd == "DATA":
+			w := text.DotWriter()
+			w.Write([]byte(testMail))
+			w.Close()
+			// LMTP replies for every recipient.
+			for i := 0; i < rcpts && (i == 0 || s.lmtp); i++ {
+				readResponse()
+			}
+			rcpts = 0
+		}
+	}
+	return responses
+}
+
+func testServer(lmtp bool, received map[string]string) *server {
+	return &server{
+		lmtp:    lmtp,
+		maxSize: 1024,
+		handle: func(raw []byte, rcpt string) error {
+			received[rcpt] = string(raw)
+			switch {
+			case strings.HasPrefix(rcpt, "rejected"):
+				return ErrRejected{"test"}
+			case strings.HasPrefix(rcpt, "failed"):
+				return errors.New("test")
+			}
+			return nil
+		},
+	}
+}
+
+func TestServer_LMTP(t *testing.T) {
+	received := make(map[string]string)
+	responses := testSession(t, testServer(true, received),
+		"LHLO localhost",
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<reply@example.com>",
+		"RCPT TO:<rejected@example.com> NOTIFY=NEVER",
+		"RCPT TO:<failed@example.com>",
+		"DATA",
+		"RCPT TO:<reply@example.com>",
+		"QUIT",
+	)
+
+	assert.Len(t, responses, 15)
+	assert.Equal(t, "250 SIZE 1024", responses[4])
+	assert.Equal(t, []string{
+		"354 End data with <CR><LF>.<CR><LF>",
+		"250 2.0.0 OK",
+		"550 5.7.1 mail rejected: test",
+		"451 4.3.0 Temporary failure, try again later",
+		"503 5.5.1 Need MAIL command",
+		"221 2.0.0 Bye",
+	}, responses[9:])
+
+	assert.Len(t, received, 3)
+	assert.Equal(t, strings.Replace(testMail, "\r\n", "\n", -1), received["reply@example.com"])
+}
+
+func TestServer_SMTP(t *testing.T) {
+	received := make(map[string]string)
+	s := testServer(false, received)
+
+	responses := testSession(t, s,
+		"HELO localhost",
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<reply@example.com>",
+		"RCPT TO:<rejected@example.com>",
+		"DATA",
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<reply@example.com>",
+		"DATA",
+	)
+	assert.Equal(t, []string{
+		"354 End data with <CR><LF>.<CR><LF>",
+		"550 5.7.1 mail rejected: test",
+		"250 2.1.0 OK",
+		"250 2.1.5 OK",
+		"354 End data with <CR><LF>.<CR><LF>",
+		"250 2.0.0 OK",
+	}, responses[5:])
+
+	s.maxSize = 8
+	responses = testSession(t, s,
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<reply@example.com>",
+		"DATA",
+		"NOOP",
+	)
+	assert.Equal(t, []string{"552 5.3.4 Message too big", "250 2.0.0 OK"}, responses[4:])
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// errorListener returns the errors from Accept.
+type errorListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errorListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestServer_Serve(t *testing.T) {
+	// Temporary errors are retried, others stop the listener.
+	l := &errorListener{errs: []error{temporaryError{}, temporaryError{}, errors.New("closed")}}
+	testServer(false, nil).serve(l)
+	assert.Empty(t, l.errs)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMail = "Subject: Re: Test\r\n\r\nThanks\r\n.dot\r\n"
+
+// serveTestPOP3 replies to the commands of a client on the connection.
+func serveTestPOP3(conn net.Conn, commands *[]string) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("+OK POP3 ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		*commands = append(*commands, line)
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "USER", "PASS", "DELE":
+			text.PrintfLine("+OK")
+		case "LIST":
+			text.PrintfLine("+OK 1 messages")
+			w := text.DotWriter()
+			w.Write([]byte("1 24\r\n"))
+			w.Close()
+		case "RETR":
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			w.Write([]byte(testMail))
+			w.Close()
+		case "QUIT":
+			text.PrintfLine("+OK Bye")
+			return
+		default:
+			text.PrintfLine("-ERR Unknown command")
+		}
+	}
+}
+
+// serveTestIMAP replies to the commands of a client on the connection.
+func serveTestIMAP(conn net.Conn, commands *[]string) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("* OK IMAP4rev1 ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		*commands = append(*commands, line)
+		fields := strings.SplitN(line, " ", 2)
+		tag, cmd := fields[0], fields[1]
+		switch {
+		case strings.HasPrefix(cmd, "LOGIN"), strings.HasPrefix(cmd, "SELECT"),
+			strings.HasPrefix(cmd, "UID STORE"), cmd == "EXPUNGE":
+		case cmd == "UID SEARCH UNSEEN":
+			text.PrintfLine("* SEARCH 7")
+		case cmd == "UID FETCH 7 (RFC822.SIZE)":
+			text.PrintfLine("* 1 FETCH (UID 7 RFC822.SIZE 24)")
+		case cmd == "UID FETCH 7 (BODY.PEEK[])":
+			text.PrintfLine("* 1 FETCH (UID 7 BODY[] {%d}", len(testMail))
+			text.W.WriteString(testMail)
+			text.PrintfLine(")")
+		case cmd == "LOGOUT":
+			text.PrintfLine("* BYE")
+			text.PrintfLine("%s OK", tag)
+			return
+		default:
+			text.PrintfLine("%s BAD Unknown command", tag)
+			continue
+		}
+		text.PrintfLine("%s OK", tag)
+	}
+}
+
+func testMailbox(t *testing.T, mb mailbox) {
+	msgs, err := mb.list()
+	assert.NoError(t, err)
+	if !assert.Len(t, msgs, 1) {
+		return
+	}
+	assert.EqualValues(t, 24, msgs[0].size)
+
+	raw, err := mb.retrieve(msgs[0].id)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Replace(testMail, "\r\n", "\n", -1), strings.Replace(string(raw), "\r\n", "\n", -1))
+
+	assert.NoError(t, mb.done(msgs[0].id))
+	assert.NoError(t, mb.close())
+}
+
+func TestPOP3Client(t *testing.T) {
+	client, server := net.Pipe()
+	var commands []string
+	done := make(chan struct{})
+	go func() {
+		serveTestPOP3(server, &commands)
+		close(done)
+	}()
+
+	mb, err := newPOP3Client(client, &setting.IncomingMailer{User: "user", Passwd: "secret"})
+	if assert.NoError(t, err) {
+		testMailbox(t, mb)
+	}
+	<-done
+	assert.Equal(t, []string{"USER user", "PASS secret", "LIST", "RETR 1", "DELE 1", "QUIT"}, commands)
+}
+
+func TestIMAPClient(t *testing.T) {
+	for _, deleteFetched := range []bool{false, true} {
+		client, server := net.Pipe()
+		var commands []string
+		done := make(chan struct{})
+		go func() {
+			serveTestIMAP(server, &commands)
+			close(done)
+		}()
+
+		mb, err := newIMAPClient(client, &setting.IncomingMailer{
+			User:          "user",
+			Passwd:        `se"cret`,
+			Mailbox:       "INBOX",
+			DeleteFetched: deleteFetched,
+		})
+		if assert.NoError(t, err) {
+			testMailbox(t, mb)
+		}
+		<-done
+
+		expected := []string{
+			`a1 LOGIN "user" "se\"cret"`,
+			`a2 SELECT "INBOX"`,
+			`a3 UID SEARCH UNSEEN`,
+			`a4 UID FETCH 7 (RFC822.SIZE)`,
+			`a5 UID FETCH 7 (BODY.PEEK[])`,
+		}
+		if deleteFetched {
+			expected = append(expected, `a6 UID STORE 7 +FLAGS.SILENT (\Seen \Deleted)`, `a7 EXPUNGE`, `a8 LOGOUT`)
+		} else {
+			expected = append(expected, `a6 UID STORE 7 +FLAGS.SILENT (\Seen)`, `a7 LOGOUT`)
+		}
+		assert.Equal(t, expected, commands)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+	"golang.org/x/net/html/charset"
+)
+
+// Mail is a parsed incoming mail.
+type Mail struct {
+	Header mail.Header
+	From   string
+	// Recipients are the addresses the mail was delivered to.
+	Recipients  []string
+	Subject     string
+	Text        string // Plain text body, converted from HTML if there is none
+	HTML        string
+	Attachments []*Attachment
+	// DeliveryStatus is the report of a delivery status notification.
+	DeliveryStatus []byte
+	// OriginalMessageID is the Message-ID of the mail returned with a
+	// delivery status notification.
+	OriginalMessageID string
+}
+
+// Attachment is a file attached to an incoming mail.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// parseMail parses the raw mail and decodes its body and attachments.
+func parseMail(raw []byte) (*Mail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mail{
+		Header:  msg.Header,
+		Subject: decodeHeader(msg.Header.Get("Subject")),
+	}
+
+	parser := &mail.AddressParser{WordDecoder: wordDecoder}
+	if from, err := parser.Parse(msg.Header.Get("From")); err == nil {
+		m.From = from.Address
+	}
+	for _, key := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+		for _, value := range msg.Header[key] {
+			addrs, err := parser.ParseList(value)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				m.Recipients = append(m.Recipients, addr.Address)
+			}
+		}
+	}
+
+	if err = m.parsePart(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return nil, err
+	}
+	if len(m.Text) == 0 && len(m.HTML) > 0 {
+		if m.Text, err = html2text.FromString(m.HTML); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parsePart walks the MIME parts and collects the first plain text and HTML
+// bodies, other parts are treated as attachments.
+func (m *Mail) parsePart(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err = m.parsePart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Parts of a multipart body are decoded from quoted-printable already.
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case "message/delivery-status", "message/global-delivery-status":
+		m.DeliveryStatus = data
+		return nil
+	case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+		// The mail returned with a bounce, or its header only, which may lack
+		// the empty line.
+		if len(m.OriginalMessageID) == 0 {
+			if returned, err := mail.ReadMessage(bytes.NewReader(append(data, "\r\n\r\n"...))); err == nil {
+				m.OriginalMessageID = strings.TrimSpace(returned.Header.Get("Message-ID"))
+			}
+		}
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition != "attachment" && (mediaType == "text/plain" || mediaType == "text/html") {
+		text := decodeCharset(params["charset"], data)
+		if mediaType == "text/plain" && len(m.Text) == 0 {
+			m.Text = text
+		} else if mediaType == "text/html" && len(m.HTML) == 0 {
+			m.HTML = text
+		}
+		return nil
+	}
+
+	name := dispParams["filename"]
+	if len(name) == 0 {
+		name = params["name"]
+	}
+	// Unnamed parts are decoration like signatures or calendar data.
+	if name = path.Base(decodeHeader(name)); name == "." || name == "/" {
+		return nil
+	}
+	m.Attachments = append(m.Attachments, &Attachment{
+		Name:        name,
+		ContentType: mediaType,
+		Data:        data,
+	})
+	return nil
+}
+
+// decodeCharset converts the text of given charset to UTF-8.
+func decodeCharset(label string, data []byte) string {
+	if len(label) == 0 {
+		return string(data)
+	}
+	r, err := charset.NewReaderLabel(label, bytes.NewReader(data))
+	if err != nil {
+		return string(data)
+	}
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return string(data)
+	}
+	return string(text)
+}
+
+// isAutoReply checks if the mail is an automatic reply, like an out of
+// office notice or a bounce, which must not be turned into a comment.
+func isAutoReply(m *Mail) bool {
+	if submitted := strings.ToLower(m.Header.Get("Auto-Submitted")); len(submitted) > 0 && submitted != "no" {
+		return true
+	}
+	switch strings.ToLower(m.Header.Get("Precedence")) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return len(m.Header.Get("X-Autoreply")) > 0 || len(m.Header.Get("X-Autorespond")) > 0 ||
+		strings.TrimSpace(m.Header.Get("Return-Path")) == "<>"
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// pop3Client is a minimal POP3 (RFC 1939) client. POP3 has no flags to mark
+// mails as seen, processed mails are always deleted.
+type pop3Client struct {
+	text *textproto.Conn
+}
+
+func newPOP3Client(conn net.Conn, cfg *setting.IncomingMailer) (*pop3Client, error) {
+	c := &pop3Client{text: textproto.NewConn(conn)}
+	if _, err := c.readStatus(); err != nil {
+		return nil, err
+	}
+	if _, err := c.cmd("USER %s", cfg.User); err != nil {
+		return nil, err
+	}
+	if _, err := c.cmd("PASS %s", cfg.Passwd); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pop3Client) readStatus() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	} else if !strings.HasPrefix(line, "+OK") {
+		return "", fmt.Errorf("pop3: %s", line)
+	}
+	return strings.TrimSpace(line[3:]), nil
+}
+
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readStatus()
+}
+
+func (c *pop3Client) list() ([]message, error) {
+	if _, err := c.cmd("LIST"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]message, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("pop3: invalid scan listing: %s", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("pop3: invalid scan listing: %s", line)
+		}
+		msgs = append(msgs, message{id: fields[0], size: size})
+	}
+	return msgs, nil
+}
+
+func (c *pop3Client) retrieve(id string) ([]byte, error) {
+	if _, err := c.cmd("RETR %s", id); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+func (c *pop3Client) done(id string) error {
+	_, err := c.cmd("DELE %s", id)
+	return err
+}
+
+// close ends the session, the server only deletes the mails if it does so
+// properly.
+func (c *pop3Client) close() error {
+	_, err := c.cmd("QUIT")
+	c.text.Close()
+	return err
+}
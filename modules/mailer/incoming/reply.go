@@ -0,0 +1,54 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"regexp"
+	"strings"
+)
+
+// quoteHeaderPattern matches the lines mail clients put above the quoted mail.
+var quoteHeaderPattern = regexp.MustCompile(`^(On\s.+\swrote:|-+\s*Original Message\s*-+|_{20,})$`)
+
+// replyToken returns the reply token of the mail, taken from the address it
+// was sent to. The quoted notification is not searched for a token, anyone
+// the notification is forwarded to could reply with it.
+func replyToken(m *Mail, replyToAddress string) string {
+	i := strings.Index(replyToAddress, "%{token}")
+	prefix := strings.ToLower(replyToAddress[:i])
+	suffix := strings.ToLower(replyToAddress[i+len("%{token}"):])
+	for _, addr := range m.Recipients {
+		addr = strings.ToLower(addr)
+		if len(addr) > len(prefix)+len(suffix) && strings.HasPrefix(addr, prefix) && strings.HasSuffix(addr, suffix) {
+			return addr[len(prefix) : len(addr)-len(suffix)]
+		}
+	}
+	return ""
+}
+
+// stripQuotedReply returns the text of a reply without the quoted mail and
+// the signature of the sender. Quotes in between the text are kept, they are
+// part of an inline reply.
+func stripQuotedReply(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		// Some clients wrap the line of the quote header.
+		if line == "-- " || quoteHeaderPattern.MatchString(trimmed) ||
+			(strings.HasPrefix(trimmed, "On ") && i+1 < len(lines) && strings.HasSuffix(strings.TrimSpace(lines[i+1]), " wrote:")) {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	for len(lines) > 0 {
+		last := strings.TrimSpace(lines[len(lines)-1])
+		if len(last) > 0 && !strings.HasPrefix(last, ">") {
+			break
+		}
+		lines = lines[:len(lines)-1]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
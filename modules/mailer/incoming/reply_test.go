@@ -0,0 +1,158 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripQuotedReply(t *testing.T) {
+	for _, test := range []struct {
+		text, expected string
+	}{
+		{"Thanks, fixed.\r\n\r\nOn Mon, Jan 2, 2017 at 10:00 AM, Gitea <gitea@example.com> wrote:\r\n> Please fix\r\n", "Thanks, fixed."},
+		{"Thanks, fixed.\n\nOn Mon, Jan 2, 2017 at 10:00 AM, Gitea\n<gitea@example.com> wrote:\n> Please fix\n", "Thanks, fixed."},
+		{"Thanks\n\n-----Original Message-----\nFrom: Gitea\n", "Thanks"},
+		{"Thanks\n-- \nJohn Doe\nExample Inc.\n", "Thanks"},
+		{"> Does it work?\nYes.\n> And on Windows?\nNo.\n\n> Regards\n", "> Does it work?\nYes.\n> And on Windows?\nNo."},
+		{"> only a quote\n", ""},
+	} {
+		assert.Equal(t, test.expected, stripQuotedReply(test.text))
+	}
+}
+
+func TestReplyToken(t *testing.T) {
+	const replyTo = "incoming+%{token}@example.com"
+
+	m := &Mail{Recipients: []string{"someone@example.com", "Incoming+1.2.ABCDEF@example.com"}}
+	assert.Equal(t, "1.2.abcdef", replyToken(m, replyTo))
+
+	// Tokens in the quoted notification are not taken.
+	m = &Mail{
+		Recipients: []string{"incoming@example.com"},
+		Text:       "> Reply to this mail: incoming+1.2.abcdef@example.com",
+	}
+	assert.Empty(t, replyToken(m, replyTo))
+
+	m = &Mail{
+		Recipients: []string{"incoming+@example.com"},
+		Text:       "no token",
+	}
+	assert.Empty(t, replyToken(m, replyTo))
+}
+
+func TestParseMail(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: =?UTF-8?Q?J=C3=BCrgen?= <juergen@example.com>",
+		"To: incoming+1.2.abcdef@example.com",
+		"Cc: other@example.com",
+		"Subject: =?ISO-8859-1?Q?Re:_Gr=FC=DFe?=",
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: multipart/alternative; boundary=inner",
+		"",
+		"--inner",
+		"Content-Type: text/plain; charset=ISO-8859-1",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Gr=FC=DFe",
+		"--inner",
+		"Content-Type: text/html; charset=UTF-8",
+		"",
+		"<p>Grüße</p>",
+		"--inner--",
+		"--outer",
+		"Content-Type: image/png; name=\"../screen.png\"",
+		"Content-Disposition: attachment",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"iVBORw0KGgo=",
+		"--outer",
+		"Content-Type: application/pgp-signature",
+		"",
+		"signature",
+		"--outer--",
+		"",
+	}, "\r\n")
+
+	m, err := parseMail([]byte(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, "juergen@example.com", m.From)
+	assert.Equal(t, []string{"incoming+1.2.abcdef@example.com", "other@example.com"}, m.Recipients)
+	assert.Equal(t, "Re: Grüße", m.Subject)
+	assert.Equal(t, "Grüße", m.Text)
+	assert.Equal(t, "<p>Grüße</p>", m.HTML)
+	if assert.Len(t, m.Attachments, 1) {
+		assert.Equal(t, "screen.png", m.Attachments[0].Name)
+		assert.Equal(t, "image/png", m.Attachments[0].ContentType)
+		assert.Equal(t, []byte("\x89PNG\r\n\x1a\n"), m.Attachments[0].Data)
+	}
+	assert.False(t, isAutoReply(m))
+
+	m, err = parseMail([]byte("Auto-Submitted: auto-replied\r\nContent-Type: text/html\r\n\r\n<p>Out of <b>office</b></p>"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Out of *office*", m.Text)
+	assert.True(t, isAutoReply(m))
+}
+
+func TestParseMail_DeliveryStatus(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: MAILER-DAEMON@example.com",
+		"Auto-Submitted: auto-replied",
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=report",
+		"",
+		"--report",
+		"Content-Type: text/plain",
+		"",
+		"Delivery failed.",
+		"--report",
+		"Content-Type: message/delivery-status",
+		"",
+		"Reporting-MTA: dns; mx.example.com",
+		"",
+		"Final-Recipient: rfc822; unknown@example.com",
+		"Action: failed",
+		"Status: 5.1.1",
+		"--report",
+		"Content-Type: text/rfc822-headers",
+		"",
+		"Message-ID: <1500000000.abcdef@example.com>",
+		"Subject: Notification",
+		"--report--",
+		"",
+	}, "\r\n")
+
+	m, err := parseMail([]byte(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, "Delivery failed.", m.Text)
+	assert.Contains(t, string(m.DeliveryStatus), "Final-Recipient: rfc822; unknown@example.com")
+	assert.Equal(t, "<1500000000.abcdef@example.com>", m.OriginalMessageID)
+	assert.Empty(t, m.Attachments)
+}
+
+func TestAllowedAttachments(t *testing.T) {
+	defer func(enabled bool, types string, maxFiles int, maxSize int64) {
+		setting.AttachmentEnabled, setting.AttachmentAllowedTypes = enabled, types
+		setting.AttachmentMaxFiles, setting.AttachmentMaxSize = maxFiles, maxSize
+	}(setting.AttachmentEnabled, setting.AttachmentAllowedTypes, setting.AttachmentMaxFiles, setting.AttachmentMaxSize)
+
+	png := &Attachment{Name: "screen.png", Data: []byte("\x89PNG\r\n\x1a\n")}
+	text := &Attachment{Name: "notes.txt", Data: []byte("notes")}
+	attachments := []*Attachment{text, png, png}
+
+	setting.AttachmentEnabled = false
+	assert.Empty(t, allowedAttachments(attachments))
+
+	setting.AttachmentEnabled = true
+	setting.AttachmentAllowedTypes = "image/jpeg, image/png"
+	setting.AttachmentMaxFiles, setting.AttachmentMaxSize = 1, 1
+	assert.Equal(t, []*Attachment{png}, allowedAttachments(attachments))
+}
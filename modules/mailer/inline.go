@@ -0,0 +1,326 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// cssRule is a rule of a style sheet with a single selector.
+type cssRule struct {
+	selector    cascadia.Selector
+	specificity int
+	order       int
+	decls       []cssDeclaration
+}
+
+// cssDeclaration is a property of a rule or style attribute.
+type cssDeclaration struct {
+	property  string
+	value     string
+	important bool
+}
+
+// cssMatch is a declaration applying to an element with the precedence of
+// its rule.
+type cssMatch struct {
+	cssDeclaration
+	specificity int
+	order       int
+}
+
+var cssCommentPattern = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// inlineCSS moves the rules of the style sheets of the HTML body into the
+// style attributes of the elements they apply to, since most mail clients
+// ignore style elements. Rules which can not be inlined, like @media rules
+// or those for :hover, are kept in a style element in the head.
+func inlineCSS(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	var styles []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+			styles = append(styles, n)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if len(styles) == 0 {
+		return body, nil
+	}
+
+	var rules []*cssRule
+	var kept []string
+	for _, style := range styles {
+		var sheet bytes.Buffer
+		for c := style.FirstChild; c != nil; c = c.NextSibling {
+			sheet.WriteString(c.Data)
+		}
+		sheetRules, sheetKept := parseStyleSheet(sheet.String(), len(rules))
+		rules = append(rules, sheetRules...)
+		kept = append(kept, sheetKept...)
+		style.Parent.RemoveChild(style)
+	}
+
+	matches := make(map[*html.Node][]cssMatch)
+	for _, rule := range rules {
+		for _, n := range rule.selector.MatchAll(doc) {
+			for _, decl := range rule.decls {
+				matches[n] = append(matches[n], cssMatch{decl, rule.specificity, rule.order})
+			}
+		}
+	}
+	for n, m := range matches {
+		applyCSS(n, m)
+	}
+
+	if len(kept) > 0 {
+		if head := findElement(doc, atom.Head); head != nil {
+			style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+			style.AppendChild(&html.Node{Type: html.TextNode, Data: strings.Join(kept, "\n")})
+			head.AppendChild(style)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// parseStyleSheet returns the rules of the style sheet which can be inlined,
+// numbered from order on, and the text of the others.
+func parseStyleSheet(sheet string, order int) (rules []*cssRule, kept []string) {
+	sheet = cssCommentPattern.ReplaceAllString(sheet, "")
+	for len(strings.TrimSpace(sheet)) > 0 {
+		sheet = strings.TrimSpace(sheet)
+		open := strings.IndexByte(sheet, '{')
+		if strings.HasPrefix(sheet, "@") {
+			// Statements like @import end with a semicolon, blocks are kept as is.
+			if semi := strings.IndexByte(sheet, ';'); semi >= 0 && (open < 0 || semi < open) {
+				kept = append(kept, sheet[:semi+1])
+				sheet = sheet[semi+1:]
+				continue
+			}
+		}
+		if open < 0 {
+			break
+		}
+		prelude, rest := strings.TrimSpace(sheet[:open]), sheet[open+1:]
+		end := cssBlockEnd(rest)
+		block := rest[:end]
+		text := prelude + " {" + block + "}"
+		if sheet = ""; end < len(rest) {
+			sheet = rest[end+1:]
+		}
+
+		if strings.HasPrefix(prelude, "@") {
+			kept = append(kept, text)
+			continue
+		}
+		decls := parseDeclarations(block)
+		var uninlined []string
+		for _, sel := range splitCSS(prelude, ',') {
+			sel = strings.TrimSpace(sel)
+			if len(sel) == 0 {
+				continue
+			}
+			compiled, err := cascadia.Compile(sel)
+			if err != nil || strings.Contains(sel, "::") || cssDynamicPseudoPattern.MatchString(sel) {
+				uninlined = append(uninlined, sel)
+				continue
+			}
+			rules = append(rules, &cssRule{
+				selector:    compiled,
+				specificity: cssSpecificity(sel),
+				order:       order,
+				decls:       decls,
+			})
+			order++
+		}
+		if len(uninlined) > 0 {
+			kept = append(kept, strings.Join(uninlined, ", ")+" {"+block+"}")
+		}
+	}
+	return rules, kept
+}
+
+// cssDynamicPseudoPattern matches the pseudo-classes which depend on the
+// interaction with the document.
+var cssDynamicPseudoPattern = regexp.MustCompile(`:(hover|active|focus|visited|link|target|before|after|first-line|first-letter)\b`)
+
+// cssBlockEnd returns the index of the brace closing the block, which
+// may contain nested blocks.
+func cssBlockEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return len(s)
+}
+
+// splitCSS splits s at sep outside of parentheses and strings.
+func splitCSS(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseDeclarations parses the declarations of a rule or style attribute.
+func parseDeclarations(block string) []cssDeclaration {
+	var decls []cssDeclaration
+	for _, decl := range splitCSS(block, ';') {
+		i := strings.IndexByte(decl, ':')
+		if i < 0 {
+			continue
+		}
+		d := cssDeclaration{
+			property: strings.ToLower(strings.TrimSpace(decl[:i])),
+			value:    strings.TrimSpace(decl[i+1:]),
+		}
+		if j := strings.LastIndexByte(d.value, '!'); j >= 0 && strings.EqualFold(strings.TrimSpace(d.value[j+1:]), "important") {
+			d.value, d.important = strings.TrimSpace(d.value[:j]), true
+		}
+		if len(d.property) > 0 && len(d.value) > 0 {
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+var (
+	cssIDPattern    = regexp.MustCompile(`#[-\w]+`)
+	cssClassPattern = regexp.MustCompile(`\.[-\w]+|\[[^\]]*\]|:[-\w]+`)
+	cssTypePattern  = regexp.MustCompile(`(^|[\s>+~(])[a-zA-Z][-\w]*`)
+)
+
+// cssSpecificity returns the specificity of the selector, weighting IDs,
+// classes and types by 10000, 100 and 1.
+func cssSpecificity(sel string) int {
+	ids := cssIDPattern.FindAllString(sel, -1)
+	sel = cssIDPattern.ReplaceAllString(sel, "")
+	classes := cssClassPattern.FindAllString(sel, -1)
+	sel = cssClassPattern.ReplaceAllString(sel, "")
+	types := cssTypePattern.FindAllString(sel, -1)
+	return len(ids)*10000 + len(classes)*100 + len(types)
+}
+
+// applyCSS merges the matching declarations into the style attribute of the
+// element. Its own declarations take precedence unless the rules are
+// important.
+func applyCSS(n *html.Node, matches []cssMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.important != b.important {
+			return b.important
+		}
+		if a.specificity != b.specificity {
+			return a.specificity < b.specificity
+		}
+		return a.order < b.order
+	})
+
+	var properties []string
+	values := make(map[string]cssDeclaration)
+	set := func(d cssDeclaration) {
+		if _, ok := values[d.property]; !ok {
+			properties = append(properties, d.property)
+		}
+		values[d.property] = d
+	}
+	for _, m := range matches {
+		if !m.important {
+			set(m.cssDeclaration)
+		}
+	}
+
+	styleIndex := -1
+	for i, attr := range n.Attr {
+		if attr.Key == "style" {
+			styleIndex = i
+			for _, d := range parseDeclarations(attr.Val) {
+				set(d)
+			}
+		}
+	}
+	for _, m := range matches {
+		if m.important {
+			if own, ok := values[m.property]; !ok || !own.important {
+				set(m.cssDeclaration)
+			}
+		}
+	}
+
+	decls := make([]string, 0, len(properties))
+	for _, p := range properties {
+		d := values[p]
+		if d.important {
+			decls = append(decls, d.property+": "+d.value+" !important")
+		} else {
+			decls = append(decls, d.property+": "+d.value)
+		}
+	}
+	style := strings.Join(decls, "; ")
+	if styleIndex >= 0 {
+		n.Attr[styleIndex].Val = style
+	} else {
+		n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: style})
+	}
+}
+
+// findElement returns the first element of the type below n.
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
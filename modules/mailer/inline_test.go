@@ -0,0 +1,60 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineCSS(t *testing.T) {
+	body, err := inlineCSS(`<html><head><style>
+/* theme */
+p { color: red; margin: 0 }
+.note, p.note { color: blue }
+#footer { color: gray !important }
+a:hover { color: green }
+@media (max-width: 600px) { p { margin: 4px } }
+</style></head><body>
+<p>Plain</p>
+<p class="note" style="margin: 8px; color: black">Note</p>
+<p id="footer" style="color: black">Footer <a href="#">link</a></p>
+</body></html>`)
+	assert.NoError(t, err)
+
+	assert.Contains(t, body, `<p style="color: red; margin: 0">Plain</p>`)
+	assert.Contains(t, body, `<p class="note" style="color: black; margin: 8px">Note</p>`)
+	assert.Contains(t, body, `<p id="footer" style="color: gray !important; margin: 0">Footer <a href="#">link</a></p>`)
+	assert.Contains(t, body, "<style>a:hover {")
+	assert.Contains(t, body, "@media (max-width: 600px) { p { margin: 4px } }</style></head>")
+	assert.NotContains(t, body, "theme")
+
+	body, err = inlineCSS(`<html><head><style>.note { color: blue }</style></head><body><div class="note">x</div></body></html>`)
+	assert.NoError(t, err)
+	assert.Equal(t, `<html><head></head><body><div class="note" style="color: blue">x</div></body></html>`, body)
+}
+
+func TestCSSSpecificity(t *testing.T) {
+	assert.Equal(t, 1, cssSpecificity("p"))
+	assert.Equal(t, 2, cssSpecificity("div p"))
+	assert.Equal(t, 101, cssSpecificity("p.note"))
+	assert.Equal(t, 10101, cssSpecificity("#footer p:first-child"))
+	assert.Equal(t, 102, cssSpecificity("a[href] > img"))
+}
+
+func TestNewMessage_InlineCSS(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", InlineCSS: true}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", `<html><head><style>p { color: red }</style></head><body><p>Hi</p></body></html>`)
+	assert.Contains(t, msg.html, `<p style="color: red">Hi</p>`)
+	assert.Equal(t, "Hi", msg.text)
+
+	setting.MailService.InlineCSS = false
+	msg = NewMessage([]string{"user2@example.com"}, "Subject", `<html><head><style>p { color: red }</style></head><body><p>Hi</p></body></html>`)
+	assert.Contains(t, msg.html, `<p>Hi</p>`)
+}
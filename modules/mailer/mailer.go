@@ -5,12 +5,26 @@
 package mailer
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
 )
 
 var (
 	daemon *Daemon
+
+	// reconfigureLock serializes the reloading of the configuration file.
+	reconfigureLock sync.Mutex
 )
 
 // NewContext start mail queue service
@@ -27,6 +41,40 @@ func NewContext() {
 	if err != nil {
 		log.Fatal(4, "Failed to initialize mail daemon: %v", err)
 	}
+
+	go reloadOnSignal()
+}
+
+// reloadOnSignal reconfigures the mail service on SIGHUP.
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := Reconfigure(); err != nil {
+			log.Error(4, "Failed to reconfigure mail service: %v", err)
+		}
+	}
+}
+
+// Reconfigure reloads the mail settings from the configuration file and
+// applies them to the running mail service, without losing queued mails.
+func Reconfigure() error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+
+	reconfigureLock.Lock()
+	defer reconfigureLock.Unlock()
+
+	opts, err := setting.ReloadMailService()
+	if err != nil {
+		return err
+	}
+	if err = daemon.Reconfigure(opts); err != nil {
+		return err
+	}
+	log.Info("Mail service reconfigured: %s, %d-%d workers", backendName(), setting.MailService.Workers, setting.MailService.MaxWorkers)
+	return nil
 }
 
 // CloseContext closes the mail queue service and releases all routines.
@@ -39,15 +87,290 @@ func SendAsync(msg *Message) {
 	daemon.SendAsync(msg)
 }
 
-// SendSync sends the mail synchronous.
-func SendSync(msg *Message) error {
-	// Create a new sender.
-	sender, err := createSender()
+// SendAsyncWithCallback sends the mail asynchronous and calls fn with the
+// outcome of the delivery.
+func SendAsyncWithCallback(ctx context.Context, msg *Message, fn func(error)) {
+	daemon.SendAsyncWithCallback(ctx, msg, fn)
+}
+
+// SendAt sends the mail asynchronous at the given time. It returns an error
+// if the mail could not be queued.
+func SendAt(msg *Message, at time.Time) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	return daemon.SendAt(msg, at)
+}
+
+// SendBatch renders and queues the personalized messages of the batch.
+func SendBatch(b *Batch) (int, error) {
+	if daemon == nil {
+		return 0, ErrMailServiceDisabled
+	}
+	return daemon.SendBatch(b)
+}
+
+// SendResult describes a mail accepted by the mail server or service.
+type SendResult struct {
+	MessageID string
+	Backend   string
+	Duration  time.Duration
+}
+
+var (
+	syncSenderLock sync.Mutex
+	syncSenders    []Sender // Idle senders of SendSync.
+)
+
+// getSyncSender returns an idle sender or creates a new one.
+func getSyncSender() (Sender, error) {
+	syncSenderLock.Lock()
+	if n := len(syncSenders); n > 0 {
+		s := syncSenders[n-1]
+		syncSenders = syncSenders[:n-1]
+		syncSenderLock.Unlock()
+		return s, nil
+	}
+	syncSenderLock.Unlock()
+	return createSender()
+}
+
+func putSyncSender(s Sender) {
+	syncSenderLock.Lock()
+	syncSenders = append(syncSenders, s)
+	syncSenderLock.Unlock()
+}
+
+// resetSyncSenders closes the idle senders, which use the old settings.
+func resetSyncSenders() {
+	syncSenderLock.Lock()
+	idle := syncSenders
+	syncSenders = nil
+	syncSenderLock.Unlock()
+
+	for _, s := range idle {
+		if err := s.Close(); err != nil {
+			log.Error(4, "Failed to close mail sender connection: %v", err)
+		}
+	}
+}
+
+// SendSync sends the mail synchronous, bypassing the mail queue. The senders
+// and their connections are reused. If ctx is done before the mail server
+// accepted the mail, the error of ctx is returned, but the mail may still
+// be delivered.
+func SendSync(ctx context.Context, msg *Message) (SendResult, error) {
+	if setting.MailService == nil {
+		return SendResult{}, ErrMailServiceDisabled
+	}
+	if err := ctx.Err(); err != nil {
+		return SendResult{}, err
+	}
+	if !filterDomains(msg) {
+		return SendResult{}, ErrNoRecipients
+	}
+	if err := beforeEnqueue(msg); err != nil {
+		return SendResult{}, err
+	}
+	redirectRecipients(msg)
+	if err := msg.encryptPending(); err != nil {
+		return SendResult{}, err
+	}
+	if err := checkSize(msg); err != nil {
+		return SendResult{}, err
+	}
+
+	sender, err := getSyncSender()
+	if err != nil {
+		return SendResult{}, err
+	}
+
+	result := SendResult{
+		MessageID: headerMessageID(msg),
+		Backend:   backendName(),
+	}
+	done := make(chan error, 1)
+	go func() {
+		start := time.Now()
+		err := sendWithHooks(sender, msg)
+		duration := time.Since(start)
+		putSyncSender(sender)
+
+		countSend(result.Backend, duration, err)
+		status := DeliverySent
+		if err != nil {
+			status = DeliveryFailed
+		}
+		recordDelivery(msg, 1, duration, err, status)
+		afterSend(msg, duration, err, status)
+
+		result.Duration = duration
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			return SendResult{}, err
+		}
+		return result, nil
+	case <-ctx.Done():
+		return SendResult{}, ctx.Err()
+	}
+}
+
+// SendTest sends the mail synchronous with the same senders as the mail
+// queue, to verify the configuration. It returns a transcript with the
+// dialogue of an SMTP server or the error of another backend.
+func SendTest(msg *Message) (string, error) {
+	if setting.MailService == nil {
+		return "", ErrMailServiceDisabled
+	}
+
+	var transcript bytes.Buffer
+	fmt.Fprintf(&transcript, "* Sending %s to %s with %s\n", msg.Info, strings.Join(msg.GetHeader("To"), ", "), backendName())
+	msg.transcript = &transcript
+	if _, err := SendSync(context.Background(), msg); err != nil {
+		fmt.Fprintf(&transcript, "* Failed: %v\n", err)
+		return transcript.String(), err
+	}
+	fmt.Fprintf(&transcript, "* Sent\n")
+	return transcript.String(), nil
+}
+
+// ErrMailServiceDisabled is returned if the mail service is not enabled.
+var ErrMailServiceDisabled = errors.New("mail service is not enabled")
+
+// Workers describes the routines sending the queued mails.
+type Workers struct {
+	Running int `json:"running"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+}
+
+// GetWorkers returns the number of mail worker routines.
+func GetWorkers() (*Workers, error) {
+	if daemon == nil {
+		return nil, ErrMailServiceDisabled
+	}
+	running, min, max := daemon.Workers()
+	return &Workers{
+		Running: running,
+		Min:     min,
+		Max:     max,
+	}, nil
+}
+
+// SetWorkers changes the number of mail worker routines, see Daemon.SetWorkers.
+func SetWorkers(min, max int) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	return daemon.SetWorkers(min, max)
+}
+
+// PendingMessages returns the messages waiting in the queue.
+func PendingMessages() ([]*PendingMessage, error) {
+	if daemon == nil {
+		return nil, ErrMailServiceDisabled
+	}
+	return daemon.queue.List()
+}
+
+// DeletePendingMessage removes the message from the queue.
+func DeletePendingMessage(id int64) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	return daemon.queue.Remove(id)
+}
+
+// ExpeditePendingMessage sends the queued message next.
+func ExpeditePendingMessage(id int64) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	return daemon.queue.Expedite(id)
+}
+
+// FlushQueue sends all waiting messages next, also the scheduled ones and
+// those waiting for a retry. It returns the number of expedited messages.
+func FlushQueue() (int, error) {
+	if daemon == nil {
+		return 0, ErrMailServiceDisabled
+	}
+	pending, err := daemon.queue.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, pm := range pending {
+		if pm.Sending {
+			continue
+		}
+		// The message may have been sent since it was listed.
+		if err = daemon.queue.Expedite(pm.ID); err != nil && !IsErrPendingMessageNotExist(err) {
+			return n, err
+		} else if err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeadLetters returns the messages which could not be delivered.
+func DeadLetters() ([]*DeadLetter, error) {
+	if daemon == nil {
+		return nil, ErrMailServiceDisabled
+	}
+	return daemon.queue.DeadLetters().List()
+}
+
+// RequeueDeadLetter moves the dead letter back into the mail queue.
+func RequeueDeadLetter(id int64) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	msg, err := daemon.queue.DeadLetters().Remove(id)
 	if err != nil {
 		return err
 	}
-	defer sender.Close()
+	msg.attempts = 0
+	msg.sendAt = time.Time{}
+	return daemon.queue.Push(msg)
+}
+
+// RequeueDeadLetters moves all dead letters back into the mail queue and
+// returns their number.
+func RequeueDeadLetters() (int, error) {
+	if daemon == nil {
+		return 0, ErrMailServiceDisabled
+	}
+	deadLetters, err := daemon.queue.DeadLetters().List()
+	if err != nil {
+		return 0, err
+	}
+	for i, dl := range deadLetters {
+		if err = RequeueDeadLetter(dl.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(deadLetters), nil
+}
+
+// DeleteDeadLetter deletes the dead letter.
+func DeleteDeadLetter(id int64) error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	_, err := daemon.queue.DeadLetters().Remove(id)
+	return err
+}
 
-	// Send the mail.
-	return sender.Send(msg)
+// PurgeDeadLetters deletes all dead letters.
+func PurgeDeadLetters() error {
+	if daemon == nil {
+		return ErrMailServiceDisabled
+	}
+	return daemon.queue.DeadLetters().Purge()
 }
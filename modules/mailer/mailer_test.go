@@ -0,0 +1,117 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendSync(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:     "gitea@example.com",
+		MailType: "dummy",
+	}
+	defer resetSyncSenders()
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	result, err := SendSync(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, msg.GetHeader("Message-ID")[0], result.MessageID)
+	assert.Equal(t, "dummy", result.Backend)
+
+	// The sender is kept for the next mail.
+	assert.Len(t, syncSenders, 1)
+	_, err = SendSync(context.Background(), NewMessage([]string{"user@example.com"}, "Subject", "Body"))
+	assert.NoError(t, err)
+	assert.Len(t, syncSenders, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = SendSync(ctx, NewMessage([]string{"user@example.com"}, "Subject", "Body"))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestFlushQueue(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:            "gitea@example.com",
+		MailType:        "dummy",
+		Workers:         1,
+		QueueLength:     10,
+		OverflowTimeout: time.Second,
+	}
+
+	var err error
+	daemon, err = NewDaemon()
+	assert.NoError(t, err)
+	defer func() {
+		daemon.Close()
+		daemon = nil
+	}()
+
+	assert.NoError(t, daemon.SendAt(NewMessage([]string{"user@example.com"}, "Subject", "Body"), time.Now().Add(time.Hour)))
+	pending, err := PendingMessages()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	n, err := FlushQueue()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	for i := 0; i < 100 && len(pending) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pending, err = PendingMessages()
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, pending)
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:        "gitea@example.com",
+		MailType:    "dummy",
+		Workers:     1,
+		QueueLength: 10,
+	}
+
+	var err error
+	daemon, err = NewDaemon()
+	assert.NoError(t, err)
+	defer func() {
+		daemon.Close()
+		daemon = nil
+	}()
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.attempts = 4
+	msg.sendAt = time.Now().Add(-time.Hour)
+	assert.NoError(t, daemon.queue.DeadLetters().Add(msg))
+	deadLetters, err := DeadLetters()
+	assert.NoError(t, err)
+	if !assert.Len(t, deadLetters, 1) {
+		return
+	}
+	id := deadLetters[0].ID
+	sent := GetStats().Sent["dummy"]
+
+	// The dead letter is sent again with new retries.
+	n, err := RequeueDeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, msg.attempts)
+	deadLetters, err = DeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+	for i := 0; i < 100 && GetStats().Sent["dummy"] == sent; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, sent+1, GetStats().Sent["dummy"])
+
+	assert.True(t, IsErrDeadLetterNotExist(RequeueDeadLetter(id)))
+}
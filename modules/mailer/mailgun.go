@@ -0,0 +1,140 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+const (
+	mailgunTagHeader = "X-Mailgun-Tag"
+)
+
+// mailgunAPIURLs are the API base URLs of the regions, tests change them to
+// a local server.
+var mailgunAPIURLs = map[string]string{
+	"us": "https://api.mailgun.net/v3",
+	"eu": "https://api.eu.mailgun.net/v3",
+}
+
+// Sender implementation for the Mailgun messages API.
+type mailgunSender struct {
+	apiURL   string
+	apiKey   string
+	tags     []string
+	tracking bool
+}
+
+func newMailgunSender(opts *setting.Mailer) (Sender, error) {
+	if len(opts.MailgunDomain) == 0 {
+		return nil, errors.New("mailer: MAILGUN_DOMAIN is required for the Mailgun sender")
+	}
+
+	return &mailgunSender{
+		apiURL:   mailgunAPIURLs[opts.MailgunRegion] + "/" + opts.MailgunDomain + "/messages",
+		apiKey:   opts.MailgunAPIKey,
+		tags:     opts.MailgunTags,
+		tracking: opts.MailgunTracking,
+	}, nil
+}
+
+func writeMailgunAddresses(w *multipart.Writer, field string, list []*mail.Address) {
+	for _, addr := range list {
+		w.WriteField(field, addr.String())
+	}
+}
+
+// Send the message synchronous.
+func (s *mailgunSender) Send(msg *Message) error {
+	c, err := msg.content()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	w.WriteField("from", c.From.String())
+	writeMailgunAddresses(w, "to", c.To)
+	writeMailgunAddresses(w, "cc", c.Cc)
+	writeMailgunAddresses(w, "bcc", c.Bcc)
+	if len(c.ReplyTo) > 0 {
+		w.WriteField("h:Reply-To", c.ReplyTo[0].String())
+	}
+	w.WriteField("subject", c.Subject)
+	if len(c.Text) > 0 {
+		w.WriteField("text", c.Text)
+	}
+	if len(c.HTML) > 0 {
+		w.WriteField("html", c.HTML)
+	}
+
+	// Mailgun allows up to three tags per message.
+	tags := append([]string{}, s.tags...)
+	for _, tag := range strings.Split(c.Headers[mailgunTagHeader], ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	for i, tag := range tags {
+		if i == 3 {
+			break
+		}
+		w.WriteField("o:tag", tag)
+	}
+	if s.tracking {
+		w.WriteField("o:tracking", "yes")
+	} else {
+		w.WriteField("o:tracking", "no")
+	}
+
+	for name, value := range c.Headers {
+		if name != mailgunTagHeader {
+			w.WriteField("h:"+name, value)
+		}
+	}
+
+	for _, a := range c.Attachments {
+		field := "attachment"
+		if len(a.ContentID) > 0 {
+			// Mailgun uses the file name as Content-ID of inline files.
+			field = "inline"
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, a.Filename))
+		h.Set("Content-Type", a.ContentType)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err = part.Write(a.Data); err != nil {
+			return err
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	req := httplib.Post(s.apiURL).
+		SetBasicAuth("api", s.apiKey).
+		Header("Content-Type", w.FormDataContentType()).
+		Body(body.Bytes())
+	return permanentAPIError(doAPIRequest("Mailgun", req, nil))
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *mailgunSender) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailgunSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+	defer func(url string) { mailgunAPIURLs["eu"] = url }(mailgunAPIURLs["eu"])
+	mailgunAPIURLs["eu"] = server.URL + "/v3"
+
+	setting.MailService = &setting.Mailer{
+		From:          "Gitea <gitea@example.com>",
+		MailgunDomain: "mg.example.com",
+		MailgunRegion: "eu",
+		MailgunAPIKey: "key",
+		MailgunTags:   []string{"gitea"},
+	}
+	s, err := newMailgunSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	server.reply(http.StatusOK, `{"id":"<1@mg.example.com>","message":"Queued. Thank you."}`)
+	assert.NoError(t, s.Send(msg))
+
+	req := server.last()
+	assert.Equal(t, "/v3/mg.example.com/messages", req.Path)
+	user, key, ok := (&http.Request{Header: req.Header}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "api", user)
+	assert.Equal(t, "key", key)
+
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	form, err := multipart.NewReader(bytes.NewReader(req.Body), params["boundary"]).ReadForm(1 << 20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"Gitea" <gitea@example.com>`}, form.Value["from"])
+	assert.Equal(t, []string{`"User" <user@example.com>`}, form.Value["to"])
+	assert.Equal(t, []string{"Subject"}, form.Value["subject"])
+	assert.Equal(t, []string{"gitea"}, form.Value["o:tag"])
+	assert.Equal(t, []string{"no"}, form.Value["o:tracking"])
+	assert.Len(t, form.Value["html"], 1)
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
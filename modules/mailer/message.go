@@ -5,21 +5,115 @@
 package mailer
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
-	"github.com/jaytaylor/html2text"
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/gomail.v2"
 
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
 )
 
+// Category classifies a message by its purpose.
+type Category string
+
+// The categories of messages.
+const (
+	// CategorySecurity is used for account related mails, e.g. activation or password reset.
+	CategorySecurity Category = "security"
+	// CategoryNotification is used for repository activity notifications.
+	CategoryNotification Category = "notification"
+	// CategoryDigest is used for summaries of several notifications.
+	CategoryDigest Category = "digest"
+	// CategoryBroadcast is used for announcements sent to many users.
+	CategoryBroadcast Category = "broadcast"
+)
+
+// IsBulk returns true if mails of the category are sent in bulk
+// rather than triggered by a single event.
+func (c Category) IsBulk() bool {
+	return c == CategoryDigest || c == CategoryBroadcast
+}
+
+// Priority defines the order in which queued messages are sent.
+type Priority int
+
+// The priorities of messages, higher priorities are sent first.
+const (
+	// PriorityDefault chooses the priority by the category of the message.
+	PriorityDefault Priority = iota
+	PriorityHigh
+	PriorityNormal
+	PriorityLow
+)
+
+// priorities lists the priorities from highest to lowest.
+var priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
 // Message mail body and log info
 type Message struct {
 	*gomail.Message
 
-	Info string // Message information for log purpose.
+	Info     string   // Message information for log purpose.
+	Category Category // Purpose of the message, CategoryNotification if empty.
+	Priority Priority // Queue priority, chosen by the category if PriorityDefault.
+	Event    Event    // Activity of a notification, receivers not wanting it are removed.
+
+	// EnvelopeFrom is the SMTP envelope sender, "<>" for the null sender.
+	// It overrides ENVELOPE_FROM and VERP_ADDRESS if set.
+	EnvelopeFrom string
+
+	// Route is the name of the [mailer.route.NAME] all recipients are sent
+	// through, overriding the routes of the domains and the repository.
+	Route string
+
+	text      string    // Plain text body, kept to add the calendar part.
+	html      string    // HTML body, kept to replace the plain text part.
+	calendar  string    // iCalendar part of an invitation, kept to replace the bodies.
+	filesSize int64     // Total size of attached and embedded files.
+	queueID   uint64    // Key of the message in a persistent queue.
+	raw       []byte    // Rendered message as restored from a persistent queue or signed.
+	attempts  int       // Number of failed delivery attempts.
+	lastError string    // Error of the last failed delivery attempt.
+	failed    time.Time // Time of the last failed delivery attempt.
+	sendAt    time.Time // Scheduled delivery time, zero to send immediately.
+	queued    time.Time // Time the message was first queued.
+	delivered []string  // Recipients which accepted the message in a previous attempt.
+	reserved  bool      // The rate limits were reserved for the message, which was delayed.
+	rcpts     []string  // Recipients of the current delivery if not nil, a subset of the headers.
+
+	omitHeaders map[string]bool // Lower case names of the [mailer.headers] left out.
+
+	encryptTo openpgp.EntityList // Keys the message is encrypted to when queued, see EncryptTo.
+
+	// Attached files not yet added to the rendered message, see attachPending.
+	attachments []*messageFile
+
+	transcript io.Writer // Records the dialogue with the mail server of a test mail.
+}
+
+// priority returns the effective queue priority: security mails are sent
+// before notifications, which are sent before bulk mails.
+func (m *Message) priority() Priority {
+	switch {
+	case m.Priority != PriorityDefault:
+		return m.Priority
+	case m.Category == CategorySecurity:
+		return PriorityHigh
+	case m.Category.IsBulk():
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
 }
 
 // NewMessageFrom creates new mail message object with custom From header.
@@ -27,28 +121,535 @@ func NewMessageFrom(to []string, from, subject, body string) *Message {
 	log.Trace("NewMessageFrom (body):\n%s", body)
 
 	msg := gomail.NewMessage()
-	msg.SetHeader("From", from)
-	msg.SetHeader("To", to...)
+	setAddressHeader(msg, "From", []string{from})
+	setAddressHeader(msg, "To", to)
 	msg.SetHeader("Subject", subject)
+	msg.SetHeader("Message-ID", newMessageID())
 	msg.SetDateHeader("Date", time.Now())
 
-	plainBody, err := html2text.FromString(body)
-	if err != nil || setting.MailService.SendAsPlainText {
-		if strings.Contains(body[:100], "<html>") {
-			log.Warn("Mail contains HTML but configured to send as plain text.")
+	m := &Message{
+		Message:  msg,
+		Category: CategoryNotification,
+	}
+
+	if len(body) > 0 {
+		themed, err := applyTheme(body)
+		if err != nil {
+			log.Error(3, "Failed to apply the theme to the mail body: %v", err)
+		} else {
+			body = themed
+		}
+	}
+	if setting.MailService.InlineCSS && strings.Contains(body, "<style") {
+		inlined, err := inlineCSS(body)
+		if err != nil {
+			log.Error(3, "Failed to inline the CSS of the mail body: %v", err)
+		} else {
+			body = inlined
+		}
+	}
+
+	plainBody, err := htmlToText(body)
+	if err != nil {
+		log.Error(3, "Failed to convert mail body to plain text: %v", err)
+		plainBody = body
+	}
+	m.SetAlternativeBodies(plainBody, body)
+
+	return m
+}
+
+// messageIDDomain returns the domain of generated Message-IDs, the domain of
+// the sender if none is configured.
+func messageIDDomain() string {
+	if len(setting.MailService.MessageIDDomain) > 0 {
+		return setting.MailService.MessageIDDomain
+	}
+	if addr, err := mail.ParseAddress(setting.MailService.From); err == nil {
+		if i := strings.LastIndexByte(addr.Address, '@'); i >= 0 {
+			return addr.Address[i+1:]
 		}
-		msg.SetBody("text/plain", plainBody)
+	}
+	return setting.Domain
+}
+
+// newMessageID generates a unique Message-ID.
+func newMessageID() string {
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomBoundary()[:16], messageIDDomain())
+}
+
+// MessageID returns the Message-ID with the local part, e.g. the path of an
+// issue, to give related messages stable IDs.
+func MessageID(local string) string {
+	return "<" + local + "@" + messageIDDomain() + ">"
+}
+
+// SetThread sets the headers referring to the first message of the thread
+// with the Message-ID, so mail clients show the messages together.
+// The message ID should be set to a stable one as well.
+func (m *Message) SetThread(messageID, rootID string) {
+	m.SetHeader("Message-ID", messageID)
+	if messageID != rootID {
+		m.SetHeader("In-Reply-To", rootID)
+		m.SetHeader("References", rootID)
+	}
+}
+
+// The headers describing the activity of a notification mail, which users can
+// filter the mails on.
+const (
+	HeaderRepository = "X-Gitea-Repository"
+	HeaderSender     = "X-Gitea-Sender"
+	HeaderReason     = "X-Gitea-Reason"
+	HeaderIssue      = "X-Gitea-Issue"
+)
+
+// Metadata is the activity a notification mail is about.
+type Metadata struct {
+	Repository string // Full name of the repository, owner/name.
+	Sender     string // Name of the user who caused the notification.
+	Issue      int64  // Index of the issue or pull request, 0 if none.
+}
+
+// SetMetadata sets the X-Gitea-* headers of the activity. The X-Gitea-Reason
+// header is set by the Event of the message when it is sent.
+func (m *Message) SetMetadata(md Metadata) {
+	if len(md.Repository) > 0 {
+		m.SetHeader(HeaderRepository, md.Repository)
+	}
+	if len(md.Sender) > 0 {
+		m.SetHeader(HeaderSender, md.Sender)
+	}
+	if md.Issue > 0 {
+		m.SetHeader(HeaderIssue, strconv.FormatInt(md.Issue, 10))
+	}
+}
+
+// FromUser returns the From header of mails on behalf of the user with the
+// display name, which is formatted by FROM_DISPLAY_NAME_FORMAT and sent with
+// the address of FROM. Non-ASCII names are encoded as in RFC 2047.
+func FromUser(displayName string) string {
+	opts := setting.MailService
+	if len(opts.FromDisplayNameFormat) == 0 {
+		return opts.From
+	}
+
+	tpl, err := template.New("").Parse(opts.FromDisplayNameFormat)
+	if err != nil {
+		log.Error(3, "Failed to parse FROM_DISPLAY_NAME_FORMAT: %v", err)
+		return opts.From
+	}
+	var name bytes.Buffer
+	if err = tpl.Execute(&name, map[string]string{
+		"DisplayName": displayName,
+		"AppName":     setting.AppName,
+	}); err != nil {
+		log.Error(3, "Failed to format From display name: %v", err)
+		return opts.From
+	}
+	return (&mail.Address{Name: strings.TrimSpace(name.String()), Address: opts.FromEmail}).String()
+}
+
+// setAddressHeader sets the address header to the addresses. The domains
+// are converted to their ASCII form. Internationalized local parts are kept
+// in UTF-8 (RFC 6532) instead of being encoded like other header values, so
+// the addresses are set as one list.
+func setAddressHeader(msg *gomail.Message, field string, addrs []string) {
+	ascii := true
+	for i := range addrs {
+		addrs[i] = idnaAddress(addrs[i])
+		ascii = ascii && isASCII(addrs[i])
+	}
+	if ascii {
+		msg.SetHeader(field, addrs...)
 	} else {
-		msg.SetBody("text/plain", plainBody)
-		msg.AddAlternative("text/html", body)
+		msg.SetAddressHeader(field, strings.Join(addrs, ", "), "")
 	}
+}
 
-	return &Message{
-		Message: msg,
+// SetAddresses sets the address header like To or Cc to the addresses.
+func (m *Message) SetAddresses(field string, addrs ...string) {
+	setAddressHeader(m.Message, field, addrs)
+}
+
+// addresses returns the addresses of the header, which are set as one list
+// if any of them is internationalized.
+func (m *Message) addresses(field string) []string {
+	var addrs []string
+	for _, value := range m.GetHeader(field) {
+		list, err := mail.ParseAddressList(value)
+		if err != nil || len(list) < 2 {
+			addrs = append(addrs, value)
+			continue
+		}
+		for _, addr := range list {
+			if len(addr.Name) == 0 {
+				addrs = append(addrs, addr.Address)
+			} else {
+				addrs = append(addrs, addr.String())
+			}
+		}
 	}
+	return addrs
 }
 
 // NewMessage creates new mail message object with default From header.
 func NewMessage(to []string, subject, body string) *Message {
 	return NewMessageFrom(to, setting.MailService.From, subject, body)
 }
+
+// SetAlternativeBodies replaces the bodies of the message. The plain text and
+// the HTML body are sent as multipart/alternative, so mail clients can choose
+// which one to display. The HTML body is left out if it is empty or if the
+// mailer is configured to send plain text only. The calendar part of an
+// invitation is kept as last alternative.
+func (m *Message) SetAlternativeBodies(text, html string) {
+	m.text, m.html = text, html
+	m.SetBody("text/plain", text)
+
+	switch {
+	case len(html) == 0:
+	case setting.MailService.SendAsPlainText:
+		if strings.Contains(html, "<html>") {
+			log.Warn("Mail contains HTML but configured to send as plain text.")
+		}
+	default:
+		m.AddAlternative("text/html", html)
+	}
+	if len(m.calendar) > 0 {
+		m.AddAlternative(calendarContentType, m.calendar)
+	}
+}
+
+// SetTextBody replaces the plain text part generated from the HTML body
+// with a custom text.
+func (m *Message) SetTextBody(text string) {
+	m.SetAlternativeBodies(text, m.html)
+}
+
+// Bodies returns the plain text and the HTML body of the message as they
+// are sent.
+func (m *Message) Bodies() (text, html string) {
+	return m.text, m.html
+}
+
+// SetListUnsubscribe sets the headers to unsubscribe from the mails with
+// the link, including one-click unsubscription with a POST request to it
+// (RFC 8058). The link has to identify the receiver, so the message should
+// have a single one.
+func (m *Message) SetListUnsubscribe(link string) {
+	m.SetHeader("List-Unsubscribe", "<"+link+">")
+	m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+}
+
+// OmitHeader leaves out the header of [mailer.headers], Auto-Submitted or
+// Precedence from the message. It has to be called before the message is
+// encrypted or sent; headers set on the message with SetHeader replace
+// them anyway.
+func (m *Message) OmitHeader(field string) {
+	if m.omitHeaders == nil {
+		m.omitHeaders = make(map[string]bool)
+	}
+	m.omitHeaders[strings.ToLower(field)] = true
+}
+
+// setGlobalHeaders adds the headers of [mailer.headers], the X-Gitea-Reason
+// of the event and the headers marking automated mails (RFC 3834) which the
+// message neither sets nor omits. Account mails are not marked, so they are
+// not filtered as bulk.
+func (m *Message) setGlobalHeaders() {
+	if setting.MailService == nil {
+		return
+	}
+	for field, value := range setting.MailService.Headers {
+		m.setDefaultHeader(field, value)
+	}
+	if reason := m.Event.reason(); len(reason) > 0 {
+		m.setDefaultHeader(HeaderReason, reason)
+	}
+	if m.Category == CategorySecurity {
+		return
+	}
+	if setting.MailService.AutoSubmitted {
+		m.setDefaultHeader("Auto-Submitted", "auto-generated")
+	}
+	if precedence := setting.MailService.Precedence; len(precedence) > 0 && precedence != "none" {
+		m.setDefaultHeader("Precedence", precedence)
+	}
+}
+
+// setDefaultHeader sets the header unless the message sets or omits it.
+func (m *Message) setDefaultHeader(field, value string) {
+	if !m.omitHeaders[strings.ToLower(field)] && len(m.GetHeader(field)) == 0 {
+		m.SetHeader(field, value)
+	}
+}
+
+// WriteTo implements io.WriterTo. Messages restored from a persistent queue
+// are written exactly as they were rendered when enqueued.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if m.raw != nil {
+		n, err := w.Write(m.raw)
+		return int64(n), err
+	}
+	m.setGlobalHeaders()
+	m.attachPending()
+	return m.Message.WriteTo(w)
+}
+
+// envelope returns the SMTP envelope sender and recipients of the message.
+// The recipients are limited to those of the current delivery.
+func (m *Message) envelope() (from string, to []string, err error) {
+	froms := m.GetHeader("Sender")
+	if len(froms) == 0 {
+		froms = m.GetHeader("From")
+		if len(froms) == 0 {
+			return "", nil, errors.New(`invalid message, "From" field is absent`)
+		}
+	}
+	addr, err := mail.ParseAddress(froms[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid address %q: %v", froms[0], err)
+	}
+	from = addr.Address
+
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, a := range m.GetHeader(field) {
+			addrs, err := mail.ParseAddressList(a)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid address %q: %v", a, err)
+			}
+			for _, addr := range addrs {
+				if m.isRecipient(addr.Address) {
+					to = appendAddress(to, addr.Address)
+				}
+			}
+		}
+	}
+	return from, to, nil
+}
+
+// isDelivered reports whether the recipient accepted the message in a
+// previous attempt.
+func (m *Message) isDelivered(addr string) bool {
+	for _, a := range m.delivered {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isRecipient reports whether the address is a recipient of the current
+// delivery.
+func (m *Message) isRecipient(addr string) bool {
+	if m.rcpts == nil {
+		return true
+	}
+	for _, a := range m.rcpts {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func appendAddress(list []string, addr string) []string {
+	for _, a := range list {
+		if a == addr {
+			return list
+		}
+	}
+	return append(list, addr)
+}
+
+// nullSender returns the empty envelope sender for "<>".
+func nullSender(addr string) string {
+	if addr == "<>" {
+		return ""
+	}
+	return addr
+}
+
+// extensionReporter is implemented by SMTP connections which know the
+// extensions offered by the server.
+type extensionReporter interface {
+	Extension(ext string) (bool, string)
+}
+
+// asciiEnvelope converts the envelope for a server without SMTPUTF8 (RFC
+// 6531). Recipients with an internationalized local part can not be reached
+// and are left out.
+func asciiEnvelope(from string, to []string) (string, []string, error) {
+	if from = idnaAddress(from); !isASCII(from) {
+		return "", nil, fmt.Errorf("envelope sender %s requires SMTPUTF8, which the mail server does not support", from)
+	}
+	ascii := make([]string, 0, len(to))
+	for _, addr := range to {
+		if addr = idnaAddress(addr); isASCII(addr) {
+			ascii = append(ascii, addr)
+		} else {
+			log.Warn("Mail to %s not sent: the mail server does not support SMTPUTF8", addr)
+		}
+	}
+	if len(ascii) == 0 {
+		return "", nil, fmt.Errorf("recipients %v require SMTPUTF8, which the mail server does not support", to)
+	}
+	return from, ascii, nil
+}
+
+// send delivers the message using the given gomail sender. With VERP every
+// recipient gets a separate copy with its own envelope sender.
+func (m *Message) send(s gomail.Sender) error {
+	from, to, err := m.envelope()
+	if err != nil {
+		return err
+	}
+	if len(m.EnvelopeFrom) > 0 {
+		from = nullSender(m.EnvelopeFrom)
+	} else if len(setting.MailService.EnvelopeFrom) > 0 {
+		from = nullSender(setting.MailService.EnvelopeFrom)
+	}
+	if r, ok := s.(extensionReporter); ok {
+		if has, _ := r.Extension("SMTPUTF8"); !has {
+			if from, to, err = asciiEnvelope(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	if len(m.EnvelopeFrom) > 0 || len(setting.MailService.VERPAddress) == 0 {
+		// Only the recipients deferred in a previous attempt are retried.
+		var pending []string
+		for _, rcpt := range to {
+			if !m.isDelivered(rcpt) {
+				pending = append(pending, rcpt)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		err = s.Send(from, pending, m)
+		if deferred, ok := err.(ErrRecipientsDeferred); ok {
+			for _, rcpt := range deferred.accepted(pending) {
+				m.delivered = appendAddress(m.delivered, rcpt)
+			}
+		}
+		return err
+	}
+
+	messageID := m.GetHeader("Message-ID")
+	for _, rcpt := range to {
+		// Recipients which got their copy in a previous attempt are skipped.
+		if m.isDelivered(rcpt) {
+			continue
+		}
+		sender := from
+		if len(messageID) > 0 {
+			if verp := verpAddress(messageID[0], rcpt); len(verp) > 0 {
+				sender = verp
+			}
+		}
+		if err = s.Send(sender, []string{rcpt}, m); err != nil {
+			return err
+		}
+		m.delivered = appendAddress(m.delivered, rcpt)
+	}
+	return nil
+}
+
+// queuedMessage is the serialized form of a message in a persistent queue.
+type queuedMessage struct {
+	Info         string
+	Category     Category
+	Priority     Priority
+	EnvelopeFrom string
+	Route        string
+	Bcc          []string // Bcc is not part of the rendered message.
+	Raw          []byte
+	Attempts     int
+	LastError    string
+	Failed       time.Time
+	SendAt       time.Time
+	Queued       time.Time
+	Delivered    []string
+	Reserved     bool
+}
+
+// encode serializes the message for a persistent queue.
+func (m *Message) encode() ([]byte, error) {
+	qm, err := m.queuedMessage()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(qm)
+}
+
+// queuedMessage renders the message and returns it with its queue state.
+func (m *Message) queuedMessage() (*queuedMessage, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return &queuedMessage{
+		Info:         m.Info,
+		Category:     m.Category,
+		Priority:     m.Priority,
+		EnvelopeFrom: m.EnvelopeFrom,
+		Route:        m.Route,
+		Bcc:          m.GetHeader("Bcc"),
+		Raw:          buf.Bytes(),
+		Attempts:     m.attempts,
+		LastError:    m.lastError,
+		Failed:       m.failed,
+		SendAt:       m.sendAt,
+		Queued:       m.queued,
+		Delivered:    m.delivered,
+		Reserved:     m.reserved,
+	}, nil
+}
+
+// decodeMessage restores a message serialized by encode.
+func decodeMessage(data []byte) (*Message, error) {
+	var qm queuedMessage
+	if err := json.Unmarshal(data, &qm); err != nil {
+		return nil, err
+	}
+	return qm.message()
+}
+
+// message restores the message from its rendered form.
+func (qm *queuedMessage) message() (*Message, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(qm.Raw))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := gomail.NewMessage()
+	for field, values := range parsed.Header {
+		if field == "To" || field == "Cc" {
+			setAddressHeader(msg, field, values)
+		} else {
+			msg.SetHeader(field, values...)
+		}
+	}
+	if len(qm.Bcc) > 0 {
+		msg.SetHeader("Bcc", qm.Bcc...)
+	}
+
+	return &Message{
+		Message:      msg,
+		Info:         qm.Info,
+		Category:     qm.Category,
+		Priority:     qm.Priority,
+		EnvelopeFrom: qm.EnvelopeFrom,
+		Route:        qm.Route,
+		raw:          qm.Raw,
+		attempts:     qm.Attempts,
+		lastError:    qm.LastError,
+		failed:       qm.Failed,
+		sendAt:       qm.SendAt,
+		queued:       qm.Queued,
+		delivered:    qm.Delivered,
+		reserved:     qm.Reserved,
+	}, nil
+}
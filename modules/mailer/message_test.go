@@ -0,0 +1,162 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	gomail "gopkg.in/gomail.v2"
+)
+
+func TestMessageID(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: `"Gitea" <gitea@example.com>`}
+	assert.Equal(t, "<user2/repo1/issues/1@example.com>", MessageID("user2/repo1/issues/1"))
+	assert.Regexp(t, `^<\d+\.[0-9a-f]{16}@example\.com>$`, newMessageID())
+
+	setting.MailService.MessageIDDomain = "mail.example.com"
+	assert.Equal(t, "<user2/repo1/issues/1@mail.example.com>", MessageID("user2/repo1/issues/1"))
+}
+
+func TestMessage_GlobalHeaders(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", Headers: map[string]string{
+		"X-Auto-Response-Suppress": "All",
+		"X-Organization":           "Example",
+	}}
+	render := func(msg *Message) string {
+		var buf bytes.Buffer
+		_, err := msg.WriteTo(&buf)
+		assert.NoError(t, err)
+		return buf.String()
+	}
+
+	raw := render(NewMessage([]string{"user@example.com"}, "Subject", "Body"))
+	assert.Contains(t, raw, "X-Auto-Response-Suppress: All\r\n")
+	assert.Contains(t, raw, "X-Organization: Example\r\n")
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetHeader("X-Organization", "Other")
+	msg.OmitHeader("x-auto-response-suppress")
+	raw = render(msg)
+	assert.NotContains(t, raw, "X-Auto-Response-Suppress")
+	assert.Contains(t, raw, "X-Organization: Other\r\n")
+}
+
+func TestMessage_AutoSubmitted(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AutoSubmitted: true, Precedence: "bulk"}
+	render := func(msg *Message) string {
+		var buf bytes.Buffer
+		_, err := msg.WriteTo(&buf)
+		assert.NoError(t, err)
+		return buf.String()
+	}
+
+	raw := render(NewMessage([]string{"user@example.com"}, "Subject", "Body"))
+	assert.Contains(t, raw, "Auto-Submitted: auto-generated\r\n")
+	assert.Contains(t, raw, "Precedence: bulk\r\n")
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.Category = CategorySecurity
+	raw = render(msg)
+	assert.NotContains(t, raw, "Auto-Submitted")
+	assert.NotContains(t, raw, "Precedence")
+
+	setting.MailService.Precedence = "none"
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetHeader("Auto-Submitted", "auto-replied")
+	raw = render(msg)
+	assert.Contains(t, raw, "Auto-Submitted: auto-replied\r\n")
+	assert.NotContains(t, raw, "Precedence")
+}
+
+func TestMessage_SetMetadata(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetMetadata(Metadata{Repository: "user2/repo1", Sender: "user1", Issue: 3})
+	msg.Event = EventAssigned
+	var buf bytes.Buffer
+	_, err := msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "X-Gitea-Repository: user2/repo1\r\n")
+	assert.Contains(t, buf.String(), "X-Gitea-Sender: user1\r\n")
+	assert.Contains(t, buf.String(), "X-Gitea-Issue: 3\r\n")
+	assert.Contains(t, buf.String(), "X-Gitea-Reason: assign\r\n")
+
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetMetadata(Metadata{Repository: "user2/repo1"})
+	assert.Empty(t, msg.GetHeader(HeaderIssue))
+	assert.Empty(t, msg.GetHeader(HeaderSender))
+}
+
+func TestMessage_SetThread(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	root := MessageID("user2/repo1/issues/1")
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetThread(root, root)
+	assert.Equal(t, []string{root}, msg.GetHeader("Message-ID"))
+	assert.Empty(t, msg.GetHeader("In-Reply-To"))
+	assert.Empty(t, msg.GetHeader("References"))
+
+	reply := MessageID("user2/repo1/issues/1/comment/2")
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetThread(reply, root)
+	assert.Equal(t, []string{reply}, msg.GetHeader("Message-ID"))
+	assert.Equal(t, []string{root}, msg.GetHeader("In-Reply-To"))
+	assert.Equal(t, []string{root}, msg.GetHeader("References"))
+}
+
+func TestMessage_EnvelopeFrom(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: `"Gitea" <gitea@example.com>`}
+
+	var envelopeFrom string
+	sender := gomail.SendFunc(func(from string, to []string, _ io.WriterTo) error {
+		envelopeFrom = from
+		return nil
+	})
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	assert.NoError(t, msg.send(sender))
+	assert.Equal(t, "gitea@example.com", envelopeFrom)
+
+	setting.MailService.EnvelopeFrom = "bounces@example.org"
+	assert.NoError(t, msg.send(sender))
+	assert.Equal(t, "bounces@example.org", envelopeFrom)
+
+	setting.MailService.EnvelopeFrom = "<>"
+	assert.NoError(t, msg.send(sender))
+	assert.Equal(t, "", envelopeFrom)
+
+	msg.EnvelopeFrom = "user@example.net"
+	data, err := msg.encode()
+	assert.NoError(t, err)
+	msg, err = decodeMessage(data)
+	assert.NoError(t, err)
+	assert.NoError(t, msg.send(sender))
+	assert.Equal(t, "user@example.net", envelopeFrom)
+}
+
+func TestFromUser(t *testing.T) {
+	setting.AppName = "Gitea"
+	setting.MailService = &setting.Mailer{
+		From:                  `"Gitea" <gitea@example.com>`,
+		FromEmail:             "gitea@example.com",
+		FromDisplayNameFormat: "{{.DisplayName}} via {{.AppName}}",
+	}
+	assert.Equal(t, `"Alice via Gitea" <gitea@example.com>`, FromUser("Alice"))
+	assert.Equal(t, `"\"Bob\" via Gitea" <gitea@example.com>`, FromUser(`"Bob"`))
+	assert.Equal(t, "=?utf-8?q?J=C3=BCrgen_via_Gitea?= <gitea@example.com>", FromUser("Jürgen"))
+
+	msg := NewMessageFrom([]string{"user@example.com"}, FromUser("Jürgen"), "Subject", "Body")
+	assert.Equal(t, []string{"=?utf-8?q?J=C3=BCrgen_via_Gitea?= <gitea@example.com>"}, msg.GetHeader("From"))
+
+	setting.MailService.FromDisplayNameFormat = ""
+	assert.Equal(t, `"Gitea" <gitea@example.com>`, FromUser("Alice"))
+}
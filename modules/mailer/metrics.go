@@ -0,0 +1,112 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w metricsWriter) value(name, labels string, v float64) {
+	if len(labels) > 0 {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// counters writes a counter with one label.
+func (w metricsWriter) counters(name, label, help string, values map[string]int64) {
+	w.header(name, "counter", help)
+	for _, key := range sortedKeys(values) {
+		w.value(name, fmt.Sprintf("%s=%q", label, key), float64(values[key]))
+	}
+}
+
+func (w metricsWriter) histogram(name, label, help string, values map[string]*Histogram) {
+	w.header(name, "histogram", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := values[key]
+		labels := fmt.Sprintf("%s=%q", label, key)
+		for i, bound := range h.Buckets {
+			w.value(name+"_bucket", fmt.Sprintf(`%s,le="%s"`, labels, strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.Counts[i]))
+		}
+		w.value(name+"_bucket", labels+`,le="+Inf"`, float64(h.Count))
+		w.value(name+"_sum", labels, h.Sum)
+		w.value(name+"_count", labels, float64(h.Count))
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteMetrics writes the metrics of the mail service in the
+// Prometheus text exposition format.
+func WriteMetrics(out io.Writer) error {
+	w := metricsWriter{bufio.NewWriter(out)}
+
+	if daemon != nil {
+		w.header("gitea_mail_queue_length", "gauge", "Number of mails waiting in the queue.")
+		w.value("gitea_mail_queue_length", "", float64(daemon.queue.Len()))
+
+		running, _, _ := daemon.Workers()
+		w.header("gitea_mail_workers", "gauge", "Number of running mail worker routines.")
+		w.value("gitea_mail_workers", "", float64(running))
+
+		if daemon.breaker != nil {
+			state := daemon.breaker.State()
+			w.header("gitea_mail_circuit_state", "gauge", "State of the circuit breaker around the sender backend, 1 for the current state.")
+			for _, s := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+				v := 0.0
+				if s == state {
+					v = 1
+				}
+				w.value("gitea_mail_circuit_state", fmt.Sprintf("state=%q", s), v)
+			}
+		}
+	}
+
+	s := GetStats()
+	w.counters("gitea_mail_sent_total", "backend", "Number of mails sent successfully.", s.Sent)
+	w.counters("gitea_mail_failed_total", "backend", "Number of failed delivery attempts.", s.Failed)
+	w.histogram("gitea_mail_send_duration_seconds", "backend", "Duration of delivery attempts.", s.Durations)
+	w.counters("gitea_mail_queue_overflows_total", "policy", "Number of mails which did not fit into the queue.", s.Overflows)
+	w.counters("gitea_mail_opens_total", "category", "Number of tracked mails opened.", s.Opens)
+	w.counters("gitea_mail_clicks_total", "category", "Number of clicked links of tracked mails.", s.Clicks)
+
+	w.header("gitea_mail_retries_total", "counter", "Number of failed mails queued again.")
+	w.value("gitea_mail_retries_total", "", float64(s.Retries))
+	w.header("gitea_mail_connections_opened_total", "counter", "Number of connections opened to the mail server.")
+	w.value("gitea_mail_connections_opened_total", "", float64(s.ConnectionsOpened))
+	w.header("gitea_mail_connections_closed_total", "counter", "Number of connections to the mail server closed.")
+	w.value("gitea_mail_connections_closed_total", "", float64(s.ConnectionsClosed))
+	w.header("gitea_mail_circuit_opens_total", "counter", "Number of times the delivery was paused after consecutive failures.")
+	w.value("gitea_mail_circuit_opens_total", "", float64(s.CircuitOpens))
+
+	return w.Flush()
+}
@@ -0,0 +1,40 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	statsLock.Lock()
+	stats = newStats()
+	statsLock.Unlock()
+
+	countSend("smtp", 200*time.Millisecond, nil)
+	countSend("smtp", 3*time.Second, errors.New("failed"))
+	countRetry()
+	countConnection(true)
+	countCircuitOpen()
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMetrics(&buf))
+	metrics := buf.String()
+	assert.Contains(t, metrics, "# TYPE gitea_mail_sent_total counter\ngitea_mail_sent_total{backend=\"smtp\"} 1\n")
+	assert.Contains(t, metrics, "gitea_mail_failed_total{backend=\"smtp\"} 1\n")
+	assert.Contains(t, metrics, "gitea_mail_send_duration_seconds_bucket{backend=\"smtp\",le=\"0.25\"} 1\n")
+	assert.Contains(t, metrics, "gitea_mail_send_duration_seconds_bucket{backend=\"smtp\",le=\"5\"} 2\n")
+	assert.Contains(t, metrics, "gitea_mail_send_duration_seconds_bucket{backend=\"smtp\",le=\"+Inf\"} 2\n")
+	assert.Contains(t, metrics, "gitea_mail_send_duration_seconds_sum{backend=\"smtp\"} 3.2\n")
+	assert.Contains(t, metrics, "gitea_mail_retries_total 1\n")
+	assert.Contains(t, metrics, "gitea_mail_connections_opened_total 1\n")
+	assert.Contains(t, metrics, "gitea_mail_connections_closed_total 0\n")
+	assert.Contains(t, metrics, "gitea_mail_circuit_opens_total 1\n")
+}
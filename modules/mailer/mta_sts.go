@@ -0,0 +1,188 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// mtaSTSMaxAge is the maximum lifetime of a policy, one year.
+const mtaSTSMaxAge = 31557600 * time.Second
+
+// mtaSTSPolicy is the MTA-STS policy of a domain (RFC 8461).
+type mtaSTSPolicy struct {
+	ID      string
+	Mode    string // enforce, testing or none
+	MX      []string
+	Expires time.Time
+}
+
+// matches reports whether the MX host is allowed by the policy. Patterns
+// like *.example.com match exactly one label.
+func (p *mtaSTSPolicy) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			dot := strings.IndexByte(host, '.')
+			if dot > 0 && host[dot:] == pattern[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMTASTSPolicy parses the policy file of a domain.
+func parseMTASTSPolicy(body string) (*mtaSTSPolicy, error) {
+	p := new(mtaSTSPolicy)
+	var version string
+	maxAge := -1
+	for _, line := range strings.Split(body, "\n") {
+		kv := strings.SplitN(strings.TrimRight(line, "\r"), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+			maxAge = age
+		}
+	}
+
+	switch {
+	case version != "STSv1":
+		return nil, fmt.Errorf("unsupported version %q", version)
+	case p.Mode != "enforce" && p.Mode != "testing" && p.Mode != "none":
+		return nil, fmt.Errorf("invalid mode %q", p.Mode)
+	case maxAge < 0:
+		return nil, errors.New("max_age is missing")
+	case len(p.MX) == 0 && p.Mode != "none":
+		return nil, errors.New("mx is missing")
+	}
+	ttl := time.Duration(maxAge) * time.Second
+	if ttl > mtaSTSMaxAge {
+		ttl = mtaSTSMaxAge
+	}
+	p.Expires = time.Now().Add(ttl)
+	return p, nil
+}
+
+// mtaSTSClient fetches the policies. Redirects must not be followed.
+var mtaSTSClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fetchMTASTSPolicy returns the policy file of the domain.
+var fetchMTASTSPolicy = func(domain string) (string, error) {
+	resp, err := mtaSTSClient.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("policy request returned %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return "", fmt.Errorf("policy has content type %q", mediaType)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 64<<10))
+	return string(body), err
+}
+
+// lookupMTASTSID returns the id of the policy announced in DNS, or the empty
+// string if the domain has no policy.
+var lookupMTASTSID = func(domain string) (string, error) {
+	txts, err := net.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(field), "=", 2); len(kv) == 2 && kv[0] == "id" {
+				return kv[1], nil
+			}
+		}
+	}
+	return "", nil
+}
+
+var (
+	mtaSTSLock     sync.Mutex
+	mtaSTSPolicies = make(map[string]*mtaSTSPolicy)
+)
+
+// getMTASTSPolicy returns the policy of the domain, or nil if it has none.
+// Policies are cached until they expire and refreshed once the id in DNS
+// changes. A policy that can not be refreshed is used as long as it is
+// cached, an attacker blocking both would otherwise disable it.
+func getMTASTSPolicy(domain string) *mtaSTSPolicy {
+	domain = strings.ToLower(domain)
+	mtaSTSLock.Lock()
+	cached := mtaSTSPolicies[domain]
+	mtaSTSLock.Unlock()
+	if cached != nil && time.Now().After(cached.Expires) {
+		cached = nil
+	}
+
+	id, err := lookupMTASTSID(domain)
+	if err != nil {
+		log.Warn("MTA-STS: failed to look up the policy of %s: %v", domain, err)
+		return cached
+	}
+	if len(id) == 0 || (cached != nil && cached.ID == id) {
+		return cached
+	}
+
+	body, err := fetchMTASTSPolicy(domain)
+	if err != nil {
+		log.Warn("MTA-STS: failed to fetch the policy of %s: %v", domain, err)
+		return cached
+	}
+	policy, err := parseMTASTSPolicy(body)
+	if err != nil {
+		log.Warn("MTA-STS: invalid policy of %s: %v", domain, err)
+		return cached
+	}
+	policy.ID = id
+
+	mtaSTSLock.Lock()
+	mtaSTSPolicies[domain] = policy
+	mtaSTSLock.Unlock()
+	return policy
+}
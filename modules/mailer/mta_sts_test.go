@@ -0,0 +1,75 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	p, err := parseMTASTSPolicy("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "enforce", p.Mode)
+	assert.Equal(t, []string{"mail.example.com", "*.example.net"}, p.MX)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), p.Expires, time.Minute)
+
+	assert.True(t, p.matches("mail.example.com"))
+	assert.True(t, p.matches("MAIL.example.com."))
+	assert.True(t, p.matches("mx1.example.net"))
+	assert.False(t, p.matches("example.net"))
+	assert.False(t, p.matches("a.mx1.example.net"))
+	assert.False(t, p.matches("mail.example.org"))
+
+	p, err = parseMTASTSPolicy("version: STSv1\nmode: none\nmax_age: 99999999999")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(mtaSTSMaxAge), p.Expires, time.Minute)
+
+	for _, body := range []string{
+		"mode: enforce\nmx: mail.example.com\nmax_age: 86400",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400",
+		"version: STSv1\nmode: enforce\nmax_age: 86400",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com",
+	} {
+		_, err = parseMTASTSPolicy(body)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestGetMTASTSPolicy(t *testing.T) {
+	lookup, fetch := lookupMTASTSID, fetchMTASTSPolicy
+	defer func() { lookupMTASTSID, fetchMTASTSPolicy = lookup, fetch }()
+
+	id, fetches := "1", 0
+	var fetchErr error
+	lookupMTASTSID = func(string) (string, error) { return id, nil }
+	fetchMTASTSPolicy = func(domain string) (string, error) {
+		fetches++
+		return "version: STSv1\nmode: enforce\nmx: mail." + domain + "\nmax_age: 86400", fetchErr
+	}
+
+	p := getMTASTSPolicy("Example.com")
+	if assert.NotNil(t, p) {
+		assert.Equal(t, "1", p.ID)
+		assert.Equal(t, []string{"mail.example.com"}, p.MX)
+	}
+	assert.Equal(t, p, getMTASTSPolicy("example.com"))
+	assert.Equal(t, 1, fetches)
+
+	// A policy which can not be refreshed is used until it expires.
+	id, fetchErr = "2", errors.New("unreachable")
+	assert.Equal(t, p, getMTASTSPolicy("example.com"))
+	assert.Equal(t, 2, fetches)
+
+	fetchErr = nil
+	assert.Equal(t, "2", getMTASTSPolicy("example.com").ID)
+	assert.Equal(t, 3, fetches)
+
+	id = ""
+	assert.Nil(t, getMTASTSPolicy("example.org"))
+}
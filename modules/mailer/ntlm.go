@@ -0,0 +1,190 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/smtp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiate56               = 0x80000000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity | ntlmNegotiateTargetInfo |
+		ntlmNegotiate128 | ntlmNegotiate56
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmAuth implements the NTLM authentication mechanism (MS-NLMP) with
+// NTLMv2 responses, as offered by Exchange servers. The user name can
+// be given as DOMAIN\user.
+type ntlmAuth struct {
+	domain, username, password string
+	now                        func() time.Time // Overridden by tests.
+}
+
+func newNTLMAuth(username, password string) *ntlmAuth {
+	a := &ntlmAuth{username: username, password: password, now: time.Now}
+	if i := strings.IndexByte(username, '\\'); i >= 0 {
+		a.domain, a.username = username[:i], username[i+1:]
+	}
+	return a
+}
+
+func (a *ntlmAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	// NEGOTIATE_MESSAGE without domain and workstation.
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return "NTLM", msg, nil
+}
+
+func (a *ntlmAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// CHALLENGE_MESSAGE
+	if len(fromServer) < 48 || !bytes.Equal(fromServer[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(fromServer[8:]) != 2 {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(fromServer[20:])
+	serverChallenge := fromServer[24:32]
+	targetInfo, err := ntlmReadField(fromServer, 40)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err = rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	ntResponse, lmResponse := a.responses(serverChallenge, clientChallenge, targetInfo)
+
+	// AUTHENTICATE_MESSAGE
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		ntlmString(a.domain),
+		ntlmString(a.username),
+		nil, // Workstation
+		nil, // EncryptedRandomSessionKey
+	}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		ntlmWriteField(msg[12+8*i:], len(field), len(msg))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags&ntlmNegotiateFlags)
+	return msg, nil
+}
+
+// responses calculates the NTLMv2 and LMv2 responses.
+func (a *ntlmAuth) responses(serverChallenge, clientChallenge, targetInfo []byte) (nt, lm []byte) {
+	h := md4.New()
+	h.Write(ntlmString(a.password))
+	ntowf := ntlmHMAC(h.Sum(nil), ntlmString(strings.ToUpper(a.username)+a.domain))
+
+	// Prefer the server time if given, as the client time may be off.
+	timestamp := ntlmAvPair(targetInfo, ntlmAvTimestamp)
+	if len(timestamp) != 8 {
+		timestamp = make([]byte, 8)
+		// Windows FILETIME: 100ns intervals since 1601-01-01.
+		now := a.now()
+		binary.LittleEndian.PutUint64(timestamp, uint64((now.Unix()+11644473600)*10000000+int64(now.Nanosecond()/100)))
+	}
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	proof := ntlmHMAC(ntowf, serverChallenge, temp.Bytes())
+	nt = append(proof, temp.Bytes()...)
+	lm = append(ntlmHMAC(ntowf, serverChallenge, clientChallenge), clientChallenge...)
+	return nt, lm
+}
+
+func ntlmHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ntlmString encodes the string as UTF-16LE.
+func ntlmString(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func ntlmReadField(msg []byte, pos int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[pos:]))
+	offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	if offset+length > len(msg) {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+	return msg[offset : offset+length], nil
+}
+
+func ntlmWriteField(b []byte, length, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(length))
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+// ntlmAvPair returns the value of the attribute in the target information.
+func ntlmAvPair(info []byte, id uint16) []byte {
+	for len(info) >= 4 {
+		avID := binary.LittleEndian.Uint16(info)
+		avLen := int(binary.LittleEndian.Uint16(info[2:]))
+		if avID == ntlmAvEOL || len(info) < 4+avLen {
+			break
+		} else if avID == id {
+			return info[4 : 4+avLen]
+		}
+		info = info[4+avLen:]
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNTLMResponses(t *testing.T) {
+	// NTLMv2 example from MS-NLMP section 4.2.4.
+	a := newNTLMAuth(`Domain\User`, "Password")
+	a.now = func() time.Time { return time.Unix(-11644473600, 0) }
+	assert.Equal(t, "Domain", a.domain)
+	assert.Equal(t, "User", a.username)
+
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+
+	nt, lm := a.responses(serverChallenge, clientChallenge, targetInfo)
+	assert.Equal(t, "68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(nt[:16]))
+	assert.Equal(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa", hex.EncodeToString(lm))
+}
+
+func TestNTLMAuth(t *testing.T) {
+	a := newNTLMAuth(`EXAMPLE\gitea`, "secret")
+
+	_, _, err := a.Start(&smtp.ServerInfo{})
+	assert.Error(t, err)
+	proto, negotiate, err := a.Start(&smtp.ServerInfo{TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "NTLM", proto)
+	assert.Equal(t, "NTLMSSP\x00\x01\x00\x00\x00", string(negotiate[:12]))
+
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0000000000")
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateFlags)
+	ntlmWriteField(challenge[40:], len(targetInfo), len(challenge))
+	challenge = append(challenge, targetInfo...)
+
+	authenticate, err := a.Next(challenge, true)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, binary.LittleEndian.Uint32(authenticate[8:]))
+	domain, err := ntlmReadField(authenticate, 28)
+	assert.NoError(t, err)
+	assert.Equal(t, ntlmString("EXAMPLE"), domain)
+	user, err := ntlmReadField(authenticate, 36)
+	assert.NoError(t, err)
+	assert.Equal(t, ntlmString("gitea"), user)
+	nt, err := ntlmReadField(authenticate, 20)
+	assert.NoError(t, err)
+	assert.Len(t, nt, 16+28+len(targetInfo)+4)
+
+	_, err = a.Next([]byte("invalid"), true)
+	assert.Error(t, err)
+}
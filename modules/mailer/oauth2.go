@@ -0,0 +1,67 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+)
+
+// oauth2TokenSource requests OAuth2 access tokens from a token endpoint and
+// caches them until shortly before they expire.
+type oauth2TokenSource struct {
+	provider string
+	tokenURL string
+	// params returns the form parameters of the token request.
+	params func() (map[string]string, error)
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token returns a valid access token.
+// This method is thread-safe.
+func (s *oauth2TokenSource) Token() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.token) > 0 && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	params, err := s.params()
+	if err != nil {
+		return "", err
+	}
+
+	req := httplib.Post(s.tokenURL)
+	for k, v := range params {
+		req.Param(k, v)
+	}
+
+	var resp oauth2TokenResponse
+	if err = doAPIRequest(s.provider+" OAuth2", req, &resp); err != nil {
+		return "", err
+	}
+
+	s.token = resp.AccessToken
+	s.expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Reset drops the cached token, e.g. after it has been rejected.
+func (s *oauth2TokenSource) Reset() {
+	s.lock.Lock()
+	s.token = ""
+	s.lock.Unlock()
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// EncryptTo marks the message to be encrypted to the given keys using
+// PGP/MIME (RFC 3156). The message is encrypted when it is queued, after
+// the mailer added the tracking and redirected it. The header fields,
+// including the subject, stay readable.
+func (m *Message) EncryptTo(to openpgp.EntityList) error {
+	if len(to) == 0 {
+		return errors.New("pgp: no keys to encrypt to")
+	}
+	m.encryptTo = to
+	return nil
+}
+
+// encryptPending encrypts the message marked by EncryptTo. Later changes
+// to the message are not applied.
+func (m *Message) encryptPending() error {
+	to := m.encryptTo
+	if len(to) == 0 {
+		return nil
+	}
+
+	var raw bytes.Buffer
+	if _, err := m.WriteTo(&raw); err != nil {
+		return err
+	}
+	outer, entity := splitContentEntity(raw.Bytes())
+
+	var encrypted bytes.Buffer
+	aw, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	pw, err := openpgp.Encrypt(aw, to, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("pgp: encrypt: %v", err)
+	}
+	if _, err = pw.Write(entity.Bytes()); err != nil {
+		return err
+	}
+	if err = pw.Close(); err != nil {
+		return err
+	}
+	if err = aw.Close(); err != nil {
+		return err
+	}
+
+	boundary := randomBoundary()
+	outer.WriteString("Mime-Version: 1.0\r\n")
+	outer.WriteString(`Content-Type: multipart/encrypted; protocol="application/pgp-encrypted"; boundary="` + boundary + "\"\r\n")
+	outer.WriteString("\r\n")
+	outer.WriteString("--" + boundary + "\r\n")
+	outer.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	outer.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	outer.WriteString("Version: 1\r\n\r\n")
+	outer.WriteString("--" + boundary + "\r\n")
+	outer.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	outer.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	outer.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	outer.Write(bytes.Replace(encrypted.Bytes(), []byte("\n"), []byte("\r\n"), -1))
+	outer.WriteString("\r\n--" + boundary + "--\r\n")
+
+	m.raw = outer.Bytes()
+	m.encryptTo = nil
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestMessageEncrypt(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", SendAsPlainText: true, RedirectTo: "dev@example.com"}
+
+	entity, err := openpgp.NewEntity("User Two", "", "user2@example.com", nil)
+	assert.NoError(t, err)
+	for _, id := range entity.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA256
+	}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Secret content")
+	assert.Error(t, msg.EncryptTo(nil))
+	assert.NoError(t, msg.EncryptTo(openpgp.EntityList{entity}))
+	redirectRecipients(msg)
+	assert.NoError(t, msg.encryptPending())
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), "Secret content")
+
+	parsed, err := mail.ReadMessage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Subject", parsed.Header.Get("Subject"))
+	// The message is encrypted after it was redirected.
+	assert.Equal(t, "dev@example.com", parsed.Header.Get("To"))
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/encrypted", mediaType)
+
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	_, err = mr.NextPart()
+	assert.NoError(t, err)
+	p, err := mr.NextPart()
+	assert.NoError(t, err)
+
+	block, err := armor.Decode(p)
+	assert.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	assert.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(md.UnverifiedBody)
+	assert.NoError(t, err)
+	assert.Contains(t, string(decrypted), "Content-Type: text/plain; charset=UTF-8\r\n")
+	assert.Contains(t, string(decrypted), "Secret content")
+}
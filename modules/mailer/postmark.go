@@ -0,0 +1,137 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// postmarkAPIURL is the endpoint of the email API, tests change it to a local server.
+var postmarkAPIURL = "https://api.postmarkapp.com/email"
+
+// Postmark error codes which will not go away by retrying the message.
+// See https://postmarkapp.com/developer/api/overview#error-codes
+var postmarkPermanentErrors = map[int]bool{
+	300: true, // Invalid email request
+	406: true, // Inactive recipient
+}
+
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     []byte
+	ContentType string
+	ContentID   string `json:",omitempty"`
+}
+
+type postmarkMail struct {
+	From          string
+	To            string
+	Cc            string `json:",omitempty"`
+	Bcc           string `json:",omitempty"`
+	ReplyTo       string `json:",omitempty"`
+	Subject       string
+	TextBody      string `json:",omitempty"`
+	HTMLBody      string `json:"HtmlBody,omitempty"`
+	Tag           string `json:",omitempty"`
+	MessageStream string
+	Headers       []*postmarkHeader     `json:",omitempty"`
+	Attachments   []*postmarkAttachment `json:",omitempty"`
+}
+
+type postmarkResponse struct {
+	ErrorCode int
+	Message   string
+}
+
+// Sender implementation for the Postmark email API.
+type postmarkSender struct {
+	serverToken         string
+	transactionalStream string
+	broadcastStream     string
+}
+
+func newPostmarkSender(opts *setting.Mailer) (Sender, error) {
+	return &postmarkSender{
+		serverToken:         opts.PostmarkServerToken,
+		transactionalStream: opts.PostmarkTransactionalStream,
+		broadcastStream:     opts.PostmarkBroadcastStream,
+	}, nil
+}
+
+// stream returns the message stream for the category of the message.
+func (s *postmarkSender) stream(msg *Message) string {
+	if msg.Category.IsBulk() {
+		return s.broadcastStream
+	}
+	return s.transactionalStream
+}
+
+// Send the message synchronous.
+func (s *postmarkSender) Send(msg *Message) error {
+	c, err := msg.content()
+	if err != nil {
+		return err
+	}
+
+	m := &postmarkMail{
+		From:          c.From.String(),
+		To:            addressList(c.To),
+		Cc:            addressList(c.Cc),
+		Bcc:           addressList(c.Bcc),
+		ReplyTo:       addressList(c.ReplyTo),
+		Subject:       c.Subject,
+		TextBody:      c.Text,
+		HTMLBody:      c.HTML,
+		Tag:           string(msg.Category),
+		MessageStream: s.stream(msg),
+	}
+	for name, value := range c.Headers {
+		m.Headers = append(m.Headers, &postmarkHeader{Name: name, Value: value})
+	}
+	for _, a := range c.Attachments {
+		attachment := &postmarkAttachment{
+			Name:        a.Filename,
+			Content:     a.Data,
+			ContentType: a.ContentType,
+		}
+		if len(a.ContentID) > 0 {
+			attachment.ContentID = "cid:" + a.ContentID
+		}
+		m.Attachments = append(m.Attachments, attachment)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req := httplib.Post(postmarkAPIURL).
+		Header("X-Postmark-Server-Token", s.serverToken).
+		Header("Accept", "application/json").
+		Header("Content-Type", "application/json").
+		Body(data)
+	err = doAPIRequest("Postmark", req, nil)
+	if apiErr, ok := err.(ErrAPIRequest); ok {
+		var resp postmarkResponse
+		if json.Unmarshal([]byte(apiErr.Body), &resp) == nil && postmarkPermanentErrors[resp.ErrorCode] {
+			return ErrPermanentFailure{fmt.Errorf("Postmark rejected the message [code: %d]: %s", resp.ErrorCode, resp.Message)}
+		}
+	}
+	return permanentAPIError(err)
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *postmarkSender) Close() error {
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostmarkSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+	defer func(url string) { postmarkAPIURL = url }(postmarkAPIURL)
+	postmarkAPIURL = server.URL + "/email"
+
+	setting.MailService = &setting.Mailer{
+		From:                        "Gitea <gitea@example.com>",
+		PostmarkServerToken:         "token",
+		PostmarkTransactionalStream: "outbound",
+		PostmarkBroadcastStream:     "broadcast",
+	}
+	s, err := newPostmarkSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	server.reply(http.StatusOK, `{"ErrorCode":0,"Message":"OK"}`)
+	assert.NoError(t, s.Send(msg))
+
+	req := server.last()
+	assert.Equal(t, "/email", req.Path)
+	assert.Equal(t, "token", req.Header.Get("X-Postmark-Server-Token"))
+	var m postmarkMail
+	assert.NoError(t, json.Unmarshal(req.Body, &m))
+	assert.Equal(t, `"Gitea" <gitea@example.com>`, m.From)
+	assert.Equal(t, `"User" <user@example.com>`, m.To)
+	assert.Equal(t, "Subject", m.Subject)
+	assert.Equal(t, "outbound", m.MessageStream)
+	assert.NotEmpty(t, m.HTMLBody)
+
+	server.reply(http.StatusUnprocessableEntity, `{"ErrorCode":406,"Message":"Inactive recipient"}`)
+	err = s.Send(msg)
+	assert.True(t, IsErrPermanentFailure(err), "%v", err)
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Event is the activity a notification mail is sent for.
+type Event string
+
+// The events notification mails are sent for.
+const (
+	// EventMention is used for mails to users mentioned in an issue or comment.
+	EventMention Event = "mention"
+	// EventAssigned is used for mails about issues assigned to the receiver.
+	EventAssigned Event = "assigned"
+	// EventWatched is used for mails about activity in watched repositories
+	// and issues the receiver participated in.
+	EventWatched Event = "watched"
+)
+
+// reason returns the X-Gitea-Reason of notification mails for the event.
+func (e Event) reason() string {
+	switch e {
+	case EventMention:
+		return "mention"
+	case EventAssigned:
+		return "assign"
+	case EventWatched:
+		return "watch"
+	}
+	return ""
+}
+
+// ErrNoRecipients is returned if none of the receivers wants to get the mail,
+// or all of them are suppressed or in domains mails may not be sent to.
+var ErrNoRecipients = errors.New("no receiver wants to get the mail")
+
+// PreferenceResolver reports whether the owner of the address wants to get
+// notification mails for the event.
+type PreferenceResolver func(to string, event Event) bool
+
+var (
+	preferenceResolverLock sync.RWMutex
+	preferenceResolver     PreferenceResolver
+)
+
+// SetPreferenceResolver sets the function consulted for all receivers of
+// notification mails before they are queued.
+// This method is thread-safe.
+func SetPreferenceResolver(r PreferenceResolver) {
+	preferenceResolverLock.Lock()
+	preferenceResolver = r
+	preferenceResolverLock.Unlock()
+}
+
+// Wants reports whether the owner of the address wants to get notification
+// mails for the event. Without a resolver all mails are wanted.
+func Wants(to string, event Event) bool {
+	preferenceResolverLock.RLock()
+	resolve := preferenceResolver
+	preferenceResolverLock.RUnlock()
+	if resolve == nil || len(event) == 0 {
+		return true
+	}
+	return resolve(to, event)
+}
+
+// allowedDomain checks the domain of the address against ALLOWED_DOMAINS
+// and BLOCKED_DOMAINS, which include their subdomains. Both are compared in
+// their lower case ASCII form.
+func allowedDomain(addr string) bool {
+	domain := strings.ToLower(idnaDomain(addr[strings.LastIndexByte(addr, '@')+1:]))
+	matches := func(domains []string) bool {
+		for _, d := range domains {
+			d = strings.ToLower(idnaDomain(d))
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+	opts := setting.MailService
+	if len(opts.AllowedDomains) > 0 && !matches(opts.AllowedDomains) {
+		return false
+	}
+	return !matches(opts.BlockedDomains)
+}
+
+// filterDomains removes the receivers in domains mails may not be sent to,
+// see filterAddresses.
+func filterDomains(msg *Message) bool {
+	return filterAddresses(msg, func(addr string) bool {
+		if !allowedDomain(addr) {
+			log.Info("Suppressing e-mail to %s: %s - recipient domain not allowed", addr, msg.Info)
+			return false
+		}
+		return true
+	})
+}
+
+// filterRecipients removes the receivers in domains mails may not be sent
+// to, not wanting to get the notification mail and the suppressed receivers,
+// see filterAddresses.
+func filterRecipients(msg *Message) bool {
+	return filterDomains(msg) && filterAddresses(msg, func(addr string) bool {
+		return Wants(addr, msg.Event) && !Suppressed(addr, msg.Category)
+	})
+}
+
+// filterAddresses removes the receivers whose address is not kept from the
+// "To", "Cc" and "Bcc" headers of the message. The "To" header of a mail left with
+// Bcc receivers only is set to the undisclosed recipients. It returns false
+// if no receiver is left.
+func filterAddresses(msg *Message, keep func(addr string) bool) bool {
+	left := 0
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		tos := msg.addresses(field)
+		wanted := make([]string, 0, len(tos))
+		for _, to := range tos {
+			if to == undisclosedRecipients {
+				wanted = append(wanted, to)
+				continue
+			}
+			addr := to
+			if parsed, err := mail.ParseAddress(to); err == nil {
+				addr = parsed.Address
+			}
+			if keep(addr) {
+				wanted = append(wanted, to)
+				left++
+			}
+		}
+		if len(wanted) < len(tos) {
+			if field == "To" && len(wanted) == 0 {
+				wanted = append(wanted, undisclosedRecipients)
+			}
+			msg.SetAddresses(field, wanted...)
+		}
+	}
+	return left > 0
+}
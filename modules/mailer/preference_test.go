@@ -0,0 +1,94 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRecipients(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	SetPreferenceResolver(func(to string, event Event) bool {
+		return to != "muted@example.com" || event == EventMention
+	})
+	defer SetPreferenceResolver(nil)
+
+	msg := NewMessage([]string{"user@example.com", "Muted <muted@example.com>"}, "Subject", "Body")
+	msg.Event = EventWatched
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{"user@example.com"}, msg.GetHeader("To"))
+
+	msg = NewMessage([]string{"muted@example.com"}, "Subject", "Body")
+	msg.Event = EventWatched
+	assert.False(t, filterRecipients(msg))
+
+	msg = NewMessage([]string{"muted@example.com"}, "Subject", "Body")
+	msg.Event = EventMention
+	assert.True(t, filterRecipients(msg))
+
+	// Mails without an event, e.g. account mails, are always sent.
+	msg = NewMessage([]string{"muted@example.com"}, "Subject", "Body")
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{"muted@example.com"}, msg.GetHeader("To"))
+}
+
+func TestDaemonSend_Requeued(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	resolved := 0
+	SetPreferenceResolver(func(to string, event Event) bool {
+		resolved++
+		return true
+	})
+	defer SetPreferenceResolver(nil)
+	q := newChannelQueue(2, "block", 0, nil)
+	defer q.Close()
+	d := &Daemon{queue: q}
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.Event = EventWatched
+	assert.NoError(t, d.send(msg))
+	assert.Equal(t, 1, resolved)
+
+	// The preferences are not resolved again for a message queued before.
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.Event = EventWatched
+	msg.queued = time.Now()
+	assert.NoError(t, d.send(msg))
+	assert.Equal(t, 1, resolved)
+}
+
+func TestFilterRecipients_Domains(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		From:           "gitea@example.com",
+		AllowedDomains: []string{"example.com", "bücher.example"},
+		BlockedDomains: []string{"blocked.example.com"},
+	}
+
+	msg := NewMessage([]string{"user@example.com", "user@sub.example.com", "user@blocked.example.com",
+		"user@bücher.example", "user@example.org"}, "Subject", "Body")
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{"user@example.com", "user@sub.example.com", "user@xn--bcher-kva.example"}, msg.GetHeader("To"))
+
+	msg = NewMessage([]string{"user@example.org"}, "Subject", "Body")
+	assert.False(t, filterRecipients(msg))
+
+	// Cc receivers are filtered as well, whatever the case of the domains.
+	setting.MailService.AllowedDomains = []string{"Example.COM", "BÜCHER.example"}
+	msg = NewMessage([]string{"user@EXAMPLE.com"}, "Subject", "Body")
+	msg.SetAddresses("Cc", "user@example.org", "user@Bücher.example")
+	assert.True(t, filterRecipients(msg))
+	assert.Equal(t, []string{"user@EXAMPLE.com"}, msg.GetHeader("To"))
+	assert.Equal(t, []string{"user@xn--bcher-kva.example"}, msg.GetHeader("Cc"))
+
+	setting.MailService.AllowedDomains = nil
+	msg = NewMessage([]string{"user@example.org", "user@blocked.example.com"}, "Subject", "Body")
+	assert.True(t, filterDomains(msg))
+	assert.Equal(t, []string{"user@example.org"}, msg.GetHeader("To"))
+}
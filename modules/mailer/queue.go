@@ -0,0 +1,142 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// ErrQueueFull is returned if a message is dropped because the queue is full.
+var ErrQueueFull = errors.New("mail queue is full")
+
+// PendingMessage describes a message waiting in the queue.
+type PendingMessage struct {
+	ID        int64     `json:"id"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	Info      string    `json:"info"`
+	Priority  Priority  `json:"priority"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Queued    time.Time `json:"queued_at"`
+	Scheduled time.Time `json:"scheduled_at"`
+	Sending   bool      `json:"sending"` // Already handed to a worker, it cannot be changed anymore.
+}
+
+func newPendingMessage(id int64, msg *Message) *PendingMessage {
+	pm := &PendingMessage{
+		ID:        id,
+		To:        msg.GetHeader("To"),
+		Info:      msg.Info,
+		Priority:  msg.priority(),
+		Attempts:  msg.attempts,
+		Error:     msg.lastError,
+		Queued:    msg.queued,
+		Scheduled: msg.sendAt,
+	}
+	if subject := msg.GetHeader("Subject"); len(subject) > 0 {
+		pm.Subject = subject[0]
+	}
+	return pm
+}
+
+func sortPendingMessages(list []*PendingMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+}
+
+// ErrPendingMessageNotExist represents a "PendingMessageNotExist" kind of error.
+type ErrPendingMessageNotExist struct {
+	ID int64
+}
+
+// IsErrPendingMessageNotExist checks if an error is a ErrPendingMessageNotExist.
+func IsErrPendingMessageNotExist(err error) bool {
+	_, ok := err.(ErrPendingMessageNotExist)
+	return ok
+}
+
+func (err ErrPendingMessageNotExist) Error() string {
+	return fmt.Sprintf("pending message does not exist [id: %d]", err.ID)
+}
+
+// Queue defines a mail queue backend implementation interface.
+type Queue interface {
+	// Push adds the message to the queue. Messages scheduled for a
+	// later time are held back until they are due.
+	Push(msg *Message) error
+
+	// Chan returns the channel the workers receive queued messages from.
+	Chan() <-chan *Message
+
+	// Done marks the message received from Chan as processed.
+	Done(msg *Message) error
+
+	// Len returns the number of messages waiting in the queue,
+	// not counting the scheduled messages which are not due yet.
+	Len() int
+
+	// List returns the messages waiting in the queue, including the
+	// scheduled messages.
+	List() ([]*PendingMessage, error)
+
+	// Remove deletes the waiting message from the queue.
+	Remove(id int64) error
+
+	// Expedite sends the waiting message next, even if it is
+	// scheduled for later.
+	Expedite(id int64) error
+
+	// DeadLetters returns the store of permanently failed messages.
+	DeadLetters() DeadLetterStore
+
+	// Close the queue and release its resources.
+	Close() error
+}
+
+// createQueue creates the mail queue, depending on the chosen queue type.
+func createQueue() (Queue, error) {
+	switch setting.MailService.QueueType {
+	case "redis":
+		return newRedisQueue(setting.MailService.QueueConnStr, setting.MailService.QueueConsumer,
+			setting.MailService.QueueVisibilityTimeout)
+	case "nats":
+		return newBrokerQueue(setting.MailService.QueueConnStr, setting.MailService.QueueConsumer)
+	}
+
+	q, err := newLocalQueue(setting.MailService.QueueLength, setting.MailService.QueuePath)
+	if err != nil || len(setting.MailService.Partitions) == 0 {
+		return q, err
+	}
+	return newPartitionedQueue(q, setting.MailService.Partitions)
+}
+
+// newLocalQueue creates a persistent queue at the path, or a channel queue
+// of the length spilling to the path.
+func newLocalQueue(queueLen int, path string) (Queue, error) {
+	if setting.MailService.QueueType == "persistent" {
+		q, err := newPersistentQueue(path)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+
+	var spill *persistentQueue
+	if setting.MailService.OverflowPolicy == "spill" {
+		var err error
+		if spill, err = newPersistentQueue(path); err != nil {
+			return nil, err
+		}
+	}
+	return newChannelQueue(queueLen, setting.MailService.OverflowPolicy,
+		setting.MailService.OverflowTimeout, spill), nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// natsTestServer speaks enough of the NATS protocol to route published
+// messages to the first subscriber of every queue group.
+type natsTestServer struct {
+	listener net.Listener
+
+	lock      sync.Mutex
+	conns     []net.Conn
+	subs      []natsTestSubscription
+	published [][]byte
+}
+
+type natsTestSubscription struct {
+	w       io.Writer
+	subject string
+	group   string
+	sid     string
+}
+
+func newNATSTestServer(t *testing.T) *natsTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &natsTestServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *natsTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.lock.Lock()
+	s.conns = append(s.conns, conn)
+	s.lock.Unlock()
+
+	w := &lockedWriter{w: conn}
+	fmt.Fprintf(w, "INFO {\"max_payload\":1048576}\r\n")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "PING":
+			fmt.Fprintf(w, "PONG\r\n")
+		case "SUB":
+			s.lock.Lock()
+			s.subs = append(s.subs, natsTestSubscription{w, fields[1], fields[2], fields[3]})
+			s.lock.Unlock()
+		case "PUB":
+			n, _ := strconv.Atoi(fields[2])
+			data := make([]byte, n+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.published = append(s.published, data[:n])
+			groups := make(map[string]bool)
+			for _, sub := range s.subs {
+				if sub.subject == fields[1] && !groups[sub.group] {
+					groups[sub.group] = true
+					fmt.Fprintf(sub.w, "MSG %s %s %d\r\n%s\r\n", fields[1], sub.sid, n, data[:n])
+				}
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Disconnect closes all client connections and drops their subscriptions.
+func (s *natsTestServer) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns, s.subs = nil, nil
+}
+
+// Clients returns the number of connections and subscriptions.
+func (s *natsTestServer) Clients() (conns, subs int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns), len(s.subs)
+}
+
+func (s *natsTestServer) Published() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.published
+}
+
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
+
+func TestParseBrokerConfig(t *testing.T) {
+	rawurl, subject, group, err := parseBrokerConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, "nats://127.0.0.1:4222", rawurl)
+	assert.Equal(t, "gitea.mail", subject)
+	assert.Equal(t, "gitea", group)
+
+	rawurl, subject, group, err = parseBrokerConfig("url=tls://token@nats:4443, subject=mail.out,group=senders")
+	assert.NoError(t, err)
+	assert.Equal(t, "tls://token@nats:4443", rawurl)
+	assert.Equal(t, "mail.out", subject)
+	assert.Equal(t, "senders", group)
+
+	_, _, _, err = parseBrokerConfig("subject=mail out")
+	assert.Error(t, err)
+	_, _, _, err = parseBrokerConfig("topic=mail")
+	assert.Error(t, err)
+}
+
+func TestBrokerQueue(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", QueueLength: 10, OverflowPolicy: "drop-newest"}
+
+	server := newNATSTestServer(t)
+	defer server.listener.Close()
+	connStr := "url=nats://" + server.listener.Addr().String()
+
+	producer, err := newBrokerQueue(connStr, false)
+	assert.NoError(t, err)
+	defer producer.Close()
+	consumer, err := newBrokerQueue(connStr, true)
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.SetHeader("Bcc", "user3@example.com")
+	msg.Info = "test mail"
+	msg.EnvelopeFrom = "bounces@example.com"
+	assert.NoError(t, producer.Push(msg))
+
+	select {
+	case received := <-consumer.Chan():
+		assert.Equal(t, "test mail", received.Info)
+		from, to, err := received.envelope()
+		assert.NoError(t, err)
+		assert.Equal(t, "gitea@example.com", from)
+		assert.Equal(t, []string{"user2@example.com", "user3@example.com"}, to)
+		assert.NoError(t, consumer.Done(received))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	select {
+	case <-producer.Chan():
+		t.Fatal("message received by the producer")
+	default:
+	}
+
+	// External services send the rendered message to the envelope.
+	published := server.Published()
+	if assert.Len(t, published, 1) {
+		var bm BrokerMessage
+		assert.NoError(t, json.Unmarshal(published[0], &bm))
+		assert.Equal(t, "bounces@example.com", bm.From)
+		assert.Equal(t, []string{"user2@example.com", "user3@example.com"}, bm.To)
+		assert.Contains(t, string(bm.Data), "Subject: Subject")
+		assert.NotContains(t, string(bm.Data), "user3@example.com")
+	}
+
+	// The subscription is restored after reconnecting.
+	server.Disconnect()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if conns, subs := server.Clients(); conns == 2 && subs == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	msg = NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.Info = "after reconnect"
+	assert.NoError(t, producer.Push(msg))
+	select {
+	case received := <-consumer.Chan():
+		assert.Equal(t, "after reconnect", received.Info)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received after reconnecting")
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+)
+
+// channelEntry is a message waiting in a channel queue.
+type channelEntry struct {
+	id      int64
+	msg     *Message
+	sending bool // Held by the queue routine until a worker receives it.
+}
+
+// channelQueue is an in-memory queue. Queued and scheduled messages are lost on shutdown.
+// Every priority has its own channel, the highest priority is served first.
+// If a channel is full, the overflow policy decides what happens to new messages.
+// Pushing never blocks the caller, which may be a request or a worker of the queue.
+type channelQueue struct {
+	queues      map[Priority]chan *channelEntry
+	mailQueue   chan *Message
+	closeChan   chan struct{}
+	deadLetters *memoryDeadLetters
+
+	policy  string           // Overflow policy.
+	timeout time.Duration    // Maximum time to wait for a free slot with the block policy.
+	spill   *persistentQueue // Queue of overflowing messages with the spill policy.
+
+	// The waiting messages by ID. Entries found in a channel which are not
+	// in this map anymore were removed or expedited and are skipped.
+	// The entry held by the queue routine stays in the map until a worker
+	// receives it, removing it signals the routine to give it up.
+	removed  chan struct{}
+	lock     sync.Mutex
+	lastID   int64
+	pending  map[int64]*channelEntry
+	inflight map[*Message]int // Messages received by the workers which are not done.
+}
+
+func newChannelQueue(queueLen int, policy string, timeout time.Duration, spill *persistentQueue) *channelQueue {
+	// Unbuffered channels would only take messages while the queue routine waits.
+	if queueLen < 1 {
+		queueLen = 1
+	}
+	q := &channelQueue{
+		queues:      make(map[Priority]chan *channelEntry, len(priorities)),
+		mailQueue:   make(chan *Message),
+		closeChan:   make(chan struct{}),
+		removed:     make(chan struct{}, 1),
+		deadLetters: newMemoryDeadLetters(),
+		policy:      policy,
+		timeout:     timeout,
+		spill:       spill,
+		pending:     make(map[int64]*channelEntry),
+		inflight:    make(map[*Message]int),
+	}
+	for _, p := range priorities {
+		q.queues[p] = make(chan *channelEntry, queueLen)
+	}
+	go q.run()
+	return q
+}
+
+// Push adds the message to the queue. Scheduled messages are held back
+// without blocking the caller. Messages received from the queue which are
+// pushed again by a worker, e.g. to be retried, are not subject to the
+// overflow policy, they wait in the background if the queue is full.
+func (q *channelQueue) Push(msg *Message) error {
+	q.lock.Lock()
+	q.lastID++
+	e := &channelEntry{id: q.lastID, msg: msg}
+	q.pending[e.id] = e
+	requeued := q.inflight[msg] > 0
+	q.lock.Unlock()
+
+	delay := time.Until(msg.sendAt)
+	if delay <= 0 {
+		if requeued {
+			q.requeue(e)
+			return nil
+		}
+		return q.push(e)
+	}
+
+	go func() {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-q.closeChan:
+			return
+		case <-t.C:
+		}
+
+		if !q.isPending(e) {
+			return
+		}
+		if requeued {
+			q.requeue(e)
+		} else if err := q.push(e); err != nil {
+			log.Error(3, "Failed to queue scheduled emails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		}
+	}()
+	return nil
+}
+
+// channel returns the channel of the priority of the entry.
+func (q *channelQueue) channel(e *channelEntry) chan *channelEntry {
+	queue := q.queues[e.msg.priority()]
+	if queue == nil {
+		queue = q.queues[PriorityNormal]
+	}
+	return queue
+}
+
+// offer adds the entry to the channel if it has room.
+func (q *channelQueue) offer(queue chan *channelEntry, e *channelEntry) bool {
+	select {
+	case <-q.closeChan:
+		return true
+	case queue <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait adds the entry to the channel once it has room, waiting at most
+// for the timeout unless it is 0. It returns false on timeout.
+func (q *channelQueue) wait(queue chan *channelEntry, e *channelEntry, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-q.closeChan:
+		return true
+	case queue <- e:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// requeue adds the entry of a message received from the queue again,
+// waiting in the background for room if the channel is full.
+func (q *channelQueue) requeue(e *channelEntry) {
+	if queue := q.channel(e); !q.offer(queue, e) {
+		go q.wait(queue, e, 0)
+	}
+}
+
+// push adds the entry to the channel of its priority. The entry is
+// removed from the pending messages if it does not fit. With the block
+// policy the entry waits in the background for up to the timeout, a 0
+// timeout only adds it if the channel has room.
+func (q *channelQueue) push(e *channelEntry) (err error) {
+	queue := q.channel(e)
+	if q.offer(queue, e) {
+		return nil
+	}
+
+	countOverflow(q.policy)
+	defer func() {
+		if err != nil {
+			q.take(e)
+		}
+	}()
+
+	switch q.policy {
+	case "drop-newest":
+		return ErrQueueFull
+
+	case "drop-oldest":
+		for {
+			select {
+			case old := <-queue:
+				if q.take(old) {
+					log.Warn("Mail queue is full, dropping emails %s: %s", old.msg.GetHeader("To"), old.msg.Info)
+				}
+			default:
+			}
+			select {
+			case queue <- e:
+				return nil
+			default:
+			}
+		}
+
+	case "spill":
+		q.take(e)
+		return q.spill.Push(e.msg)
+
+	default:
+		timeout := q.timeout
+		if timeout <= 0 {
+			return ErrQueueFull
+		}
+		go func() {
+			if !q.wait(queue, e, timeout) && q.take(e) {
+				log.Warn("Mail queue is full, dropping emails %s: %s after %v", e.msg.GetHeader("To"), e.msg.Info, timeout)
+			}
+		}()
+		return nil
+	}
+}
+
+func (q *channelQueue) isPending(e *channelEntry) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending[e.id] == e
+}
+
+// take removes the entry from the pending messages. It returns false
+// if the entry was removed or expedited before.
+func (q *channelQueue) take(e *channelEntry) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.pending[e.id] != e {
+		return false
+	}
+	delete(q.pending, e.id)
+	return true
+}
+
+// spilled returns the channel of the spilled messages, or nil if
+// the messages are not spilled.
+func (q *channelQueue) spilled() <-chan *Message {
+	if q.spill == nil {
+		return nil
+	}
+	return q.spill.Chan()
+}
+
+// next returns the queued entry with the highest priority marked as
+// sending, or nil if the queue is closed. Spilled messages come last,
+// their entries are not pending.
+func (q *channelQueue) next() *channelEntry {
+	for {
+		e, spilled := q.receive()
+		if spilled != nil {
+			e = &channelEntry{msg: spilled, sending: true}
+			q.lock.Lock()
+			q.inflight[spilled]++
+			q.lock.Unlock()
+			return e
+		} else if e == nil {
+			return nil
+		}
+
+		q.lock.Lock()
+		taken := q.pending[e.id] == e
+		if taken {
+			e.sending = true
+			q.inflight[e.msg]++
+		}
+		q.lock.Unlock()
+		if taken {
+			return e
+		}
+	}
+}
+
+// receive returns the entry with the highest priority or a spilled message.
+// It returns nothing if the queue is closed.
+func (q *channelQueue) receive() (*channelEntry, *Message) {
+	for _, p := range priorities {
+		select {
+		case e := <-q.queues[p]:
+			return e, nil
+		default:
+		}
+	}
+	select {
+	case msg := <-q.spilled():
+		return nil, msg
+	default:
+	}
+
+	// All queues are empty, take whatever comes first.
+	select {
+	case <-q.closeChan:
+		return nil, nil
+	case e := <-q.queues[PriorityHigh]:
+		return e, nil
+	case e := <-q.queues[PriorityNormal]:
+		return e, nil
+	case e := <-q.queues[PriorityLow]:
+		return e, nil
+	case msg := <-q.spilled():
+		return nil, msg
+	}
+}
+
+// run feeds the queued messages to the workers.
+func (q *channelQueue) run() {
+	for {
+		e := q.next()
+		if e == nil || !q.deliver(e) {
+			return
+		}
+	}
+}
+
+// deliver hands the entry to a worker and removes it from the pending
+// messages. The entry is given up if it is removed while the workers are
+// busy. It returns false if the queue is closed.
+func (q *channelQueue) deliver(e *channelEntry) bool {
+	for {
+		select {
+		case <-q.closeChan:
+			return false
+		case q.mailQueue <- e.msg:
+			q.take(e)
+			return true
+		case <-q.removed:
+			if e.id != 0 && !q.isPending(e) {
+				q.lock.Lock()
+				if q.inflight[e.msg]--; q.inflight[e.msg] <= 0 {
+					delete(q.inflight, e.msg)
+				}
+				q.lock.Unlock()
+				return true
+			}
+		}
+	}
+}
+
+func (q *channelQueue) Chan() <-chan *Message {
+	return q.mailQueue
+}
+
+func (q *channelQueue) Done(msg *Message) error {
+	q.lock.Lock()
+	if q.inflight[msg]--; q.inflight[msg] <= 0 {
+		delete(q.inflight, msg)
+	}
+	q.lock.Unlock()
+
+	// Only spilled messages have a key in a persistent queue.
+	if q.spill != nil && msg.queueID != 0 {
+		return q.spill.Done(msg)
+	}
+	return nil
+}
+
+func (q *channelQueue) Len() (n int) {
+	now := time.Now()
+	q.lock.Lock()
+	for _, e := range q.pending {
+		if !e.msg.sendAt.After(now) {
+			n++
+		}
+	}
+	q.lock.Unlock()
+
+	if q.spill != nil {
+		n += q.spill.Len()
+	}
+	return n
+}
+
+// List returns the messages waiting in memory, spilled messages are not listed.
+func (q *channelQueue) List() ([]*PendingMessage, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	list := make([]*PendingMessage, 0, len(q.pending))
+	for id, e := range q.pending {
+		pm := newPendingMessage(id, e.msg)
+		pm.Sending = e.sending
+		list = append(list, pm)
+	}
+	sortPendingMessages(list)
+	return list, nil
+}
+
+func (q *channelQueue) Remove(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	e, ok := q.pending[id]
+	if !ok {
+		return ErrPendingMessageNotExist{id}
+	}
+	delete(q.pending, id)
+	if e.sending {
+		select {
+		case q.removed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Expedite queues the message again with high priority, the old entry
+// is skipped when it comes up. The message held by the queue routine
+// is sent next anyway.
+func (q *channelQueue) Expedite(id int64) error {
+	q.lock.Lock()
+	old, ok := q.pending[id]
+	if !ok {
+		q.lock.Unlock()
+		return ErrPendingMessageNotExist{id}
+	} else if old.sending {
+		q.lock.Unlock()
+		return nil
+	}
+	// Copy the message, the old entry may be read concurrently.
+	msg := *old.msg
+	msg.sendAt = time.Time{}
+	msg.Priority = PriorityHigh
+	e := &channelEntry{id: id, msg: &msg}
+	q.pending[id] = e
+	q.lock.Unlock()
+
+	return q.push(e)
+}
+
+func (q *channelQueue) DeadLetters() DeadLetterStore {
+	return q.deadLetters
+}
+
+func (q *channelQueue) Close() error {
+	close(q.closeChan)
+	if q.spill != nil {
+		return q.spill.Close()
+	}
+	return nil
+}
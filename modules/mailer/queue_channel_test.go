@@ -0,0 +1,200 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fillChannelQueue pushes messages until a message is held by the queue
+// routine and the channel of normal priority is full.
+func fillChannelQueue(t *testing.T, q *channelQueue, infos ...string) {
+	for i, info := range infos {
+		msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		msg.Info = info
+		assert.NoError(t, q.Push(msg))
+
+		// Wait for the queue routine to take the first message.
+		if i == 0 {
+			waitSending(t, q, info)
+		}
+	}
+}
+
+// waitSending waits until the message of the info is held by the queue
+// routine for the next free worker.
+func waitSending(t *testing.T, q Queue, info string) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		list, err := q.List()
+		require.NoError(t, err)
+		for _, pm := range list {
+			if pm.Info == info && pm.Sending {
+				return
+			}
+		}
+	}
+	t.Fatalf("%s not held by the queue routine", info)
+}
+
+// waitLen waits until n messages are waiting in the queue. Messages
+// received by a worker are removed by the queue routine right after.
+func waitLen(t *testing.T, q Queue, n int) {
+	for start := time.Now(); q.Len() != n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d messages waiting, expected %d", q.Len(), n)
+		}
+	}
+}
+
+func receiveInfos(q Queue, n int) []string {
+	infos := make([]string, n)
+	for i := range infos {
+		msg := <-q.Chan()
+		infos[i] = msg.Info
+		q.Done(msg)
+	}
+	return infos
+}
+
+func TestChannelQueueOverflow(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	newMsg := func(info string) *Message {
+		msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		msg.Info = info
+		return msg
+	}
+	before := GetStats()
+
+	q := newChannelQueue(1, "drop-newest", 0, nil)
+	fillChannelQueue(t, q, "held", "queued")
+	assert.Equal(t, ErrQueueFull, q.Push(newMsg("new")))
+	assert.Equal(t, []string{"held", "queued"}, receiveInfos(q, 2))
+	assert.NoError(t, q.Close())
+
+	q = newChannelQueue(1, "drop-oldest", 0, nil)
+	fillChannelQueue(t, q, "held", "queued")
+	assert.NoError(t, q.Push(newMsg("new")))
+	assert.Equal(t, []string{"held", "new"}, receiveInfos(q, 2))
+	assert.NoError(t, q.Close())
+
+	// Without a timeout the mail is only queued if there is room.
+	q = newChannelQueue(1, "block", 0, nil)
+	fillChannelQueue(t, q, "held", "queued")
+	assert.Equal(t, ErrQueueFull, q.Push(newMsg("new")))
+
+	// The caller does not wait for a free slot, the mail is dropped after the timeout.
+	q.timeout = 10 * time.Millisecond
+	assert.NoError(t, q.Push(newMsg("dropped")))
+	assert.Equal(t, 3, q.Len())
+	for q.Len() > 2 {
+		time.Sleep(time.Millisecond)
+	}
+	q.timeout = time.Second
+	start := time.Now()
+	assert.NoError(t, q.Push(newMsg("new")))
+	assert.True(t, time.Since(start) < q.timeout)
+	assert.Equal(t, []string{"held", "queued", "new"}, receiveInfos(q, 3))
+	assert.NoError(t, q.Close())
+
+	after := GetStats()
+	assert.EqualValues(t, 1, after.Overflows["drop-newest"]-before.Overflows["drop-newest"])
+	assert.EqualValues(t, 1, after.Overflows["drop-oldest"]-before.Overflows["drop-oldest"])
+	assert.EqualValues(t, 3, after.Overflows["block"]-before.Overflows["block"])
+}
+
+func TestChannelQueueRequeue(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	q := newChannelQueue(1, "drop-newest", 0, nil)
+	defer q.Close()
+	fillChannelQueue(t, q, "held", "queued")
+
+	// A worker retrying a message does not lose it to the full queue.
+	retried := <-q.Chan()
+	waitSending(t, q, "queued")
+	full := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	full.Info = "full"
+	assert.NoError(t, q.Push(full))
+	assert.NoError(t, q.Push(retried))
+	assert.NoError(t, q.Done(retried))
+	assert.Equal(t, []string{"queued", "full", "held"}, receiveInfos(q, 3))
+	waitLen(t, q, 0)
+
+	// Other messages are dropped by the policy.
+	fillChannelQueue(t, q, "held", "full")
+	assert.Equal(t, ErrQueueFull, q.Push(NewMessage([]string{"user2@example.com"}, "Subject", "Body")))
+}
+
+func TestChannelQueueSpill(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	dir, err := ioutil.TempDir("", "mail_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spill, err := newPersistentQueue(filepath.Join(dir, "queue.db"))
+	assert.NoError(t, err)
+	q := newChannelQueue(1, "spill", 0, spill)
+	defer q.Close()
+
+	fillChannelQueue(t, q, "held", "queued", "spilled")
+	assert.Equal(t, []string{"held", "queued", "spilled"}, receiveInfos(q, 3))
+	waitLen(t, q, 0)
+}
+
+func TestChannelQueueManage(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	q := newChannelQueue(10, "block", 0, nil)
+	defer q.Close()
+
+	fillChannelQueue(t, q, "held", "removed", "queued")
+	scheduled := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	scheduled.Info = "scheduled"
+	scheduled.sendAt = time.Now().Add(time.Hour)
+	assert.NoError(t, q.Push(scheduled))
+
+	// The message held for the next free worker is still listed.
+	list, err := q.List()
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	assert.Equal(t, "held", list[0].Info)
+	assert.True(t, list[0].Sending)
+	assert.Equal(t, "removed", list[1].Info)
+	assert.False(t, list[1].Sending)
+	assert.Equal(t, "queued", list[2].Info)
+	assert.Equal(t, "scheduled", list[3].Info)
+	assert.Equal(t, []string{"user2@example.com"}, list[3].To)
+	assert.Equal(t, "Subject", list[3].Subject)
+	assert.False(t, list[3].Scheduled.IsZero())
+	assert.Equal(t, 3, q.Len())
+
+	assert.NoError(t, q.Remove(list[1].ID))
+	assert.True(t, IsErrPendingMessageNotExist(q.Remove(list[1].ID)))
+	assert.NoError(t, q.Expedite(list[3].ID))
+	assert.NoError(t, q.Expedite(list[0].ID))
+
+	assert.Equal(t, []string{"held", "scheduled", "queued"}, receiveInfos(q, 3))
+	waitLen(t, q, 0)
+
+	// The held message can be removed until a worker receives it.
+	fillChannelQueue(t, q, "removed", "queued")
+	list, err = q.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.NoError(t, q.Remove(list[0].ID))
+	assert.Equal(t, []string{"queued"}, receiveInfos(q, 1))
+	waitLen(t, q, 0)
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// partitionedQueue splits the queue by the category of the messages into
+// the partitions of QUEUE_PARTITIONS. Every partition is a queue of its own
+// with separate workers, so a backlog in one partition does not delay the
+// messages of the others. The ID of a waiting message is its ID in the
+// partition times the number of queues plus the index of the partition.
+type partitionedQueue struct {
+	queues     []Queue // The queue of [mailer] first, then the partitions.
+	names      []string
+	categories map[Category]int // Index of the queue of the partitioned categories.
+}
+
+func newPartitionedQueue(q Queue, partitions []*setting.MailPartition) (*partitionedQueue, error) {
+	pq := &partitionedQueue{
+		queues:     []Queue{q},
+		names:      []string{"mailer"},
+		categories: make(map[Category]int),
+	}
+	for _, p := range partitions {
+		part, err := newLocalQueue(p.QueueLength, partitionQueuePath(setting.MailService.QueuePath, p.Name))
+		if err != nil {
+			pq.Close()
+			return nil, fmt.Errorf("mailer.partition.%s: %v", p.Name, err)
+		}
+		for _, category := range p.Categories {
+			pq.categories[Category(category)] = len(pq.queues)
+		}
+		pq.queues = append(pq.queues, part)
+		pq.names = append(pq.names, p.Name)
+	}
+	return pq, nil
+}
+
+// partitionQueuePath returns the path of the persistent queue of the
+// partition next to the path of [mailer], e.g. mail_queue.security.db.
+func partitionQueuePath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// index returns the index of the queue of the message.
+func (q *partitionedQueue) index(msg *Message) int {
+	category := msg.Category
+	if len(category) == 0 {
+		category = CategoryNotification
+	}
+	return q.categories[category]
+}
+
+// split returns the index of the queue and the ID in it of a waiting message.
+func (q *partitionedQueue) split(id int64) (int, int64, bool) {
+	if id < 0 {
+		return 0, 0, false
+	}
+	n := int64(len(q.queues))
+	return int(id % n), id / n, true
+}
+
+// Push adds the message to the queue of its partition.
+func (q *partitionedQueue) Push(msg *Message) error {
+	return q.queues[q.index(msg)].Push(msg)
+}
+
+// Chan returns the channel of the queue of [mailer], the workers of the
+// partitions receive from the queues of their partition.
+func (q *partitionedQueue) Chan() <-chan *Message {
+	return q.queues[0].Chan()
+}
+
+func (q *partitionedQueue) Done(msg *Message) error {
+	return q.queues[q.index(msg)].Done(msg)
+}
+
+func (q *partitionedQueue) Len() (n int) {
+	for _, part := range q.queues {
+		n += part.Len()
+	}
+	return n
+}
+
+// List returns the messages waiting in all partitions.
+func (q *partitionedQueue) List() ([]*PendingMessage, error) {
+	var list []*PendingMessage
+	for i, part := range q.queues {
+		pending, err := part.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, pm := range pending {
+			pm.ID = pm.ID*int64(len(q.queues)) + int64(i)
+			list = append(list, pm)
+		}
+	}
+	sortPendingMessages(list)
+	return list, nil
+}
+
+func (q *partitionedQueue) Remove(id int64) error {
+	i, partID, ok := q.split(id)
+	if !ok {
+		return ErrPendingMessageNotExist{id}
+	}
+	err := q.queues[i].Remove(partID)
+	if IsErrPendingMessageNotExist(err) {
+		return ErrPendingMessageNotExist{id}
+	}
+	return err
+}
+
+func (q *partitionedQueue) Expedite(id int64) error {
+	i, partID, ok := q.split(id)
+	if !ok {
+		return ErrPendingMessageNotExist{id}
+	}
+	err := q.queues[i].Expedite(partID)
+	if IsErrPendingMessageNotExist(err) {
+		return ErrPendingMessageNotExist{id}
+	}
+	return err
+}
+
+// DeadLetters returns the store of the queue of [mailer], which keeps the
+// dead letters of all partitions.
+func (q *partitionedQueue) DeadLetters() DeadLetterStore {
+	return q.queues[0].DeadLetters()
+}
+
+func (q *partitionedQueue) Close() (err error) {
+	for _, part := range q.queues {
+		if cerr := part.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
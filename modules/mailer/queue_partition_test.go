@@ -0,0 +1,65 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionedQueue(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", QueueType: "channel", OverflowPolicy: "drop-newest"}
+	q, err := newPartitionedQueue(newChannelQueue(10, "drop-newest", 0, nil), []*setting.MailPartition{
+		{Name: "security", Categories: []string{"security"}, QueueLength: 1},
+	})
+	assert.NoError(t, err)
+	defer q.Close()
+
+	newMsg := func(info string, category Category) *Message {
+		msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		msg.Info, msg.Category = info, category
+		return msg
+	}
+	for _, info := range []string{"digest1", "digest2", "digest3"} {
+		assert.NoError(t, q.Push(newMsg(info, CategoryDigest)))
+	}
+	assert.NoError(t, q.Push(newMsg("activation", CategorySecurity)))
+
+	// The security mail does not wait for the digests.
+	security := q.queues[1]
+	assert.Equal(t, []string{"activation"}, receiveInfos(security, 1))
+	waitSending(t, q, "digest1")
+	waitLen(t, q, 3)
+
+	// The IDs of the partitions do not collide.
+	assert.NoError(t, q.Push(newMsg("reset", CategorySecurity)))
+	list, err := q.List()
+	assert.NoError(t, err)
+	ids := make(map[int64]string)
+	for _, pm := range list {
+		ids[pm.ID] = pm.Info
+	}
+	assert.Len(t, ids, len(list))
+	for id, info := range ids {
+		if info == "reset" {
+			assert.NoError(t, q.Remove(id))
+		}
+	}
+	assert.True(t, IsErrPendingMessageNotExist(q.Remove(-1)))
+	list, err = q.List()
+	assert.NoError(t, err)
+	for _, pm := range list {
+		assert.NotEqual(t, "reset", pm.Info)
+	}
+	assert.Equal(t, []string{"digest1", "digest2", "digest3"}, receiveInfos(q, 3))
+}
+
+func TestPartitionQueuePath(t *testing.T) {
+	assert.Equal(t, "data/mail_queue.security.db", partitionQueuePath("data/mail_queue.db", "security"))
+	assert.Equal(t, "data/queue.security", partitionQueuePath("data/queue", "security"))
+}
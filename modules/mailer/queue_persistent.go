@@ -0,0 +1,497 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	pendingBucket   = []byte("pending")
+	inflightBucket  = []byte("inflight")
+	deadBucket      = []byte("dead")
+	scheduledBucket = []byte("scheduled")
+)
+
+// persistentQueue is a disk-backed queue stored in a BoltDB database.
+// Pending messages are keyed by priority and sequence number, so the
+// message with the highest priority is sent first. Messages are moved
+// to the inflight bucket while a worker is sending them, so messages
+// interrupted by a shutdown or crash are sent again on startup.
+// Messages scheduled for later are kept in the scheduled bucket, keyed
+// by their delivery time, until they are due.
+type persistentQueue struct {
+	db *bolt.DB
+
+	mailQueue  chan *Message
+	notifyChan chan struct{}
+	closeChan  chan struct{}
+
+	scheduleLock sync.Mutex
+	nextSchedule time.Time // Delivery time of the next scheduled message, zero if none.
+}
+
+func newPersistentQueue(path string) (*persistentQueue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("mail queue: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("mail queue: open %s: %v", path, err)
+	}
+
+	// Recover messages which were being sent when the queue was closed.
+	err = db.Update(func(tx *bolt.Tx) error {
+		pending, err := tx.CreateBucketIfNotExists(pendingBucket)
+		if err != nil {
+			return err
+		}
+		inflight, err := tx.CreateBucketIfNotExists(inflightBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(deadBucket); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(scheduledBucket); err != nil {
+			return err
+		}
+		c := inflight.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err = pending.Put(k, v); err != nil {
+				return err
+			}
+		}
+		if err = tx.DeleteBucket(inflightBucket); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(inflightBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mail queue: recover %s: %v", path, err)
+	}
+
+	q := &persistentQueue{
+		db:         db,
+		mailQueue:  make(chan *Message),
+		notifyChan: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+	}
+	if n := q.Len(); n > 0 {
+		log.Info("Mail queue: %d queued messages restored from %s", n, path)
+	}
+	if err = q.promote(time.Now()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mail queue: schedule %s: %v", path, err)
+	}
+
+	go q.run()
+	return q, nil
+}
+
+func queueKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// pendingKey returns the key of a pending or inflight message.
+func pendingKey(priority Priority, id uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = byte(priority)
+	binary.BigEndian.PutUint64(key[1:], id)
+	return key
+}
+
+// pendingID returns the sequence number of a pending message. Queues
+// written by older versions use the plain sequence number as key.
+func pendingID(key []byte) uint64 {
+	if len(key) == 8 {
+		return binary.BigEndian.Uint64(key)
+	}
+	return binary.BigEndian.Uint64(key[1:])
+}
+
+// scheduledKey returns the key of a scheduled message, which orders
+// the messages by their delivery time.
+func scheduledKey(at time.Time, priority Priority, id uint64) []byte {
+	key := make([]byte, 17)
+	binary.BigEndian.PutUint64(key, uint64(at.UnixNano()))
+	copy(key[8:], pendingKey(priority, id))
+	return key
+}
+
+// Push stores the message on disk.
+func (q *persistentQueue) Push(msg *Message) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	if msg.sendAt.After(time.Now()) {
+		err = q.schedule(msg, data)
+	} else {
+		err = q.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(pendingBucket)
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			return b.Put(pendingKey(msg.priority(), id), data)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Wake up the queue routine.
+	select {
+	case q.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next moves the oldest pending message with the highest priority
+// to the inflight bucket and returns it.
+// A nil message is returned if the queue is empty.
+func (q *persistentQueue) next() (msg *Message, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket)
+		k, v := pending.Cursor().First()
+		if k == nil {
+			return nil
+		}
+
+		if err := pending.Delete(k); err != nil {
+			return err
+		}
+
+		data := make([]byte, len(v))
+		copy(data, v)
+
+		var decodeErr error
+		msg, decodeErr = decodeMessage(data)
+		if decodeErr != nil {
+			// Drop the broken message, it would block the queue forever.
+			log.Error(3, "Mail queue: dropping undecodable message %d: %v", pendingID(k), decodeErr)
+			return nil
+		}
+		msg.queueID = pendingID(k)
+
+		return tx.Bucket(inflightBucket).Put(pendingKey(msg.priority(), msg.queueID), data)
+	})
+	return msg, err
+}
+
+// schedule stores the message until it is due.
+func (q *persistentQueue) schedule(msg *Message, data []byte) error {
+	q.scheduleLock.Lock()
+	defer q.scheduleLock.Unlock()
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(pendingBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(scheduledBucket).Put(scheduledKey(msg.sendAt, msg.priority(), id), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if q.nextSchedule.IsZero() || msg.sendAt.Before(q.nextSchedule) {
+		q.nextSchedule = msg.sendAt
+	}
+	return nil
+}
+
+// promote moves the scheduled messages which are due to the pending bucket.
+func (q *persistentQueue) promote(now time.Time) error {
+	q.scheduleLock.Lock()
+	defer q.scheduleLock.Unlock()
+
+	var next time.Time
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		scheduled := tx.Bucket(scheduledBucket)
+		pending := tx.Bucket(pendingBucket)
+
+		c := scheduled.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			at := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+			if at.After(now) {
+				next = at
+				return nil
+			}
+
+			key := make([]byte, len(k)-8)
+			copy(key, k[8:])
+			data := make([]byte, len(v))
+			copy(data, v)
+			if err := scheduled.Delete(k); err != nil {
+				return err
+			}
+			if err := pending.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.nextSchedule = next
+	return nil
+}
+
+// untilScheduled returns the duration until the next scheduled message is due.
+// It returns false if no message is scheduled.
+func (q *persistentQueue) untilScheduled(now time.Time) (time.Duration, bool) {
+	q.scheduleLock.Lock()
+	defer q.scheduleLock.Unlock()
+
+	if q.nextSchedule.IsZero() {
+		return 0, false
+	}
+	return q.nextSchedule.Sub(now), true
+}
+
+// run feeds the pending messages to the workers.
+func (q *persistentQueue) run() {
+	for {
+		if wait, ok := q.untilScheduled(time.Now()); ok && wait <= 0 {
+			if err := q.promote(time.Now()); err != nil {
+				log.Error(3, "Mail queue: failed to move scheduled messages: %v", err)
+			}
+		}
+
+		msg, err := q.next()
+		if err != nil {
+			select {
+			case <-q.closeChan:
+				return
+			default:
+			}
+			log.Error(3, "Mail queue: failed to read message: %v", err)
+		}
+
+		if msg == nil {
+			wait := time.Minute
+			if until, ok := q.untilScheduled(time.Now()); ok && until < wait {
+				wait = until
+			}
+
+			select {
+			case <-q.closeChan:
+				return
+			case <-q.notifyChan:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		select {
+		case <-q.closeChan:
+			// The message stays in the inflight bucket and is restored on startup.
+			return
+		case q.mailQueue <- msg:
+		}
+	}
+}
+
+func (q *persistentQueue) Chan() <-chan *Message {
+	return q.mailQueue
+}
+
+// Done removes the sent message from disk.
+func (q *persistentQueue) Done(msg *Message) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inflightBucket).Delete(pendingKey(msg.priority(), msg.queueID))
+	})
+}
+
+func (q *persistentQueue) Len() (n int) {
+	q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(pendingBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// List returns the pending, scheduled and inflight messages.
+func (q *persistentQueue) List() ([]*PendingMessage, error) {
+	var list []*PendingMessage
+	err := q.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{pendingBucket, scheduledBucket, inflightBucket} {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				msg, err := decodeMessage(v)
+				if err != nil {
+					return err
+				}
+				pm := newPendingMessage(int64(messageID(name, k)), msg)
+				pm.Sending = bytes.Equal(name, inflightBucket)
+				list = append(list, pm)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	sortPendingMessages(list)
+	return list, err
+}
+
+// messageID returns the sequence number of a message in the bucket.
+func messageID(bucket, key []byte) uint64 {
+	if bytes.Equal(bucket, scheduledBucket) {
+		return pendingID(key[8:])
+	}
+	return pendingID(key)
+}
+
+// find returns the bucket and key of a pending or scheduled message.
+func (q *persistentQueue) find(tx *bolt.Tx, id int64) (*bolt.Bucket, []byte) {
+	for _, name := range [][]byte{pendingBucket, scheduledBucket} {
+		c := tx.Bucket(name).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if messageID(name, k) == uint64(id) {
+				key := make([]byte, len(k))
+				copy(key, k)
+				return tx.Bucket(name), key
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (q *persistentQueue) Remove(id int64) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b, key := q.find(tx, id)
+		if b == nil {
+			return ErrPendingMessageNotExist{id}
+		}
+		return b.Delete(key)
+	})
+}
+
+// Expedite moves the message to the front of the pending messages.
+func (q *persistentQueue) Expedite(id int64) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b, key := q.find(tx, id)
+		if b == nil {
+			return ErrPendingMessageNotExist{id}
+		}
+
+		msg, err := decodeMessage(b.Get(key))
+		if err != nil {
+			return err
+		}
+		msg.sendAt = time.Time{}
+		msg.Priority = PriorityHigh
+		data, err := msg.encode()
+		if err != nil {
+			return err
+		}
+
+		if err = b.Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket(pendingBucket).Put(pendingKey(PriorityHigh, uint64(id)), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Wake up the queue routine.
+	select {
+	case q.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *persistentQueue) DeadLetters() DeadLetterStore {
+	return (*boltDeadLetters)(q)
+}
+
+func (q *persistentQueue) Close() error {
+	close(q.closeChan)
+	return q.db.Close()
+}
+
+// boltDeadLetters stores the dead letters in the queue database.
+type boltDeadLetters persistentQueue
+
+func (s *boltDeadLetters) Add(msg *Message) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(queueKey(id), data)
+	})
+}
+
+func (s *boltDeadLetters) List() ([]*DeadLetter, error) {
+	var list []*DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadBucket).ForEach(func(k, v []byte) error {
+			msg, err := decodeMessage(v)
+			if err != nil {
+				return err
+			}
+			list = append(list, newDeadLetter(int64(binary.BigEndian.Uint64(k)), msg))
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *boltDeadLetters) Remove(id int64) (msg *Message, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadBucket)
+		key := queueKey(uint64(id))
+		v := b.Get(key)
+		if v == nil {
+			return ErrDeadLetterNotExist{id}
+		}
+		if msg, err = decodeMessage(v); err != nil {
+			return err
+		}
+		return b.Delete(key)
+	})
+	return msg, err
+}
+
+func (s *boltDeadLetters) Purge() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(deadBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(deadBucket)
+		return err
+	})
+}
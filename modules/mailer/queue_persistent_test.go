@@ -0,0 +1,187 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistentQueue(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	dir, err := ioutil.TempDir("", "mail_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	q, err := newPersistentQueue(path)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "<p>Body</p>")
+	msg.SetHeader("Bcc", "user3@example.com")
+	msg.Info = "test mail"
+	assert.NoError(t, q.Push(msg))
+
+	// Receive the message but close the queue before it is marked as done.
+	received := <-q.Chan()
+	assert.Equal(t, "test mail", received.Info)
+	assert.NoError(t, q.Close())
+
+	q, err = newPersistentQueue(path)
+	assert.NoError(t, err)
+	defer q.Close()
+
+	restored := <-q.Chan()
+	assert.Equal(t, "test mail", restored.Info)
+	assert.Equal(t, []string{"Subject"}, restored.GetHeader("Subject"))
+
+	from, to, err := restored.envelope()
+	assert.NoError(t, err)
+	assert.Equal(t, "gitea@example.com", from)
+	assert.Equal(t, []string{"user2@example.com", "user3@example.com"}, to)
+
+	var buf bytes.Buffer
+	_, err = restored.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "<p>Body</p>")
+
+	assert.NoError(t, q.Done(restored))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestPersistentQueuePriority(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	dir, err := ioutil.TempDir("", "mail_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	q, err := newPersistentQueue(path)
+	assert.NoError(t, err)
+	for _, msg := range []struct {
+		info     string
+		category Category
+		priority Priority
+	}{
+		{"broadcast", CategoryBroadcast, PriorityDefault},
+		{"notification", CategoryNotification, PriorityDefault},
+		{"urgent broadcast", CategoryBroadcast, PriorityHigh},
+		{"security", CategorySecurity, PriorityDefault},
+	} {
+		m := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		m.Info = msg.info
+		m.Category = msg.category
+		m.Priority = msg.priority
+		assert.NoError(t, q.Push(m))
+	}
+	assert.NoError(t, q.Close())
+
+	// Reopen the queue, so all messages are pending when it starts.
+	q, err = newPersistentQueue(path)
+	assert.NoError(t, err)
+	defer q.Close()
+
+	for _, info := range []string{"urgent broadcast", "security", "notification", "broadcast"} {
+		msg := <-q.Chan()
+		assert.Equal(t, info, msg.Info)
+		assert.NoError(t, q.Done(msg))
+	}
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestPersistentQueueSchedule(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	dir, err := ioutil.TempDir("", "mail_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	q, err := newPersistentQueue(path)
+	assert.NoError(t, err)
+
+	at := time.Now().Add(300 * time.Millisecond)
+	scheduled := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	scheduled.Info = "scheduled"
+	scheduled.sendAt = at
+	assert.NoError(t, q.Push(scheduled))
+	assert.Equal(t, 0, q.Len())
+	assert.NoError(t, q.Close())
+
+	// Scheduled messages survive a restart.
+	q, err = newPersistentQueue(path)
+	assert.NoError(t, err)
+	defer q.Close()
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.Info = "immediate"
+	assert.NoError(t, q.Push(msg))
+
+	received := <-q.Chan()
+	assert.Equal(t, "immediate", received.Info)
+	assert.NoError(t, q.Done(received))
+
+	received = <-q.Chan()
+	assert.Equal(t, "scheduled", received.Info)
+	assert.False(t, time.Now().Before(at))
+	assert.NoError(t, q.Done(received))
+}
+
+func TestPersistentQueueManage(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	dir, err := ioutil.TempDir("", "mail_queue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := newPersistentQueue(filepath.Join(dir, "queue.db"))
+	assert.NoError(t, err)
+	defer q.Close()
+
+	for _, info := range []string{"held", "removed", "queued", "scheduled"} {
+		msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		msg.Info = info
+		if info == "scheduled" {
+			msg.sendAt = time.Now().Add(time.Hour)
+		}
+		assert.NoError(t, q.Push(msg))
+
+		// Wait for the queue routine to take the first message.
+		for info == "held" && q.Len() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	list, err := q.List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 4) {
+		assert.Equal(t, "held", list[0].Info)
+		assert.True(t, list[0].Sending)
+		assert.Equal(t, "removed", list[1].Info)
+		assert.Equal(t, "queued", list[2].Info)
+		assert.Equal(t, "scheduled", list[3].Info)
+		assert.False(t, list[3].Scheduled.IsZero())
+	}
+
+	assert.True(t, IsErrPendingMessageNotExist(q.Remove(list[0].ID)))
+	assert.NoError(t, q.Remove(list[1].ID))
+	assert.True(t, IsErrPendingMessageNotExist(q.Remove(list[1].ID)))
+	assert.NoError(t, q.Expedite(list[3].ID))
+
+	assert.Equal(t, []string{"held", "scheduled", "queued"}, receiveInfos(q, 3))
+	list, err = q.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 0)
+}
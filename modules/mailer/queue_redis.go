@@ -0,0 +1,506 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"gopkg.in/redis.v2"
+)
+
+// redisQueuePollInterval is the interval a consumer checks the queue for
+// messages pushed by other instances.
+const redisQueuePollInterval = time.Second
+
+// The scripts keep the keys of the queue consistent, every script runs as
+// one atomic operation. The messages are stored by ID in a hash with their
+// priority in another one. The IDs are kept in a list per priority while
+// pending, in a sorted set by the delivery time while scheduled and in a
+// sorted set by the visibility deadline while a consumer is sending them.
+// IDs left in the lists by Remove and Expedite are skipped.
+var (
+	// KEYS: seq, messages, priorities, pending list, scheduled
+	// ARGV: data, priority, delivery time in ms or 0
+	redisPushScript = redis.NewScript(`
+local id = redis.call('INCR', KEYS[1])
+redis.call('HSET', KEYS[2], id, ARGV[1])
+redis.call('HSET', KEYS[3], id, ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('ZADD', KEYS[5], ARGV[3], id)
+else
+	redis.call('LPUSH', KEYS[4], id)
+end
+return id`)
+
+	// KEYS: messages, priorities, scheduled, inflight
+	// ARGV: now in ms, visibility deadline in ms, prefix of the pending lists, priorities from highest to lowest
+	redisTakeScript = redis.NewScript(`
+-- Messages whose consumer did not finish in time are sent again first.
+for _, set in ipairs({KEYS[4], KEYS[3]}) do
+	for _, id in ipairs(redis.call('ZRANGEBYSCORE', set, '-inf', ARGV[1])) do
+		redis.call('ZREM', set, id)
+		local priority = redis.call('HGET', KEYS[2], id)
+		if priority then
+			redis.call('RPUSH', ARGV[3] .. priority, id)
+		end
+	end
+end
+for i = 4, #ARGV do
+	while true do
+		local id = redis.call('RPOP', ARGV[3] .. ARGV[i])
+		if not id then
+			break
+		end
+		if redis.call('HGET', KEYS[2], id) == ARGV[i] and not redis.call('ZSCORE', KEYS[4], id) then
+			redis.call('ZADD', KEYS[4], ARGV[2], id)
+			return {id, redis.call('HGET', KEYS[1], id)}
+		end
+	end
+end
+return false`)
+
+	// KEYS: messages, priorities, inflight
+	// ARGV: id
+	redisDoneScript = redis.NewScript(`
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1`)
+
+	// KEYS: priorities, inflight
+	// ARGV: id, prefix of the pending lists
+	redisReleaseScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 1 then
+	local priority = redis.call('HGET', KEYS[1], ARGV[1])
+	if priority then
+		redis.call('RPUSH', ARGV[2] .. priority, ARGV[1])
+	end
+end
+return 1`)
+
+	// KEYS: messages, priorities, scheduled, inflight
+	// ARGV: id
+	redisRemoveScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 or redis.call('ZSCORE', KEYS[4], ARGV[1]) then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+return 1`)
+
+	// KEYS: messages, priorities, scheduled, inflight, pending list
+	// ARGV: id, data, priority
+	redisExpediteScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 or redis.call('ZSCORE', KEYS[4], ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('RPUSH', KEYS[5], ARGV[1])
+return 1`)
+)
+
+// redisQueue is a queue stored in Redis, which is shared by all instances
+// using the same server and prefix. Every instance can push messages, the
+// consumers take them for sending. A message a consumer did not finish
+// within the visibility timeout, e.g. because the instance crashed, is
+// sent again by any consumer.
+type redisQueue struct {
+	client     *redis.Client
+	prefix     string
+	consume    bool
+	visibility time.Duration
+
+	mailQueue  chan *Message
+	notifyChan chan struct{}
+	closeChan  chan struct{}
+}
+
+// parseRedisConfig parses the comma separated settings of QUEUE_CONN_STR,
+// like network=tcp,addr=:6379,password=secret,db=0,pool_size=10,idle_timeout=180,prefix=gitea:mail:.
+func parseRedisConfig(connStr string) (*redis.Options, string, error) {
+	opts := &redis.Options{Network: "tcp", Addr: "127.0.0.1:6379"}
+	prefix := "gitea:mail:"
+	for _, field := range strings.Split(connStr, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, "", fmt.Errorf("invalid field %q", field)
+		}
+
+		var err error
+		switch key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); key {
+		case "network":
+			opts.Network = value
+		case "addr":
+			opts.Addr = value
+		case "password":
+			opts.Password = value
+		case "db":
+			opts.DB, err = strconv.ParseInt(value, 10, 64)
+		case "pool_size":
+			opts.PoolSize, err = strconv.Atoi(value)
+		case "idle_timeout":
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			opts.IdleTimeout = time.Duration(seconds) * time.Second
+		case "prefix":
+			prefix = value
+		default:
+			return nil, "", fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %v", kv[0], err)
+		}
+	}
+	return opts, prefix, nil
+}
+
+func newRedisQueue(connStr string, consume bool, visibility time.Duration) (*redisQueue, error) {
+	opts, prefix, err := parseRedisConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("mail queue: QUEUE_CONN_STR: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	if err = client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("mail queue: connect to %s: %v", opts.Addr, err)
+	}
+
+	q := &redisQueue{
+		client:     client,
+		prefix:     prefix,
+		consume:    consume,
+		visibility: visibility,
+		mailQueue:  make(chan *Message),
+		notifyChan: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+	}
+	if n := q.Len(); n > 0 {
+		log.Info("Mail queue: %d queued messages in %s", n, opts.Addr)
+	}
+
+	if consume {
+		go q.run()
+	}
+	return q, nil
+}
+
+func (q *redisQueue) key(name string) string {
+	return q.prefix + name
+}
+
+func (q *redisQueue) pendingKey(priority Priority) string {
+	return q.key("pending:") + strconv.Itoa(int(priority))
+}
+
+// millis returns the time in milliseconds since the epoch.
+func millis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// Push stores the message in Redis, the messages scheduled for later
+// are held back until they are due.
+func (q *redisQueue) Push(msg *Message) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	at := "0"
+	if msg.sendAt.After(time.Now()) {
+		at = millis(msg.sendAt)
+	}
+	priority := msg.priority()
+	err = redisPushScript.Run(q.client,
+		[]string{q.key("seq"), q.key("messages"), q.key("priorities"), q.pendingKey(priority), q.key("scheduled")},
+		[]string{string(data), strconv.Itoa(int(priority)), at}).Err()
+	if err != nil {
+		return err
+	}
+
+	// Wake up the queue routine.
+	select {
+	case q.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next takes the oldest pending message with the highest priority, it
+// returns nil if the queue is empty.
+func (q *redisQueue) next() (*Message, error) {
+	now := time.Now()
+	args := []string{millis(now), millis(now.Add(q.visibility)), q.key("pending:")}
+	for _, p := range priorities {
+		args = append(args, strconv.Itoa(int(p)))
+	}
+	res, err := redisTakeScript.Run(q.client,
+		[]string{q.key("messages"), q.key("priorities"), q.key("scheduled"), q.key("inflight")},
+		args).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	reply, ok := res.([]interface{})
+	if !ok || len(reply) != 2 {
+		return nil, fmt.Errorf("unexpected reply: %v", res)
+	}
+	idStr, _ := reply[0].(string)
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected reply: %v", res)
+	}
+	data, _ := reply[1].(string)
+	msg, err := decodeMessage([]byte(data))
+	if err != nil {
+		// Drop the broken message, it would be sent again forever.
+		log.Error(3, "Mail queue: dropping undecodable message %d: %v", id, err)
+		return nil, q.done(id)
+	}
+	msg.queueID = id
+	return msg, nil
+}
+
+// run feeds the pending messages to the workers.
+func (q *redisQueue) run() {
+	for {
+		msg, err := q.next()
+		if err != nil {
+			select {
+			case <-q.closeChan:
+				return
+			default:
+			}
+			log.Error(3, "Mail queue: failed to read message: %v", err)
+		}
+
+		if msg == nil {
+			select {
+			case <-q.closeChan:
+				return
+			case <-q.notifyChan:
+			case <-time.After(redisQueuePollInterval):
+			}
+			continue
+		}
+
+		select {
+		case <-q.closeChan:
+			// Hand the message to another consumer right away.
+			if err = q.release(msg.queueID); err != nil {
+				log.Error(3, "Mail queue: failed to release message %d: %v", msg.queueID, err)
+			}
+			return
+		case q.mailQueue <- msg:
+		}
+	}
+}
+
+func (q *redisQueue) Chan() <-chan *Message {
+	return q.mailQueue
+}
+
+func (q *redisQueue) done(id uint64) error {
+	return redisDoneScript.Run(q.client,
+		[]string{q.key("messages"), q.key("priorities"), q.key("inflight")},
+		[]string{strconv.FormatUint(id, 10)}).Err()
+}
+
+// Done removes the sent message from Redis.
+func (q *redisQueue) Done(msg *Message) error {
+	if msg.queueID == 0 {
+		return nil
+	}
+	return q.done(msg.queueID)
+}
+
+func (q *redisQueue) release(id uint64) error {
+	return redisReleaseScript.Run(q.client,
+		[]string{q.key("priorities"), q.key("inflight")},
+		[]string{strconv.FormatUint(id, 10), q.key("pending:")}).Err()
+}
+
+func (q *redisQueue) Len() int {
+	messages := q.client.HLen(q.key("messages")).Val()
+	scheduled := q.client.ZCard(q.key("scheduled")).Val()
+	inflight := q.client.ZCard(q.key("inflight")).Val()
+	if n := messages - scheduled - inflight; n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// List returns the pending, scheduled and inflight messages of all instances.
+func (q *redisQueue) List() ([]*PendingMessage, error) {
+	messages, err := q.client.HGetAllMap(q.key("messages")).Result()
+	if err != nil {
+		return nil, err
+	}
+	inflight, err := q.client.ZRange(q.key("inflight"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	sending := make(map[string]bool, len(inflight))
+	for _, id := range inflight {
+		sending[id] = true
+	}
+
+	list := make([]*PendingMessage, 0, len(messages))
+	for idStr, data := range messages {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeMessage([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		pm := newPendingMessage(id, msg)
+		pm.Sending = sending[idStr]
+		list = append(list, pm)
+	}
+	sortPendingMessages(list)
+	return list, nil
+}
+
+func (q *redisQueue) Remove(id int64) error {
+	n, err := redisRemoveScript.Run(q.client,
+		[]string{q.key("messages"), q.key("priorities"), q.key("scheduled"), q.key("inflight")},
+		[]string{strconv.FormatInt(id, 10)}).Result()
+	if err != nil {
+		return err
+	} else if n == int64(0) {
+		return ErrPendingMessageNotExist{id}
+	}
+	return nil
+}
+
+// Expedite moves the message to the front of the pending messages.
+func (q *redisQueue) Expedite(id int64) error {
+	idStr := strconv.FormatInt(id, 10)
+	data, err := q.client.HGet(q.key("messages"), idStr).Result()
+	if err == redis.Nil {
+		return ErrPendingMessageNotExist{id}
+	} else if err != nil {
+		return err
+	}
+
+	msg, err := decodeMessage([]byte(data))
+	if err != nil {
+		return err
+	}
+	msg.sendAt = time.Time{}
+	msg.Priority = PriorityHigh
+	encoded, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	n, err := redisExpediteScript.Run(q.client,
+		[]string{q.key("messages"), q.key("priorities"), q.key("scheduled"), q.key("inflight"), q.pendingKey(PriorityHigh)},
+		[]string{idStr, string(encoded), strconv.Itoa(int(PriorityHigh))}).Result()
+	if err != nil {
+		return err
+	} else if n == int64(0) {
+		return ErrPendingMessageNotExist{id}
+	}
+
+	// Wake up the queue routine.
+	select {
+	case q.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *redisQueue) DeadLetters() DeadLetterStore {
+	return (*redisDeadLetters)(q)
+}
+
+func (q *redisQueue) Close() error {
+	close(q.closeChan)
+	return q.client.Close()
+}
+
+// redisDeadLetters stores the dead letters in a hash next to the queue.
+type redisDeadLetters redisQueue
+
+func (s *redisDeadLetters) Add(msg *Message) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	q := (*redisQueue)(s)
+	id, err := q.client.Incr(q.key("seq")).Result()
+	if err != nil {
+		return err
+	}
+	return q.client.HSet(q.key("dead"), strconv.FormatInt(id, 10), string(data)).Err()
+}
+
+func (s *redisDeadLetters) List() ([]*DeadLetter, error) {
+	q := (*redisQueue)(s)
+	deadLetters, err := q.client.HGetAllMap(q.key("dead")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*DeadLetter, 0, len(deadLetters))
+	for idStr, data := range deadLetters {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeMessage([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, newDeadLetter(id, msg))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (s *redisDeadLetters) Remove(id int64) (*Message, error) {
+	q := (*redisQueue)(s)
+	idStr := strconv.FormatInt(id, 10)
+	data, err := q.client.HGet(q.key("dead"), idStr).Result()
+	if err == redis.Nil {
+		return nil, ErrDeadLetterNotExist{id}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Another instance may have removed it in the meantime.
+	if n, err := q.client.HDel(q.key("dead"), idStr).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrDeadLetterNotExist{id}
+	}
+	return decodeMessage([]byte(data))
+}
+
+func (s *redisDeadLetters) Purge() error {
+	q := (*redisQueue)(s)
+	return q.client.Del(q.key("dead")).Err()
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRedisConfig(t *testing.T) {
+	opts, prefix, err := parseRedisConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:6379", opts.Addr)
+	assert.Equal(t, "gitea:mail:", prefix)
+
+	opts, prefix, err = parseRedisConfig("addr=redis:6380, password=secret,db=2,pool_size=10,idle_timeout=180,prefix=mail:")
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", opts.Network)
+	assert.Equal(t, "redis:6380", opts.Addr)
+	assert.Equal(t, "secret", opts.Password)
+	assert.EqualValues(t, 2, opts.DB)
+	assert.Equal(t, 10, opts.PoolSize)
+	assert.Equal(t, 180*time.Second, opts.IdleTimeout)
+	assert.Equal(t, "mail:", prefix)
+
+	_, _, err = parseRedisConfig("addr")
+	assert.Error(t, err)
+	_, _, err = parseRedisConfig("db=one")
+	assert.Error(t, err)
+	_, _, err = parseRedisConfig("host=redis")
+	assert.Error(t, err)
+}
+
+// newTestRedisQueue connects to the Redis server of TEST_REDIS_ADDR, the
+// test is skipped without it.
+func newTestRedisQueue(t *testing.T, consume bool, visibility time.Duration) *redisQueue {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if len(addr) == 0 {
+		t.Skip("TEST_REDIS_ADDR is not set")
+	}
+	prefix := "gitea:test:" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	q, err := newRedisQueue("addr="+addr+",prefix="+prefix, consume, visibility)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return q
+}
+
+func TestRedisQueue(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	producer := newTestRedisQueue(t, false, time.Minute)
+	defer producer.Close()
+	consumer, err := newRedisQueue("addr="+os.Getenv("TEST_REDIS_ADDR")+",prefix="+producer.prefix, true, 300*time.Millisecond)
+	assert.NoError(t, err)
+
+	for _, msg := range []struct {
+		info     string
+		priority Priority
+	}{
+		{"normal", PriorityNormal},
+		{"urgent", PriorityHigh},
+		{"expedited", PriorityLow},
+		{"removed", PriorityNormal},
+	} {
+		m := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+		m.Info = msg.info
+		m.Priority = msg.priority
+		assert.NoError(t, producer.Push(m))
+	}
+
+	list, err := producer.List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 4) {
+		assert.NoError(t, producer.Remove(list[3].ID))
+		assert.NoError(t, producer.Expedite(list[2].ID))
+	}
+	assert.True(t, IsErrPendingMessageNotExist(producer.Remove(list[3].ID)))
+
+	// The producer never takes messages, the consumer does.
+	select {
+	case <-producer.Chan():
+		t.Fatal("message taken by the producer")
+	case msg := <-consumer.Chan():
+		assert.Equal(t, "urgent", msg.Info)
+		assert.NoError(t, consumer.Done(msg))
+	}
+	msg := <-consumer.Chan()
+	assert.Equal(t, "expedited", msg.Info)
+	assert.NoError(t, consumer.Done(msg))
+
+	// A message is sent again if the consumer does not finish in time.
+	msg = <-consumer.Chan()
+	assert.Equal(t, "normal", msg.Info)
+	assert.NoError(t, consumer.Close())
+
+	consumer, err = newRedisQueue("addr="+os.Getenv("TEST_REDIS_ADDR")+",prefix="+producer.prefix, true, time.Minute)
+	assert.NoError(t, err)
+	defer consumer.Close()
+	select {
+	case msg = <-consumer.Chan():
+		assert.Equal(t, "normal", msg.Info)
+		assert.NoError(t, consumer.Done(msg))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not sent again after the visibility timeout")
+	}
+	assert.Equal(t, 0, producer.Len())
+
+	dead := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	dead.Info = "dead"
+	assert.NoError(t, producer.DeadLetters().Add(dead))
+	letters, err := consumer.DeadLetters().List()
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		restored, err := consumer.DeadLetters().Remove(letters[0].ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "dead", restored.Info)
+	}
+	assert.NoError(t, producer.DeadLetters().Purge())
+	producer.client.Del(producer.key("seq"))
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDomainLimiters is the number of per domain limiters after which
+// limiters of domains without recent mails are dropped.
+const maxDomainLimiters = 10000
+
+// rateLimiter is a token bucket allowing rate messages per minute with
+// bursts of up to burst messages.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // Tokens per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Reserve takes a token and returns how long to wait before
+// the message may be sent.
+// This method is thread-safe.
+func (l *rateLimiter) Reserve(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// full checks whether no message has been sent for long enough
+// to refill the bucket.
+func (l *rateLimiter) full(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill(now)
+	return l.tokens >= l.burst
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// domainRateLimiter limits the messages sent to each recipient domain. The
+// callouts use it with the client addresses instead of domains.
+type domainRateLimiter struct {
+	perMinute int
+
+	lock     sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func newDomainRateLimiter(perMinute int) *domainRateLimiter {
+	return &domainRateLimiter{
+		perMinute: perMinute,
+		limiters:  make(map[string]*rateLimiter),
+	}
+}
+
+// Reserve takes a token for each recipient domain and returns how long to
+// wait before the message may be sent.
+// This method is thread-safe.
+func (dl *domainRateLimiter) Reserve(to []string, now time.Time) time.Duration {
+	var delay time.Duration
+	for _, domain := range recipientDomains(to) {
+		if d := dl.limiter(domain, now).Reserve(now); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+func (dl *domainRateLimiter) limiter(domain string, now time.Time) *rateLimiter {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	l, ok := dl.limiters[domain]
+	if !ok {
+		if len(dl.limiters) >= maxDomainLimiters {
+			for d, l := range dl.limiters {
+				if l.full(now) {
+					delete(dl.limiters, d)
+				}
+			}
+		}
+		l = newRateLimiter(dl.perMinute, dl.perMinute)
+		dl.limiters[domain] = l
+	}
+	return l
+}
+
+// recipientDomains returns the distinct domains of the addresses.
+func recipientDomains(to []string) []string {
+	domains := make([]string, 0, len(to))
+	seen := make(map[string]bool, len(to))
+	for _, addr := range to {
+		domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
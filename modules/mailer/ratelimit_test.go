@@ -0,0 +1,78 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(60, 2)
+
+	assert.Zero(t, l.Reserve(now))
+	assert.Zero(t, l.Reserve(now))
+	assert.Equal(t, time.Second, l.Reserve(now))
+	assert.Equal(t, 2*time.Second, l.Reserve(now))
+
+	// Tokens are refilled over time, up to the burst.
+	assert.Zero(t, l.Reserve(now.Add(10*time.Second)))
+	assert.True(t, l.full(now.Add(time.Minute)))
+}
+
+func TestDomainRateLimiter(t *testing.T) {
+	now := time.Now()
+	dl := newDomainRateLimiter(1)
+
+	assert.Zero(t, dl.Reserve([]string{"user1@example.com", "user2@EXAMPLE.com"}, now))
+	assert.Zero(t, dl.Reserve([]string{"user1@example.org"}, now))
+	assert.Equal(t, time.Minute, dl.Reserve([]string{"user3@example.org", "user3@example.net"}, now))
+	assert.Len(t, dl.limiters, 3)
+}
+
+func TestDaemonThrottle(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+
+	d := &Daemon{rateLimit: newRateLimiter(1, 1)}
+	assert.Zero(t, d.throttle(msg))
+
+	// The next message is delayed until the next token, which is reserved
+	// for it when it comes back.
+	delay := d.throttle(msg)
+	assert.True(t, delay > 0 && delay <= time.Minute, "%v", delay)
+	assert.True(t, msg.reserved)
+	assert.Zero(t, d.throttle(msg))
+	assert.False(t, msg.reserved)
+}
+
+func TestDaemonDeferMessage(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	q := newChannelQueue(1, "block", 0, nil)
+	defer q.Close()
+	d := &Daemon{queue: q}
+
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+	msg.reserved = true
+	assert.True(t, d.deferMessage(msg, time.Hour))
+	assert.Zero(t, q.Len())
+	list, err := q.List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.True(t, list[0].Scheduled.After(time.Now().Add(59*time.Minute)))
+	}
+
+	// The reservation is kept by a persistent queue.
+	data, err := msg.encode()
+	assert.NoError(t, err)
+	restored, err := decodeMessage(data)
+	assert.NoError(t, err)
+	assert.True(t, restored.reserved)
+}
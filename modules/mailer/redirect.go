@@ -0,0 +1,37 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// HeaderOriginalTo lists a recipient of a mail redirected to REDIRECT_TO.
+const HeaderOriginalTo = "X-Original-To"
+
+// redirectRecipients replaces the recipients of the message by REDIRECT_TO,
+// the original To, Cc and Bcc recipients are kept in X-Original-To headers.
+func redirectRecipients(msg *Message) {
+	redirectTo := setting.MailService.RedirectTo
+	if len(redirectTo) == 0 || len(msg.GetHeader(HeaderOriginalTo)) > 0 {
+		return
+	}
+
+	var originals []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, addr := range msg.addresses(field) {
+			if addr != undisclosedRecipients {
+				originals = append(originals, addr)
+			}
+		}
+		if field != "To" && len(msg.GetHeader(field)) > 0 {
+			msg.SetHeader(field)
+		}
+	}
+	log.Trace("Redirecting e-mails %v to %s: %s", originals, redirectTo, msg.Info)
+	msg.SetHeader(HeaderOriginalTo, originals...)
+	msg.SetAddresses("To", redirectTo)
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectRecipients(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	redirectRecipients(msg)
+	assert.Equal(t, []string{"user@example.com"}, msg.GetHeader("To"))
+	assert.Empty(t, msg.GetHeader(HeaderOriginalTo))
+
+	setting.MailService.RedirectTo = "staging@example.org"
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "Body")
+	msg.SetAddresses("Cc", "cc@example.com")
+	redirectRecipients(msg)
+	assert.Equal(t, []string{"staging@example.org"}, msg.GetHeader("To"))
+	assert.Equal(t, []string{"user@example.com", "cc@example.com"}, msg.GetHeader(HeaderOriginalTo))
+	_, to, err := msg.envelope()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"staging@example.org"}, to)
+
+	msgs := NewBccMessages([]string{"a@example.com", "b@example.com"}, "Subject", "Body")
+	redirectRecipients(msgs[0])
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, msgs[0].GetHeader(HeaderOriginalTo))
+	_, to, err = msgs[0].envelope()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"staging@example.org"}, to)
+}
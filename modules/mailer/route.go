@@ -0,0 +1,290 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// mailRoute returns the route of the repository in the X-Gitea-Repository
+// header of the message. A route of the repository takes precedence over a
+// route of its owner.
+func mailRoute(msg *Message) *setting.MailRoute {
+	repos := msg.GetHeader(HeaderRepository)
+	if len(repos) == 0 {
+		return nil
+	}
+	repo := strings.ToLower(repos[0])
+	owner := repo
+	if i := strings.IndexByte(repo, '/'); i >= 0 {
+		owner = repo[:i]
+	}
+
+	routes := setting.MailService.Routes
+	for _, r := range routes {
+		for _, name := range r.Repositories {
+			if name == repo {
+				return r
+			}
+		}
+	}
+	for _, r := range routes {
+		for _, name := range r.Organizations {
+			if name == owner {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// namedRoute returns the route the message selects by name, else the route
+// of its category. It returns nil if there is none or the selected route does
+// not exist.
+func namedRoute(msg *Message) *setting.MailRoute {
+	if len(msg.Route) == 0 {
+		for _, r := range setting.MailService.Routes {
+			for _, category := range r.Categories {
+				if category == string(msg.Category) {
+					return r
+				}
+			}
+		}
+		return nil
+	}
+	for _, r := range setting.MailService.Routes {
+		if r.Name == msg.Route {
+			return r
+		}
+	}
+	log.Warn("Mail route %s of e-mails %s: %s does not exist, using the default", msg.Route, msg.GetHeader("To"), msg.Info)
+	return nil
+}
+
+// domainRoute returns the route of the domain of the recipient address. A
+// route of a domain also takes its subdomains.
+func domainRoute(addr string) *setting.MailRoute {
+	domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+	for _, r := range setting.MailService.Routes {
+		for _, d := range r.Domains {
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	routePoolLock sync.Mutex
+	routeHosts    = make(map[string]*smtpHosts)
+	routePools    = make(map[string]*smtpPool)
+)
+
+// routeSMTPSender returns a sender using the connection pool of the route,
+// which is separate from the pools of [mailer] and other routes.
+func routeSMTPSender(r *setting.MailRoute) (Sender, error) {
+	routePoolLock.Lock()
+	defer routePoolLock.Unlock()
+
+	p, ok := routePools[r.Name]
+	if !ok {
+		hosts, err := newSMTPHosts(r.Mailer)
+		if err != nil {
+			return nil, err
+		}
+		p = newSMTPPool(hosts.Dial, r.SMTPMaxConns, r.Mailer)
+		routeHosts[r.Name], routePools[r.Name] = hosts, p
+	}
+	return &smtpSender{hosts: routeHosts[r.Name], pool: p}, nil
+}
+
+// resetRoutePools closes the idle connections of all routes, new
+// connections use the current settings.
+func resetRoutePools() (err error) {
+	routePoolLock.Lock()
+	pools := routePools
+	routeHosts = make(map[string]*smtpHosts)
+	routePools = make(map[string]*smtpPool)
+	routePoolLock.Unlock()
+
+	for _, p := range pools {
+		if cerr := p.CloseIdle(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// routeSender sends the mails to the recipient domains of a mail route, the
+// mails of the organizations and repositories with a mail route and the
+// mails selecting a route by name, with the backend and the From address of
+// the route, other mails with the default sender. The route selected by
+// name takes precedence, then the route of the recipient domain and the
+// route of the repository.
+type routeSender struct {
+	Sender
+
+	lock    sync.Mutex
+	senders map[string]Sender // Signing senders of the routes by name.
+}
+
+func newRouteSender(s Sender) Sender {
+	return &routeSender{
+		Sender:  s,
+		senders: make(map[string]Sender),
+	}
+}
+
+// sender returns the sender of the route, signing with its keys.
+func (s *routeSender) sender(r *setting.MailRoute) (Sender, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if rs, ok := s.senders[r.Name]; ok {
+		return rs, nil
+	}
+	var rs Sender
+	var err error
+	if len(r.MailType) == 0 || r.MailType == "smtp" {
+		rs, err = routeSMTPSender(r)
+	} else {
+		rs, err = createBackend(r.Mailer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mailer.route.%s: %v", r.Name, err)
+	}
+	if rs, err = signSender(r.Mailer, rs); err != nil {
+		return nil, err
+	}
+	s.senders[r.Name] = rs
+	return rs, nil
+}
+
+// Send the message with the senders of the routes of its recipients, every
+// route gets its recipients only. A message selecting a route by name, or of
+// the categories of a route, is sent with the route only. Recipients which accepted the message in a
+// previous attempt are skipped. If every failed route greylisted the
+// message, ErrGreylisted is returned.
+// This method is thread-safe.
+func (s *routeSender) Send(msg *Message) error {
+	if r := namedRoute(msg); r != nil {
+		return s.send(r, msg)
+	}
+
+	_, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+	route := mailRoute(msg)
+	if len(to) == 0 {
+		return s.send(route, msg)
+	}
+
+	var routes []*setting.MailRoute
+	rcpts := make(map[*setting.MailRoute][]string)
+	for _, addr := range to {
+		if msg.isDelivered(addr) {
+			continue
+		}
+		r := domainRoute(addr)
+		if r == nil {
+			r = route
+		}
+		if _, ok := rcpts[r]; !ok {
+			routes = append(routes, r)
+		}
+		rcpts[r] = append(rcpts[r], addr)
+	}
+	if len(routes) == 1 && len(rcpts[routes[0]]) == len(to) {
+		return s.send(routes[0], msg)
+	}
+
+	// Every route renders the message with its own From and signature.
+	raw, from := msg.raw, msg.GetHeader("From")
+	var errs []string
+	greylisted := true
+	for _, r := range routes {
+		msg.rcpts = rcpts[r]
+		err := s.send(r, msg)
+		msg.rcpts, msg.raw = nil, raw
+		if len(from) > 0 {
+			msg.SetHeader("From", from...)
+		}
+		if err == nil {
+			msg.delivered = append(msg.delivered, rcpts[r]...)
+			continue
+		}
+		if len(routes) == 1 {
+			return err
+		}
+		errs = append(errs, err.Error())
+		greylisted = greylisted && IsErrGreylisted(err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	err = fmt.Errorf("failed to send through some mail routes: %s", strings.Join(errs, "; "))
+	if greylisted {
+		return ErrGreylisted{err}
+	}
+	return err
+}
+
+// send sends the message with the sender of the route, or the default
+// sender if the route is nil.
+func (s *routeSender) send(r *setting.MailRoute, msg *Message) error {
+	if r == nil {
+		return s.Sender.Send(msg)
+	}
+
+	rs, err := s.sender(r)
+	if err != nil {
+		return err
+	}
+	// Messages rendered already, e.g. encrypted ones, keep their From.
+	if msg.raw == nil && r.FromEmail != setting.MailService.FromEmail {
+		setRouteFrom(msg, r.FromEmail)
+	}
+	return rs.Send(msg)
+}
+
+// setRouteFrom replaces the address of the From header, keeping the display
+// name of the user the mail is sent on behalf of.
+func setRouteFrom(msg *Message, addr string) {
+	froms := msg.GetHeader("From")
+	if len(froms) == 0 {
+		return
+	}
+	from, err := mail.ParseAddress(froms[0])
+	if err != nil {
+		return
+	}
+	from.Address = addr
+	setAddressHeader(msg.Message, "From", []string{from.String()})
+}
+
+// Close the default sender and the senders of the routes.
+// This method is thread-safe.
+func (s *routeSender) Close() error {
+	s.lock.Lock()
+	senders := s.senders
+	s.senders = make(map[string]Sender)
+	s.lock.Unlock()
+
+	err := s.Sender.Close()
+	for _, rs := range senders {
+		if cerr := rs.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
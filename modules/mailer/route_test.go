@@ -0,0 +1,203 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailRoute(t *testing.T) {
+	org := &setting.MailRoute{Name: "org", Organizations: []string{"acme"}}
+	repo := &setting.MailRoute{Name: "repo", Repositories: []string{"acme/app"}}
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", Routes: []*setting.MailRoute{org, repo}}
+
+	route := func(repository string) *setting.MailRoute {
+		msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+		if len(repository) > 0 {
+			msg.SetMetadata(Metadata{Repository: repository})
+		}
+		return mailRoute(msg)
+	}
+	assert.Equal(t, repo, route("Acme/App"))
+	assert.Equal(t, org, route("acme/other"))
+	assert.Nil(t, route("user2/repo1"))
+	assert.Nil(t, route(""))
+
+	domain := &setting.MailRoute{Name: "domain", Domains: []string{"corp.example"}}
+	setting.MailService.Routes = append(setting.MailService.Routes, domain)
+	assert.Equal(t, domain, domainRoute("user@corp.example"))
+	assert.Equal(t, domain, domainRoute("user@Mail.Corp.Example"))
+	assert.Nil(t, domainRoute("user@notcorp.example"))
+	assert.Nil(t, domainRoute("user@example.com"))
+}
+
+func TestRouteSender(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer base.Close()
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer relay.Close()
+
+	setting.MailService = &setting.Mailer{
+		From:      `"Gitea" <gitea@example.com>`,
+		FromEmail: "gitea@example.com",
+		Host:      base.Addr().String(),
+		Routes: []*setting.MailRoute{{
+			Name:          "acme",
+			Organizations: []string{"acme"},
+			Mailer:        &setting.Mailer{Host: relay.Addr().String(), FromEmail: "gitea@acme.example"},
+		}},
+	}
+	defer resetSMTPPool()
+	defer resetRoutePools()
+	s, err := createSender()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	send := func(l net.Listener, repository string) string {
+		go serveTestSMTP(t, l)
+		var transcript bytes.Buffer
+		msg := NewMessage([]string{"user@example.com"}, "Subject", "Body")
+		msg.SetMetadata(Metadata{Repository: repository})
+		msg.transcript = &transcript
+		assert.NoError(t, s.Send(msg))
+		return transcript.String()
+	}
+
+	transcript := send(relay, "acme/app")
+	assert.Contains(t, transcript, "* Connecting to "+relay.Addr().String()+"\n")
+	assert.Contains(t, transcript, "C: MAIL FROM:<gitea@acme.example>")
+
+	transcript = send(base, "user2/repo1")
+	assert.Contains(t, transcript, "* Connecting to "+base.Addr().String()+"\n")
+	assert.Contains(t, transcript, "C: MAIL FROM:<gitea@example.com>")
+}
+
+func TestRouteSender_Domains(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer base.Close()
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer relay.Close()
+
+	setting.MailService = &setting.Mailer{
+		From:      "gitea@example.com",
+		FromEmail: "gitea@example.com",
+		Host:      base.Addr().String(),
+		Routes: []*setting.MailRoute{{
+			Name:    "corp",
+			Domains: []string{"corp.example"},
+			Mailer:  &setting.Mailer{Host: relay.Addr().String(), FromEmail: "gitea@corp.example"},
+		}},
+	}
+	defer resetSMTPPool()
+	defer resetRoutePools()
+	s, err := createSender()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	// Every relay gets its own recipients, the From header of the message is
+	// restored for the default sender.
+	go serveTestSMTP(t, relay)
+	go serveTestSMTP(t, base)
+	var transcript bytes.Buffer
+	msg := NewMessage([]string{"alice@corp.example", "bob@example.com"}, "Subject", "Body")
+	msg.transcript = &transcript
+	assert.NoError(t, s.Send(msg))
+	assert.Equal(t, []string{"alice@corp.example", "bob@example.com"}, msg.delivered)
+	assert.Equal(t, []string{"gitea@example.com"}, msg.GetHeader("From"))
+	assert.Nil(t, msg.rcpts)
+
+	out := transcript.String()
+	relayPart := out[:strings.Index(out, "* Connecting to "+base.Addr().String())]
+	basePart := out[len(relayPart):]
+	assert.Contains(t, relayPart, "C: MAIL FROM:<gitea@corp.example>")
+	assert.Contains(t, relayPart, "C: RCPT TO:<alice@corp.example>")
+	assert.NotContains(t, relayPart, "bob@example.com>")
+	assert.Contains(t, basePart, "C: MAIL FROM:<gitea@example.com>")
+	assert.Contains(t, basePart, "C: RCPT TO:<bob@example.com>")
+	assert.NotContains(t, basePart, "alice@corp.example>")
+
+	// Recipients which accepted the message are skipped when it is retried.
+	go serveTestSMTP(t, base)
+	transcript.Reset()
+	msg.delivered = []string{"alice@corp.example"}
+	assert.NoError(t, s.Send(msg))
+	assert.Contains(t, transcript.String(), "* Connecting to "+base.Addr().String()+"\n")
+	assert.NotContains(t, transcript.String(), "alice@corp.example>")
+}
+
+func TestRouteSender_Named(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer base.Close()
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer relay.Close()
+
+	setting.MailService = &setting.Mailer{
+		From:      "gitea@example.com",
+		FromEmail: "gitea@example.com",
+		Host:      base.Addr().String(),
+		Routes: []*setting.MailRoute{{
+			Name:       "secure",
+			Categories: []string{"security"},
+			Mailer:     &setting.Mailer{MailType: "smtp", Host: relay.Addr().String(), FromEmail: "gitea@example.com"},
+		}, {
+			Name:    "corp",
+			Domains: []string{"corp.example"},
+			Mailer:  &setting.Mailer{MailType: "dummy", FromEmail: "gitea@corp.example"},
+		}},
+	}
+	defer resetSMTPPool()
+	defer resetRoutePools()
+	s, err := createSender()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	send := func(l net.Listener, route string, category Category) string {
+		go serveTestSMTP(t, l)
+		var transcript bytes.Buffer
+		msg := NewMessage([]string{"alice@corp.example", "bob@example.com"}, "Subject", "Body")
+		msg.Route, msg.Category = route, category
+		msg.transcript = &transcript
+		assert.NoError(t, s.Send(msg))
+		return transcript.String()
+	}
+
+	// The named route takes all recipients, including those of other routes.
+	transcript := send(relay, "secure", CategoryNotification)
+	assert.Contains(t, transcript, "* Connecting to "+relay.Addr().String()+"\n")
+	assert.Contains(t, transcript, "C: RCPT TO:<alice@corp.example>")
+	assert.Contains(t, transcript, "C: RCPT TO:<bob@example.com>")
+
+	// So does the route of the category.
+	transcript = send(relay, "", CategorySecurity)
+	assert.Contains(t, transcript, "* Connecting to "+relay.Addr().String()+"\n")
+	assert.Contains(t, transcript, "C: RCPT TO:<alice@corp.example>")
+
+	// Unknown routes are ignored.
+	transcript = send(base, "unknown", CategoryNotification)
+	assert.Contains(t, transcript, "* Connecting to "+base.Addr().String()+"\n")
+	assert.NotContains(t, transcript, "alice@corp.example>")
+
+	// The route is kept in persistent queues.
+	msg := NewMessage([]string{"bob@example.com"}, "Subject", "Body")
+	msg.Route = "secure"
+	data, err := msg.encode()
+	assert.NoError(t, err)
+	msg, err = decodeMessage(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "secure", msg.Route)
+}
@@ -4,7 +4,14 @@
 
 package mailer
 
-import "code.gitea.io/gitea/modules/setting"
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/setting"
+)
 
 // Sender defines an mail sender backend implementation interface.
 type Sender interface {
@@ -16,10 +23,241 @@ type Sender interface {
 	Close() error
 }
 
-// createSender creates the actual sender, depending on the chosen sender backend.
+// ErrPermanentFailure wraps a send error which will not go away by retrying
+// the message, such as a rejected recipient.
+type ErrPermanentFailure struct {
+	Err error
+}
+
+// IsErrPermanentFailure checks if an error is a ErrPermanentFailure.
+func IsErrPermanentFailure(err error) bool {
+	_, ok := err.(ErrPermanentFailure)
+	return ok
+}
+
+func (err ErrPermanentFailure) Error() string {
+	return err.Err.Error()
+}
+
+// ErrGreylisted wraps a temporary rejection by a mail server greylisting the
+// message, which is accepted once it is retried after a delay.
+type ErrGreylisted struct {
+	Err error
+}
+
+// IsErrGreylisted checks if an error is a ErrGreylisted.
+func IsErrGreylisted(err error) bool {
+	_, ok := err.(ErrGreylisted)
+	return ok
+}
+
+func (err ErrGreylisted) Error() string {
+	return err.Err.Error()
+}
+
+// ErrRecipientsDeferred is returned if the message was sent, but some
+// recipients were temporarily rejected and have to be retried.
+type ErrRecipientsDeferred struct {
+	Recipients []string
+	Err        error
+}
+
+// IsErrRecipientsDeferred checks if an error is a ErrRecipientsDeferred.
+func IsErrRecipientsDeferred(err error) bool {
+	_, ok := err.(ErrRecipientsDeferred)
+	return ok
+}
+
+func (err ErrRecipientsDeferred) Error() string {
+	return fmt.Sprintf("recipients %v deferred: %v", err.Recipients, err.Err)
+}
+
+// accepted returns the recipients which are not deferred. The deferred ones
+// may be in the ASCII form of the envelope.
+func (err ErrRecipientsDeferred) accepted(to []string) []string {
+	var accepted []string
+	for _, addr := range to {
+		deferred := false
+		for _, rcpt := range err.Recipients {
+			if rcpt == addr || rcpt == idnaAddress(addr) {
+				deferred = true
+				break
+			}
+		}
+		if !deferred {
+			accepted = append(accepted, addr)
+		}
+	}
+	return accepted
+}
+
+// isGreylisting reports whether the error is a temporary rejection of
+// greylisting, like "450 4.2.0 Greylisted, please try again later". Replies
+// without the word only count with the codes greylisting servers use, other
+// temporary failures like full mailboxes ask to try again later as well.
+func isGreylisting(err error) bool {
+	if deferred, ok := err.(ErrRecipientsDeferred); ok {
+		err = deferred.Err
+	}
+	reply, ok := err.(*textproto.Error)
+	if !ok || reply.Code < 400 || reply.Code >= 500 {
+		return false
+	}
+	msg := strings.ToLower(reply.Msg)
+	if strings.Contains(msg, "greylist") || strings.Contains(msg, "graylist") {
+		return true
+	}
+	return (reply.Code == 450 || reply.Code == 451) &&
+		(strings.HasPrefix(msg, "4.2.0 ") || strings.HasPrefix(msg, "4.7.1 ")) &&
+		strings.Contains(msg, "try again later")
+}
+
+// createSender creates the sender for the chosen sender backend,
+// signing the messages if configured. Mails of the organizations and
+// repositories with a mail route are sent with the relay of the route.
+// With DRY_RUN the signed messages are only recorded.
 func createSender() (Sender, error) {
-	if setting.MailService.UseSendmail {
-		return newSendmailSender()
+	if setting.MailService.DryRun {
+		return signSender(setting.MailService, &dryRunSender{})
+	}
+
+	s, err := createBackend(setting.MailService)
+	if err != nil {
+		return nil, err
+	}
+	if len(setting.MailService.Fallbacks) > 0 {
+		if s, err = newFallbackSender(s); err != nil {
+			return nil, err
+		}
+	}
+	if s, err = signSender(setting.MailService, s); err != nil {
+		return nil, err
+	}
+	if len(setting.MailService.Routes) > 0 {
+		s = newRouteSender(s)
+	}
+	return s, nil
+}
+
+// signSender wraps the sender to sign the messages with the DKIM and S/MIME
+// keys of the settings. The sender is closed if a key can not be loaded.
+func signSender(opts *setting.Mailer, s Sender) (Sender, error) {
+	// DKIM has to sign the final message, so it is applied last.
+	dkim, err := newDKIMSigner(opts)
+	if err != nil {
+		s.Close()
+		return nil, err
+	} else if dkim != nil {
+		s = &dkimSender{s, dkim}
+	}
+
+	smime, err := newSMIMESigner(opts)
+	if err != nil {
+		s.Close()
+		return nil, err
+	} else if smime != nil {
+		s = &smimeSender{s, smime}
+	}
+	return s, nil
+}
+
+// checkSender checks that the senders of the settings can be created,
+// before the settings are used. The shared connection pools are not
+// touched, the SMTP servers are only parsed.
+func checkSender(opts *setting.Mailer) error {
+	if !opts.DryRun {
+		if err := checkBackend(opts); err != nil {
+			return err
+		}
+		for _, f := range opts.Fallbacks {
+			if err := checkBackend(f.Mailer); err != nil {
+				return fmt.Errorf("mailer.fallback.%s: %v", f.Name, err)
+			}
+		}
+	}
+	if _, err := newDKIMSigner(opts); err != nil {
+		return err
+	}
+	_, err := newSMIMESigner(opts)
+	return err
+}
+
+// checkBackend checks that the sender backend of the settings can be created.
+func checkBackend(opts *setting.Mailer) error {
+	if opts.MailType == "smtp" || len(opts.MailType) == 0 {
+		_, err := newSMTPHosts(opts)
+		return err
+	}
+	s, err := createBackend(opts)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// createBackend creates the actual sender, depending on the chosen sender backend.
+func createBackend(opts *setting.Mailer) (Sender, error) {
+	switch opts.MailType {
+	case "sendmail":
+		return newSendmailSender(opts)
+	case "sendgrid":
+		return newSendGridSender(opts)
+	case "ses":
+		return newSESSender(opts)
+	case "mailgun":
+		return newMailgunSender(opts)
+	case "postmark":
+		return newPostmarkSender(opts)
+	case "graph":
+		return newGraphSender(opts)
+	case "gmail":
+		return newGmailSender(opts)
+	case "webhook":
+		return newWebhookSender(opts)
+	case "direct":
+		return newDirectSender()
+	case "dummy":
+		return newDummySender()
+	case "file":
+		return newFileSender(opts)
+	default:
+		if factory := getSenderFactory(opts.MailType); factory != nil {
+			return factory(opts)
+		}
+		return newSMTPSender()
+	}
+}
+
+// SenderFactory creates a sender of a registered backend with the settings
+// of [mailer], a route or a fallback. Settings of its own can be read from
+// the section in setting.Cfg.
+type SenderFactory func(opts *setting.Mailer) (Sender, error)
+
+var (
+	senderFactoriesLock sync.RWMutex
+	senderFactories     = make(map[string]SenderFactory)
+)
+
+// RegisterSenderFactory adds a sender backend used with MAIL_TYPE = name.
+// It has to be called before the settings are loaded, e.g. in an init
+// function, and panics if the name is already taken.
+// This method is thread-safe.
+func RegisterSenderFactory(name string, factory SenderFactory) {
+	senderFactoriesLock.Lock()
+	defer senderFactoriesLock.Unlock()
+
+	for _, t := range setting.MailTypes {
+		if t == name {
+			panic(fmt.Sprintf("mailer: sender backend %q is already registered", name))
+		}
 	}
-	return newSMTPSender()
+	senderFactories[name] = factory
+	setting.MailTypes = append(setting.MailTypes, name)
+}
+
+// getSenderFactory returns the factory registered for the name, or nil.
+func getSenderFactory(name string) SenderFactory {
+	senderFactoriesLock.RLock()
+	defer senderFactoriesLock.RUnlock()
+	return senderFactories[name]
 }
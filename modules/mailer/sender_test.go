@@ -0,0 +1,36 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterSenderFactory(t *testing.T) {
+	defer func(types []string) {
+		setting.MailTypes = types
+		delete(senderFactories, "custom")
+	}(setting.MailTypes)
+	custom := &failingSender{}
+	var got *setting.Mailer
+	RegisterSenderFactory("custom", func(opts *setting.Mailer) (Sender, error) {
+		got = opts
+		return custom, nil
+	})
+	assert.Contains(t, setting.MailTypes, "custom")
+
+	opts := &setting.Mailer{MailType: "custom"}
+	s, err := createBackend(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, custom, s)
+	assert.Equal(t, opts, got)
+
+	assert.Panics(t, func() { RegisterSenderFactory("custom", nil) })
+	assert.Panics(t, func() { RegisterSenderFactory("smtp", nil) })
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/mail"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// sendGridAPIURL is the endpoint of the mail API, tests change it to a local server.
+var sendGridAPIURL = "https://api.sendgrid.com/v3/mail/send"
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []*sendGridAddress `json:"to"`
+	Cc  []*sendGridAddress `json:"cc,omitempty"`
+	Bcc []*sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridMail struct {
+	Personalizations []*sendGridPersonalization `json:"personalizations"`
+	From             *sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress           `json:"reply_to,omitempty"`
+	Subject          string                     `json:"subject"`
+	Content          []*sendGridContent         `json:"content"`
+	Attachments      []*sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string          `json:"headers,omitempty"`
+}
+
+func toSendGridAddresses(list []*mail.Address) []*sendGridAddress {
+	addrs := make([]*sendGridAddress, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, &sendGridAddress{Email: addr.Address, Name: addr.Name})
+	}
+	return addrs
+}
+
+// Sender implementation for the SendGrid v3 mail API.
+type sendGridSender struct {
+	apiKey string
+}
+
+func newSendGridSender(opts *setting.Mailer) (Sender, error) {
+	return &sendGridSender{
+		apiKey: opts.SendGridAPIKey,
+	}, nil
+}
+
+// Send the message synchronous.
+func (s *sendGridSender) Send(msg *Message) error {
+	c, err := msg.content()
+	if err != nil {
+		return err
+	}
+
+	m := &sendGridMail{
+		Personalizations: []*sendGridPersonalization{{
+			To:  toSendGridAddresses(c.To),
+			Cc:  toSendGridAddresses(c.Cc),
+			Bcc: toSendGridAddresses(c.Bcc),
+		}},
+		From:    &sendGridAddress{Email: c.From.Address, Name: c.From.Name},
+		Subject: c.Subject,
+		Headers: c.Headers,
+	}
+	if len(c.ReplyTo) > 0 {
+		m.ReplyTo = &sendGridAddress{Email: c.ReplyTo[0].Address, Name: c.ReplyTo[0].Name}
+	}
+
+	// SendGrid requires the plain text content to be the first one.
+	if len(c.Text) > 0 {
+		m.Content = append(m.Content, &sendGridContent{Type: "text/plain", Value: c.Text})
+	}
+	if len(c.HTML) > 0 {
+		m.Content = append(m.Content, &sendGridContent{Type: "text/html", Value: c.HTML})
+	}
+
+	for _, a := range c.Attachments {
+		attachment := &sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+			Type:        a.ContentType,
+			Filename:    a.Filename,
+			Disposition: "attachment",
+		}
+		if len(a.ContentID) > 0 {
+			attachment.Disposition = "inline"
+			attachment.ContentID = a.ContentID
+		}
+		m.Attachments = append(m.Attachments, attachment)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req := httplib.Post(sendGridAPIURL).
+		Header("Authorization", "Bearer "+s.apiKey).
+		Header("Content-Type", "application/json").
+		Body(data)
+	return permanentAPIError(doAPIRequest("SendGrid", req, nil))
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *sendGridSender) Close() error {
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendGridSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+	defer func(url string) { sendGridAPIURL = url }(sendGridAPIURL)
+	sendGridAPIURL = server.URL + "/v3/mail/send"
+
+	setting.MailService = &setting.Mailer{From: "Gitea <gitea@example.com>", SendGridAPIKey: "key"}
+	s, err := newSendGridSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	server.reply(http.StatusAccepted, "")
+	assert.NoError(t, s.Send(msg))
+
+	req := server.last()
+	assert.Equal(t, "/v3/mail/send", req.Path)
+	assert.Equal(t, "Bearer key", req.Header.Get("Authorization"))
+	var m sendGridMail
+	assert.NoError(t, json.Unmarshal(req.Body, &m))
+	assert.Equal(t, "Subject", m.Subject)
+	assert.Equal(t, &sendGridAddress{Email: "gitea@example.com", Name: "Gitea"}, m.From)
+	if assert.Len(t, m.Personalizations, 1) {
+		assert.Equal(t, []*sendGridAddress{{Email: "user@example.com", Name: "User"}}, m.Personalizations[0].To)
+	}
+	if assert.Len(t, m.Content, 2) {
+		assert.Equal(t, "text/plain", m.Content[0].Type)
+		assert.Equal(t, "text/html", m.Content[1].Type)
+	}
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
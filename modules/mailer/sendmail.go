@@ -5,42 +5,129 @@
 package mailer
 
 import (
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/process"
 	"code.gitea.io/gitea/modules/setting"
 
 	gomail "gopkg.in/gomail.v2"
 )
 
+// sendmailSlotTimeout is how long a sender waits for a running process to
+// finish if the number of processes is limited, but not their runtime.
+const sendmailSlotTimeout = time.Minute
+
+var (
+	sendmailSlotsLock sync.Mutex
+	sendmailSlots     chan struct{}
+)
+
+// sendmailSemaphore returns the semaphore limiting the sendmail processes
+// of all senders to max, or nil if the number is unlimited. The semaphore
+// is replaced when the limit changes, the senders using the old one keep
+// it until they are closed.
+func sendmailSemaphore(max int) chan struct{} {
+	sendmailSlotsLock.Lock()
+	defer sendmailSlotsLock.Unlock()
+
+	if max <= 0 {
+		sendmailSlots = nil
+	} else if sendmailSlots == nil || cap(sendmailSlots) != max {
+		sendmailSlots = make(chan struct{}, max)
+	}
+	return sendmailSlots
+}
+
 // Sender sendmail mail sender
 type sendmailSender struct {
-	sender gomail.Sender
+	sender  gomail.Sender
+	path    string
+	args    []string
+	timeout time.Duration // Zero if unlimited.
+	env     []string      // Nil to inherit the environment.
+	slots   chan struct{} // Nil if the number of processes is unlimited.
 }
 
-func newSendmailSender() (Sender, error) {
-	s := &sendmailSender{}
+func newSendmailSender(opts *setting.Mailer) (Sender, error) {
+	s := &sendmailSender{
+		path:    opts.SendmailPath,
+		args:    opts.SendmailArgs,
+		timeout: opts.SendmailTimeout,
+		slots:   sendmailSemaphore(setting.MailService.SendmailMaxProcesses),
+	}
+	if opts.SendmailScrubEnv {
+		s.env = sendmailEnv(opts.SendmailEnv)
+	}
 	s.sender = gomail.SendFunc(s.send)
 
 	return s, nil
 }
 
+// sendmailEnv returns the environment of the variables, either NAME to
+// pass the variable of this process or NAME=value.
+func sendmailEnv(vars []string) []string {
+	env := []string{}
+	for _, v := range vars {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		} else if strings.Contains(v, "=") {
+			env = append(env, v)
+		} else if value, ok := os.LookupEnv(v); ok {
+			env = append(env, v+"="+value)
+		}
+	}
+	return env
+}
+
 func (s *sendmailSender) Close() error {
 	return nil
 }
 
 // Send the message synchronous.
 func (s *sendmailSender) Send(msg *Message) error {
-	return gomail.Send(s.sender, msg.Message)
+	return msg.send(s.sender)
 }
 
-// send email.
+// send email. The process is killed with the processes it spawned once it
+// runs longer than the timeout.
+// If the number of processes is limited, it waits for a running one to
+// finish first, up to the timeout.
 func (s *sendmailSender) send(from string, to []string, msg io.WriterTo) error {
-	args := []string{"-F", from, "-i"}
+	if s.slots != nil {
+		wait := s.timeout
+		if wait <= 0 {
+			wait = sendmailSlotTimeout
+		}
+		t := time.NewTimer(wait)
+		select {
+		case s.slots <- struct{}{}:
+			t.Stop()
+		case <-t.C:
+			return fmt.Errorf("no sendmail process finished within %s", wait)
+		}
+		defer func() { <-s.slots }()
+	}
+
+	// Set the envelope sender, the empty one is passed as <>.
+	if len(from) == 0 {
+		from = "<>"
+	}
+	args := append([]string{}, s.args...)
+	// Recipients starting with "-" must not be taken for options.
+	args = append(args, "-f", from, "-i", "--")
 	args = append(args, to...)
-	log.Trace("Sending with: %s %v", setting.MailService.SendmailPath, args)
-	cmd := exec.Command(setting.MailService.SendmailPath, args...)
+	log.Trace("Sending with: %s %v", s.path, args)
+	cmd := exec.Command(s.path, args...)
+	cmd.Env = s.env
+	setProcessGroup(cmd)
 
 	// Stdin Pipe for message content.
 	pipe, err := cmd.StdinPipe()
@@ -53,6 +140,15 @@ func (s *sendmailSender) send(from string, to []string, msg io.WriterTo) error {
 	if err != nil {
 		return err
 	}
+	pid := process.GetManager().Add(fmt.Sprintf("sendmail %v", to), cmd)
+	defer process.GetManager().Remove(pid)
+
+	var timer *time.Timer
+	if s.timeout > 0 {
+		timer = time.AfterFunc(s.timeout, func() {
+			killProcessGroup(cmd)
+		})
+	}
 
 	// Write the message to the pipe and wait for the command to finish.
 	// We MUST close the pipe or sendmail will hang waiting for more of the message
@@ -60,7 +156,9 @@ func (s *sendmailSender) send(from string, to []string, msg io.WriterTo) error {
 	_, err = msg.WriteTo(pipe)
 	closeError := pipe.Close()
 	waitError := cmd.Wait()
-	if err != nil {
+	if timer != nil && !timer.Stop() {
+		return fmt.Errorf("%s killed after the timeout of %s", s.path, s.timeout)
+	} else if err != nil {
 		return err
 	} else if closeError != nil {
 		return closeError
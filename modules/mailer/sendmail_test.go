@@ -0,0 +1,103 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendmailSender(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test sendmail is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "sendmail")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The script records its arguments, environment and input.
+	script := filepath.Join(dir, "sendmail")
+	assert.NoError(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" > "$0.args"
+env > "$0.env"
+cat > "$0.msg"
+[ -z "$SLEEP" ] || (sleep "$SLEEP"; touch "$0.late")
+`), 0755))
+
+	os.Setenv("GITEA_TEST_SECRET", "secret")
+	defer os.Unsetenv("GITEA_TEST_SECRET")
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	opts := &setting.Mailer{
+		SendmailPath:     script,
+		SendmailArgs:     []string{"-C", "/etc/msmtprc"},
+		SendmailTimeout:  time.Second,
+		SendmailScrubEnv: true,
+		SendmailEnv:      []string{"PATH", " LANG=C"},
+	}
+	s, err := newSendmailSender(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Send(NewMessage([]string{"user2@example.com"}, "Subject", "Body")))
+
+	args, err := ioutil.ReadFile(script + ".args")
+	assert.NoError(t, err)
+	assert.Equal(t, "-C /etc/msmtprc -f gitea@example.com -i -- user2@example.com\n", string(args))
+	env, err := ioutil.ReadFile(script + ".env")
+	assert.NoError(t, err)
+	assert.Contains(t, string(env), "LANG=C")
+	assert.NotContains(t, string(env), "GITEA_TEST_SECRET")
+	msg, err := ioutil.ReadFile(script + ".msg")
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(msg), "Subject: Subject"))
+
+	// A hanging sendmail is killed with the processes it spawned.
+	opts.SendmailEnv = append(opts.SendmailEnv, "SLEEP=2")
+	s, err = newSendmailSender(opts)
+	assert.NoError(t, err)
+	start := time.Now()
+	err = s.Send(NewMessage([]string{"user2@example.com"}, "Subject", "Body"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "killed after the timeout")
+	}
+	assert.True(t, time.Since(start) < 2*time.Second)
+	time.Sleep(2 * time.Second)
+	_, err = os.Stat(script + ".late")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSendmailSemaphore(t *testing.T) {
+	slots := sendmailSemaphore(2)
+	assert.Equal(t, 2, cap(slots))
+	assert.True(t, slots == sendmailSemaphore(2))
+	assert.False(t, slots == sendmailSemaphore(3))
+	assert.Nil(t, sendmailSemaphore(0))
+
+	// The senders share the semaphore.
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", SendmailMaxProcesses: 1}
+	s1, err := newSendmailSender(setting.MailService)
+	assert.NoError(t, err)
+	s2, err := newSendmailSender(setting.MailService)
+	assert.NoError(t, err)
+	assert.NotNil(t, s1.(*sendmailSender).slots)
+	assert.True(t, s1.(*sendmailSender).slots == s2.(*sendmailSender).slots)
+
+	// Senders give up if no process finishes in time.
+	s := s1.(*sendmailSender)
+	s.timeout = 10 * time.Millisecond
+	s.slots <- struct{}{}
+	err = s.Send(NewMessage([]string{"user2@example.com"}, "Subject", "Body"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no sendmail process finished")
+	}
+	<-s.slots
+}
@@ -0,0 +1,20 @@
+// +build windows
+
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing, Windows has no process groups.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup kills the started command only.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,343 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+const (
+	sesMaxThrottleRetries = 3
+
+	awsMetadataURL  = "http://169.254.169.254/latest"
+	awsContainerURL = "http://169.254.170.2"
+)
+
+// awsCredentials are the credentials used to sign AWS API requests.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (c *awsCredentials) expired() bool {
+	// Refresh the temporary credentials a few minutes before they expire.
+	return !c.Expiration.IsZero() && time.Now().Add(5*time.Minute).After(c.Expiration)
+}
+
+// awsCredentialsProvider resolves the credentials from the configuration,
+// the environment, the ECS container or the EC2 instance role in that order.
+type awsCredentialsProvider struct {
+	opts *setting.Mailer
+
+	lock  sync.Mutex
+	creds *awsCredentials
+}
+
+func (p *awsCredentialsProvider) get() (*awsCredentials, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.creds != nil && !p.creds.expired() {
+		return p.creds, nil
+	}
+
+	opts := p.opts
+	if len(opts.SESAccessKeyID) > 0 {
+		p.creds = &awsCredentials{
+			AccessKeyID:     opts.SESAccessKeyID,
+			SecretAccessKey: opts.SESSecretAccessKey,
+		}
+		return p.creds, nil
+	}
+
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); len(id) > 0 {
+		p.creds = &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		return p.creds, nil
+	}
+
+	var err error
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); len(uri) > 0 {
+		p.creds, err = fetchAWSCredentials(httplib.Get(awsContainerURL + uri))
+	} else {
+		p.creds, err = fetchInstanceRoleCredentials()
+	}
+	if err != nil {
+		p.creds = nil
+		return nil, fmt.Errorf("AWS credentials: %v", err)
+	}
+	return p.creds, nil
+}
+
+// fetchInstanceRoleCredentials requests the credentials of the
+// EC2 instance role from the instance metadata service.
+func fetchInstanceRoleCredentials() (*awsCredentials, error) {
+	token, err := httplib.Put(awsMetadataURL+"/api/token").
+		SetTimeout(5*time.Second, 5*time.Second).
+		Header("X-aws-ec2-metadata-token-ttl-seconds", "21600").
+		String()
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := httplib.Get(awsMetadataURL+"/meta-data/iam/security-credentials/").
+		SetTimeout(5*time.Second, 5*time.Second).
+		Header("X-aws-ec2-metadata-token", token).
+		String()
+	if err != nil {
+		return nil, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	if len(role) == 0 {
+		return nil, errors.New("no instance role attached")
+	}
+
+	return fetchAWSCredentials(httplib.Get(awsMetadataURL+"/meta-data/iam/security-credentials/"+role).
+		Header("X-aws-ec2-metadata-token", token))
+}
+
+func fetchAWSCredentials(req *httplib.Request) (*awsCredentials, error) {
+	var resp struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := req.SetTimeout(5*time.Second, 5*time.Second).ToJSON(&resp); err != nil {
+		return nil, err
+	}
+	if len(resp.AccessKeyID) == 0 {
+		return nil, errors.New("empty credentials response")
+	}
+	return &awsCredentials{
+		AccessKeyID:     resp.AccessKeyID,
+		SecretAccessKey: resp.SecretAccessKey,
+		Token:           resp.Token,
+		Expiration:      resp.Expiration,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4.
+func signAWSRequest(req *httplib.Request, u *url.URL, body []byte, region, service string, creds *awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+
+	req.Header("X-Amz-Date", amzDate)
+	req.Header("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"content-type":         "application/json",
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if len(creds.Token) > 0 {
+		req.Header("X-Amz-Security-Token", creds.Token)
+		headers["x-amz-security-token"] = creds.Token
+	}
+
+	req.Header("Authorization", awsAuthorization("POST", u, headers, payloadHash, region, service, creds, amzDate))
+}
+
+// awsCanonicalRequest returns the canonical request of the signature and
+// the names of the signed headers, which are all lower case headers given.
+func awsCanonicalRequest(method string, u *url.URL, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	return strings.Join([]string{
+		method,
+		path,
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+// awsSigningKey derives the key signing the requests of the day to the
+// service in the region.
+func awsSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// awsAuthorization returns the Authorization header of the request signed at
+// the time of amzDate, in the format 20060102T150405Z.
+func awsAuthorization(method string, u *url.URL, headers map[string]string, payloadHash, region, service string, creds *awsCredentials, amzDate string) string {
+	canonicalRequest, signedHeaders := awsCanonicalRequest(method, u, headers, payloadHash)
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds.SecretAccessKey, date, region, service), stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature)
+}
+
+// sesError is the error response of the SES v2 API.
+type sesError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// parseSESError extracts the error type and message from a failed request.
+func parseSESError(err ErrAPIRequest) *sesError {
+	e := &sesError{}
+	json.Unmarshal([]byte(err.Body), e)
+	if i := strings.LastIndex(e.Type, "#"); i >= 0 {
+		e.Type = e.Type[i+1:]
+	}
+	return e
+}
+
+// Sender implementation for the Amazon SES v2 API.
+type sesSender struct {
+	region           string
+	configurationSet string
+	creds            awsCredentialsProvider
+}
+
+func newSESSender(opts *setting.Mailer) (Sender, error) {
+	if len(opts.SESRegion) == 0 {
+		return nil, errors.New("mailer: SES_REGION is required for the SES sender")
+	}
+
+	return &sesSender{
+		region:           opts.SESRegion,
+		configurationSet: opts.SESConfigurationSet,
+		creds:            awsCredentialsProvider{opts: opts},
+	}, nil
+}
+
+// Send the message synchronous.
+func (s *sesSender) Send(msg *Message) error {
+	from, to, err := msg.envelope()
+	if err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	if _, err = msg.WriteTo(&raw); err != nil {
+		return err
+	}
+
+	request := map[string]interface{}{
+		"FromEmailAddress": from,
+		"Destination": map[string][]string{
+			"ToAddresses": to,
+		},
+		"Content": map[string]interface{}{
+			"Raw": map[string][]byte{
+				"Data": raw.Bytes(),
+			},
+		},
+	}
+	if len(s.configurationSet) > 0 {
+		request["ConfigurationSetName"] = s.configurationSet
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		err = s.send(body)
+		apiErr, ok := err.(ErrAPIRequest)
+		if !ok {
+			return err
+		}
+
+		sesErr := parseSESError(apiErr)
+		switch sesErr.Type {
+		case "TooManyRequestsException", "LimitExceededException":
+			if i < sesMaxThrottleRetries {
+				// Back off and try again, SES throttles per second.
+				time.Sleep(time.Duration(1<<uint(i)) * time.Second)
+				continue
+			}
+			return fmt.Errorf("SES throttled the request: %s", sesErr.Message)
+		case "MessageRejected":
+			if strings.Contains(sesErr.Message, "not verified") {
+				log.Warn("SES rejected the message, the SES account may still be in the sandbox: %s", sesErr.Message)
+			}
+			return ErrPermanentFailure{fmt.Errorf("SES rejected the message: %s", sesErr.Message)}
+		case "AccountSuspendedException", "SendingPausedException", "MailFromDomainNotVerifiedException":
+			return ErrPermanentFailure{fmt.Errorf("SES %s: %s", sesErr.Type, sesErr.Message)}
+		}
+		return err
+	}
+}
+
+func (s *sesSender) send(body []byte) error {
+	creds, err := s.creds.get()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/outbound-emails", s.region))
+	if err != nil {
+		return err
+	}
+
+	req := httplib.Post(u.String()).
+		Header("Content-Type", "application/json").
+		Body(body)
+	signAWSRequest(req, u, body, s.region, "ses", creds, time.Now())
+
+	return doAPIRequest("SES", req, nil)
+}
+
+// Close is a no-op, the API does not keep a connection open.
+func (s *sesSender) Close() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"encoding/hex"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The test vectors of the AWS Signature Version 4 test suite.
+var awsTestCredentials = &awsCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestAWSSigningKey(t *testing.T) {
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d",
+		hex.EncodeToString(awsSigningKey(awsTestCredentials.SecretAccessKey, "20120215", "us-east-1", "iam")))
+}
+
+func TestAWSAuthorization(t *testing.T) {
+	emptyHash := sha256Hex(nil)
+	headers := map[string]string{
+		"host":       "example.amazonaws.com",
+		"x-amz-date": "20150830T123600Z",
+	}
+	u, err := url.Parse("https://example.amazonaws.com/")
+	assert.NoError(t, err)
+
+	// get-vanilla
+	canonical, signed := awsCanonicalRequest("GET", u, headers, emptyHash)
+	assert.Equal(t, "GET\n/\n\nhost:example.amazonaws.com\nx-amz-date:20150830T123600Z\n\nhost;x-amz-date\n"+emptyHash, canonical)
+	assert.Equal(t, "host;x-amz-date", signed)
+	assert.Equal(t, "bb579772317eb040ac9ed261061d46c1f17a8133879d6129b6e1c25292927e63", sha256Hex([]byte(canonical)))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		awsAuthorization("GET", u, headers, emptyHash, "us-east-1", "service", awsTestCredentials, "20150830T123600Z"))
+
+	// post-vanilla
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		awsAuthorization("POST", u, headers, emptyHash, "us-east-1", "service", awsTestCredentials, "20150830T123600Z"))
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Policies for mails exceeding MESSAGE_MAX_SIZE.
+const (
+	OversizeReject = "reject" // The mail is not queued.
+	OversizeLink   = "link"   // The attachments are replaced by download links.
+)
+
+// ErrMessageTooLarge represents a "MessageTooLarge" kind of error.
+type ErrMessageTooLarge struct {
+	Size    int64
+	MaxSize int64
+}
+
+// IsErrMessageTooLarge checks if an error is a ErrMessageTooLarge.
+func IsErrMessageTooLarge(err error) bool {
+	_, ok := err.(ErrMessageTooLarge)
+	return ok
+}
+
+func (err ErrMessageTooLarge) Error() string {
+	return fmt.Sprintf("message exceeds the maximum size [size: %d, max_size: %d]", err.Size, err.MaxSize)
+}
+
+// AttachmentUploader stores an attached file read from r and returns the
+// absolute URL to download it, which is restricted to the recipients.
+type AttachmentUploader func(name string, r io.Reader, recipients []string) (string, error)
+
+var (
+	attachmentUploaderLock sync.RWMutex
+	attachmentUploader     AttachmentUploader
+)
+
+// SetAttachmentUploader sets the function storing the attachments of mails
+// which are too large with the link policy. Without uploader those mails are
+// rejected. This method is thread-safe.
+func SetAttachmentUploader(u AttachmentUploader) {
+	attachmentUploaderLock.Lock()
+	attachmentUploader = u
+	attachmentUploaderLock.Unlock()
+}
+
+// sizeCounter is an io.Writer counting the written bytes.
+type sizeCounter int64
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	*c += sizeCounter(len(p))
+	return len(p), nil
+}
+
+// size returns the size of the rendered message, estimated for the
+// attachments which are not yet added.
+func (m *Message) size() (int64, error) {
+	if m.raw != nil {
+		return int64(len(m.raw)), nil
+	}
+
+	var c sizeCounter
+	m.setGlobalHeaders()
+	if _, err := m.Message.WriteTo(&c); err != nil {
+		return 0, err
+	}
+	size := int64(c)
+	for _, f := range m.attachments {
+		// Base64 in lines of 76 characters and the headers of the part.
+		encoded := (f.size + 2) / 3 * 4
+		size += encoded + (encoded+75)/76*2 + 256 + 2*int64(len(f.name))
+	}
+	return size, nil
+}
+
+// checkSize enforces MESSAGE_MAX_SIZE on a message about to be sent: with
+// the link policy its attachments are replaced by links to download them,
+// it returns ErrMessageTooLarge if the message is still too large.
+func checkSize(m *Message) error {
+	maxSize := setting.MailService.MessageMaxSize
+	if maxSize <= 0 {
+		return nil
+	}
+	size, err := m.size()
+	if err != nil {
+		return err
+	} else if size <= maxSize {
+		return nil
+	}
+
+	attachmentUploaderLock.RLock()
+	upload := attachmentUploader
+	attachmentUploaderLock.RUnlock()
+	if setting.MailService.OversizePolicy != OversizeLink || upload == nil || len(m.attachments) == 0 {
+		return ErrMessageTooLarge{size, maxSize}
+	}
+
+	if err = m.linkAttachments(upload); err != nil {
+		return fmt.Errorf("link attachments: %v", err)
+	}
+	if size, err = m.size(); err != nil {
+		return err
+	} else if size > maxSize {
+		return ErrMessageTooLarge{size, maxSize}
+	}
+	return nil
+}
+
+// linkAttachments uploads the attachments of the message and lists the links
+// to download them at the end of the bodies instead.
+func (m *Message) linkAttachments(upload AttachmentUploader) error {
+	_, to, err := m.envelope()
+	if err != nil {
+		return err
+	}
+
+	var text, htmlList bytes.Buffer
+	text.WriteString("\n\n---\n")
+	htmlList.WriteString("<ul>")
+	for _, f := range m.attachments {
+		link, err := uploadFile(upload, f, to)
+		if err != nil {
+			return err
+		}
+		label := fmt.Sprintf("%s (%s)", f.name, base.FileSize(f.size))
+		fmt.Fprintf(&text, "%s: %s\n", label, link)
+		fmt.Fprintf(&htmlList, `<li><a href="%s">%s</a></li>`, html.EscapeString(link), html.EscapeString(label))
+	}
+	htmlList.WriteString("</ul>")
+
+	for _, f := range m.attachments {
+		m.filesSize -= f.size
+	}
+	m.attachments = nil
+
+	body := m.html
+	if len(body) > 0 {
+		if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+			body = body[:i] + htmlList.String() + body[i:]
+		} else {
+			body += htmlList.String()
+		}
+	}
+	m.SetAlternativeBodies(m.text+text.String(), body)
+	return nil
+}
+
+// uploadFile streams the content of the file to the uploader.
+func uploadFile(upload AttachmentUploader, f *messageFile, recipients []string) (string, error) {
+	r, err := f.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return upload(f.name, r, recipients)
+}
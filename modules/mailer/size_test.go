@@ -0,0 +1,66 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSize(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AttachmentMaxSize: 1 << 20}
+	newMessage := func() *Message {
+		msg := NewMessage([]string{"user2@example.com"}, "Subject", "<html><body><p>Body</p></body></html>")
+		assert.NoError(t, msg.AttachReader("large.bin", strings.NewReader(strings.Repeat("x", 8192))))
+		return msg
+	}
+
+	// Unlimited
+	assert.NoError(t, checkSize(newMessage()))
+
+	setting.MailService.MessageMaxSize = 4096
+	msg := newMessage()
+	size, err := msg.size()
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.InDelta(t, buf.Len(), size, 512)
+
+	err = checkSize(newMessage())
+	assert.True(t, IsErrMessageTooLarge(err))
+
+	// The link policy needs an uploader.
+	setting.MailService.OversizePolicy = OversizeLink
+	assert.True(t, IsErrMessageTooLarge(checkSize(newMessage())))
+
+	var uploaded, recipients []string
+	SetAttachmentUploader(func(name string, r io.Reader, to []string) (string, error) {
+		uploaded = append(uploaded, name)
+		recipients = to
+		return "https://try.gitea.io/attachments/1", nil
+	})
+	defer SetAttachmentUploader(nil)
+
+	msg = newMessage()
+	assert.NoError(t, checkSize(msg))
+	assert.Equal(t, []string{"large.bin"}, uploaded)
+	assert.Equal(t, []string{"user2@example.com"}, recipients)
+	c, err := msg.content()
+	assert.NoError(t, err)
+	assert.Empty(t, c.Attachments)
+	assert.Contains(t, c.Text, "large.bin (8.0KB): https://try.gitea.io/attachments/1")
+	assert.Contains(t, c.HTML, `<ul><li><a href="https://try.gitea.io/attachments/1">large.bin (8.0KB)</a></li></ul></body>`)
+
+	// Too large without attachments
+	setting.MailService.MessageMaxSize = 16
+	assert.True(t, IsErrMessageTooLarge(checkSize(NewMessage([]string{"user2@example.com"}, "Subject", "Body"))))
+}
@@ -0,0 +1,266 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// CMS structures (RFC 5652) of a detached signature.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0"` // Explicitly tagged SignedData.
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      encapContentInfo
+	Certificates     asn1.RawValue `asn1:"tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// smimeSigner signs messages with S/MIME (RFC 5751) as multipart/signed.
+type smimeSigner struct {
+	certs [][]byte
+	cert  *x509.Certificate
+	key   crypto.Signer
+}
+
+// newSMIMESigner loads the configured S/MIME certificate and key.
+// It returns nil if S/MIME signing is not enabled.
+func newSMIMESigner(opts *setting.Mailer) (*smimeSigner, error) {
+	if len(opts.SMIMECertFile) == 0 {
+		return nil, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(opts.SMIMECertFile, opts.SMIMEKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("smime: load certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("smime: parse certificate: %v", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("smime: unsupported private key")
+	}
+
+	return &smimeSigner{
+		certs: pair.Certificate,
+		cert:  cert,
+		key:   key,
+	}, nil
+}
+
+// sign returns the rendered message converted to a multipart/signed message.
+func (s *smimeSigner) sign(raw []byte, now time.Time) ([]byte, error) {
+	outer, entity := splitContentEntity(raw)
+
+	signature, err := s.signature(entity.Bytes(), now)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := randomBoundary()
+	outer.WriteString("Mime-Version: 1.0\r\n")
+	outer.WriteString(`Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="` + boundary + "\"\r\n")
+	outer.WriteString("\r\n")
+	outer.WriteString("--" + boundary + "\r\n")
+	outer.Write(entity.Bytes())
+	// The CRLF before the boundary belongs to the boundary, not to the signed entity.
+	outer.WriteString("\r\n--" + boundary + "\r\n")
+	outer.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	outer.WriteString("Content-Transfer-Encoding: base64\r\n")
+	outer.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 76 {
+		outer.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	outer.WriteString(encoded + "\r\n")
+	outer.WriteString("--" + boundary + "--\r\n")
+	return outer.Bytes(), nil
+}
+
+// signature creates the detached CMS signature of the entity.
+func (s *smimeSigner) signature(entity []byte, now time.Time) ([]byte, error) {
+	digest := sha256.Sum256(entity)
+	attrs, err := marshalAttributes(
+		cmsAttr{oidContentType, oidData},
+		cmsAttr{oidSigningTime, now.UTC()},
+		cmsAttr{oidMessageDigest, digest[:]},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is calculated over the DER encoded SET OF the attributes.
+	setOfAttrs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256(setOfAttrs)
+	sig, err := s.key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("smime: sign: %v", err)
+	}
+
+	sigAlg := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	if _, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	}
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo:      encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bytes.Join(s.certs, nil)},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			SID: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: s.cert.RawIssuer},
+				Serial: s.cert.SerialNumber,
+			},
+			DigestAlgorithm:    digestAlg,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+type cmsAttr struct {
+	oid   asn1.ObjectIdentifier
+	value interface{}
+}
+
+// marshalAttributes encodes the attributes in DER order, as required for a SET OF.
+func marshalAttributes(attrs ...cmsAttr) ([]byte, error) {
+	encoded := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		value, err := asn1.Marshal(attr.value)
+		if err != nil {
+			return nil, err
+		}
+		data, err := asn1.Marshal(cmsAttribute{
+			Type:   attr.oid,
+			Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+func randomBoundary() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return fmt.Sprintf("%x", buf[:])
+}
+
+// smimeSender signs every message with S/MIME before it is passed
+// to the actual sender.
+type smimeSender struct {
+	Sender
+	signer *smimeSigner
+}
+
+func (s *smimeSender) Send(msg *Message) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	// Retried messages are signed already.
+	if !isMultipartSigned(buf.Bytes()) {
+		raw, err := s.signer.sign(buf.Bytes(), time.Now())
+		if err != nil {
+			return err
+		}
+		msg.raw = raw
+	}
+
+	return s.Sender.Send(msg)
+}
+
+// isMultipartSigned checks if the rendered message is multipart/signed.
+func isMultipartSigned(raw []byte) bool {
+	header, _ := splitRawMessage(raw)
+	for _, field := range splitHeaderFields(header) {
+		if strings.EqualFold(fieldName(field), "Content-Type") {
+			mediaType, _, _ := mime.ParseMediaType(field[strings.IndexByte(field, ':')+1:])
+			return mediaType == "multipart/signed"
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMIMESign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "gitea@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	s := &smimeSigner{certs: [][]byte{der}, cert: cert, key: key}
+
+	raw := "Mime-Version: 1.0\r\nFrom: gitea@example.com\r\nSubject: Test\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nHello\r\n"
+	signed, err := s.sign([]byte(raw), time.Now())
+	assert.NoError(t, err)
+	assert.True(t, isMultipartSigned(signed))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(signed))
+	assert.NoError(t, err)
+	assert.Equal(t, "Test", msg.Header.Get("Subject"))
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+
+	entity := "Content-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nHello\r\n"
+	assert.Contains(t, string(signed), "--"+params["boundary"]+"\r\n"+entity+"\r\n--"+params["boundary"]+"\r\n")
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	_, err = mr.NextPart()
+	assert.NoError(t, err)
+	p, err := mr.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "application/pkcs7-signature; name=\"smime.p7s\"", p.Header.Get("Content-Type"))
+	encoded, err := ioutil.ReadAll(p)
+	assert.NoError(t, err)
+	der, err = base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	assert.NoError(t, err)
+
+	// Verify the signature as a receiving client would.
+	var ci contentInfo
+	_, err = asn1.Unmarshal(der, &ci)
+	assert.NoError(t, err)
+	assert.True(t, ci.ContentType.Equal(oidSignedData))
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	assert.NoError(t, err)
+	if !assert.Len(t, sd.SignerInfos, 1) {
+		return
+	}
+	si := sd.SignerInfos[0]
+	assert.EqualValues(t, 42, si.SID.Serial.Int64())
+
+	digest := sha256.Sum256([]byte(entity))
+	assert.True(t, bytes.Contains(si.SignedAttrs.Bytes, digest[:]))
+
+	setOfAttrs, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	assert.NoError(t, err)
+	hashed := sha256.Sum256(setOfAttrs)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], si.Signature))
+}
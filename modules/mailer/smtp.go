@@ -6,30 +6,72 @@ package mailer
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/textproto"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"code.gitea.io/gitea/modules/setting"
 
 	"gopkg.in/gomail.v2"
 )
 
-// Sender implementation for SMTP mails.
+// Sender implementation for SMTP mails. All SMTP senders share
+// one pool of connections.
 type smtpSender struct {
-	mutex  sync.Mutex
-	dailer *gomail.Dialer
-	sender gomail.SendCloser
-	isOpen bool
+	hosts *smtpHosts
+	pool  *smtpPool
 }
 
+var (
+	smtpPoolLock  sync.Mutex
+	smtpConnHosts *smtpHosts
+	smtpConnPool  *smtpPool
+)
+
 func newSMTPSender() (Sender, error) {
-	opts := setting.MailService
+	smtpPoolLock.Lock()
+	defer smtpPoolLock.Unlock()
+
+	if smtpConnPool == nil {
+		hosts, err := newSMTPHosts(setting.MailService)
+		if err != nil {
+			return nil, err
+		}
+		smtpConnHosts = hosts
+		smtpConnPool = newSMTPPool(hosts.Dial, setting.MailService.SMTPMaxConns, setting.MailService)
+	}
+
+	return &smtpSender{
+		hosts: smtpConnHosts,
+		pool:  smtpConnPool,
+	}, nil
+}
 
+// resetSMTPPool closes the idle connections of the pool, new senders
+// use a new pool with the current settings.
+func resetSMTPPool() error {
+	smtpPoolLock.Lock()
+	defer smtpPoolLock.Unlock()
+
+	if smtpConnPool == nil {
+		return nil
+	}
+	err := smtpConnPool.CloseIdle()
+	smtpConnHosts, smtpConnPool = nil, nil
+	return err
+}
+
+// newSMTPDialer returns the dialer of the mail server with the settings.
+func newSMTPDialer(opts *setting.Mailer, addr string) (*gomail.Dialer, error) {
 	// Prepare the host and port.
-	host, portStr, err := net.SplitHostPort(opts.Host)
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -40,24 +82,69 @@ func newSMTPSender() (Sender, error) {
 
 	// Prepare the dailer.
 	d := gomail.NewDialer(host, port, opts.User, opts.Passwd)
+	d.SSL = smtpSecurity(opts, port) == "tls"
+	d.Auth = smtpAuth(opts, host)
 
 	if !opts.DisableHelo {
-		hostname := opts.HeloHostname
-		if len(hostname) == 0 {
-			hostname, err = os.Hostname()
-			if err != nil {
-				return nil, err
-			}
-		}
-
 		// LocalName is the hostname sent to the SMTP server with the HELO command.
-		d.LocalName = hostname
+		if d.LocalName, err = heloHostname(opts); err != nil {
+			return nil, err
+		}
 	}
 
 	// Prepare TLS.
-	d.TLSConfig = &tls.Config{
+	if d.TLSConfig, err = newSMTPTLSConfig(opts, host); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// heloHostname returns the name sent with EHLO, which is HELO_HOSTNAME or the
+// DOMAIN of the instance, and the hostname of the machine if neither is set.
+// IP addresses are sent as address literals.
+func heloHostname(opts *setting.Mailer) (string, error) {
+	name := opts.HeloHostname
+	if len(name) == 0 {
+		if name = setting.Domain; len(name) == 0 || name == "localhost" {
+			return os.Hostname()
+		}
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		if ip.To4() != nil {
+			return "[" + name + "]", nil
+		}
+		return "[IPv6:" + name + "]", nil
+	}
+	return name, nil
+}
+
+// smtpSecurity returns the SECURITY of the connections to the port, which is
+// implicit TLS for port 465 and STARTTLS for others if it is not configured.
+func smtpSecurity(opts *setting.Mailer, port int) string {
+	if security := opts.SMTPSecurity; len(security) > 0 {
+		return security
+	}
+	if port == 465 {
+		return "tls"
+	}
+	return "starttls"
+}
+
+// tlsVersions are the values of TLS_MIN_VERSION.
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+// newSMTPTLSConfig returns the TLS configuration of the connections to the
+// server with the client certificate, CAs, version and cipher suites.
+func newSMTPTLSConfig(opts *setting.Mailer, host string) (*tls.Config, error) {
+	config := &tls.Config{
 		InsecureSkipVerify: opts.SkipVerify,
 		ServerName:         host,
+		MinVersion:         tlsVersions[opts.TLSMinVersion],
 	}
 
 	if opts.UseCertificate {
@@ -65,49 +152,148 @@ func newSMTPSender() (Sender, error) {
 		if err != nil {
 			return nil, err
 		}
-		d.TLSConfig.Certificates = []tls.Certificate{cert}
+		config.Certificates = []tls.Certificate{cert}
 	}
 
-	s := &smtpSender{
-		dailer: d,
+	if len(opts.CAFile) > 0 {
+		data, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA_FILE %s", opts.CAFile)
+		}
 	}
 
-	return s, err
+	if len(opts.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range opts.TLSCipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite in TLS_CIPHER_SUITES: %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, nil
 }
 
-// Send the message synchronous. The connection is opened if required.
+// Send the message synchronous with a connection of the pool.
 // This method is thread-safe.
-func (s *smtpSender) Send(msg *Message) (err error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+func (s *smtpSender) Send(msg *Message) error {
+	if msg.transcript != nil {
+		return s.sendTranscript(msg)
+	}
 
-	// Open the smtp connection if required.
-	if !s.isOpen {
-		s.sender, err = s.dailer.Dial()
+	for {
+		c, err := s.pool.Get()
 		if err != nil {
 			return fmt.Errorf("failed to open smtp connection: %v", err)
 		}
-		s.isOpen = true
+
+		err = msg.send(c)
+		if err == nil || IsErrRecipientsDeferred(err) {
+			// The message was sent, even if some recipients have to be retried.
+			s.pool.Put(c)
+			return err
+		}
+
+		// The state of the connection is unknown after an error.
+		s.pool.Discard(c)
+
+		// Idle connections may have been closed by the server in the meantime,
+		// try again with a new connection if the server did not reply an error.
+		if _, isReply := err.(*textproto.Error); !c.reused || isReply {
+			return err
+		}
 	}
+}
+
+// sendTranscript sends the message with a new connection, which records
+// the dialogue with the server in the transcript of the message.
+func (s *smtpSender) sendTranscript(msg *Message) error {
+	var errs []string
+	for _, h := range s.hosts.candidates(time.Now()) {
+		c, err := dialSMTPSecurity(h.dialer, h.security, msg.transcript)
+		if err != nil {
+			fmt.Fprintf(msg.transcript, "* Failed to connect to %s: %v\n", h.addr, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", h.addr, err))
+			continue
+		}
 
-	// Send the mail.
-	return gomail.Send(s.sender, msg.Message)
+		err = msg.send(c)
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return fmt.Errorf("failed to open smtp connection: %s", strings.Join(errs, "; "))
 }
 
-// Close the connection if open.
+// Close the idle connections of the pool.
 // This method is thread-safe.
 func (s *smtpSender) Close() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	return s.pool.CloseIdle()
+}
 
-	if s.isOpen {
-		// Always set the flag to false. Even if the sender fails to close.
-		s.isOpen = false
+// expireIdle closes the timed out idle connections of the SMTP pools of the
+// sender, or keeps them alive, see smtpPool.Expire. It returns the time
+// until it has to be called again, 0 if no idle connection is left to
+// expire. ok is false for senders without pools.
+func expireIdle(s Sender) (wait time.Duration, ok bool) {
+	switch s := s.(type) {
+	case *smtpSender:
+		return s.pool.Expire(), true
+	case *directSender:
+		directPoolLock.Lock()
+		pools := make([]*smtpPool, 0, len(directPools))
+		for _, p := range directPools {
+			pools = append(pools, p)
+		}
+		directPoolLock.Unlock()
 
-		if err := s.sender.Close(); err != nil {
-			return err
+		for _, p := range pools {
+			wait = minWait(wait, p.Expire())
+		}
+		removeUnusedDirectPools()
+		return wait, true
+	case *fallbackSender:
+		for _, fs := range s.senders {
+			fsWait, fsOK := expireIdle(fs)
+			wait, ok = minWait(wait, fsWait), ok || fsOK
+		}
+		return wait, ok
+	case *dkimSender:
+		return expireIdle(s.Sender)
+	case *smimeSender:
+		return expireIdle(s.Sender)
+	case *routeSender:
+		s.lock.Lock()
+		senders := make([]Sender, 0, len(s.senders))
+		for _, rs := range s.senders {
+			senders = append(senders, rs)
 		}
+		s.lock.Unlock()
+
+		wait, ok = expireIdle(s.Sender)
+		for _, rs := range senders {
+			// Routes of other backends have nothing to expire.
+			routeWait, _ := expireIdle(rs)
+			wait = minWait(wait, routeWait)
+		}
+		return wait, ok
 	}
+	return 0, false
+}
 
-	return nil
+// minWait returns the shorter of both waits, 0 means none.
+func minWait(a, b time.Duration) time.Duration {
+	if a == 0 || b > 0 && b < a {
+		return b
+	}
+	return a
 }
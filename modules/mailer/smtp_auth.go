@@ -0,0 +1,120 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/smtp"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// smtpAuth returns the configured SMTP authentication mechanism,
+// or nil to choose one from the mechanisms offered by the server.
+func smtpAuth(opts *setting.Mailer, host string) smtp.Auth {
+
+	switch opts.SMTPAuth {
+	case "PLAIN":
+		return smtp.PlainAuth("", opts.User, opts.Passwd, host)
+	case "LOGIN":
+		return &loginAuth{opts.User, opts.Passwd}
+	case "CRAM-MD5":
+		return smtp.CRAMMD5Auth(opts.User, opts.Passwd)
+	case "NTLM":
+		return newNTLMAuth(opts.User, opts.Passwd)
+	case "XOAUTH2":
+		return &xoauth2Auth{
+			username: opts.User,
+			tokens: &oauth2TokenSource{
+				provider: "SMTP",
+				tokenURL: opts.SMTPOAuth2TokenURL,
+				params: func() (map[string]string, error) {
+					return smtpOAuth2Params(opts)
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// smtpOAuth2Params returns the parameters of the token request, using the
+// refresh token grant if a refresh token is configured and the client
+// credentials grant otherwise.
+func smtpOAuth2Params(opts *setting.Mailer) (map[string]string, error) {
+
+	params := map[string]string{
+		"client_id":     opts.SMTPOAuth2ClientID,
+		"client_secret": opts.SMTPOAuth2ClientSecret,
+	}
+	if len(opts.SMTPOAuth2Scope) > 0 {
+		params["scope"] = opts.SMTPOAuth2Scope
+	}
+	if len(opts.SMTPOAuth2RefreshToken) > 0 {
+		params["grant_type"] = "refresh_token"
+		params["refresh_token"] = opts.SMTPOAuth2RefreshToken
+	} else {
+		params["grant_type"] = "client_credentials"
+	}
+	return params, nil
+}
+
+// loginAuth implements the LOGIN authentication mechanism.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch {
+	case bytes.EqualFold(fromServer, []byte("Username:")):
+		return []byte(a.username), nil
+	case bytes.EqualFold(fromServer, []byte("Password:")):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 authentication mechanism
+// used by Gmail and Office 365.
+type xoauth2Auth struct {
+	username string
+	tokens   *oauth2TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server rejected the token and sent the error details, it expects
+		// an empty response to finish the exchange. The next connection
+		// requests a new token.
+		a.tokens.Reset()
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXOAuth2Auth(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "refresh", r.PostForm.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	setting.MailService = &setting.Mailer{
+		User:                   "gitea@example.com",
+		SMTPAuth:               "XOAUTH2",
+		SMTPOAuth2TokenURL:     srv.URL,
+		SMTPOAuth2RefreshToken: "refresh",
+	}
+	auth := smtpAuth(setting.MailService, "smtp.example.com")
+
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+	assert.Error(t, err)
+
+	proto, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", proto)
+	assert.Equal(t, "user=gitea@example.com\x01auth=Bearer token\x01\x01", string(resp))
+
+	// A rejected token is requested again on the next authentication.
+	resp, err = auth.Next([]byte(`{"status":"401"}`), true)
+	assert.NoError(t, err)
+	assert.Empty(t, resp)
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
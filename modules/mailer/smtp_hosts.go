@@ -0,0 +1,116 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	smtpHostMinDownTime = 30 * time.Second
+	smtpHostMaxDownTime = 10 * time.Minute
+)
+
+// smtpHost is a configured mail server with its health state.
+type smtpHost struct {
+	addr      string
+	dialer    *gomail.Dialer
+	security  string // SECURITY of the connections.
+	failures  int
+	downUntil time.Time
+}
+
+// smtpHosts dials the configured mail servers in order, failing over to
+// the next one if a server is unreachable. Unreachable servers are tried
+// last until their down time is over, which doubles with every failure.
+type smtpHosts struct {
+	lock  sync.Mutex
+	hosts []*smtpHost
+}
+
+func newSMTPHosts(opts *setting.Mailer) (*smtpHosts, error) {
+	hs := &smtpHosts{}
+	for _, addr := range strings.Split(opts.Host, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+
+		d, err := newSMTPDialer(opts, addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mail server %s: %v", addr, err)
+		}
+		hs.hosts = append(hs.hosts, &smtpHost{addr: addr, dialer: d, security: smtpSecurity(opts, d.Port)})
+	}
+	if len(hs.hosts) == 0 {
+		return nil, errors.New("no mail server configured")
+	}
+	return hs, nil
+}
+
+// candidates returns the hosts in the order to try them.
+func (hs *smtpHosts) candidates(now time.Time) []*smtpHost {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	hosts := make([]*smtpHost, len(hs.hosts))
+	copy(hosts, hs.hosts)
+	sort.SliceStable(hosts, func(i, j int) bool {
+		iDown, jDown := now.Before(hosts[i].downUntil), now.Before(hosts[j].downUntil)
+		if iDown && jDown {
+			return hosts[i].downUntil.Before(hosts[j].downUntil)
+		}
+		return !iDown && jDown
+	})
+	return hosts
+}
+
+// Dial opens a connection to the first reachable mail server.
+// This method is thread-safe.
+func (hs *smtpHosts) Dial() (gomail.SendCloser, error) {
+	var errs []string
+	for _, h := range hs.candidates(time.Now()) {
+		c, err := dialSMTPSecurity(h.dialer, h.security, ioutil.Discard)
+		if err == nil {
+			hs.markUp(h)
+			return c, nil
+		}
+
+		hs.markDown(h, time.Now())
+		log.Warn("Failed to connect to mail server %s: %v", h.addr, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", h.addr, err))
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (hs *smtpHosts) markUp(h *smtpHost) {
+	hs.lock.Lock()
+	h.failures = 0
+	h.downUntil = time.Time{}
+	hs.lock.Unlock()
+}
+
+func (hs *smtpHosts) markDown(h *smtpHost, now time.Time) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	downTime := smtpHostMinDownTime << uint(h.failures)
+	if downTime > smtpHostMaxDownTime || downTime <= 0 {
+		downTime = smtpHostMaxDownTime
+	}
+	h.failures++
+	h.downUntil = now.Add(downTime)
+}
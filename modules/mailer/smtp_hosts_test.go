@@ -0,0 +1,81 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/mailer/smtptest"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMTPHosts(t *testing.T) {
+	setting.MailService = &setting.Mailer{
+		Host:        "smtp1.example.com:587, smtp2.example.com:587,smtp3.example.com:25",
+		DisableHelo: true,
+	}
+	hs, err := newSMTPHosts(setting.MailService)
+	assert.NoError(t, err)
+
+	addrs := func(now time.Time) (list []string) {
+		for _, h := range hs.candidates(now) {
+			list = append(list, h.addr)
+		}
+		return list
+	}
+
+	now := time.Now()
+	assert.Equal(t, []string{"smtp1.example.com:587", "smtp2.example.com:587", "smtp3.example.com:25"}, addrs(now))
+
+	hs.markDown(hs.hosts[0], now)
+	hs.markDown(hs.hosts[1], now.Add(-time.Second))
+	assert.Equal(t, []string{"smtp3.example.com:25", "smtp2.example.com:587", "smtp1.example.com:587"}, addrs(now))
+	assert.Equal(t, now.Add(smtpHostMinDownTime), hs.hosts[0].downUntil)
+
+	// The down time doubles with every failure.
+	hs.markDown(hs.hosts[0], now)
+	assert.Equal(t, now.Add(2*smtpHostMinDownTime), hs.hosts[0].downUntil)
+
+	// Hosts are tried in order again after their down time.
+	assert.Equal(t, []string{"smtp1.example.com:587", "smtp2.example.com:587", "smtp3.example.com:25"}, addrs(now.Add(time.Hour)))
+
+	hs.markUp(hs.hosts[0])
+	assert.Equal(t, []string{"smtp1.example.com:587", "smtp3.example.com:25", "smtp2.example.com:587"}, addrs(now))
+
+	setting.MailService.Host = "smtp.example.com"
+	_, err = newSMTPHosts(setting.MailService)
+	assert.Error(t, err)
+}
+
+func TestSMTPHosts_Failover(t *testing.T) {
+	busy, backup := smtptest.NewServer(), smtptest.NewServer()
+	defer busy.Close()
+	defer backup.Close()
+	busy.AddRule(smtptest.Rule{Command: "CONNECT", Code: 421, Text: "Too busy"})
+
+	setting.MailService = &setting.Mailer{
+		From:         "gitea@example.com",
+		Host:         busy.Addr + "," + backup.Addr,
+		SMTPSecurity: "none",
+		DisableHelo:  true,
+	}
+	assert.NoError(t, resetSMTPPool())
+	defer resetSMTPPool()
+
+	s, err := newSMTPSender()
+	assert.NoError(t, err)
+	assert.NoError(t, s.Send(NewMessage([]string{"user@example.com"}, "Subject", "Body")))
+	assert.Len(t, backup.Messages(), 1)
+	assert.Equal(t, 1, busy.Connections())
+
+	// The busy server is not tried again within its down time.
+	s.Close()
+	assert.NoError(t, s.Send(NewMessage([]string{"user@example.com"}, "Subject", "Body")))
+	assert.Len(t, backup.Messages(), 2)
+	assert.Equal(t, 1, busy.Connections())
+}
@@ -0,0 +1,257 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"gopkg.in/gomail.v2"
+)
+
+// smtpConn is a connection of the pool.
+type smtpConn struct {
+	gomail.SendCloser
+	reused bool // Whether the connection was idle in the pool before.
+}
+
+// Extension reports whether the server offers the extension.
+func (c *smtpConn) Extension(ext string) (bool, string) {
+	if r, ok := c.SendCloser.(extensionReporter); ok {
+		return r.Extension(ext)
+	}
+	return false, ""
+}
+
+// noopSender is a connection which can send NOOP to keep the session alive.
+type noopSender interface {
+	Noop() error
+}
+
+// idleSMTPConn is a connection waiting in the pool.
+type idleSMTPConn struct {
+	gomail.SendCloser
+	used   time.Time // When the connection was returned to the pool.
+	active time.Time // When the server answered last, NOOP included.
+}
+
+// smtpPool is a bounded pool of SMTP connections shared by all senders. If
+// maxConns is greater than zero, at most maxConns connections are open at
+// the same time and further senders wait for a connection to be released.
+type smtpPool struct {
+	dial  func() (gomail.SendCloser, error)
+	slots chan struct{} // Nil if the number of connections is unlimited.
+
+	idleTimeout time.Duration // Idle connections are closed after it, 0 if never.
+	keepalive   time.Duration // NOOP interval keeping idle connections open, 0 if disabled.
+	maxIdle     time.Duration // Connections kept alive are closed after it, 0 if never.
+
+	lock   sync.Mutex
+	idle   []idleSMTPConn // The most recently used connection last.
+	closed bool           // Returned connections are closed, see CloseIfUnused.
+}
+
+// newSMTPPool creates a pool closing or keeping alive idle connections as
+// configured in the settings.
+func newSMTPPool(dial func() (gomail.SendCloser, error), maxConns int, opts *setting.Mailer) *smtpPool {
+	p := &smtpPool{
+		dial:        dial,
+		idleTimeout: opts.SMTPIdleTimeout,
+		keepalive:   opts.SMTPKeepalive,
+		maxIdle:     opts.SMTPKeepaliveMaxIdle,
+	}
+	if maxConns > 0 {
+		p.slots = make(chan struct{}, maxConns)
+	}
+	return p
+}
+
+// Get borrows an idle connection or opens a new one.
+// This method is thread-safe.
+func (p *smtpPool) Get() (*smtpConn, error) {
+	if p.slots != nil {
+		p.slots <- struct{}{}
+	}
+
+	p.lock.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return &smtpConn{c.SendCloser, true}, nil
+	}
+	p.lock.Unlock()
+
+	c, err := p.dial()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	countConnection(true)
+	return &smtpConn{c, false}, nil
+}
+
+// Put returns the connection to the pool.
+// This method is thread-safe.
+func (p *smtpPool) Put(c *smtpConn) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		p.Discard(c)
+		return
+	}
+	now := time.Now()
+	p.idle = append(p.idle, idleSMTPConn{c.SendCloser, now, now})
+	p.lock.Unlock()
+	p.release()
+}
+
+// Discard closes a broken connection instead of returning it to the pool.
+// This method is thread-safe.
+func (p *smtpPool) Discard(c *smtpConn) {
+	c.Close()
+	countConnection(false)
+	p.release()
+}
+
+// CloseIdle closes all idle connections.
+// This method is thread-safe.
+func (p *smtpPool) CloseIdle() (err error) {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+
+	for _, c := range idle {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+		countConnection(false)
+	}
+	return err
+}
+
+// CloseIfUnused closes the pool if it has no idle connections, connections
+// in use are closed when they are returned. It reports whether the pool was
+// closed.
+// This method is thread-safe.
+func (p *smtpPool) CloseIfUnused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.idle) > 0 {
+		return false
+	}
+	p.closed = true
+	return true
+}
+
+// Expire closes the connections idle for the idle timeout, or with
+// keepalive, sends NOOP on the connections idle for the keepalive interval
+// so the server does not close them and closes the ones unused for the
+// maximum idle time. A connection failing NOOP is closed. It returns the
+// time until it has to be called again, 0 if no idle connection is left to
+// expire.
+// This method is thread-safe.
+func (p *smtpPool) Expire() time.Duration {
+	now := time.Now()
+	var expired, due []idleSMTPConn
+	p.lock.Lock()
+	idle := p.idle[:0]
+	for _, c := range p.idle {
+		if d := p.deadline(c); d.IsZero() || now.Before(d) {
+			idle = append(idle, c)
+		} else if !p.keptAlive(c) || p.maxIdle > 0 && !now.Before(c.used.Add(p.maxIdle)) {
+			expired = append(expired, c)
+		} else if p.tryAcquire() {
+			// Meanwhile the connection counts against the maximum.
+			due = append(due, c)
+		} else {
+			// All connections are in use, it is kept alive later.
+			idle = append(idle, c)
+		}
+	}
+	p.idle = idle
+	p.lock.Unlock()
+
+	for _, c := range expired {
+		c.Close()
+		countConnection(false)
+	}
+	for _, c := range due {
+		if err := c.SendCloser.(noopSender).Noop(); err != nil {
+			log.Trace("Closing idle mail server connection: %v", err)
+			c.Close()
+			countConnection(false)
+		} else {
+			c.active = time.Now()
+			// Connections used in the meantime stay the most recent ones.
+			p.lock.Lock()
+			p.idle = append([]idleSMTPConn{c}, p.idle...)
+			p.lock.Unlock()
+		}
+		p.release()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var wait time.Duration
+	now = time.Now()
+	for _, c := range p.idle {
+		d := p.deadline(c)
+		if d.IsZero() {
+			continue
+		}
+		next := d.Sub(now)
+		if next < time.Second {
+			next = time.Second
+		}
+		wait = minWait(wait, next)
+	}
+	return wait
+}
+
+// keptAlive reports whether the idle connection is kept alive with NOOP.
+func (p *smtpPool) keptAlive(c idleSMTPConn) bool {
+	_, ok := c.SendCloser.(noopSender)
+	return ok && p.keepalive > 0
+}
+
+// deadline returns when the idle connection has to be closed or kept
+// alive, the zero time if never.
+func (p *smtpPool) deadline(c idleSMTPConn) time.Time {
+	if !p.keptAlive(c) {
+		if p.idleTimeout <= 0 {
+			return time.Time{}
+		}
+		return c.used.Add(p.idleTimeout)
+	}
+	next := c.active.Add(p.keepalive)
+	if p.maxIdle > 0 && c.used.Add(p.maxIdle).Before(next) {
+		next = c.used.Add(p.maxIdle)
+	}
+	return next
+}
+
+// tryAcquire takes a connection slot if one is free.
+func (p *smtpPool) tryAcquire() bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *smtpPool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+type testSMTPConn struct {
+	sendErr error
+	sent    int
+	closed  bool
+
+	noopErr error
+	noops   int
+}
+
+func (c *testSMTPConn) Noop() error {
+	c.noops++
+	return c.noopErr
+}
+
+func (c *testSMTPConn) Send(from string, to []string, msg io.WriterTo) error {
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+	c.sent++
+	return nil
+}
+
+func (c *testSMTPConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSMTPPool(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	var conns []*testSMTPConn
+	p := newSMTPPool(func() (gomail.SendCloser, error) {
+		c := &testSMTPConn{}
+		conns = append(conns, c)
+		return c, nil
+	}, 1, setting.MailService)
+	s := &smtpSender{pool: p}
+	msg := NewMessage([]string{"user2@example.com"}, "Subject", "Body")
+
+	// Connections are reused.
+	assert.NoError(t, s.Send(msg))
+	assert.NoError(t, s.Send(msg))
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, 2, conns[0].sent)
+	}
+
+	// A reused connection closed by the server is replaced.
+	conns[0].sendErr = io.EOF
+	assert.NoError(t, s.Send(msg))
+	if assert.Len(t, conns, 2) {
+		assert.True(t, conns[0].closed)
+		assert.Equal(t, 1, conns[1].sent)
+	}
+
+	// Errors replied by the server are returned.
+	conns[1].sendErr = &textproto.Error{Code: 550, Msg: "rejected"}
+	assert.Error(t, s.Send(msg))
+	assert.Len(t, conns, 2)
+
+	// After the error the connection slot is free again.
+	assert.NoError(t, s.Send(msg))
+	assert.Len(t, conns, 3)
+
+	assert.NoError(t, s.Close())
+	assert.True(t, conns[2].closed)
+
+	// Errors of new connections are not retried.
+	p.dial = func() (gomail.SendCloser, error) {
+		return &testSMTPConn{sendErr: errors.New("broken")}, nil
+	}
+	assert.Error(t, s.Send(msg))
+}
+
+func TestSMTPPool_Expire(t *testing.T) {
+	var conns []*testSMTPConn
+	p := newSMTPPool(func() (gomail.SendCloser, error) {
+		c := &testSMTPConn{}
+		conns = append(conns, c)
+		return c, nil
+	}, 2, &setting.Mailer{SMTPIdleTimeout: time.Minute})
+	c, err := p.Get()
+	assert.NoError(t, err)
+	p.Put(c)
+
+	// Idle connections are closed after the timeout.
+	wait := p.Expire()
+	assert.True(t, wait > 55*time.Second && wait <= time.Minute, wait)
+	assert.False(t, conns[0].closed)
+	p.idle[0].used = time.Now().Add(-time.Minute)
+	assert.Equal(t, time.Duration(0), p.Expire())
+	assert.True(t, conns[0].closed)
+}
+
+func TestSMTPPool_CloseIfUnused(t *testing.T) {
+	var conns []*testSMTPConn
+	p := newSMTPPool(func() (gomail.SendCloser, error) {
+		c := &testSMTPConn{}
+		conns = append(conns, c)
+		return c, nil
+	}, 0, &setting.Mailer{})
+	c, err := p.Get()
+	assert.NoError(t, err)
+	p.Put(c)
+	assert.False(t, p.CloseIfUnused())
+
+	// Connections in use when the pool is closed are closed once returned.
+	c, err = p.Get()
+	assert.NoError(t, err)
+	assert.True(t, p.CloseIfUnused())
+	p.Put(c)
+	assert.True(t, conns[0].closed)
+	assert.Empty(t, p.idle)
+}
+
+func TestSMTPPool_Keepalive(t *testing.T) {
+	var conns []*testSMTPConn
+	p := newSMTPPool(func() (gomail.SendCloser, error) {
+		c := &testSMTPConn{}
+		conns = append(conns, c)
+		return c, nil
+	}, 2, &setting.Mailer{SMTPIdleTimeout: time.Second, SMTPKeepalive: time.Minute, SMTPKeepaliveMaxIdle: time.Hour})
+	c1, err := p.Get()
+	assert.NoError(t, err)
+	c2, err := p.Get()
+	assert.NoError(t, err)
+	p.Put(c1)
+	p.Put(c2)
+
+	// Connections are only kept alive after the interval.
+	assert.True(t, p.Expire() > 55*time.Second)
+	assert.Equal(t, 0, conns[0].noops)
+	for i := range p.idle {
+		p.idle[i].active = time.Now().Add(-time.Minute)
+	}
+	assert.True(t, p.Expire() > 55*time.Second)
+	assert.Equal(t, 1, conns[0].noops)
+	assert.Equal(t, 1, conns[1].noops)
+	assert.False(t, conns[0].closed)
+
+	// A connection failing NOOP is closed.
+	conns[0].noopErr = io.EOF
+	for i := range p.idle {
+		p.idle[i].active = time.Now().Add(-time.Minute)
+	}
+	p.Expire()
+	assert.True(t, conns[0].closed)
+	assert.False(t, conns[1].closed)
+	assert.Len(t, p.idle, 1)
+
+	// The kept connection is reused.
+	c, err := p.Get()
+	assert.NoError(t, err)
+	assert.True(t, c.reused)
+	assert.Equal(t, conns[1], c.SendCloser)
+	p.Put(c)
+
+	// Connections idle for too long are closed.
+	p.idle[0].used = time.Now().Add(-time.Hour)
+	assert.Equal(t, time.Duration(0), p.Expire())
+	assert.True(t, conns[1].closed)
+	assert.Equal(t, 2, conns[1].noops)
+}
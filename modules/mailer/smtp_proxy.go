@@ -0,0 +1,281 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// getEnv returns the first non-empty environment variable of the names.
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// smtpProxy returns the proxy the connections to the address are dialed
+// through, which is SMTP_PROXY or ALL_PROXY, or nil if NO_PROXY excludes the
+// address or no proxy is configured.
+func smtpProxy(addr string) (*url.URL, error) {
+	proxy := setting.MailService.SMTPProxy
+	if len(proxy) == 0 {
+		proxy = getEnv("ALL_PROXY", "all_proxy")
+	}
+	if len(proxy) == 0 || proxy == "none" || noProxy(addr, getEnv("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || len(u.Host) == 0 {
+		// Like curl, a proxy given without scheme is an HTTP proxy.
+		if u, err = url.Parse("http://" + proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+		}
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// noProxy reports whether the address matches the comma separated hosts,
+// domains, IP addresses and networks of NO_PROXY.
+func noProxy(addr, noProxy string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case len(entry) == 0:
+			continue
+		case entry == "*":
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialSMTP opens a TCP connection to the address, through the proxy if one
+// is configured. A timeout of 0 means none.
+func dialSMTP(addr string, timeout time.Duration) (net.Conn, error) {
+	proxy, err := smtpProxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+
+	conn, err := net.DialTimeout("tcp", proxy.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", proxy.Host, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tunnel := conn
+	if proxy.Scheme == "http" {
+		tunnel, err = connectHTTPProxy(conn, proxy, addr)
+	} else {
+		err = connectSOCKS5(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// bufferedConn is a connection whose first bytes were read by the reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connectHTTPProxy opens a tunnel to the address with the CONNECT method.
+func connectHTTPProxy(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	// The server may have greeted already.
+	return &bufferedConn{conn, r}, nil
+}
+
+// Replies of SOCKS5 servers (RFC 1928).
+var socks5Errors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// connectSOCKS5 asks the SOCKS5 server to connect to the address. The host
+// is resolved by the proxy with socks5h, locally with socks5.
+func connectSOCKS5(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// Greeting with no authentication and username/password (RFC 1929).
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = []byte{2}
+	}
+	if _, err = conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != methods[0] {
+		return errors.New("SOCKS5 authentication method not accepted")
+	}
+	if proxy.User != nil {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		auth := append([]byte{1, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		host = ips[0].String()
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socks5Errors) {
+			return fmt.Errorf("SOCKS5 connect to %s: %s", addr, socks5Errors[reply[1]])
+		}
+		return fmt.Errorf("SOCKS5 connect to %s: error %d", addr, reply[1])
+	}
+
+	// Skip the bound address.
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		if _, err = io.ReadFull(conn, reply[:1]); err != nil {
+			return err
+		}
+		skip = int(reply[0])
+	default:
+		return errors.New("invalid SOCKS5 reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
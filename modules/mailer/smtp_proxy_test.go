@@ -0,0 +1,161 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+func TestNoProxy(t *testing.T) {
+	const list = "localhost, .internal.example.com,example.org, 10.0.0.0/8, 192.168.1.1, mail.example.net:25"
+	for addr, expected := range map[string]bool{
+		"localhost:587":                 true,
+		"smtp.internal.example.com:587": true,
+		"internal.example.com:587":      true,
+		"example.org:587":               true,
+		"mail.example.org:587":          true,
+		"10.1.2.3:587":                  true,
+		"192.168.1.1:587":               true,
+		"mail.example.net:25":           true,
+		"mail.example.net:587":          false,
+		"example.com:587":               false,
+		"192.168.1.2:587":               false,
+		"notexample.org:587":            false,
+	} {
+		assert.Equal(t, expected, noProxy(addr, list), addr)
+	}
+	assert.True(t, noProxy("example.com:587", "*"))
+	assert.False(t, noProxy("example.com:587", ""))
+}
+
+// pipe copies between the connections until one is closed.
+func pipe(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+	a.Close()
+	b.Close()
+}
+
+// serveTestSOCKS5 accepts one connection with username/password
+// authentication and connects it to the requested address.
+func serveTestSOCKS5(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 256)
+	io.ReadFull(conn, buf[:2])
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{5, 2})
+
+	io.ReadFull(conn, buf[:2])
+	n := buf[1]
+	io.ReadFull(conn, buf[:n])
+	username := string(buf[:n])
+	io.ReadFull(conn, buf[:1])
+	n = buf[0]
+	io.ReadFull(conn, buf[:n])
+	password := string(buf[:n])
+	if username != "user" || password != "secret" {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	io.ReadFull(conn, buf[:5])
+	assert.Equal(t, byte(3), buf[3], "host names are resolved by the proxy")
+	n = buf[4]
+	io.ReadFull(conn, buf[:n+2])
+	host := string(buf[:n])
+	port := binary.BigEndian.Uint16(buf[n:])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	pipe(conn, target)
+}
+
+// serveTestHTTPProxy accepts one CONNECT request.
+func serveTestHTTPProxy(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if !assert.NoError(t, err) || !assert.Equal(t, "CONNECT", req.Method) {
+		conn.Close()
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		conn.Close()
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(conn, target)
+}
+
+func TestDialSMTP_Proxy(t *testing.T) {
+	smtp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer smtp.Close()
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer proxy.Close()
+	_, port, _ := net.SplitHostPort(smtp.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	send := func(serveProxy func(*testing.T, net.Listener)) error {
+		go serveTestSMTP(t, smtp)
+		go serveProxy(t, proxy)
+		c, err := dialSMTPTranscript(gomail.NewDialer("localhost", portNum, "", ""), ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		err = NewMessage([]string{"user@example.com"}, "Subject", "Body").send(c)
+		c.Close()
+		return err
+	}
+
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", SMTPProxy: "socks5h://user:secret@" + proxy.Addr().String()}
+	assert.NoError(t, send(serveTestSOCKS5))
+
+	os.Setenv("ALL_PROXY", "http://"+proxy.Addr().String())
+	defer os.Unsetenv("ALL_PROXY")
+	setting.MailService.SMTPProxy = ""
+	assert.NoError(t, send(serveTestHTTPProxy))
+
+	// NO_PROXY bypasses the proxy, which is not listening.
+	os.Setenv("ALL_PROXY", "socks5://127.0.0.1:1")
+	os.Setenv("NO_PROXY", "localhost")
+	defer os.Unsetenv("NO_PROXY")
+	go serveTestSMTP(t, smtp)
+	c, err := dialSMTPTranscript(gomail.NewDialer("localhost", portNum, "", ""), ioutil.Discard)
+	if assert.NoError(t, err) {
+		c.Close()
+	}
+
+	setting.MailService.SMTPProxy = "ftp://proxy"
+	_, err = smtpProxy("mail.example.com:587")
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSMTPTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtp_tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Relay CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	setting.MailService = &setting.Mailer{
+		UseCertificate:  true,
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		CAFile:          certFile,
+		TLSMinVersion:   "TLS1.2",
+		TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+	}
+	config, err := newSMTPTLSConfig(setting.MailService, "smtp.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "smtp.example.com", config.ServerName)
+	assert.Len(t, config.Certificates, 1)
+	assert.EqualValues(t, tls.VersionTLS12, config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, config.CipherSuites)
+	if assert.NotNil(t, config.RootCAs) {
+		cert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		_, err = cert.Verify(x509.VerifyOptions{Roots: config.RootCAs})
+		assert.NoError(t, err)
+	}
+
+	setting.MailService.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	_, err = newSMTPTLSConfig(setting.MailService, "smtp.example.com")
+	assert.Error(t, err)
+
+	setting.MailService.TLSCipherSuites = nil
+	setting.MailService.CAFile = keyFile
+	_, err = newSMTPTLSConfig(setting.MailService, "smtp.example.com")
+	assert.Error(t, err)
+}
+
+func TestHeloHostname(t *testing.T) {
+	defer func(domain string) { setting.Domain = domain }(setting.Domain)
+	setting.MailService = &setting.Mailer{}
+
+	setting.Domain = "git.example.com"
+	name, err := heloHostname(setting.MailService)
+	assert.NoError(t, err)
+	assert.Equal(t, "git.example.com", name)
+
+	setting.Domain = "localhost"
+	hostname, _ := os.Hostname()
+	name, err = heloHostname(setting.MailService)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, name)
+
+	setting.Domain = "192.0.2.1"
+	name, _ = heloHostname(setting.MailService)
+	assert.Equal(t, "[192.0.2.1]", name)
+	setting.Domain = "2001:db8::1"
+	name, _ = heloHostname(setting.MailService)
+	assert.Equal(t, "[IPv6:2001:db8::1]", name)
+
+	setting.MailService.HeloHostname = "mail.example.com"
+	name, _ = heloHostname(setting.MailService)
+	assert.Equal(t, "mail.example.com", name)
+}
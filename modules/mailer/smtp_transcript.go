@@ -0,0 +1,461 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"gopkg.in/gomail.v2"
+)
+
+// smtpTranscript is an SMTP client which records the dialogue with the
+// server, used to diagnose the configuration with test mails. It follows
+// gomail.Dialer, but the credentials are not recorded. Unlike gomail it
+// supports every SECURITY mode, so the connections of the pool use it too and
+// discard the dialogue.
+type smtpTranscript struct {
+	w    io.Writer
+	conn net.Conn
+	text *textproto.Conn
+	host string
+	tls  bool
+	ext  map[string]string // Extensions offered by the server.
+
+	security string // SECURITY of the connection.
+
+	// Timeouts of the connection, 0 means none.
+	helloTimeout   time.Duration
+	commandTimeout time.Duration
+	dataTimeout    time.Duration
+
+	// Timeout of the current phase of the dialogue, the commands do not set
+	// their own deadline while it is not zero.
+	phase time.Duration
+}
+
+// dialSMTPTranscript connects and authenticates to the server of the dialer.
+func dialSMTPTranscript(d *gomail.Dialer, w io.Writer) (*smtpTranscript, error) {
+	return dialSMTPSecurity(d, smtpSecurity(setting.MailService, d.Port), w)
+}
+
+// dialSMTPSecurity connects to the server of the dialer with the SECURITY.
+func dialSMTPSecurity(d *gomail.Dialer, security string, w io.Writer) (*smtpTranscript, error) {
+	addr := net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	c := &smtpTranscript{w: w, host: d.Host, security: security}
+	var connectTimeout time.Duration
+	if opts := setting.MailService; opts != nil {
+		connectTimeout = opts.SMTPConnectTimeout
+		c.helloTimeout, c.commandTimeout, c.dataTimeout = opts.SMTPHelloTimeout, opts.SMTPCommandTimeout, opts.SMTPDataTimeout
+	}
+
+	fmt.Fprintf(w, "* Connecting to %s\n", addr)
+	conn, err := dialSMTP(addr, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The TLS handshake and the greeting count to connecting.
+	c.startPhase(conn, connectTimeout)
+	if c.security == "tls" {
+		tlsConn := tls.Client(conn, d.TLSConfig)
+		if err = c.handshake(tlsConn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c.setConn(conn)
+
+	if err = c.open(d); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startPhase sets the deadline of a phase of the dialogue on the connection.
+func (c *smtpTranscript) startPhase(conn net.Conn, timeout time.Duration) {
+	c.phase = timeout
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// endPhase clears the deadline of the phase, so the connection can be idle.
+func (c *smtpTranscript) endPhase() {
+	c.phase = 0
+	c.conn.SetDeadline(time.Time{})
+}
+
+func (c *smtpTranscript) setConn(conn net.Conn) {
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+func (c *smtpTranscript) handshake(conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	state := conn.ConnectionState()
+	fmt.Fprintf(c.w, "* TLS connection established (%s, %s)\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	c.tls = true
+	return nil
+}
+
+// open greets the server, starts TLS if offered and authenticates.
+func (c *smtpTranscript) open(d *gomail.Dialer) error {
+	if _, _, err := c.read(220); err != nil {
+		return c.timeoutError(err, "the greeting")
+	}
+	c.startPhase(c.conn, c.helloTimeout)
+	defer c.endPhase()
+	if err := c.hello(d.LocalName); err != nil {
+		return err
+	}
+
+	_, starttls := c.ext["STARTTLS"]
+	if !c.tls && !starttls && c.security == "starttls-required" {
+		// Do not authenticate or send mails in plain text, the capability
+		// may have been removed by a man in the middle.
+		fmt.Fprintf(c.w, "* STARTTLS is not offered by the server\n")
+		return errors.New("mail server does not offer STARTTLS, which is required")
+	}
+	if starttls && !c.tls && c.security != "none" {
+		if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(c.conn, d.TLSConfig)
+		if err := c.handshake(tlsConn); err != nil {
+			return err
+		}
+		c.setConn(tlsConn)
+		if err := c.hello(d.LocalName); err != nil {
+			return err
+		}
+	}
+
+	auth := d.Auth
+	if mechs, ok := c.ext["AUTH"]; ok && auth == nil && len(d.Username) > 0 {
+		// Same choice as gomail.
+		if strings.Contains(mechs, "CRAM-MD5") {
+			auth = smtp.CRAMMD5Auth(d.Username, d.Password)
+		} else if strings.Contains(mechs, "LOGIN") && !strings.Contains(mechs, "PLAIN") {
+			auth = &loginAuth{d.Username, d.Password}
+		} else {
+			auth = smtp.PlainAuth("", d.Username, d.Password, d.Host)
+		}
+	}
+	if auth != nil {
+		return c.auth(auth)
+	}
+	return nil
+}
+
+func (c *smtpTranscript) hello(name string) error {
+	if len(name) == 0 {
+		name = "localhost"
+	}
+	_, msg, err := c.cmd(250, "EHLO %s", name)
+	if _, isReply := err.(*textproto.Error); err != nil && !isReply {
+		return err
+	} else if err != nil {
+		if _, _, err = c.cmd(250, "HELO %s", name); err != nil {
+			return err
+		}
+		c.ext = nil
+		return nil
+	}
+
+	c.ext = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) > 1 {
+			c.ext[strings.ToUpper(fields[0])] = fields[1]
+		} else {
+			c.ext[strings.ToUpper(fields[0])] = ""
+		}
+	}
+	return nil
+}
+
+// auth runs the authentication exchange like smtp.Client.Auth.
+func (c *smtpTranscript) auth(a smtp.Auth) error {
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.host, TLS: c.tls, Auth: strings.Fields(c.ext["AUTH"])})
+	if err != nil {
+		fmt.Fprintf(c.w, "* Authentication not started: %v\n", err)
+		return err
+	}
+
+	visible, line := "AUTH "+mech, "AUTH "+mech
+	if resp != nil {
+		visible += " ***"
+		line += " " + base64.StdEncoding.EncodeToString(resp)
+	}
+	code, msg64, err := c.cmdHidden(0, visible, line)
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = base64.StdEncoding.DecodeString(msg64)
+		case 235:
+			// The last message isn't base64 because it isn't a challenge.
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// Abort the exchange.
+			c.cmdHidden(0, "*", "*")
+			break
+		}
+		if resp == nil {
+			break
+		}
+		code, msg64, err = c.cmdHidden(0, "***", base64.StdEncoding.EncodeToString(resp))
+	}
+	return err
+}
+
+// Extension reports whether the server offers the extension.
+func (c *smtpTranscript) Extension(ext string) (bool, string) {
+	param, ok := c.ext[strings.ToUpper(ext)]
+	return ok, param
+}
+
+// Send implements gomail.Sender. The recipients are split into transactions
+// of at most SMTP_MAX_RECIPIENTS and the ones the server defers for their
+// number are sent in another transaction (RFC 5321 4.5.3.1.10). Recipients
+// with other temporary failures are returned in ErrRecipientsDeferred once
+// the message was sent to the others.
+func (c *smtpTranscript) Send(from string, to []string, msg io.WriterTo) error {
+	var retry ErrRecipientsDeferred
+	for len(to) > 0 {
+		n := len(to)
+		if max := setting.MailService.SMTPMaxRecipients; max > 0 && n > max {
+			n = max
+		}
+		deferred, failed, err := c.transaction(from, to[:n], msg)
+		if err != nil {
+			return err
+		}
+		if len(failed.Recipients) > 0 {
+			retry.Recipients = append(retry.Recipients, failed.Recipients...)
+			if retry.Err == nil {
+				retry.Err = failed.Err
+			}
+		}
+		to = append(deferred, to[n:]...)
+	}
+	if len(retry.Recipients) > 0 {
+		return retry
+	}
+	return nil
+}
+
+// transaction sends the message to the recipients, pipelining the commands
+// if the server supports it. The message is sent if any recipient is
+// accepted, permanently rejected recipients are only logged as the others
+// would receive the message again if it was retried. The recipients deferred
+// with 452 are returned, as well as the ones with other temporary failures.
+// The parameters of the MAIL command are the ones of smtp.Client.
+func (c *smtpTranscript) transaction(from string, to []string, msg io.WriterTo) (deferred []string, failed ErrRecipientsDeferred, err error) {
+	var params string
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		params += " SMTPUTF8"
+	}
+
+	var accepted, rejected []string
+	var rcptErr error
+	rcpt := func(addr string, err error) {
+		switch {
+		case err == nil:
+			accepted = append(accepted, addr)
+		case errorCode(err) == 452:
+			deferred = append(deferred, addr)
+		case errorCode(err) >= 400 && errorCode(err) < 500:
+			failed.Recipients = append(failed.Recipients, addr)
+			if failed.Err == nil {
+				failed.Err = err
+			}
+		default:
+			rejected = append(rejected, addr)
+		}
+		if err != nil && rcptErr == nil {
+			rcptErr = err
+		}
+	}
+
+	if pipelining, _ := c.Extension("PIPELINING"); pipelining {
+		lines := []string{fmt.Sprintf("MAIL FROM:<%s>%s", from, params)}
+		for _, addr := range to {
+			lines = append(lines, fmt.Sprintf("RCPT TO:<%s>", addr))
+		}
+		lines = append(lines, "DATA")
+		c.startPhase(c.conn, c.commandTimeout)
+		for _, line := range lines {
+			fmt.Fprintf(c.w, "C: %s\n", line)
+			if err = c.text.PrintfLine("%s", line); err != nil {
+				err = c.timeoutError(err, "MAIL")
+				fmt.Fprintf(c.w, "* %v\n", err)
+				return nil, failed, err
+			}
+		}
+
+		// Every command gets a reply, even if an earlier one failed.
+		_, _, mailErr := c.read(250)
+		if _, isReply := mailErr.(*textproto.Error); mailErr != nil && !isReply {
+			return nil, failed, c.timeoutError(mailErr, "MAIL")
+		}
+		for _, addr := range to {
+			_, _, err = c.read(25)
+			if _, isReply := err.(*textproto.Error); err != nil && !isReply {
+				return nil, failed, c.timeoutError(err, "RCPT")
+			}
+			rcpt(addr, err)
+		}
+		_, _, err = c.read(354)
+		err = c.timeoutError(err, "DATA")
+		c.endPhase()
+		if err == nil && (mailErr != nil || len(accepted) == 0) {
+			// The server must not accept the data without recipients.
+			c.text.DotWriter().Close()
+			c.read(250)
+		}
+		if mailErr != nil {
+			return nil, failed, mailErr
+		}
+		if len(accepted) == 0 {
+			return nil, failed, rcptErr
+		}
+		if err != nil {
+			return nil, failed, err
+		}
+	} else {
+		if _, _, err = c.cmd(250, "MAIL FROM:<%s>%s", from, params); err != nil {
+			return nil, failed, err
+		}
+		for i, addr := range to {
+			_, _, err = c.cmd(25, "RCPT TO:<%s>", addr)
+			if _, isReply := err.(*textproto.Error); err != nil && !isReply {
+				return nil, failed, err
+			}
+			if rcpt(addr, err); len(deferred) > 0 {
+				// The following recipients would be deferred as well.
+				deferred = append(deferred, to[i+1:]...)
+				break
+			}
+		}
+		if len(accepted) == 0 {
+			return nil, failed, rcptErr
+		}
+		if _, _, err = c.cmd(354, "DATA"); err != nil {
+			return nil, failed, err
+		}
+	}
+
+	c.startPhase(c.conn, c.dataTimeout)
+	defer c.endPhase()
+	w := c.text.DotWriter()
+	n, err := msg.WriteTo(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	fmt.Fprintf(c.w, "C: (%d bytes of message data)\n", n)
+	if err != nil {
+		return nil, failed, c.timeoutError(err, "the message data")
+	}
+	if _, _, err = c.read(250); err != nil {
+		return nil, failed, c.timeoutError(err, "the message data")
+	}
+	if len(rejected) > 0 {
+		log.Warn("Mail server rejected recipients %v: %v", rejected, rcptErr)
+	}
+	return deferred, failed, nil
+}
+
+// Close implements gomail.SendCloser.
+func (c *smtpTranscript) Close() error {
+	_, _, err := c.cmd(221, "QUIT")
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Noop sends NOOP to keep the connection alive while it is idle.
+func (c *smtpTranscript) Noop() error {
+	_, _, err := c.cmd(250, "NOOP")
+	return err
+}
+
+func (c *smtpTranscript) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	return c.cmdHidden(expectCode, line, line)
+}
+
+// cmdHidden sends the line, but records the visible text instead. Outside
+// of a phase every command has its own deadline.
+func (c *smtpTranscript) cmdHidden(expectCode int, visible, line string) (int, string, error) {
+	if c.phase == 0 && c.commandTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.commandTimeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	command := strings.SplitN(visible, " ", 2)[0]
+	fmt.Fprintf(c.w, "C: %s\n", visible)
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		err = c.timeoutError(err, command)
+		fmt.Fprintf(c.w, "* %v\n", err)
+		return 0, "", err
+	}
+	code, msg, err := c.read(expectCode)
+	return code, msg, c.timeoutError(err, command)
+}
+
+// timeoutError describes a timeout of the connection, other errors are
+// returned unchanged. The mail is retried like after other network errors.
+func (c *smtpTranscript) timeoutError(err error, during string) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("mail server %s timed out during %s: %v", c.host, during, err)
+	}
+	return err
+}
+
+func (c *smtpTranscript) read(expectCode int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(expectCode)
+	if _, isReply := err.(*textproto.Error); err == nil || isReply {
+		lines := strings.Split(msg, "\n")
+		for i, line := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			fmt.Fprintf(c.w, "S: %d%s%s\n", code, sep, line)
+		}
+	} else {
+		fmt.Fprintf(c.w, "* %v\n", err)
+	}
+	return code, msg, err
+}
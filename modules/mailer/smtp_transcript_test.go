@@ -0,0 +1,313 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/mailer/smtptest"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/gomail.v2"
+)
+
+// serveTestSMTP accepts one connection and replies to the commands of a client.
+func serveTestSMTP(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH CRAM-MD5")
+		case "AUTH":
+			text.PrintfLine("334 PDE3ODkzLjEzMjA2NzkxMjNAdGVzc2VyYWN0LnN1c2FtLmluPg==")
+			text.ReadLine()
+			text.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.Contains(line, "unknown@") {
+				text.PrintfLine("550 No such user")
+			} else if strings.Contains(line, "greylisted@") {
+				text.PrintfLine("450 4.2.0 Greylisted, please try again later")
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			text.ReadDotBytes()
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func testTranscript(t *testing.T, to string) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go serveTestSMTP(t, l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	d := gomail.NewDialer(host, portNum, "user", "secret")
+	d.Auth = smtp.CRAMMD5Auth("user", "secret")
+
+	var transcript bytes.Buffer
+	c, err := dialSMTPTranscript(d, &transcript)
+	if !assert.NoError(t, err) {
+		return transcript.String(), err
+	}
+	msg := NewMessageFrom([]string{to}, "gitea@example.com", "Subject", "Body")
+	err = msg.send(c)
+	c.Close()
+	return transcript.String(), err
+}
+
+func TestSMTPTranscript(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	transcript, err := testTranscript(t, "user@example.com")
+	assert.NoError(t, err)
+	assert.Contains(t, transcript, "S: 220 localhost ESMTP\n")
+	assert.Contains(t, transcript, "C: EHLO localhost\nS: 250-localhost\nS: 250 AUTH CRAM-MD5\n")
+	assert.Contains(t, transcript, "C: AUTH CRAM-MD5\n")
+	assert.Contains(t, transcript, "C: ***\nS: 235 Authentication successful\n")
+	assert.Contains(t, transcript, "C: MAIL FROM:<gitea@example.com>\nS: 250 OK\n")
+	assert.Contains(t, transcript, "S: 250 Queued\nC: QUIT\nS: 221 Bye\n")
+	assert.NotContains(t, transcript, "secret")
+
+	transcript, err = testTranscript(t, "unknown@example.com")
+	assert.Error(t, err)
+	assert.Equal(t, 550, errorCode(err))
+	assert.Contains(t, transcript, "C: RCPT TO:<unknown@example.com>\nS: 550 No such user\n")
+}
+
+func TestSMTPTranscript_STARTTLSRequired(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", SMTPSecurity: "starttls-required"}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go serveTestSMTP(t, l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	d := gomail.NewDialer(host, portNum, "user", "secret")
+
+	var transcript bytes.Buffer
+	_, err = dialSMTPTranscript(d, &transcript)
+	assert.Error(t, err)
+	assert.Contains(t, transcript.String(), "* STARTTLS is not offered by the server\n")
+	assert.NotContains(t, transcript.String(), "C: AUTH")
+}
+
+// serveTestPipelining accepts one connection of a server offering PIPELINING,
+// which accepts two recipients per transaction.
+func serveTestPipelining(t *testing.T, l net.Listener, transactions *[][]string) {
+	conn, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	var rcpts []string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 PIPELINING")
+		case "MAIL":
+			rcpts = nil
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			switch {
+			case strings.Contains(line, "unknown@"):
+				text.PrintfLine("550 No such user")
+			case strings.Contains(line, "busy@"):
+				text.PrintfLine("450 Mailbox busy")
+			case len(rcpts) == 2:
+				text.PrintfLine("452 Too many recipients")
+			default:
+				rcpts = append(rcpts, line[len("RCPT TO:"):])
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			if len(rcpts) == 0 {
+				text.PrintfLine("554 No valid recipients")
+				continue
+			}
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			text.ReadDotBytes()
+			*transactions = append(*transactions, rcpts)
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		}
+	}
+}
+
+func TestSMTPTranscript_Pipelining(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", SMTPMaxRecipients: 4}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	var transactions [][]string
+	done := make(chan struct{})
+	go func() {
+		serveTestPipelining(t, l, &transactions)
+		close(done)
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	var transcript bytes.Buffer
+	c, err := dialSMTPTranscript(gomail.NewDialer(host, portNum, "", ""), &transcript)
+	if !assert.NoError(t, err) {
+		return
+	}
+	msg := NewMessage([]string{"a@example.com", "unknown@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}, "Subject", "Body")
+	assert.NoError(t, msg.send(c))
+	c.Close()
+	<-done
+
+	// The first transaction of four recipients defers one, which is sent
+	// with the remaining two.
+	assert.Equal(t, [][]string{
+		{"<a@example.com>", "<b@example.com>"},
+		{"<c@example.com>", "<d@example.com>"},
+		{"<e@example.com>"},
+	}, transactions)
+	assert.Contains(t, transcript.String(), "C: MAIL FROM:<gitea@example.com>\nC: RCPT TO:<a@example.com>\nC: RCPT TO:<unknown@example.com>\n")
+
+	transactions = nil
+	done = make(chan struct{})
+	go func() {
+		serveTestPipelining(t, l, &transactions)
+		close(done)
+	}()
+	c, err = dialSMTPTranscript(gomail.NewDialer(host, portNum, "", ""), ioutil.Discard)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = NewMessage([]string{"unknown@example.com"}, "Subject", "Body").send(c)
+	assert.Equal(t, 550, errorCode(err))
+	c.Close()
+	<-done
+	assert.Empty(t, transactions)
+}
+
+func TestSMTPTranscript_TemporaryFailure(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	msg := NewMessage([]string{"a@example.com", "busy@example.com", "b@example.com"}, "Subject", "Body")
+	for _, expected := range [][]string{
+		{"<a@example.com>", "<b@example.com>"},
+		nil,
+	} {
+		var transactions [][]string
+		done := make(chan struct{})
+		go func() {
+			serveTestPipelining(t, l, &transactions)
+			close(done)
+		}()
+		var transcript bytes.Buffer
+		c, err := dialSMTPTranscript(gomail.NewDialer(host, portNum, "", ""), &transcript)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = msg.send(c)
+		c.Close()
+		<-done
+
+		// The message is sent to the others and the busy mailbox is retried
+		// alone.
+		if expected != nil {
+			assert.True(t, IsErrRecipientsDeferred(err))
+			assert.Equal(t, []string{"busy@example.com"}, err.(ErrRecipientsDeferred).Recipients)
+			assert.Equal(t, [][]string{expected}, transactions)
+		} else {
+			assert.Equal(t, 450, errorCode(err))
+			assert.Empty(t, transactions)
+			assert.Contains(t, transcript.String(), "C: MAIL FROM:<gitea@example.com>\nC: RCPT TO:<busy@example.com>\nC: DATA\n")
+		}
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, msg.delivered)
+	}
+}
+
+func TestSMTPTranscript_Timeouts(t *testing.T) {
+	server := smtptest.NewServer()
+	defer server.Close()
+	host, port := server.Host()
+	setting.MailService = &setting.Mailer{
+		SMTPConnectTimeout: 200 * time.Millisecond,
+		SMTPHelloTimeout:   200 * time.Millisecond,
+		SMTPCommandTimeout: 200 * time.Millisecond,
+		SMTPDataTimeout:    200 * time.Millisecond,
+	}
+	d := &gomail.Dialer{Host: host, Port: port}
+
+	for _, test := range []struct {
+		command string
+		err     string
+	}{
+		{"CONNECT", "timed out during the greeting"},
+		{"EHLO", "timed out during EHLO"},
+		{"RCPT", "timed out during RCPT"},
+		{".", "timed out during the message data"},
+	} {
+		server.Reset()
+		server.AddRule(smtptest.Rule{Command: test.command, Code: 0})
+
+		start := time.Now()
+		c, err := dialSMTPSecurity(d, "none", ioutil.Discard)
+		if err == nil {
+			err = c.Send("gitea@example.com", []string{"user@example.com"}, bytes.NewBufferString("Subject: Test\r\n\r\nBody\r\n"))
+			c.conn.Close()
+		}
+		if assert.Error(t, err, test.command) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+		assert.True(t, time.Since(start) < 2*time.Second, test.command)
+	}
+}
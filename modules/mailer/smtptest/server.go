@@ -0,0 +1,330 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package smtptest provides an in-process SMTP server for tests, which
+// records the delivered messages and can reply with errors or not at all
+// to exercise the retries and failover of the mailer.
+package smtptest
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a message delivered to the server.
+type Message struct {
+	From string   // Address of MAIL FROM.
+	To   []string // Addresses of the accepted RCPT TO.
+	Data []byte   // Content after DATA, with CRLF line endings.
+}
+
+// A Rule changes the reply of the server to a command.
+type Rule struct {
+	Command string // SMTP command like RCPT, or CONNECT for the greeting.
+	Match   string // Substring the command line must contain, any if empty.
+	Code    int    // Reply code, 0 to never reply like a stuck server.
+	Text    string
+	Times   int           // Number of times the rule applies, 0 for always.
+	Delay   time.Duration // Time to wait before the reply.
+}
+
+// Server is an SMTP server listening on a local port. It accepts any
+// authentication and all recipients unless a rule says otherwise.
+type Server struct {
+	Addr string // Address of the server, like 127.0.0.1:2525.
+
+	listener net.Listener
+	closed   chan struct{}
+	wg       sync.WaitGroup
+
+	lock        sync.Mutex
+	rules       []*Rule
+	messages    []*Message
+	connections int
+	conns       map[net.Conn]struct{}
+	received    chan struct{}
+}
+
+// NewServer starts a server on a free port of the loopback interface.
+// Close it when the test is done.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+	}
+
+	s := &Server{
+		Addr:     l.Addr().String(),
+		listener: l,
+		closed:   make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		received: make(chan struct{}, 1),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Host returns the host and the port of the server.
+func (s *Server) Host() (string, int) {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// AddRule makes the server reply to the matching commands as the rule says.
+// The rules are tried in the order they were added.
+func (s *Server) AddRule(r Rule) {
+	s.lock.Lock()
+	s.rules = append(s.rules, &r)
+	s.lock.Unlock()
+}
+
+// Reset removes the rules and the recorded messages.
+func (s *Server) Reset() {
+	s.lock.Lock()
+	s.rules, s.messages, s.connections = nil, nil, 0
+	s.lock.Unlock()
+}
+
+// Messages returns the messages delivered to the server.
+func (s *Server) Messages() []*Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// WaitMessages waits until n messages are delivered to the server or the
+// timeout expires, and returns the delivered messages.
+func (s *Server) WaitMessages(n int, timeout time.Duration) []*Message {
+	deadline := time.After(timeout)
+	for {
+		if msgs := s.Messages(); len(msgs) >= n {
+			return msgs
+		}
+		select {
+		case <-s.received:
+		case <-deadline:
+			return s.Messages()
+		}
+	}
+}
+
+// Connections returns the number of connections accepted by the server.
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connections
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	close(s.closed)
+	s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.connections++
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// rule returns the first rule matching the command line, or nil if none
+// matches. Rules applying a number of times are removed when used up.
+func (s *Server) rule(cmd, line string) *Rule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, r := range s.rules {
+		if r.Command != cmd || !strings.Contains(line, r.Match) {
+			continue
+		}
+		if r.Times > 0 {
+			if r.Times--; r.Times == 0 {
+				s.rules = append(s.rules[:i:i], s.rules[i+1:]...)
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+// reply sends the reply of the first rule matching the command line, else
+// the default reply. It reports whether the reply is a positive one and
+// whether the connection is still open.
+func (s *Server) reply(text *textproto.Conn, cmd, line string, code int, msg string) (ok, open bool) {
+	if r := s.rule(cmd, line); r != nil {
+		return s.apply(text, r)
+	}
+	return true, text.PrintfLine("%d %s", code, msg) == nil
+}
+
+// apply replies as the rule says.
+func (s *Server) apply(text *textproto.Conn, r *Rule) (ok, open bool) {
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-s.closed:
+			return false, false
+		}
+	}
+	if r.Code == 0 {
+		<-s.closed
+		return false, false
+	}
+	if err := text.PrintfLine("%d %s", r.Code, r.Text); err != nil {
+		return false, false
+	}
+	// 421 announces that the server closes the connection.
+	return r.Code/100 == 2 || r.Code/100 == 3, r.Code != 421
+}
+
+func (s *Server) handle(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	if _, ok := s.reply(text, "CONNECT", "", 220, "localhost ESMTP smtptest"); !ok {
+		return
+	}
+
+	var msg *Message
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		var ok, open bool
+		switch cmd {
+		case "EHLO":
+			if r := s.rule(cmd, line); r != nil {
+				_, open = s.apply(text, r)
+				break
+			}
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250-8BITMIME")
+			text.PrintfLine("250-SMTPUTF8")
+			open = text.PrintfLine("250 AUTH PLAIN LOGIN") == nil
+		case "HELO", "NOOP":
+			ok, open = s.reply(text, cmd, line, 250, "OK")
+		case "AUTH":
+			open = s.auth(text, line)
+		case "MAIL":
+			if ok, open = s.reply(text, cmd, line, 250, "OK"); ok {
+				msg = &Message{From: address(line)}
+			}
+		case "RCPT":
+			if msg == nil {
+				open = text.PrintfLine("503 Need MAIL command") == nil
+			} else if ok, open = s.reply(text, cmd, line, 250, "OK"); ok {
+				msg.To = append(msg.To, address(line))
+			}
+		case "DATA":
+			if msg == nil || len(msg.To) == 0 {
+				open = text.PrintfLine("554 No valid recipients") == nil
+				break
+			}
+			if ok, open = s.reply(text, cmd, line, 354, "End data with <CR><LF>.<CR><LF>"); !ok {
+				break
+			}
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = []byte(strings.Replace(string(data), "\n", "\r\n", -1))
+			// The rules of the end of the data are those of the "." command.
+			if ok, open = s.reply(text, ".", "", 250, "OK queued"); ok {
+				s.deliver(msg)
+			}
+			msg = nil
+		case "RSET":
+			msg = nil
+			ok, open = s.reply(text, cmd, line, 250, "OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			open = text.PrintfLine("502 Command not implemented") == nil
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// auth accepts any credentials of AUTH PLAIN and AUTH LOGIN.
+func (s *Server) auth(text *textproto.Conn, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return text.PrintfLine("501 Syntax error") == nil
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "PLAIN":
+		if len(fields) == 2 {
+			text.PrintfLine("334 ")
+			if _, err := text.ReadLine(); err != nil {
+				return false
+			}
+		}
+	case "LOGIN":
+		for _, prompt := range []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} {
+			text.PrintfLine("334 %s", prompt)
+			if _, err := text.ReadLine(); err != nil {
+				return false
+			}
+		}
+	default:
+		return text.PrintfLine("504 Unrecognized authentication type") == nil
+	}
+	_, open := s.reply(text, "AUTH", line, 235, "Authentication successful")
+	return open
+}
+
+func (s *Server) deliver(msg *Message) {
+	s.lock.Lock()
+	s.messages = append(s.messages, msg)
+	s.lock.Unlock()
+
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+}
+
+// address returns the address of MAIL FROM:<addr> or RCPT TO:<addr>.
+func address(line string) string {
+	start, end := strings.IndexByte(line, '<'), strings.IndexByte(line, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
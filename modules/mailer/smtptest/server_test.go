@@ -0,0 +1,75 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package smtptest
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	auth := smtp.PlainAuth("", "user", "secret", "127.0.0.1")
+	err := smtp.SendMail(s.Addr, auth, "gitea@example.com", []string{"a@example.com", "b@example.com"}, []byte("Subject: Test\r\n\r\nBody\r\n"))
+	assert.NoError(t, err)
+	msgs := s.WaitMessages(1, time.Second)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "gitea@example.com", msgs[0].From)
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, msgs[0].To)
+		assert.Equal(t, "Subject: Test\r\n\r\nBody\r\n", string(msgs[0].Data))
+	}
+
+	// The rule rejects one recipient once.
+	s.Reset()
+	s.AddRule(Rule{Command: "RCPT", Match: "b@example.com", Code: 550, Text: "No such user", Times: 1})
+	err = smtp.SendMail(s.Addr, nil, "gitea@example.com", []string{"b@example.com"}, []byte("Body\r\n"))
+	if assert.IsType(t, &textproto.Error{}, err) {
+		assert.Equal(t, 550, err.(*textproto.Error).Code)
+	}
+	assert.NoError(t, smtp.SendMail(s.Addr, nil, "gitea@example.com", []string{"b@example.com"}, []byte("Body\r\n")))
+	assert.Len(t, s.WaitMessages(1, time.Second), 1)
+	assert.Equal(t, 2, s.Connections())
+
+	s.Reset()
+	s.AddRule(Rule{Command: ".", Code: 451, Text: "Try again later"})
+	err = smtp.SendMail(s.Addr, nil, "gitea@example.com", []string{"a@example.com"}, []byte("Body\r\n"))
+	if assert.IsType(t, &textproto.Error{}, err) {
+		assert.Equal(t, 451, err.(*textproto.Error).Code)
+	}
+	assert.Empty(t, s.Messages())
+
+	s.Reset()
+	s.AddRule(Rule{Command: "CONNECT", Code: 421, Text: "Too busy"})
+	err = smtp.SendMail(s.Addr, nil, "gitea@example.com", []string{"a@example.com"}, []byte("Body\r\n"))
+	if assert.IsType(t, &textproto.Error{}, err) {
+		assert.Equal(t, 421, err.(*textproto.Error).Code)
+	}
+}
+
+func TestServer_Timeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRule(Rule{Command: "MAIL", Code: 0})
+
+	conn, err := net.Dial("tcp", s.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	c, err := smtp.NewClient(conn, "127.0.0.1")
+	assert.NoError(t, err)
+
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	err = c.Mail("gitea@example.com")
+	if assert.Error(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), err.Error())
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the send duration histogram.
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram counts observed durations in buckets.
+type Histogram struct {
+	Buckets []float64 // Upper bounds in seconds.
+	Counts  []int64   // Cumulative number of observations per bucket.
+	Count   int64
+	Sum     float64 // In seconds.
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: buckets,
+		Counts:  make([]int64, len(buckets)),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range h.Buckets {
+		if seconds <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+func (h *Histogram) copy() *Histogram {
+	c := *h
+	c.Counts = append([]int64(nil), h.Counts...)
+	return &c
+}
+
+// Stats are the counters of the mail service since startup.
+type Stats struct {
+	// Overflows is the number of mails which did not fit into the
+	// queue, by the applied overflow policy.
+	Overflows map[string]int64
+
+	// Sent and Failed are the number of delivery attempts by
+	// sender backend, Durations their duration.
+	Sent      map[string]int64
+	Failed    map[string]int64
+	Durations map[string]*Histogram
+
+	// Retries is the number of failed mails queued again.
+	Retries int64
+
+	// ConnectionsOpened and ConnectionsClosed count the connections
+	// to the mail server.
+	ConnectionsOpened int64
+	ConnectionsClosed int64
+
+	// LastSent and LastFailed are the times of the last successful and
+	// failed delivery attempt, zero if there was none.
+	LastSent   time.Time
+	LastFailed time.Time
+
+	// CircuitOpens is the number of times the delivery was paused
+	// after consecutive failures.
+	CircuitOpens int64
+
+	// Opens and Clicks are the number of tracked mails opened and links
+	// clicked, by category of the mail.
+	Opens  map[string]int64
+	Clicks map[string]int64
+}
+
+var (
+	statsLock sync.Mutex
+	stats     = newStats()
+)
+
+func newStats() *Stats {
+	return &Stats{
+		Overflows: make(map[string]int64),
+		Sent:      make(map[string]int64),
+		Failed:    make(map[string]int64),
+		Durations: make(map[string]*Histogram),
+		Opens:     make(map[string]int64),
+		Clicks:    make(map[string]int64),
+	}
+}
+
+func countOverflow(policy string) {
+	statsLock.Lock()
+	stats.Overflows[policy]++
+	statsLock.Unlock()
+}
+
+func countSend(backend string, d time.Duration, err error) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	if err != nil {
+		stats.Failed[backend]++
+		stats.LastFailed = time.Now()
+	} else {
+		stats.Sent[backend]++
+		stats.LastSent = time.Now()
+	}
+	h := stats.Durations[backend]
+	if h == nil {
+		h = newHistogram(durationBuckets)
+		stats.Durations[backend] = h
+	}
+	h.observe(d)
+}
+
+func countRetry() {
+	statsLock.Lock()
+	stats.Retries++
+	statsLock.Unlock()
+}
+
+func countConnection(opened bool) {
+	statsLock.Lock()
+	if opened {
+		stats.ConnectionsOpened++
+	} else {
+		stats.ConnectionsClosed++
+	}
+	statsLock.Unlock()
+}
+
+func countCircuitOpen() {
+	statsLock.Lock()
+	stats.CircuitOpens++
+	statsLock.Unlock()
+}
+
+func countTracking(open bool, category Category) {
+	statsLock.Lock()
+	if open {
+		stats.Opens[string(category)]++
+	} else {
+		stats.Clicks[string(category)]++
+	}
+	statsLock.Unlock()
+}
+
+// GetStats returns a copy of the current counters.
+func GetStats() *Stats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	s := newStats()
+	for policy, n := range stats.Overflows {
+		s.Overflows[policy] = n
+	}
+	for backend, n := range stats.Sent {
+		s.Sent[backend] = n
+	}
+	for backend, n := range stats.Failed {
+		s.Failed[backend] = n
+	}
+	for backend, h := range stats.Durations {
+		s.Durations[backend] = h.copy()
+	}
+	s.Retries = stats.Retries
+	s.ConnectionsOpened = stats.ConnectionsOpened
+	s.ConnectionsClosed = stats.ConnectionsClosed
+	s.LastSent, s.LastFailed = stats.LastSent, stats.LastFailed
+	s.CircuitOpens = stats.CircuitOpens
+	for category, n := range stats.Opens {
+		s.Opens[category] = n
+	}
+	for category, n := range stats.Clicks {
+		s.Clicks[category] = n
+	}
+	return s
+}
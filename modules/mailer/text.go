@@ -0,0 +1,88 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToText converts an HTML mail body into readable plain text. Tags are
+// stripped and links are replaced by numbered references, which are listed
+// as footnotes at the end of the text.
+func htmlToText(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	var links []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			// Links remove themselves from the tree.
+			next := c.NextSibling
+			walk(c)
+			c = next
+		}
+		if n.Type != html.ElementNode || n.DataAtom != atom.A {
+			return
+		}
+
+		var href string
+		for _, attr := range n.Attr {
+			if attr.Key == "href" {
+				href = strings.TrimSpace(attr.Val)
+			}
+		}
+		if len(href) == 0 || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "mailto:") {
+			return
+		}
+
+		// Replace the link by its text followed by the reference.
+		text := strings.TrimSpace(nodeText(n))
+		if text != href {
+			links = append(links, href)
+			text = fmt.Sprintf("%s [%d]", text, len(links))
+		}
+		n.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: text}, n)
+		n.Parent.RemoveChild(n)
+	}
+	walk(doc)
+
+	var buf bytes.Buffer
+	if err = html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	text, err := html2text.FromString(buf.String())
+	if err != nil {
+		return "", err
+	}
+
+	if len(links) > 0 {
+		text += "\n\n"
+		for i, link := range links {
+			text += fmt.Sprintf("[%d] %s\n", i+1, link)
+		}
+	}
+	return text, nil
+}
+
+// nodeText returns the concatenated text of all text nodes below n.
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var s string
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s += nodeText(c)
+	}
+	return s
+}
@@ -0,0 +1,18 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	text, err := htmlToText(`<html><body><p>See <a href="https://try.gitea.io/user2/repo1/issues/1">issue #1</a>` +
+		` and <a href="https://try.gitea.io">https://try.gitea.io</a>.</p></body></html>`)
+	assert.NoError(t, err)
+	assert.Equal(t, "See issue #1 [1] and https://try.gitea.io.\n\n[1] https://try.gitea.io/user2/repo1/issues/1\n", text)
+}
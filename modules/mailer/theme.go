@@ -0,0 +1,108 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Themes of HTML mails.
+const (
+	ThemeNone  = "none"  // The mail templates are sent as they are.
+	ThemeLight = "light" // The light theme.
+	ThemeAuto  = "auto"  // The light theme, dark for clients preferring it.
+)
+
+// themeLightCSS is the style sheet of the light theme, formatted with the
+// brand color. Its rules are inlined before the mail is sent.
+const themeLightCSS = `body { margin: 0; padding: 16px; background-color: #ffffff; color: #24292e; }
+a { color: %[1]s; }
+.mail-header { padding-bottom: 16px; margin-bottom: 16px; border-bottom: 2px solid %[1]s; }
+.mail-header img { height: 32px; border: 0; }`
+
+// themeDarkCSS is the style sheet of the dark theme, which overrides the
+// inlined light theme in clients preferring dark colors.
+const themeDarkCSS = `@media (prefers-color-scheme: dark) {
+body, div, p, td, th { background-color: #1b1c1d !important; color: #dbdbdb !important; }
+a { color: %[1]s !important; }
+code, pre { background-color: #2e323e !important; color: #dbdbdb !important; }
+}`
+
+// applyTheme adds the theme of the mailer to the HTML body: the style sheets
+// of the light and, for the auto theme, the dark colors with the hints of
+// the supported color schemes, and a header with the logo.
+func applyTheme(body string) (string, error) {
+	theme := setting.MailService.Theme
+	if theme != ThemeLight && theme != ThemeAuto {
+		return body, nil
+	}
+
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	head, bodyNode := findElement(doc, atom.Head), findElement(doc, atom.Body)
+	if head == nil || bodyNode == nil {
+		return body, nil
+	}
+
+	brand := setting.MailService.ThemeBrandColor
+	if theme == ThemeAuto {
+		head.AppendChild(metaNode("color-scheme", "light dark"))
+		head.AppendChild(metaNode("supported-color-schemes", "light dark"))
+	}
+	// The theme goes first, so the style sheets of the templates override it.
+	css := fmt.Sprintf(themeLightCSS, brand)
+	if theme == ThemeAuto {
+		css += "\n" + fmt.Sprintf(themeDarkCSS, brand)
+	}
+	style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+	style.AppendChild(&html.Node{Type: html.TextNode, Data: css})
+	head.InsertBefore(style, firstStyle(head))
+
+	if logo := setting.MailService.ThemeLogo; len(logo) > 0 {
+		img := &html.Node{Type: html.ElementNode, Data: "img", DataAtom: atom.Img, Attr: []html.Attribute{
+			{Key: "src", Val: logo},
+			{Key: "alt", Val: setting.AppName},
+		}}
+		header := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []html.Attribute{
+			{Key: "class", Val: "mail-header"},
+		}}
+		header.AppendChild(img)
+		bodyNode.InsertBefore(header, bodyNode.FirstChild)
+	}
+
+	var buf bytes.Buffer
+	if err = html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// metaNode returns a meta element with the name and content.
+func metaNode(name, content string) *html.Node {
+	return &html.Node{Type: html.ElementNode, Data: "meta", DataAtom: atom.Meta, Attr: []html.Attribute{
+		{Key: "name", Val: name},
+		{Key: "content", Val: content},
+	}}
+}
+
+// firstStyle returns the first style element of the head, nil if it has
+// none.
+func firstStyle(head *html.Node) *html.Node {
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Style {
+			return c
+		}
+	}
+	return nil
+}
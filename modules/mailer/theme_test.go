@@ -0,0 +1,49 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyTheme(t *testing.T) {
+	setting.AppName = "Gitea"
+	setting.MailService = &setting.Mailer{
+		Theme:           ThemeAuto,
+		ThemeBrandColor: "#ff0000",
+		ThemeLogo:       "https://try.gitea.io/img/gitea-lg.png",
+	}
+	body := `<html><head><style>a { color: blue }</style></head><body><p>Hi</p></body></html>`
+
+	themed, err := applyTheme(body)
+	assert.NoError(t, err)
+	assert.Contains(t, themed, `<meta name="color-scheme" content="light dark"/>`)
+	assert.Contains(t, themed, "a { color: #ff0000; }")
+	assert.Contains(t, themed, "@media (prefers-color-scheme: dark)")
+	assert.Contains(t, themed, `<body><div class="mail-header"><img src="https://try.gitea.io/img/gitea-lg.png" alt="Gitea"/></div><p>Hi</p></body>`)
+
+	// The style sheet of the template comes last and takes precedence when inlined.
+	inlined, err := inlineCSS(themed)
+	assert.NoError(t, err)
+	assert.Contains(t, inlined, `<p>Hi</p>`)
+	assert.Contains(t, inlined, `<img src="https://try.gitea.io/img/gitea-lg.png" alt="Gitea" style="height: 32px; border: 0"/>`)
+	assert.Contains(t, inlined, "<style>@media (prefers-color-scheme: dark)")
+
+	setting.MailService.Theme = ThemeLight
+	setting.MailService.ThemeLogo = ""
+	themed, err = applyTheme(body)
+	assert.NoError(t, err)
+	assert.NotContains(t, themed, "color-scheme")
+	assert.NotContains(t, themed, `class="mail-header"`)
+
+	setting.MailService.Theme = ThemeNone
+	themed, err = applyTheme(body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, themed)
+}
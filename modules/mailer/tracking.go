@@ -0,0 +1,222 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// ErrTrackingDisabled is returned for tracking requests of a disabled kind of tracking.
+	ErrTrackingDisabled = errors.New("mail tracking is disabled")
+	// ErrTrackingToken is returned if a tracking token is invalid.
+	ErrTrackingToken = errors.New("invalid mail tracking token")
+)
+
+// TrackingResolver reports whether the owner of the address allows to track
+// whether the mails are opened and their links clicked.
+type TrackingResolver func(to string) bool
+
+var (
+	trackingResolverLock sync.RWMutex
+	trackingResolver     TrackingResolver
+)
+
+// SetTrackingResolver sets the function consulted for all receivers of
+// tracked mails before they are queued.
+// This method is thread-safe.
+func SetTrackingResolver(r TrackingResolver) {
+	trackingResolverLock.Lock()
+	trackingResolver = r
+	trackingResolverLock.Unlock()
+}
+
+// allowsTracking reports whether the owner of the address allows tracking.
+// Without a resolver all mails can be tracked.
+func allowsTracking(to string) bool {
+	trackingResolverLock.RLock()
+	resolve := trackingResolver
+	trackingResolverLock.RUnlock()
+	return resolve == nil || resolve(to)
+}
+
+// trackingToken returns the token of the tracking URLs of a mail of the
+// category, with the target of a link. The token is signed with the
+// SECRET_KEY, so the links cannot be used to redirect to other sites.
+func trackingToken(category Category, target string) string {
+	data := base64.RawURLEncoding.EncodeToString([]byte(string(category) + "\n" + target))
+	return data + "." + trackingSignature(data)
+}
+
+func trackingSignature(data string) string {
+	mac := hmac.New(sha256.New, []byte(setting.SecretKey))
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// parseTrackingToken returns the category and the link target of the token.
+func parseTrackingToken(token string) (Category, string, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(trackingSignature(token[:i]))) {
+		return "", "", ErrTrackingToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return "", "", ErrTrackingToken
+	}
+	parts := strings.SplitN(string(payload), "\n", 2)
+	if len(parts) != 2 {
+		return "", "", ErrTrackingToken
+	}
+
+	category := Category(parts[0])
+	switch category {
+	case CategoryNotification, CategoryDigest, CategoryBroadcast:
+	default:
+		return "", "", ErrTrackingToken
+	}
+	return category, parts[1], nil
+}
+
+// TrackOpen counts the opening of a mail by the request of the tracking
+// pixel with the token.
+func TrackOpen(token string) error {
+	if setting.MailService == nil || !setting.MailService.TrackOpens {
+		return ErrTrackingDisabled
+	}
+	category, _, err := parseTrackingToken(token)
+	if err != nil {
+		return err
+	}
+	countTracking(true, category)
+	return nil
+}
+
+// TrackClick counts the click of a link with the token and returns the URL
+// the link points to.
+func TrackClick(token string) (string, error) {
+	if setting.MailService == nil || !setting.MailService.TrackClicks {
+		return "", ErrTrackingDisabled
+	}
+	category, target, err := parseTrackingToken(token)
+	if err != nil {
+		return "", err
+	} else if len(target) == 0 {
+		return "", ErrTrackingToken
+	}
+	countTracking(false, category)
+	return target, nil
+}
+
+// addTracking adds the tracking pixel to the HTML body of the message and
+// routes its links through the click tracking, as enabled by TRACK_OPENS and
+// TRACK_CLICKS. Account mails, plain text mails and mails to a receiver who
+// opted out are not tracked.
+func addTracking(msg *Message) {
+	opts := setting.MailService
+	if !opts.TrackOpens && !opts.TrackClicks || opts.SendAsPlainText ||
+		msg.Category == CategorySecurity || len(msg.html) == 0 || msg.raw != nil {
+		return
+	}
+	_, to, err := msg.envelope()
+	if err != nil {
+		return
+	}
+	for _, addr := range to {
+		if !allowsTracking(addr) {
+			return
+		}
+	}
+
+	category := msg.Category
+	if len(category) == 0 {
+		category = CategoryNotification
+	}
+	body, err := trackBody(msg.html, category)
+	if err != nil {
+		log.Error(3, "Failed to add the tracking to e-mails %s: %s - %v", msg.GetHeader("To"), msg.Info, err)
+		return
+	}
+	msg.SetAlternativeBodies(msg.text, body)
+}
+
+// trackBody rewrites the HTTP links of the HTML body to the click tracking
+// and adds the tracking pixel at the end of the body.
+func trackBody(body string, category Category) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	opts := setting.MailService
+	var bodyNode *html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Body:
+				bodyNode = n
+			case atom.A:
+				if opts.TrackClicks {
+					trackLink(n, category)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if opts.TrackOpens && bodyNode != nil {
+		bodyNode.AppendChild(&html.Node{
+			Type:     html.ElementNode,
+			Data:     "img",
+			DataAtom: atom.Img,
+			Attr: []html.Attribute{
+				{Key: "src", Val: setting.AppURL + "mail/open/" + trackingToken(category, "")},
+				{Key: "width", Val: "1"},
+				{Key: "height", Val: "1"},
+				{Key: "alt", Val: ""},
+				{Key: "style", Val: "border:0"},
+			},
+		})
+	}
+
+	var buf bytes.Buffer
+	if err = html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// trackLink routes the HTTP link of the anchor through the click tracking.
+func trackLink(n *html.Node, category Category) {
+	for i, attr := range n.Attr {
+		if attr.Key != "href" {
+			continue
+		}
+		href := strings.TrimSpace(attr.Val)
+		lower := strings.ToLower(href)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") ||
+			strings.HasPrefix(href, setting.AppURL+"mail/") {
+			return
+		}
+		n.Attr[i].Val = setting.AppURL + "mail/click/" + trackingToken(category, href)
+		return
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackingToken(t *testing.T) {
+	setting.SecretKey = "secret"
+	token := trackingToken(CategoryDigest, "https://example.com/?a=b")
+	category, target, err := parseTrackingToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, CategoryDigest, category)
+	assert.Equal(t, "https://example.com/?a=b", target)
+
+	// Tokens of other links or keys are rejected.
+	other := trackingToken(CategoryDigest, "https://evil.example.com/")
+	_, _, err = parseTrackingToken(token[:strings.IndexByte(token, '.')] + other[strings.IndexByte(other, '.'):])
+	assert.Equal(t, ErrTrackingToken, err)
+	setting.SecretKey = "other"
+	_, _, err = parseTrackingToken(token)
+	assert.Equal(t, ErrTrackingToken, err)
+	_, _, err = parseTrackingToken(trackingToken(CategorySecurity, ""))
+	assert.Equal(t, ErrTrackingToken, err)
+	_, _, err = parseTrackingToken("invalid")
+	assert.Equal(t, ErrTrackingToken, err)
+}
+
+func TestTrackBody(t *testing.T) {
+	setting.AppURL = "https://try.gitea.io/"
+	setting.MailService = &setting.Mailer{TrackOpens: true, TrackClicks: true}
+	body, err := trackBody(`<html><body><a href="https://example.com/">link</a> <a href="mailto:user@example.com">mail</a></body></html>`, CategoryNotification)
+	assert.NoError(t, err)
+	assert.Contains(t, body, `<a href="https://try.gitea.io/mail/click/`+trackingToken(CategoryNotification, "https://example.com/")+`">link</a>`)
+	assert.Contains(t, body, `<a href="mailto:user@example.com">mail</a>`)
+	assert.Contains(t, body, `<img src="https://try.gitea.io/mail/open/`+trackingToken(CategoryNotification, "")+`"`)
+
+	setting.MailService.TrackClicks = false
+	body, err = trackBody(`<html><body><a href="https://example.com/">link</a></body></html>`, CategoryNotification)
+	assert.NoError(t, err)
+	assert.Contains(t, body, `<a href="https://example.com/">link</a>`)
+	assert.Contains(t, body, "/mail/open/")
+}
+
+func TestAddTracking(t *testing.T) {
+	setting.AppURL = "https://try.gitea.io/"
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", TrackOpens: true}
+	SetTrackingResolver(func(to string) bool {
+		return to != "private@example.com"
+	})
+	defer SetTrackingResolver(nil)
+
+	msg := NewMessage([]string{"user@example.com"}, "Subject", "<p>Body</p>")
+	addTracking(msg)
+	assert.Contains(t, msg.html, "/mail/open/")
+
+	// Account mails and receivers who opted out are not tracked.
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "<p>Body</p>")
+	msg.Category = CategorySecurity
+	addTracking(msg)
+	assert.NotContains(t, msg.html, "/mail/open/")
+	msg = NewMessage([]string{"user@example.com", "private@example.com"}, "Subject", "<p>Body</p>")
+	addTracking(msg)
+	assert.NotContains(t, msg.html, "/mail/open/")
+
+	setting.MailService.TrackOpens = false
+	msg = NewMessage([]string{"user@example.com"}, "Subject", "<p>Body</p>")
+	addTracking(msg)
+	assert.NotContains(t, msg.html, "/mail/open/")
+}
+
+func TestTrackOpenAndClick(t *testing.T) {
+	statsLock.Lock()
+	stats = newStats()
+	statsLock.Unlock()
+
+	setting.MailService = &setting.Mailer{}
+	assert.Equal(t, ErrTrackingDisabled, TrackOpen(trackingToken(CategoryDigest, "")))
+	_, err := TrackClick(trackingToken(CategoryDigest, "https://example.com/"))
+	assert.Equal(t, ErrTrackingDisabled, err)
+
+	setting.MailService = &setting.Mailer{TrackOpens: true, TrackClicks: true}
+	assert.NoError(t, TrackOpen(trackingToken(CategoryDigest, "")))
+	target, err := TrackClick(trackingToken(CategoryBroadcast, "https://example.com/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/", target)
+	_, err = TrackClick(trackingToken(CategoryBroadcast, ""))
+	assert.Equal(t, ErrTrackingToken, err)
+
+	s := GetStats()
+	assert.Equal(t, map[string]int64{"digest": 1}, s.Opens)
+	assert.Equal(t, map[string]int64{"broadcast": 1}, s.Clicks)
+}
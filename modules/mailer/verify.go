@@ -0,0 +1,118 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// calloutTimeout is the time the mail server gets to answer a callout.
+const calloutTimeout = 15 * time.Second
+
+// calloutsPerMinute limits the callouts for the requests of a client, which
+// could otherwise probe addresses of other domains through the server.
+const calloutsPerMinute = 5
+
+// calloutLimits are the rate limits of the callouts by client address.
+var calloutLimits = newDomainRateLimiter(calloutsPerMinute)
+
+// ErrUndeliverableAddress represents a "UndeliverableAddress" kind of error.
+type ErrUndeliverableAddress struct {
+	Email  string
+	Reason string
+}
+
+// IsErrUndeliverableAddress checks if an error is a ErrUndeliverableAddress.
+func IsErrUndeliverableAddress(err error) bool {
+	_, ok := err.(ErrUndeliverableAddress)
+	return ok
+}
+
+func (err ErrUndeliverableAddress) Error() string {
+	return fmt.Sprintf("email address can not receive mail [email: %s, reason: %s]", err.Email, err.Reason)
+}
+
+// lookupHost returns the addresses of the host, it is overridden by tests.
+var lookupHost = net.LookupHost
+
+// VerifyAddress checks with ADDRESS_VERIFICATION whether the address can
+// receive mail: its syntax, the mail servers of its domain and with callout
+// whether one of them accepts the recipient. It returns ErrUndeliverableAddress
+// if it can not, temporary failures of the DNS or the mail server are only
+// logged. The callouts of the requests from the remote address are rate
+// limited, the address is only checked for a mail server beyond the limit.
+func VerifyAddress(email, remoteAddr string) error {
+	if setting.MailService == nil || setting.MailService.AddressVerification == "none" {
+		return nil
+	}
+
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email {
+		return ErrUndeliverableAddress{email, "invalid address"}
+	}
+	domain := idnaDomain(email[strings.LastIndexByte(email, '@')+1:])
+
+	mxs, _, err := lookupMX(domain)
+	if err != nil {
+		log.Warn("Verifying %s: MX lookup of %s failed: %v", email, domain, err)
+		return nil
+	}
+	switch {
+	case len(mxs) == 1 && mxs[0].Host == ".":
+		return ErrUndeliverableAddress{email, "domain does not accept mail"}
+	case len(mxs) == 0:
+		// The domain itself is the implicit mail server (RFC 5321).
+		if _, err = lookupHost(domain); err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				return ErrUndeliverableAddress{email, "domain has no mail server"}
+			}
+			log.Warn("Verifying %s: lookup of %s failed: %v", email, domain, err)
+			return nil
+		}
+	}
+
+	if setting.MailService.AddressVerification == "callout" {
+		now := time.Now()
+		if calloutLimits.limiter(remoteAddr, now).Reserve(now) > 0 {
+			log.Warn("Verifying %s: too many callouts for %s, skipping the callout", email, remoteAddr)
+			return nil
+		}
+		return callout(email, domain)
+	}
+	return nil
+}
+
+// callout asks a mail server of the domain whether it accepts the recipient,
+// with the null sender and without sending a message.
+func callout(email, domain string) error {
+	c, err := connectDomain(domain, ioutil.Discard)
+	if err != nil {
+		log.Warn("Verifying %s: %v", email, err)
+		return nil
+	}
+	defer c.Close()
+	c.conn.SetDeadline(time.Now().Add(calloutTimeout))
+
+	if _, _, err = c.cmd(250, "MAIL FROM:<>"); err != nil {
+		// The server rejects the sender, not the recipient.
+		log.Warn("Verifying %s: %v", email, err)
+		return nil
+	}
+	_, msg, err := c.cmd(25, "RCPT TO:<%s>", idnaAddress(email))
+	if code := errorCode(err); code >= 500 && code < 600 {
+		return ErrUndeliverableAddress{email, msg}
+	} else if err != nil {
+		log.Warn("Verifying %s: %v", email, err)
+	}
+	return nil
+}
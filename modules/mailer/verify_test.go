@@ -0,0 +1,78 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAddress(t *testing.T) {
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", AddressVerification: "mx"}
+
+	mx, host := lookupMX, lookupHost
+	defer func() {
+		lookupMX, lookupHost = mx, host
+		directPort = 25
+	}()
+	lookupMX = func(domain string) ([]*net.MX, bool, error) {
+		switch domain {
+		case "null.example.org":
+			return []*net.MX{{Host: "."}}, false, nil
+		case "nomx.example.org", "missing.example.org":
+			return nil, false, nil
+		case "failing.example.org":
+			return nil, false, errors.New("timeout")
+		}
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, false, nil
+	}
+	lookupHost = func(host string) ([]string, error) {
+		if host == "missing.example.org" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+
+	assert.NoError(t, VerifyAddress("user@example.org", "127.0.0.1"))
+	assert.NoError(t, VerifyAddress("user@nomx.example.org", "127.0.0.1"))
+	assert.NoError(t, VerifyAddress("user@failing.example.org", "127.0.0.1"))
+	for _, email := range []string{"invalid", "User <user@example.org>", "user@null.example.org", "user@missing.example.org"} {
+		assert.True(t, IsErrUndeliverableAddress(VerifyAddress(email, "127.0.0.1")), email)
+	}
+
+	// The callout rejects unknown recipients only.
+	setting.MailService.AddressVerification = "callout"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	directPort, _ = strconv.Atoi(port)
+
+	for email, undeliverable := range map[string]bool{
+		"user@example.org":       false,
+		"unknown@example.org":    true,
+		"greylisted@example.org": false,
+	} {
+		go serveTestSMTP(t, l)
+		assert.Equal(t, undeliverable, IsErrUndeliverableAddress(VerifyAddress(email, "127.0.0.1")), email)
+	}
+
+	// Beyond the rate limit of the client only the mail servers are checked.
+	calloutLimits = newDomainRateLimiter(calloutsPerMinute)
+	for i := 0; i < calloutsPerMinute; i++ {
+		go serveTestSMTP(t, l)
+		assert.True(t, IsErrUndeliverableAddress(VerifyAddress("unknown@example.org", "10.0.0.1")))
+	}
+	assert.NoError(t, VerifyAddress("unknown@example.org", "10.0.0.1"))
+	assert.True(t, IsErrUndeliverableAddress(VerifyAddress("user@null.example.org", "10.0.0.1")))
+	go serveTestSMTP(t, l)
+	assert.True(t, IsErrUndeliverableAddress(VerifyAddress("unknown@example.org", "10.0.0.2")))
+}
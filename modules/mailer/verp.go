@@ -0,0 +1,140 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// verpMessageIDPattern matches the left part of the Message-IDs which can be
+// used in a local part without quoting.
+var verpMessageIDPattern = regexp.MustCompile(`^[-\w./]+$`)
+
+// verpSignature signs the message and the recipient of a VERP token. Mail
+// servers may change the case of the local part, so it is signed in lower
+// case.
+func verpSignature(messageID, rcpt string) string {
+	mac := hmac.New(sha256.New, []byte(setting.SecretKey))
+	mac.Write([]byte(strings.ToLower(messageID + "\n" + rcpt)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// maxLocalPartLength is the limit of the local part of an address (RFC 5321).
+const maxLocalPartLength = 64
+
+// verpRecipientHash returns the hash of the recipient, which replaces the
+// Message-ID and the recipient in tokens which would exceed the limit of the
+// local part otherwise.
+func verpRecipientHash(rcpt string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(rcpt)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// verpAddress returns the envelope sender of the message to the recipient,
+// which identifies both, or the empty string if VERP is disabled or the
+// Message-ID can not be encoded. The token is the signature, the left part
+// of the Message-ID and the recipient with its @ replaced by =, like
+// 0123456789abcdef.1500000000.abcdef=user=example.org. If the local part of
+// the address would get too long, the token is the signature and the hash
+// of the recipient only, like 0123456789abcdef=fedcba9876543210.
+func verpAddress(messageID, rcpt string) string {
+	format := setting.MailService.VERPAddress
+	if len(format) == 0 {
+		return ""
+	}
+
+	messageID = strings.TrimSuffix(strings.TrimPrefix(messageID, "<"), ">")
+	at := strings.LastIndexByte(messageID, '@')
+	if at < 0 || !verpMessageIDPattern.MatchString(messageID[:at]) {
+		return ""
+	}
+	messageID = messageID[:at]
+
+	at = strings.LastIndexByte(rcpt, '@')
+	if at < 0 {
+		return ""
+	}
+	token := verpSignature(messageID, rcpt) + "." + messageID + "=" + rcpt[:at] + "=" + rcpt[at+1:]
+	if addr := strings.Replace(format, "%{token}", token, 1); localPartLength(addr) <= maxLocalPartLength {
+		return addr
+	}
+	hash := verpRecipientHash(rcpt)
+	return strings.Replace(format, "%{token}", verpSignature("", hash)+"="+hash, 1)
+}
+
+func localPartLength(addr string) int {
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		return at
+	}
+	return len(addr)
+}
+
+// ParseVERPAddress returns the Message-ID and the recipient of the message a
+// bounce was sent for, if the address is a valid envelope sender generated
+// for VERP. Both are empty if the address only contains the hash of the
+// recipient, see IsVERPRecipient.
+func ParseVERPAddress(addr string) (messageID, rcpt string, ok bool) {
+	messageID, rcpt, _, ok = parseVERPAddress(addr)
+	return messageID, rcpt, ok
+}
+
+// IsVERPRecipient checks whether the address, e.g. reported in a delivery
+// status notification, is the recipient of the VERP address.
+func IsVERPRecipient(verpAddr, addr string) bool {
+	_, rcpt, hash, ok := parseVERPAddress(verpAddr)
+	if !ok {
+		return false
+	} else if len(rcpt) > 0 {
+		return strings.EqualFold(rcpt, addr)
+	}
+	return hash == verpRecipientHash(addr)
+}
+
+// parseVERPAddress returns the Message-ID and the recipient, or the hash of
+// the recipient only.
+func parseVERPAddress(addr string) (messageID, rcpt, hash string, ok bool) {
+	if setting.MailService == nil || len(setting.MailService.VERPAddress) == 0 {
+		return "", "", "", false
+	}
+	format := setting.MailService.VERPAddress
+	i := strings.Index(format, "%{token}")
+	prefix := strings.ToLower(format[:i])
+	suffix := strings.ToLower(format[i+len("%{token}"):])
+	if len(addr) <= len(prefix)+len(suffix) || !strings.HasPrefix(strings.ToLower(addr), prefix) ||
+		!strings.HasSuffix(strings.ToLower(addr), suffix) {
+		return "", "", "", false
+	}
+	token := addr[len(prefix) : len(addr)-len(suffix)]
+
+	// The signature is hexadecimal, the Message-ID contains no = and the
+	// domain of the recipient neither. The hash of a recipient follows the
+	// signature directly.
+	first := strings.IndexByte(token, '=')
+	if first > 0 && !strings.ContainsAny(token, ".@") && first == strings.LastIndexByte(token, '=') {
+		hash = strings.ToLower(token[first+1:])
+		if !hmac.Equal([]byte(strings.ToLower(token[:first])), []byte(verpSignature("", hash))) {
+			return "", "", "", false
+		}
+		return "", "", hash, true
+	}
+
+	dot := strings.IndexByte(token, '.')
+	last := strings.LastIndexByte(token, '=')
+	if dot < 0 || first < dot || first == last {
+		return "", "", "", false
+	}
+	messageID = token[dot+1 : first]
+	rcpt = token[first+1:last] + "@" + token[last+1:]
+	if !hmac.Equal([]byte(strings.ToLower(token[:dot])), []byte(verpSignature(messageID, rcpt))) {
+		return "", "", "", false
+	}
+	return "<" + messageID + "@" + messageIDDomain() + ">", rcpt, "", true
+}
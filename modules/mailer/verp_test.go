@@ -0,0 +1,101 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+	gomail "gopkg.in/gomail.v2"
+)
+
+func TestVERPAddress(t *testing.T) {
+	setting.SecretKey = "secret"
+	setting.MailService = &setting.Mailer{From: "gitea@example.com"}
+	assert.Empty(t, verpAddress("<1.abc@example.com>", "user@example.org"))
+
+	setting.MailService.VERPAddress = "bounce+%{token}@example.com"
+	messageID := MessageID("user2/repo1/issues/1")
+	addr := verpAddress(messageID, "User=1@Example.org")
+	assert.Regexp(t, `^bounce\+[0-9a-f]{16}\.user2/repo1/issues/1=User=1=Example\.org@example\.com$`, addr)
+
+	for _, a := range []string{addr, strings.ToLower(addr)} {
+		id, rcpt, ok := ParseVERPAddress(a)
+		assert.True(t, ok)
+		assert.Equal(t, strings.ToLower(messageID), strings.ToLower(id))
+		assert.Equal(t, "user=1@example.org", strings.ToLower(rcpt))
+	}
+
+	_, _, ok := ParseVERPAddress(strings.Replace(addr, "issues/1=", "issues/2=", 1))
+	assert.False(t, ok)
+	_, _, ok = ParseVERPAddress("bounce+@example.com")
+	assert.False(t, ok)
+	_, _, ok = ParseVERPAddress("gitea@example.com")
+	assert.False(t, ok)
+
+	assert.Empty(t, verpAddress(`<"quoted id"@example.com>`, "user@example.org"))
+}
+
+func TestVERPAddress_Long(t *testing.T) {
+	setting.SecretKey = "secret"
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", VERPAddress: "bounce+%{token}@example.com"}
+
+	// Tokens too long for the local part contain the hash of the recipient only.
+	const rcpt = "a.very.long.name@subdomain.example.org"
+	addr := verpAddress(newMessageID(), rcpt)
+	assert.Regexp(t, `^bounce\+[0-9a-f]{16}=[0-9a-f]{16}@example\.com$`, addr)
+
+	id, verpRcpt, ok := ParseVERPAddress(addr)
+	assert.True(t, ok)
+	assert.Empty(t, id)
+	assert.Empty(t, verpRcpt)
+	assert.True(t, IsVERPRecipient(addr, "A.Very.Long.Name@subdomain.example.org"))
+	assert.False(t, IsVERPRecipient(addr, "other@example.org"))
+	_, _, ok = ParseVERPAddress(addr[:len("bounce+")] + "0000000000000000" + addr[len("bounce+")+16:])
+	assert.False(t, ok)
+}
+
+func TestMessage_SendVERP(t *testing.T) {
+	setting.SecretKey = "secret"
+	setting.MailService = &setting.Mailer{From: "gitea@example.com", VERPAddress: "bounce+%{token}@example.com"}
+
+	msg := NewMessage([]string{"a@example.org", "b@example.org"}, "Subject", "Body")
+	msg.SetHeader("Message-ID", MessageID("1.abcdef"))
+	envelopes := make(map[string]string)
+	assert.NoError(t, msg.send(gomail.SendFunc(func(from string, to []string, _ io.WriterTo) error {
+		if assert.Len(t, to, 1) {
+			envelopes[to[0]] = from
+		}
+		return nil
+	})))
+	assert.Len(t, envelopes, 2)
+	for rcpt, from := range envelopes {
+		id, verpRcpt, ok := ParseVERPAddress(from)
+		assert.True(t, ok)
+		assert.Equal(t, msg.GetHeader("Message-ID")[0], id)
+		assert.Equal(t, rcpt, verpRcpt)
+	}
+
+	// A retry skips the recipients which got their copy already.
+	msg = NewMessage([]string{"a@example.org", "b@example.org"}, "Subject", "Body")
+	var sent []string
+	failed := false
+	send := gomail.SendFunc(func(from string, to []string, _ io.WriterTo) error {
+		if to[0] == "b@example.org" && !failed {
+			failed = true
+			return errors.New("b failed")
+		}
+		sent = append(sent, to[0])
+		return nil
+	})
+	assert.Error(t, msg.send(send))
+	assert.NoError(t, msg.send(send))
+	assert.Equal(t, []string{"a@example.org", "b@example.org"}, sent)
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/mail"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Content     []byte `json:"content"`
+}
+
+// webhookPayload is the JSON document posted for every message.
+type webhookPayload struct {
+	From        string               `json:"from"`
+	To          []string             `json:"to"`
+	Cc          []string             `json:"cc,omitempty"`
+	Bcc         []string             `json:"bcc,omitempty"`
+	ReplyTo     []string             `json:"reply_to,omitempty"`
+	Subject     string               `json:"subject"`
+	Category    Category             `json:"category"`
+	Headers     map[string]string    `json:"headers"`
+	Text        string               `json:"text"`
+	HTML        string               `json:"html,omitempty"`
+	Attachments []*webhookAttachment `json:"attachments,omitempty"`
+}
+
+func webhookAddresses(list []*mail.Address) []string {
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.String())
+	}
+	return addrs
+}
+
+// Sender implementation which posts messages to an HTTP endpoint.
+// The request body is signed with HMAC-SHA256 using the configured secret,
+// the hex encoded signature is sent in the X-Gitea-Signature header.
+type webhookSender struct {
+	url    string
+	secret string
+}
+
+func newWebhookSender(opts *setting.Mailer) (Sender, error) {
+	if len(opts.WebhookURL) == 0 {
+		return nil, errors.New("mailer: WEBHOOK_URL is required for the webhook sender")
+	}
+
+	return &webhookSender{
+		url:    opts.WebhookURL,
+		secret: opts.WebhookSecret,
+	}, nil
+}
+
+// Send the message synchronous.
+func (s *webhookSender) Send(msg *Message) error {
+	c, err := msg.content()
+	if err != nil {
+		return err
+	}
+
+	p := &webhookPayload{
+		From:     c.From.String(),
+		To:       webhookAddresses(c.To),
+		Cc:       webhookAddresses(c.Cc),
+		Bcc:      webhookAddresses(c.Bcc),
+		ReplyTo:  webhookAddresses(c.ReplyTo),
+		Subject:  c.Subject,
+		Category: msg.Category,
+		Headers:  c.Headers,
+		Text:     c.Text,
+		HTML:     c.HTML,
+	}
+	for _, a := range c.Attachments {
+		p.Attachments = append(p.Attachments, &webhookAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Content:     a.Data,
+		})
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(data)
+
+	req := httplib.Post(s.url).
+		Header("Content-Type", "application/json").
+		Header("X-Gitea-Signature", hex.EncodeToString(mac.Sum(nil))).
+		Body(data)
+	return permanentAPIError(doAPIRequest("Webhook", req, nil))
+}
+
+// Close is a no-op, the webhook does not keep a connection open.
+func (s *webhookSender) Close() error {
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSender(t *testing.T) {
+	server := newAPIServer()
+	defer server.Close()
+
+	setting.MailService = &setting.Mailer{
+		From:          "Gitea <gitea@example.com>",
+		WebhookURL:    server.URL + "/hook",
+		WebhookSecret: "secret",
+	}
+	s, err := newWebhookSender(setting.MailService)
+	assert.NoError(t, err)
+
+	msg := NewMessage([]string{"User <user@example.com>"}, "Subject", "<p>Body</p>")
+	msg.Category = CategoryNotification
+	server.reply(http.StatusNoContent, "")
+	assert.NoError(t, s.Send(msg))
+
+	req := server.last()
+	assert.Equal(t, "/hook", req.Path)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(req.Body)
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Gitea-Signature"))
+	var p webhookPayload
+	assert.NoError(t, json.Unmarshal(req.Body, &p))
+	assert.Equal(t, `"Gitea" <gitea@example.com>`, p.From)
+	assert.Equal(t, []string{`"User" <user@example.com>`}, p.To)
+	assert.Equal(t, "Subject", p.Subject)
+	assert.Equal(t, CategoryNotification, p.Category)
+
+	assertAPIErrors(t, server, func() error { return s.Send(msg) })
+}
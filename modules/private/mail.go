@@ -0,0 +1,101 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package private
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// MailQueue describes the mails waiting in the queue of the running server
+// and those which could not be delivered.
+type MailQueue struct {
+	Pending     []*mailer.PendingMessage `json:"pending"`
+	DeadLetters []*mailer.DeadLetter     `json:"dead_letters"`
+}
+
+// GetMailQueue returns the mail queue of the running server
+func GetMailQueue() (*MailQueue, error) {
+	reqURL := setting.LocalURL + "api/internal/mail/queue"
+	log.Trace("GetMailQueue: %s", reqURL)
+
+	resp, err := newRequest(reqURL, "GET").SetTLSClientConfig(&tls.Config{
+		InsecureSkipVerify: true,
+	}).Response()
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	// All 2XX status codes are accepted and others will return an error
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Failed to get mail queue: %s", decodeJSONError(resp).Err)
+	}
+
+	var queue MailQueue
+	if err := json.NewDecoder(resp.Body).Decode(&queue); err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+// FlushMailQueue makes the running server send all queued mails next, and
+// requeue all dead letters if deadLetters is true. It returns the numbers of
+// expedited mails and requeued dead letters.
+func FlushMailQueue(deadLetters bool) (flushed, requeued int, err error) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/mail/flush?dead_letters=%t", deadLetters)
+	log.Trace("FlushMailQueue: %s", reqURL)
+
+	resp, err := newRequest(reqURL, "POST").SetTLSClientConfig(&tls.Config{
+		InsecureSkipVerify: true,
+	}).Response()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	// All 2XX status codes are accepted and others will return an error
+	if resp.StatusCode/100 != 2 {
+		return 0, 0, fmt.Errorf("Failed to flush mail queue: %s", decodeJSONError(resp).Err)
+	}
+
+	var res struct {
+		Flushed  int `json:"flushed"`
+		Requeued int `json:"requeued"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, 0, err
+	}
+	return res.Flushed, res.Requeued, nil
+}
+
+// RetryDeadLetter makes the running server move the dead letter back into
+// its mail queue
+func RetryDeadLetter(id int64) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/mail/dead/%d/retry", id)
+	log.Trace("RetryDeadLetter: %s", reqURL)
+
+	resp, err := newRequest(reqURL, "POST").SetTLSClientConfig(&tls.Config{
+		InsecureSkipVerify: true,
+	}).Response()
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	// All 2XX status codes are accepted and others will return an error
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Failed to retry dead letter: %s", decodeJSONError(resp).Err)
+	}
+	return nil
+}
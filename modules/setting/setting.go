@@ -10,6 +10,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/mail"
 	"net/url"
 	"os"
@@ -20,6 +21,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"code.gitea.io/git"
@@ -85,6 +87,8 @@ var (
 	LandingPageURL       LandingPage
 	UnixSocketPermission uint32
 	EnablePprof          bool
+	EnableHealthCheck    bool
+	HealthCheckToken     string
 
 	SSH = struct {
 		Disabled            bool           `ini:"DISABLE_SSH"`
@@ -355,6 +359,33 @@ var (
 			Schedule       string
 			UpdateExisting bool
 		} `ini:"cron.sync_external_users"`
+		MailDeliveryCleanup struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+			OlderThan  time.Duration
+		} `ini:"cron.mail_delivery_cleanup"`
+		MailAttachmentCleanup struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		} `ini:"cron.mail_attachment_cleanup"`
+		MailDigest struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		} `ini:"cron.mail_digest"`
+		MilestoneDeadlineMail struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+			Lead       time.Duration
+		} `ini:"cron.milestone_deadline_mail"`
+		FetchIncomingMail struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		} `ini:"cron.fetch_incoming_mail"`
 	}{
 		UpdateMirror: struct {
 			Enabled    bool
@@ -409,6 +440,55 @@ var (
 			Schedule:       "@every 24h",
 			UpdateExisting: true,
 		},
+		MailDeliveryCleanup: struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+			OlderThan  time.Duration
+		}{
+			Enabled:    true,
+			RunAtStart: false,
+			Schedule:   "@every 24h",
+			OlderThan:  30 * 24 * time.Hour,
+		},
+		MailAttachmentCleanup: struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		}{
+			Enabled:    true,
+			RunAtStart: false,
+			Schedule:   "@every 24h",
+		},
+		MailDigest: struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		}{
+			Enabled:    true,
+			RunAtStart: false,
+			Schedule:   "@every 10m",
+		},
+		MilestoneDeadlineMail: struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+			Lead       time.Duration
+		}{
+			Enabled:    true,
+			RunAtStart: false,
+			Schedule:   "@every 1h",
+			Lead:       72 * time.Hour,
+		},
+		FetchIncomingMail: struct {
+			Enabled    bool
+			RunAtStart bool
+			Schedule   string
+		}{
+			Enabled:    true,
+			RunAtStart: true,
+			Schedule:   "@every 1m",
+		},
 	}
 
 	// Git settings
@@ -460,6 +540,15 @@ var (
 		MaxResponseItems: 50,
 	}
 
+	// Metrics settings
+	Metrics = struct {
+		Enabled bool
+		Token   string
+	}{
+		Enabled: false,
+		Token:   "",
+	}
+
 	// I18n settings
 	Langs     []string
 	Names     []string
@@ -663,6 +752,8 @@ please consider changing to GITEA_CUSTOM`)
 	AppDataPath = sec.Key("APP_DATA_PATH").MustString("data")
 	EnableGzip = sec.Key("ENABLE_GZIP").MustBool()
 	EnablePprof = sec.Key("ENABLE_PPROF").MustBool(false)
+	EnableHealthCheck = sec.Key("ENABLE_HEALTH_CHECK").MustBool(false)
+	HealthCheckToken = sec.Key("HEALTH_CHECK_TOKEN").String()
 
 	switch sec.Key("LANDING_PAGE").MustString("home") {
 	case "explore":
@@ -959,6 +1050,8 @@ please consider changing to GITEA_CUSTOM`)
 		log.Fatal(4, "Failed to map Git settings: %v", err)
 	} else if err = Cfg.Section("api").MapTo(&API); err != nil {
 		log.Fatal(4, "Failed to map API settings: %v", err)
+	} else if err = Cfg.Section("metrics").MapTo(&Metrics); err != nil {
+		log.Fatal(4, "Failed to map Metrics settings: %v", err)
 	}
 
 	sec = Cfg.Section("mirror")
@@ -1249,15 +1342,170 @@ func newSessionService() {
 	log.Info("Session Service Enabled")
 }
 
+// MailRoute is a mailer.route.* section, the mails to its recipient domains
+// and about its organizations and repositories, and the mails of its
+// categories or selecting it by name, are sent with its backend instead of
+// the one of [mailer]. Settings it does not set are taken from [mailer].
+type MailRoute struct {
+	Name          string
+	Categories    []string // Lower case categories of the mails, e.g. security.
+	Domains       []string // Lower case recipient domains, including subdomains.
+	Organizations []string // Lower case names of the owners.
+	Repositories  []string // Lower case full names, owner/name.
+	*Mailer
+}
+
+// MailFallback is a mailer.fallback.* section listed in FALLBACKS of
+// [mailer], a sender backend the mails are retried with when the previous
+// backend rejects them or keeps failing. Settings it does not set are taken
+// from [mailer].
+type MailFallback struct {
+	Name string
+	*Mailer
+}
+
+// MailPartition is a mailer.partition.* section listed in QUEUE_PARTITIONS
+// of [mailer], a part of the queue with its own length and workers for the
+// mails of its categories. Mails of other categories are queued in [mailer].
+type MailPartition struct {
+	Name        string
+	Categories  []string // Lower case categories of the mails, e.g. security.
+	QueueLength int
+	Workers     int
+}
+
 // Mailer represents mail service.
 type Mailer struct {
 	// Mailer
-	QueueLength     int
+	QueueType   string
+	QueuePath   string
+	QueueLength int
+
+	// Redis or NATS queue shared by several instances
+	QueueConnStr           string
+	QueueConsumer          bool
+	QueueVisibilityTimeout time.Duration
+
+	// Parts of the queue with their own workers, e.g. for security mails
+	Partitions []*MailPartition
+
 	Workers         int
+	MaxWorkers      int
+	MaxRetries      int
+	RetryDelay      time.Duration
+	RetryMaxDelay   time.Duration
 	Name            string
 	From            string
 	FromEmail       string
+	MessageIDDomain string
+	EnvelopeFrom    string
 	SendAsPlainText bool
+	InlineCSS       bool
+
+	// Theme of HTML mails
+	Theme           string
+	ThemeBrandColor string
+	ThemeLogo       string
+	MailType        string
+	DryRun          bool
+	Profile         string
+
+	AttachmentMaxSize int64
+
+	// Maximum size of rendered mails, 0 means unlimited
+	MessageMaxSize     int64
+	OversizePolicy     string
+	OversizeLinkExpiry time.Duration
+
+	// Format of the From display name of mails on behalf of a user
+	FromDisplayNameFormat string
+
+	// Interval of checking custom/templates/mail for changes, 0 disables it
+	TemplateReloadInterval time.Duration
+
+	// Queue overflow
+	OverflowPolicy  string
+	OverflowTimeout time.Duration
+
+	// Record every send attempt in the database
+	DeliveryLog bool
+
+	// Hour of the day daily notification digests are sent
+	DigestHour int
+
+	// Maximum number of Bcc recipients of one announcement mail
+	BccMaxRecipients int
+
+	// Extra headers of every mail
+	Headers       map[string]string
+	AutoSubmitted bool
+	Precedence    string
+
+	// Open and click tracking of the HTML mails
+	TrackOpens  bool
+	TrackClicks bool
+
+	// Lifetime of the signed links of actions in notification mails
+	DeepLinkExpiry time.Duration
+
+	// Relays of the mails of some organizations and repositories
+	Routes []*MailRoute
+
+	// Sender backends the mails are retried with, in order
+	Fallbacks        []*MailFallback
+	FallbackAttempts int
+
+	// Bounce handling and delivery event webhooks
+	BounceThreshold          int
+	EventWebhookToken        string
+	SendGridWebhookPublicKey string
+	MailgunWebhookSigningKey string
+	SESTopicARN              string
+	VERPAddress              string
+
+	// Rate limits
+	RateLimit          int
+	RateLimitBurst     int
+	RateLimitPerDomain int
+
+	// Lower case recipient domains, including subdomains, mails may only be sent
+	// to or are never sent to
+	AllowedDomains []string
+	BlockedDomains []string
+
+	// Verification of the addresses of new accounts and emails: none, mx or callout
+	AddressVerification string
+
+	// Address all mails are sent to instead of their recipients, for staging instances
+	RedirectTo string
+
+	// Notification mails each user may cause per period, against abuse of mentions
+	UserNotifyLimit       int
+	UserNotifyLimitPeriod time.Duration
+
+	// Circuit breaker pausing the delivery while the backend fails
+	CircuitBreakerThreshold     int
+	CircuitBreakerProbeInterval time.Duration
+
+	// Time without a sent mail after which a non-empty queue is reported as stuck
+	HealthStuckTimeout time.Duration
+
+	// Alerting the administrators about failing deliveries
+	AlertFailurePercent int
+	AlertMinAttempts    int
+	AlertWindow         time.Duration
+	AlertDeadLetters    int
+	AlertWebhookURL     string
+	AlertWebhookType    string
+
+	// DKIM signing
+	DKIMDomain         string
+	DKIMSelector       string
+	DKIMPrivateKeyFile string
+
+	// S/MIME signing
+	SMIMECertFile string
+	SMIMEKeyFile  string
 
 	// SMTP sender
 	Host              string
@@ -1265,17 +1513,132 @@ type Mailer struct {
 	DisableHelo       bool
 	HeloHostname      string
 	SkipVerify        bool
+	SMTPSecurity      string
 	UseCertificate    bool
 	CertFile, KeyFile string
+	SMTPAuth          string
+	SMTPMaxConns      int
+	SMTPMaxRecipients int
+	SMTPProxy         string
+
+	// SMTP timeouts, 0 means none
+	SMTPConnectTimeout time.Duration
+	SMTPHelloTimeout   time.Duration
+	SMTPCommandTimeout time.Duration
+	SMTPDataTimeout    time.Duration
+
+	// Idle SMTP connections, 0 means never closed or not kept alive
+	SMTPIdleTimeout      time.Duration
+	SMTPKeepalive        time.Duration
+	SMTPKeepaliveMaxIdle time.Duration
+
+	// SMTP TLS
+	CAFile          string
+	TLSMinVersion   string
+	TLSCipherSuites []string
+
+	// Direct delivery to the mail servers of the recipients
+	MTASTS          bool
+	DANE            bool
+	DANEResolver    string
+	GreylistDelay   time.Duration
+	GreylistTimeout time.Duration
+
+	// SMTP XOAUTH2 authentication
+	SMTPOAuth2TokenURL     string
+	SMTPOAuth2ClientID     string
+	SMTPOAuth2ClientSecret string
+	SMTPOAuth2RefreshToken string
+	SMTPOAuth2Scope        string
 
 	// Sendmail sender
-	UseSendmail  bool
-	SendmailPath string
+	UseSendmail      bool
+	SendmailPath     string
+	SendmailArgs     []string
+	SendmailTimeout  time.Duration
+	SendmailScrubEnv bool
+	SendmailEnv      []string
+	// Shared by the sendmail backends of [mailer], the routes and fallbacks.
+	SendmailMaxProcesses int
+
+	// SendGrid sender
+	SendGridAPIKey string
+
+	// Amazon SES sender
+	SESRegion           string
+	SESAccessKeyID      string
+	SESSecretAccessKey  string
+	SESConfigurationSet string
+
+	// Mailgun sender
+	MailgunDomain   string
+	MailgunAPIKey   string
+	MailgunRegion   string
+	MailgunTags     []string
+	MailgunTracking bool
+
+	// Postmark sender
+	PostmarkServerToken         string
+	PostmarkTransactionalStream string
+	PostmarkBroadcastStream     string
+
+	// Microsoft Graph sender
+	GraphTenantID     string
+	GraphClientID     string
+	GraphClientSecret string
+	GraphUser         string
+
+	// Gmail sender
+	GmailServiceAccountFile string
+	GmailUser               string
+
+	// Webhook sender
+	WebhookURL    string
+	WebhookSecret string
+
+	// File sender
+	FileDir    string
+	FileFormat string
 }
 
 var (
 	// MailService the global mailer
 	MailService *Mailer
+
+	// MailTypes are the valid values of MAIL_TYPE, the backends registered
+	// with the mailer are added to them.
+	MailTypes = []string{"smtp", "sendmail", "sendgrid", "ses", "mailgun", "postmark", "graph", "gmail", "webhook", "direct", "dummy", "file"}
+)
+
+// IncomingMailer represents the mailbox replies to notification mails are fetched from,
+// or the listener they are received by.
+type IncomingMailer struct {
+	Protocol      string
+	ListenAddr    string
+	Host          string
+	Port          int
+	UseTLS        bool
+	SkipVerify    bool
+	User, Passwd  string
+	Mailbox       string
+	DeleteFetched bool
+
+	// Address the replies are sent to, %{token} is replaced by the reply token
+	ReplyToAddress string
+
+	// Limits of a reply
+	MaxSize int64
+}
+
+// Polling returns whether replies are fetched from a mailbox, instead of being
+// delivered to the LMTP or SMTP listener by a mail server.
+func (m *IncomingMailer) Polling() bool {
+	return m.Protocol == "imap" || m.Protocol == "pop3"
+}
+
+var (
+	// IncomingMail the mailbox of replies, nil if replying by mail is disabled
+	IncomingMail *IncomingMailer
 )
 
 func newMailService() {
@@ -1285,11 +1648,113 @@ func newMailService() {
 		return
 	}
 
-	MailService = &Mailer{
-		QueueLength:     sec.Key("SEND_BUFFER_LEN").MustInt(100),
-		Workers:         sec.Key("SEND_WORKERS").MustInt(2),
-		Name:            sec.Key("NAME").MustString(AppName),
-		SendAsPlainText: sec.Key("SEND_AS_PLAIN_TEXT").MustBool(false),
+	var err error
+	MailService, err = loadMailService(sec)
+	if err != nil {
+		log.Fatal(4, "%v", err)
+	}
+	log.Info("Mail Service Enabled")
+
+	if Cfg.Section("").Key("RUN_MODE").String() == "prod" && isMailCatcher(MailService) {
+		log.Warn("Mail server %s looks like a mail catcher for development, mails are not delivered to their recipients", MailService.Host)
+	}
+}
+
+// isMailCatcher reports whether the mails are sent to a mail catcher like
+// MailHog or Mailpit, which is recognized by its name or port 1025.
+func isMailCatcher(m *Mailer) bool {
+	if m.Profile == "dev" {
+		return true
+	} else if m.MailType != "smtp" {
+		return false
+	}
+	for _, addr := range strings.Split(m.Host, ",") {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+		if err != nil {
+			continue
+		}
+		host = strings.ToLower(host)
+		if port == "1025" || strings.Contains(host, "mailhog") || strings.Contains(host, "mailpit") {
+			return true
+		}
+	}
+	return false
+}
+
+func loadMailService(sec *ini.Section) (*Mailer, error) {
+	m := &Mailer{
+		QueueType:              sec.Key("QUEUE_TYPE").In("channel", []string{"channel", "persistent", "redis", "nats"}),
+		QueuePath:              sec.Key("QUEUE_PATH").MustString(path.Join(AppDataPath, "mail_queue.db")),
+		QueueLength:            sec.Key("SEND_BUFFER_LEN").MustInt(100),
+		QueueConnStr:           sec.Key("QUEUE_CONN_STR").String(),
+		QueueConsumer:          sec.Key("QUEUE_CONSUMER").MustBool(true),
+		QueueVisibilityTimeout: sec.Key("QUEUE_VISIBILITY_TIMEOUT").MustDuration(10 * time.Minute),
+		Workers:                sec.Key("SEND_WORKERS").MustInt(2),
+		MaxWorkers:             sec.Key("SEND_WORKERS_MAX").MustInt(0),
+		MaxRetries:             sec.Key("MAX_RETRIES").MustInt(3),
+		RetryDelay:             sec.Key("RETRY_DELAY").MustDuration(time.Minute),
+		RetryMaxDelay:          sec.Key("RETRY_MAX_DELAY").MustDuration(time.Hour),
+		Name:                   sec.Key("NAME").MustString(AppName),
+		SendAsPlainText:        sec.Key("SEND_AS_PLAIN_TEXT").MustBool(false),
+		InlineCSS:              sec.Key("INLINE_CSS").MustBool(true),
+		Theme:                  sec.Key("THEME").In("auto", []string{"none", "light", "auto"}),
+		ThemeBrandColor:        sec.Key("THEME_BRAND_COLOR").MustString("#609926"),
+		ThemeLogo:              sec.Key("THEME_LOGO").String(),
+		AttachmentMaxSize:      sec.Key("ATTACHMENT_MAX_SIZE").MustInt64(10) << 20,
+		MessageMaxSize:         sec.Key("MESSAGE_MAX_SIZE").MustInt64(0) << 20,
+		OversizePolicy:         sec.Key("OVERSIZE_POLICY").In("reject", []string{"reject", "link"}),
+		OversizeLinkExpiry:     sec.Key("OVERSIZE_LINK_EXPIRY").MustDuration(7 * 24 * time.Hour),
+		MailType:               sec.Key("MAIL_TYPE").In("smtp", MailTypes),
+		DryRun:                 sec.Key("DRY_RUN").MustBool(false),
+		Profile:                sec.Key("PROFILE").In("", []string{"", "dev"}),
+
+		OverflowPolicy:  sec.Key("OVERFLOW_POLICY").In("block", []string{"block", "drop-oldest", "drop-newest", "spill"}),
+		OverflowTimeout: sec.Key("OVERFLOW_TIMEOUT").MustDuration(5 * time.Second),
+
+		DeliveryLog: sec.Key("DELIVERY_LOG").MustBool(false),
+
+		DigestHour: sec.Key("DIGEST_HOUR").RangeInt(8, 0, 23),
+
+		BccMaxRecipients: sec.Key("BCC_MAX_RECIPIENTS").MustInt(50),
+
+		AutoSubmitted: sec.Key("AUTO_SUBMITTED").MustBool(true),
+		Precedence:    sec.Key("PRECEDENCE").In("bulk", []string{"bulk", "list", "junk", "none"}),
+
+		TrackOpens:  sec.Key("TRACK_OPENS").MustBool(false),
+		TrackClicks: sec.Key("TRACK_CLICKS").MustBool(false),
+
+		DeepLinkExpiry: sec.Key("DEEP_LINK_EXPIRY").MustDuration(7 * 24 * time.Hour),
+
+		BounceThreshold:          sec.Key("BOUNCE_THRESHOLD").MustInt(3),
+		EventWebhookToken:        sec.Key("EVENT_WEBHOOK_TOKEN").String(),
+		SendGridWebhookPublicKey: sec.Key("SENDGRID_WEBHOOK_PUBLIC_KEY").String(),
+		MailgunWebhookSigningKey: sec.Key("MAILGUN_WEBHOOK_SIGNING_KEY").String(),
+		SESTopicARN:              sec.Key("SES_TOPIC_ARN").String(),
+		VERPAddress:              sec.Key("VERP_ADDRESS").String(),
+
+		RateLimit:          sec.Key("RATE_LIMIT").MustInt(0),
+		RateLimitBurst:     sec.Key("RATE_LIMIT_BURST").MustInt(10),
+		RateLimitPerDomain: sec.Key("RATE_LIMIT_PER_DOMAIN").MustInt(0),
+
+		UserNotifyLimit:       sec.Key("USER_NOTIFY_LIMIT").MustInt(0),
+		UserNotifyLimitPeriod: sec.Key("USER_NOTIFY_LIMIT_PERIOD").MustDuration(time.Hour),
+
+		CircuitBreakerThreshold:     sec.Key("CIRCUIT_BREAKER_THRESHOLD").MustInt(5),
+		CircuitBreakerProbeInterval: sec.Key("CIRCUIT_BREAKER_PROBE_INTERVAL").MustDuration(30 * time.Second),
+		HealthStuckTimeout:          sec.Key("HEALTH_STUCK_TIMEOUT").MustDuration(15 * time.Minute),
+		AlertFailurePercent:         sec.Key("ALERT_FAILURE_PERCENT").MustInt(0),
+		AlertMinAttempts:            sec.Key("ALERT_MIN_ATTEMPTS").MustInt(10),
+		AlertWindow:                 sec.Key("ALERT_WINDOW").MustDuration(15 * time.Minute),
+		AlertDeadLetters:            sec.Key("ALERT_DEAD_LETTERS").MustInt(0),
+		AlertWebhookURL:             sec.Key("ALERT_WEBHOOK_URL").String(),
+		AlertWebhookType:            sec.Key("ALERT_WEBHOOK_TYPE").In("json", []string{"json", "slack"}),
+
+		DKIMDomain:         sec.Key("DKIM_DOMAIN").String(),
+		DKIMSelector:       sec.Key("DKIM_SELECTOR").MustString("gitea"),
+		DKIMPrivateKeyFile: sec.Key("DKIM_PRIVATE_KEY_FILE").MustString("custom/mailer/dkim.key"),
+
+		SMIMECertFile: sec.Key("SMIME_CERT_FILE").String(),
+		SMIMEKeyFile:  sec.Key("SMIME_KEY_FILE").String(),
 
 		Host:           sec.Key("HOST").String(),
 		User:           sec.Key("USER").String(),
@@ -1297,27 +1762,354 @@ func newMailService() {
 		DisableHelo:    sec.Key("DISABLE_HELO").MustBool(),
 		HeloHostname:   sec.Key("HELO_HOSTNAME").String(),
 		SkipVerify:     sec.Key("SKIP_VERIFY").MustBool(),
+		SMTPSecurity:   sec.Key("SECURITY").In("", []string{"none", "starttls", "starttls-required", "tls"}),
 		UseCertificate: sec.Key("USE_CERTIFICATE").MustBool(),
 		CertFile:       sec.Key("CERT_FILE").String(),
 		KeyFile:        sec.Key("KEY_FILE").String(),
+		SMTPAuth:       sec.Key("SMTP_AUTH").In("", []string{"PLAIN", "LOGIN", "CRAM-MD5", "NTLM", "XOAUTH2"}),
+		SMTPMaxConns:   sec.Key("SMTP_MAX_CONNECTIONS").MustInt(0),
+		SMTPProxy:      sec.Key("SMTP_PROXY").String(),
+
+		SMTPMaxRecipients: sec.Key("SMTP_MAX_RECIPIENTS").MustInt(100),
+
+		SMTPConnectTimeout: sec.Key("SMTP_CONNECT_TIMEOUT").MustDuration(10 * time.Second),
+		SMTPHelloTimeout:   sec.Key("SMTP_HELLO_TIMEOUT").MustDuration(30 * time.Second),
+		SMTPCommandTimeout: sec.Key("SMTP_COMMAND_TIMEOUT").MustDuration(5 * time.Minute),
+		SMTPDataTimeout:    sec.Key("SMTP_DATA_TIMEOUT").MustDuration(10 * time.Minute),
+
+		SMTPIdleTimeout:      sec.Key("SMTP_IDLE_TIMEOUT").MustDuration(30 * time.Second),
+		SMTPKeepalive:        sec.Key("SMTP_KEEPALIVE").MustDuration(0),
+		SMTPKeepaliveMaxIdle: sec.Key("SMTP_KEEPALIVE_MAX_IDLE").MustDuration(10 * time.Minute),
+
+		CAFile:          sec.Key("CA_FILE").String(),
+		TLSMinVersion:   sec.Key("TLS_MIN_VERSION").In("", []string{"TLS1.0", "TLS1.1", "TLS1.2", "TLS1.3"}),
+		TLSCipherSuites: sec.Key("TLS_CIPHER_SUITES").Strings(","),
+
+		MTASTS:          sec.Key("MTA_STS").MustBool(true),
+		DANE:            sec.Key("DANE").MustBool(false),
+		DANEResolver:    sec.Key("DANE_RESOLVER").String(),
+		GreylistDelay:   sec.Key("GREYLIST_DELAY").MustDuration(5 * time.Minute),
+		GreylistTimeout: sec.Key("GREYLIST_TIMEOUT").MustDuration(4 * time.Hour),
+
+		SMTPOAuth2TokenURL:     sec.Key("SMTP_OAUTH2_TOKEN_URL").String(),
+		SMTPOAuth2ClientID:     sec.Key("SMTP_OAUTH2_CLIENT_ID").String(),
+		SMTPOAuth2ClientSecret: sec.Key("SMTP_OAUTH2_CLIENT_SECRET").String(),
+		SMTPOAuth2RefreshToken: sec.Key("SMTP_OAUTH2_REFRESH_TOKEN").String(),
+		SMTPOAuth2Scope:        sec.Key("SMTP_OAUTH2_SCOPE").String(),
+
+		UseSendmail:          sec.Key("USE_SENDMAIL").MustBool(),
+		SendmailPath:         sec.Key("SENDMAIL_PATH").MustString("sendmail"),
+		SendmailArgs:         strings.Fields(sec.Key("SENDMAIL_ARGS").String()),
+		SendmailTimeout:      sec.Key("SENDMAIL_TIMEOUT").MustDuration(5 * time.Minute),
+		SendmailScrubEnv:     sec.Key("SENDMAIL_SCRUB_ENV").MustBool(false),
+		SendmailEnv:          strings.Split(sec.Key("SENDMAIL_ENV").MustString("PATH,HOME,LANG"), ","),
+		SendmailMaxProcesses: sec.Key("SENDMAIL_MAX_PROCESSES").MustInt(0),
+
+		SendGridAPIKey: sec.Key("SENDGRID_API_KEY").String(),
+
+		SESRegion:           sec.Key("SES_REGION").String(),
+		SESAccessKeyID:      sec.Key("SES_ACCESS_KEY_ID").String(),
+		SESSecretAccessKey:  sec.Key("SES_SECRET_ACCESS_KEY").String(),
+		SESConfigurationSet: sec.Key("SES_CONFIGURATION_SET").String(),
+
+		MailgunDomain:   sec.Key("MAILGUN_DOMAIN").String(),
+		MailgunAPIKey:   sec.Key("MAILGUN_API_KEY").String(),
+		MailgunRegion:   sec.Key("MAILGUN_REGION").In("us", []string{"us", "eu"}),
+		MailgunTags:     sec.Key("MAILGUN_TAGS").Strings(","),
+		MailgunTracking: sec.Key("MAILGUN_TRACKING").MustBool(false),
+
+		PostmarkServerToken:         sec.Key("POSTMARK_SERVER_TOKEN").String(),
+		PostmarkTransactionalStream: sec.Key("POSTMARK_TRANSACTIONAL_STREAM").MustString("outbound"),
+		PostmarkBroadcastStream:     sec.Key("POSTMARK_BROADCAST_STREAM").MustString("broadcast"),
+
+		GraphTenantID:     sec.Key("GRAPH_TENANT_ID").String(),
+		GraphClientID:     sec.Key("GRAPH_CLIENT_ID").String(),
+		GraphClientSecret: sec.Key("GRAPH_CLIENT_SECRET").String(),
+		GraphUser:         sec.Key("GRAPH_USER").String(),
+
+		GmailServiceAccountFile: sec.Key("GMAIL_SERVICE_ACCOUNT_FILE").MustString("custom/mailer/gmail.json"),
+		GmailUser:               sec.Key("GMAIL_USER").String(),
+
+		WebhookURL:    sec.Key("WEBHOOK_URL").String(),
+		WebhookSecret: sec.Key("WEBHOOK_SECRET").String(),
+
+		FileDir:    sec.Key("FILE_DIR").MustString(path.Join(AppDataPath, "mail")),
+		FileFormat: sec.Key("FILE_FORMAT").In("eml", []string{"eml", "maildir"}),
+
+		MessageIDDomain: sec.Key("MESSAGE_ID_DOMAIN").String(),
+
+		TemplateReloadInterval: sec.Key("TEMPLATE_RELOAD_INTERVAL").MustDuration(10 * time.Second),
+	}
+	m.From = sec.Key("FROM").MustString(m.User)
+
+	// The dev profile sends to a mail catcher like MailHog or Mailpit on
+	// this machine, keys set in the section still apply.
+	if m.Profile == "dev" {
+		if len(m.Host) == 0 {
+			m.Host = "localhost:1025"
+		}
+		if len(m.SMTPSecurity) == 0 {
+			m.SMTPSecurity = "none"
+		}
+		if len(m.From) == 0 {
+			m.From = "gitea@localhost"
+		}
+	}
+	// An empty format sends the mails from FROM, only a missing key gets the default.
+	m.FromDisplayNameFormat = "{{.DisplayName}}"
+	if sec.HasKey("FROM_DISPLAY_NAME_FORMAT") {
+		m.FromDisplayNameFormat = sec.Key("FROM_DISPLAY_NAME_FORMAT").String()
+	}
 
-		UseSendmail:  sec.Key("USE_SENDMAIL").MustBool(),
-		SendmailPath: sec.Key("SENDMAIL_PATH").MustString("sendmail"),
+	if m.UseSendmail {
+		m.MailType = "sendmail"
 	}
-	MailService.From = sec.Key("FROM").MustString(MailService.User)
+	m.UseSendmail = m.MailType == "sendmail"
 
 	if sec.HasKey("ENABLE_HTML_ALTERNATIVE") {
 		log.Warn("ENABLE_HTML_ALTERNATIVE is deprecated, use SEND_AS_PLAIN_TEXT")
-		MailService.SendAsPlainText = !sec.Key("ENABLE_HTML_ALTERNATIVE").MustBool(false)
+		m.SendAsPlainText = !sec.Key("ENABLE_HTML_ALTERNATIVE").MustBool(false)
 	}
 
-	parsed, err := mail.ParseAddress(MailService.From)
+	parsed, err := mail.ParseAddress(m.From)
 	if err != nil {
-		log.Fatal(4, "Invalid mailer.FROM (%s): %v", MailService.From, err)
+		return nil, fmt.Errorf("Invalid mailer.FROM (%s): %v", m.From, err)
 	}
-	MailService.FromEmail = parsed.Address
+	m.FromEmail = parsed.Address
 
-	log.Info("Mail Service Enabled")
+	if _, err = template.New("").Parse(m.FromDisplayNameFormat); err != nil {
+		return nil, fmt.Errorf("Invalid mailer.FROM_DISPLAY_NAME_FORMAT (%s): %v", m.FromDisplayNameFormat, err)
+	}
+
+	if m.DANE && len(m.DANEResolver) > 0 {
+		host, _, err := net.SplitHostPort(m.DANEResolver)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("Invalid mailer.DANE_RESOLVER (%s): DANE requires a validating resolver on a loopback address", m.DANEResolver)
+		}
+	}
+
+	m.EnvelopeFrom = sec.Key("ENVELOPE_FROM").String()
+	if len(m.EnvelopeFrom) > 0 && m.EnvelopeFrom != "<>" {
+		parsed, err = mail.ParseAddress(m.EnvelopeFrom)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mailer.ENVELOPE_FROM (%s): %v", m.EnvelopeFrom, err)
+		}
+		m.EnvelopeFrom = parsed.Address
+	}
+
+	if redirectTo := sec.Key("REDIRECT_TO").String(); len(redirectTo) > 0 {
+		if parsed, err = mail.ParseAddress(redirectTo); err != nil {
+			return nil, fmt.Errorf("Invalid mailer.REDIRECT_TO (%s): %v", redirectTo, err)
+		}
+		m.RedirectTo = parsed.Address
+	}
+
+	if len(m.VERPAddress) > 0 && !strings.Contains(m.VERPAddress, "%{token}") {
+		return nil, fmt.Errorf("Invalid mailer.VERP_ADDRESS (%s): must contain %%{token}", m.VERPAddress)
+	}
+
+	m.AllowedDomains = mailDomains(sec.Key("ALLOWED_DOMAINS"))
+	m.BlockedDomains = mailDomains(sec.Key("BLOCKED_DOMAINS"))
+	m.AddressVerification = sec.Key("ADDRESS_VERIFICATION").In("none", []string{"none", "mx", "callout"})
+
+	if m.Headers, err = loadMailHeaders(Cfg.Section("mailer.headers")); err != nil {
+		return nil, err
+	}
+
+	if sec.Name() == "mailer" {
+		if m.Routes, err = loadMailRoutes(); err != nil {
+			return nil, err
+		}
+		if m.Fallbacks, err = loadMailFallbacks(sec.Key("FALLBACKS").Strings(",")); err != nil {
+			return nil, err
+		}
+		m.FallbackAttempts = sec.Key("FALLBACK_ATTEMPTS").MustInt(2)
+		if m.Partitions, err = loadMailPartitions(sec.Key("QUEUE_PARTITIONS").Strings(","), m); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// mailDomains returns the comma separated domains of the key in lower case.
+func mailDomains(key *ini.Key) []string {
+	var domains []string
+	for _, domain := range key.Strings(",") {
+		domains = append(domains, strings.TrimPrefix(strings.ToLower(domain), "."))
+	}
+	return domains
+}
+
+// loadMailRoutes reads the mailer.route.* sections, which inherit the keys
+// of [mailer].
+func loadMailRoutes() ([]*MailRoute, error) {
+	var routes []*MailRoute
+	routeOf := make(map[string]string)
+	for _, sec := range Cfg.Sections() {
+		if !strings.HasPrefix(sec.Name(), "mailer.route.") {
+			continue
+		}
+		name := strings.TrimPrefix(sec.Name(), "mailer.route.")
+		m, err := loadMailService(sec)
+		if err != nil {
+			return nil, err
+		}
+		r := &MailRoute{Name: name, Mailer: m, Domains: mailDomains(sec.Key("DOMAINS"))}
+		for _, category := range sec.Key("CATEGORIES").Strings(",") {
+			category = strings.ToLower(category)
+			if !com.IsSliceContainsStr(mailCategories, category) {
+				return nil, fmt.Errorf("Invalid mailer.route.%s: unknown category %s", name, category)
+			} else if other, ok := routeOf[category]; ok {
+				return nil, fmt.Errorf("Invalid mailer.route.%s: category %s already uses route %s", name, category, other)
+			}
+			routeOf[category] = name
+			r.Categories = append(r.Categories, category)
+		}
+		for _, org := range sec.Key("ORGANIZATIONS").Strings(",") {
+			r.Organizations = append(r.Organizations, strings.ToLower(org))
+		}
+		for _, repo := range sec.Key("REPOSITORIES").Strings(",") {
+			if !strings.Contains(repo, "/") {
+				return nil, fmt.Errorf("Invalid mailer.route.%s: repository %s must be owner/name", name, repo)
+			}
+			r.Repositories = append(r.Repositories, strings.ToLower(repo))
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// loadMailFallbacks reads the mailer.fallback.* sections of the names, which
+// inherit the keys of [mailer].
+func loadMailFallbacks(names []string) ([]*MailFallback, error) {
+	var fallbacks []*MailFallback
+	for _, name := range names {
+		sec, err := Cfg.GetSection("mailer.fallback." + name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mailer.FALLBACKS: section mailer.fallback.%s does not exist", name)
+		}
+		m, err := loadMailService(sec)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, &MailFallback{Name: name, Mailer: m})
+	}
+	return fallbacks, nil
+}
+
+// mailCategories are the categories of mails which can be queued in a
+// partition or sent through a route.
+var mailCategories = []string{"security", "notification", "digest", "broadcast"}
+
+// loadMailPartitions reads the mailer.partition.* sections of the names,
+// which inherit SEND_BUFFER_LEN and SEND_WORKERS of [mailer].
+func loadMailPartitions(names []string, m *Mailer) ([]*MailPartition, error) {
+	if len(names) > 0 && m.QueueType != "channel" && m.QueueType != "persistent" {
+		return nil, fmt.Errorf("Invalid mailer.QUEUE_PARTITIONS: QUEUE_TYPE %s has no partitions", m.QueueType)
+	}
+
+	var partitions []*MailPartition
+	partitionOf := make(map[string]string)
+	for _, name := range names {
+		sec, err := Cfg.GetSection("mailer.partition." + name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mailer.QUEUE_PARTITIONS: section mailer.partition.%s does not exist", name)
+		}
+		p := &MailPartition{
+			Name:        name,
+			QueueLength: sec.Key("SEND_BUFFER_LEN").MustInt(m.QueueLength),
+			Workers:     sec.Key("SEND_WORKERS").MustInt(m.Workers),
+		}
+		if p.QueueLength < 0 || p.Workers < 1 {
+			return nil, fmt.Errorf("Invalid mailer.partition.%s: SEND_BUFFER_LEN must not be negative and SEND_WORKERS positive", name)
+		}
+		for _, category := range sec.Key("CATEGORIES").Strings(",") {
+			category = strings.ToLower(category)
+			if !com.IsSliceContainsStr(mailCategories, category) {
+				return nil, fmt.Errorf("Invalid mailer.partition.%s: unknown category %s", name, category)
+			} else if other, ok := partitionOf[category]; ok {
+				return nil, fmt.Errorf("Invalid mailer.partition.%s: category %s is already queued in partition %s", name, category, other)
+			}
+			partitionOf[category] = name
+			p.Categories = append(p.Categories, category)
+		}
+		if len(p.Categories) == 0 {
+			return nil, fmt.Errorf("Invalid mailer.partition.%s: CATEGORIES must not be empty", name)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+// reservedMailHeaders are the headers set by the mailer, which can not be
+// configured in the mailer.headers section.
+var reservedMailHeaders = map[string]bool{
+	"from":                      true,
+	"sender":                    true,
+	"reply-to":                  true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"subject":                   true,
+	"date":                      true,
+	"message-id":                true,
+	"in-reply-to":               true,
+	"references":                true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"dkim-signature":            true,
+	"return-path":               true,
+}
+
+// loadMailHeaders reads the extra headers of every mail, empty values are
+// skipped.
+func loadMailHeaders(sec *ini.Section) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, key := range sec.Keys() {
+		name := key.Name()
+		if len(name) == 0 || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+			return nil, fmt.Errorf("Invalid mailer.headers name %q", name)
+		} else if reservedMailHeaders[strings.ToLower(name)] {
+			return nil, fmt.Errorf("Invalid mailer.headers name %q: the header is set by the mailer", name)
+		}
+		value := key.String()
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("Invalid mailer.headers value of %s: must be a single line", name)
+		}
+		if len(value) > 0 {
+			headers[name] = value
+		}
+	}
+	return headers, nil
+}
+
+// ReloadMailService reloads the configuration file and returns the new mail
+// settings, which replace MailService once the mailer applied them.
+// Enabling or disabling the mail service and changing the queue requires a
+// restart, the current queue settings are kept.
+func ReloadMailService() (*Mailer, error) {
+	if MailService == nil {
+		return nil, fmt.Errorf("mail service is disabled")
+	}
+	if err := Cfg.Reload(); err != nil {
+		return nil, err
+	}
+
+	m, err := loadMailService(Cfg.Section("mailer"))
+	if err != nil {
+		return nil, err
+	}
+	m.QueueType = MailService.QueueType
+	m.QueuePath = MailService.QueuePath
+	m.QueueLength = MailService.QueueLength
+	m.QueueConnStr = MailService.QueueConnStr
+	m.QueueConsumer = MailService.QueueConsumer
+	m.QueueVisibilityTimeout = MailService.QueueVisibilityTimeout
+	m.OverflowPolicy = MailService.OverflowPolicy
+	m.OverflowTimeout = MailService.OverflowTimeout
+	return m, nil
 }
 
 func newRegisterMailService() {
@@ -1342,6 +2134,47 @@ func newNotifyMailService() {
 	log.Info("Notify Mail Service Enabled")
 }
 
+func newIncomingMailService() {
+	sec := Cfg.Section("incoming_mail")
+	if !sec.Key("ENABLED").MustBool() {
+		return
+	} else if !Service.EnableNotifyMail {
+		log.Warn("Incoming Mail Service: Notify Mail Service is not enabled")
+		return
+	}
+
+	m := &IncomingMailer{
+		Protocol:       sec.Key("PROTOCOL").In("imap", []string{"imap", "pop3", "lmtp", "smtp"}),
+		Host:           sec.Key("HOST").String(),
+		UseTLS:         sec.Key("USE_TLS").MustBool(true),
+		SkipVerify:     sec.Key("SKIP_VERIFY").MustBool(false),
+		User:           sec.Key("USER").String(),
+		Passwd:         sec.Key("PASSWD").String(),
+		Mailbox:        sec.Key("MAILBOX").MustString("INBOX"),
+		DeleteFetched:  sec.Key("DELETE_FETCHED").MustBool(false),
+		ReplyToAddress: sec.Key("REPLY_TO_ADDRESS").String(),
+		MaxSize:        sec.Key("MAX_SIZE").MustInt64(10) << 20,
+	}
+	defaultPort := map[string]map[bool]int{
+		"imap": {false: 143, true: 993},
+		"pop3": {false: 110, true: 995},
+	}
+	if m.Polling() {
+		m.Port = sec.Key("PORT").MustInt(defaultPort[m.Protocol][m.UseTLS])
+	} else {
+		m.ListenAddr = sec.Key("LISTEN_ADDR").MustString("127.0.0.1:2525")
+	}
+
+	if m.Polling() && len(m.Host) == 0 {
+		log.Fatal(4, "Incoming Mail Service: HOST is required")
+	} else if !strings.Contains(m.ReplyToAddress, "%{token}") {
+		log.Fatal(4, "Incoming Mail Service: REPLY_TO_ADDRESS must contain %%{token}")
+	}
+
+	IncomingMail = m
+	log.Info("Incoming Mail Service Enabled")
+}
+
 func newWebhookService() {
 	sec := Cfg.Section("webhook")
 	Webhook.QueueLength = sec.Key("QUEUE_LENGTH").MustInt(1000)
@@ -1361,5 +2194,6 @@ func NewServices() {
 	newMailService()
 	newRegisterMailService()
 	newNotifyMailService()
+	newIncomingMailService()
 	newWebhookService()
 }
@@ -8,20 +8,13 @@ package templates
 
 import (
 	"html/template"
-	"io/ioutil"
 	"path"
-	"strings"
+	texttmpl "text/template"
 
-	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
-	"github.com/Unknwon/com"
 	"gopkg.in/macaron.v1"
 )
 
-var (
-	templates = template.New("")
-)
-
 // Renderer implements the macaron handler for serving the templates.
 func Renderer() macaron.Handler {
 	return macaron.Renderer(macaron.RenderOptions{
@@ -33,71 +26,24 @@ func Renderer() macaron.Handler {
 	})
 }
 
-// Mailer provides the templates required for sending notification mails.
-func Mailer() *template.Template {
-	for _, funcs := range NewFuncMap() {
-		templates.Funcs(funcs)
-	}
-
-	staticDir := path.Join(setting.StaticRootPath, "templates", "mail")
-
-	if com.IsDir(staticDir) {
-		files, err := com.StatDir(staticDir)
-
-		if err != nil {
-			log.Warn("Failed to read %s templates dir. %v", staticDir, err)
-		} else {
-			for _, filePath := range files {
-				if !strings.HasSuffix(filePath, ".tmpl") {
-					continue
-				}
-
-				content, err := ioutil.ReadFile(path.Join(staticDir, filePath))
-
-				if err != nil {
-					log.Warn("Failed to read static %s template. %v", filePath, err)
-					continue
-				}
-
-				templates.New(
-					strings.TrimSuffix(
-						filePath,
-						".tmpl",
-					),
-				).Parse(string(content))
-			}
+// Mailer parses the templates of the mails, the HTML bodies and the text
+// templates of subjects and plain text bodies. Those of the custom
+// directory override the default ones.
+func Mailer() (*template.Template, *texttmpl.Template, error) {
+	t := newMailTemplates()
+	for _, dir := range mailDirs() {
+		if err := t.parseDir(dir); err != nil {
+			return nil, nil, err
 		}
 	}
+	return t.html, t.text, nil
+}
 
-	customDir := path.Join(setting.CustomPath, "templates", "mail")
-
-	if com.IsDir(customDir) {
-		files, err := com.StatDir(customDir)
-
-		if err != nil {
-			log.Warn("Failed to read %s templates dir. %v", customDir, err)
-		} else {
-			for _, filePath := range files {
-				if !strings.HasSuffix(filePath, ".tmpl") {
-					continue
-				}
-
-				content, err := ioutil.ReadFile(path.Join(customDir, filePath))
-
-				if err != nil {
-					log.Warn("Failed to read custom %s template. %v", filePath, err)
-					continue
-				}
-
-				templates.New(
-					strings.TrimSuffix(
-						filePath,
-						".tmpl",
-					),
-				).Parse(string(content))
-			}
-		}
+// mailDirs returns the directories of the mail templates, the custom one
+// last.
+func mailDirs() []string {
+	return []string{
+		path.Join(setting.StaticRootPath, "templates", "mail"),
+		path.Join(setting.CustomPath, "templates", "mail"),
 	}
-
-	return templates
 }
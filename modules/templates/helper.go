@@ -68,6 +68,7 @@ func NewFuncMap() []template.FuncMap {
 		"Safe":         Safe,
 		"Sanitize":     bluemonday.UGCPolicy().Sanitize,
 		"Str2html":     Str2html,
+		"Escape":       template.HTMLEscapeString,
 		"TimeSince":    base.TimeSince,
 		"RawTimeSince": base.RawTimeSince,
 		"FileSize":     base.FileSize,
@@ -0,0 +1,126 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	texttmpl "text/template"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"github.com/Unknwon/com"
+)
+
+// Suffixes of the mail templates which are text templates: the subject and
+// the plain text body of the mail template without the suffix.
+const (
+	mailSubjectSuffix = ".subject"
+	mailTextSuffix    = ".text"
+)
+
+// mailTemplates are the HTML and text templates of the mails while they
+// are parsed.
+type mailTemplates struct {
+	html *template.Template
+	text *texttmpl.Template
+}
+
+func newMailTemplates() *mailTemplates {
+	t := &mailTemplates{
+		html: template.New(""),
+		text: texttmpl.New(""),
+	}
+	for _, funcs := range append(NewFuncMap(), mailFuncMap()) {
+		t.html.Funcs(funcs)
+		t.text.Funcs(texttmpl.FuncMap(funcs))
+	}
+	return t
+}
+
+// parse adds the template file, named by its path below the mail directory
+// without the .tmpl extension. It replaces a template of the same name.
+func (t *mailTemplates) parse(filePath string, content []byte) error {
+	name := strings.TrimSuffix(filepath.ToSlash(filePath), ".tmpl")
+	var err error
+	if strings.HasSuffix(name, mailSubjectSuffix) || strings.HasSuffix(name, mailTextSuffix) {
+		_, err = t.text.New(name).Parse(string(content))
+	} else {
+		_, err = t.html.New(name).Parse(string(content))
+	}
+	if err != nil {
+		return fmt.Errorf("mail template %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// parseDir adds the templates of the directory if it exists.
+func (t *mailTemplates) parseDir(dir string) error {
+	if !com.IsDir(dir) {
+		return nil
+	}
+	files, err := com.StatDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s templates dir: %v", dir, err)
+	}
+	for _, filePath := range files {
+		if !strings.HasSuffix(filePath, ".tmpl") {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, filePath))
+		if err != nil {
+			return fmt.Errorf("failed to read mail template %s: %v", filePath, err)
+		}
+		if err = t.parse(filePath, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchMailer checks the mail templates on disk for changes every interval
+// and passes them to fn once they changed. If they fail to parse or fn
+// rejects them, the error is logged and the previous templates stay in use.
+func WatchMailer(interval time.Duration, fn func(*template.Template, *texttmpl.Template) error) {
+	last := mailDirsState()
+	for range time.Tick(interval) {
+		state := mailDirsState()
+		if state == last {
+			continue
+		}
+		last = state
+
+		html, text, err := Mailer()
+		if err == nil {
+			err = fn(html, text)
+		}
+		if err != nil {
+			log.Error(4, "Failed to reload mail templates: %v", err)
+			continue
+		}
+		log.Info("Mail templates reloaded")
+	}
+}
+
+// mailDirsState describes the files of the mail template directories, it
+// changes when a file is added, removed or modified.
+func mailDirsState() string {
+	var buf bytes.Buffer
+	for _, dir := range mailDirs() {
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				fmt.Fprintf(&buf, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return buf.String()
+}
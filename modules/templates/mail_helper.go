@@ -0,0 +1,173 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/markdown"
+	"code.gitea.io/gitea/modules/setting"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// mailStyles are the inline styles of the elements of mails by name, most
+// mail clients ignore style sheets.
+var mailStyles = map[string]string{
+	"body":       "font-family: -apple-system, 'Segoe UI', Helvetica, Arial, sans-serif; font-size: 14px; line-height: 1.5; color: #24292e;",
+	"footer":     "font-size: 12px; color: #6a737d;",
+	"button":     "display: inline-block; padding: 6px 12px; border-radius: 3px; color: #ffffff; text-decoration: none;",
+	"avatar":     "width: 20px; height: 20px; border: 0; border-radius: 3px; vertical-align: middle;",
+	"blockquote": "margin: 0 0 16px 0; padding: 0 1em; border-left: 4px solid #dfe2e5; color: #6a737d;",
+	"code":       "padding: 0.2em 0.4em; border-radius: 3px; background-color: #f6f8fa; font-family: Consolas, Menlo, monospace; font-size: 85%;",
+	"pre":        "padding: 16px; overflow: auto; border-radius: 3px; background-color: #f6f8fa; font-family: Consolas, Menlo, monospace; font-size: 85%; line-height: 1.45;",
+	"table":      "border-collapse: collapse;",
+	"th":         "padding: 6px 13px; border: 1px solid #dfe2e5; font-weight: bold;",
+	"td":         "padding: 6px 13px; border: 1px solid #dfe2e5;",
+	"img":        "max-width: 100%; border: 0;",
+}
+
+// mailElementStyles are the styles MailHTML gives to the elements of
+// rendered markdown.
+var mailElementStyles = map[atom.Atom]string{
+	atom.Blockquote: "blockquote",
+	atom.Code:       "code",
+	atom.Pre:        "pre",
+	atom.Table:      "table",
+	atom.Th:         "th",
+	atom.Td:         "td",
+	atom.Img:        "img",
+}
+
+// mailFuncMap returns the functions of the mail templates in addition to
+// those of NewFuncMap.
+func mailFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"MailStyle":     MailStyle,
+		"MailAvatar":    MailAvatar,
+		"MailTimeSince": MailTimeSince,
+		"MailHTML":      MailHTML,
+		"MailMarkdown": func(content, urlPrefix string) template.HTML {
+			return MailHTML(markdown.RenderString(content, urlPrefix, nil))
+		},
+	}
+}
+
+// MailStyle returns the inline style of the named elements of mails, e.g.
+// <p style="{{MailStyle "footer"}}">. Unknown names are ignored, buttons
+// have the brand color of the mail theme.
+func MailStyle(names ...string) template.CSS {
+	styles := make([]string, 0, len(names))
+	for _, name := range names {
+		if style, ok := mailStyles[name]; ok {
+			if name == "button" {
+				style += " background-color: " + mailBrandColor() + ";"
+			}
+			styles = append(styles, style)
+		}
+	}
+	return template.CSS(strings.Join(styles, " "))
+}
+
+// mailBrandColor returns the brand color of the mail theme.
+func mailBrandColor() string {
+	if setting.MailService != nil && len(setting.MailService.ThemeBrandColor) > 0 {
+		return setting.MailService.ThemeBrandColor
+	}
+	return "#609926"
+}
+
+// MailAvatar returns the absolute URL of the avatar of a user, given by
+// anything with an AvatarLink method, or of an email address.
+func MailAvatar(v interface{}) string {
+	switch v := v.(type) {
+	case interface {
+		AvatarLink() string
+	}:
+		return absoluteMailURL(v.AvatarLink())
+	case string:
+		return absoluteMailURL(base.AvatarLink(v))
+	}
+	return absoluteMailURL(setting.AppSubURL + "/img/avatar_default.png")
+}
+
+// MailTimeSince returns the time since t in the language, as plain text
+// since mails can not update it.
+func MailTimeSince(t time.Time, lang string) string {
+	return base.RawTimeSince(t, lang)
+}
+
+// MailHTML sanitizes the rendered HTML for mails: links and images become
+// absolute URLs, classes are dropped and the elements get inline styles.
+func MailHTML(raw string) template.HTML {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(markdown.Sanitize(raw)), context)
+	if err != nil {
+		return template.HTML(markdown.Sanitize(raw))
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		styleMailNode(n)
+		if err = html.Render(&buf, n); err != nil {
+			return template.HTML(markdown.Sanitize(raw))
+		}
+	}
+	return template.HTML(buf.String())
+}
+
+// styleMailNode applies MailHTML to the node and its children.
+func styleMailNode(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		styleMailNode(c)
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		switch attr.Key {
+		case "class", "style":
+			continue
+		case "href", "src":
+			attr.Val = absoluteMailURL(attr.Val)
+		}
+		attrs = append(attrs, attr)
+	}
+	n.Attr = attrs
+
+	name, ok := mailElementStyles[n.DataAtom]
+	// Code blocks are styled by their pre element.
+	if n.DataAtom == atom.Code && n.Parent != nil && n.Parent.DataAtom == atom.Pre {
+		ok = false
+	}
+	if ok {
+		n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: mailStyles[name]})
+	}
+}
+
+// absoluteMailURL resolves the link relative to the URL of the instance,
+// links within mails have no base URL.
+func absoluteMailURL(link string) string {
+	if len(link) == 0 || strings.HasPrefix(link, "#") {
+		return link
+	}
+	ref, err := url.Parse(link)
+	if err != nil || ref.IsAbs() {
+		return link
+	}
+	appURL, err := url.Parse(setting.AppURL)
+	if err != nil {
+		return link
+	}
+	return appURL.ResolveReference(ref).String()
+}
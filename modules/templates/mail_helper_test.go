@@ -0,0 +1,55 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package templates
+
+import (
+	"html/template"
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailStyle(t *testing.T) {
+	assert.Equal(t, template.CSS(mailStyles["footer"]), MailStyle("footer"))
+	assert.Equal(t, template.CSS(mailStyles["code"]+" "+mailStyles["img"]), MailStyle("code", "unknown", "img"))
+	assert.Equal(t, template.CSS(""), MailStyle())
+
+	setting.MailService = &setting.Mailer{ThemeBrandColor: "#ff0000"}
+	defer func() { setting.MailService = nil }()
+	assert.Equal(t, template.CSS(mailStyles["button"]+" background-color: #ff0000;"), MailStyle("button"))
+}
+
+type testAvatarUser struct{}
+
+func (testAvatarUser) AvatarLink() string { return "/sub/avatars/1" }
+
+func TestMailAvatar(t *testing.T) {
+	setting.AppURL = "https://try.gitea.io/sub/"
+	setting.AppSubURL = "/sub"
+	setting.DisableGravatar = true
+	setting.EnableFederatedAvatar = false
+
+	assert.Equal(t, "https://try.gitea.io/sub/avatars/1", MailAvatar(testAvatarUser{}))
+	assert.Equal(t, "https://try.gitea.io/sub/img/avatar_default.png", MailAvatar("user2@example.com"))
+	assert.Equal(t, "https://try.gitea.io/sub/img/avatar_default.png", MailAvatar(nil))
+}
+
+func TestMailHTML(t *testing.T) {
+	setting.AppURL = "https://try.gitea.io/"
+
+	assert.Equal(t,
+		`<p><a href="https://try.gitea.io/user2/repo1/issues/1" rel="nofollow">#1</a> <code style="`+mailStyles["code"]+`">x</code></p>`,
+		string(MailHTML(`<p class="x"><a href="/user2/repo1/issues/1">#1</a> <code>x</code></p>`)))
+	assert.Equal(t,
+		`<pre style="`+mailStyles["pre"]+`"><code>go build</code></pre>`,
+		string(MailHTML(`<pre><code class="language-sh">go build</code></pre>`)))
+	assert.Equal(t,
+		`<img src="https://try.gitea.io/attachments/1" style="`+mailStyles["img"]+`"/>`,
+		string(MailHTML(`<img src="attachments/1" style="width: 9999px">`)))
+	assert.Equal(t, `<a href="#top" rel="nofollow">top</a>`, string(MailHTML(`<a href="#top" onclick="x()">top</a>`)))
+	assert.Equal(t, "", string(MailHTML(`<script>alert(1)</script>`)))
+}
@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 	"path"
 	"strings"
+	texttmpl "text/template"
 
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
@@ -21,10 +22,6 @@ import (
 	"gopkg.in/macaron.v1"
 )
 
-var (
-	templates = template.New("")
-)
-
 type templateFileSystem struct {
 	files []macaron.TemplateFile
 }
@@ -116,68 +113,35 @@ func Renderer() macaron.Handler {
 	})
 }
 
-// Mailer provides the templates required for sending notification mails.
-func Mailer() *template.Template {
-	for _, funcs := range NewFuncMap() {
-		templates.Funcs(funcs)
-	}
-
+// Mailer parses the templates of the mails, the HTML bodies and the text
+// templates of subjects and plain text bodies. Those of the custom
+// directory override the embedded ones.
+func Mailer() (*template.Template, *texttmpl.Template, error) {
+	t := newMailTemplates()
 	for _, assetPath := range AssetNames() {
-		if !strings.HasPrefix(assetPath, "mail/") {
-			continue
-		}
-
-		if !strings.HasSuffix(assetPath, ".tmpl") {
+		if !strings.HasPrefix(assetPath, "mail/") || !strings.HasSuffix(assetPath, ".tmpl") {
 			continue
 		}
 
 		content, err := Asset(assetPath)
-
 		if err != nil {
-			log.Warn("Failed to read embedded %s template. %v", assetPath, err)
-			continue
+			return nil, nil, fmt.Errorf("failed to read embedded %s template: %v", assetPath, err)
+		}
+		if err = t.parse(strings.TrimPrefix(assetPath, "mail/"), content); err != nil {
+			return nil, nil, err
 		}
-
-		templates.New(
-			strings.TrimPrefix(
-				strings.TrimSuffix(
-					assetPath,
-					".tmpl",
-				),
-				"mail/",
-			),
-		).Parse(string(content))
 	}
 
-	customDir := path.Join(setting.CustomPath, "templates", "mail")
-
-	if com.IsDir(customDir) {
-		files, err := com.StatDir(customDir)
-
-		if err != nil {
-			log.Warn("Failed to read %s templates dir. %v", customDir, err)
-		} else {
-			for _, filePath := range files {
-				if !strings.HasSuffix(filePath, ".tmpl") {
-					continue
-				}
-
-				content, err := ioutil.ReadFile(path.Join(customDir, filePath))
-
-				if err != nil {
-					log.Warn("Failed to read custom %s template. %v", filePath, err)
-					continue
-				}
-
-				templates.New(
-					strings.TrimSuffix(
-						filePath,
-						".tmpl",
-					),
-				).Parse(string(content))
-			}
+	for _, dir := range mailDirs() {
+		if err := t.parseDir(dir); err != nil {
+			return nil, nil, err
 		}
 	}
+	return t.html, t.text, nil
+}
 
-	return templates
+// mailDirs returns the directories of the mail templates on disk, only
+// the custom one as the default templates are embedded.
+func mailDirs() []string {
+	return []string{path.Join(setting.CustomPath, "templates", "mail")}
 }
@@ -21,12 +21,18 @@ const (
 var (
 	// GitRefNamePattern is regular expression wirh unallowed characters in git reference name
 	GitRefNamePattern = regexp.MustCompile("[^\\d\\w-_\\./]")
+
+	// InternationalizedEmailPattern is the email pattern of binding which
+	// allows letters and digits of all scripts in the local part and the
+	// domain (RFC 6531)
+	InternationalizedEmailPattern = regexp.MustCompile("[\\pL\\pN_!#$%&'*+/=?^`{|}~-]+(?:\\.[\\pL\\pN_!#$%&'*+/=?^`{|}~-]+)*@(?:[\\pL\\pN_](?:[\\pL\\pN_-]*[\\pL\\pN_])?\\.)+[\\pL\\pN](?:[\\pL\\pN_-]*[\\pL\\pN_])?")
 )
 
 // AddBindingRules adds additional binding rules
 func AddBindingRules() {
 	addGitRefNameBindingRule()
 	addValidURLBindingRule()
+	binding.EmailPattern = InternationalizedEmailPattern
 }
 
 func addGitRefNameBindingRule() {
@@ -35,6 +35,7 @@ type (
 	TestForm struct {
 		BranchName string `form:"BranchName" binding:"GitRefName"`
 		URL        string `form:"ValidUrl" binding:"ValidUrl"`
+		Email      string `form:"Email" binding:"OmitEmpty;Email"`
 	}
 )
 
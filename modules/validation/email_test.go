@@ -0,0 +1,58 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package validation
+
+import (
+	"testing"
+
+	"github.com/go-macaron/binding"
+)
+
+var emailValidationTestCases = []validationTestCase{
+	{
+		description: "ASCII email",
+		data: TestForm{
+			Email: "user@example.com",
+		},
+		expectedErrors: binding.Errors{},
+	},
+	{
+		description: "Internationalized domain",
+		data: TestForm{
+			Email: "user@bücher.example",
+		},
+		expectedErrors: binding.Errors{},
+	},
+	{
+		description: "Internationalized local part",
+		data: TestForm{
+			Email: "用户@例子.广告",
+		},
+		expectedErrors: binding.Errors{},
+	},
+	{
+		description: "Missing domain",
+		data: TestForm{
+			Email: "jürgen@",
+		},
+		expectedErrors: binding.Errors{
+			binding.Error{
+				FieldNames:     []string{"Email"},
+				Classification: binding.ERR_EMAIL,
+				Message:        "Email",
+			},
+		},
+	},
+}
+
+func Test_EmailValidation(t *testing.T) {
+	AddBindingRules()
+
+	for _, testCase := range emailValidationTestCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			performValidationTest(t, testCase)
+		})
+	}
+}
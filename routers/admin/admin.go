@@ -17,6 +17,7 @@ import (
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/cron"
+	"code.gitea.io/gitea/modules/mailer"
 	"code.gitea.io/gitea/modules/process"
 	"code.gitea.io/gitea/modules/setting"
 )
@@ -25,6 +26,7 @@ const (
 	tplDashboard base.TplName = "admin/dashboard"
 	tplConfig    base.TplName = "admin/config"
 	tplMonitor   base.TplName = "admin/monitor"
+	tplMailTest  base.TplName = "admin/mail_test"
 )
 
 var (
@@ -173,6 +175,7 @@ func Dashboard(ctx *context.Context) {
 	}
 
 	ctx.Data["Stats"] = models.GetStatistic()
+	ctx.Data["MailAlert"] = mailer.GetAlert()
 	// FIXME: update periodically
 	updateSystemStatus()
 	ctx.Data["SysStatus"] = sysStatus
@@ -181,15 +184,21 @@ func Dashboard(ctx *context.Context) {
 
 // SendTestMail send test mail to confirm mail service is OK
 func SendTestMail(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.config.send_test_mail")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminConfig"] = true
+
 	email := ctx.Query("email")
-	// Send a test email to the user's email address and redirect back to Config
-	if err := models.SendTestMail(email); err != nil {
-		ctx.Flash.Error(ctx.Tr("admin.config.test_mail_failed", email, err))
+	// Send a test email to the given email address and show the reply of the mail server
+	transcript, err := models.SendTestMail(email)
+	if err != nil {
+		ctx.Flash.Error(ctx.Tr("admin.config.test_mail_failed", email, err), true)
 	} else {
-		ctx.Flash.Info(ctx.Tr("admin.config.test_mail_sent", email))
+		ctx.Flash.Info(ctx.Tr("admin.config.test_mail_sent", email), true)
 	}
+	ctx.Data["Transcript"] = transcript
 
-	ctx.Redirect(setting.AppSubURL + "/admin/config")
+	ctx.HTML(200, tplMailTest)
 }
 
 // Config show admin config page
@@ -0,0 +1,316 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"net/url"
+
+	"github.com/Unknwon/com"
+	"github.com/Unknwon/paginater"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/auth"
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+const (
+	tplMail             base.TplName = "admin/mail"
+	tplMailDeliveries   base.TplName = "admin/mail_deliveries"
+	tplMailSuppressions base.TplName = "admin/mail_suppressions"
+	tplMailAnnounce     base.TplName = "admin/mail_announce"
+	tplMailPreview      base.TplName = "admin/mail_preview"
+)
+
+// Mail shows the mail queue and its dead letters
+func Mail(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+
+	if setting.MailService == nil {
+		ctx.Data["PendingMails"] = []*mailer.PendingMessage{}
+		ctx.Data["DeadLetters"] = []*mailer.DeadLetter{}
+		ctx.HTML(200, tplMail)
+		return
+	}
+
+	pending, err := mailer.PendingMessages()
+	if err != nil {
+		ctx.Handle(500, "PendingMessages", err)
+		return
+	}
+	ctx.Data["PendingMails"] = pending
+
+	deadLetters, err := mailer.DeadLetters()
+	if err != nil {
+		ctx.Handle(500, "DeadLetters", err)
+		return
+	}
+	ctx.Data["DeadLetters"] = deadLetters
+
+	ctx.HTML(200, tplMail)
+}
+
+// MailDeliveries shows the logged delivery attempts
+func MailDeliveries(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.deliveries")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+
+	keyword := ctx.Query("q")
+	total := models.CountMailDeliveries(keyword)
+	page := ctx.QueryInt("page")
+	if page <= 1 {
+		page = 1
+	}
+	ctx.Data["Page"] = paginater.New(int(total), setting.UI.Admin.NoticePagingNum, page, 5)
+
+	deliveries, err := models.MailDeliveries(keyword, page, setting.UI.Admin.NoticePagingNum)
+	if err != nil {
+		ctx.Handle(500, "MailDeliveries", err)
+		return
+	}
+	ctx.Data["Deliveries"] = deliveries
+
+	ctx.Data["Keyword"] = keyword
+	ctx.Data["Total"] = total
+	ctx.Data["DeliveryLog"] = setting.MailService != nil && setting.MailService.DeliveryLog
+	ctx.HTML(200, tplMailDeliveries)
+}
+
+// MailSuppressions shows the addresses which bounced permanently
+func MailSuppressions(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.suppressions")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+
+	keyword := ctx.Query("q")
+	total := models.CountMailBounces(keyword)
+	page := ctx.QueryInt("page")
+	if page <= 1 {
+		page = 1
+	}
+	ctx.Data["Page"] = paginater.New(int(total), setting.UI.Admin.NoticePagingNum, page, 5)
+
+	bounces, err := models.MailBounces(keyword, page, setting.UI.Admin.NoticePagingNum)
+	if err != nil {
+		ctx.Handle(500, "MailBounces", err)
+		return
+	}
+	ctx.Data["Bounces"] = bounces
+
+	ctx.Data["Keyword"] = keyword
+	ctx.Data["Total"] = total
+	ctx.HTML(200, tplMailSuppressions)
+}
+
+// DeleteMailSuppression clears the bounces of an address, so mails are sent to it again
+func DeleteMailSuppression(ctx *context.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := models.DeleteMailBounce(id); err != nil {
+		ctx.Handle(500, "DeleteMailBounce", err)
+		return
+	}
+
+	log.Trace("Mail suppression cleared by admin (%s): %d", ctx.User.Name, id)
+	ctx.Flash.Success(ctx.Tr("admin.mail.suppression_cleared"))
+	ctx.Redirect(setting.AppSubURL + "/admin/mail/suppressions")
+}
+
+// SendPendingMail sends a queued mail next
+func SendPendingMail(ctx *context.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := mailer.ExpeditePendingMessage(id); err != nil {
+		ctx.Flash.Error(ctx.Tr("admin.mail.queue_failed", err))
+	} else {
+		log.Trace("Queued mail expedited by admin (%s): %d", ctx.User.Name, id)
+		ctx.Flash.Success(ctx.Tr("admin.mail.queued_expedited"))
+	}
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// DeletePendingMail removes a mail from the queue
+func DeletePendingMail(ctx *context.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := mailer.DeletePendingMessage(id); err != nil {
+		ctx.Flash.Error(ctx.Tr("admin.mail.queue_failed", err))
+	} else {
+		log.Trace("Queued mail deleted by admin (%s): %d", ctx.User.Name, id)
+		ctx.Flash.Success(ctx.Tr("admin.mail.queued_deleted"))
+	}
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// RequeueDeadLetter moves a dead letter back into the mail queue
+func RequeueDeadLetter(ctx *context.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := mailer.RequeueDeadLetter(id); err != nil {
+		ctx.Flash.Error(ctx.Tr("admin.mail.dead_letter_failed", err))
+	} else {
+		log.Trace("Dead letter requeued by admin (%s): %d", ctx.User.Name, id)
+		ctx.Flash.Success(ctx.Tr("admin.mail.dead_letter_requeued"))
+	}
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// DeleteDeadLetter deletes a dead letter
+func DeleteDeadLetter(ctx *context.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := mailer.DeleteDeadLetter(id); err != nil {
+		ctx.Flash.Error(ctx.Tr("admin.mail.dead_letter_failed", err))
+	} else {
+		log.Trace("Dead letter deleted by admin (%s): %d", ctx.User.Name, id)
+		ctx.Flash.Success(ctx.Tr("admin.mail.dead_letter_deleted"))
+	}
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// PurgeDeadLetters deletes all dead letters
+func PurgeDeadLetters(ctx *context.Context) {
+	if err := mailer.PurgeDeadLetters(); err != nil {
+		ctx.Handle(500, "PurgeDeadLetters", err)
+		return
+	}
+
+	log.Trace("Dead letters purged by admin (%s)", ctx.User.Name)
+	ctx.Flash.Success(ctx.Tr("admin.mail.dead_letter_deleted"))
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// MailAnnounce shows the form to send an announcement mail
+func MailAnnounce(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.announce")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+	ctx.Data["CanSendEmail"] = setting.MailService != nil
+	ctx.Data["audience"] = "all"
+	ctx.HTML(200, tplMailAnnounce)
+}
+
+// MailAnnouncePost sends an announcement mail to all users, the members of an
+// organization or the watchers of a repository
+func MailAnnouncePost(ctx *context.Context, form auth.AdminAnnouncementForm) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.announce")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+	ctx.Data["CanSendEmail"] = setting.MailService != nil
+
+	if ctx.HasError() {
+		ctx.HTML(200, tplMailAnnounce)
+		return
+	}
+	if setting.MailService == nil {
+		ctx.RenderWithErr(ctx.Tr("admin.mail.announce_disabled"), tplMailAnnounce, &form)
+		return
+	}
+
+	a := &models.Announcement{
+		Subject: form.Subject,
+		Content: form.Content,
+		Bcc:     form.Bcc,
+	}
+	var err error
+	switch form.Audience {
+	case "org":
+		if a.Org, err = models.GetOrgByName(form.Organization); err != nil {
+			if err == models.ErrOrgNotExist {
+				ctx.Data["Err_Organization"] = true
+				ctx.RenderWithErr(ctx.Tr("admin.mail.announce_org_not_exist"), tplMailAnnounce, &form)
+			} else {
+				ctx.Handle(500, "GetOrgByName", err)
+			}
+			return
+		}
+	case "repo":
+		if a.Repo, err = models.GetRepositoryByRef(form.Repository); err != nil {
+			if err == models.ErrInvalidReference || models.IsErrUserNotExist(err) || models.IsErrRepoNotExist(err) {
+				ctx.Data["Err_Repository"] = true
+				ctx.RenderWithErr(ctx.Tr("admin.mail.announce_repo_not_exist"), tplMailAnnounce, &form)
+			} else {
+				ctx.Handle(500, "GetRepositoryByRef", err)
+			}
+			return
+		}
+	}
+
+	count, err := models.SendAnnouncementMail(a)
+	if err != nil {
+		ctx.Handle(500, "SendAnnouncementMail", err)
+		return
+	}
+
+	log.Trace("Announcement sent by admin (%s) to %d users: %s", ctx.User.Name, count, form.Subject)
+	ctx.Flash.Success(ctx.Tr("admin.mail.announce_sent", count))
+	ctx.Redirect(setting.AppSubURL + "/admin/mail")
+}
+
+// previewMail renders the mail template and language of the request for the
+// signed in admin, it returns nil if the page has been rendered or handled.
+func previewMail(ctx *context.Context) *models.MailPreview {
+	names := models.MailTemplateNames()
+	name := ctx.Query("template")
+	if len(name) == 0 {
+		name = names[0]
+	} else if !com.IsSliceContainsStr(names, name) {
+		ctx.Handle(404, "MailPreview", nil)
+		return nil
+	}
+	lang := ctx.Query("lang")
+	if !com.IsSliceContainsStr(setting.Langs, lang) {
+		lang = ctx.Locale.Language()
+	}
+	ctx.Data["MailTemplates"] = names
+	ctx.Data["template"] = name
+	ctx.Data["lang"] = lang
+
+	if setting.MailService == nil {
+		ctx.Flash.Error(ctx.Tr("admin.mail.announce_disabled"), true)
+		ctx.HTML(200, tplMailPreview)
+		return nil
+	}
+	preview, err := models.PreviewMail(name, lang, ctx.User)
+	if err != nil {
+		// Errors of customized templates are shown to be fixed.
+		ctx.Flash.Error(ctx.Tr("admin.mail.preview_failed", err), true)
+		ctx.HTML(200, tplMailPreview)
+		return nil
+	}
+	return preview
+}
+
+// MailPreview shows a mail template rendered with sample data
+func MailPreview(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.preview")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+
+	preview := previewMail(ctx)
+	if preview == nil {
+		return
+	}
+	ctx.Data["Preview"] = preview
+	ctx.HTML(200, tplMailPreview)
+}
+
+// MailPreviewPost sends the preview of a mail template to the signed in admin
+func MailPreviewPost(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.mail.preview")
+	ctx.Data["PageIsAdmin"] = true
+	ctx.Data["PageIsAdminMail"] = true
+
+	preview := previewMail(ctx)
+	if preview == nil {
+		return
+	}
+	preview.Send()
+
+	log.Trace("Mail preview of %s sent to admin (%s)", preview.Name, ctx.User.Name)
+	ctx.Flash.Success(ctx.Tr("admin.mail.preview_sent", ctx.User.Email))
+	ctx.Redirect(setting.AppSubURL + "/admin/mail/preview?template=" + url.QueryEscape(preview.Name) + "&lang=" + url.QueryEscape(ctx.Data["lang"].(string)))
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+)
+
+func handleMailError(ctx *context.APIContext, title string, err error) {
+	if mailer.IsErrDeadLetterNotExist(err) || mailer.IsErrPendingMessageNotExist(err) {
+		ctx.Status(404)
+	} else if err == mailer.ErrMailServiceDisabled || mailer.IsErrInvalidWorkers(err) {
+		ctx.Error(422, "", err)
+	} else {
+		ctx.Error(500, title, err)
+	}
+}
+
+// ListPendingMails api for listing the emails waiting in the mail queue
+func ListPendingMails(ctx *context.APIContext) {
+	pending, err := mailer.PendingMessages()
+	if err != nil {
+		handleMailError(ctx, "PendingMessages", err)
+		return
+	}
+	ctx.JSON(200, pending)
+}
+
+// DeletePendingMail api for removing an email from the mail queue
+func DeletePendingMail(ctx *context.APIContext) {
+	if err := mailer.DeletePendingMessage(ctx.ParamsInt64(":id")); err != nil {
+		handleMailError(ctx, "DeletePendingMessage", err)
+		return
+	}
+	log.Trace("Queued mail deleted by admin(%s): %d", ctx.User.Name, ctx.ParamsInt64(":id"))
+
+	ctx.Status(204)
+}
+
+// SendPendingMail api for sending an email of the mail queue immediately
+func SendPendingMail(ctx *context.APIContext) {
+	if err := mailer.ExpeditePendingMessage(ctx.ParamsInt64(":id")); err != nil {
+		handleMailError(ctx, "ExpeditePendingMessage", err)
+		return
+	}
+	log.Trace("Queued mail expedited by admin(%s): %d", ctx.User.Name, ctx.ParamsInt64(":id"))
+
+	ctx.Status(204)
+}
+
+// ListDeadLetters api for listing the emails which could not be delivered
+func ListDeadLetters(ctx *context.APIContext) {
+	deadLetters, err := mailer.DeadLetters()
+	if err != nil {
+		handleMailError(ctx, "DeadLetters", err)
+		return
+	}
+	ctx.JSON(200, deadLetters)
+}
+
+// RequeueDeadLetter api for moving an undeliverable email back into the mail queue
+func RequeueDeadLetter(ctx *context.APIContext) {
+	if err := mailer.RequeueDeadLetter(ctx.ParamsInt64(":id")); err != nil {
+		handleMailError(ctx, "RequeueDeadLetter", err)
+		return
+	}
+	log.Trace("Dead letter requeued by admin(%s): %d", ctx.User.Name, ctx.ParamsInt64(":id"))
+
+	ctx.Status(204)
+}
+
+// DeleteDeadLetter api for deleting an undeliverable email
+func DeleteDeadLetter(ctx *context.APIContext) {
+	if err := mailer.DeleteDeadLetter(ctx.ParamsInt64(":id")); err != nil {
+		handleMailError(ctx, "DeleteDeadLetter", err)
+		return
+	}
+	log.Trace("Dead letter deleted by admin(%s): %d", ctx.User.Name, ctx.ParamsInt64(":id"))
+
+	ctx.Status(204)
+}
+
+// PurgeDeadLetters api for deleting all undeliverable emails
+func PurgeDeadLetters(ctx *context.APIContext) {
+	if err := mailer.PurgeDeadLetters(); err != nil {
+		handleMailError(ctx, "PurgeDeadLetters", err)
+		return
+	}
+	log.Trace("Dead letters purged by admin(%s)", ctx.User.Name)
+
+	ctx.Status(204)
+}
+
+// EditMailWorkersOption options for changing the number of mail workers
+type EditMailWorkersOption struct {
+	// Number of workers, or the lower bound if MaxWorkers is larger
+	MinWorkers int `json:"min_workers" binding:"Required"`
+	// Upper bound of workers added while many emails are queued, 0 keeps the number fixed
+	MaxWorkers int `json:"max_workers"`
+}
+
+// GetMailWorkers api for getting the number of mail worker routines
+func GetMailWorkers(ctx *context.APIContext) {
+	workers, err := mailer.GetWorkers()
+	if err != nil {
+		handleMailError(ctx, "GetWorkers", err)
+		return
+	}
+	ctx.JSON(200, workers)
+}
+
+// EditMailWorkers api for changing the number of mail worker routines
+func EditMailWorkers(ctx *context.APIContext, form EditMailWorkersOption) {
+	if err := mailer.SetWorkers(form.MinWorkers, form.MaxWorkers); err != nil {
+		handleMailError(ctx, "SetWorkers", err)
+		return
+	}
+	log.Trace("Mail workers changed by admin(%s): %d-%d", ctx.User.Name, form.MinWorkers, form.MaxWorkers)
+
+	GetMailWorkers(ctx)
+}
+
+// ReloadMailService api for applying the changed mail settings of the configuration file
+func ReloadMailService(ctx *context.APIContext) {
+	if err := mailer.Reconfigure(); err != nil {
+		handleMailError(ctx, "Reconfigure", err)
+		return
+	}
+	log.Trace("Mail service reconfigured by admin(%s)", ctx.User.Name)
+
+	ctx.Status(204)
+}
+
+// SendTestMailOption options for sending a test email
+type SendTestMailOption struct {
+	To string `json:"to" binding:"Required;Email"`
+}
+
+// TestMailResult is the outcome of sending a test email
+type TestMailResult struct {
+	Sent bool `json:"sent"`
+	// Error returned by the mail server or service, empty if sent
+	Error string `json:"error"`
+	// Dialogue with the SMTP server, or the progress for other mail types
+	Transcript string `json:"transcript"`
+}
+
+// SendTestMail api for sending a test email through the configured mail service
+func SendTestMail(ctx *context.APIContext, form SendTestMailOption) {
+	transcript, err := models.SendTestMail(form.To)
+	if err == mailer.ErrMailServiceDisabled {
+		handleMailError(ctx, "SendTestMail", err)
+		return
+	}
+	log.Trace("Test email requested by admin(%s): %s", ctx.User.Name, form.To)
+
+	result := &TestMailResult{
+		Sent:       err == nil,
+		Transcript: transcript,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	ctx.JSON(200, result)
+}
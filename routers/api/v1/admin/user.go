@@ -151,6 +151,21 @@ func DeleteUser(ctx *context.APIContext) {
 	ctx.Status(204)
 }
 
+// ListUserMailAudits api for listing the security emails sent to a user
+func ListUserMailAudits(ctx *context.APIContext) {
+	u := user.GetUserByParams(ctx)
+	if ctx.Written() {
+		return
+	}
+
+	audits, err := models.GetMailAudits(u.ID)
+	if err != nil {
+		ctx.Error(500, "GetMailAudits", err)
+		return
+	}
+	ctx.JSON(200, audits)
+}
+
 // CreatePublicKey api for creating a public key to a user
 // see https://github.com/gogits/go-gogs-client/wiki/Administration-Users#create-a-public-key-for-user
 func CreatePublicKey(ctx *context.APIContext, form api.CreateKeyOption) {
@@ -261,6 +261,7 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Get("/version", misc.Version)
 		m.Post("/markdown", bind(api.MarkdownOption{}), misc.Markdown)
 		m.Post("/markdown/raw", misc.MarkdownRaw)
+		m.Post("/mail/events/:provider", misc.MailEvents)
 
 		// Users
 		m.Group("/users", func() {
@@ -506,8 +507,22 @@ func RegisterRoutes(m *macaron.Macaron) {
 					m.Post("/keys", bind(api.CreateKeyOption{}), admin.CreatePublicKey)
 					m.Post("/orgs", bind(api.CreateOrgOption{}), admin.CreateOrg)
 					m.Post("/repos", bind(api.CreateRepoOption{}), admin.CreateRepo)
+					m.Get("/mail_audit", admin.ListUserMailAudits)
 				})
 			})
+			m.Group("/mail", func() {
+				m.Get("/queue", admin.ListPendingMails)
+				m.Delete("/queue/:id", admin.DeletePendingMail)
+				m.Post("/queue/:id/send", admin.SendPendingMail)
+				m.Combo("/dead_letters").Get(admin.ListDeadLetters).
+					Delete(admin.PurgeDeadLetters)
+				m.Delete("/dead_letters/:id", admin.DeleteDeadLetter)
+				m.Post("/dead_letters/:id/requeue", admin.RequeueDeadLetter)
+				m.Combo("/workers").Get(admin.GetMailWorkers).
+					Patch(bind(admin.EditMailWorkersOption{}), admin.EditMailWorkers)
+				m.Post("/reload", admin.ReloadMailService)
+				m.Post("/test", bind(admin.SendTestMailOption{}), admin.SendTestMail)
+			})
 		}, reqAdmin())
 	}, context.APIContexter())
 }
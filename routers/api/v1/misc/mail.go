@@ -0,0 +1,71 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package misc
+
+import (
+	"io"
+	"io/ioutil"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// maxEventWebhookSize limits the body of a delivery event notification.
+const maxEventWebhookSize = 1 << 20
+
+// MailEvents records the delivery events posted by the webhook of a mail service
+func MailEvents(ctx *context.APIContext) {
+	// swagger:route POST /mail/events/{provider} recordMailEvents
+	//
+	//     Consumes:
+	//     - application/json
+	//
+	//     Responses:
+	//       204: empty
+	//       403: forbidden
+	//       404: notFound
+	//       422: validationError
+	//       500: error
+
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Req.Request.Body, maxEventWebhookSize))
+	if err != nil {
+		ctx.Error(422, "", err)
+		return
+	}
+
+	provider := ctx.Params(":provider")
+	events, err := mailer.ParseWebhookEvents(provider, ctx.Req.Request, body)
+	switch {
+	case err == mailer.ErrWebhookDisabled:
+		ctx.Status(404)
+		return
+	case err == mailer.ErrWebhookSignature:
+		ctx.Error(403, "", err)
+		return
+	case err != nil:
+		ctx.Error(422, "", err)
+		return
+	}
+
+	for _, event := range events {
+		if setting.MailService.DeliveryLog {
+			if err = models.RecordMailDelivery(event.Delivery(provider)); err != nil {
+				ctx.Error(500, "RecordMailDelivery", err)
+				return
+			}
+		}
+		if bounce := event.Bounce(); bounce != nil {
+			if err = models.RecordMailBounce(bounce); err != nil {
+				ctx.Error(500, "RecordMailBounce", err)
+				return
+			}
+		}
+		log.Trace("Mail delivery event recorded: %s %s [provider: %s]", event.Email, event.Status, provider)
+	}
+	ctx.Status(204)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routers
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/models"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// healthCheck is the outcome of the check of a subsystem.
+type healthCheck struct {
+	Status mailer.HealthStatus `json:"status"`
+	Output string              `json:"output,omitempty"`
+}
+
+// mailHealthCheck is the outcome of the check of the mail delivery.
+type mailHealthCheck struct {
+	healthCheck
+	Circuit       mailer.CircuitState `json:"circuit,omitempty"`
+	QueueLength   int                 `json:"queue_length"`
+	QueueCapacity int                 `json:"queue_capacity,omitempty"`
+	LastSent      *time.Time          `json:"last_sent,omitempty"`
+}
+
+// healthResponse is the body of the health check, its status is the worst
+// of the checks.
+type healthResponse struct {
+	Status mailer.HealthStatus    `json:"status"`
+	Checks map[string]interface{} `json:"checks"`
+}
+
+// isHealthCheckAuthorized reports whether the request passes the
+// HEALTH_CHECK_TOKEN, if any.
+func isHealthCheckAuthorized(ctx *context.Context) bool {
+	if len(setting.HealthCheckToken) == 0 {
+		return true
+	}
+	token := ctx.Query("token")
+	if auth := strings.Fields(ctx.Req.Header.Get("Authorization")); len(auth) == 2 && strings.EqualFold(auth[0], "token") {
+		token = auth[1]
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(setting.HealthCheckToken)) == 1
+}
+
+// HealthCheck reports the health of the database and the mail delivery, with
+// status 503 if one of them fails, for load balancers and monitoring. The
+// errors are only logged, the response does not reveal them.
+func HealthCheck(ctx *context.Context) {
+	if !setting.EnableHealthCheck {
+		ctx.Error(404)
+		return
+	}
+	if !isHealthCheckAuthorized(ctx) {
+		ctx.Error(401)
+		return
+	}
+
+	resp := &healthResponse{
+		Status: mailer.HealthPass,
+		Checks: make(map[string]interface{}),
+	}
+	report := func(name string, status mailer.HealthStatus, check interface{}) {
+		resp.Checks[name] = check
+		if status == mailer.HealthFail || status == mailer.HealthWarn && resp.Status == mailer.HealthPass {
+			resp.Status = status
+		}
+	}
+
+	db := &healthCheck{Status: mailer.HealthPass}
+	if err := models.Ping(); err != nil {
+		log.Error(4, "HealthCheck: Ping: %v", err)
+		db.Status, db.Output = mailer.HealthFail, "database unavailable"
+	}
+	report("database", db.Status, db)
+
+	if setting.MailService != nil {
+		check := &mailHealthCheck{healthCheck: healthCheck{Status: mailer.HealthPass}}
+		if h, err := mailer.GetHealth(); err != nil {
+			log.Error(4, "HealthCheck: GetHealth: %v", err)
+			check.Status, check.Output = mailer.HealthFail, "mail service unavailable"
+		} else {
+			check.Status, check.Output = h.Status, h.Reason
+			check.Circuit = h.Circuit
+			check.QueueLength, check.QueueCapacity = h.QueueLength, h.QueueCapacity
+			if !h.LastSent.IsZero() {
+				check.LastSent = &h.LastSent
+			}
+		}
+		report("mail", check.Status, check)
+	}
+
+	status := 200
+	if resp.Status == mailer.HealthFail {
+		status = 503
+	}
+	ctx.Resp.Header().Set("Cache-Control", "no-store")
+	ctx.JSON(status, resp)
+}
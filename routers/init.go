@@ -15,6 +15,7 @@ import (
 	"code.gitea.io/gitea/modules/indexer"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/mailer/incoming"
 	"code.gitea.io/gitea/modules/markdown"
 	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/ssh"
@@ -55,6 +56,15 @@ func GlobalInit() {
 		}
 		models.HasEngine = true
 		models.InitOAuth2()
+		if setting.MailService != nil && setting.MailService.DeliveryLog {
+			mailer.SetDeliveryRecorder(models.RecordMailDelivery)
+		}
+		mailer.SetPreferenceResolver(models.ResolveMailPreference)
+		mailer.SetTrackingResolver(models.ResolveMailTracking)
+		mailer.SetSuppressionChecker(models.IsMailSuppressed)
+		mailer.SetAttachmentUploader(models.NewMailAttachment)
+		mailer.SetCircuitListener(models.NoticeMailCircuit)
+		mailer.RegisterHook(models.MailAuditHook{})
 
 		models.LoadRepoConfig()
 		models.NewRepoContext()
@@ -79,4 +89,9 @@ func GlobalInit() {
 		ssh.Listen(setting.SSH.ListenHost, setting.SSH.ListenPort)
 		log.Info("SSH server started on %s:%v", setting.SSH.ListenHost, setting.SSH.ListenPort)
 	}
+
+	if setting.InstallLock && setting.IncomingMail != nil && !setting.IncomingMail.Polling() {
+		incoming.Listen(setting.IncomingMail.ListenAddr)
+		log.Info("Incoming mail %s server started on %s", strings.ToUpper(setting.IncomingMail.Protocol), setting.IncomingMail.ListenAddr)
+	}
 }
@@ -0,0 +1,41 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routers
+
+import (
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/mailer"
+)
+
+// trackingPixel is a transparent GIF of 1x1 pixels.
+var trackingPixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// MailOpen counts the opening of a mail and serves its tracking pixel
+func MailOpen(ctx *context.Context) {
+	if err := mailer.TrackOpen(ctx.Params(":token")); err != nil {
+		ctx.Handle(404, "TrackOpen", err)
+		return
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "image/gif")
+	ctx.Resp.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	ctx.Resp.Write(trackingPixel)
+}
+
+// MailClick counts the click of a link in a mail and redirects to its target
+func MailClick(ctx *context.Context) {
+	target, err := mailer.TrackClick(ctx.Params(":token"))
+	if err != nil {
+		ctx.Handle(404, "TrackClick", err)
+		return
+	}
+
+	ctx.Resp.Header().Set("Cache-Control", "no-store")
+	ctx.Redirect(target)
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package routers
+
+import (
+	"crypto/subtle"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// Metrics serves the metrics in the Prometheus text format
+func Metrics(ctx *context.Context) {
+	if len(setting.Metrics.Token) > 0 {
+		token := ctx.Req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+setting.Metrics.Token)) != 1 {
+			ctx.Error(401)
+			return
+		}
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := mailer.WriteMetrics(ctx.Resp); err != nil {
+		log.Error(4, "Failed to write metrics: %v", err)
+	}
+}
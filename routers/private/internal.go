@@ -43,5 +43,8 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Post("/ssh/:id/update", UpdatePublicKey)
 		m.Post("/push/update", PushUpdate)
 		m.Get("/branch/:id/*", GetProtectedBranchBy)
+		m.Get("/mail/queue", MailQueue)
+		m.Post("/mail/flush", FlushMailQueue)
+		m.Post("/mail/dead/:id/retry", RetryDeadLetter)
 	}, CheckInternalToken)
 }
@@ -0,0 +1,81 @@
+// Copyright 2017 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package private
+
+import (
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
+
+	macaron "gopkg.in/macaron.v1"
+)
+
+// MailQueue lists the queued mails and the dead letters
+func MailQueue(ctx *macaron.Context) {
+	pending, err := mailer.PendingMessages()
+	if err != nil {
+		ctx.JSON(500, map[string]interface{}{
+			"err": err.Error(),
+		})
+		return
+	}
+	deadLetters, err := mailer.DeadLetters()
+	if err != nil {
+		ctx.JSON(500, map[string]interface{}{
+			"err": err.Error(),
+		})
+		return
+	}
+
+	ctx.JSON(200, map[string]interface{}{
+		"pending":      pending,
+		"dead_letters": deadLetters,
+	})
+}
+
+// FlushMailQueue sends all queued mails next, and requeues the dead letters
+// if asked to
+func FlushMailQueue(ctx *macaron.Context) {
+	flushed, err := mailer.FlushQueue()
+	if err != nil {
+		ctx.JSON(500, map[string]interface{}{
+			"err": err.Error(),
+		})
+		return
+	}
+
+	requeued := 0
+	if ctx.QueryBool("dead_letters") {
+		if requeued, err = mailer.RequeueDeadLetters(); err != nil {
+			ctx.JSON(500, map[string]interface{}{
+				"err": err.Error(),
+			})
+			return
+		}
+	}
+	log.Trace("Mail queue flushed: %d mails expedited, %d dead letters requeued", flushed, requeued)
+
+	ctx.JSON(200, map[string]interface{}{
+		"flushed":  flushed,
+		"requeued": requeued,
+	})
+}
+
+// RetryDeadLetter moves a dead letter back into the mail queue
+func RetryDeadLetter(ctx *macaron.Context) {
+	id := ctx.ParamsInt64(":id")
+	if err := mailer.RequeueDeadLetter(id); err != nil {
+		status := 500
+		if mailer.IsErrDeadLetterNotExist(err) {
+			status = 404
+		}
+		ctx.JSON(status, map[string]interface{}{
+			"err": err.Error(),
+		})
+		return
+	}
+	log.Trace("Dead letter requeued: %d", id)
+
+	ctx.PlainText(200, []byte("success"))
+}
@@ -7,6 +7,7 @@ package repo
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 
 	"code.gitea.io/gitea/models"
@@ -70,3 +71,42 @@ func UploadAttachment(ctx *context.Context) {
 		"uuid": attach.UUID,
 	})
 }
+
+// GetMailAttachment serves an attachment linked in a mail which exceeded the
+// maximum size of the mailer to the recipients of the mail.
+func GetMailAttachment(ctx *context.Context) {
+	attach, err := models.GetMailAttachmentByUUID(ctx.Params(":uuid"))
+	if err != nil {
+		if models.IsErrAttachmentNotExist(err) {
+			ctx.Error(404)
+		} else {
+			ctx.Handle(500, "GetMailAttachmentByUUID", err)
+		}
+		return
+	}
+	if attach.IsExpired() {
+		ctx.Error(404)
+		return
+	}
+	if !ctx.User.IsAdmin {
+		isRecipient, err := attach.IsRecipient(ctx.User)
+		if err != nil {
+			ctx.Handle(500, "IsRecipient", err)
+			return
+		} else if !isRecipient {
+			ctx.Error(404)
+			return
+		}
+	}
+
+	fr, err := os.Open(attach.LocalPath())
+	if err != nil {
+		ctx.Handle(500, "Open", err)
+		return
+	}
+	defer fr.Close()
+
+	if err = ServeData(ctx, attach.Name, fr); err != nil {
+		ctx.Handle(500, "ServeData", err)
+	}
+}
@@ -736,6 +736,30 @@ func UpdateIssueContent(ctx *context.Context) {
 	})
 }
 
+// UpdateIssueDeadline sets or removes the deadline of the issue
+func UpdateIssueDeadline(ctx *context.Context) {
+	issue := getActionIssue(ctx)
+	if ctx.Written() {
+		return
+	}
+
+	var deadline time.Time
+	if form := ctx.QueryTrim("deadline"); len(form) > 0 {
+		var err error
+		if deadline, err = time.ParseInLocation("2006-01-02", form, time.Local); err != nil {
+			ctx.Flash.Error(ctx.Tr("repo.issues.deadline_invalid"))
+			ctx.Redirect(fmt.Sprintf("%s/issues/%d", ctx.Repo.RepoLink, issue.Index))
+			return
+		}
+	}
+
+	if err := issue.ChangeDeadline(ctx.User, deadline); err != nil {
+		ctx.Handle(500, "ChangeDeadline", err)
+		return
+	}
+	ctx.Redirect(fmt.Sprintf("%s/issues/%d", ctx.Repo.RepoLink, issue.Index))
+}
+
 // UpdateIssueMilestone change issue's milestone
 func UpdateIssueMilestone(ctx *context.Context) {
 	issues := getActionIssues(ctx)
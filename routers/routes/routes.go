@@ -72,7 +72,16 @@ func NewMacaron() *macaron.Macaron {
 	))
 
 	m.Use(templates.Renderer())
-	models.InitMailRender(templates.Mailer())
+	mailHTML, mailText, err := templates.Mailer()
+	if err != nil {
+		log.Fatal(4, "Failed to parse mail templates: %v", err)
+	}
+	if err = models.InitMailRender(mailHTML, mailText); err != nil {
+		log.Fatal(4, "Invalid mail templates: %v", err)
+	}
+	if setting.MailService != nil && setting.MailService.TemplateReloadInterval > 0 {
+		go templates.WatchMailer(setting.MailService.TemplateReloadInterval, models.InitMailRender)
+	}
 
 	localeNames, err := options.Dir("locale")
 
@@ -147,6 +156,12 @@ func RegisterRoutes(m *macaron.Macaron) {
 	})
 	m.Get("/", ignSignIn, routers.Home)
 	m.Get("/swagger", ignSignIn, routers.Swagger)
+	if setting.Metrics.Enabled {
+		m.Get("/metrics", routers.Metrics)
+	}
+	m.Get("/api/healthz", routers.HealthCheck)
+	m.Get("/mail/open/:token", routers.MailOpen)
+	m.Get("/mail/click/:token", routers.MailClick)
 	m.Group("/explore", func() {
 		m.Get("", func(ctx *context.Context) {
 			ctx.Redirect(setting.AppSubURL + "/explore/repos")
@@ -204,6 +219,8 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Combo("/email").Get(user.SettingsEmails).
 			Post(bindIgnErr(auth.AddEmailForm{}), user.SettingsEmailPost)
 		m.Post("/email/delete", user.DeleteEmail)
+		m.Combo("/notifications").Get(user.SettingsNotifications).
+			Post(bindIgnErr(auth.UpdateNotificationsForm{}), user.SettingsNotificationsPost)
 		m.Get("/password", user.SettingsPassword)
 		m.Post("/password", bindIgnErr(auth.ChangePasswordForm{}), user.SettingsPasswordPost)
 		if setting.Service.EnableOpenIDSignIn {
@@ -218,6 +235,7 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Combo("/keys").Get(user.SettingsKeys).
 			Post(bindIgnErr(auth.AddKeyForm{}), user.SettingsKeysPost)
 		m.Post("/keys/delete", user.DeleteKey)
+		m.Post("/keys/encrypt_mail", bindIgnErr(auth.EncryptNotifyMailForm{}), user.SettingsKeysEncryptMail)
 		m.Combo("/applications").Get(user.SettingsApplications).
 			Post(bindIgnErr(auth.NewAccessTokenForm{}), user.SettingsApplicationsPost)
 		m.Post("/applications/delete", user.SettingsDeleteApplication)
@@ -242,6 +260,10 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Get("/email2user", user.Email2User)
 		m.Get("/forgot_password", user.ForgotPasswd)
 		m.Post("/forgot_password", user.ForgotPasswdPost)
+		m.Get("/unsubscribe/:token", user.Unsubscribe)
+		m.Post("/unsubscribe/:token", ignSignInAndCsrf, user.UnsubscribePost)
+		m.Get("/mail_action/:token", user.MailAction)
+		m.Post("/mail_action/:token", ignSignInAndCsrf, user.MailActionPost)
 		m.Get("/logout", user.SignOut)
 	})
 	// ***** END: User *****
@@ -255,6 +277,20 @@ func RegisterRoutes(m *macaron.Macaron) {
 		m.Post("/config/test_mail", admin.SendTestMail)
 		m.Get("/monitor", admin.Monitor)
 
+		m.Group("/mail", func() {
+			m.Get("", admin.Mail)
+			m.Get("/deliveries", admin.MailDeliveries)
+			m.Get("/suppressions", admin.MailSuppressions)
+			m.Post("/suppressions/:id/delete", admin.DeleteMailSuppression)
+			m.Combo("/announce").Get(admin.MailAnnounce).Post(bindIgnErr(auth.AdminAnnouncementForm{}), admin.MailAnnouncePost)
+			m.Combo("/preview").Get(admin.MailPreview).Post(admin.MailPreviewPost)
+			m.Post("/queue/:id/send", admin.SendPendingMail)
+			m.Post("/queue/:id/delete", admin.DeletePendingMail)
+			m.Post("/dead_letters/purge", admin.PurgeDeadLetters)
+			m.Post("/dead_letters/:id/requeue", admin.RequeueDeadLetter)
+			m.Post("/dead_letters/:id/delete", admin.DeleteDeadLetter)
+		})
+
 		m.Group("/users", func() {
 			m.Get("", admin.Users)
 			m.Combo("/new").Get(admin.NewUser).Post(bindIgnErr(auth.AdminCreateUserForm{}), admin.NewUserPost)
@@ -324,6 +360,7 @@ func RegisterRoutes(m *macaron.Macaron) {
 		})
 		m.Post("/attachments", repo.UploadAttachment)
 	}, ignSignIn)
+	m.Get("/attachments/mail/:uuid", reqSignIn, repo.GetMailAttachment)
 
 	m.Group("/:username", func() {
 		m.Get("/action/:action", user.Action)
@@ -466,6 +503,7 @@ func RegisterRoutes(m *macaron.Macaron) {
 				m.Post("/title", repo.UpdateIssueTitle)
 				m.Post("/content", repo.UpdateIssueContent)
 				m.Post("/watch", repo.IssueWatch)
+				m.Post("/deadline", reqRepoWriter, repo.UpdateIssueDeadline)
 				m.Combo("/comments").Post(bindIgnErr(auth.CreateCommentForm{}), repo.NewComment)
 			})
 
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"code.gitea.io/gitea/models"
 	"code.gitea.io/gitea/modules/auth"
@@ -17,6 +18,7 @@ import (
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
 	"code.gitea.io/gitea/modules/setting"
 
 	"github.com/go-macaron/captcha"
@@ -35,8 +37,14 @@ const (
 	tplTwofa          base.TplName = "user/auth/twofa"
 	tplTwofaScratch   base.TplName = "user/auth/twofa_scratch"
 	tplLinkAccount    base.TplName = "user/auth/link_account"
+	tplUnsubscribe    base.TplName = "user/auth/unsubscribe"
+	tplMailAction     base.TplName = "user/auth/mail_action"
 )
 
+// mailResultTimeout is how long a request waits for a mail to be sent,
+// to tell the user if it failed.
+const mailResultTimeout = 3 * time.Second
+
 // AutoSignIn reads cookie and try to auto-login.
 func AutoSignIn(ctx *context.Context) (bool, error) {
 	if !models.HasEngine {
@@ -626,6 +634,12 @@ func LinkAccountPostRegister(ctx *context.Context, cpt *captcha.Captcha, form au
 		return
 	}
 
+	if err := mailer.VerifyAddress(form.Email, ctx.RemoteAddr()); err != nil {
+		ctx.Data["Err_Email"] = true
+		ctx.RenderWithErr(ctx.Tr("form.email_undeliverable"), tplLinkAccount, &form)
+		return
+	}
+
 	loginSource, err := models.GetActiveOAuth2LoginSourceByName(gothUser.(goth.User).Provider)
 	if err != nil {
 		ctx.Handle(500, "CreateUser", err)
@@ -639,6 +653,7 @@ func LinkAccountPostRegister(ctx *context.Context, cpt *captcha.Captcha, form au
 		LoginType:   models.LoginOAuth2,
 		LoginSource: loginSource.ID,
 		LoginName:   gothUser.(goth.User).UserID,
+		Language:    ctx.Locale.Language(),
 	}
 
 	if err := models.CreateUser(u); err != nil {
@@ -750,11 +765,18 @@ func SignUpPost(ctx *context.Context, cpt *captcha.Captcha, form auth.RegisterFo
 		return
 	}
 
+	if err := mailer.VerifyAddress(form.Email, ctx.RemoteAddr()); err != nil {
+		ctx.Data["Err_Email"] = true
+		ctx.RenderWithErr(ctx.Tr("form.email_undeliverable"), tplSignUp, &form)
+		return
+	}
+
 	u := &models.User{
 		Name:     form.UserName,
 		Email:    form.Email,
 		Passwd:   form.Password,
 		IsActive: !setting.Service.RegisterEmailConfirm,
+		Language: ctx.Locale.Language(),
 	}
 	if err := models.CreateUser(u); err != nil {
 		switch {
@@ -935,7 +957,22 @@ func ForgotPasswdPost(ctx *context.Context) {
 		return
 	}
 
-	models.SendResetPasswordMail(ctx.Context, u)
+	result := make(chan error, 1)
+	models.SendResetPasswordMail(ctx.Context, u, func(err error) {
+		result <- err
+	})
+	select {
+	case err = <-result:
+	case <-time.After(mailResultTimeout):
+		// Still queued or retried, the mail will most likely arrive.
+		err = nil
+	}
+	if err != nil {
+		log.Error(4, "SendResetPasswordMail: %v", err)
+		ctx.RenderWithErr(ctx.Tr("auth.reset_password_mail_failed"), tplForgotPassword, nil)
+		return
+	}
+
 	if err = ctx.Cache.Put("MailResendLimit_"+u.LowerName, u.LowerName, 180); err != nil {
 		log.Error(4, "Set cache(MailResendLimit) fail: %v", err)
 	}
@@ -1004,3 +1041,120 @@ func ResetPasswdPost(ctx *context.Context) {
 	ctx.Data["IsResetFailed"] = true
 	ctx.HTML(200, tplResetPassword)
 }
+
+// unsubscribeToken verifies the unsubscribe token of the request and sets the
+// data to render the page, it returns false if the page is rendered already.
+func unsubscribeToken(ctx *context.Context) (*models.User, int64, bool) {
+	ctx.Data["Title"] = ctx.Tr("auth.unsubscribe")
+
+	u, issueID, err := models.VerifyUnsubscribeToken(ctx.Params(":token"))
+	if err != nil {
+		if !models.IsErrUnsubscribeTokenInvalid(err) {
+			ctx.Handle(500, "VerifyUnsubscribeToken", err)
+			return nil, 0, false
+		}
+		ctx.Data["IsUnsubscribeInvalid"] = true
+		ctx.HTML(200, tplUnsubscribe)
+		return nil, 0, false
+	}
+
+	if issueID > 0 {
+		issue, err := models.GetIssueByID(issueID)
+		if err != nil {
+			if !models.IsErrIssueNotExist(err) {
+				ctx.Handle(500, "GetIssueByID", err)
+				return nil, 0, false
+			}
+			ctx.Data["IsUnsubscribeInvalid"] = true
+			ctx.HTML(200, tplUnsubscribe)
+			return nil, 0, false
+		}
+		ctx.Data["Issue"] = issue
+	}
+	return u, issueID, true
+}
+
+// Unsubscribe render the page to confirm muting notification mails
+func Unsubscribe(ctx *context.Context) {
+	if _, _, ok := unsubscribeToken(ctx); !ok {
+		return
+	}
+	ctx.HTML(200, tplUnsubscribe)
+}
+
+// UnsubscribePost response for muting notification mails, it is also
+// requested by mail clients for one-click unsubscription.
+func UnsubscribePost(ctx *context.Context) {
+	u, issueID, ok := unsubscribeToken(ctx)
+	if !ok {
+		return
+	}
+
+	if err := models.UnsubscribeNotifyMail(u, issueID); err != nil {
+		ctx.Handle(500, "UnsubscribeNotifyMail", err)
+		return
+	}
+
+	log.Trace("User unsubscribed from notification mails [issue_id: %d]: %s", issueID, u.Name)
+	ctx.Data["IsUnsubscribed"] = true
+	ctx.HTML(200, tplUnsubscribe)
+}
+
+// mailActionToken verifies the token of the mail action of the request and
+// sets the data to render the page, it returns false if the page is rendered
+// already.
+func mailActionToken(ctx *context.Context) (*models.User, *mailer.DeepLink, bool) {
+	ctx.Data["Title"] = ctx.Tr("auth.mail_action")
+
+	u, link, err := models.VerifyMailActionToken(ctx.Params(":token"))
+	if err != nil {
+		if !models.IsErrMailActionTokenInvalid(err) {
+			ctx.Handle(500, "VerifyMailActionToken", err)
+			return nil, nil, false
+		}
+		ctx.Data["IsInvalid"] = true
+		ctx.Data["IsExpired"] = err.(models.ErrMailActionTokenInvalid).Expired
+		ctx.HTML(200, tplMailAction)
+		return nil, nil, false
+	}
+
+	issue, err := models.GetIssueByID(link.TargetID)
+	if err != nil {
+		if !models.IsErrIssueNotExist(err) {
+			ctx.Handle(500, "GetIssueByID", err)
+			return nil, nil, false
+		}
+		ctx.Data["IsInvalid"] = true
+		ctx.HTML(200, tplMailAction)
+		return nil, nil, false
+	}
+	ctx.Data["Issue"] = issue
+	return u, link, true
+}
+
+// MailAction render the page to confirm the action of a link in a mail. Mail
+// providers request the links of mails to scan them, so actions are only
+// performed by the post of the page.
+func MailAction(ctx *context.Context) {
+	if _, _, ok := mailActionToken(ctx); !ok {
+		return
+	}
+	ctx.HTML(200, tplMailAction)
+}
+
+// MailActionPost response for performing the action of a link in a mail
+func MailActionPost(ctx *context.Context) {
+	u, link, ok := mailActionToken(ctx)
+	if !ok {
+		return
+	}
+
+	if err := models.PerformMailAction(u, link); err != nil {
+		ctx.Handle(500, "PerformMailAction", err)
+		return
+	}
+
+	log.Trace("User performed mail action %s [target_id: %d]: %s", link.Action, link.TargetID, u.Name)
+	ctx.Data["IsDone"] = true
+	ctx.HTML(200, tplMailAction)
+}
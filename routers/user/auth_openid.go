@@ -14,6 +14,7 @@ import (
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
 	"code.gitea.io/gitea/modules/setting"
 
 	"github.com/go-macaron/captcha"
@@ -361,12 +362,19 @@ func RegisterOpenIDPost(ctx *context.Context, cpt *captcha.Captcha, form auth.Si
 		return
 	}
 
+	if err := mailer.VerifyAddress(form.Email, ctx.RemoteAddr()); err != nil {
+		ctx.Data["Err_Email"] = true
+		ctx.RenderWithErr(ctx.Tr("form.email_undeliverable"), tplSignUpOID, &form)
+		return
+	}
+
 	// TODO: abstract a finalizeSignUp function ?
 	u := &models.User{
 		Name:     form.UserName,
 		Email:    form.Email,
 		Passwd:   password,
 		IsActive: !setting.Service.RegisterEmailConfirm,
+		Language: ctx.Locale.Language(),
 	}
 	if err := models.CreateUser(u); err != nil {
 		switch {
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/Unknwon/com"
 	"github.com/pquerna/otp"
@@ -24,23 +25,25 @@ import (
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/mailer"
 	"code.gitea.io/gitea/modules/setting"
 )
 
 const (
-	tplSettingsProfile      base.TplName = "user/settings/profile"
-	tplSettingsAvatar       base.TplName = "user/settings/avatar"
-	tplSettingsPassword     base.TplName = "user/settings/password"
-	tplSettingsEmails       base.TplName = "user/settings/email"
-	tplSettingsKeys         base.TplName = "user/settings/keys"
-	tplSettingsSocial       base.TplName = "user/settings/social"
-	tplSettingsApplications base.TplName = "user/settings/applications"
-	tplSettingsTwofa        base.TplName = "user/settings/twofa"
-	tplSettingsTwofaEnroll  base.TplName = "user/settings/twofa_enroll"
-	tplSettingsAccountLink  base.TplName = "user/settings/account_link"
-	tplSettingsOrganization base.TplName = "user/settings/organization"
-	tplSettingsDelete       base.TplName = "user/settings/delete"
-	tplSecurity             base.TplName = "user/security"
+	tplSettingsProfile       base.TplName = "user/settings/profile"
+	tplSettingsAvatar        base.TplName = "user/settings/avatar"
+	tplSettingsPassword      base.TplName = "user/settings/password"
+	tplSettingsEmails        base.TplName = "user/settings/email"
+	tplSettingsNotifications base.TplName = "user/settings/notifications"
+	tplSettingsKeys          base.TplName = "user/settings/keys"
+	tplSettingsSocial        base.TplName = "user/settings/social"
+	tplSettingsApplications  base.TplName = "user/settings/applications"
+	tplSettingsTwofa         base.TplName = "user/settings/twofa"
+	tplSettingsTwofaEnroll   base.TplName = "user/settings/twofa_enroll"
+	tplSettingsAccountLink   base.TplName = "user/settings/account_link"
+	tplSettingsOrganization  base.TplName = "user/settings/organization"
+	tplSettingsDelete        base.TplName = "user/settings/delete"
+	tplSecurity              base.TplName = "user/security"
 )
 
 // Settings render user's profile page
@@ -277,6 +280,11 @@ func SettingsEmailPost(ctx *context.Context, form auth.AddEmailForm) {
 		return
 	}
 
+	if err := mailer.VerifyAddress(form.Email, ctx.RemoteAddr()); err != nil {
+		ctx.RenderWithErr(ctx.Tr("form.email_undeliverable"), tplSettingsEmails, &form)
+		return
+	}
+
 	email := &models.EmailAddress{
 		UID:         ctx.User.ID,
 		Email:       form.Email,
@@ -293,12 +301,15 @@ func SettingsEmailPost(ctx *context.Context, form auth.AddEmailForm) {
 
 	// Send confirmation email
 	if setting.Service.RegisterEmailConfirm {
-		models.SendActivateEmailMail(ctx.Context, ctx.User, email)
-
-		if err := ctx.Cache.Put("MailResendLimit_"+ctx.User.LowerName, ctx.User.LowerName, 180); err != nil {
-			log.Error(4, "Set cache(MailResendLimit) fail: %v", err)
+		if err := models.SendActivateEmailMail(ctx.Context, ctx.User, email); err != nil {
+			log.Error(4, "SendActivateEmailMail: %v", err)
+			ctx.Flash.Error(ctx.Tr("settings.add_email_confirmation_failed", email.Email))
+		} else {
+			if err := ctx.Cache.Put("MailResendLimit_"+ctx.User.LowerName, ctx.User.LowerName, 180); err != nil {
+				log.Error(4, "Set cache(MailResendLimit) fail: %v", err)
+			}
+			ctx.Flash.Info(ctx.Tr("settings.add_email_confirmation_sent", email.Email, base.MinutesToFriendly(setting.Service.ActiveCodeLives)))
 		}
-		ctx.Flash.Info(ctx.Tr("settings.add_email_confirmation_sent", email.Email, base.MinutesToFriendly(setting.Service.ActiveCodeLives)))
 	} else {
 		ctx.Flash.Success(ctx.Tr("settings.add_email_success"))
 	}
@@ -424,6 +435,111 @@ func SettingsKeysPost(ctx *context.Context, form auth.AddKeyForm) {
 
 }
 
+// SettingsKeysEncryptMail response for changing encryption of user's notification mails
+func SettingsKeysEncryptMail(ctx *context.Context, form auth.EncryptNotifyMailForm) {
+	if form.EncryptNotifyMail {
+		has, err := models.HasEncryptionGPGKey(ctx.User.ID)
+		if err != nil {
+			ctx.Handle(500, "HasEncryptionGPGKey", err)
+			return
+		} else if !has {
+			ctx.Flash.Error(ctx.Tr("settings.encrypt_notify_mail_no_key"))
+			ctx.Redirect(setting.AppSubURL + "/user/settings/keys")
+			return
+		}
+	}
+
+	ctx.User.EncryptNotifyMail = form.EncryptNotifyMail
+	if err := models.UpdateUser(ctx.User); err != nil {
+		ctx.Handle(500, "UpdateUser", err)
+		return
+	}
+
+	ctx.Flash.Success(ctx.Tr("settings.encrypt_notify_mail_success"))
+	ctx.Redirect(setting.AppSubURL + "/user/settings/keys")
+}
+
+// quietHours are the hours quiet hours can start and end at.
+var quietHours = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}
+
+// mailTracking reports whether the opening of mails or the clicks of their
+// links are tracked, which users can opt out of.
+func mailTracking() bool {
+	return setting.MailService != nil && (setting.MailService.TrackOpens || setting.MailService.TrackClicks)
+}
+
+// SettingsNotifications render user's notification mail settings page
+func SettingsNotifications(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("settings")
+	ctx.Data["PageIsSettingsNotifications"] = true
+	ctx.Data["QuietHours"] = quietHours
+	ctx.Data["MailTracking"] = mailTracking()
+	ctx.HTML(200, tplSettingsNotifications)
+}
+
+// SettingsNotificationsPost response for changing user's notification mail settings
+func SettingsNotificationsPost(ctx *context.Context, form auth.UpdateNotificationsForm) {
+	ctx.Data["Title"] = ctx.Tr("settings")
+	ctx.Data["PageIsSettingsNotifications"] = true
+	ctx.Data["QuietHours"] = quietHours
+	ctx.Data["MailTracking"] = mailTracking()
+
+	if ctx.HasError() {
+		ctx.HTML(200, tplSettingsNotifications)
+		return
+	}
+
+	switch form.NotifyMailEvents {
+	case models.NotifyMailAll, models.NotifyMailAssigned, models.NotifyMailMentions, models.NotifyMailNone:
+	default:
+		ctx.Flash.Error(ctx.Tr("settings.notify_mail_events_invalid"))
+		ctx.Redirect(setting.AppSubURL + "/user/settings/notifications")
+		return
+	}
+
+	switch form.NotifyMailDigest {
+	case models.MailDigestOff, models.MailDigestHourly, models.MailDigestDaily:
+	default:
+		ctx.Flash.Error(ctx.Tr("settings.notify_mail_digest_invalid"))
+		ctx.Redirect(setting.AppSubURL + "/user/settings/notifications")
+		return
+	}
+
+	form.Timezone = strings.TrimSpace(form.Timezone)
+	if len(form.Timezone) > 0 {
+		if _, err := time.LoadLocation(form.Timezone); err != nil {
+			ctx.Data["Err_Timezone"] = true
+			ctx.RenderWithErr(ctx.Tr("settings.timezone_invalid", form.Timezone), tplSettingsNotifications, &form)
+			return
+		}
+	}
+
+	if len(form.Language) > 0 && !com.IsSliceContainsStr(setting.Langs, form.Language) {
+		ctx.Flash.Error(ctx.Tr("settings.mail_language_invalid", form.Language))
+		ctx.Redirect(setting.AppSubURL + "/user/settings/notifications")
+		return
+	}
+
+	ctx.User.NotifyMailEvents = form.NotifyMailEvents
+	ctx.User.NotifyMailDigest = form.NotifyMailDigest
+	ctx.User.QuietHoursStart = form.QuietHoursStart
+	ctx.User.QuietHoursEnd = form.QuietHoursEnd
+	ctx.User.Timezone = form.Timezone
+	ctx.User.Language = form.Language
+	// The option is only shown while the tracking is enabled.
+	if mailTracking() {
+		ctx.User.DisableMailTracking = form.DisableMailTracking
+	}
+	if err := models.UpdateUser(ctx.User); err != nil {
+		ctx.Handle(500, "UpdateUser", err)
+		return
+	}
+
+	log.Trace("User notification settings updated: %s", ctx.User.Name)
+	ctx.Flash.Success(ctx.Tr("settings.update_notifications_success"))
+	ctx.Redirect(setting.AppSubURL + "/user/settings/notifications")
+}
+
 // DeleteKey response for delete user's SSH/GPG key
 func DeleteKey(ctx *context.Context) {
 